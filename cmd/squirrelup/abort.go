@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+type (
+	// backupState tracks progress of a running backup.
+	backupState struct {
+		lock      sync.Mutex
+		name      string
+		stage     string
+		objectUri *url.URL
+		tempFiles []string
+		snapshot  *common.Snapshot
+		uploaded  atomic.Int64
+		reporter  common.ProgressReporter
+		keys      *auxiliaryKeys
+		// name the aborted marker is stored under, the backup name if empty
+		markerName string
+		// releases the lease on the prefix, if set
+		release func()
+	}
+
+	// abortedMarker describes how far an interrupted backup got.
+	abortedMarker struct {
+		Name          string    `json:"name"`
+		Stage         string    `json:"stage"`
+		Signal        string    `json:"signal"`
+		Time          time.Time `json:"time"`
+		BytesUploaded int64     `json:"bytes_uploaded"`
+		Object        string    `json:"object,omitempty"`
+		UploadId      string    `json:"upload_id,omitempty"`
+		// name the marker is stored under, without abortedMarkerSuffix
+		objectName string
+	}
+)
+
+const (
+	// abortedMarkerSuffix is appended to the backup name to form the name of the aborted marker.
+	abortedMarkerSuffix = common.AbortedMarkerSuffix
+
+	// abortedMarkerDeadline limits the time spent uploading the aborted marker on shutdown.
+	abortedMarkerDeadline = 2 * time.Second
+
+	stageInitializing = "initializing"
+	stageArchiving    = common.StageArchiving
+	stageEncrypting   = common.StageEncrypting
+	stageUploading    = common.StageUploading
+	stageCleanup      = common.StageCleanup
+)
+
+var (
+	// exitfunc terminates the process after the aborted marker was handled, can be overridden in tests.
+	exitfunc func(int) = os.Exit
+)
+
+// setStage records the current stage of the backup.
+func (state *backupState) setStage(stage string) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.stage = stage
+}
+
+// setObject records URI of the object being uploaded.
+func (state *backupState) setObject(uri *url.URL) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.objectUri = uri
+}
+
+// addTempFile records the path of a temporary file created for the backup.
+func (state *backupState) addTempFile(path string) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.tempFiles = append(state.tempFiles, path)
+}
+
+// removeTempFiles removes the temporary files created for the backup that still exist.
+func (state *backupState) removeTempFiles() {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	for _, path := range state.tempFiles {
+		_ = os.Remove(path)
+	}
+	state.tempFiles = nil
+}
+
+// setSnapshot records the snapshot the backup is read from.
+func (state *backupState) setSnapshot(snapshot *common.Snapshot) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.snapshot = snapshot
+}
+
+// removeSnapshot removes the snapshot the backup is read from, if any. Failures are reported
+// to `stderr`.
+func (state *backupState) removeSnapshot(stderr io.Writer) {
+	state.lock.Lock()
+	snapshot := state.snapshot
+	state.snapshot = nil
+	state.lock.Unlock()
+
+	if snapshot == nil {
+		return
+	}
+	if err := snapshot.Remove(context.Background()); err != nil {
+		fmt.Fprintf(stderr, "warning: %s\n", err.Error())
+	}
+}
+
+// setMarkerName records the name the aborted marker is stored under, like the obfuscated
+// backup name, so that the object key does not reveal the backup name.
+func (state *backupState) setMarkerName(name string) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.markerName = name
+}
+
+// marker returns the aborted marker describing the current state.
+func (state *backupState) marker(backend common.StorageBackend, sig os.Signal) abortedMarker {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+
+	marker := abortedMarker{
+		Name:          state.name,
+		Stage:         state.stage,
+		Signal:        sig.String(),
+		Time:          common.Now().UTC(),
+		BytesUploaded: state.uploaded.Load(),
+		objectName:    state.name,
+	}
+	if len(state.markerName) > 0 {
+		marker.objectName = state.markerName
+	}
+	if state.objectUri != nil {
+		marker.Object = state.objectUri.String()
+		if reporter, ok := common.AsBackend[common.PendingUploadReporter](backend); ok {
+			marker.UploadId, _ = reporter.PendingUploadId(state.objectUri)
+		}
+	}
+	return marker
+}
+
+// uploadAbortedMarker stores the aborted marker under the output prefix. Gives up after `deadline`.
+func uploadAbortedMarker(backend common.StorageBackend, outputPrefixUri *url.URL, marker abortedMarker, keys *auxiliaryKeys, deadline time.Duration) error {
+	uri := common.ResolveObjectURI(outputPrefixUri, marker.objectName+abortedMarkerSuffix)
+	data, err := json.Marshal(&marker)
+	if err == nil {
+		data, err = keys.seal(data)
+	}
+	if err != nil {
+		return fmt.Errorf("could not encode marker: %s", err.Error())
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- backend.StoreFile(context.Background(), common.StoreRequest{URI: uri, BodyAt: bytes.NewReader(data), Length: int64(len(data)), Quiet: true})
+	}()
+	select {
+	case err = <-result:
+		if err != nil {
+			return fmt.Errorf("could not upload marker: %s", err.Error())
+		}
+		return nil
+	case <-time.After(deadline):
+		return fmt.Errorf("could not upload marker: deadline of %s exceeded", deadline)
+	}
+}
+
+// watchSignals uploads an aborted marker, releases the lease and terminates the process on
+// SIGTERM or SIGINT.
+// A backup finishing within `grace` after the signal is not interrupted.
+// The returned function stops watching.
+func watchSignals(backend common.StorageBackend, outputPrefixUri *url.URL, state *backupState, grace time.Duration, stderr io.Writer) func() {
+	signals := make(chan os.Signal, 1)
+	done := make(chan bool)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	go func() {
+		select {
+		case sig := <-signals:
+			if grace > 0 {
+				fmt.Fprintf(stderr, "received %s, waiting up to %s for the backup to finish...\n", sig, grace)
+				select {
+				case <-done:
+					return
+				case <-time.After(grace):
+				}
+			}
+			if closer, ok := state.reporter.(io.Closer); ok {
+				_ = closer.Close()
+			}
+			fmt.Fprintf(stderr, "received %s, uploading aborted marker...\n", sig)
+			err := uploadAbortedMarker(backend, outputPrefixUri, state.marker(backend, sig), state.keys, abortedMarkerDeadline)
+			if err != nil {
+				fmt.Fprintf(stderr, "%s\n", err.Error())
+			}
+			state.removeTempFiles()
+			state.removeSnapshot(stderr)
+			if state.release != nil {
+				state.release()
+			}
+			exitfunc(1)
+		case <-done:
+		}
+	}()
+
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
+
+// reportAbortedMarkers reports aborted markers left by previous runs and removes them.
+func reportAbortedMarkers(backend common.StorageBackend, outputPrefixUri *url.URL, keys *auxiliaryKeys, stderr io.Writer) error {
+	filelist, err := backend.ListFiles(outputPrefixUri)
+	if err != nil {
+		return fmt.Errorf("could not list remote files: %s", err.Error())
+	}
+
+	for _, fileinfo := range filelist {
+		if !strings.HasSuffix(fileinfo.Name(), abortedMarkerSuffix) {
+			continue
+		}
+		uri := common.ResolveObjectURI(outputPrefixUri, path.Base(fileinfo.Name()))
+
+		var buf bytes.Buffer
+		var marker abortedMarker
+		var data []byte
+		err = backend.RetrieveFile(&buf, uri)
+		if err == nil {
+			data, err = keys.open(buf.Bytes())
+		}
+		if err == nil {
+			err = json.Unmarshal(data, &marker)
+		}
+		if err != nil {
+			fmt.Fprintf(stderr, "found unreadable aborted marker %q: %s\n", uri, err.Error())
+			continue
+		}
+
+		fmt.Fprintf(stderr, "previous backup %q was aborted by %s during %s stage after uploading %d bytes\n", marker.Name, marker.Signal, marker.Stage, marker.BytesUploaded)
+		if len(marker.UploadId) > 0 {
+			fmt.Fprintf(stderr, "incomplete multipart upload %q of %q may need to be removed\n", marker.UploadId, marker.Object)
+		}
+		err = backend.RemoveFile(uri)
+		if err != nil {
+			fmt.Fprintf(stderr, "could not remove aborted marker %q: %s\n", uri, err.Error())
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+type (
+	// pendingBackend is a MemoryBackend reporting a multipart upload in progress.
+	pendingBackend struct {
+		*common.MemoryBackend
+	}
+
+	// blockingBackend is a MemoryBackend whose uploads never finish.
+	blockingBackend struct {
+		*common.MemoryBackend
+		release chan bool
+	}
+
+	// lockedBuffer is a bytes.Buffer safe for concurrent use.
+	lockedBuffer struct {
+		lock sync.Mutex
+		buf  bytes.Buffer
+	}
+)
+
+func (lb *lockedBuffer) Write(p []byte) (int, error) {
+	lb.lock.Lock()
+	defer lb.lock.Unlock()
+	return lb.buf.Write(p)
+}
+
+func (lb *lockedBuffer) String() string {
+	lb.lock.Lock()
+	defer lb.lock.Unlock()
+	return lb.buf.String()
+}
+
+func (pb *pendingBackend) PendingUploadId(uri *url.URL) (string, bool) {
+	return "upload-1", true
+}
+
+func (bb *blockingBackend) StoreFile(ctx context.Context, req common.StoreRequest) error {
+	<-bb.release
+	return nil
+}
+
+func TestAbortedMarker(t *testing.T) {
+	fmt.Println("Running TestAbortedMarker...")
+	pinClock(t)
+
+	// Setup Test
+	memory := common.NewMemoryBackend()
+	backend := &pendingBackend{memory}
+	prefixUri, _ := url.ParseRequestURI("dummy://bucket/prefix/")
+	objectUri, _ := prefixUri.Parse("2024-05-01T03+0000.tar.gz")
+
+	state := &backupState{name: "2024-05-01T03+0000", stage: stageInitializing}
+	state.setStage(stageUploading)
+	state.setObject(objectUri)
+	state.uploaded.Add(4)
+
+	// Perform the test
+	err := uploadAbortedMarker(backend, prefixUri, state.marker(backend, syscall.SIGTERM), nil, time.Second)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	var buf bytes.Buffer
+	markerUri, _ := prefixUri.Parse("2024-05-01T03+0000.aborted")
+	if err := memory.RetrieveFile(&buf, markerUri); err != nil {
+		t.Fatalf("could not retrieve marker: %s", err.Error())
+	}
+	assertEquals(t, `{"name":"2024-05-01T03+0000","stage":"uploading","signal":"terminated","time":"2024-05-01T03:00:00Z","bytes_uploaded":4,"object":"dummy://bucket/prefix/2024-05-01T03+0000.tar.gz","upload_id":"upload-1"}`, buf.String(), "TestAbortedMarker.marker")
+
+	/* marker upload does not block beyond the deadline */
+	blocking := &blockingBackend{memory, make(chan bool)}
+	defer close(blocking.release)
+	err = uploadAbortedMarker(blocking, prefixUri, state.marker(blocking, syscall.SIGTERM), nil, 10*time.Millisecond)
+	if err == nil {
+		t.Fatalf("uploadAbortedMarker was supposed to fail")
+	}
+	assertEquals(t, "could not upload marker: deadline of 10ms exceeded", err.Error(), "TestAbortedMarker.Error")
+}
+
+func TestAbortedMarkerObfuscated(t *testing.T) {
+	fmt.Println("Running TestAbortedMarkerObfuscated...")
+	pinClock(t)
+
+	// Setup Test
+	memory := common.NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("dummy://bucket/prefix/")
+	objectName := obfuscateName([]byte("name-key"), "2024-05-01T03+0000")
+	state := &backupState{name: "2024-05-01T03+0000", stage: stageArchiving}
+	state.setMarkerName(objectName)
+
+	// Perform the test
+	err := uploadAbortedMarker(memory, prefixUri, state.marker(memory, syscall.SIGTERM), nil, time.Second)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	/* the marker is stored under the obfuscated name, the backup name is only in its content */
+	filelist, _ := memory.ListFiles(prefixUri)
+	assertEquals(t, 1, len(filelist), "TestAbortedMarkerObfuscated.len(filelist)")
+	assertEquals(t, "prefix/"+objectName+".aborted", filelist[0].Name(), "TestAbortedMarkerObfuscated.Name")
+}
+
+func TestAbortedSignal(t *testing.T) {
+	fmt.Println("Running TestAbortedSignal...")
+	pinClock(t)
+
+	// Setup Test
+	memory := common.NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("dummy://bucket/prefix/")
+	exitCodes := make(chan int, 1)
+	exitfunc = func(code int) { exitCodes <- code }
+	defer func() { exitfunc = os.Exit }()
+
+	var cfg common.Config
+	if err := cfg.SetDefaultValues(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	var stdout lockedBuffer
+	reporter := common.NewConfiguredProgressbarReporter(&stdout, &cfg)
+	index, _ := reporter.CreateFileTask(-1)
+	_ = reporter.AdvanceTask(index, 1)
+
+	var stderr bytes.Buffer
+	/* the lease is released before the process exits */
+	cfg.Backup.Lease = true
+	release, err := holdLease(memory, &cfg, prefixUri, &stderr)
+	if err != nil {
+		t.Fatalf("could not acquire lease: %s", err.Error())
+	}
+	defer release()
+	leaseUri := common.ResolveObjectURI(prefixUri, common.LeaseObjectName)
+	if _, err = memory.GetFileInfo(leaseUri); err != nil {
+		t.Fatalf("lease was not stored: %s", err.Error())
+	}
+
+	state := &backupState{name: "2024-05-01T03+0000", stage: stageArchiving, reporter: reporter, release: release}
+	stopWatching := watchSignals(memory, prefixUri, state, 0, io.Writer(&stderr))
+	defer stopWatching()
+
+	/* temporary files of the run are removed, those of other runs are kept */
+	tmpDir := t.TempDir()
+	ownFile := filepath.Join(tmpDir, "SquirrelUp-bucket-prefix-20240501T030000Z-backup-1")
+	otherFile := filepath.Join(tmpDir, "SquirrelUp-bucket-other-20240501T030000Z-backup-2")
+	for _, path := range []string{ownFile, otherFile} {
+		if err := os.WriteFile(path, []byte("archive"), 0600); err != nil {
+			t.Fatalf("could not write file: %s", err.Error())
+		}
+	}
+	state.addTempFile(ownFile)
+	state.addTempFile(filepath.Join(tmpDir, "SquirrelUp-bucket-prefix-20240501T030000Z-encrypted-3"))
+
+	/* the snapshot the backup is read from is removed */
+	snapDir := t.TempDir()
+	cfg.Backup.SnapshotType = common.SnapshotCustom
+	cfg.Backup.SnapshotCreate, cfg.Backup.SnapshotTeardown = writeSnapshotScripts(t, snapDir)
+	snapshot, err := common.CreateSnapshot(context.Background(), tmpDir, "snapshot", &cfg)
+	if err != nil {
+		t.Fatalf("could not create snapshot: %s", err.Error())
+	}
+	state.setSnapshot(snapshot)
+
+	// Perform the test
+	sendSignal(t, syscall.SIGTERM)
+	select {
+	case code := <-exitCodes:
+		assertEquals(t, 1, code, "TestAbortedSignal.code")
+	case <-time.After(5 * time.Second):
+		t.Fatalf("signal was not handled")
+	}
+	assertEquals(t, "received terminated, uploading aborted marker...\n", stderr.String(), "TestAbortedSignal.stderr")
+	assertEquals(t, true, strings.HasSuffix(stdout.String(), "\r\033[?25h"), "TestAbortedSignal.stdout")
+
+	markerUri, _ := prefixUri.Parse("2024-05-01T03+0000.aborted")
+	fileinfo, err := memory.GetFileInfo(markerUri)
+	if err != nil {
+		t.Fatalf("marker was not uploaded: %s", err.Error())
+	}
+	assertEquals(t, true, fileinfo.IsFile(), "TestAbortedSignal.IsFile")
+
+	_, err = os.Stat(ownFile)
+	assertEquals(t, true, os.IsNotExist(err), "TestAbortedSignal.ownFile")
+	_, err = os.Stat(otherFile)
+	assertEquals(t, nil, err, "TestAbortedSignal.otherFile")
+	_, err = os.Stat(snapshot.Path)
+	assertEquals(t, true, os.IsNotExist(err), "TestAbortedSignal.snapshot")
+	removed, _ := os.ReadFile(filepath.Join(snapDir, "removed"))
+	assertEquals(t, "snapshot\n", string(removed), "TestAbortedSignal.removed")
+	_, err = memory.GetFileInfo(leaseUri)
+	assertEquals(t, common.ErrFileNotFound, fmt.Sprint(err), "TestAbortedSignal.lease")
+}
+
+func TestAbortedSignalGrace(t *testing.T) {
+	fmt.Println("Running TestAbortedSignalGrace...")
+	pinClock(t)
+
+	// Setup Test
+	memory := common.NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("dummy://bucket/prefix/")
+	exitCodes := make(chan int, 1)
+	exitfunc = func(code int) { exitCodes <- code }
+	defer func() { exitfunc = os.Exit }()
+
+	var stderr lockedBuffer
+	state := &backupState{name: "2024-05-01T03+0000", stage: stageUploading}
+	stopWatching := watchSignals(memory, prefixUri, state, time.Minute, &stderr)
+
+	// Perform the test
+	sendSignal(t, syscall.SIGTERM)
+	for deadline := time.Now().Add(5 * time.Second); len(stderr.String()) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("signal was not handled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assertEquals(t, "received terminated, waiting up to 1m0s for the backup to finish...\n", stderr.String(), "TestAbortedSignalGrace.stderr")
+
+	/* backup finishing within the grace period is not interrupted */
+	stopWatching()
+	select {
+	case code := <-exitCodes:
+		t.Fatalf("unexpected exit with code %d", code)
+	case <-time.After(10 * time.Millisecond):
+	}
+	filelist, _ := memory.ListFiles(prefixUri)
+	assertEquals(t, 0, len(filelist), "TestAbortedSignalGrace.len(filelist)")
+}
+
+func TestAbortedDetection(t *testing.T) {
+	fmt.Println("Running TestAbortedDetection...")
+
+	// Setup Test
+	memory := common.NewMemoryBackend()
+	setupBackend(t, memory, map[string]string{"SQUIRRELUP_BACKUP_HOURS": "0"})
+
+	prefixUri, _ := url.ParseRequestURI("dummy://bucket/prefix/")
+	state := &backupState{name: "2024-05-01T02+0000", stage: stageUploading}
+	if err := uploadAbortedMarker(memory, prefixUri, state.marker(memory, syscall.SIGINT), nil, time.Second); err != nil {
+		t.Fatalf("could not upload marker: %s", err.Error())
+	}
+
+	// Perform the test
+	var stdout, stderr bytes.Buffer
+	err := run([]string{appname, ".", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, strings.Contains(stderr.String(), "previous backup \"2024-05-01T02+0000\" was aborted by interrupt during uploading stage after uploading 0 bytes\n"), "TestAbortedDetection.stderr")
+
+	filelist, _ := memory.ListFiles(prefixUri)
+	assertEquals(t, 2, len(filelist), "TestAbortedDetection.len(filelist)")
+	assertEquals(t, "prefix/"+catalogObjectName, filelist[0].Name(), "TestAbortedDetection.filelist[0]")
+	assertEquals(t, "prefix/2024-05-01T03+0000.tar.gz", filelist[1].Name(), "TestAbortedDetection.filelist[1]")
+}
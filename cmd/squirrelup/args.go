@@ -0,0 +1,442 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+type (
+	// commandSpec describes a subcommand, its positional arguments and its help text.
+	commandSpec struct {
+		minArgs  int
+		maxArgs  int
+		expected string
+		// switches and positional arguments following the program name
+		synopsis string
+		// description of the command, its arguments and switches
+		help string
+	}
+
+	// flagSpec describes a command line switch.
+	flagSpec struct {
+		// long name followed by its aliases
+		names []string
+		// name of the switch in error messages if it takes a value, empty otherwise
+		value string
+		// commands accepting the switch, all commands if empty
+		commands []string
+		// records the switch, `value` is empty for switches without a value
+		apply func(cli_args *cliArgs, value string)
+	}
+)
+
+const (
+	// positionalSeparator ends the switches, all following arguments are positional.
+	positionalSeparator = "--"
+
+	// maxSuggestionDistance limits the edit distance of switches suggested for an unknown one.
+	maxSuggestionDistance = 2
+
+	usageFooter = `Exit status:
+    0 on success, 1 on failure and 2 if the backup is stored, but removing old backups failed
+    (unless backup.cleanup_errors_fatal is set) or its size deviates from recent backups as
+    configured by backup.size_*. 3 if the backup did not finish within backup.max_duration_minutes.
+
+Storage backends:
+    URL schemes supported by this build: %[3]s.
+
+BackBlaze B2 Backend:
+    <output_prefix_uri> must follow the pattern 'b2://<bucket>/<path>/<to>/<prefix>/'.`
+
+	usageGlobalOptions = `Optional arguments:
+    --config, -c <config_file>    Path to local config file.
+    --verbose, -v                 Verbose output.
+    --no-progress                 Do not display progress in verbose mode.
+    --strict-env                  Fail on unknown SQUIRRELUP_ environment variables.
+    --                            Treat all following arguments as positional arguments.`
+
+	usageDefaultConfig = "Default configuration is stored under %[2]s."
+)
+
+var (
+	// commandOrder lists subcommands in the order of the usage text.
+	commandOrder = []string{commandBackup, commandDecrypt, commandRekey, commandGet, commandDaemon, commandCheck, commandList, commandRebuild, commandDiff, commandVerify, commandConfig, commandCreds, commandHistory}
+
+	commands = map[string]commandSpec{
+		commandBackup: {2, 2, "exactly 2 positional arguments",
+			"[backup] <backup_dir> <output_prefix_uri>",
+			`    Create an (optionally) encrypted gzip-compressed TAR file and upload it to storage backend.
+    At the moment only BackBlaze B2 cloud storage is implemented.
+    Backups are named after backup.name, a Go time layout such as '2006-01-02T15-0700', or a
+    strftime pattern with backup.name_format: strftime. Names with strftime directives in a Go
+    layout are rejected, names without a time component are reported (rejected with
+    backup.name_strict).
+
+Required arguments:
+    <backup_dir>                  Path to local directory that serves as backup root, or '-' to read
+                                  a TAR stream from standard input along with --input-format.
+    <output_prefix_uri>           Remote URI prefix.
+
+Optional arguments:
+    --config, -c <config_file>    Path to local config file.
+    --verbose, -v                 Verbose output.
+    --no-progress                 Do not display progress in verbose mode.
+    --strict-env                  Fail on unknown SQUIRRELUP_ environment variables.
+    --allow-empty                 Skip the minimum size check of <backup_dir>.
+    --allow-nested                Allow a file:// <output_prefix_uri> inside <backup_dir> or vice versa.
+    --timestamp <RFC3339>         Nominal time of the backup (defaults to current time).
+    --resume-upload <file>        Complete an interrupted upload using its recovery file.
+    --input-format <format>       Format of the stream read instead of <backup_dir>: 'tar' is compressed
+                                  (re-compressed if gzipped), 'tar.gz' is stored as given.
+    --notify-desktop              Show a desktop notification with the outcome once the backup ends.
+    --print-plan                  Print what the backup is going to do as JSON before starting it.
+    --plan-only                   Print the plan like --print-plan and exit without backing up.
+    --keep-local <dir>            Keep the uploaded backup in a local directory (backup.keep_local_dir).
+    --also <uri>                  Also upload the backup to another prefix, repeatable (backup.mirrors).
+    --yes                         Remove old backups without asking when run on a terminal.
+    --no-preflight                Skip the backend probe of verbose mode and the readability check of
+                                  files (backup.preflight).
+    --stat-prefix                 List all objects under <output_prefix_uri> and print its size,
+                                  only the first object is listed to validate it by default.
+    --help, -h                    Print this help, '<command> --help' prints the help of a single command.
+    --                            Treat all following arguments as positional arguments.`},
+		commandDecrypt: {1, 2, "1 or 2 positional arguments",
+			"decrypt [--restore-owner <mode>] [--overwrite <policy>] [--include <glob>] [--exclude <glob>] [--list] <input_file> [output_dir]",
+			`Decrypt command:
+    Decrypt a local age-encrypted backup archive using the configured identity and extract it.
+    <input_file>                  Path to local encrypted backup archive.
+    [output_dir]                  Output directory (defaults to the directory of <input_file>).
+    --restore-owner <mode>        Ownership of extracted files: 'skip' (default) or 'preserve'.
+    --preserve-owner              Same as --restore-owner preserve.
+    --preserve-perms              Apply permissions recorded in the archive (default).
+    --no-preserve-perms           Leave permissions of extracted files to the umask.
+    --preserve-special            Keep setuid and setgid bits, they are stripped by default.
+    --allow-devices               Create device and FIFO entries, they are skipped by default.
+    --overwrite <policy>          Existing files: 'always' (default), 'older' or 'never'.
+    --include <glob>              Only extract entries matching the pattern or inside a matching directory, repeatable.
+    --exclude <glob>              Do not extract entries matching the pattern or inside a matching directory, repeatable.
+    --list                        Only print names of the selected entries.
+                                  Patterns are anchored at the archive root, '**' matches any number of directories.`},
+		commandRekey: {1, 1, "exactly 1 positional argument",
+			"rekey [--filter <glob>] [--dry-run] [--yes] <prefix_uri>",
+			`Rekey command:
+    Re-encrypt remote backup archives with the configured identity to the configured recipients.
+    <prefix_uri>                  Remote URI prefix.
+    --filter <glob>               Only re-encrypt files with names matching the pattern.
+    --dry-run                     Only list files that would be re-encrypted.
+    --yes                         Replace the files without asking, required without a terminal.`},
+		commandGet: {1, 2, "1 or 2 positional arguments",
+			"get [--decrypt] <uri> [local_path|-]",
+			`Get command:
+    Download a single remote backup object to a local file or standard output.
+    <uri>                         Remote object URI.
+    [local_path|-]                Output file path or '-' for standard output (defaults to the object name).
+    --decrypt                     Decrypt the object using the configured identity.`},
+		commandDaemon: {2, 2, "exactly 2 positional arguments",
+			"daemon <backup_dir> <output_prefix_uri>",
+			`Daemon command:
+    Keep running and create backups on the schedule configured in backup.schedule.
+    Send SIGUSR1 to start a backup immediately.
+    --notify-desktop              Show a desktop notification with the outcome of every backup.
+    --keep-local <dir>            Keep every uploaded backup in a local directory (backup.keep_local_dir).
+    --also <uri>                  Also upload every backup to another prefix, repeatable (backup.mirrors).
+    --no-preflight                Skip the backend probe of verbose mode and the readability check of
+                                  files (backup.preflight).
+    --stat-prefix                 List all objects under <output_prefix_uri> and print its size.`},
+		commandCheck: {0, 1, "at most 1 positional argument",
+			"check [--encryption-roundtrip] [--no-preflight] [<output_prefix_uri>]",
+			`Check command:
+    Verify configuration and access to the backend without creating a backup. The backend is
+    probed with a single request first, its endpoint, region and round trip are printed.
+    <output_prefix_uri>           Remote URI prefix.
+    --encryption-roundtrip        Encrypt a probe to the configured recipients and decrypt it with the
+                                  configured identity, without network access.
+    --no-preflight                Skip the backend probe.`},
+		commandList: {1, 1, "exactly 1 positional argument",
+			"list <prefix_uri>",
+			`List command:
+    List backups stored under a prefix using its catalog, or its contents if there is no catalog.
+    <prefix_uri>                  Remote URI prefix.`},
+		commandRebuild: {1, 1, "exactly 1 positional argument",
+			"rebuild-catalog <prefix_uri>",
+			`Rebuild-catalog command:
+    Replace the catalog of backups stored under a prefix with one built from its contents.
+    <prefix_uri>                  Remote URI prefix.`},
+		commandDiff: {2, 2, "exactly 2 positional arguments",
+			"diff [--hash] [--ignore <glob>] <backup_uri> <local_dir>",
+			`Diff command:
+    Compare a remote backup archive against a local directory and list added (+), removed (-)
+    and changed (~) files. Fails if differences are found.
+    <backup_uri>                  Remote backup archive URI.
+    <local_dir>                   Local directory the backup was created from.
+    --hash                        Compare contents of files with equal sizes as well.
+    --ignore <glob>               Do not compare entries matching the pattern, repeatable.`},
+		commandVerify: {1, 1, "exactly 1 positional argument",
+			"verify-prefix [--sample <n>] [--seed <n>] [--latest] [--max-age <age>] [--record] <prefix_uri>",
+			`Verify-prefix command:
+    Verify a random sample of the backups stored under a prefix: download each, compare it against
+    the catalog and read the archive to the end, decrypting it if an identity is configured.
+    Fails if any sampled backup fails verification.
+    <prefix_uri>                  Remote URI prefix.
+    --sample <n>                  Number of backups to verify (defaults to 1).
+    --seed <n>                    Seed of the random sample, printed in verbose mode.
+    --latest                      Verify the most recent backup in addition to the sample.
+    --max-age <age>               Only sample backups newer than the age, e.g. '36h' or '30d'.
+    --record                      Record the outcome in the catalog, shown by the list command.`},
+		commandConfig: {0, 0, "no positional arguments",
+			"config",
+			`Config command:
+    Print the effective configuration with secrets redacted. Every value is followed by where
+    it was set: default, file, env along with the variable, flag, or keyring.`},
+		commandCreds: {1, 1, "exactly 1 positional argument",
+			"credentials set|delete",
+			`Credentials command:
+    Store the S3 key ID and secret in the keyring of the operating system, or remove them. The
+    entry is named by s3.keyring_service and s3.keyring_account and read if s3.credential_source
+    is 'keyring'.
+    set                           Store the key ID and secret prompted for on the terminal, or read
+                                  from standard input one per line.
+    delete                        Remove the stored key ID and secret.`},
+		commandHistory: {0, 0, "no positional arguments",
+			"history [--prefix <uri>] [--limit <n>] [--json]",
+			`History command:
+    Print the backup runs recorded in the local journal (backup.journal_path), oldest first,
+    without accessing the backend.
+    --prefix <uri>                Only print runs whose output prefix starts with the URI.
+    --limit <n>                   Only print the last n runs.
+    --json                        Print every run as a JSON object on its own line.`},
+	}
+
+	flags = []flagSpec{
+		{[]string{"--verbose", "-v"}, "", nil, func(cli_args *cliArgs, value string) { cli_args.Verbose = true }},
+		{[]string{"--no-progress"}, "", nil, func(cli_args *cliArgs, value string) { cli_args.NoProgress = true }},
+		{[]string{"--strict-env"}, "", nil, func(cli_args *cliArgs, value string) { cli_args.StrictEnv = true }},
+		{[]string{"--config", "-c"}, "configuration", nil, func(cli_args *cliArgs, value string) { cli_args.ConfigFilepath = value }},
+		{[]string{"--allow-empty"}, "", []string{commandBackup, commandDaemon}, func(cli_args *cliArgs, value string) { cli_args.AllowEmpty = true }},
+		{[]string{"--allow-nested"}, "", []string{commandBackup, commandDaemon}, func(cli_args *cliArgs, value string) { cli_args.AllowNested = true }},
+		{[]string{"--timestamp"}, "timestamp", []string{commandBackup}, func(cli_args *cliArgs, value string) { cli_args.Timestamp = value }},
+		{[]string{"--resume-upload"}, "resume-upload", []string{commandBackup}, func(cli_args *cliArgs, value string) { cli_args.ResumeUpload = value }},
+		{[]string{"--input-format"}, "input-format", []string{commandBackup}, func(cli_args *cliArgs, value string) { cli_args.InputFormat = value }},
+		{[]string{"--notify-desktop"}, "", []string{commandBackup, commandDaemon}, func(cli_args *cliArgs, value string) { cli_args.NotifyDesktop = true }},
+		{[]string{"--print-plan"}, "", []string{commandBackup}, func(cli_args *cliArgs, value string) { cli_args.PrintPlan = true }},
+		{[]string{"--keep-local"}, "keep-local", []string{commandBackup, commandDaemon}, func(cli_args *cliArgs, value string) { cli_args.KeepLocal = value }},
+		{[]string{"--also"}, "also", []string{commandBackup, commandDaemon}, func(cli_args *cliArgs, value string) { cli_args.Also = append(cli_args.Also, value) }},
+		{[]string{"--plan-only"}, "", []string{commandBackup}, func(cli_args *cliArgs, value string) { cli_args.PlanOnly = true }},
+		{[]string{"--encryption-roundtrip"}, "", []string{commandCheck}, func(cli_args *cliArgs, value string) { cli_args.EncryptionRoundtrip = true }},
+		{[]string{"--prefix"}, "prefix", []string{commandHistory}, func(cli_args *cliArgs, value string) { cli_args.Prefix = value }},
+		{[]string{"--limit"}, "limit", []string{commandHistory}, func(cli_args *cliArgs, value string) { cli_args.Limit = value }},
+		{[]string{"--json"}, "", []string{commandHistory}, func(cli_args *cliArgs, value string) { cli_args.JSON = true }},
+		{[]string{"--yes"}, "", []string{commandBackup, commandRekey}, func(cli_args *cliArgs, value string) { cli_args.Yes = true }},
+		{[]string{"--no-preflight"}, "", []string{commandBackup, commandDaemon, commandCheck}, func(cli_args *cliArgs, value string) { cli_args.NoPreflight = true }},
+		{[]string{"--stat-prefix"}, "", []string{commandBackup, commandDaemon}, func(cli_args *cliArgs, value string) { cli_args.StatPrefix = true }},
+		{[]string{"--restore-owner"}, "restore-owner", []string{commandDecrypt}, func(cli_args *cliArgs, value string) { cli_args.RestoreOwner = value }},
+		{[]string{"--preserve-owner"}, "", []string{commandDecrypt}, func(cli_args *cliArgs, value string) { cli_args.PreserveOwner = true }},
+		{[]string{"--preserve-perms"}, "", []string{commandDecrypt}, func(cli_args *cliArgs, value string) { cli_args.NoPreservePerms = false }},
+		{[]string{"--no-preserve-perms"}, "", []string{commandDecrypt}, func(cli_args *cliArgs, value string) { cli_args.NoPreservePerms = true }},
+		{[]string{"--preserve-special"}, "", []string{commandDecrypt}, func(cli_args *cliArgs, value string) { cli_args.PreserveSpecial = true }},
+		{[]string{"--allow-devices"}, "", []string{commandDecrypt}, func(cli_args *cliArgs, value string) { cli_args.AllowDevices = true }},
+		{[]string{"--overwrite"}, "overwrite", []string{commandDecrypt}, func(cli_args *cliArgs, value string) { cli_args.Overwrite = value }},
+		{[]string{"--include"}, "include", []string{commandDecrypt}, func(cli_args *cliArgs, value string) { cli_args.Include = append(cli_args.Include, value) }},
+		{[]string{"--exclude"}, "exclude", []string{commandDecrypt}, func(cli_args *cliArgs, value string) { cli_args.Exclude = append(cli_args.Exclude, value) }},
+		{[]string{"--list"}, "", []string{commandDecrypt}, func(cli_args *cliArgs, value string) { cli_args.List = true }},
+		{[]string{"--filter"}, "filter", []string{commandRekey}, func(cli_args *cliArgs, value string) { cli_args.Filter = value }},
+		{[]string{"--dry-run"}, "", []string{commandRekey}, func(cli_args *cliArgs, value string) { cli_args.DryRun = true }},
+		{[]string{"--decrypt"}, "", []string{commandGet}, func(cli_args *cliArgs, value string) { cli_args.Decrypt = true }},
+		{[]string{"--hash"}, "", []string{commandDiff}, func(cli_args *cliArgs, value string) { cli_args.Hash = true }},
+		{[]string{"--ignore"}, "ignore", []string{commandDiff}, func(cli_args *cliArgs, value string) { cli_args.Ignore = append(cli_args.Ignore, value) }},
+		{[]string{"--sample"}, "sample", []string{commandVerify}, func(cli_args *cliArgs, value string) { cli_args.Sample = value }},
+		{[]string{"--seed"}, "seed", []string{commandVerify}, func(cli_args *cliArgs, value string) { cli_args.Seed = value }},
+		{[]string{"--latest"}, "", []string{commandVerify}, func(cli_args *cliArgs, value string) { cli_args.Latest = true }},
+		{[]string{"--max-age"}, "max-age", []string{commandVerify}, func(cli_args *cliArgs, value string) { cli_args.MaxAge = value }},
+		{[]string{"--record"}, "", []string{commandVerify}, func(cli_args *cliArgs, value string) { cli_args.Record = true }},
+	}
+)
+
+// usageString returns the usage text of all commands.
+func usageString(name string) string {
+	var synopses, helps []string
+	for _, command := range commandOrder {
+		synopses = append(synopses, "%[1]s "+commands[command].synopsis)
+		if command != commandBackup {
+			helps = append(helps, commands[command].help)
+		}
+	}
+	format := "Usage: " + strings.Join(synopses, "\n       ") + "\n" + commands[commandBackup].help + "\n\n" +
+		strings.Join(helps, "\n\n") + "\n\n" + usageFooter + "\n\n" + usageDefaultConfig + "\n"
+	return fmt.Sprintf(format, name, defaultConfigFilepath, strings.Join(common.RegisteredSchemes(), ", "))
+}
+
+// commandUsageString returns the usage text of `command`, or of all commands if it is empty.
+func commandUsageString(name, command string) string {
+	spec, prs := commands[command]
+	if !prs {
+		return usageString(name)
+	}
+
+	format := "Usage: %[1]s " + spec.synopsis + "\n"
+	if command == commandBackup {
+		format += spec.help + "\n\n" + usageFooter
+	} else {
+		format += "\n" + spec.help + "\n\n" + usageGlobalOptions
+	}
+	format += "\n\n" + usageDefaultConfig + "\n"
+	return fmt.Sprintf(format, name, defaultConfigFilepath, strings.Join(common.RegisteredSchemes(), ", "))
+}
+
+// lookupFlag returns the switch known under `name`, or nil.
+func lookupFlag(name string) *flagSpec {
+	for index := range flags {
+		for _, alias := range flags[index].names {
+			if alias == name {
+				return &flags[index]
+			}
+		}
+	}
+	return nil
+}
+
+// suggestFlag returns the long switch closest to the unknown switch `name`, or an empty
+// string if none is close enough. Only long switches are considered.
+func suggestFlag(name string) string {
+	if !strings.HasPrefix(name, "--") {
+		return ""
+	}
+
+	candidates := []string{"--help", "--version"}
+	for _, flag := range flags {
+		candidates = append(candidates, flag.names[0])
+	}
+	sort.Strings(candidates)
+
+	var suggestion string
+	var best int = maxSuggestionDistance + 1
+	for _, candidate := range candidates {
+		if distance := editDistance(name, candidate); distance < best {
+			suggestion, best = candidate, distance
+		}
+	}
+	return suggestion
+}
+
+// editDistance returns the Levenshtein distance between `a` and `b`.
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+// parseArgs processes command line arguments. Switches are accepted as '--switch value' and
+// '--switch=value' anywhere on the command line, arguments following '--' are positional. The
+// first positional argument selects the command, two positional arguments without a command
+// create a backup. Returns true if the program should terminate.
+func parseArgs(args []string, cli_args *cliArgs, stdout, stderr io.Writer) (bool, error) {
+	var pending *flagSpec = nil
+	var separated bool
+	var given []string
+	var positionalArgs []string = []string{}
+
+	for _, arg := range args[1:] {
+		if pending != nil {
+			pending.apply(cli_args, arg)
+			pending = nil
+			continue
+		} else if separated || !strings.HasPrefix(arg, "-") || arg == "-" {
+			positionalArgs = append(positionalArgs, arg)
+			continue
+		} else if arg == positionalSeparator {
+			separated = true
+			continue
+		}
+
+		// split '--switch=value' into its parts
+		var inlineValue *string = nil
+		if name, value, found := strings.Cut(arg, "="); found && strings.HasPrefix(arg, "--") {
+			arg, inlineValue = name, &value
+		}
+
+		switch arg {
+		case "--help", "-h":
+			var command string
+			if len(positionalArgs) > 0 {
+				command = positionalArgs[0]
+			}
+			fmt.Fprintf(stdout, "%s\n", commandUsageString(args[0], command))
+			return true, nil
+		case "--version", "-V":
+			fmt.Fprintf(stdout, "%s v%s (commit hash:%s | date:%s)\n", appname, version, commit, date)
+			return true, nil
+		}
+
+		flag := lookupFlag(arg)
+		if flag == nil {
+			if suggestion := suggestFlag(arg); len(suggestion) > 0 {
+				return true, fmt.Errorf("unrecognize command line option '%s', did you mean %s?", arg, suggestion)
+			}
+			return true, fmt.Errorf("unrecognize command line option '%s'", arg)
+		}
+		given = append(given, arg)
+
+		if len(flag.value) == 0 {
+			if inlineValue != nil {
+				return true, fmt.Errorf("invalid use of the %s switch, does not accept a value", strings.TrimLeft(arg, "-"))
+			}
+			flag.apply(cli_args, "")
+		} else if inlineValue != nil {
+			flag.apply(cli_args, *inlineValue)
+		} else {
+			pending = flag
+		}
+	}
+
+	if pending != nil {
+		return true, fmt.Errorf("invalid use of the %s switch, must provide a value", pending.value)
+	}
+
+	// an explicit backup command is only recognized along with both of its arguments, so
+	// that a backup directory named like the command keeps working
+	cli_args.Command = commandBackup
+	cli_args.PositionalArgs = positionalArgs
+	if len(positionalArgs) > 0 {
+		if spec, prs := commands[positionalArgs[0]]; prs && (positionalArgs[0] != commandBackup || len(positionalArgs) == 3) {
+			cli_args.Command = positionalArgs[0]
+			cli_args.PositionalArgs = positionalArgs[1:]
+			if len(cli_args.PositionalArgs) < spec.minArgs || len(cli_args.PositionalArgs) > spec.maxArgs {
+				fmt.Fprintf(stderr, "%s\n", commandUsageString(args[0], cli_args.Command))
+				return true, fmt.Errorf("wrong number of arguments, %s expects %s", cli_args.Command, spec.expected)
+			}
+		}
+	}
+	if cli_args.Command == commandBackup && len(cli_args.PositionalArgs) != 2 {
+		fmt.Fprintf(stderr, "%s\n", usageString(args[0]))
+		return true, fmt.Errorf("wrong number of arguments, expecting exactly 2 positional arguments")
+	}
+
+	// reject switches the command does not use
+	for _, arg := range given {
+		flag := lookupFlag(arg)
+		if len(flag.commands) > 0 && !slices.Contains(flag.commands, cli_args.Command) {
+			return true, fmt.Errorf("the %s switch is not supported by the %s command", arg, cli_args.Command)
+		}
+	}
+
+	return false, nil
+}
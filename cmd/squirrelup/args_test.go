@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestParseArgs(t *testing.T) {
+	fmt.Println("Running TestParseArgs...")
+	defaultConfigFilepath = ""
+
+	var tests = []struct {
+		name       string
+		args       []string
+		command    string
+		positional string
+		check      func(cli_args *cliArgs) bool
+	}{
+		{"legacy backup", []string{".", "b2://bucket/prefix/"}, commandBackup, ". b2://bucket/prefix/", nil},
+		{"legacy switches", []string{"-v", "-c", "config.yaml", ".", "b2://bucket/prefix/"}, commandBackup, ". b2://bucket/prefix/",
+			func(cli_args *cliArgs) bool { return cli_args.Verbose && cli_args.ConfigFilepath == "config.yaml" }},
+		{"legacy inline value", []string{"--config=config.yaml", ".", "b2://bucket/prefix/"}, commandBackup, ". b2://bucket/prefix/",
+			func(cli_args *cliArgs) bool { return cli_args.ConfigFilepath == "config.yaml" }},
+		{"switches after positionals", []string{".", "b2://bucket/prefix/", "--allow-empty", "--timestamp", "2024-05-01T03:00:00Z"}, commandBackup, ". b2://bucket/prefix/",
+			func(cli_args *cliArgs) bool {
+				return cli_args.AllowEmpty && cli_args.Timestamp == "2024-05-01T03:00:00Z"
+			}},
+		{"separator", []string{"-v", "--", "--dir", "-"}, commandBackup, "--dir -",
+			func(cli_args *cliArgs) bool { return cli_args.Verbose }},
+		{"explicit backup", []string{"backup", ".", "b2://bucket/prefix/"}, commandBackup, ". b2://bucket/prefix/", nil},
+		{"directory named backup", []string{"backup", "b2://bucket/prefix/"}, commandBackup, "backup b2://bucket/prefix/", nil},
+		{"rekey", []string{"rekey", "--dry-run", "--filter", "*.age", "b2://bucket/prefix/"}, commandRekey, "b2://bucket/prefix/",
+			func(cli_args *cliArgs) bool { return cli_args.DryRun && cli_args.Filter == "*.age" }},
+		{"decrypt", []string{"decrypt", "--include=a/**", "--include", "b", "--no-preserve-perms", "backup.tar.gz.age"}, commandDecrypt, "backup.tar.gz.age",
+			func(cli_args *cliArgs) bool {
+				return strings.Join(cli_args.Include, " ") == "a/** b" && cli_args.NoPreservePerms
+			}},
+		{"diff", []string{"diff", "--hash", "--ignore", "*.log", "b2://bucket/backup", "."}, commandDiff, "b2://bucket/backup .",
+			func(cli_args *cliArgs) bool { return cli_args.Hash && cli_args.Ignore[0] == "*.log" }},
+		{"get to stdout", []string{"get", "--decrypt", "b2://bucket/backup", "-"}, commandGet, "b2://bucket/backup -",
+			func(cli_args *cliArgs) bool { return cli_args.Decrypt }},
+	}
+
+	for _, test := range tests {
+		var cli_args cliArgs
+		var stdout, stderr bytes.Buffer
+		exit, err := parseArgs(append([]string{appname}, test.args...), &cli_args, io.Writer(&stdout), io.Writer(&stderr))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.name, err.Error())
+		}
+		assertEquals(t, false, exit, "TestParseArgs."+test.name+".exit")
+		assertEquals(t, test.command, cli_args.Command, "TestParseArgs."+test.name+".Command")
+		assertEquals(t, test.positional, strings.Join(cli_args.PositionalArgs, " "), "TestParseArgs."+test.name+".PositionalArgs")
+		if test.check != nil {
+			assertEquals(t, true, test.check(&cli_args), "TestParseArgs."+test.name+".check")
+		}
+		assertEquals(t, 0, stdout.Len()+stderr.Len(), "TestParseArgs."+test.name+".output")
+	}
+}
+
+func TestParseArgsErrors(t *testing.T) {
+	fmt.Println("Running TestParseArgsErrors...")
+	defaultConfigFilepath = ""
+
+	var tests = []struct {
+		args   []string
+		err    string
+		stderr string
+	}{
+		{[]string{"."}, "wrong number of arguments, expecting exactly 2 positional arguments", expected_usage},
+		{[]string{".", "b2://bucket/prefix/", "extra"}, "wrong number of arguments, expecting exactly 2 positional arguments", expected_usage},
+		{[]string{"backup"}, "wrong number of arguments, expecting exactly 2 positional arguments", expected_usage},
+		{[]string{".", "b2://bucket/prefix/", "-c"}, "invalid use of the configuration switch, must provide a value", ""},
+		{[]string{".", "b2://bucket/prefix/", "--verbose=yes"}, "invalid use of the verbose switch, does not accept a value", ""},
+		{[]string{".", "b2://bucket/prefix/", "-u"}, "unrecognize command line option '-u'", ""},
+		{[]string{".", "b2://bucket/prefix/", "--unknown"}, "unrecognize command line option '--unknown'", ""},
+		{[]string{".", "b2://bucket/prefix/", "--confg=config.yaml"}, "unrecognize command line option '--confg', did you mean --config?", ""},
+		{[]string{"rekey", "--dryrun", "b2://bucket/prefix/"}, "unrecognize command line option '--dryrun', did you mean --dry-run?", ""},
+		{[]string{".", "b2://bucket/prefix/", "--hash"}, "the --hash switch is not supported by the backup command", ""},
+		{[]string{"get", "--dry-run", "b2://bucket/backup"}, "the --dry-run switch is not supported by the get command", ""},
+	}
+
+	for _, test := range tests {
+		var cli_args cliArgs
+		var stdout, stderr bytes.Buffer
+		exit, err := parseArgs(append([]string{appname}, test.args...), &cli_args, io.Writer(&stdout), io.Writer(&stderr))
+		if err == nil {
+			t.Fatalf("parsing %q was supposed to fail", test.args)
+		}
+		assertEquals(t, true, exit, "TestParseArgsErrors.exit")
+		assertEquals(t, test.err, err.Error(), "TestParseArgsErrors.Error")
+		assertEquals(t, test.stderr, stderr.String(), "TestParseArgsErrors.stderr")
+	}
+
+	/* commands print their own usage */
+	var cli_args cliArgs
+	var stdout, stderr bytes.Buffer
+	_, err := parseArgs([]string{appname, "rekey"}, &cli_args, io.Writer(&stdout), io.Writer(&stderr))
+	assertEquals(t, "wrong number of arguments, rekey expects exactly 1 positional argument", err.Error(), "TestParseArgsErrors.Error")
+	assertEquals(t, commandUsageString(appname, commandRekey)+"\n", stderr.String(), "TestParseArgsErrors.stderr")
+}
+
+func TestParseArgsHelp(t *testing.T) {
+	fmt.Println("Running TestParseArgsHelp...")
+	defaultConfigFilepath = ""
+
+	var tests = []struct {
+		args   []string
+		stdout string
+	}{
+		{[]string{"--help"}, expected_usage},
+		{[]string{"-h", "rekey"}, expected_usage},
+		{[]string{".", "--help"}, expected_usage},
+		{[]string{"rekey", "--help"}, `Usage: SquirrelUp rekey [--filter <glob>] [--dry-run] [--yes] <prefix_uri>
+
+Rekey command:
+    Re-encrypt remote backup archives with the configured identity to the configured recipients.
+    <prefix_uri>                  Remote URI prefix.
+    --filter <glob>               Only re-encrypt files with names matching the pattern.
+    --dry-run                     Only list files that would be re-encrypted.
+    --yes                         Replace the files without asking, required without a terminal.
+
+Optional arguments:
+    --config, -c <config_file>    Path to local config file.
+    --verbose, -v                 Verbose output.
+    --no-progress                 Do not display progress in verbose mode.
+    --strict-env                  Fail on unknown SQUIRRELUP_ environment variables.
+    --                            Treat all following arguments as positional arguments.
+
+Default configuration is stored under .
+
+`},
+	}
+
+	for _, test := range tests {
+		var cli_args cliArgs
+		var stdout, stderr bytes.Buffer
+		exit, err := parseArgs(append([]string{appname}, test.args...), &cli_args, io.Writer(&stdout), io.Writer(&stderr))
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err.Error())
+		}
+		assertEquals(t, true, exit, "TestParseArgsHelp.exit")
+		assertEquals(t, test.stdout, stdout.String(), "TestParseArgsHelp.stdout")
+	}
+
+	/* backup help keeps the backend details */
+	var cli_args cliArgs
+	var stdout, stderr bytes.Buffer
+	_, _ = parseArgs([]string{appname, "backup", "--help"}, &cli_args, io.Writer(&stdout), io.Writer(&stderr))
+	assertEquals(t, true, strings.HasPrefix(stdout.String(), "Usage: SquirrelUp [backup] <backup_dir> <output_prefix_uri>\n"), "TestParseArgsHelp.backup")
+	assertEquals(t, true, strings.Contains(stdout.String(), "BackBlaze B2 Backend:"), "TestParseArgsHelp.backup")
+	assertEquals(t, false, strings.Contains(stdout.String(), "Rekey command:"), "TestParseArgsHelp.backup")
+}
+
+func TestEditDistance(t *testing.T) {
+	fmt.Println("Running TestEditDistance...")
+
+	assertEquals(t, 0, editDistance("--config", "--config"), "TestEditDistance.equal")
+	assertEquals(t, 1, editDistance("--confg", "--config"), "TestEditDistance.insert")
+	assertEquals(t, 2, editDistance("--cnofig", "--config"), "TestEditDistance.swap")
+	assertEquals(t, 8, editDistance("", "--config"), "TestEditDistance.empty")
+}
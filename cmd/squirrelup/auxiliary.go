@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+// auxiliaryKeys holds the keys protecting objects SquirrelUp stores next to the backups:
+// the catalog, the fingerprint and aborted markers. Objects are encrypted whenever recipients
+// are configured, the entries of the catalog one by one so that hosts holding only the
+// recipients can update it. The fingerprint is stored as a keyed hash, which is not secret,
+// see keyedHash. Plaintext objects written by older versions or without recipients are still
+// accepted, so a prefix may hold a mix of both. A nil value stores and reads plaintext only.
+type auxiliaryKeys struct {
+	recipients []age.Recipient
+	identities []age.Identity
+}
+
+// initAuxiliaryKeys loads recipients and identities configured for encryption.
+func initAuxiliaryKeys(cfg *common.Config, stdout, stderr io.Writer) (*auxiliaryKeys, error) {
+	recipients, err := initEncryption(cfg, stdout, stderr)
+	if err != nil {
+		return nil, err
+	}
+	identities, err := initIdentities(cfg, stdout, stderr)
+	if err != nil {
+		return nil, err
+	}
+	return &auxiliaryKeys{recipients, identities}, nil
+}
+
+// seal encrypts `data` for the configured recipients, plaintext is returned if there are none.
+func (keys *auxiliaryKeys) seal(data []byte) ([]byte, error) {
+	if keys == nil || len(keys.recipients) == 0 {
+		return data, nil
+	}
+
+	var buf bytes.Buffer
+	encryptedWriter, err := age.Encrypt(&buf, keys.recipients...)
+	if err == nil {
+		_, err = encryptedWriter.Write(data)
+	}
+	if err == nil {
+		err = encryptedWriter.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not encrypt: %s", err.Error())
+	}
+	return buf.Bytes(), nil
+}
+
+// open returns the plaintext of `data`. Encrypted data is decrypted with the configured
+// identities, anything else is assumed to be a plaintext object and returned as is.
+func (keys *auxiliaryKeys) open(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(ageHeaderPrefix)) && !bytes.HasPrefix(data, []byte(armor.Header)) {
+		return data, nil
+	}
+	if keys == nil || len(keys.identities) == 0 {
+		return nil, fmt.Errorf("object is encrypted, but no identity is configured")
+	}
+
+	plaintext, err := common.DecryptStream(bytes.NewReader(data), keys.identities)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(plaintext)
+}
+
+// keyedHash returns an HMAC of `fingerprint` keyed with the fingerprint of the configured
+// recipients, so that hosts without an identity can compare fingerprints. The key is derived
+// from public keys only: anyone knowing the recipients and guessing the contents of the
+// backup directory can compute the same hash, it only keeps fingerprints of the same
+// directory apart between sets of recipients. The fingerprint is returned as is if there are
+// no recipients.
+func (keys *auxiliaryKeys) keyedHash(fingerprint string) string {
+	if keys == nil || len(keys.recipients) == 0 {
+		return fingerprint
+	}
+
+	key := sha256.Sum256([]byte("squirrelup fingerprint\n" + recipientsFingerprint(keys.recipients)))
+	mac := hmac.New(sha256.New, key[:])
+	_, _ = io.WriteString(mac, fingerprint)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+func TestAuxiliarySealOpen(t *testing.T) {
+	fmt.Println("Running TestAuxiliarySealOpen...")
+
+	// Setup Test
+	identity, _ := age.GenerateX25519Identity()
+	other, _ := age.GenerateX25519Identity()
+	keys := &auxiliaryKeys{[]age.Recipient{identity.Recipient()}, []age.Identity{identity}}
+	plaintext := []byte("{\"entries\":[]}")
+
+	// Perform the test
+	/* no keys, plaintext is passed through */
+	var noKeys *auxiliaryKeys
+	sealed, err := noKeys.seal(plaintext)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, string(plaintext), string(sealed), "TestAuxiliarySealOpen.seal(nil)")
+	opened, err := noKeys.open(sealed)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, string(plaintext), string(opened), "TestAuxiliarySealOpen.open(nil)")
+
+	/* recipients configured */
+	sealed, err = keys.seal(plaintext)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, strings.HasPrefix(string(sealed), ageHeaderPrefix), "TestAuxiliarySealOpen.seal")
+	opened, err = keys.open(sealed)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, string(plaintext), string(opened), "TestAuxiliarySealOpen.open")
+
+	/* plaintext objects written before encryption was enabled */
+	opened, err = keys.open(plaintext)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, string(plaintext), string(opened), "TestAuxiliarySealOpen.open(plaintext)")
+
+	/* armored objects */
+	var armored bytes.Buffer
+	armorWriter := armor.NewWriter(&armored)
+	_, _ = armorWriter.Write(sealed)
+	_ = armorWriter.Close()
+	opened, err = keys.open(armored.Bytes())
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, string(plaintext), string(opened), "TestAuxiliarySealOpen.open(armored)")
+
+	/* encrypted objects without a matching identity */
+	_, err = noKeys.open(sealed)
+	assertEquals(t, "object is encrypted, but no identity is configured", fmt.Sprintf("%v", err), "TestAuxiliarySealOpen.open(nil).err")
+	_, err = (&auxiliaryKeys{identities: []age.Identity{other}}).open(sealed)
+	assertEquals(t, "wrong key: none of the configured identities can decrypt this file", fmt.Sprintf("%v", err), "TestAuxiliarySealOpen.open(other).err")
+}
+
+func TestAuxiliaryUpgrade(t *testing.T) {
+	fmt.Println("Running TestAuxiliaryUpgrade...")
+
+	// Setup Test
+	memory := setupCatalog(t)
+	os.Setenv("SQUIRRELUP_BACKUP_SKIP_UNCHANGED", "true")
+	defer os.Setenv("SQUIRRELUP_BACKUP_SKIP_UNCHANGED", "")
+	identity, _ := age.GenerateX25519Identity()
+	keys := &auxiliaryKeys{[]age.Recipient{identity.Recipient()}, []age.Identity{identity}}
+
+	prefixUri, _ := url.ParseRequestURI("dummy://bucket/prefix/")
+	catalogObjectUri, _ := catalogUri(prefixUri)
+	fingerprintObjectUri, _ := fingerprintUri(prefixUri)
+	var stdout, stderr bytes.Buffer
+
+	/* prefix written by a version without encrypted auxiliary objects */
+	err := run([]string{appname, "--timestamp", "2024-05-01T02:00:00Z", ".", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	state := &backupState{name: "2024-05-01T02+0000", stage: stageArchiving}
+	if err := uploadAbortedMarker(memory, prefixUri, state.marker(memory, syscall.SIGINT), nil, time.Second); err != nil {
+		t.Fatalf("could not upload marker: %s", err.Error())
+	}
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	// the fingerprint covers the encryption settings, store the one of the encrypted run
+	var cfg common.Config
+	cfg.Backup.IgnoreFileName = ".squirrelignore"
+	cfg.Encryption.Pubkey = identity.Recipient().String()
+	fingerprint, err := fingerprintDirectory(".", &cfg)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	if err := storeFingerprint(memory, fingerprintObjectUri, fingerprint, nil); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	// Perform the test
+	/* plaintext objects are read once encryption is enabled */
+	os.Setenv("SQUIRRELUP_PUBKEY", identity.Recipient().String())
+	defer os.Setenv("SQUIRRELUP_PUBKEY", "")
+	os.Setenv("SQUIRRELUP_IDENTITY", identity.String())
+	defer os.Setenv("SQUIRRELUP_IDENTITY", "")
+	err = run([]string{appname, ".", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, strings.Contains(stderr.String(), "previous backup \"2024-05-01T02+0000\" was aborted by interrupt during archiving stage after uploading 0 bytes\n"), "TestAuxiliaryUpgrade.stderr")
+	assertEquals(t, true, strings.Contains(stdout.String(), "unchanged, skipped\n"), "TestAuxiliaryUpgrade.stdout")
+
+	/* the catalog entries were rewritten encrypted, the fingerprint is untouched by a skipped backup */
+	catalog, err := readCatalog(memory, catalogObjectUri, nil)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 1, len(catalog.Entries), "TestAuxiliaryUpgrade.len(Entries)")
+	assertEquals(t, true, catalog.Entries[0].Sealed != nil, "TestAuxiliaryUpgrade.Entries[0].Sealed")
+	catalog, err = readCatalog(memory, catalogObjectUri, keys)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 1, len(catalog.Entries), "TestAuxiliaryUpgrade.len(Entries)")
+	assertEquals(t, "host-a", catalog.Entries[0].Host, "TestAuxiliaryUpgrade.Entries[0].Host")
+	var buf bytes.Buffer
+	_ = memory.RetrieveFile(&buf, fingerprintObjectUri)
+	assertEquals(t, fingerprint+"\n", buf.String(), "TestAuxiliaryUpgrade.fingerprint")
+
+	/* a new backup stores the fingerprint as a keyed hash that is read back by the next run */
+	if err := memory.RemoveFile(fingerprintObjectUri); err != nil {
+		t.Fatalf("could not remove file: %s", err.Error())
+	}
+	err = run([]string{appname, ".", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	buf.Reset()
+	_ = memory.RetrieveFile(&buf, fingerprintObjectUri)
+	assertEquals(t, keys.keyedHash(fingerprint)+"\n", buf.String(), "TestAuxiliaryUpgrade.fingerprint")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	err = run([]string{appname, ".", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, strings.Contains(stdout.String(), "unchanged, skipped\n"), "TestAuxiliaryUpgrade.stdout")
+}
+
+func TestAuxiliaryPubkeyOnly(t *testing.T) {
+	fmt.Println("Running TestAuxiliaryPubkeyOnly...")
+
+	// Setup Test
+	memory := setupCatalog(t)
+	os.Setenv("SQUIRRELUP_BACKUP_SKIP_UNCHANGED", "true")
+	defer os.Setenv("SQUIRRELUP_BACKUP_SKIP_UNCHANGED", "")
+	identity, _ := age.GenerateX25519Identity()
+	keys := &auxiliaryKeys{[]age.Recipient{identity.Recipient()}, []age.Identity{identity}}
+	os.Setenv("SQUIRRELUP_PUBKEY", identity.Recipient().String())
+	defer os.Setenv("SQUIRRELUP_PUBKEY", "")
+
+	prefixUri, _ := url.ParseRequestURI("dummy://bucket/prefix/")
+	catalogObjectUri, _ := catalogUri(prefixUri)
+	fingerprintObjectUri, _ := fingerprintUri(prefixUri)
+	var stdout, stderr bytes.Buffer
+
+	/* a host holding the identity stores the first backup */
+	os.Setenv("SQUIRRELUP_IDENTITY", identity.String())
+	defer os.Setenv("SQUIRRELUP_IDENTITY", "")
+	err := run([]string{appname, "--timestamp", "2024-05-01T02:00:00Z", ".", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	// Perform the test
+	/* a host holding only the recipient compares the fingerprint */
+	os.Setenv("SQUIRRELUP_IDENTITY", "")
+	err = run([]string{appname, "--timestamp", "2024-05-01T03:00:00Z", ".", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, strings.Contains(stdout.String(), "unchanged, skipped\n"), "TestAuxiliaryPubkeyOnly.stdout")
+	assertEquals(t, false, strings.Contains(stderr.String(), "could not decrypt"), "TestAuxiliaryPubkeyOnly.stderr")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* and adds its backup to the catalog, keeping the entries it cannot decrypt */
+	if err := memory.RemoveFile(fingerprintObjectUri); err != nil {
+		t.Fatalf("could not remove file: %s", err.Error())
+	}
+	err = run([]string{appname, "--timestamp", "2024-05-01T03:00:00Z", ".", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, false, strings.Contains(stderr.String(), "rebuilding the backup catalog"), "TestAuxiliaryPubkeyOnly.stderr")
+
+	catalog, err := readCatalog(memory, catalogObjectUri, keys)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 2, len(catalog.Entries), "TestAuxiliaryPubkeyOnly.len(Entries)")
+	for index, key := range []string{"2024-05-01T02+0000.tar.gz.age", "2024-05-01T03+0000.tar.gz.age"} {
+		assertEquals(t, key, catalog.Entries[index].Key, "TestAuxiliaryPubkeyOnly.Key")
+		assertEquals(t, "host-a", catalog.Entries[index].Host, "TestAuxiliaryPubkeyOnly.Host")
+		assertEquals(t, true, catalog.Entries[index].Sealed == nil, "TestAuxiliaryPubkeyOnly.Sealed")
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+type (
+	// backupCatalog lists backups stored under a prefix.
+	//
+	// The catalog is updated with a read-merge-write cycle: right before storing it, the
+	// current catalog is read again, the new entry is merged in and entries are reconciled
+	// with a listing of the prefix. Entries of removed objects are dropped and objects
+	// missing from the catalog get an entry built from the listing. Two hosts writing the
+	// same prefix concurrently follow the last-writer-wins rule, an entry lost this way is
+	// restored (without host, source and checksum details) by the next update.
+	backupCatalog struct {
+		Entries []catalogEntry `json:"entries"`
+	}
+
+	catalogEntry struct {
+		Key         string    `json:"key"`
+		Time        time.Time `json:"time"`
+		Host        string    `json:"host,omitempty"`
+		Source      string    `json:"source,omitempty"`
+		SourceSize  int64     `json:"source_size,omitempty"`
+		ArchiveSize int64     `json:"archive_size,omitempty"`
+		Size        int64     `json:"size"`
+		Checksum    string    `json:"checksum,omitempty"`
+		Recipients  string    `json:"recipients,omitempty"`
+		// durations of the backup stages, not known for entries rebuilt from a listing
+		Timings *catalogTimings `json:"timings,omitempty"`
+		// outcome of the last verification, see verify-prefix
+		Verified *catalogVerification `json:"verified,omitempty"`
+		// the entry encrypted for the recipients, only key, time and size are stored next
+		// to it, see sealEntries
+		Sealed []byte `json:"sealed,omitempty"`
+	}
+
+	// catalogVerification records when a backup was last verified and the outcome.
+	catalogVerification struct {
+		Time   time.Time `json:"time"`
+		Passed bool      `json:"passed"`
+		Error  string    `json:"error,omitempty"`
+	}
+
+	// catalogTimings holds durations of the backup stages in seconds.
+	catalogTimings struct {
+		Archive float64 `json:"archive"`
+		Encrypt float64 `json:"encrypt"`
+		Upload  float64 `json:"upload"`
+		Cleanup float64 `json:"cleanup"`
+		Total   float64 `json:"total"`
+	}
+)
+
+const (
+	// catalogObjectName is the name of the object listing all backups stored under a prefix.
+	catalogObjectName = common.CatalogObjectName
+)
+
+// newCatalogEntry describes a backup uploaded to `objectUri`. The checksum is left empty.
+func newCatalogEntry(cfg *common.Config, objectUri *url.URL, nominalTime time.Time, inputDirectory string, sizes common.BackupSizes, recipients []age.Recipient) *catalogEntry {
+	entry := &catalogEntry{
+		Key:         path.Base(objectUri.Path),
+		Time:        nominalTime.UTC(),
+		Source:      inputDirectory,
+		SourceSize:  sizes.Source,
+		ArchiveSize: sizes.Archive,
+		Size:        sizes.Uploaded,
+		Recipients:  recipientsFingerprint(recipients),
+	}
+	if inputDirectory == stdinSourcePath {
+		entry.Source = "(stdin)"
+	} else if source, err := filepath.Abs(inputDirectory); err == nil {
+		entry.Source = source
+	}
+	if host, err := cfg.BackupHostname(); err == nil {
+		entry.Host = host
+	}
+	return entry
+}
+
+// newCatalogTimings converts stage durations to seconds.
+func newCatalogTimings(timings common.StageTimings) *catalogTimings {
+	return &catalogTimings{
+		Archive: timings.Archive.Seconds(),
+		Encrypt: timings.Encrypt.Seconds(),
+		Upload:  timings.Upload.Seconds(),
+		Cleanup: timings.Cleanup.Seconds(),
+		Total:   timings.Total.Seconds(),
+	}
+}
+
+// add inserts an entry, replacing any entry with the same key.
+func (catalog *backupCatalog) add(entry catalogEntry) {
+	catalog.remove(entry.Key)
+	catalog.Entries = append(catalog.Entries, entry)
+}
+
+// remove drops the entry for an object key.
+func (catalog *backupCatalog) remove(key string) {
+	entries := catalog.Entries[:0]
+	for _, entry := range catalog.Entries {
+		if entry.Key != key {
+			entries = append(entries, entry)
+		}
+	}
+	catalog.Entries = entries
+}
+
+// reconcile drops entries of objects missing from `filelist` and adds entries for listed
+// backup objects the catalog does not know about. Entries are sorted by time.
+func (catalog *backupCatalog) reconcile(filelist []common.FileInfo) {
+	listed := map[string]common.FileInfo{}
+	for _, fileinfo := range filelist {
+		key := path.Base(fileinfo.Name())
+		if common.IsBackupObject(key) {
+			listed[key] = fileinfo
+		}
+	}
+
+	entries := catalog.Entries[:0]
+	for _, entry := range catalog.Entries {
+		if _, prs := listed[entry.Key]; prs {
+			entries = append(entries, entry)
+			delete(listed, entry.Key)
+		}
+	}
+	for key, fileinfo := range listed {
+		entries = append(entries, catalogEntry{
+			Key:  key,
+			Time: fileinfo.Modified().UTC(),
+			Size: int64(fileinfo.Size()),
+		})
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Time.Equal(entries[j].Time) {
+			return entries[i].Key < entries[j].Key
+		}
+		return entries[i].Time.Before(entries[j].Time)
+	})
+	catalog.Entries = entries
+}
+
+// backups describes the entries of the catalog of `prefixUri`, in the order of the catalog.
+func (catalog *backupCatalog) backups(prefixUri *url.URL) []common.BackupInfo {
+	var backups []common.BackupInfo
+	for _, entry := range catalog.Entries {
+		backup := common.BackupInfo{
+			Key:    entry.Key,
+			Object: common.ResolveObjectURI(prefixUri, entry.Key),
+			Time:   entry.Time,
+			Size:   uint64(max(entry.Size, 0)),
+		}
+		if entry.Verified != nil {
+			backup.Verified = &common.BackupVerification{Time: entry.Verified.Time, Passed: entry.Verified.Passed, Error: entry.Verified.Error}
+		}
+		backups = append(backups, backup)
+	}
+	return backups
+}
+
+// recipientsFingerprint returns a fingerprint of the encryption recipients, independent of their order.
+func recipientsFingerprint(recipients []age.Recipient) string {
+	var keys []string
+	for _, recipient := range recipients {
+		if stringer, ok := recipient.(fmt.Stringer); ok {
+			keys = append(keys, stringer.String())
+		}
+	}
+	if len(keys) == 0 {
+		return ""
+	}
+	sort.Strings(keys)
+	sum := sha256.Sum256([]byte(strings.Join(keys, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// catalogUri returns URI of the catalog object under the output prefix.
+func catalogUri(outputPrefixUri *url.URL) (*url.URL, error) {
+	uri, err := outputPrefixUri.Parse(catalogObjectName)
+	if err != nil {
+		return nil, fmt.Errorf("could not construct catalog URI: %s", err.Error())
+	}
+	return uri, nil
+}
+
+// sealEntries returns a copy of the catalog whose entries are encrypted for the recipients,
+// only their key, time and size are kept in plaintext as they show in a listing of the
+// prefix anyway. Entries sealed already are kept as they are. Without recipients the
+// catalog is returned as is.
+func (catalog *backupCatalog) sealEntries(keys *auxiliaryKeys) (*backupCatalog, error) {
+	if keys == nil || len(keys.recipients) == 0 {
+		return catalog, nil
+	}
+
+	sealed := &backupCatalog{Entries: make([]catalogEntry, 0, len(catalog.Entries))}
+	for _, entry := range catalog.Entries {
+		if entry.Sealed == nil {
+			data, err := json.Marshal(entry)
+			if err == nil {
+				data, err = keys.seal(data)
+			}
+			if err != nil {
+				return nil, err
+			}
+			entry = catalogEntry{Key: entry.Key, Time: entry.Time, Size: entry.Size, Sealed: data}
+		}
+		sealed.Entries = append(sealed.Entries, entry)
+	}
+	return sealed, nil
+}
+
+// openEntries decrypts sealed entries with the configured identities. Entries that cannot be
+// decrypted stay sealed, so hosts holding only the recipients keep them when updating the
+// catalog.
+func (catalog *backupCatalog) openEntries(keys *auxiliaryKeys) {
+	for index, entry := range catalog.Entries {
+		if entry.Sealed == nil {
+			continue
+		}
+		data, err := keys.open(entry.Sealed)
+		if err != nil {
+			continue
+		}
+		var opened catalogEntry
+		if err = json.Unmarshal(data, &opened); err == nil && opened.Key == entry.Key {
+			catalog.Entries[index] = opened
+		}
+	}
+}
+
+// readCatalog returns the stored catalog. Missing catalogs are reported as ErrFileNotFound.
+// Entries that cannot be decrypted are returned sealed.
+func readCatalog(backend common.StorageBackend, uri *url.URL, keys *auxiliaryKeys) (*backupCatalog, error) {
+	var buf bytes.Buffer
+	err := backend.RetrieveFile(&buf, uri)
+	if err != nil {
+		return nil, err
+	}
+	var catalog backupCatalog
+	if buf.Len() == 0 {
+		return &catalog, nil
+	}
+	data, err := keys.open(buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt backup catalog: %s", err.Error())
+	}
+	err = json.NewDecoder(bytes.NewReader(data)).Decode(&catalog)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse backup catalog: %s", err.Error())
+	}
+	catalog.openEntries(keys)
+	return &catalog, nil
+}
+
+// storeCatalog replaces the stored catalog with a single object upload, its entries are
+// sealed for the recipients.
+func storeCatalog(backend common.StorageBackend, uri *url.URL, catalog *backupCatalog, keys *auxiliaryKeys) error {
+	sealed, err := catalog.sealEntries(keys)
+	var data []byte
+	if err == nil {
+		data, err = json.Marshal(sealed)
+	}
+	if err == nil {
+		err = backend.StoreFile(context.Background(), common.StoreRequest{URI: uri, BodyAt: bytes.NewReader(data), Length: int64(len(data)), Quiet: true})
+	}
+	if err != nil {
+		return fmt.Errorf("could not store backup catalog: %s", err.Error())
+	}
+	return nil
+}
+
+// updateCatalog merges `entry` (if given) into the catalog stored under the output prefix and
+// reconciles it with the prefix contents. A missing or corrupted catalog is rebuilt.
+func updateCatalog(backend common.StorageBackend, outputPrefixUri *url.URL, entry *catalogEntry, keys *auxiliaryKeys, stderr io.Writer) error {
+	return modifyCatalog(backend, outputPrefixUri, keys, stderr, func(catalog *backupCatalog) {
+		if entry != nil {
+			catalog.add(*entry)
+		}
+	})
+}
+
+// modifyCatalog applies `modify` to the catalog stored under the output prefix and reconciles
+// it with the prefix contents. A missing or corrupted catalog is rebuilt.
+func modifyCatalog(backend common.StorageBackend, outputPrefixUri *url.URL, keys *auxiliaryKeys, stderr io.Writer, modify func(catalog *backupCatalog)) error {
+	uri, err := catalogUri(outputPrefixUri)
+	if err != nil {
+		return err
+	}
+
+	filelist, err := backend.ListFiles(outputPrefixUri)
+	if err != nil {
+		return fmt.Errorf("could not list remote files: %s", err.Error())
+	}
+
+	catalog, err := readCatalog(backend, uri, keys)
+	if err != nil {
+		if err.Error() != common.ErrFileNotFound {
+			fmt.Fprintf(stderr, "warning: %s, rebuilding the backup catalog\n", err.Error())
+		}
+		catalog = &backupCatalog{}
+	}
+	modify(catalog)
+	catalog.reconcile(filelist)
+
+	return storeCatalog(backend, uri, catalog, keys)
+}
+
+// rebuildCatalog replaces the catalog stored under the output prefix with one built from a listing.
+func rebuildCatalog(backend common.StorageBackend, outputPrefixUri *url.URL, keys *auxiliaryKeys) (*backupCatalog, error) {
+	uri, err := catalogUri(outputPrefixUri)
+	if err != nil {
+		return nil, err
+	}
+
+	filelist, err := backend.ListFiles(outputPrefixUri)
+	if err != nil {
+		return nil, fmt.Errorf("could not list remote files: %s", err.Error())
+	}
+
+	catalog := &backupCatalog{}
+	catalog.reconcile(filelist)
+
+	return catalog, storeCatalog(backend, uri, catalog, keys)
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+// setupCatalog injects a MemoryBackend and a fixed host name for backups of the current directory.
+func setupCatalog(t *testing.T) *common.MemoryBackend {
+	memory := common.NewMemoryBackend()
+	setupBackend(t, memory, map[string]string{
+		"SQUIRRELUP_BACKUP_HOURS":    "24",
+		"SQUIRRELUP_BACKUP_HOSTNAME": "host-a",
+	})
+	return memory
+}
+
+func TestCatalogRun(t *testing.T) {
+	fmt.Println("Running TestCatalogRun...")
+
+	// Setup Test
+	memory := setupCatalog(t)
+	identity, _ := age.GenerateX25519Identity()
+	os.Setenv("SQUIRRELUP_PUBKEY", identity.Recipient().String())
+	defer os.Setenv("SQUIRRELUP_PUBKEY", "")
+
+	prefixUri, _ := url.ParseRequestURI("dummy://bucket/prefix/")
+	catalogObjectUri, _ := catalogUri(prefixUri)
+	source, _ := filepath.Abs(".")
+	var stdout, stderr bytes.Buffer
+
+	// Perform the test
+	for _, timestamp := range []string{"2024-04-29T00:00:00Z", "2024-05-01T02:00:00Z", "2024-05-01T03:00:00Z"} {
+		err := run([]string{appname, "--timestamp", timestamp, ".", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		if timestamp == "2024-04-29T00:00:00Z" {
+			/* backdate the first backup, so it is pruned by the last run */
+			objectUri, _ := prefixUri.Parse("2024-04-29T00+0000.tar.gz.age")
+			if err := memory.SetFileModified(objectUri, time.Date(2024, time.April, 29, 0, 0, 0, 0, time.UTC)); err != nil {
+				t.Fatalf("unexpected test result: %+v", err)
+			}
+		}
+	}
+
+	/* catalog entries are encrypted for the backup recipients, keys, times and sizes are not */
+	var stored bytes.Buffer
+	if err := memory.RetrieveFile(&stored, catalogObjectUri); err != nil {
+		t.Fatalf("could not retrieve file: %s", err.Error())
+	}
+	assertEquals(t, false, strings.Contains(stored.String(), "host-a"), "TestCatalogRun.stored")
+	catalog, err := readCatalog(memory, catalogObjectUri, nil)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 2, len(catalog.Entries), "TestCatalogRun.len(Entries)")
+	assertEquals(t, "2024-05-01T03+0000.tar.gz.age", catalog.Entries[1].Key, "TestCatalogRun.Entries[1].Key")
+	assertEquals(t, "", catalog.Entries[1].Host, "TestCatalogRun.Entries[1].Host")
+	assertEquals(t, true, catalog.Entries[1].Sealed != nil, "TestCatalogRun.Entries[1].Sealed")
+	catalog, err = readCatalog(memory, catalogObjectUri, &auxiliaryKeys{identities: []age.Identity{identity}})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 2, len(catalog.Entries), "TestCatalogRun.len(Entries)")
+	assertEquals(t, "2024-05-01T02+0000.tar.gz.age", catalog.Entries[0].Key, "TestCatalogRun.Entries[0].Key")
+	assertEquals(t, "2024-05-01T03+0000.tar.gz.age", catalog.Entries[1].Key, "TestCatalogRun.Entries[1].Key")
+
+	entry := catalog.Entries[1]
+	assertEquals(t, "2024-05-01 03:00:00 +0000 UTC", entry.Time.String(), "TestCatalogRun.Time")
+	assertEquals(t, "host-a", entry.Host, "TestCatalogRun.Host")
+	assertEquals(t, source, entry.Source, "TestCatalogRun.Source")
+	assertEquals(t, true, entry.SourceSize > 0 && entry.ArchiveSize > 0, "TestCatalogRun.Sizes")
+	assertEquals(t, recipientsFingerprint([]age.Recipient{identity.Recipient()}), entry.Recipients, "TestCatalogRun.Recipients")
+	assertEquals(t, true, entry.Timings != nil && entry.Timings.Total >= entry.Timings.Archive, "TestCatalogRun.Timings")
+
+	var buf bytes.Buffer
+	objectUri, _ := prefixUri.Parse(entry.Key)
+	if err := memory.RetrieveFile(&buf, objectUri); err != nil {
+		t.Fatalf("could not retrieve file: %s", err.Error())
+	}
+	checksum := sha256.Sum256(buf.Bytes())
+	assertEquals(t, int64(buf.Len()), entry.Size, "TestCatalogRun.Size")
+	assertEquals(t, hex.EncodeToString(checksum[:]), entry.Checksum, "TestCatalogRun.Checksum")
+}
+
+func TestCatalogPassthrough(t *testing.T) {
+	fmt.Println("Running TestCatalogPassthrough...")
+
+	// Setup Test
+	memory := setupCatalog(t)
+	identity, _ := age.GenerateX25519Identity()
+	keys := &auxiliaryKeys{identities: []age.Identity{identity}}
+	for name, value := range map[string]string{
+		"SQUIRRELUP_PUBKEY":                      identity.Recipient().String(),
+		"SQUIRRELUP_BACKUP_PASSTHROUGH":          "true",
+		"SQUIRRELUP_BACKUP_PASSTHROUGH_MULTIPLE": "individual",
+	} {
+		os.Setenv(name, value)
+		defer os.Setenv(name, "")
+	}
+
+	srcDir := t.TempDir()
+	for name, content := range map[string]string{"db.dump.zst": "dump", "media.tar": "media!"} {
+		if err := os.WriteFile(filepath.Join(srcDir, name), []byte(content), 0600); err != nil {
+			t.Fatalf("could not write to temporary file: %s", err.Error())
+		}
+	}
+	prefixUri, _ := url.ParseRequestURI("dummy://bucket/prefix/")
+	catalogObjectUri, _ := catalogUri(prefixUri)
+	var stdout, stderr bytes.Buffer
+
+	// Perform the test
+	err := run([]string{appname, "--timestamp", "2024-05-01T03:00:00Z", srcDir, "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	/* every file stored individually gets an entry */
+	catalog, err := readCatalog(memory, catalogObjectUri, keys)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 2, len(catalog.Entries), "TestCatalogPassthrough.len(Entries)")
+	for index, name := range []string{"2024-05-01T03+0000_db.dump.zst.age", "2024-05-01T03+0000_media.tar.age"} {
+		entry := catalog.Entries[index]
+		assertEquals(t, name, entry.Key, "TestCatalogPassthrough.Key")
+		assertEquals(t, int64(len("dump")+2*index), entry.SourceSize, "TestCatalogPassthrough.SourceSize")
+
+		var buf bytes.Buffer
+		objectUri, _ := prefixUri.Parse(entry.Key)
+		if err := memory.RetrieveFile(&buf, objectUri); err != nil {
+			t.Fatalf("could not retrieve file: %s", err.Error())
+		}
+		checksum := sha256.Sum256(buf.Bytes())
+		assertEquals(t, hex.EncodeToString(checksum[:]), entry.Checksum, "TestCatalogPassthrough.Checksum")
+	}
+}
+
+func TestCatalogRecovery(t *testing.T) {
+	fmt.Println("Running TestCatalogRecovery...")
+
+	// Setup Test
+	memory := setupCatalog(t)
+	prefixUri, _ := url.ParseRequestURI("dummy://bucket/prefix/")
+	catalogObjectUri, _ := catalogUri(prefixUri)
+	for _, key := range []string{"a.tar.gz", "b.tar.gz"} {
+		objectUri, _ := prefixUri.Parse(key)
+		if err := memory.StoreFile(context.Background(), common.StoreRequest{URI: objectUri, BodyAt: strings.NewReader(key), Length: int64(len(key))}); err != nil {
+			t.Fatalf("could not store file: %s", err.Error())
+		}
+	}
+	var stderr bytes.Buffer
+
+	/* two hosts updated the catalog concurrently and the entry of host A was lost */
+	entryA := catalogEntry{Key: "a.tar.gz", Time: common.Now(), Host: "host-a", Checksum: "a"}
+	entryB := catalogEntry{Key: "b.tar.gz", Time: common.Now(), Host: "host-b", Checksum: "b"}
+	if err := updateCatalog(memory, prefixUri, &entryA, nil, &stderr); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	if err := storeCatalog(memory, catalogObjectUri, &backupCatalog{Entries: []catalogEntry{entryB}}, nil); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	// Perform the test
+	if err := updateCatalog(memory, prefixUri, nil, nil, &stderr); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	catalog, _ := readCatalog(memory, catalogObjectUri, nil)
+	assertEquals(t, 2, len(catalog.Entries), "TestCatalogRecovery.len(Entries)")
+	assertEquals(t, "a.tar.gz", catalog.Entries[0].Key, "TestCatalogRecovery.Entries[0].Key")
+	assertEquals(t, "", catalog.Entries[0].Checksum, "TestCatalogRecovery.Entries[0].Checksum")
+	assertEquals(t, "host-b", catalog.Entries[1].Host, "TestCatalogRecovery.Entries[1].Host")
+	assertEquals(t, "", stderr.String(), "TestCatalogRecovery.stderr")
+
+	/* corrupted catalog does not block backups */
+	if err := memory.StoreFile(context.Background(), common.StoreRequest{URI: catalogObjectUri, BodyAt: strings.NewReader("garbage"), Length: 7}); err != nil {
+		t.Fatalf("could not store file: %s", err.Error())
+	}
+	var stdout bytes.Buffer
+	err := run([]string{appname, ".", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, strings.Contains(stderr.String(), "warning: could not parse backup catalog: invalid character 'g' looking for beginning of value, rebuilding the backup catalog\n"), "TestCatalogRecovery.stderr")
+
+	catalog, _ = readCatalog(memory, catalogObjectUri, nil)
+	assertEquals(t, 3, len(catalog.Entries), "TestCatalogRecovery.len(Entries)")
+	assertEquals(t, "2024-05-01T03+0000.tar.gz", catalog.Entries[0].Key, "TestCatalogRecovery.Entries[0].Key")
+	assertEquals(t, "host-a", catalog.Entries[0].Host, "TestCatalogRecovery.Entries[0].Host")
+}
+
+func TestListRun(t *testing.T) {
+	fmt.Println("Running TestListRun...")
+
+	// Setup Test
+	memory := setupCatalog(t)
+	prefixUri, _ := url.ParseRequestURI("dummy://bucket/prefix/")
+	catalogObjectUri, _ := catalogUri(prefixUri)
+	for _, key := range []string{"a.tar.gz", ".fingerprint", "b.aborted"} {
+		objectUri, _ := prefixUri.Parse(key)
+		if err := memory.StoreFile(context.Background(), common.StoreRequest{URI: objectUri, BodyAt: strings.NewReader(key), Length: int64(len(key))}); err != nil {
+			t.Fatalf("could not store file: %s", err.Error())
+		}
+	}
+	var stdout, stderr bytes.Buffer
+
+	/* no catalog */
+	err := run([]string{appname, "list", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "2024-05-01T03:00:00Z\t8\ta.tar.gz\n", stdout.String(), "TestListRun.stdout")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* catalog is preferred */
+	catalog := &backupCatalog{Entries: []catalogEntry{{Key: "c.tar.gz", Time: time.Date(2024, time.April, 1, 0, 0, 0, 0, time.UTC), Size: 42}}}
+	if err := storeCatalog(memory, catalogObjectUri, catalog, nil); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	err = run([]string{appname, "list", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "2024-04-01T00:00:00Z\t42\tc.tar.gz\n", stdout.String(), "TestListRun.stdout")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* corrupted catalog falls back to the listing */
+	if err := memory.StoreFile(context.Background(), common.StoreRequest{URI: catalogObjectUri, BodyAt: strings.NewReader("{"), Length: 1}); err != nil {
+		t.Fatalf("could not store file: %s", err.Error())
+	}
+	err = run([]string{appname, "list", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "2024-05-01T03:00:00Z\t8\ta.tar.gz\n", stdout.String(), "TestListRun.stdout")
+	assertEquals(t, true, strings.HasSuffix(stderr.String(), "warning: could not parse backup catalog: unexpected EOF, listing objects instead\n"), "TestListRun.stderr")
+}
+
+func TestRebuildCatalogRun(t *testing.T) {
+	fmt.Println("Running TestRebuildCatalogRun...")
+
+	// Setup Test
+	memory := setupCatalog(t)
+	prefixUri, _ := url.ParseRequestURI("dummy://bucket/prefix/")
+	catalogObjectUri, _ := catalogUri(prefixUri)
+	for _, key := range []string{"a.tar.gz", "b.tar.gz", ".squirrelup-index.age"} {
+		objectUri, _ := prefixUri.Parse(key)
+		if err := memory.StoreFile(context.Background(), common.StoreRequest{URI: objectUri, BodyAt: strings.NewReader(key), Length: int64(len(key))}); err != nil {
+			t.Fatalf("could not store file: %s", err.Error())
+		}
+	}
+	if err := memory.StoreFile(context.Background(), common.StoreRequest{URI: catalogObjectUri, BodyAt: strings.NewReader("garbage"), Length: 7}); err != nil {
+		t.Fatalf("could not store file: %s", err.Error())
+	}
+
+	// Perform the test
+	var stdout, stderr bytes.Buffer
+	err := run([]string{appname, "rebuild-catalog", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "rebuilt catalog of \"dummy://bucket/prefix/\" with 2 entries\n", stdout.String(), "TestRebuildCatalogRun.stdout")
+
+	catalog, err := readCatalog(memory, catalogObjectUri, nil)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 2, len(catalog.Entries), "TestRebuildCatalogRun.len(Entries)")
+	assertEquals(t, "a.tar.gz", catalog.Entries[0].Key, "TestRebuildCatalogRun.Entries[0].Key")
+	assertEquals(t, int64(8), catalog.Entries[0].Size, "TestRebuildCatalogRun.Entries[0].Size")
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+
+	"filippo.io/age"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+// runCheck verifies configuration and access to the backend without creating a backup.
+func runCheck(cli_args *cliArgs, stdout, stderr io.Writer) error {
+	var err error
+
+	// process input arguments
+	if len(cli_args.PositionalArgs) == 0 && !cli_args.EncryptionRoundtrip {
+		return fmt.Errorf("wrong number of arguments, check expects a prefix URI or --encryption-roundtrip")
+	}
+	var prefixUri *url.URL
+	if len(cli_args.PositionalArgs) > 0 {
+		prefixUri, err = parsePrefixUri(cli_args.PositionalArgs[0], cli_args.Verbose, stderr)
+		if err != nil {
+			return fmt.Errorf("could not parse prefix URI: %s", err.Error())
+		}
+	}
+
+	/* load configuration */
+	var cfg common.Config
+
+	err = loadConfig(cli_args, &cfg, stdout, stderr)
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	}
+
+	/* verify the encryption keys */
+	if cli_args.EncryptionRoundtrip {
+		if err = checkEncryptionRoundtrip(&cfg, stdout, stderr); err != nil {
+			return err
+		}
+		if prefixUri == nil {
+			return nil
+		}
+	}
+
+	/* initialize the backend */
+	if cli_args.Verbose {
+		fmt.Fprintf(stderr, "intializing backend & verifying settings...\n")
+	}
+	backend, err := common.CreateStorageBackend(prefixUri, &cfg)
+	if err != nil {
+		return fmt.Errorf("failed to create backend: %s", err.Error())
+	}
+	if err = probeBackend(cli_args, backend, prefixUri, stdout, stderr); err != nil {
+		return err
+	}
+
+	/* report the proxy used to reach the backend */
+	if reporter, ok := common.AsBackend[common.ProxyReporter](backend); ok {
+		var proxyUri *url.URL
+		proxyUri, err = reporter.Proxy()
+		if err != nil {
+			return fmt.Errorf("invalid proxy configuration: %s", err.Error())
+		}
+		if proxyUri != nil {
+			fmt.Fprintf(stdout, "proxy: %s\n", proxyUri.Redacted())
+		} else {
+			fmt.Fprintf(stdout, "proxy: none\n")
+		}
+	}
+
+	/* verify access to the prefix */
+	fileinfo, err := backend.GetFileInfo(prefixUri)
+	if err != nil {
+		if err.Error() != common.ErrFileNotFound {
+			printBackendHint(err, prefixUri, stderr)
+			return fmt.Errorf("backend operation failed: %s", err.Error())
+		}
+	} else if fileinfo.IsFile() {
+		return fmt.Errorf("prefix URI must be a directory prefix, but a file path was specified: %q", prefixUri)
+	}
+
+	fmt.Fprintf(stdout, "check of %q passed\n", prefixUri)
+	return nil
+}
+
+// checkEncryptionRoundtrip encrypts a small probe to the configured recipients and decrypts it
+// with the configured identity. Each recipient is reported along with its fingerprint and, if
+// an identity is configured, whether the identity matches it. The check fails unless at least
+// one recipient is matched. Without an identity only the recipients are parsed and reported,
+// so their fingerprints can be compared by hand. Nothing is written and recipients are not
+// fetched from a URL, only key files are read.
+func checkEncryptionRoundtrip(cfg *common.Config, stdout, stderr io.Writer) error {
+	pubkey := strings.TrimSpace(cfg.Encryption.Pubkey)
+	if len(cfg.Encryption.PubkeyURL) > 0 || strings.HasPrefix(pubkey, "https://") {
+		return fmt.Errorf("encryption round trip failed: recipients fetched from a URL are not checked without network access")
+	}
+	recipients, err := initEncryption(cfg, stdout, stderr)
+	if err != nil {
+		return fmt.Errorf("encryption round trip failed: %s", err.Error())
+	}
+	if len(recipients) == 0 {
+		return fmt.Errorf("encryption round trip failed: no recipients configured")
+	}
+
+	identities, err := common.LoadIdentities(cfg)
+	if err != nil {
+		return fmt.Errorf("encryption round trip failed: %s", err.Error())
+	}
+
+	probe := make([]byte, 32)
+	if _, err = rand.Read(probe); err != nil {
+		return fmt.Errorf("encryption round trip failed: %s", err.Error())
+	}
+
+	var matched int
+	for _, recipient := range recipients {
+		description := "recipient"
+		if stringer, ok := recipient.(fmt.Stringer); ok {
+			description = fmt.Sprintf("recipient %s (%s)", stringer.String(), recipientFingerprints([]age.Recipient{recipient})[0])
+		}
+		ciphertext, err := encryptProbe(probe, recipient)
+		if err != nil {
+			return fmt.Errorf("encryption round trip failed: %s", err.Error())
+		}
+		switch {
+		case len(identities) == 0:
+			fmt.Fprintf(stdout, "%s\n", description)
+		case decryptsProbe(probe, ciphertext, identities):
+			fmt.Fprintf(stdout, "%s: matches the identity\n", description)
+			matched++
+		default:
+			fmt.Fprintf(stdout, "%s: does not match the identity\n", description)
+		}
+	}
+
+	if len(identities) == 0 {
+		fmt.Fprintf(stdout, "encryption round trip skipped: no identity configured, compare the fingerprints with those of your identity\n")
+		return nil
+	}
+
+	/* the probe must also survive encryption to all recipients at once, like a backup */
+	ciphertext, err := encryptProbe(probe, recipients...)
+	if err != nil {
+		return fmt.Errorf("encryption round trip failed: %s", err.Error())
+	}
+	if matched == 0 || !decryptsProbe(probe, ciphertext, identities) {
+		return fmt.Errorf("encryption round trip failed: the identity does not match any of the configured recipients")
+	}
+	fmt.Fprintf(stdout, "encryption round trip passed\n")
+	return nil
+}
+
+// encryptProbe encrypts `probe` in memory to `recipients`.
+func encryptProbe(probe []byte, recipients ...age.Recipient) ([]byte, error) {
+	var buf bytes.Buffer
+	writer, err := age.Encrypt(&buf, recipients...)
+	if err != nil {
+		return nil, fmt.Errorf("could not encrypt probe: %s", err.Error())
+	}
+	if _, err = writer.Write(probe); err != nil {
+		return nil, fmt.Errorf("could not encrypt probe: %s", err.Error())
+	}
+	if err = writer.Close(); err != nil {
+		return nil, fmt.Errorf("could not encrypt probe: %s", err.Error())
+	}
+	return buf.Bytes(), nil
+}
+
+// decryptsProbe reports whether `ciphertext` decrypts to `probe` with `identities`.
+func decryptsProbe(probe, ciphertext []byte, identities []age.Identity) bool {
+	reader, err := age.Decrypt(bytes.NewReader(ciphertext), identities...)
+	if err != nil {
+		return false
+	}
+	plaintext, err := io.ReadAll(reader)
+	return err == nil && bytes.Equal(plaintext, probe)
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+// runConfig prints the effective configuration and where each value was set.
+func runConfig(cli_args *cliArgs, stdout, stderr io.Writer) error {
+	var cfg common.Config
+
+	err := loadConfig(cli_args, &cfg, stdout, stderr)
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	}
+
+	for _, field := range cfg.Fields() {
+		source := field.Source
+		if source == common.ConfigSourceEnv {
+			source += " " + field.Env
+		}
+		fmt.Fprintf(stdout, "%s = %s (%s)\n", field.Key, field.Value, source)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConfigCommand(t *testing.T) {
+	fmt.Println("Running TestConfigCommand...")
+
+	// Setup Test
+	cfgPath := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(cfgPath, []byte("s3:\n  secret: secret\nbackup:\n  hours: 24\n"), 0600); err != nil {
+		t.Fatalf("could not write configuration: %s", err.Error())
+	}
+	os.Setenv("SQUIRRELUP_BACKUP_TIMEZONE", "UTC")
+	t.Cleanup(func() { os.Setenv("SQUIRRELUP_BACKUP_TIMEZONE", "") })
+
+	// Perform the test
+	var stdout, stderr bytes.Buffer
+	err := run([]string{appname, "config", "--config", cfgPath, "--no-progress"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	lines := map[string]bool{}
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		lines[line] = true
+	}
+	for _, expected := range []string{
+		`s3.region = "" (default)`,
+		`s3.secret = <redacted> (file)`,
+		`backup.hours = 24 (file)`,
+		`backup.timezone = "UTC" (env SQUIRRELUP_BACKUP_TIMEZONE)`,
+		`progress.enabled = false (flag)`,
+		`performance.buffer_kb = 32 (default)`,
+	} {
+		assertEquals(t, true, lines[expected], "TestConfigCommand.stdout("+expected+")")
+	}
+	assertEquals(t, false, strings.Contains(stdout.String(), "secret ("), "TestConfigCommand.stdout")
+}
+
+func TestConfigCommandStrictEnv(t *testing.T) {
+	fmt.Println("Running TestConfigCommandStrictEnv...")
+
+	// Setup Test
+	missingPath := filepath.Join(t.TempDir(), "missing.yaml")
+	os.Setenv("SQUIRRELUP_BACKUP_HOUR", "24")
+	t.Cleanup(func() { os.Unsetenv("SQUIRRELUP_BACKUP_HOUR") })
+
+	// Perform the test
+	var stdout, stderr bytes.Buffer
+	err := run([]string{appname, "config", "--config", missingPath}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, strings.Contains(stdout.String(), "backup.hours = 240 (default)\n"), "TestConfigCommandStrictEnv.stdout")
+
+	/* unknown variables fail every command in strict mode */
+	for _, args := range [][]string{
+		{appname, "config", "--strict-env", "--config", missingPath},
+		{appname, "--strict-env", "--config", missingPath, t.TempDir(), "file:///tmp/"},
+	} {
+		stdout.Reset()
+		err = run(args, nil, io.Writer(&stdout), io.Writer(&stderr))
+		assertEquals(t, "could not load configuration from environment: LoadConfigFromEnv failed: unknown environment variables SQUIRRELUP_BACKUP_HOUR", fmt.Sprintf("%v", err), "TestConfigCommandStrictEnv.err")
+	}
+	assertEquals(t, "", stdout.String(), "TestConfigCommandStrictEnv.stdout")
+}
+
+func TestConfigCommandBackupName(t *testing.T) {
+	fmt.Println("Running TestConfigCommandBackupName...")
+
+	// Setup Test
+	defaultConfigFilepath = ""
+	t.Setenv("SQUIRRELUP_BACKUP_FILENAME", "backup")
+	var stdout, stderr bytes.Buffer
+
+	/* names without time component are reported */
+	err := run([]string{appname, "config"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, strings.Contains(stderr.String(), "warning: backup name \"backup\" contains no time component, every backup overwrites the previous one"), "TestConfigCommandBackupName.stderr")
+
+	/* and rejected with backup.name_strict */
+	t.Setenv("SQUIRRELUP_BACKUP_NAME_STRICT", "true")
+	err = run([]string{appname, "config"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, "invalid configuration: backup name \"backup\" contains no time component, every backup would overwrite the previous one", err.Error(), "TestConfigCommandBackupName.Error")
+
+	/* strftime directives are rejected along with the Go equivalent */
+	t.Setenv("SQUIRRELUP_BACKUP_FILENAME", "backup-%Y%m%d")
+	err = run([]string{appname, "config"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, true, strings.Contains(err.Error(), "use the Go layout \"backup-20060102\""), "TestConfigCommandBackupName.Error")
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// userConfigDir returns the user configuration directory, can be overridden in tests.
+var userConfigDir func() (string, error) = os.UserConfigDir
+
+// runtimeConfigFilepath returns the default configuration file of builds without one set
+// at build time: squirrelup/squirrelup.yml in the user configuration directory, such as
+// %AppData% on Windows or $XDG_CONFIG_HOME on Linux. Empty if there is no such directory.
+func runtimeConfigFilepath() string {
+	dir, err := userConfigDir()
+	if err != nil || len(dir) == 0 {
+		return ""
+	}
+	name := strings.ToLower(appname)
+	return filepath.Join(dir, name, name+".yml")
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// helper function: make `dir` the user configuration directory for the duration of the test.
+func setUserConfigDir(t *testing.T, dir string, err error) {
+	userConfigDir = func() (string, error) { return dir, err }
+	t.Cleanup(func() { userConfigDir = os.UserConfigDir })
+}
+
+func TestRuntimeConfigFilepath(t *testing.T) {
+	fmt.Println("Running TestRuntimeConfigFilepath...")
+
+	/* the configuration file is named after the application */
+	configDir := filepath.Join(t.TempDir(), "AppData", "Roaming")
+	setUserConfigDir(t, configDir, nil)
+	assertEquals(t, filepath.Join(configDir, "squirrelup", "squirrelup.yml"), runtimeConfigFilepath(), "TestRuntimeConfigFilepath.path")
+
+	/* there is no default without a user configuration directory */
+	setUserConfigDir(t, "", errors.New("neither $XDG_CONFIG_HOME nor $HOME are defined"))
+	assertEquals(t, "", runtimeConfigFilepath(), "TestRuntimeConfigFilepath.missing")
+}
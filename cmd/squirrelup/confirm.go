@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// confirmCountAbove is the number of objects above which the number of objects has to be
+// typed to confirm, rather than 'y'.
+const confirmCountAbove = 10
+
+// isInteractive reports whether `stdin` is a terminal a confirmation can be read from, tests
+// replace it to script the answer.
+var isInteractive = func(stdin io.Reader) bool {
+	file, ok := stdin.(*os.File)
+	return ok && term.IsTerminal(int(file.Fd()))
+}
+
+// confirmDestructive asks on the terminal whether to `action` the `objects`, which are listed
+// on stderr first. The answer is read from `cli_args.stdin`, for more than confirmCountAbove
+// objects their number has to be typed. Passing --yes skips the question. If stdin is not a
+// terminal, --yes is required.
+func confirmDestructive(cli_args *cliArgs, action string, objects []string, stderr io.Writer) error {
+	if cli_args.Yes || len(objects) == 0 {
+		return nil
+	}
+	if !isInteractive(cli_args.stdin) {
+		return fmt.Errorf("refusing to %s %d objects without confirmation, pass --yes to proceed without a terminal", action, len(objects))
+	}
+
+	fmt.Fprintf(stderr, "about to %s %d objects:\n", action, len(objects))
+	for _, object := range objects {
+		fmt.Fprintf(stderr, "  %s\n", object)
+	}
+	expected := "y"
+	if len(objects) > confirmCountAbove {
+		expected = strconv.Itoa(len(objects))
+		fmt.Fprintf(stderr, "type the number of objects to confirm: ")
+	} else {
+		fmt.Fprintf(stderr, "proceed? [y/N] ")
+	}
+
+	answer, err := bufio.NewReader(cli_args.stdin).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("could not read confirmation: %s", err.Error())
+	}
+	answer = strings.TrimSpace(answer)
+	confirmed := answer == expected
+	if expected == "y" {
+		confirmed = strings.EqualFold(answer, "y") || strings.EqualFold(answer, "yes")
+	}
+	if !confirmed {
+		return fmt.Errorf("not confirmed, refusing to %s %d objects", action, len(objects))
+	}
+	return nil
+}
+
+// cleanupConfirmation returns the confirmation asked before the cleanup of old backups removes
+// objects, nil unless the backup runs on a terminal without --yes. Backups reading their source
+// from standard input, backups of the daemon and scheduled backups, which run without a
+// terminal, are not asked.
+func cleanupConfirmation(cli_args *cliArgs, streamed bool, stderr io.Writer) func(objects []string) error {
+	if cli_args.Yes || streamed || cli_args.Command == commandDaemon || !isInteractive(cli_args.stdin) {
+		return nil
+	}
+	return func(objects []string) error {
+		return confirmDestructive(cli_args, "remove", objects, stderr)
+	}
+}
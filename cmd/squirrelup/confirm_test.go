@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+// helper function: treat standard input as a terminal for the duration of the test.
+func setInteractive(t *testing.T) {
+	original := isInteractive
+	isInteractive = func(stdin io.Reader) bool { return stdin != nil }
+	t.Cleanup(func() { isInteractive = original })
+}
+
+func TestConfirmDestructive(t *testing.T) {
+	fmt.Println("Running TestConfirmDestructive...")
+
+	// Setup Test
+	setInteractive(t)
+	objects := []string{"b2://bucket/prefix/a", "b2://bucket/prefix/b"}
+	var stderr bytes.Buffer
+
+	/* the objects are listed and 'y' confirms */
+	cli_args := cliArgs{stdin: strings.NewReader("y\n")}
+	err := confirmDestructive(&cli_args, "remove", objects, &stderr)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "about to remove 2 objects:\n  b2://bucket/prefix/a\n  b2://bucket/prefix/b\nproceed? [y/N] ", stderr.String(), "TestConfirmDestructive.stderr")
+
+	/* any other answer rejects */
+	for _, answer := range []string{"n\n", "\n", ""} {
+		cli_args.stdin = strings.NewReader(answer)
+		err = confirmDestructive(&cli_args, "remove", objects, &stderr)
+		if err == nil {
+			t.Fatalf("confirmation was supposed to be rejected by %q", answer)
+		}
+		assertEquals(t, "not confirmed, refusing to remove 2 objects", err.Error(), "TestConfirmDestructive.Error")
+	}
+
+	/* the number of objects has to be typed for large sets */
+	stderr.Reset()
+	var many []string
+	for index := 0; index <= confirmCountAbove; index++ {
+		many = append(many, fmt.Sprintf("b2://bucket/prefix/%d", index))
+	}
+	cli_args.stdin = strings.NewReader("y\n")
+	err = confirmDestructive(&cli_args, "remove", many, &stderr)
+	if err == nil {
+		t.Fatalf("confirmation was supposed to be rejected")
+	}
+	assertEquals(t, true, strings.HasSuffix(stderr.String(), "type the number of objects to confirm: "), "TestConfirmDestructive.stderr")
+	cli_args.stdin = strings.NewReader(fmt.Sprintf("%d\n", len(many)))
+	if err = confirmDestructive(&cli_args, "remove", many, &stderr); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	/* --yes is required without a terminal */
+	cli_args.stdin = nil
+	err = confirmDestructive(&cli_args, "remove", objects, &stderr)
+	if err == nil {
+		t.Fatalf("confirmation was supposed to be rejected")
+	}
+	assertEquals(t, "refusing to remove 2 objects without confirmation, pass --yes to proceed without a terminal", err.Error(), "TestConfirmDestructive.Error")
+	cli_args.Yes = true
+	if err = confirmDestructive(&cli_args, "remove", objects, &stderr); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+}
+
+func TestConfirmCleanup(t *testing.T) {
+	fmt.Println("Running TestConfirmCleanup...")
+
+	// Setup Test
+	setInteractive(t)
+	memory := common.NewMemoryBackend()
+	setupBackend(t, memory, map[string]string{"SQUIRRELUP_BACKUP_HOURS": "24"})
+	oldUri, _ := url.ParseRequestURI("dummy://bucket/prefix/2024-04-01T03+0000.tar.gz")
+	if err := memory.StoreFile(context.Background(), common.StoreRequest{URI: oldUri, BodyAt: strings.NewReader("old"), Length: 3}); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	if err := memory.SetFileModified(oldUri, common.Now().Add(-30*24*time.Hour)); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	var stdout, stderr bytes.Buffer
+
+	/* old backups are kept if their removal is rejected on the terminal */
+	err := run([]string{appname, ".", "dummy://bucket/prefix/"}, strings.NewReader("n\n"), io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, true, strings.Contains(err.Error(), "not confirmed, refusing to remove 1 objects"), "TestConfirmCleanup.Error")
+	assertEquals(t, true, strings.Contains(stderr.String(), "about to remove 1 objects:\n  dummy://bucket/prefix/2024-04-01T03+0000.tar.gz\n"), "TestConfirmCleanup.stderr")
+	if _, err = memory.GetFileInfo(oldUri); err != nil {
+		t.Fatalf("old backup was removed: %+v", err)
+	}
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* and removed once confirmed */
+	err = run([]string{appname, "--timestamp", "2024-05-01T04:00:00Z", ".", "dummy://bucket/prefix/"}, strings.NewReader("y\n"), io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	if _, err = memory.GetFileInfo(oldUri); err == nil {
+		t.Fatalf("old backup was supposed to be removed")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+const (
+	credentialsSet    = "set"
+	credentialsDelete = "delete"
+)
+
+// runCredentials stores the S3 key ID and secret in the keyring or removes them.
+func runCredentials(cli_args *cliArgs, stdout, stderr io.Writer) error {
+	action := cli_args.PositionalArgs[0]
+	if action != credentialsSet && action != credentialsDelete {
+		return fmt.Errorf("invalid credentials action %q, expecting '%s' or '%s'", action, credentialsSet, credentialsDelete)
+	}
+
+	/* load configuration */
+	var cfg common.Config
+
+	err := loadConfig(cli_args, &cfg, stdout, stderr)
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	}
+	service, account := cfg.S3.KeyringService, cfg.S3.KeyringAccount
+
+	if action == credentialsDelete {
+		err = common.SystemKeyring.Delete(service, account)
+		if errors.Is(err, common.ErrKeyringNotFound) {
+			return fmt.Errorf("no credentials stored for service %q and account %q", service, account)
+		} else if err != nil {
+			return fmt.Errorf("could not remove credentials from the keyring: %s", err.Error())
+		}
+		fmt.Fprintf(stdout, "removed credentials for service %q and account %q from the keyring\n", service, account)
+		return nil
+	}
+
+	credentials, err := readCredentials(cli_args.stdin)
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	}
+	secret, err := common.EncodeS3Credentials(credentials)
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	}
+	if err = common.SystemKeyring.Set(service, account, secret); err != nil {
+		return fmt.Errorf("could not store credentials in the keyring: %s", err.Error())
+	}
+	fmt.Fprintf(stdout, "stored credentials for service %q and account %q in the keyring\n", service, account)
+	if cfg.S3.CredentialSource != common.CredentialSourceKeyring {
+		fmt.Fprintf(stderr, "hint: set s3.credential_source to '%s' to use the stored credentials\n", common.CredentialSourceKeyring)
+	}
+	return nil
+}
+
+// readCredentials prompts for the S3 key ID and secret on the terminal, or reads them from
+// `stdin` one per line if it is not a terminal.
+func readCredentials(stdin io.Reader) (common.S3Credentials, error) {
+	var credentials common.S3Credentials
+	if file, ok := stdin.(*os.File); stdin == nil || (ok && term.IsTerminal(int(file.Fd()))) {
+		id, err := common.ReadPassphrase("S3 key ID: ")
+		if err != nil {
+			return credentials, fmt.Errorf("could not read key ID: %s", err.Error())
+		}
+		secret, err := common.ReadPassphrase("S3 secret: ")
+		if err != nil {
+			return credentials, fmt.Errorf("could not read secret: %s", err.Error())
+		}
+		credentials.ID, credentials.Secret = strings.TrimSpace(string(id)), strings.TrimSpace(string(secret))
+	} else {
+		scanner := bufio.NewScanner(stdin)
+		for _, field := range []*string{&credentials.ID, &credentials.Secret} {
+			if scanner.Scan() {
+				*field = strings.TrimSpace(scanner.Text())
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return credentials, fmt.Errorf("could not read credentials: %s", err.Error())
+		}
+	}
+
+	if len(credentials.ID) == 0 || len(credentials.Secret) == 0 {
+		return credentials, fmt.Errorf("the key ID and secret must not be empty")
+	}
+	return credentials, nil
+}
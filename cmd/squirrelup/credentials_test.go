@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+// helper function: replace the system keyring with an empty memory keyring.
+func setupKeyring(t *testing.T) *common.MemoryKeyring {
+	keyring := common.NewMemoryKeyring()
+	original := common.SystemKeyring
+	common.SystemKeyring = keyring
+	t.Cleanup(func() { common.SystemKeyring = original })
+	defaultConfigFilepath = ""
+	return keyring
+}
+
+func TestCredentials(t *testing.T) {
+	fmt.Println("Running TestCredentials...")
+
+	// Setup Test
+	keyring := setupKeyring(t)
+	var stdout, stderr bytes.Buffer
+
+	/* credentials are read from standard input and stored in the keyring */
+	err := run([]string{appname, "credentials", "set"}, strings.NewReader("key-id\nkey-secret\n"), io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	secret, err := keyring.Get("squirrelup", "default")
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, `{"id":"key-id","secret":"key-secret"}`, secret, "TestCredentials.secret")
+	assertEquals(t, "stored credentials for service \"squirrelup\" and account \"default\" in the keyring\n", stdout.String(), "TestCredentials.stdout")
+	assertEquals(t, true, strings.Contains(stderr.String(), "hint: set s3.credential_source to 'keyring'"), "TestCredentials.stderr")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* the stored credentials replace configured ones */
+	t.Setenv("SQUIRRELUP_S3_CREDENTIAL_SOURCE", "keyring")
+	t.Setenv("SQUIRRELUP_S3_ID", "env-id")
+	err = run([]string{appname, "config"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, strings.Contains(stdout.String(), "s3.id = <redacted> (keyring)\n"), "TestCredentials.stdout")
+	assertEquals(t, true, strings.Contains(stdout.String(), "s3.secret = <redacted> (keyring)\n"), "TestCredentials.stdout")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* credentials are removed from the keyring */
+	err = run([]string{appname, "credentials", "delete"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "removed credentials for service \"squirrelup\" and account \"default\" from the keyring\n", stdout.String(), "TestCredentials.stdout")
+	err = run([]string{appname, "credentials", "delete"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, "no credentials stored for service \"squirrelup\" and account \"default\"", err.Error(), "TestCredentials.Error")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* configured credentials are used without an entry in the keyring */
+	err = run([]string{appname, "config"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, strings.Contains(stdout.String(), "s3.id = <redacted> (env SQUIRRELUP_S3_ID)\n"), "TestCredentials.stdout")
+	assertEquals(t, true, strings.Contains(stderr.String(), "warning: could not read S3 credentials from the keyring: no credentials stored"), "TestCredentials.stderr")
+}
+
+func TestCredentialsErrors(t *testing.T) {
+	fmt.Println("Running TestCredentialsErrors...")
+
+	// Setup Test
+	setupKeyring(t)
+	var stdout, stderr bytes.Buffer
+
+	/* unknown actions are rejected */
+	err := run([]string{appname, "credentials", "show"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, "invalid credentials action \"show\", expecting 'set' or 'delete'", err.Error(), "TestCredentialsErrors.Error")
+
+	/* both the key ID and secret are required */
+	err = run([]string{appname, "credentials", "set"}, strings.NewReader("key-id\n"), io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, "the key ID and secret must not be empty", err.Error(), "TestCredentialsErrors.Error")
+}
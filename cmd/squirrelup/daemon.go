@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+// afterfunc waits for the next scheduled backup, can be overridden in tests.
+var afterfunc func(time.Duration) <-chan time.Time = time.After
+
+// scheduleJitter returns a random delay of up to `cfg.Backup.ScheduleJitter` seconds.
+func scheduleJitter(cfg *common.Config) time.Duration {
+	jitter := time.Duration(cfg.Backup.ScheduleJitter * float64(time.Second))
+	if jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(jitter)))
+}
+
+// runDaemon keeps running backups on the configured schedule until SIGTERM or SIGINT is received.
+// SIGUSR1 starts a backup immediately. Backups never overlap, a failed backup is reported
+// and the daemon waits for the next scheduled one.
+func runDaemon(cli_args *cliArgs, stdout, stderr io.Writer) error {
+	/* load configuration */
+	var cfg common.Config
+
+	err := loadConfig(cli_args, &cfg, stdout, stderr)
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	}
+	schedule, err := cfg.BackupSchedule()
+	if err != nil {
+		return fmt.Errorf("daemon mode requires a schedule: %s", err.Error())
+	}
+
+	signals := make(chan os.Signal, 4)
+	if runNowSignal != nil {
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt, runNowSignal)
+	} else {
+		signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	}
+	defer signal.Stop(signals)
+
+	var runNow bool
+	for {
+		if !runNow {
+			next := schedule.Next(common.Now())
+			if next.IsZero() {
+				return fmt.Errorf("schedule %q has no further activations", cfg.Backup.Schedule)
+			}
+			next = next.Add(scheduleJitter(&cfg))
+			fmt.Fprintf(stderr, "next backup scheduled at %s\n", next.Format(time.RFC3339))
+
+			select {
+			case <-afterfunc(next.Sub(common.Now())):
+			case sig := <-signals:
+				if sig != runNowSignal {
+					fmt.Fprintf(stderr, "received %s, shutting down\n", sig)
+					return nil
+				}
+				fmt.Fprintf(stderr, "received %s, starting backup now\n", sig)
+			}
+		}
+		runNow = false
+
+		err = runBackup(cli_args, stdout, stderr)
+		var warning *warningError
+		var timeout *timeoutError
+		if errors.As(err, &warning) {
+			fmt.Fprintf(stderr, "%s\n", warning.Error())
+		} else if errors.As(err, &timeout) {
+			fmt.Fprintf(stderr, "scheduled backup timed out: %s\n", timeout.Error())
+		} else if err != nil {
+			fmt.Fprintf(stderr, "scheduled backup failed: %s\n", err.Error())
+		}
+
+		/* handle signals received while the backup was running */
+		for pending := true; pending; {
+			select {
+			case sig := <-signals:
+				if sig != runNowSignal {
+					fmt.Fprintf(stderr, "received %s, shutting down\n", sig)
+					return nil
+				}
+				runNow = true
+			default:
+				pending = false
+			}
+		}
+	}
+}
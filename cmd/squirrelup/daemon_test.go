@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+// scheduleSignals makes the daemon wait for scheduled backups without delay. Signals listed in
+// `signals` are sent to the process instead of firing the corresponding wait.
+func scheduleSignals(t *testing.T, signals map[int]os.Signal) {
+	var calls int
+	afterfunc = func(time.Duration) <-chan time.Time {
+		calls++
+		if sig, prs := signals[calls]; prs {
+			sendSignal(t, sig)
+			return nil
+		}
+		ch := make(chan time.Time, 1)
+		ch <- common.Now()
+		return ch
+	}
+	t.Cleanup(func() { afterfunc = time.After })
+}
+
+// setupDaemon makes dummy:// URIs resolve to `backend` for daemons backing up every hour.
+func setupDaemon(t *testing.T, backend common.StorageBackend) {
+	setupBackend(t, backend, map[string]string{
+		"SQUIRRELUP_BACKUP_HOURS":    "0",
+		"SQUIRRELUP_BACKUP_SCHEDULE": "1h",
+	})
+}
+
+func TestDaemonSchedule(t *testing.T) {
+	fmt.Println("Running TestDaemonSchedule...")
+
+	// Setup Test
+	setupDaemon(t, common.NewMemoryBackend())
+	scheduleSignals(t, map[int]os.Signal{3: syscall.SIGTERM})
+
+	// Perform the test
+	var stdout, stderr bytes.Buffer
+	err := run([]string{appname, "daemon", ".", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 2, strings.Count(stdout.String(), "uploaded backup archive of \".\""), "TestDaemonSchedule.uploads")
+	assertEquals(t, 3, strings.Count(stderr.String(), "next backup scheduled at 2024-05-01T04:00:00Z\n"), "TestDaemonSchedule.scheduled")
+	assertEquals(t, true, strings.HasSuffix(stderr.String(), "received terminated, shutting down\n"), "TestDaemonSchedule.stderr")
+}
+
+func TestDaemonFailure(t *testing.T) {
+	fmt.Println("Running TestDaemonFailure...")
+
+	// Setup Test
+	setupDaemon(t, common.NewMemoryBackend())
+	scheduleSignals(t, map[int]os.Signal{3: syscall.SIGINT})
+
+	// Perform the test
+	var stdout, stderr bytes.Buffer
+	err := run([]string{appname, "daemon", t.TempDir(), "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 2, strings.Count(stderr.String(), "scheduled backup failed: "), "TestDaemonFailure.failures")
+	assertEquals(t, true, strings.HasSuffix(stderr.String(), "received interrupt, shutting down\n"), "TestDaemonFailure.stderr")
+}
+
+func TestDaemonTimeout(t *testing.T) {
+	fmt.Println("Running TestDaemonTimeout...")
+
+	// Setup Test
+	setupDaemon(t, &slowBackend{common.NewMemoryBackend()})
+	t.Setenv("SQUIRRELUP_BACKUP_MAX_DURATION_MINUTES", "0.001")
+	scheduleSignals(t, map[int]os.Signal{2: syscall.SIGTERM})
+
+	// Perform the test
+	var stdout, stderr bytes.Buffer
+	err := run([]string{appname, "daemon", ".", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 1, strings.Count(stderr.String(), "scheduled backup timed out: deadline exceeded: "), "TestDaemonTimeout.timeouts")
+	assertEquals(t, 0, strings.Count(stderr.String(), "scheduled backup failed: "), "TestDaemonTimeout.failures")
+}
+
+func TestDaemonRunNow(t *testing.T) {
+	fmt.Println("Running TestDaemonRunNow...")
+
+	// Setup Test
+	setupDaemon(t, common.NewMemoryBackend())
+	scheduleSignals(t, map[int]os.Signal{1: runNowSignal, 2: syscall.SIGTERM})
+
+	// Perform the test
+	var stdout, stderr bytes.Buffer
+	err := run([]string{appname, "daemon", ".", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 1, strings.Count(stdout.String(), "uploaded backup archive of \".\""), "TestDaemonRunNow.uploads")
+	assertEquals(t, true, strings.Contains(stderr.String(), "received user defined signal 1, starting backup now\n"), "TestDaemonRunNow.stderr")
+}
+
+func TestDaemonNoSchedule(t *testing.T) {
+	fmt.Println("Running TestDaemonNoSchedule...")
+
+	// Setup Test
+	setupDaemon(t, common.NewMemoryBackend())
+	os.Setenv("SQUIRRELUP_BACKUP_SCHEDULE", "")
+
+	// Perform the test
+	var stdout, stderr bytes.Buffer
+	err := run([]string{appname, "daemon", ".", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, "daemon mode requires a schedule: no backup schedule configured", err.Error(), "TestDaemonNoSchedule.Error")
+}
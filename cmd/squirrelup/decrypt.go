@@ -0,0 +1,314 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/breezerider/squirrel-up/pkg/common"
+	"github.com/mholt/archiver/v4"
+)
+
+const (
+	agePublicKeyPrefix = "age1"
+	ageHeaderPrefix    = common.AgeHeaderPrefix
+	ageFileSuffix      = common.AgeFileSuffix
+
+	errTruncatedCiphertext = common.ErrTruncatedCiphertext
+)
+
+func runDecrypt(cli_args *cliArgs, stdout, stderr io.Writer) error {
+	var err error
+
+	// process input arguments
+	var inputPath string = cli_args.PositionalArgs[0]
+	var outputDirectory string = filepath.Dir(inputPath)
+	if len(cli_args.PositionalArgs) > 1 {
+		outputDirectory = cli_args.PositionalArgs[1]
+	}
+	if isDir, err := isDirectory(outputDirectory); !isDir && !cli_args.List {
+		if err != nil {
+			return fmt.Errorf("output must be a valid directory path: %s", err.Error())
+		} else {
+			return fmt.Errorf("output must be a valid directory path")
+		}
+	}
+
+	if cli_args.PreserveOwner {
+		if len(cli_args.RestoreOwner) > 0 && cli_args.RestoreOwner != restoreOwnerPreserve {
+			return fmt.Errorf("--preserve-owner conflicts with --restore-owner %s", cli_args.RestoreOwner)
+		}
+		cli_args.RestoreOwner = restoreOwnerPreserve
+	}
+	switch cli_args.RestoreOwner {
+	case "":
+		cli_args.RestoreOwner = restoreOwnerSkip
+	case restoreOwnerSkip, restoreOwnerPreserve:
+	default:
+		return fmt.Errorf("invalid restore owner mode %q, must be %q or %q", cli_args.RestoreOwner, restoreOwnerSkip, restoreOwnerPreserve)
+	}
+
+	switch cli_args.Overwrite {
+	case "":
+		cli_args.Overwrite = overwriteAlways
+	case overwriteNever, overwriteOlder, overwriteAlways:
+	default:
+		return fmt.Errorf("invalid overwrite policy %q, must be %q, %q or %q", cli_args.Overwrite, overwriteNever, overwriteOlder, overwriteAlways)
+	}
+
+	options := &extractOptions{
+		restoreOwner:    cli_args.RestoreOwner,
+		overwrite:       cli_args.Overwrite,
+		preservePerms:   !cli_args.NoPreservePerms,
+		preserveSpecial: cli_args.PreserveSpecial,
+		allowDevices:    cli_args.AllowDevices,
+		report:          stderr,
+	}
+	options.filter, err = newExtractFilter(cli_args.Include, cli_args.Exclude)
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	}
+	if cli_args.List {
+		options.list = stdout
+	}
+
+	/* load configuration */
+	var cfg common.Config
+
+	err = loadConfig(cli_args, &cfg, stdout, stderr)
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	}
+
+	/* initialize decryption */
+	if cli_args.Verbose {
+		fmt.Fprintf(stderr, "initializing decryption...\n")
+	}
+	var identities []age.Identity
+	identities, err = initIdentities(&cfg, stdout, stderr)
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	} else if len(identities) == 0 {
+		return fmt.Errorf("no identity configured, decryption is not possible")
+	}
+
+	/* decrypt the input file */
+	if cli_args.Verbose {
+		fmt.Fprintf(stderr, "decrypting %q...\n", inputPath)
+	}
+	var outputPath string
+	outputPath, err = decryptFile(inputPath, outputDirectory, identities, options, &cfg, stderr)
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	}
+	if !cli_args.List {
+		fmt.Fprintf(stdout, "decrypted %q to %q\n", inputPath, outputPath)
+		if outputPath == outputDirectory {
+			fmt.Fprintf(stdout, "restored %d entries, skipped %d entries, stripped setuid/setgid bits from %d entries\n", options.restored, options.skipped, options.stripped)
+		}
+	}
+
+	return nil
+}
+
+func initIdentities(cfg *common.Config, stdout, stderr io.Writer) ([]age.Identity, error) {
+	return common.LoadIdentities(cfg)
+}
+
+// decryptFile decrypts `filePath` and extracts it into `outputDirectory` if the plaintext is a
+// TAR archive, otherwise the plaintext is written to `outputDirectory` under the input name
+// with the `.age` suffix stripped. Returns path to the extracted directory or the plaintext file.
+// Entries are selected, listed and their ownership handled according to `options`. Input that
+// turns out not to be age-encrypted is processed as plaintext.
+func decryptFile(filePath, outputDirectory string, identities []age.Identity, options *extractOptions, cfg *common.Config, stderr io.Writer) (string, error) {
+	// open input file
+	input, err := os.Open(filepath.Clean(filePath))
+	if err != nil {
+		return "", fmt.Errorf("could not open input file %s: %s", filePath, err.Error())
+	}
+	defer input.Close()
+
+	var plaintext io.Reader
+	buffered := bufio.NewReader(input)
+	if common.SniffEncryption(buffered, filepath.Base(filePath), stderr) {
+		plaintext, err = common.DecryptStream(buffered, identities)
+		if err != nil {
+			return "", fmt.Errorf("could not decrypt file '%s': %s", filePath, err.Error())
+		}
+	} else {
+		plaintext = buffered
+	}
+
+	// detect the format of the plaintext
+	format, plaintext, err := archiver.Identify("", plaintext)
+	if err != nil && !errors.Is(err, archiver.ErrNoMatch) {
+		return "", fmt.Errorf("could not identify format of decrypted file '%s': %s", filePath, err.Error())
+	}
+
+	if isTarFormat(format) {
+		var handler archiver.FileHandler
+		if options.list != nil {
+			handler = listFileHandler(options.list)
+		} else {
+			handler = extractFileHandler(outputDirectory, options)
+		}
+		err = format.(archiver.Extractor).Extract(context.Background(), plaintext, nil, metadataFileHandler(filteredFileHandler(options.filter, handler), stderr))
+		if err != nil && !errors.Is(err, errExtractionComplete) {
+			return "", fmt.Errorf("could not extract decrypted file '%s': %s", filePath, err.Error())
+		}
+		return outputDirectory, nil
+	} else if options.list != nil || options.filter != nil {
+		return "", fmt.Errorf("could not select entries of decrypted file '%s': not a TAR archive", filePath)
+	}
+
+	// write plaintext as is
+	var outputPath string = filepath.Join(outputDirectory, strings.TrimSuffix(filepath.Base(filePath), ageFileSuffix))
+	if outputPath == filepath.Clean(filePath) {
+		outputPath += ".decrypted"
+	}
+	output, err := common.CreateFile(outputPath, cfg.FileMode(common.SecretFile))
+	if err != nil {
+		return "", fmt.Errorf("could not create output file: %s", err.Error())
+	}
+	_, err = common.CopyBuffer(output, plaintext, cfg.BufferSize())
+	_ = output.Close()
+	if err != nil {
+		_ = os.Remove(outputPath)
+		return "", fmt.Errorf("could not write decrypted file '%s': %s", outputPath, err.Error())
+	}
+
+	return outputPath, nil
+}
+
+// isTarFormat returns true if `format` is a TAR archive, possibly compressed.
+func isTarFormat(format archiver.Format) bool {
+	switch f := format.(type) {
+	case archiver.Tar:
+		return true
+	case archiver.CompressedArchive:
+		_, ok := f.Archival.(archiver.Tar)
+		return ok
+	}
+	return false
+}
+
+// extractFileHandler returns an archiver.FileHandler writing archive entries under `outputDirectory`.
+// Existing files, permissions, ownership and special entries are handled according to `options`.
+// Existing files are removed before being replaced, so symbolic links are never followed.
+func extractFileHandler(outputDirectory string, options *extractOptions) archiver.FileHandler {
+	root := filepath.Clean(outputDirectory)
+
+	return func(ctx context.Context, f archiver.File) error {
+		target := filepath.Join(root, filepath.FromSlash(f.NameInArchive))
+		if target != root && !strings.HasPrefix(target, root+string(filepath.Separator)) {
+			return fmt.Errorf("illegal file path in archive: %q", f.NameInArchive)
+		}
+		if err := checkSymlinkParents(root, target, f.NameInArchive); err != nil {
+			return err
+		}
+		hdr, isTar := f.Header.(*tar.Header)
+		if !isTar {
+			hdr = nil
+		}
+
+		if f.IsDir() {
+			_, statErr := os.Lstat(target)
+			var dirPerm fs.FileMode = 0777
+			if options.preservePerms {
+				dirPerm = 0700
+			}
+			err := os.MkdirAll(target, dirPerm)
+			if err == nil && (os.IsNotExist(statErr) || options.overwrite != overwriteNever) {
+				err = options.applyAttributes(target, f.NameInArchive, f.Mode(), hdr)
+			}
+			if err == nil {
+				options.restored++
+			}
+			return err
+		}
+
+		isSymlink := hdr != nil && hdr.Typeflag == tar.TypeSymlink
+		isDevice := hdr != nil && isDeviceEntry(hdr)
+		if isDevice && !options.allowDevices {
+			options.skip(f.NameInArchive, "device and FIFO entries are not allowed")
+			return nil
+		} else if isDevice && !devicesSupported {
+			options.skip(f.NameInArchive, "device and FIFO entries are not supported on "+runtime.GOOS)
+			return nil
+		} else if !isSymlink && !isDevice && (!f.Mode().IsRegular() || (hdr != nil && hdr.Typeflag != tar.TypeReg)) {
+			options.skip(f.NameInArchive, "unsupported entry type")
+			return nil
+		}
+
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return err
+		}
+		if reason, ok := options.replaceable(target, f.ModTime()); !ok {
+			options.skip(f.NameInArchive, reason)
+			return nil
+		}
+		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		if isSymlink {
+			err := os.Symlink(f.LinkTarget, target)
+			if err == nil {
+				err = restoreOwnership(target, hdr, options.restoreOwner)
+			}
+			if err == nil {
+				options.restoreXattrs(target, f.NameInArchive, hdr)
+			}
+			if err == nil {
+				options.restored++
+			}
+			return err
+		} else if isDevice {
+			err := createDevice(target, hdr)
+			if err == nil {
+				err = options.applyAttributes(target, f.NameInArchive, f.Mode(), hdr)
+			}
+			if err == nil {
+				options.restored++
+			}
+			return err
+		}
+
+		reader, err := f.Open()
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+
+		var filePerm fs.FileMode = 0666
+		if options.preservePerms {
+			filePerm = 0600
+		}
+		output, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, filePerm)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(output, reader)
+		if closeErr := output.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = options.applyAttributes(target, f.NameInArchive, f.Mode(), hdr)
+		}
+		if err != nil {
+			return err
+		}
+
+		options.restored++
+		return os.Chtimes(target, f.ModTime(), f.ModTime())
+	}
+}
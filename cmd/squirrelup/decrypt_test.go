@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+// helper function: encrypt `filePath` to a freshly generated identity.
+func setupEncryptedFile(t *testing.T, filePath string) (*age.X25519Identity, string) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("could not generate identity: %s", err.Error())
+	}
+
+	var cfg common.Config
+	encryptedPath, err := common.EncryptFile(filePath, []age.Recipient{identity.Recipient()}, &cfg)
+	if err != nil {
+		t.Fatalf("could not encrypt file: %s", err.Error())
+	}
+
+	return identity, encryptedPath
+}
+
+func TestDecryptArchiveRoundTrip(t *testing.T) {
+	fmt.Println("Running TestDecryptArchiveRoundTrip...")
+
+	// Setup Test
+	srcDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(srcDir, "sub"), 0700); err != nil {
+		t.Fatalf("could not create directory: %s", err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "sub", "file.txt"), []byte("test content"), 0600); err != nil {
+		t.Fatalf("could not write file: %s", err.Error())
+	}
+
+	var cfg common.Config
+	archivePath, _, err := archiveDirectory(srcDir, &cfg)
+	if err != nil {
+		t.Fatalf("could not archive directory: %s", err.Error())
+	}
+	defer os.Remove(archivePath)
+
+	identity, encryptedPath := setupEncryptedFile(t, archivePath)
+	defer os.Remove(encryptedPath)
+
+	// Perform the test
+	outDir := t.TempDir()
+	outputPath, err := decryptFile(encryptedPath, outDir, []age.Identity{identity}, &extractOptions{restoreOwner: restoreOwnerSkip}, &cfg, io.Discard)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, outDir, outputPath, "TestDecryptArchiveRoundTrip.outputPath")
+
+	data, err := os.ReadFile(filepath.Join(outDir, filepath.Base(srcDir), "sub", "file.txt"))
+	if err != nil {
+		t.Fatalf("could not read extracted file: %s", err.Error())
+	}
+	assertEquals(t, "test content", string(data), "TestDecryptArchiveRoundTrip.content")
+}
+
+func TestDecryptPlainFile(t *testing.T) {
+	fmt.Println("Running TestDecryptPlainFile...")
+
+	// Setup Test
+	srcDir := t.TempDir()
+	plainPath := filepath.Join(srcDir, "notes.txt")
+	if err := os.WriteFile(plainPath, []byte("plain content"), 0600); err != nil {
+		t.Fatalf("could not write file: %s", err.Error())
+	}
+
+	identity, encryptedPath := setupEncryptedFile(t, plainPath)
+	defer os.Remove(encryptedPath)
+
+	inputPath := filepath.Join(srcDir, "notes.txt.age")
+	if err := os.Rename(encryptedPath, inputPath); err != nil {
+		t.Fatalf("could not rename file: %s", err.Error())
+	}
+
+	// Perform the test
+	var stdout, stderr bytes.Buffer
+	os.Setenv("SQUIRRELUP_IDENTITY", identity.String())
+	defaultConfigFilepath = ""
+	outDir := t.TempDir()
+	err := run([]string{appname, "decrypt", inputPath, outDir}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	os.Setenv("SQUIRRELUP_IDENTITY", "")
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	outputPath := filepath.Join(outDir, "notes.txt")
+	assertEquals(t, fmt.Sprintf("decrypted %q to %q\n", inputPath, outputPath), stdout.String(), "TestDecryptPlainFile.stdout")
+
+	data, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatalf("could not read decrypted file: %s", err.Error())
+	}
+	assertEquals(t, "plain content", string(data), "TestDecryptPlainFile.content")
+	assertPerm(t, 0600, outputPath, "TestDecryptPlainFile.perm")
+}
+
+func TestDecryptWrongKey(t *testing.T) {
+	fmt.Println("Running TestDecryptWrongKey...")
+
+	// Setup Test
+	plainPath := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(plainPath, []byte("plain content"), 0600); err != nil {
+		t.Fatalf("could not write file: %s", err.Error())
+	}
+
+	_, encryptedPath := setupEncryptedFile(t, plainPath)
+	defer os.Remove(encryptedPath)
+
+	otherIdentity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("could not generate identity: %s", err.Error())
+	}
+
+	// Perform the test
+	var cfg common.Config
+	_, err = decryptFile(encryptedPath, t.TempDir(), []age.Identity{otherIdentity}, &extractOptions{restoreOwner: restoreOwnerSkip}, &cfg, io.Discard)
+	if err == nil {
+		t.Fatalf("decryptFile was supposed to fail")
+	}
+	assertEquals(t,
+		fmt.Sprintf("could not decrypt file '%s': wrong key: none of the configured identities can decrypt this file", encryptedPath),
+		err.Error(), "TestDecryptWrongKey.Error")
+}
+
+func TestDecryptTruncatedCiphertext(t *testing.T) {
+	fmt.Println("Running TestDecryptTruncatedCiphertext...")
+
+	// Setup Test
+	plainPath := filepath.Join(t.TempDir(), "notes.txt")
+	if err := os.WriteFile(plainPath, bytes.Repeat([]byte("plain content "), 10000), 0600); err != nil {
+		t.Fatalf("could not write file: %s", err.Error())
+	}
+
+	identity, encryptedPath := setupEncryptedFile(t, plainPath)
+	defer os.Remove(encryptedPath)
+
+	fileInfo, err := os.Stat(encryptedPath)
+	if err != nil {
+		t.Fatalf("could not stat file: %s", err.Error())
+	}
+	if err = os.Truncate(encryptedPath, fileInfo.Size()/2); err != nil {
+		t.Fatalf("could not truncate file: %s", err.Error())
+	}
+
+	// Perform the test
+	var cfg common.Config
+	_, err = decryptFile(encryptedPath, t.TempDir(), []age.Identity{identity}, &extractOptions{restoreOwner: restoreOwnerSkip}, &cfg, io.Discard)
+	if err == nil {
+		t.Fatalf("decryptFile was supposed to fail")
+	} else if !strings.Contains(err.Error(), errTruncatedCiphertext) {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	// truncate within the header
+	if err = os.Truncate(encryptedPath, 20); err != nil {
+		t.Fatalf("could not truncate file: %s", err.Error())
+	}
+	_, err = decryptFile(encryptedPath, t.TempDir(), []age.Identity{identity}, &extractOptions{restoreOwner: restoreOwnerSkip}, &cfg, io.Discard)
+	if err == nil {
+		t.Fatalf("decryptFile was supposed to fail")
+	} else if !strings.Contains(err.Error(), errTruncatedCiphertext) {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+}
+
+func TestDecryptSniffEncryption(t *testing.T) {
+	fmt.Println("Running TestDecryptSniffEncryption...")
+
+	// Setup Test
+	const content = "plain content"
+	identity, _ := age.GenerateX25519Identity()
+
+	var encrypted bytes.Buffer
+	encryptedWriter, _ := age.Encrypt(&encrypted, identity.Recipient())
+	_, _ = io.WriteString(encryptedWriter, content)
+	_ = encryptedWriter.Close()
+
+	var armored bytes.Buffer
+	armorWriter := armor.NewWriter(&armored)
+	encryptedWriter, _ = age.Encrypt(armorWriter, identity.Recipient())
+	_, _ = io.WriteString(encryptedWriter, content)
+	_ = encryptedWriter.Close()
+	_ = armorWriter.Close()
+
+	tests := []struct {
+		name   string
+		data   []byte
+		stderr string
+	}{
+		/* extension and header agree */
+		{"notes.txt.age", encrypted.Bytes(), ""},
+		{"notes.txt", []byte(content), ""},
+		/* extension and header disagree, the header wins */
+		{"notes.txt", encrypted.Bytes(), "warning: \"notes.txt\" is age-encrypted despite missing the .age extension, decrypting it\n"},
+		{"notes.txt.age", []byte(content), "warning: \"notes.txt.age\" is not age-encrypted despite the .age extension, passing it through\n"},
+		/* armored files */
+		{"notes.txt.age", armored.Bytes(), ""},
+	}
+
+	// Perform the test
+	var cfg common.Config
+	for _, test := range tests {
+		inputPath := filepath.Join(t.TempDir(), test.name)
+		if err := os.WriteFile(inputPath, test.data, 0600); err != nil {
+			t.Fatalf("could not write file: %s", err.Error())
+		}
+
+		var stderr bytes.Buffer
+		outputPath, err := decryptFile(inputPath, t.TempDir(), []age.Identity{identity}, &extractOptions{restoreOwner: restoreOwnerSkip}, &cfg, io.Writer(&stderr))
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		data, err := os.ReadFile(outputPath)
+		if err != nil {
+			t.Fatalf("could not read output file: %s", err.Error())
+		}
+		assertEquals(t, "notes.txt", filepath.Base(outputPath), "TestDecryptSniffEncryption.outputPath")
+		assertEquals(t, content, string(data), "TestDecryptSniffEncryption.content")
+		assertEquals(t, test.stderr, stderr.String(), "TestDecryptSniffEncryption.stderr")
+	}
+
+	/* empty streams fall back to the extension */
+	assertEquals(t, true, common.SniffEncryption(bufio.NewReader(strings.NewReader("")), "a.age", io.Discard), "TestDecryptSniffEncryption.empty")
+	assertEquals(t, false, common.SniffEncryption(bufio.NewReader(strings.NewReader("")), "a.txt", io.Discard), "TestDecryptSniffEncryption.empty")
+}
+
+func TestDecryptWrongCliArgs(t *testing.T) {
+	fmt.Println("Running TestDecryptWrongCliArgs...")
+
+	var stdout, stderr bytes.Buffer
+
+	/* test without input file */
+	err := run([]string{appname, "decrypt"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, "wrong number of arguments, decrypt expects 1 or 2 positional arguments", err.Error(), "TestDecryptWrongCliArgs.Error")
+	assertEquals(t, true, strings.HasPrefix(stderr.String(), "Usage: SquirrelUp decrypt "), "TestDecryptWrongCliArgs.stderr")
+	assertEquals(t, false, strings.Contains(stderr.String(), "Rekey command:"), "TestDecryptWrongCliArgs.stderr")
+
+	// clean up
+	stderr.Reset()
+
+	/* test without identity */
+	defaultConfigFilepath = ""
+	err = run([]string{appname, "decrypt", "input.tar.gz.age", "."}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, "no identity configured, decryption is not possible", err.Error(), "TestDecryptWrongCliArgs.Error")
+	assertEquals(t, 0, len(stdout.String()), "TestDecryptWrongCliArgs.stdout")
+}
+
+func TestDecryptArchiveMetadata(t *testing.T) {
+	fmt.Println("Running TestDecryptArchiveMetadata...")
+
+	// Setup Test
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "file.txt"), []byte("test content"), 0600); err != nil {
+		t.Fatalf("could not write file: %s", err.Error())
+	}
+
+	var cfg common.Config
+	filter, err := newArchiveFilter(srcDir, &cfg)
+	if err != nil {
+		t.Fatalf("could not create archive filter: %s", err.Error())
+	}
+	filter.Metadata = common.NewArchiveMetadata(&cfg, "9.9.9", "abcdef")
+	archivePath, _, err := common.ArchiveDirectory(context.Background(), srcDir, &cfg, filter)
+	if err != nil {
+		t.Fatalf("could not archive directory: %s", err.Error())
+	}
+	defer os.Remove(archivePath)
+
+	identity, encryptedPath := setupEncryptedFile(t, archivePath)
+	defer os.Remove(encryptedPath)
+
+	version = "1.0.0"
+	defer func() { version = "" }()
+	var expected_stderr = "warning: archive was created by SquirrelUp 9.9.9, which is newer than this version 1.0.0\n"
+
+	// Perform the test
+	var stderr bytes.Buffer
+	outDir := t.TempDir()
+	_, err = decryptFile(encryptedPath, outDir, []age.Identity{identity}, &extractOptions{restoreOwner: restoreOwnerSkip}, &cfg, &stderr)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, strings.HasSuffix(stderr.String(), expected_stderr), "TestDecryptArchiveMetadata.stderr")
+	data, err := os.ReadFile(filepath.Join(outDir, filepath.Base(srcDir), "file.txt"))
+	if err != nil {
+		t.Fatalf("could not read extracted file: %s", err.Error())
+	}
+	assertEquals(t, "test content", string(data), "TestDecryptArchiveMetadata.content")
+	_, err = os.Lstat(filepath.Join(outDir, common.ArchiveMetadataName))
+	assertEquals(t, true, os.IsNotExist(err), "TestDecryptArchiveMetadata.metadata")
+
+	/* the metadata is not listed */
+	var list bytes.Buffer
+	stderr.Reset()
+	_, err = decryptFile(encryptedPath, outDir, []age.Identity{identity}, &extractOptions{restoreOwner: restoreOwnerSkip, list: &list}, &cfg, &stderr)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, strings.HasSuffix(stderr.String(), expected_stderr), "TestDecryptArchiveMetadata.stderr")
+	assertEquals(t, false, strings.Contains(list.String(), common.ArchiveMetadataName), "TestDecryptArchiveMetadata.list")
+
+	/* archives of older versions are restored without warnings */
+	version = "9.10.0"
+	stderr.Reset()
+	_, err = decryptFile(encryptedPath, t.TempDir(), []age.Identity{identity}, &extractOptions{restoreOwner: restoreOwnerSkip}, &cfg, &stderr)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, false, strings.Contains(stderr.String(), "SquirrelUp 9.9.9"), "TestDecryptArchiveMetadata.stderr")
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+// desktopRunner runs the notifier command `args`, can be overridden in tests.
+var desktopRunner = func(args ...string) error {
+	if _, err := exec.LookPath(args[0]); err != nil {
+		return err
+	}
+	output, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %s: %s", args[0], err.Error(), strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// desktopNotifierCommand returns the command showing a desktop notification with `title` and
+// `message` on the operating system `goos`, nil if there is no notifier for it.
+func desktopNotifierCommand(goos, title, message string) []string {
+	switch goos {
+	case "darwin":
+		quote := func(text string) string {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(text) + `"`
+		}
+		return []string{"osascript", "-e", "display notification " + quote(message) + " with title " + quote(title)}
+	case "windows":
+		quote := func(text string) string {
+			return "'" + strings.ReplaceAll(text, "'", "''") + "'"
+		}
+		script := "[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null; " +
+			"$xml = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02); " +
+			"$text = $xml.GetElementsByTagName('text'); " +
+			"$text.Item(0).AppendChild($xml.CreateTextNode(" + quote(title) + ")) > $null; " +
+			"$text.Item(1).AppendChild($xml.CreateTextNode(" + quote(message) + ")) > $null; " +
+			"[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier(" + quote(appname) + ").Show([Windows.UI.Notifications.ToastNotification]::new($xml))"
+		return []string{"powershell", "-NoProfile", "-NonInteractive", "-Command", script}
+	case "android", "ios", "js", "wasip1", "plan9":
+		return nil
+	}
+	return []string{"notify-send", "--app-name=" + appname, title, message}
+}
+
+// desktopNotification returns title and message of the desktop notification for `summary`.
+func desktopNotification(summary *common.RunSummary) (string, string) {
+	duration := summary.Finished.Sub(summary.Started).Round(time.Second)
+	title := fmt.Sprintf("%s backup %s", appname, summary.Status)
+	message := fmt.Sprintf("%s in %s", summary.Destination, duration)
+	if len(summary.Warnings) > 0 {
+		message += ", " + common.WarningsSummary(summary.Warnings)
+	}
+	if summary.Err != nil {
+		message += ": " + summary.Err.Error()
+	}
+	return title, message
+}
+
+// notifyDesktop shows the outcome of a run as desktop notification. A terminal bell along
+// with the message is written to stderr instead if no notifier is available.
+func notifyDesktop(summary *common.RunSummary, stderr io.Writer) {
+	title, message := desktopNotification(summary)
+	if args := desktopNotifierCommand(runtime.GOOS, title, message); args != nil {
+		if err := desktopRunner(args...); err == nil {
+			return
+		}
+	}
+	fmt.Fprintf(stderr, "\a%s: %s\n", title, message)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+// stubDesktopRunner records the notifier commands run, they fail with `err`.
+func stubDesktopRunner(t *testing.T, err error) *[][]string {
+	var calls [][]string
+	original := desktopRunner
+	desktopRunner = func(args ...string) error {
+		calls = append(calls, args)
+		return err
+	}
+	t.Cleanup(func() { desktopRunner = original })
+	return &calls
+}
+
+func TestDesktopNotifierCommand(t *testing.T) {
+	fmt.Println("Running TestDesktopNotifierCommand...")
+
+	// Perform the test
+	args := desktopNotifierCommand("linux", "title", "message")
+	assertEquals(t, "notify-send|--app-name=SquirrelUp|title|message", strings.Join(args, "|"), "TestDesktopNotifierCommand.linux")
+
+	args = desktopNotifierCommand("darwin", "title", `say "hi" \ bye`)
+	assertEquals(t, `osascript|-e|display notification "say \"hi\" \\ bye" with title "title"`, strings.Join(args, "|"), "TestDesktopNotifierCommand.darwin")
+
+	args = desktopNotifierCommand("windows", "title", "it's done")
+	assertEquals(t, "powershell", args[0], "TestDesktopNotifierCommand.windows")
+	assertEquals(t, true, strings.Contains(args[len(args)-1], "CreateTextNode('it''s done')"), "TestDesktopNotifierCommand.windows")
+	assertEquals(t, true, strings.Contains(args[len(args)-1], "CreateToastNotifier('SquirrelUp')"), "TestDesktopNotifierCommand.windows")
+
+	assertEquals(t, 0, len(desktopNotifierCommand("plan9", "title", "message")), "TestDesktopNotifierCommand.plan9")
+}
+
+func TestNotifyDesktop(t *testing.T) {
+	fmt.Println("Running TestNotifyDesktop...")
+
+	// Setup Test
+	summary := &common.RunSummary{
+		Status:      common.RunFailed,
+		Destination: "b2://bucket/prefix/",
+		Started:     time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC),
+		Finished:    time.Date(2024, 5, 1, 6, 12, 5, 400000000, time.UTC),
+		Err:         errors.New("access denied"),
+	}
+	title, message := desktopNotification(summary)
+	assertEquals(t, "SquirrelUp backup failed", title, "TestNotifyDesktop.title")
+	assertEquals(t, "b2://bucket/prefix/ in 3h12m5s: access denied", message, "TestNotifyDesktop.message")
+
+	/* warnings are counted */
+	summary.Warnings = []common.Warning{{Code: common.WarningCleanup, Message: "failed to clean up backup prefix"}}
+	_, message = desktopNotification(summary)
+	assertEquals(t, "b2://bucket/prefix/ in 3h12m5s, 1 warning (cleanup: 1): access denied", message, "TestNotifyDesktop.message")
+	summary.Warnings = nil
+	title, message = desktopNotification(summary)
+
+	/* the notifier is run */
+	calls := stubDesktopRunner(t, nil)
+	var stderr bytes.Buffer
+	notifyDesktop(summary, &stderr)
+	assertEquals(t, 1, len(*calls), "TestNotifyDesktop.calls")
+	assertEquals(t, true, strings.Contains(strings.Join((*calls)[0], " "), message), "TestNotifyDesktop.args")
+	assertEquals(t, "", stderr.String(), "TestNotifyDesktop.stderr")
+
+	/* unavailable notifiers fall back to the terminal */
+	calls = stubDesktopRunner(t, fmt.Errorf("not available"))
+	notifyDesktop(summary, &stderr)
+	assertEquals(t, 1, len(*calls), "TestNotifyDesktop.calls")
+	assertEquals(t, "\aSquirrelUp backup failed: b2://bucket/prefix/ in 3h12m5s: access denied\n", stderr.String(), "TestNotifyDesktop.stderr")
+}
+
+func TestMainNotifyDesktop(t *testing.T) {
+	fmt.Println("Running TestMainNotifyDesktop...")
+
+	// Setup Test
+	setupDaemon(t, common.NewMemoryBackend())
+	calls := stubDesktopRunner(t, nil)
+	var stdout, stderr bytes.Buffer
+
+	/* backups are reported once they end */
+	err := run([]string{appname, "--notify-desktop", ".", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 1, len(*calls), "TestMainNotifyDesktop.calls")
+	assertEquals(t, true, strings.Contains(strings.Join((*calls)[0], " "), "SquirrelUp backup succeeded"), "TestMainNotifyDesktop.args")
+
+	/* the daemon reports every scheduled backup */
+	*calls = nil
+	scheduleSignals(t, map[int]os.Signal{3: syscall.SIGTERM})
+	err = run([]string{appname, "daemon", "--notify-desktop", ".", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 2, len(*calls), "TestMainNotifyDesktop.calls")
+
+	/* nothing is shown without the switch */
+	*calls = nil
+	err = run([]string{appname, ".", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 0, len(*calls), "TestMainNotifyDesktop.calls")
+}
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"runtime"
+)
+
+// devicesSupported is true if device and FIFO entries can be restored on this platform.
+const devicesSupported = false
+
+// createDevice fails, device and FIFO entries cannot be restored on this platform.
+func createDevice(target string, hdr *tar.Header) error {
+	return fmt.Errorf("could not create %q: device and FIFO entries are not supported on %s", target, runtime.GOOS)
+}
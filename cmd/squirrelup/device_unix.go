@@ -0,0 +1,28 @@
+//go:build unix
+
+package main
+
+import (
+	"archive/tar"
+	"syscall"
+)
+
+// devicesSupported is true if device and FIFO entries can be restored on this platform.
+const devicesSupported = true
+
+// createDevice creates the device or FIFO described by `hdr` at `target`.
+func createDevice(target string, hdr *tar.Header) error {
+	mode := uint32(hdr.Mode & 0777)
+	switch hdr.Typeflag {
+	case tar.TypeChar:
+		mode |= syscall.S_IFCHR
+	case tar.TypeBlock:
+		mode |= syscall.S_IFBLK
+	case tar.TypeFifo:
+		mode |= syscall.S_IFIFO
+	}
+	// device number encoding used by Linux
+	major, minor := uint64(hdr.Devmajor), uint64(hdr.Devminor)
+	dev := (minor & 0xff) | ((major & 0xfff) << 8) | ((minor &^ 0xff) << 12) | ((major &^ 0xfff) << 32)
+	return syscall.Mknod(target, mode, int(dev))
+}
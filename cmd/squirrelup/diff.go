@@ -0,0 +1,340 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"filippo.io/age"
+	"github.com/breezerider/squirrel-up/pkg/common"
+	"github.com/mholt/archiver/v4"
+)
+
+type (
+	// diffEntry is a difference between a backup and the local directory.
+	diffEntry struct {
+		kind    string
+		relPath string
+		// attributes that differ for changed entries
+		changes []string
+	}
+
+	// treeDiff compares archive entries against a local directory. Only the paths seen in the
+	// archive are kept in memory, entries are compared while the archive is streamed.
+	treeDiff struct {
+		root     string
+		hash     bool
+		hook     headerHook
+		ignore   *extractFilter
+		excluded map[string]bool
+
+		seen        map[string]bool
+		removedDirs map[string]bool
+		entries     []diffEntry
+	}
+)
+
+const (
+	// diffMtimeTolerance is the largest difference of modification times not reported as a
+	// change. TAR headers in the USTAR format only store whole seconds.
+	diffMtimeTolerance = time.Second
+
+	diffAdded   = "+"
+	diffRemoved = "-"
+	diffChanged = "~"
+)
+
+// runDiff compares a remote backup archive against a local directory.
+func runDiff(cli_args *cliArgs, stdout, stderr io.Writer) error {
+	var err error
+
+	// process input arguments
+	inputUri, err := url.ParseRequestURI(cli_args.PositionalArgs[0])
+	if err != nil {
+		return fmt.Errorf("could not parse backup URI: %s", err.Error())
+	}
+	var localDirectory string = cli_args.PositionalArgs[1]
+	if isDir, err := isDirectory(localDirectory); !isDir {
+		if err != nil {
+			return fmt.Errorf("local directory must be a valid directory path: %s", err.Error())
+		} else {
+			return fmt.Errorf("local directory must be a valid directory path")
+		}
+	}
+	ignore, err := newExtractFilter(nil, cli_args.Ignore)
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	}
+
+	/* load configuration */
+	var cfg common.Config
+
+	err = loadConfig(cli_args, &cfg, stdout, stderr)
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	}
+
+	/* initialize decryption */
+	var identities []age.Identity
+	identities, err = initIdentities(&cfg, stdout, stderr)
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	}
+	var objectName string = path.Base(inputUri.Path)
+	if len(identities) == 0 && strings.HasSuffix(objectName, ageFileSuffix) {
+		return fmt.Errorf("no identity configured, decryption is not possible")
+	}
+
+	/* initialize the backend */
+	if cli_args.Verbose {
+		fmt.Fprintf(stderr, "intializing backend & verifying settings...\n")
+	}
+	backend, err := common.CreateStorageBackend(inputUri, &cfg)
+	if err != nil {
+		return fmt.Errorf("failed to create backend: %s", err.Error())
+	}
+	if cfg.Backup.ObfuscateNames {
+		inputUri = resolveObfuscatedUri(backend, inputUri, identities, stderr)
+	}
+
+	/* validate input URI */
+	fileinfo, err := backend.GetFileInfo(inputUri)
+	if err != nil {
+		return fmt.Errorf("backend operation failed: %s", err.Error())
+	} else if !fileinfo.IsFile() {
+		return fmt.Errorf("backup URI must be a file path, but a directory prefix was specified: %q", inputUri)
+	}
+
+	/* compare archive entries as they are downloaded */
+	differ := &treeDiff{
+		root:        localDirectory,
+		hash:        cli_args.Hash,
+		ignore:      ignore,
+		seen:        map[string]bool{},
+		removedDirs: map[string]bool{},
+	}
+	differ.hook, err = newHeaderHook(&cfg)
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	}
+	differ.excluded, err = excludedPaths(localDirectory, &cfg)
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	}
+
+	if cli_args.Verbose {
+		fmt.Fprintf(stderr, "comparing %q (%d bytes) against %q...\n", inputUri, fileinfo.Size(), localDirectory)
+	}
+	input, _, err := common.RetrieveStream(context.Background(), backend, inputUri, objectName, identities, stderr)
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	}
+	defer input.Close()
+
+	format, plaintext, err := archiver.Identify("", input)
+	if err != nil && !errors.Is(err, archiver.ErrNoMatch) {
+		return fmt.Errorf("could not identify format of backup %q: %s", inputUri, err.Error())
+	} else if !isTarFormat(format) {
+		return fmt.Errorf("backup %q is not a TAR archive", inputUri)
+	}
+	err = format.(archiver.Extractor).Extract(context.Background(), plaintext, nil, metadataFileHandler(differ.compareEntry, stderr))
+	if err != nil {
+		return fmt.Errorf("could not read backup %q: %s", inputUri, err.Error())
+	}
+	err = differ.walkLocal()
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	}
+
+	/* print a summary ordered by path */
+	counts := differ.print(stdout)
+	if len(differ.entries) > 0 {
+		return fmt.Errorf("backup %q differs from %q: %d added, %d removed, %d changed", inputUri, localDirectory, counts[diffAdded], counts[diffRemoved], counts[diffChanged])
+	}
+	fmt.Fprintf(stdout, "backup %q matches %q\n", inputUri, localDirectory)
+
+	return nil
+}
+
+// skipped reports whether a path relative to the local directory is left out of the comparison.
+func (differ *treeDiff) skipped(relPath string) bool {
+	return relPath == "." || !differ.ignore.match(relPath) || isExcluded(differ.excluded, relPath)
+}
+
+// compareEntry is an archiver.FileHandler comparing an archive entry against the local file.
+func (differ *treeDiff) compareEntry(ctx context.Context, f archiver.File) error {
+	relPath := archiveRelPath(strings.TrimSuffix(f.NameInArchive, "/"), differ.root)
+	if err := checkArchivePath(relPath); err != nil {
+		return err
+	}
+	if differ.skipped(relPath) {
+		return nil
+	}
+	differ.seen[relPath] = true
+
+	localPath := filepath.Join(differ.root, filepath.FromSlash(relPath))
+	info, err := os.Lstat(localPath)
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+		/* contents of a removed directory are covered by its entry */
+		if !isExcluded(differ.removedDirs, path.Dir(relPath)) {
+			differ.entries = append(differ.entries, diffEntry{diffRemoved, relPath, nil})
+		}
+		if f.IsDir() {
+			differ.removedDirs[relPath] = true
+		}
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not stat %q: %s", localPath, err.Error())
+	}
+
+	changes, err := differ.compareFile(f, localPath, info)
+	if err != nil {
+		return err
+	}
+	if len(changes) > 0 {
+		differ.entries = append(differ.entries, diffEntry{diffChanged, relPath, changes})
+		if f.IsDir() && !info.IsDir() {
+			differ.removedDirs[relPath] = true
+		}
+	}
+	return nil
+}
+
+// compareFile lists attributes of the archive entry `f` that differ from the local file.
+func (differ *treeDiff) compareFile(f archiver.File, localPath string, info fs.FileInfo) ([]string, error) {
+	if f.Mode().Type() != info.Mode().Type() {
+		return []string{"type"}, nil
+	}
+
+	var linkTarget string
+	if info.Mode()&fs.ModeSymlink != 0 {
+		var err error
+		if linkTarget, err = os.Readlink(localPath); err != nil {
+			return nil, fmt.Errorf("could not read link %q: %s", localPath, err.Error())
+		}
+	}
+	local, err := tar.FileInfoHeader(info, linkTarget)
+	if err != nil {
+		return nil, fmt.Errorf("could not describe %q: %s", localPath, err.Error())
+	}
+	if differ.hook != nil {
+		differ.hook(local)
+	}
+
+	var changes []string
+	sizeChanged := info.Mode().IsRegular() && f.Size() != info.Size()
+	if sizeChanged {
+		changes = append(changes, "size")
+	}
+	const modeBits = fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky
+	if f.Mode()&modeBits != local.FileInfo().Mode()&modeBits {
+		changes = append(changes, "mode")
+	}
+	if !info.IsDir() {
+		delta := f.ModTime().Sub(info.ModTime())
+		if delta > diffMtimeTolerance || delta < -diffMtimeTolerance {
+			changes = append(changes, "mtime")
+		}
+	}
+	if f.LinkTarget != linkTarget {
+		changes = append(changes, "link")
+	}
+	if differ.hash && info.Mode().IsRegular() && !sizeChanged {
+		same, err := sameContent(f, localPath)
+		if err != nil {
+			return nil, err
+		} else if !same {
+			changes = append(changes, "content")
+		}
+	}
+	return changes, nil
+}
+
+// sameContent compares SHA-256 checksums of the archive entry `f` and the local file.
+func sameContent(f archiver.File, localPath string) (bool, error) {
+	checksum := func(open func() (io.ReadCloser, error)) ([]byte, error) {
+		reader, err := open()
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		hash := sha256.New()
+		if _, err = io.Copy(hash, reader); err != nil {
+			return nil, err
+		}
+		return hash.Sum(nil), nil
+	}
+
+	archived, err := checksum(f.Open)
+	if err != nil {
+		return false, fmt.Errorf("could not read %q from backup: %s", f.NameInArchive, err.Error())
+	}
+	local, err := checksum(func() (io.ReadCloser, error) { return os.Open(filepath.Clean(localPath)) })
+	if err != nil {
+		return false, fmt.Errorf("could not read %q: %s", localPath, err.Error())
+	}
+	return string(archived) == string(local), nil
+}
+
+// walkLocal reports files of the local directory missing from the archive. Contents of an
+// added directory are covered by its entry.
+func (differ *treeDiff) walkLocal() error {
+	err := filepath.WalkDir(differ.root, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(differ.root, filePath)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		if relPath == "." || differ.seen[relPath] {
+			return nil
+		} else if differ.skipped(relPath) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		differ.entries = append(differ.entries, diffEntry{diffAdded, relPath, nil})
+		if d.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not walk local directory: %s", err.Error())
+	}
+	return nil
+}
+
+// print writes differences ordered by path to `output` and returns their number by kind.
+func (differ *treeDiff) print(output io.Writer) map[string]int {
+	sort.SliceStable(differ.entries, func(i, j int) bool {
+		return differ.entries[i].relPath < differ.entries[j].relPath
+	})
+
+	counts := map[string]int{}
+	for _, entry := range differ.entries {
+		counts[entry.kind]++
+		if len(entry.changes) > 0 {
+			fmt.Fprintf(output, "%s %s (%s)\n", entry.kind, entry.relPath, strings.Join(entry.changes, ", "))
+		} else {
+			fmt.Fprintf(output, "%s %s\n", entry.kind, entry.relPath)
+		}
+	}
+	return counts
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+// helper function: create a directory tree, upload its encrypted backup to a MemoryBackend
+// and configure the identity to read it back.
+func setupDiff(t *testing.T) (string, string) {
+	srcDir := filepath.Join(t.TempDir(), "source")
+	for _, dirPath := range []string{"olddir", "cache", "type"} {
+		if err := os.MkdirAll(filepath.Join(srcDir, dirPath), 0755); err != nil {
+			t.Fatalf("could not create directory: %s", err.Error())
+		}
+	}
+	for _, filePath := range []string{"gone.txt", "olddir/a.txt", "olddir/b.txt", "size.txt", "mode.txt", "mtime.txt", "content.txt", "same.txt", "cache/tmp.txt", "type/inner.txt"} {
+		if err := os.WriteFile(filepath.Join(srcDir, filePath), []byte(filePath), 0644); err != nil {
+			t.Fatalf("could not write file: %s", err.Error())
+		}
+	}
+	if err := os.Symlink("same.txt", filepath.Join(srcDir, "link")); err != nil {
+		t.Fatalf("could not create symlink: %s", err.Error())
+	}
+
+	var cfg common.Config
+	archivePath, _, err := archiveDirectory(srcDir, &cfg)
+	if err != nil {
+		t.Fatalf("could not archive directory: %s", err.Error())
+	}
+	defer os.Remove(archivePath)
+	identity, encryptedPath := setupEncryptedFile(t, archivePath)
+	defer os.Remove(encryptedPath)
+
+	memory := common.NewMemoryBackend()
+	setupBackend(t, memory, map[string]string{"SQUIRRELUP_IDENTITY": identity.String()})
+	data, err := os.ReadFile(encryptedPath)
+	if err != nil {
+		t.Fatalf("could not read file: %s", err.Error())
+	}
+	backupUri, _ := url.ParseRequestURI("dummy://bucket/prefix/backup.tar.gz.age")
+	if err := memory.StoreFile(context.Background(), common.StoreRequest{URI: backupUri, BodyAt: bytes.NewReader(data), Length: int64(len(data))}); err != nil {
+		t.Fatalf("could not store file: %s", err.Error())
+	}
+
+	return backupUri.String(), srcDir
+}
+
+func TestDiffRun(t *testing.T) {
+	fmt.Println("Running TestDiffRun...")
+	if !permissionBits {
+		t.Skip("changes of permission bits are not detected on " + runtime.GOOS)
+	}
+
+	// Setup Test
+	backupUri, srcDir := setupDiff(t)
+	var stdout, stderr bytes.Buffer
+
+	/* unchanged directory */
+	err := run([]string{appname, "diff", "--hash", backupUri, srcDir}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, fmt.Sprintf("backup %q matches %q\n", backupUri, srcDir), stdout.String(), "TestDiffRun.stdout")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* one change of each category */
+	modTime := time.Now().Add(time.Hour)
+	content, _ := os.Stat(filepath.Join(srcDir, "content.txt"))
+	for _, step := range []error{
+		os.WriteFile(filepath.Join(srcDir, "new.txt"), []byte("new"), 0644),
+		os.MkdirAll(filepath.Join(srcDir, "newdir", "sub"), 0755),
+		os.WriteFile(filepath.Join(srcDir, "newdir", "sub", "c.txt"), []byte("c"), 0644),
+		os.Remove(filepath.Join(srcDir, "gone.txt")),
+		os.RemoveAll(filepath.Join(srcDir, "olddir")),
+		os.WriteFile(filepath.Join(srcDir, "size.txt"), []byte("size.txt grown"), 0644),
+		os.Chmod(filepath.Join(srcDir, "mode.txt"), 0600),
+		os.Chtimes(filepath.Join(srcDir, "mtime.txt"), modTime, modTime),
+		os.WriteFile(filepath.Join(srcDir, "content.txt"), []byte("CONTENT.TXT"), 0644),
+		os.Chtimes(filepath.Join(srcDir, "content.txt"), content.ModTime(), content.ModTime()),
+		os.Remove(filepath.Join(srcDir, "link")),
+		os.Symlink("size.txt", filepath.Join(srcDir, "link")),
+		os.RemoveAll(filepath.Join(srcDir, "type")),
+		os.WriteFile(filepath.Join(srcDir, "type"), []byte("type"), 0644),
+		os.WriteFile(filepath.Join(srcDir, "cache", "tmp.txt"), []byte("changed"), 0644),
+		os.WriteFile(filepath.Join(srcDir, "cache", "more.txt"), []byte("more"), 0644),
+	} {
+		if step != nil {
+			t.Fatalf("could not modify directory: %s", step.Error())
+		}
+	}
+
+	// Perform the test
+	err = run([]string{appname, "diff", "--ignore", "cache", backupUri, srcDir}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	assertEquals(t, fmt.Sprintf("backup %q differs from %q: 2 added, 2 removed, 5 changed", backupUri, srcDir), fmt.Sprintf("%v", err), "TestDiffRun.err")
+	assertEquals(t, "- gone.txt\n"+
+		"~ link (link)\n"+
+		"~ mode.txt (mode)\n"+
+		"~ mtime.txt (mtime)\n"+
+		"+ new.txt\n"+
+		"+ newdir\n"+
+		"- olddir\n"+
+		"~ size.txt (size)\n"+
+		"~ type (type)\n", stdout.String(), "TestDiffRun.stdout")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* content comparison and ignore patterns */
+	err = run([]string{appname, "diff", "--hash", "--ignore=cache/tmp.txt", "--ignore", "*.txt", "--ignore=type", "--ignore=link", "--ignore=newdir", "--ignore=olddir", backupUri, srcDir}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	assertEquals(t, fmt.Sprintf("backup %q differs from %q: 1 added, 0 removed, 0 changed", backupUri, srcDir), fmt.Sprintf("%v", err), "TestDiffRun.err")
+	assertEquals(t, "+ cache/more.txt\n", stdout.String(), "TestDiffRun.stdout")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	err = run([]string{appname, "diff", "--hash", "--ignore=cache", "--ignore=type", "--ignore=link", "--ignore=newdir", "--ignore=olddir", "--ignore=new.txt", "--ignore=gone.txt", "--ignore=size.txt", "--ignore=mode.txt", "--ignore=mtime.txt", backupUri, srcDir}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	assertEquals(t, fmt.Sprintf("backup %q differs from %q: 0 added, 0 removed, 1 changed", backupUri, srcDir), fmt.Sprintf("%v", err), "TestDiffRun.err")
+	assertEquals(t, "~ content.txt (content)\n", stdout.String(), "TestDiffRun.stdout")
+}
+
+func TestDiffWrongCliArgs(t *testing.T) {
+	fmt.Println("Running TestDiffWrongCliArgs...")
+
+	// Setup Test
+	backupUri, srcDir := setupDiff(t)
+	var stdout, stderr bytes.Buffer
+
+	// Perform the test
+	err := run([]string{appname, "diff", backupUri}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	assertEquals(t, "wrong number of arguments, diff expects exactly 2 positional arguments", fmt.Sprintf("%v", err), "TestDiffWrongCliArgs.err")
+
+	err = run([]string{appname, "diff", backupUri, filepath.Join(srcDir, "missing")}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	assertEquals(t, fmt.Sprintf("local directory must be a valid directory path: stat call failed on %q: stat %s: no such file or directory", filepath.Join(srcDir, "missing"), filepath.Join(srcDir, "missing")), fmt.Sprintf("%v", err), "TestDiffWrongCliArgs.err")
+
+	err = run([]string{appname, "diff", "--ignore", backupUri, srcDir}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	assertEquals(t, "wrong number of arguments, diff expects exactly 2 positional arguments", fmt.Sprintf("%v", err), "TestDiffWrongCliArgs.err")
+
+	/* wrong identity */
+	otherIdentity, _ := age.GenerateX25519Identity()
+	os.Setenv("SQUIRRELUP_IDENTITY", otherIdentity.String())
+	err = run([]string{appname, "diff", backupUri, srcDir}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	assertEquals(t, "could not decrypt file: wrong key: none of the configured identities can decrypt this file", fmt.Sprintf("%v", err), "TestDiffWrongCliArgs.err")
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/mholt/archiver/v4"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+type (
+	// extractOptions controls how entries of a decrypted archive are restored.
+	extractOptions struct {
+		// ownership of extracted files, either restoreOwnerSkip or restoreOwnerPreserve
+		restoreOwner string
+		// selects entries to restore, nil selects all entries
+		filter *extractFilter
+		// entries are printed here instead of being extracted if set
+		list io.Writer
+		// policy for existing files, one of overwriteNever, overwriteOlder or overwriteAlways (default)
+		overwrite string
+		// permissions recorded in the archive are applied, otherwise the umask decides
+		preservePerms bool
+		// setuid and setgid bits are applied along with the permissions
+		preserveSpecial bool
+		// device and FIFO entries are created instead of being skipped
+		allowDevices bool
+		// skipped entries and stripped bits are reported here if set
+		report io.Writer
+
+		// number of restored and skipped entries and of entries with stripped setuid/setgid bits
+		restored int
+		skipped  int
+		stripped int
+	}
+
+	// extractFilter selects archive entries by their names. A pattern selects an entry if it
+	// matches the entry name or the name of one of its parent directories. Patterns are
+	// anchored at the archive root.
+	extractFilter struct {
+		include [][]string
+		exclude [][]string
+		// names of literal include patterns found so far
+		found map[string]bool
+		// true if all include patterns are literal paths
+		literal bool
+	}
+)
+
+const (
+	overwriteNever  = "never"
+	overwriteOlder  = "older"
+	overwriteAlways = "always"
+)
+
+var (
+	// errExtractionComplete stops the extraction once all literal include patterns were restored.
+	errExtractionComplete = errors.New("all included paths were found")
+)
+
+// newExtractFilter parses include and exclude glob patterns. Patterns use the path.Match
+// syntax, with "**" matching any number of path segments. Returns nil without any patterns.
+func newExtractFilter(include, exclude []string) (*extractFilter, error) {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil, nil
+	}
+
+	filter := &extractFilter{found: map[string]bool{}, literal: len(include) > 0}
+	for _, pattern := range include {
+		segments, err := parseFilterPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		filter.include = append(filter.include, segments)
+		if strings.ContainsAny(pattern, "*?[\\") {
+			filter.literal = false
+		}
+	}
+	for _, pattern := range exclude {
+		segments, err := parseFilterPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		filter.exclude = append(filter.exclude, segments)
+	}
+	return filter, nil
+}
+
+// parseFilterPattern splits a glob pattern into path segments and validates them.
+func parseFilterPattern(pattern string) ([]string, error) {
+	segments := archiveNameSegments(pattern)
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("invalid filter pattern %q: pattern is empty", pattern)
+	}
+	for _, segment := range segments {
+		if _, err := path.Match(segment, ""); err != nil {
+			return nil, fmt.Errorf("invalid filter pattern %q: %s", pattern, err.Error())
+		}
+	}
+	return segments, nil
+}
+
+// archiveNameSegments splits an archive entry name into path segments, ignoring leading
+// "./" and trailing slashes.
+func archiveNameSegments(name string) []string {
+	name = strings.Trim(strings.TrimPrefix(name, "./"), "/")
+	if len(name) == 0 || name == "." {
+		return nil
+	}
+	return strings.Split(name, "/")
+}
+
+// matchAny returns the index of the first pattern matching `segments` or one of its parents, -1 otherwise.
+func matchAny(patterns [][]string, segments []string) int {
+	for index, pattern := range patterns {
+		for length := 1; length <= len(segments); length++ {
+			if matchSegments(pattern, segments[:length]) {
+				return index
+			}
+		}
+	}
+	return -1
+}
+
+// match reports whether the entry `name` is selected by the filter.
+func (filter *extractFilter) match(name string) bool {
+	if filter == nil {
+		return true
+	}
+	segments := archiveNameSegments(name)
+	if matchAny(filter.exclude, segments) >= 0 {
+		return false
+	}
+	if len(filter.include) == 0 {
+		return true
+	}
+	index := matchAny(filter.include, segments)
+	if index < 0 {
+		return false
+	}
+	filter.found[strings.Join(filter.include[index], "/")] = true
+	return true
+}
+
+// done reports whether all include patterns are literal paths that were already found and
+// the entry `name` lies outside of all of them. Archives list the contents of a directory
+// next to each other, so no more entries can match once such an entry is reached.
+func (filter *extractFilter) done(name string) bool {
+	if filter == nil || !filter.literal || matchAny(filter.include, archiveNameSegments(name)) >= 0 {
+		return false
+	}
+	for _, pattern := range filter.include {
+		if !filter.found[strings.Join(pattern, "/")] {
+			return false
+		}
+	}
+	return true
+}
+
+// checkArchivePath rejects archive entries with absolute paths, paths on a Windows drive or
+// parent directory references.
+func checkArchivePath(name string) error {
+	if strings.HasPrefix(name, "/") || strings.HasPrefix(name, "\\") || len(filepath.VolumeName(filepath.FromSlash(name))) > 0 {
+		return fmt.Errorf("illegal file path in archive: %q", name)
+	}
+	for _, segment := range strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if segment == ".." {
+			return fmt.Errorf("illegal file path in archive: %q", name)
+		}
+	}
+	return nil
+}
+
+// filteredFileHandler passes entries selected by `filter` to `handler`. Entry paths are checked
+// for all entries, selected or not. Returns errExtractionComplete once no more entries can match.
+func filteredFileHandler(filter *extractFilter, handler archiver.FileHandler) archiver.FileHandler {
+	return func(ctx context.Context, f archiver.File) error {
+		if err := checkArchivePath(f.NameInArchive); err != nil {
+			return err
+		}
+		if !filter.match(f.NameInArchive) {
+			if filter.done(f.NameInArchive) {
+				return errExtractionComplete
+			}
+			return nil
+		}
+		return handler(ctx, f)
+	}
+}
+
+// metadataFileHandler passes entries to `handler` except for the archive metadata, which is
+// only recognized as the first entry. Reasons why the archive may not be restored as created
+// are written to `stderr` as warnings.
+func metadataFileHandler(handler archiver.FileHandler, stderr io.Writer) archiver.FileHandler {
+	first := true
+	return func(ctx context.Context, f archiver.File) error {
+		if !first || f.NameInArchive != common.ArchiveMetadataName {
+			first = false
+			return handler(ctx, f)
+		}
+		first = false
+		reader, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("could not open archive metadata: %s", err.Error())
+		}
+		defer reader.Close()
+		warnArchiveMetadata(reader, stderr)
+		return nil
+	}
+}
+
+// warnArchiveMetadata writes warnings about the archive metadata read from `input` to `stderr`.
+func warnArchiveMetadata(input io.Reader, stderr io.Writer) {
+	metadata, err := common.ReadArchiveMetadata(input)
+	if err != nil {
+		fmt.Fprintf(stderr, "warning: %s\n", err.Error())
+		return
+	}
+	for _, warning := range metadata.Warnings(version) {
+		fmt.Fprintf(stderr, "warning: %s\n", warning)
+	}
+}
+
+// listFileHandler prints names of archive entries to `output`.
+func listFileHandler(output io.Writer) archiver.FileHandler {
+	return func(ctx context.Context, f archiver.File) error {
+		_, err := fmt.Fprintf(output, "%s\n", f.NameInArchive)
+		return err
+	}
+}
+
+// skip reports an entry that was not restored.
+func (options *extractOptions) skip(name, reason string) {
+	options.skipped++
+	if options.report != nil {
+		fmt.Fprintf(options.report, "skipped %q: %s\n", name, reason)
+	}
+}
+
+// replaceable checks the overwrite policy for an entry modified at `modTime` against the file
+// at `target`. Returns the reason if the file must be left alone.
+func (options *extractOptions) replaceable(target string, modTime time.Time) (string, bool) {
+	info, err := os.Lstat(target)
+	if err != nil {
+		return "", true
+	}
+	if info.IsDir() {
+		return "a directory exists at the target path", false
+	}
+	switch options.overwrite {
+	case overwriteNever:
+		return "target exists", false
+	case overwriteOlder:
+		if !info.ModTime().Before(modTime) {
+			return "target is not older than the archived entry", false
+		}
+	}
+	return "", true
+}
+
+// applyAttributes restores ownership, if enabled permissions, and extended attributes of an
+// extracted entry. Setuid and setgid bits are stripped unless `options.preserveSpecial` is set.
+// Directories always stay accessible to the owner, so that their contents can be extracted.
+func (options *extractOptions) applyAttributes(target, name string, mode fs.FileMode, hdr *tar.Header) error {
+	if hdr != nil {
+		// changing the owner clears setuid and setgid bits, so it goes first
+		if err := restoreOwnership(target, hdr, options.restoreOwner); err != nil {
+			return err
+		}
+	}
+	if err := options.applyPermissions(target, name, mode); err != nil {
+		return err
+	}
+	// changing permissions updates the ACL mask, so ACLs go last
+	if hdr != nil {
+		options.restoreXattrs(target, name, hdr)
+	}
+	return nil
+}
+
+// restoreXattrs sets extended attributes and ACLs recorded in `hdr` on `target`. Attributes
+// that cannot be set, e.g. without the privileges to set them, are reported as warnings.
+func (options *extractOptions) restoreXattrs(target, name string, hdr *tar.Header) {
+	for _, err := range common.RestoreXattrs(target, hdr.PAXRecords) {
+		if options.report != nil {
+			fmt.Fprintf(options.report, "warning: could not restore extended attribute of %q: %s\n", name, err.Error())
+		}
+	}
+}
+
+// applyPermissions applies the permissions of an extracted entry if enabled.
+func (options *extractOptions) applyPermissions(target, name string, mode fs.FileMode) error {
+	if !options.preservePerms {
+		return nil
+	}
+
+	perm := mode & (fs.ModePerm | fs.ModeSticky)
+	if mode.IsDir() {
+		perm |= 0700
+	}
+	if special := mode & (fs.ModeSetuid | fs.ModeSetgid); special != 0 {
+		if options.preserveSpecial {
+			perm |= special
+		} else {
+			options.stripped++
+			if options.report != nil {
+				fmt.Fprintf(options.report, "stripped setuid/setgid bits from %q\n", name)
+			}
+		}
+	}
+	return os.Chmod(target, perm)
+}
+
+// isDeviceEntry returns true for character and block device as well as FIFO entries.
+func isDeviceEntry(hdr *tar.Header) bool {
+	switch hdr.Typeflag {
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		return true
+	}
+	return false
+}
+
+// checkSymlinkParents rejects targets under `root` reached through a symbolic link, which an
+// archive could have planted to write outside of `root`.
+func checkSymlinkParents(root, target, name string) error {
+	relPath, err := filepath.Rel(root, filepath.Dir(target))
+	if err != nil || relPath == "." {
+		return err
+	}
+	current := root
+	for _, segment := range strings.Split(relPath, string(filepath.Separator)) {
+		current = filepath.Join(current, segment)
+		info, err := os.Lstat(current)
+		if err != nil {
+			return nil
+		}
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("illegal file path in archive: %q traverses a symbolic link", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/breezerider/squirrel-up/pkg/common"
+	"github.com/mholt/archiver/v4"
+)
+
+// helper function: write a plain TAR archive with the given entries, names ending with a slash
+// are directories. The archive is cut short in the middle of the content of the last entry if
+// `truncate` is set.
+func setupTarArchive(t *testing.T, names []string, truncate bool) string {
+	var headers []*tar.Header
+	for _, name := range names {
+		hdr := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0600}
+		if strings.HasSuffix(name, "/") {
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0700
+		}
+		headers = append(headers, hdr)
+	}
+	return writeTarArchive(t, headers, truncate)
+}
+
+// helper function: write a plain TAR archive with the given headers. Regular files hold their
+// own name. Modification times default to the pinned clock.
+func writeTarArchive(t *testing.T, headers []*tar.Header, truncate bool) string {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range headers {
+		if hdr.ModTime.IsZero() {
+			hdr.ModTime = time.Date(2024, time.May, 1, 0, 0, 0, 0, time.UTC)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(hdr.Name))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("could not write header: %s", err.Error())
+		}
+		if _, err := io.WriteString(tw, hdr.Name[:hdr.Size]); err != nil {
+			t.Fatalf("could not write content: %s", err.Error())
+		}
+	}
+	var data []byte
+	if truncate {
+		data = buf.Bytes()[:buf.Len()-2]
+	} else {
+		_ = tw.Close()
+		data = buf.Bytes()
+	}
+
+	archivePath := filepath.Join(t.TempDir(), "archive.tar")
+	if err := os.WriteFile(archivePath, data, 0600); err != nil {
+		t.Fatalf("could not write archive: %s", err.Error())
+	}
+	return archivePath
+}
+
+// helper function: list regular files under `dirPath` relative to it.
+func listExtracted(t *testing.T, dirPath string) []string {
+	var files []string
+	err := filepath.Walk(dirPath, func(filePath string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			relPath, _ := filepath.Rel(dirPath, filePath)
+			files = append(files, filepath.ToSlash(relPath))
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("could not list extracted files: %s", err.Error())
+	}
+	return files
+}
+
+func TestExtractFilterMatch(t *testing.T) {
+	fmt.Println("Running TestExtractFilterMatch...")
+
+	tests := []struct {
+		include []string
+		exclude []string
+		name    string
+		match   bool
+	}{
+		{nil, nil, "data/a.txt", true},
+		{[]string{"data"}, nil, "data/", true},
+		{[]string{"data"}, nil, "data/sub/a.txt", true},
+		{[]string{"data/"}, nil, "./data/a.txt", true},
+		{[]string{"data"}, nil, "database/a.txt", false},
+		{[]string{"data/sub/a.txt"}, nil, "data/", false},
+		{[]string{"*/a.txt"}, nil, "data/a.txt", true},
+		{[]string{"*/a.txt"}, nil, "data/sub/a.txt", false},
+		{[]string{"**/a.txt"}, nil, "data/sub/a.txt", true},
+		{[]string{"data"}, []string{"*.log"}, "data/b.log", true},
+		{[]string{"data"}, []string{"**/*.log"}, "data/b.log", false},
+		{[]string{"data"}, []string{"data/sub"}, "data/sub/a.txt", false},
+		{nil, []string{"**/cache"}, "home/user/cache/a.txt", false},
+		{nil, []string{"**/cache"}, "home/user/a.txt", true},
+	}
+
+	// Perform the test
+	for index, test := range tests {
+		filter, err := newExtractFilter(test.include, test.exclude)
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		assertEquals(t, test.match, filter.match(test.name), fmt.Sprintf("TestExtractFilterMatch[%d].match", index))
+	}
+
+	/* invalid patterns */
+	_, err := newExtractFilter([]string{"data/[a"}, nil)
+	assertEquals(t, "invalid filter pattern \"data/[a\": syntax error in pattern", fmt.Sprintf("%v", err), "TestExtractFilterMatch.err")
+	_, err = newExtractFilter(nil, []string{"/"})
+	assertEquals(t, "invalid filter pattern \"/\": pattern is empty", fmt.Sprintf("%v", err), "TestExtractFilterMatch.err")
+}
+
+func TestExtractFilterDone(t *testing.T) {
+	fmt.Println("Running TestExtractFilterDone...")
+
+	// Setup Test
+	var handled []string
+	handler := func(ctx context.Context, f archiver.File) error {
+		handled = append(handled, f.NameInArchive)
+		return nil
+	}
+	filter, _ := newExtractFilter([]string{"data", "other.txt"}, []string{"data/b.log"})
+
+	// Perform the test
+	var err error
+	for _, name := range []string{"data/", "data/a.txt", "data/b.log", "data/c.txt", "docs/", "other.txt", "zzz.txt"} {
+		err = filteredFileHandler(filter, handler)(context.Background(), archiver.File{NameInArchive: name})
+		if err != nil {
+			break
+		}
+	}
+	assertEquals(t, errExtractionComplete, err, "TestExtractFilterDone.err")
+	assertEquals(t, "data/ data/a.txt data/c.txt other.txt", strings.Join(handled, " "), "TestExtractFilterDone.handled")
+
+	/* glob patterns never stop early */
+	filter, _ = newExtractFilter([]string{"data", "*.txt"}, nil)
+	assertEquals(t, false, filter.match("data/a.txt") && filter.match("a.txt") && filter.done("zzz/"), "TestExtractFilterDone.glob")
+}
+
+func TestDecryptSelective(t *testing.T) {
+	fmt.Println("Running TestDecryptSelective...")
+
+	// Setup Test
+	archivePath := setupTarArchive(t, []string{"data/", "data/a.txt", "data/b.log", "docs/", "docs/x.txt", "other.txt"}, false)
+	identity, encryptedPath := setupEncryptedFile(t, archivePath)
+	defer os.Remove(encryptedPath)
+	var cfg common.Config
+
+	// Perform the test
+	filter, _ := newExtractFilter([]string{"data", "other.txt"}, []string{"**/*.log"})
+	outDir := t.TempDir()
+	_, err := decryptFile(encryptedPath, outDir, []age.Identity{identity}, &extractOptions{restoreOwner: restoreOwnerSkip, filter: filter}, &cfg, io.Discard)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "data/a.txt other.txt", strings.Join(listExtracted(t, outDir), " "), "TestDecryptSelective.files")
+
+	/* list mode through the command line */
+	defaultConfigFilepath = ""
+	os.Setenv("SQUIRRELUP_IDENTITY", identity.String())
+	defer os.Setenv("SQUIRRELUP_IDENTITY", "")
+	var stdout, stderr bytes.Buffer
+	err = run([]string{appname, "decrypt", "--include", "docs", "--include=other.txt", "--list", encryptedPath, "/nonexistent"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "docs/\ndocs/x.txt\nother.txt\n", stdout.String(), "TestDecryptSelective.stdout")
+
+	/* filters need a TAR archive */
+	plainPath := filepath.Join(t.TempDir(), "notes.txt")
+	_ = os.WriteFile(plainPath, []byte("plain content"), 0600)
+	_, err = decryptFile(plainPath, t.TempDir(), []age.Identity{identity}, &extractOptions{restoreOwner: restoreOwnerSkip, filter: filter}, &cfg, io.Discard)
+	assertEquals(t, fmt.Sprintf("could not select entries of decrypted file '%s': not a TAR archive", plainPath), fmt.Sprintf("%v", err), "TestDecryptSelective.err")
+}
+
+func TestDecryptSelectiveStopsEarly(t *testing.T) {
+	fmt.Println("Running TestDecryptSelectiveStopsEarly...")
+
+	// Setup Test
+	/* the archive is cut short, only reading stops before the end succeeds */
+	archivePath := setupTarArchive(t, []string{"data/", "data/a.txt", "docs/", "docs/truncated.txt"}, true)
+	var cfg common.Config
+
+	// Perform the test
+	filter, _ := newExtractFilter([]string{"data/a.txt"}, nil)
+	outDir := t.TempDir()
+	_, err := decryptFile(archivePath, outDir, nil, &extractOptions{restoreOwner: restoreOwnerSkip, filter: filter}, &cfg, io.Discard)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "data/a.txt", strings.Join(listExtracted(t, outDir), " "), "TestDecryptSelectiveStopsEarly.files")
+
+	filter, _ = newExtractFilter([]string{"data/*.txt"}, nil)
+	_, err = decryptFile(archivePath, t.TempDir(), nil, &extractOptions{restoreOwner: restoreOwnerSkip, filter: filter}, &cfg, io.Discard)
+	assertEquals(t, true, err != nil && strings.Contains(err.Error(), "unexpected EOF"), "TestDecryptSelectiveStopsEarly.err")
+}
+
+func TestDecryptMaliciousEntries(t *testing.T) {
+	fmt.Println("Running TestDecryptMaliciousEntries...")
+
+	tests := []string{"../evil.txt", "/abs/evil.txt", "data/../../evil.txt", "data/..\\..\\evil.txt"}
+	if runtime.GOOS == "windows" {
+		// paths on another drive are absolute on Windows only
+		tests = append(tests, "C:/evil.txt", "C:evil.txt")
+	}
+
+	// Perform the test
+	var cfg common.Config
+	for _, name := range tests {
+		archivePath := setupTarArchive(t, []string{"data/", "data/a.txt", name}, false)
+		parentDir := t.TempDir()
+		outDir := filepath.Join(parentDir, "out")
+		_ = os.Mkdir(outDir, 0700)
+
+		for _, options := range []*extractOptions{
+			{restoreOwner: restoreOwnerSkip},
+			{restoreOwner: restoreOwnerSkip, filter: &extractFilter{include: [][]string{{"data"}}, found: map[string]bool{}}},
+			{restoreOwner: restoreOwnerSkip, list: io.Discard},
+		} {
+			_, err := decryptFile(archivePath, outDir, nil, options, &cfg, io.Discard)
+			assertEquals(t, true, err != nil && strings.Contains(err.Error(), fmt.Sprintf("illegal file path in archive: %q", name)), "TestDecryptMaliciousEntries.err")
+		}
+		assertEquals(t, "out/data/a.txt", strings.Join(listExtracted(t, parentDir), " "), "TestDecryptMaliciousEntries.files")
+	}
+}
+
+func TestExtractSpecialEntries(t *testing.T) {
+	fmt.Println("Running TestExtractSpecialEntries...")
+
+	// Setup Test
+	setUmask(t, 022)
+	headers := []*tar.Header{
+		{Name: "bin/", Typeflag: tar.TypeDir, Mode: 0750},
+		{Name: "bin/suid", Typeflag: tar.TypeReg, Mode: 04755},
+		{Name: "bin/plain", Typeflag: tar.TypeReg, Mode: 0640},
+		{Name: "bin/hard", Typeflag: tar.TypeLink, Linkname: "bin/plain"},
+		{Name: "dev/fifo", Typeflag: tar.TypeFifo, Mode: 0600},
+		{Name: "dev/null", Typeflag: tar.TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3},
+	}
+	var cfg common.Config
+
+	// Perform the test
+	/* setuid bits are stripped, devices and unsupported entries are skipped */
+	archivePath := writeTarArchive(t, headers, false)
+	outDir := t.TempDir()
+	var report bytes.Buffer
+	options := &extractOptions{restoreOwner: restoreOwnerSkip, preservePerms: true, report: &report}
+	_, err := decryptFile(archivePath, outDir, nil, options, &cfg, io.Discard)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "bin/plain bin/suid", strings.Join(listExtracted(t, outDir), " "), "TestExtractSpecialEntries.files")
+	info, _ := os.Stat(filepath.Join(outDir, "bin"))
+	assertEquals(t, fs.ModeDir|0750, info.Mode(), "TestExtractSpecialEntries.bin")
+	info, _ = os.Stat(filepath.Join(outDir, "bin", "suid"))
+	assertEquals(t, fs.FileMode(0755), info.Mode(), "TestExtractSpecialEntries.suid")
+	info, _ = os.Stat(filepath.Join(outDir, "bin", "plain"))
+	assertEquals(t, fs.FileMode(0640), info.Mode(), "TestExtractSpecialEntries.plain")
+	assertEquals(t, "stripped setuid/setgid bits from \"bin/suid\"\n"+
+		"skipped \"bin/hard\": unsupported entry type\n"+
+		"skipped \"dev/fifo\": device and FIFO entries are not allowed\n"+
+		"skipped \"dev/null\": device and FIFO entries are not allowed\n", report.String(), "TestExtractSpecialEntries.report")
+	assertEquals(t, "3 3 1", fmt.Sprintf("%d %d %d", options.restored, options.skipped, options.stripped), "TestExtractSpecialEntries.summary")
+
+	/* permissions are left to the umask */
+	outDir = t.TempDir()
+	options = &extractOptions{restoreOwner: restoreOwnerSkip}
+	if _, err = decryptFile(archivePath, outDir, nil, options, &cfg, io.Discard); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	info, _ = os.Stat(filepath.Join(outDir, "bin", "suid"))
+	assertEquals(t, fs.FileMode(0644), info.Mode(), "TestExtractSpecialEntries.suid")
+	info, _ = os.Stat(filepath.Join(outDir, "bin"))
+	assertEquals(t, fs.ModeDir|0755, info.Mode(), "TestExtractSpecialEntries.bin")
+
+	/* special bits and devices are restored on request, creating devices requires root */
+	if os.Geteuid() != 0 {
+		headers = headers[:len(headers)-1]
+	}
+	archivePath = writeTarArchive(t, headers, false)
+	outDir = t.TempDir()
+	options = &extractOptions{restoreOwner: restoreOwnerSkip, preservePerms: true, preserveSpecial: true, allowDevices: true}
+	if _, err = decryptFile(archivePath, outDir, nil, options, &cfg, io.Discard); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	info, _ = os.Stat(filepath.Join(outDir, "bin", "suid"))
+	assertEquals(t, fs.ModeSetuid|0755, info.Mode(), "TestExtractSpecialEntries.suid")
+	info, _ = os.Lstat(filepath.Join(outDir, "dev", "fifo"))
+	assertEquals(t, fs.ModeNamedPipe|0600, info.Mode(), "TestExtractSpecialEntries.fifo")
+	if os.Geteuid() == 0 {
+		info, _ = os.Lstat(filepath.Join(outDir, "dev", "null"))
+		assertEquals(t, fs.ModeDevice|fs.ModeCharDevice|0666, info.Mode(), "TestExtractSpecialEntries.null")
+		assertEquals(t, uint64(0x103), deviceNumber(info), "TestExtractSpecialEntries.Rdev")
+	}
+	assertEquals(t, 1, options.skipped, "TestExtractSpecialEntries.skipped")
+}
+
+func TestExtractOverwritePolicy(t *testing.T) {
+	fmt.Println("Running TestExtractOverwritePolicy...")
+
+	// Setup Test
+	archivePath := writeTarArchive(t, []*tar.Header{
+		{Name: "old.txt", Typeflag: tar.TypeReg, Mode: 0600},
+		{Name: "new.txt", Typeflag: tar.TypeReg, Mode: 0600},
+		{Name: "link.txt", Typeflag: tar.TypeReg, Mode: 0600},
+	}, false)
+	outsidePath := filepath.Join(t.TempDir(), "outside.txt")
+	setupExisting := func() string {
+		outDir := t.TempDir()
+		for name, modTime := range map[string]time.Time{
+			"old.txt": time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC),
+			"new.txt": time.Date(2024, time.June, 1, 0, 0, 0, 0, time.UTC),
+		} {
+			_ = os.WriteFile(filepath.Join(outDir, name), []byte("existing"), 0600)
+			_ = os.Chtimes(filepath.Join(outDir, name), modTime, modTime)
+		}
+		_ = os.WriteFile(outsidePath, []byte("outside"), 0600)
+		_ = os.Symlink(outsidePath, filepath.Join(outDir, "link.txt"))
+		return outDir
+	}
+	readContents := func(outDir string) string {
+		var contents []string
+		for _, name := range []string{"old.txt", "new.txt", "link.txt"} {
+			data, _ := os.ReadFile(filepath.Join(outDir, name))
+			contents = append(contents, string(data))
+		}
+		data, _ := os.ReadFile(outsidePath)
+		return strings.Join(append(contents, string(data)), " ")
+	}
+	var cfg common.Config
+
+	// Perform the test
+	tests := []struct {
+		overwrite string
+		contents  string
+		skipped   int
+	}{
+		{overwriteNever, "existing existing outside outside", 3},
+		{overwriteOlder, "old.txt existing outside outside", 2},
+		{overwriteAlways, "old.txt new.txt link.txt outside", 0},
+	}
+	for _, test := range tests {
+		outDir := setupExisting()
+		options := &extractOptions{restoreOwner: restoreOwnerSkip, preservePerms: true, overwrite: test.overwrite}
+		if _, err := decryptFile(archivePath, outDir, nil, options, &cfg, io.Discard); err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		assertEquals(t, test.contents, readContents(outDir), "TestExtractOverwritePolicy.contents")
+		assertEquals(t, test.skipped, options.skipped, "TestExtractOverwritePolicy.skipped")
+	}
+
+	/* policy and summary on the command line */
+	defaultConfigFilepath = ""
+	identity, _ := age.GenerateX25519Identity()
+	os.Setenv("SQUIRRELUP_IDENTITY", identity.String())
+	defer os.Setenv("SQUIRRELUP_IDENTITY", "")
+	outDir := setupExisting()
+	var stdout, stderr bytes.Buffer
+	err := run([]string{appname, "decrypt", "--overwrite=older", archivePath, outDir}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, strings.HasSuffix(stdout.String(), "restored 1 entries, skipped 2 entries, stripped setuid/setgid bits from 0 entries\n"), "TestExtractOverwritePolicy.stdout")
+	assertEquals(t, true, strings.HasSuffix(stderr.String(), "skipped \"new.txt\": target is not older than the archived entry\n"+
+		"skipped \"link.txt\": target is not older than the archived entry\n"), "TestExtractOverwritePolicy.stderr")
+
+	err = run([]string{appname, "decrypt", "--overwrite", "sometimes", archivePath, outDir}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	assertEquals(t, `invalid overwrite policy "sometimes", must be "never", "older" or "always"`, fmt.Sprintf("%v", err), "TestExtractOverwritePolicy.err")
+}
+
+func TestExtractSymlinkParent(t *testing.T) {
+	fmt.Println("Running TestExtractSymlinkParent...")
+
+	// Setup Test
+	outsideDir := t.TempDir()
+	archivePath := writeTarArchive(t, []*tar.Header{
+		{Name: "link", Typeflag: tar.TypeSymlink, Linkname: outsideDir},
+		{Name: "link/evil.txt", Typeflag: tar.TypeReg, Mode: 0600},
+	}, false)
+	var cfg common.Config
+
+	// Perform the test
+	_, err := decryptFile(archivePath, t.TempDir(), nil, &extractOptions{restoreOwner: restoreOwnerSkip}, &cfg, io.Discard)
+	assertEquals(t, true, err != nil && strings.HasSuffix(err.Error(), "illegal file path in archive: \"link/evil.txt\" traverses a symbolic link"), "TestExtractSymlinkParent.err")
+	assertEquals(t, 0, len(listExtracted(t, outsideDir)), "TestExtractSymlinkParent.outside")
+}
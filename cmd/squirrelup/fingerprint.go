@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+// fingerprintObjectName is the name of the object storing the fingerprint of the last uploaded backup.
+const fingerprintObjectName = common.FingerprintObjectName
+
+// fingerprintDirectory computes a fingerprint of the directory tree from sorted paths, sizes,
+// modes and modification times of all entries, along with the exclusion and encryption
+// settings and the contents of ignore files, since changing them changes the backup as well.
+// In paranoid mode file contents are hashed as well.
+func fingerprintDirectory(inputDirectory string, cfg *common.Config) (string, error) {
+	hash := sha256.New()
+	paranoid := cfg.Backup.FingerprintParanoid
+
+	/* settings affecting the backup contents */
+	for _, pattern := range cfg.Backup.Exclude {
+		fmt.Fprintf(hash, "exclude\x00%s\n", pattern)
+	}
+	fmt.Fprintf(hash, "ignore\x00%s\n", cfg.Backup.IgnoreFileName)
+	fmt.Fprintf(hash, "encryption\x00%s\x00%s\x00%s\x00%s\n", strings.TrimSpace(cfg.Encryption.Pubkey), cfg.Encryption.PubkeyURL, cfg.Encryption.Command, cfg.Encryption.CommandSuffix)
+
+	// WalkDir visits entries in lexical order, so the fingerprint is deterministic
+	err := filepath.WalkDir(inputDirectory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		relativePath, err := filepath.Rel(inputDirectory, path)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(hash, "%s\x00%d\x00%d\x00%s\x00", filepath.ToSlash(relativePath), info.Size(), info.ModTime().UnixNano(), info.Mode())
+		ignoreFile := len(cfg.Backup.IgnoreFileName) > 0 && d.Name() == cfg.Backup.IgnoreFileName
+		if (paranoid || ignoreFile) && info.Mode().IsRegular() {
+			file, err := os.Open(filepath.Clean(path))
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(hash, file)
+			_ = file.Close()
+			if err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(hash, "\n")
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("could not fingerprint backup directory: %s", err.Error())
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// fingerprintUri returns URI of the fingerprint object under the output prefix.
+func fingerprintUri(outputPrefixUri *url.URL) (*url.URL, error) {
+	uri, err := outputPrefixUri.Parse(fingerprintObjectName)
+	if err != nil {
+		return nil, fmt.Errorf("could not construct fingerprint URI: %s", err.Error())
+	}
+	return uri, nil
+}
+
+// readFingerprint returns the stored fingerprint or an empty string if there is none.
+// A fingerprint encrypted by an older version that cannot be decrypted is reported as a
+// warning and treated as missing.
+func readFingerprint(backend common.StorageBackend, uri *url.URL, keys *auxiliaryKeys, stderr io.Writer) (string, error) {
+	var buf bytes.Buffer
+	err := backend.RetrieveFile(&buf, uri)
+	if err != nil {
+		if err.Error() == common.ErrFileNotFound {
+			return "", nil
+		}
+		return "", fmt.Errorf("could not read fingerprint: %s", err.Error())
+	}
+	data, err := keys.open(buf.Bytes())
+	if err != nil {
+		fmt.Fprintf(stderr, "warning: could not decrypt fingerprint: %s, assuming the backup directory changed\n", err.Error())
+		return "", nil
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// fingerprintMatches tells whether the stored fingerprint `previous` matches `fingerprint`,
+// either as a keyed hash or in plaintext as stored by older versions.
+func fingerprintMatches(previous, fingerprint string, keys *auxiliaryKeys) bool {
+	return len(previous) > 0 && (previous == keys.keyedHash(fingerprint) || previous == fingerprint)
+}
+
+// storeFingerprint replaces the stored fingerprint with a single object upload, it is
+// stored as a keyed hash if recipients are configured.
+func storeFingerprint(backend common.StorageBackend, uri *url.URL, fingerprint string, keys *auxiliaryKeys) error {
+	data := []byte(keys.keyedHash(fingerprint) + "\n")
+	err := backend.StoreFile(context.Background(), common.StoreRequest{URI: uri, BodyAt: bytes.NewReader(data), Length: int64(len(data)), Quiet: true})
+	if err != nil {
+		return fmt.Errorf("could not store fingerprint: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+func TestFingerprintDirectory(t *testing.T) {
+	fmt.Println("Running TestFingerprintDirectory...")
+
+	// Setup Test
+	tmpDir := t.TempDir()
+	filePath := filepath.Join(tmpDir, "file")
+	modified := time.Unix(1000, 0)
+	if err := os.WriteFile(filePath, []byte("test"), 0600); err != nil {
+		t.Fatalf("could not write to temporary file: %s", err.Error())
+	}
+	if err := os.Chtimes(filePath, modified, modified); err != nil {
+		t.Fatalf("could not set file times: %s", err.Error())
+	}
+
+	var cfg common.Config
+	fingerprint := func(paranoid bool) string {
+		cfg.Backup.FingerprintParanoid = paranoid
+		result, err := fingerprintDirectory(tmpDir, &cfg)
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		return result
+	}
+
+	/* fingerprint is stable */
+	fast, paranoid := fingerprint(false), fingerprint(true)
+	assertEquals(t, fast, fingerprint(false), "TestFingerprintDirectory.fast")
+	assertEquals(t, paranoid, fingerprint(true), "TestFingerprintDirectory.paranoid")
+
+	/* content change with same size and modification time */
+	if err := os.WriteFile(filePath, []byte("TEST"), 0600); err != nil {
+		t.Fatalf("could not write to temporary file: %s", err.Error())
+	}
+	if err := os.Chtimes(filePath, modified, modified); err != nil {
+		t.Fatalf("could not set file times: %s", err.Error())
+	}
+	assertEquals(t, fast, fingerprint(false), "TestFingerprintDirectory.fast")
+	assertEquals(t, false, paranoid == fingerprint(true), "TestFingerprintDirectory.paranoid")
+
+	/* modification time change */
+	if err := os.Chtimes(filePath, modified, modified.Add(time.Second)); err != nil {
+		t.Fatalf("could not set file times: %s", err.Error())
+	}
+	assertEquals(t, false, fast == fingerprint(false), "TestFingerprintDirectory.fast")
+	fast = fingerprint(false)
+
+	/* exclusion and encryption settings */
+	cfg.Backup.Exclude = []string{"*.log"}
+	assertEquals(t, false, fast == fingerprint(false), "TestFingerprintDirectory.exclude")
+	cfg.Backup.Exclude = nil
+	cfg.Encryption.Pubkey = "age1mock"
+	assertEquals(t, false, fast == fingerprint(false), "TestFingerprintDirectory.pubkey")
+	cfg.Encryption.Pubkey = ""
+	assertEquals(t, fast, fingerprint(false), "TestFingerprintDirectory.fast")
+
+	/* ignore file content change with same size and modification time */
+	cfg.Backup.IgnoreFileName = ".squirrelignore"
+	ignorePath := filepath.Join(tmpDir, ".squirrelignore")
+	for _, patterns := range []string{"*.tmp\n", "*.log\n"} {
+		if err := os.WriteFile(ignorePath, []byte(patterns), 0600); err != nil {
+			t.Fatalf("could not write to temporary file: %s", err.Error())
+		}
+		if err := os.Chtimes(ignorePath, modified, modified); err != nil {
+			t.Fatalf("could not set file times: %s", err.Error())
+		}
+		assertEquals(t, false, fast == fingerprint(false), "TestFingerprintDirectory.ignore")
+		fast = fingerprint(false)
+	}
+
+	/* inaccessible directory */
+	_, err := fingerprintDirectory(filepath.Join(tmpDir, "missing"), &cfg)
+	if err == nil {
+		t.Fatalf("fingerprintDirectory was supposed to fail")
+	}
+}
+
+func TestFingerprintRun(t *testing.T) {
+	fmt.Println("Running TestFingerprintRun...")
+
+	// Setup Test
+	memory := common.NewMemoryBackend()
+	setupBackend(t, memory, map[string]string{
+		"SQUIRRELUP_BACKUP_SKIP_UNCHANGED": "true",
+		"SQUIRRELUP_BACKUP_HOURS":          "0",
+	})
+
+	tmpDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpDir, "file"), []byte("test"), 0600); err != nil {
+		t.Fatalf("could not write to temporary file: %s", err.Error())
+	}
+	prefixUri, _ := url.ParseRequestURI("dummy://bucket/prefix/")
+
+	/* missing fingerprint object */
+	var stdout, stderr bytes.Buffer
+	args := []string{appname, "--timestamp", "2024-05-01T01:00:00Z", tmpDir, "dummy://bucket/prefix/"}
+	err := run(args, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, fmt.Sprintf(`uploaded backup archive of %q to "dummy://bucket/prefix/2024-05-01T01+0000.tar.gz"
+backup sizes: source N bytes, archive N bytes, uploaded N bytes
+`, tmpDir), maskBackupSizes(stdout.String()), "TestFingerprintRun.stdout")
+
+	filelist, _ := memory.ListFiles(prefixUri)
+	assertEquals(t, 3, len(filelist), "TestFingerprintRun.len(filelist)")
+	assertEquals(t, "prefix/.fingerprint", filelist[0].Name(), "TestFingerprintRun.filelist[0]")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* unchanged directory */
+	args = []string{appname, "--timestamp", "2024-05-01T02:00:00Z", tmpDir, "dummy://bucket/prefix/"}
+	err = run(args, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, bytes.HasSuffix(stdout.Bytes(), []byte(fmt.Sprintf("backup directory %q unchanged, skipped\n", tmpDir))), "TestFingerprintRun.stdout")
+
+	filelist, _ = memory.ListFiles(prefixUri)
+	assertEquals(t, 3, len(filelist), "TestFingerprintRun.len(filelist)")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* changed directory */
+	if err := os.WriteFile(filepath.Join(tmpDir, "other"), []byte("test"), 0600); err != nil {
+		t.Fatalf("could not write to temporary file: %s", err.Error())
+	}
+	args = []string{appname, "--timestamp", "2024-05-01T03:00:00Z", tmpDir, "dummy://bucket/prefix/"}
+	err = run(args, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, strings.HasSuffix(maskBackupSizes(stdout.String()), fmt.Sprintf("uploaded backup archive of %q to \"dummy://bucket/prefix/2024-05-01T03+0000.tar.gz\"\nbackup sizes: source N bytes, archive N bytes, uploaded N bytes\n", tmpDir)), "TestFingerprintRun.stdout")
+
+	filelist, _ = memory.ListFiles(prefixUri)
+	assertEquals(t, 4, len(filelist), "TestFingerprintRun.len(filelist)")
+}
+
+func TestFingerprintRunKeepsNewest(t *testing.T) {
+	fmt.Println("Running TestFingerprintRunKeepsNewest...")
+
+	// Setup Test
+	memory := common.NewMemoryBackend()
+	setupBackend(t, memory, map[string]string{
+		"SQUIRRELUP_BACKUP_SKIP_UNCHANGED": "true",
+		"SQUIRRELUP_BACKUP_HOURS":          "24",
+	})
+
+	tmpDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(tmpDir, "file"), []byte("test"), 0600); err != nil {
+		t.Fatalf("could not write to temporary file: %s", err.Error())
+	}
+	prefixUri, _ := url.ParseRequestURI("dummy://bucket/prefix/")
+
+	var stdout, stderr bytes.Buffer
+	for _, timestamp := range []string{"2024-05-01T01:00:00Z", "2024-05-01T02:00:00Z"} {
+		os.WriteFile(filepath.Join(tmpDir, "file"), []byte(timestamp), 0600)
+		args := []string{appname, "--timestamp", timestamp, tmpDir, "dummy://bucket/prefix/"}
+		if err := run(args, nil, io.Writer(&stdout), io.Writer(&stderr)); err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+	}
+	for key, modified := range map[string]string{"2024-05-01T01+0000.tar.gz": "2024-05-01T01:00:00Z", "2024-05-01T02+0000.tar.gz": "2024-05-01T02:00:00Z"} {
+		uri, _ := prefixUri.Parse(key)
+		timestamp, _ := time.Parse(time.RFC3339, modified)
+		if err := memory.SetFileModified(uri, timestamp); err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+	}
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* unchanged directory, all backups are older than the retention period */
+	args := []string{appname, "--timestamp", "2024-05-10T02:00:00Z", tmpDir, "dummy://bucket/prefix/"}
+	err := run(args, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, bytes.Contains(stdout.Bytes(), []byte(fmt.Sprintf("backup directory %q unchanged, skipped\n", tmpDir))), "TestFingerprintRunKeepsNewest.stdout")
+
+	/* the newest backup survives */
+	var backups []string
+	filelist, _ := memory.ListFiles(prefixUri)
+	for _, fileinfo := range filelist {
+		if common.IsBackupObject(filepath.Base(fileinfo.Name())) {
+			backups = append(backups, fileinfo.Name())
+		}
+	}
+	assertEquals(t, "[prefix/2024-05-01T02+0000.tar.gz]", fmt.Sprint(backups), "TestFingerprintRunKeepsNewest.backups")
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+const getStdoutPath = "-"
+
+func runGet(cli_args *cliArgs, stdout, stderr io.Writer) error {
+	var err error
+
+	// process input arguments
+	inputUri, err := url.ParseRequestURI(cli_args.PositionalArgs[0])
+	if err != nil {
+		return fmt.Errorf("could not parse input URI: %s", err.Error())
+	}
+	var objectName string = path.Base(inputUri.Path)
+	var outputPath string = objectName
+	if common.IsDedupManifest(objectName) {
+		// deduplicated backups are reassembled into an archive
+		outputPath = strings.TrimSuffix(objectName, common.DedupManifestSuffix) + ".tar.gz"
+	} else if cli_args.Decrypt {
+		outputPath = strings.TrimSuffix(outputPath, ageFileSuffix)
+	}
+	if len(cli_args.PositionalArgs) > 1 {
+		outputPath = cli_args.PositionalArgs[1]
+	}
+
+	// keep stdout clean when it receives the downloaded data
+	var output io.Writer = stdout
+	if outputPath == getStdoutPath {
+		stdout = stderr
+	} else if _, err = os.Stat(outputPath); err == nil {
+		return fmt.Errorf("output file %q already exists", outputPath)
+	}
+
+	/* load configuration */
+	var cfg common.Config
+
+	err = loadConfig(cli_args, &cfg, stdout, stderr)
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	}
+
+	/* initialize decryption */
+	var identities []age.Identity
+	if cli_args.Decrypt {
+		if cli_args.Verbose {
+			fmt.Fprintf(stderr, "initializing decryption...\n")
+		}
+		identities, err = initIdentities(&cfg, stdout, stderr)
+		if err != nil {
+			return fmt.Errorf("%s", err.Error())
+		} else if len(identities) == 0 {
+			return fmt.Errorf("no identity configured, decryption is not possible")
+		}
+	}
+
+	/* initialize the backend */
+	if cli_args.Verbose {
+		fmt.Fprintf(stderr, "intializing backend & verifying settings...\n")
+	}
+	backend, err := common.CreateStorageBackend(inputUri, &cfg)
+	if err != nil {
+		return fmt.Errorf("failed to create backend: %s", err.Error())
+	}
+
+	/* resolve logical names of backups with obfuscated names */
+	if cfg.Backup.ObfuscateNames {
+		indexIdentities := identities
+		if !cli_args.Decrypt {
+			indexIdentities, err = initIdentities(&cfg, stdout, stderr)
+			if err != nil {
+				return fmt.Errorf("%s", err.Error())
+			}
+		}
+		inputUri = resolveObfuscatedUri(backend, inputUri, indexIdentities, stderr)
+		if cli_args.Verbose {
+			fmt.Fprintf(stderr, "resolved object URI %q\n", inputUri)
+		}
+	}
+
+	/* validate input URI */
+	fileinfo, err := backend.GetFileInfo(inputUri)
+	if err != nil {
+		return fmt.Errorf("backend operation failed: %s", err.Error())
+	} else if !fileinfo.IsFile() {
+		return fmt.Errorf("input URI must be a file path, but a directory prefix was specified: %q", inputUri)
+	}
+
+	/* download the file */
+	if cli_args.Verbose {
+		fmt.Fprintf(stderr, "downloading %q (%d bytes)...\n", inputUri, fileinfo.Size())
+	}
+	if outputPath == getStdoutPath {
+		_, err = downloadFile(backend, inputUri, objectName, output, identities, &cfg, stderr)
+		if err != nil {
+			return fmt.Errorf("%s", err.Error())
+		}
+		return nil
+	}
+
+	// download into a temporary file next to the output to avoid leaving partial files behind
+	var outputFile *os.File
+	outputFile, err = common.CreateTempFile(filepath.Dir(outputPath), "."+filepath.Base(outputPath)+".part-", cfg.FileMode(common.SecretFile))
+	if err != nil {
+		return fmt.Errorf("could not create temporary file: %s", err.Error())
+	}
+	if len(identities) > 0 || common.IsDedupManifest(objectName) {
+		_, err = downloadFile(backend, inputUri, objectName, outputFile, identities, &cfg, stderr)
+	} else {
+		// pass the file directly to allow concurrent ranged downloads
+		err = downloadToFile(backend, inputUri, fileinfo.Size(), outputFile)
+	}
+	if err == nil {
+		err = outputFile.Close()
+	} else {
+		_ = outputFile.Close()
+	}
+	if err == nil {
+		err = os.Rename(outputFile.Name(), outputPath)
+	}
+	if err != nil {
+		_ = os.Remove(outputFile.Name())
+		return fmt.Errorf("%s", err.Error())
+	}
+	fmt.Fprintf(stdout, "downloaded %q to %q\n", inputUri, outputPath)
+
+	return nil
+}
+
+// downloadFile streams the object under `uri` to `output` with common.Restore, decrypting it
+// when `identities` are given and the object named `name` turns out to be age-encrypted.
+// Deduplicated backups are reassembled from their chunks.
+func downloadFile(backend common.StorageBackend, uri *url.URL, name string, output io.Writer, identities []age.Identity, cfg *common.Config, stderr io.Writer) (int64, error) {
+	result, err := common.Restore(context.Background(), common.RestoreOptions{
+		Object:     uri,
+		Name:       name,
+		Config:     cfg,
+		Backend:    backend,
+		Identities: identities,
+		Output:     output,
+		Stderr:     stderr,
+	})
+	return result.Written, err
+}
+
+// downloadToFile writes the object under `uri` to `output` and verifies its expected `size`.
+func downloadToFile(backend common.StorageBackend, uri *url.URL, size uint64, output *os.File) error {
+	err := backend.RetrieveFile(output, uri)
+	if err != nil {
+		return fmt.Errorf("could not download file: %s", err.Error())
+	}
+
+	fileInfo, err := output.Stat()
+	if err != nil {
+		return fmt.Errorf("could not stat downloaded file: %s", err.Error())
+	}
+	if uint64(fileInfo.Size()) != size {
+		return fmt.Errorf("size mismatch for downloaded file: expected %d, got %d", size, fileInfo.Size())
+	}
+
+	return nil
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+// truncatingBackend is a MemoryBackend whose downloads break off halfway.
+type truncatingBackend struct {
+	*common.MemoryBackend
+}
+
+func (tb *truncatingBackend) RetrieveFile(output io.Writer, uri *url.URL) error {
+	var buf bytes.Buffer
+	if err := tb.MemoryBackend.RetrieveFile(&buf, uri); err != nil {
+		return err
+	}
+	_, _ = output.Write(buf.Bytes()[:buf.Len()/2])
+	return errors.New("connection reset by peer")
+}
+
+func TestGetRun(t *testing.T) {
+	fmt.Println("Running TestGetRun...")
+
+	// Setup Test
+	identity, _ := age.GenerateX25519Identity()
+
+	memory := common.NewMemoryBackend()
+	storeEncrypted(t, memory, "dummy://bucket/prefix/a.tar.gz", "content a", nil)
+	storeEncrypted(t, memory, "dummy://bucket/prefix/b.tar.gz.age", "content b", identity.Recipient())
+	setupBackend(t, memory, nil)
+	tmpDir := t.TempDir()
+
+	/* download to a local file */
+	var stdout, stderr bytes.Buffer
+	outputPath := filepath.Join(tmpDir, "a.tar.gz")
+	err := run([]string{appname, "get", "dummy://bucket/prefix/a.tar.gz", outputPath}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, fmt.Sprintf("downloaded \"dummy://bucket/prefix/a.tar.gz\" to %q\n", outputPath), stdout.String(), "TestGetRun.stdout")
+	data, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatalf("could not read output file: %s", err.Error())
+	}
+	assertEquals(t, "content a", string(data), "TestGetRun.content")
+	assertPerm(t, 0600, outputPath, "TestGetRun.perm")
+
+	/* downloads are created with the configured mode, reduced by the umask */
+	setUmask(t, 022)
+	os.Setenv("SQUIRRELUP_BACKUP_FILE_MODE", "0666")
+	err = run([]string{appname, "get", "dummy://bucket/prefix/a.tar.gz", outputPath + ".shared"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	os.Setenv("SQUIRRELUP_BACKUP_FILE_MODE", "")
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertPerm(t, 0644, outputPath+".shared", "TestGetRun.perm")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* refuse to overwrite an existing file */
+	err = run([]string{appname, "get", "dummy://bucket/prefix/a.tar.gz", outputPath}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, fmt.Sprintf("output file %q already exists", outputPath), err.Error(), "TestGetRun.Error")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* download to stdout */
+	err = run([]string{appname, "get", "-v", "dummy://bucket/prefix/a.tar.gz", "-"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "content a", stdout.String(), "TestGetRun.stdout")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* download and decrypt to stdout */
+	os.Setenv("SQUIRRELUP_IDENTITY", identity.String())
+	defer os.Setenv("SQUIRRELUP_IDENTITY", "")
+
+	err = run([]string{appname, "get", "--decrypt", "dummy://bucket/prefix/b.tar.gz.age", "-"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "content b", stdout.String(), "TestGetRun.stdout")
+	assertEquals(t, false, strings.Contains(stderr.String(), "warning"), "TestGetRun.stderr")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* encryption is detected from the content of renamed objects */
+	storeEncrypted(t, memory, "dummy://bucket/prefix/renamed", "content c", identity.Recipient())
+	err = run([]string{appname, "get", "--decrypt", "dummy://bucket/prefix/renamed", "-"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "content c", stdout.String(), "TestGetRun.stdout")
+	assertEquals(t, true, strings.HasSuffix(stderr.String(), "warning: \"renamed\" is age-encrypted despite missing the .age extension, decrypting it\n"), "TestGetRun.stderr")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* plaintext objects are passed through */
+	storeEncrypted(t, memory, "dummy://bucket/prefix/plain.tar.gz.age", "content d", nil)
+	err = run([]string{appname, "get", "--decrypt", "dummy://bucket/prefix/plain.tar.gz.age", "-"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "content d", stdout.String(), "TestGetRun.stdout")
+	assertEquals(t, true, strings.HasSuffix(stderr.String(), "warning: \"plain.tar.gz.age\" is not age-encrypted despite the .age extension, passing it through\n"), "TestGetRun.stderr")
+}
+
+func TestGetPartialDownload(t *testing.T) {
+	fmt.Println("Running TestGetPartialDownload...")
+
+	// Setup Test
+	memory := common.NewMemoryBackend()
+	storeEncrypted(t, memory, "dummy://bucket/prefix/a.tar.gz", "content a", nil)
+
+	setupBackend(t, &truncatingBackend{memory}, nil)
+	tmpDir := t.TempDir()
+
+	// Perform the test
+	var stdout, stderr bytes.Buffer
+	outputPath := filepath.Join(tmpDir, "a.tar.gz")
+	err := run([]string{appname, "get", "dummy://bucket/prefix/a.tar.gz", outputPath}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, "could not download file: connection reset by peer", err.Error(), "TestGetPartialDownload.Error")
+	assertEquals(t, 0, len(stdout.String()), "TestGetPartialDownload.stdout")
+
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatalf("could not read directory: %s", err.Error())
+	}
+	assertEquals(t, 0, len(entries), "TestGetPartialDownload.entries")
+}
+
+func TestGetDedup(t *testing.T) {
+	fmt.Println("Running TestGetDedup...")
+
+	// Setup Test
+	identity, _ := age.GenerateX25519Identity()
+	memory := common.NewMemoryBackend()
+	setupBackend(t, memory, map[string]string{
+		"SQUIRRELUP_BACKUP_HOURS":           "0",
+		"SQUIRRELUP_BACKUP_DEDUP":           "true",
+		"SQUIRRELUP_BACKUP_DEDUP_CACHE_DIR": t.TempDir(),
+		"SQUIRRELUP_PUBKEY":                 identity.Recipient().String(),
+		"SQUIRRELUP_IDENTITY":               identity.String(),
+	})
+
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "file"), []byte("data"), 0600); err != nil {
+		t.Fatalf("could not write to temporary file: %s", err.Error())
+	}
+	var stdout, stderr bytes.Buffer
+	err := run([]string{appname, "--timestamp", "2024-05-01T03:00:00Z", srcDir, "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	manifestUri := "dummy://bucket/prefix/2024-05-01T03+0000" + common.DedupManifestSuffix
+	assertEquals(t, true, strings.Contains(stdout.String(), fmt.Sprintf("uploaded backup archive of %q to %q, 1 of 1 chunks were new\n", srcDir, manifestUri)), "TestGetDedup.stdout")
+
+	/* deduplicated backups are reassembled into an archive */
+	outputPath := filepath.Join(t.TempDir(), "backup.tar.gz")
+	err = run([]string{appname, "get", "--decrypt", manifestUri, outputPath}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	headers := readArchiveHeaders(t, outputPath)
+	assertEquals(t, true, headers[filepath.Base(srcDir)+"/file"] != nil, "TestGetDedup.headers")
+
+	/* encrypted chunks cannot be reassembled without decryption */
+	err = run([]string{appname, "get", manifestUri, outputPath + ".raw"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	assertEquals(t, true, err != nil && strings.Contains(err.Error(), "an identity is required"), "TestGetDedup.err")
+
+	/* encrypted chunks are named with a key derived from the identity or backup.name_key */
+	t.Setenv("SQUIRRELUP_IDENTITY", "")
+	err = run([]string{appname, "--timestamp", "2024-05-02T03:00:00Z", srcDir, "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("run was supposed to fail")
+	}
+	assertEquals(t, "encrypted deduplicated backups need a key to name their chunks: no name key configured and no X25519 identity to derive it from", err.Error(), "TestGetDedup.Error")
+	t.Setenv("SQUIRRELUP_BACKUP_NAME_KEY", "secret")
+	err = run([]string{appname, "--timestamp", "2024-05-02T03:00:00Z", srcDir, "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+}
+
+func TestGetWrongCliArgs(t *testing.T) {
+	fmt.Println("Running TestGetWrongCliArgs...")
+
+	// Setup Test
+	memory := common.NewMemoryBackend()
+	storeEncrypted(t, memory, "dummy://bucket/prefix/a.tar.gz", "content a", nil)
+	setupBackend(t, memory, nil)
+	var stdout, stderr bytes.Buffer
+
+	/* too many arguments */
+	err := run([]string{appname, "get", "dummy://bucket/prefix/a.tar.gz", "a", "b"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, "wrong number of arguments, get expects 1 or 2 positional arguments", err.Error(), "TestGetWrongCliArgs.Error")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* prefix instead of a file */
+	err = run([]string{appname, "get", "dummy://bucket/prefix/", "-"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, `input URI must be a file path, but a directory prefix was specified: "dummy://bucket/prefix/"`, err.Error(), "TestGetWrongCliArgs.Error")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* missing file */
+	err = run([]string{appname, "get", "dummy://bucket/prefix/missing", "-"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, "backend operation failed: file not found", err.Error(), "TestGetWrongCliArgs.Error")
+	assertEquals(t, 0, len(stdout.String()), "TestGetWrongCliArgs.stdout")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* decryption without an identity */
+	err = run([]string{appname, "get", "--decrypt", "dummy://bucket/prefix/a.tar.gz", "-"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, "no identity configured, decryption is not possible", err.Error(), "TestGetWrongCliArgs.Error")
+}
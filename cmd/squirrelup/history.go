@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
+	"time"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+// recordJournal appends the outcome of the run described by `summary` to the journal if there
+// is one, see common.JournalFilepath. Failures are printed to stderr as warnings only.
+func recordJournal(cfg *common.Config, summary *common.RunSummary, stderr io.Writer) {
+	journalPath := common.JournalFilepath(cfg, defaultConfigFilepath)
+	if len(journalPath) == 0 {
+		return
+	}
+	if err := common.AppendJournal(journalPath, common.NewJournalEntry(summary), cfg.Backup.JournalMaxEntries); err != nil {
+		fmt.Fprintf(stderr, "warning: could not record the backup in the journal %q: %s\n", journalPath, err.Error())
+	}
+}
+
+// runHistory prints the backup runs recorded in the journal, oldest first, without accessing
+// the backend.
+func runHistory(cli_args *cliArgs, stdout, stderr io.Writer) error {
+	var limit int
+	var err error
+	if len(cli_args.Limit) > 0 {
+		limit, err = strconv.Atoi(cli_args.Limit)
+		if err != nil || limit < 1 {
+			return fmt.Errorf("invalid limit %q, must be a positive integer", cli_args.Limit)
+		}
+	}
+
+	/* load configuration */
+	var cfg common.Config
+
+	err = loadConfig(cli_args, &cfg, stdout, stderr)
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	}
+	journalPath := common.JournalFilepath(&cfg, defaultConfigFilepath)
+	if len(journalPath) == 0 {
+		return fmt.Errorf("no journal configured, set backup.journal_path")
+	}
+
+	entries, err := common.ReadJournal(journalPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		if cli_args.Verbose {
+			fmt.Fprintf(stderr, "no backups recorded in %q yet\n", journalPath)
+		}
+		entries = nil
+	} else if err != nil {
+		return fmt.Errorf("could not read journal %q: %s", journalPath, err.Error())
+	}
+	entries = common.QueryJournal(entries, cli_args.Prefix, limit)
+
+	if cli_args.JSON {
+		encoder := json.NewEncoder(stdout)
+		for _, entry := range entries {
+			if err = encoder.Encode(entry); err != nil {
+				return fmt.Errorf("could not print journal entry: %s", err.Error())
+			}
+		}
+		return nil
+	}
+	for _, entry := range entries {
+		status := entry.Status
+		if entry.Skipped {
+			status = "skipped"
+		}
+		duration := (time.Duration(entry.Seconds * float64(time.Second))).Round(time.Second)
+		line := fmt.Sprintf("%s\t%s\t%s\t%d\t%s%s", entry.Time.Format(time.RFC3339), status, duration, entry.UploadedBytes, entry.Destination, entry.Key)
+		if len(entry.Error) > 0 {
+			line += "\t" + entry.Error
+		}
+		fmt.Fprintln(stdout, line)
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+func TestHistory(t *testing.T) {
+	fmt.Println("Running TestHistory...")
+
+	// Setup Test
+	journalPath := filepath.Join(t.TempDir(), "journal.jsonl")
+	setupBackend(t, &bucketUnwritableBackend{common.NewMemoryBackend(), "offline"}, map[string]string{
+		"SQUIRRELUP_BACKUP_JOURNAL_PATH": journalPath,
+		"SQUIRRELUP_BACKUP_HOURS":        "0",
+	})
+	var stdout, stderr bytes.Buffer
+
+	/* every run is recorded, whether it succeeded or not */
+	for _, prefix := range []string{"dummy://bucket/first/", "dummy://offline/second/", "dummy://bucket/third/"} {
+		_ = run([]string{appname, ".", prefix}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	}
+	stdout.Reset()
+	stderr.Reset()
+	err := run([]string{appname, "history"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(stdout.String(), "\n"), "\n")
+	assertEquals(t, 3, len(lines), "TestHistory.lines")
+	assertEquals(t, true, strings.HasPrefix(lines[0], "2024-05-01T03:00:00Z\tsucceeded\t0s\t"), "TestHistory.lines[0]")
+	assertEquals(t, true, strings.HasSuffix(lines[0], "\tdummy://bucket/first/2024-05-01T03+0000.tar.gz"), "TestHistory.lines[0]")
+	assertEquals(t, true, strings.HasPrefix(lines[1], "2024-05-01T03:00:00Z\tfailed\t0s\t"), "TestHistory.lines[1]")
+	assertEquals(t, true, strings.Contains(lines[1], "\tdummy://offline/second/\tunable to write backup archive"), "TestHistory.lines[1]")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* runs are filtered by prefix and limited to the last ones */
+	err = run([]string{appname, "history", "--prefix", "dummy://bucket/", "--limit", "1", "--json"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 1, strings.Count(stdout.String(), "\n"), "TestHistory.stdout")
+	assertEquals(t, true, strings.Contains(stdout.String(), `"destination":"dummy://bucket/third/","key":"2024-05-01T03+0000.tar.gz"`), "TestHistory.stdout")
+	assertEquals(t, true, strings.Contains(stdout.String(), `"upload":"succeeded","cleanup":"skipped"`), "TestHistory.stdout")
+	assertEquals(t, true, strings.Contains(stdout.String(), `"warnings":[{"code":"encryption","message":"no pubkey found, encryption disabled"}],"warning_counts":{"encryption":1}`), "TestHistory.stdout")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* the limit must be a positive integer */
+	err = run([]string{appname, "history", "--limit", "0"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, "invalid limit \"0\", must be a positive integer", err.Error(), "TestHistory.Error")
+}
+
+func TestHistoryJournalErrors(t *testing.T) {
+	fmt.Println("Running TestHistoryJournalErrors...")
+
+	// Setup Test
+	setupBackend(t, common.NewMemoryBackend(), map[string]string{"SQUIRRELUP_BACKUP_HOURS": "0"})
+	var stdout, stderr bytes.Buffer
+
+	/* there is no journal without a default configuration file or backup.journal_path */
+	err := run([]string{appname, "history"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, "no journal configured, set backup.journal_path", err.Error(), "TestHistoryJournalErrors.Error")
+
+	/* the journal is kept next to the default configuration file */
+	configDir := t.TempDir()
+	defaultConfigFilepath = filepath.Join(configDir, "squirrelup.yml")
+	defer func() { defaultConfigFilepath = "" }()
+	err = run([]string{appname, ".", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	entries, err := common.ReadJournal(filepath.Join(configDir, "journal.jsonl"))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 1, len(entries), "TestHistoryJournalErrors.entries")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* a journal that cannot be written does not fail the backup */
+	t.Setenv("SQUIRRELUP_BACKUP_JOURNAL_PATH", configDir)
+	err = run([]string{appname, ".", "dummy://bucket/other/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, strings.Contains(stderr.String(), fmt.Sprintf("warning: could not record the backup in the journal %q: could not open journal: ", configDir)), "TestHistoryJournalErrors.stderr")
+}
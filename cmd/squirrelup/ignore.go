@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+type (
+	// ignorePattern is a single pattern in gitignore syntax.
+	ignorePattern struct {
+		// directory of the ignore file relative to the backup root, "." for the root
+		base     string
+		segments []string
+		negate   bool
+		dirOnly  bool
+		anchored bool
+	}
+
+	// ignoreRules are patterns applying to a directory, the last matching pattern wins.
+	ignoreRules []ignorePattern
+)
+
+// parseIgnorePattern parses a line of an ignore file located in `base`.
+// Returns false for blank lines and comments.
+func parseIgnorePattern(line string, base string) (ignorePattern, bool) {
+	pattern := ignorePattern{base: base}
+
+	// trailing spaces are ignored unless escaped
+	line = strings.TrimRight(line, "\r")
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if len(line) == 0 || strings.HasPrefix(line, "#") {
+		return pattern, false
+	}
+
+	if strings.HasPrefix(line, "!") {
+		pattern.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		pattern.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	// a separator at the beginning or in the middle anchors the pattern to `base`
+	if strings.Contains(line, "/") {
+		pattern.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if len(line) == 0 {
+		return pattern, false
+	}
+
+	// path.Match expects '^' instead of '!' to negate character classes
+	pattern.segments = strings.Split(strings.ReplaceAll(line, "[!", "[^"), "/")
+	return pattern, true
+}
+
+// matchSegments matches path segments against pattern segments, "**" matches any number of segments.
+func matchSegments(patternSegments, pathSegments []string) bool {
+	for len(patternSegments) > 0 {
+		if patternSegments[0] == "**" {
+			if len(patternSegments) == 1 {
+				// trailing "**" matches everything inside
+				return len(pathSegments) > 0
+			}
+			for skip := 0; skip <= len(pathSegments); skip++ {
+				if matchSegments(patternSegments[1:], pathSegments[skip:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(pathSegments) == 0 {
+			return false
+		}
+		if matched, err := path.Match(patternSegments[0], pathSegments[0]); err != nil || !matched {
+			return false
+		}
+		patternSegments, pathSegments = patternSegments[1:], pathSegments[1:]
+	}
+	return len(pathSegments) == 0
+}
+
+// match reports whether the pattern matches a slash-separated path relative to the backup root.
+func (pattern *ignorePattern) match(relPath string, isDir bool) bool {
+	if pattern.dirOnly && !isDir {
+		return false
+	}
+	if pattern.base != "." {
+		if !strings.HasPrefix(relPath, pattern.base+"/") {
+			return false
+		}
+		relPath = strings.TrimPrefix(relPath, pattern.base+"/")
+	}
+	if pattern.anchored {
+		return matchSegments(pattern.segments, strings.Split(relPath, "/"))
+	}
+	return matchSegments(pattern.segments, []string{path.Base(relPath)})
+}
+
+// ignored reports whether a path is excluded by the rules.
+func (rules ignoreRules) ignored(relPath string, isDir bool) bool {
+	for index := len(rules) - 1; index >= 0; index-- {
+		if rules[index].match(relPath, isDir) {
+			return !rules[index].negate
+		}
+	}
+	return false
+}
+
+// readIgnoreFile appends patterns from the ignore file in `dirPath` to `rules`.
+func readIgnoreFile(rules ignoreRules, dirPath, base, ignoreFileName string) (ignoreRules, error) {
+	file, err := os.Open(filepath.Join(dirPath, ignoreFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return rules, nil
+		}
+		return nil, err
+	}
+	defer file.Close()
+
+	// copy the parent rules so sibling directories do not share the backing array
+	rules = append(ignoreRules{}, rules...)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if pattern, ok := parseIgnorePattern(scanner.Text(), base); ok {
+			rules = append(rules, pattern)
+		}
+	}
+	return rules, scanner.Err()
+}
+
+// excludedPaths walks the backup directory and returns slash-separated paths relative to it
+// that are excluded by the configuration or by ignore files. Contents of excluded directories
+// are not walked and thus not listed. Returns nil if no exclusion is configured.
+func excludedPaths(dirPath string, cfg *common.Config) (map[string]bool, error) {
+	if len(cfg.Backup.Exclude) == 0 && len(cfg.Backup.IgnoreFileName) == 0 {
+		return nil, nil
+	}
+
+	var rootRules ignoreRules
+	for _, line := range cfg.Backup.Exclude {
+		if pattern, ok := parseIgnorePattern(line, "."); ok {
+			rootRules = append(rootRules, pattern)
+		}
+	}
+
+	excluded := map[string]bool{}
+	rules := map[string]ignoreRules{}
+	err := filepath.WalkDir(dirPath, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(dirPath, filePath)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+
+		var dirRules ignoreRules
+		if relPath == "." {
+			dirRules = rootRules
+		} else {
+			dirRules = rules[path.Dir(relPath)]
+			if dirRules.ignored(relPath, d.IsDir()) {
+				excluded[relPath] = true
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+
+		if d.IsDir() {
+			if len(cfg.Backup.IgnoreFileName) > 0 {
+				dirRules, err = readIgnoreFile(dirRules, filePath, relPath, cfg.Backup.IgnoreFileName)
+				if err != nil {
+					return err
+				}
+			}
+			rules[relPath] = dirRules
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not apply ignore patterns: %s", err.Error())
+	}
+
+	return excluded, nil
+}
+
+// isExcluded reports whether a path or any of its parent directories is excluded.
+func isExcluded(excluded map[string]bool, relPath string) bool {
+	for ; relPath != "." && relPath != "/" && len(relPath) > 0; relPath = path.Dir(relPath) {
+		if excluded[relPath] {
+			return true
+		}
+	}
+	return false
+}
+
+// archiveRelPath maps a name assigned by archiver.FilesFromDisk to an entry of `dirPath`
+// back to the slash-separated path relative to `dirPath`.
+func archiveRelPath(nameInArchive, dirPath string) string {
+	var root string
+	if !common.HasTrailingSeparator(dirPath) {
+		root = filepath.ToSlash(filepath.Base(dirPath))
+	}
+	if root == "." {
+		// contents of the current directory are stored without a root entry name
+		root = ""
+	}
+	if len(root) > 0 {
+		if nameInArchive == root {
+			return "."
+		}
+		return strings.TrimPrefix(nameInArchive, root+"/")
+	}
+	return nameInArchive
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+func TestIgnorePatterns(t *testing.T) {
+	fmt.Println("Running TestIgnorePatterns...")
+
+	// test vectors adapted from the gitignore documentation and git's test suite
+	tests := []struct {
+		patterns []string
+		relPath  string
+		isDir    bool
+		expected bool
+	}{
+		/* plain names match at any depth */
+		{[]string{"foo"}, "foo", false, true},
+		{[]string{"foo"}, "a/b/foo", false, true},
+		{[]string{"foo"}, "a/foo", true, true},
+		{[]string{"foo"}, "foobar", false, false},
+		/* comments, blank lines and escapes */
+		{[]string{"# foo", "", "   "}, "# foo", false, false},
+		{[]string{"\\#foo"}, "#foo", false, true},
+		{[]string{"\\!foo"}, "!foo", false, true},
+		{[]string{"foo   "}, "foo", false, true},
+		{[]string{"foo\\ "}, "foo ", false, true},
+		/* globs */
+		{[]string{"*.log"}, "debug.log", false, true},
+		{[]string{"*.log"}, "logs/debug.log", false, true},
+		{[]string{"*.log"}, "debug.log.1", false, false},
+		{[]string{"debug?.log"}, "debug1.log", false, true},
+		{[]string{"debug?.log"}, "debug10.log", false, false},
+		{[]string{"debug[0-9].log"}, "debug7.log", false, true},
+		{[]string{"debug[!0-9].log"}, "debug7.log", false, false},
+		{[]string{"debug[!0-9].log"}, "debuga.log", false, true},
+		/* directory patterns */
+		{[]string{"build/"}, "build", true, true},
+		{[]string{"build/"}, "build", false, false},
+		{[]string{"build/"}, "src/build", true, true},
+		/* anchored patterns */
+		{[]string{"/foo"}, "foo", false, true},
+		{[]string{"/foo"}, "a/foo", false, false},
+		{[]string{"doc/frotz"}, "doc/frotz", false, true},
+		{[]string{"doc/frotz"}, "a/doc/frotz", false, false},
+		{[]string{"doc/*.txt"}, "doc/notes.txt", false, true},
+		{[]string{"doc/*.txt"}, "doc/server/arch.txt", false, false},
+		/* double asterisks */
+		{[]string{"**/foo"}, "foo", false, true},
+		{[]string{"**/foo"}, "a/b/foo", false, true},
+		{[]string{"**/foo/bar"}, "a/foo/bar", false, true},
+		{[]string{"abc/**"}, "abc/x/y", false, true},
+		{[]string{"abc/**"}, "abc", true, false},
+		{[]string{"a/**/b"}, "a/b", false, true},
+		{[]string{"a/**/b"}, "a/x/y/b", false, true},
+		{[]string{"a/**/b"}, "x/a/b", false, false},
+		/* negation, the last matching pattern wins */
+		{[]string{"*.log", "!important.log"}, "important.log", false, false},
+		{[]string{"*.log", "!important.log"}, "debug.log", false, true},
+		{[]string{"!important.log", "*.log"}, "important.log", false, true},
+	}
+
+	// Perform the test
+	for _, test := range tests {
+		var rules ignoreRules
+		for _, line := range test.patterns {
+			if pattern, ok := parseIgnorePattern(line, "."); ok {
+				rules = append(rules, pattern)
+			}
+		}
+		assertEquals(t, test.expected, rules.ignored(test.relPath, test.isDir),
+			fmt.Sprintf("TestIgnorePatterns(%q, %q)", test.patterns, test.relPath))
+	}
+
+	/* patterns from a nested ignore file are relative to its directory */
+	pattern, _ := parseIgnorePattern("/cache", "app")
+	rules := ignoreRules{pattern}
+	assertEquals(t, true, rules.ignored("app/cache", true), "TestIgnorePatterns.nested")
+	assertEquals(t, false, rules.ignored("cache", true), "TestIgnorePatterns.nested")
+	assertEquals(t, false, rules.ignored("other/app/cache", true), "TestIgnorePatterns.nested")
+}
+
+func TestArchiveRelPath(t *testing.T) {
+	fmt.Println("Running TestArchiveRelPath...")
+
+	assertEquals(t, ".", archiveRelPath("dir", "/path/to/dir"), "TestArchiveRelPath")
+	assertEquals(t, "a/b", archiveRelPath("dir/a/b", "/path/to/dir"), "TestArchiveRelPath")
+	assertEquals(t, "a/b", archiveRelPath("a/b", "/path/to/dir/"), "TestArchiveRelPath")
+	assertEquals(t, "a/b", archiveRelPath("a/b", "."), "TestArchiveRelPath")
+}
+
+func TestIgnoreArchive(t *testing.T) {
+	fmt.Println("Running TestIgnoreArchive...")
+
+	// Setup Test
+	srcDir := t.TempDir()
+	for name, content := range map[string]string{
+		".squirrelignore":          "*.tmp\ncache/\n",
+		"keep.txt":                 "keep",
+		"drop.tmp":                 "drop",
+		"cache/data":               "cache",
+		"app/.squirrelignore":      "!*.tmp\n/logs\n.squirrelignore\n",
+		"app/keep.tmp":             "keep",
+		"app/logs/today.log":       "log",
+		"app/sub/logs/today.log":   "log",
+		"app/sub/secret.key":       "secret",
+		"other/.squirrelignore":    "",
+		"other/drop.tmp":           "drop",
+		"other/nested/cache/entry": "cache",
+	} {
+		filePath := filepath.Join(srcDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			t.Fatalf("could not create directory: %s", err.Error())
+		}
+		if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+			t.Fatalf("could not write file: %s", err.Error())
+		}
+	}
+
+	var cfg common.Config
+	if err := cfg.SetDefaultValues(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	cfg.Backup.Exclude = []string{"*.key"}
+
+	archivedFiles := func() string {
+		archivePath, _, err := archiveDirectory(srcDir, &cfg)
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		defer os.Remove(archivePath)
+
+		var names []string
+		for name, header := range readArchiveHeaders(t, archivePath) {
+			if !header.FileInfo().IsDir() {
+				names = append(names, strings.TrimPrefix(name, filepath.Base(srcDir)+"/"))
+			}
+		}
+		sort.Strings(names)
+		return strings.Join(names, "\n")
+	}
+
+	// Perform the test
+	assertEquals(t, `.squirrelignore
+app/keep.tmp
+app/sub/logs/today.log
+keep.txt
+other/.squirrelignore`, archivedFiles(), "TestIgnoreArchive.files")
+
+	/* renamed ignore file */
+	cfg.Backup.IgnoreFileName = ".backupignore"
+	cfg.Backup.Exclude = nil
+	assertEquals(t, 12, len(strings.Split(archivedFiles(), "\n")), "TestIgnoreArchive.files")
+}
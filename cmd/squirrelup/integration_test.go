@@ -0,0 +1,194 @@
+//go:build integration
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+// smallest part size accepted by S3-compatible services, archives just above it are
+// uploaded in two parts
+const integrationPartSize = 5 * 1024 * 1024
+
+// uploadedRegexp matches the URI of the object stored by a backup in its output.
+var uploadedRegexp = regexp.MustCompile(`uploaded backup archive of ".*" to "(.+)"`)
+
+// helper function: run the backup of `srcDir` to `prefixUri` at the nominal time `timestamp`
+// and return the URI of the stored object.
+func runIntegrationBackup(t *testing.T, srcDir string, prefixUri *url.URL, timestamp time.Time) *url.URL {
+	var stdout, stderr bytes.Buffer
+	err := run([]string{appname, "--allow-empty", "--timestamp", timestamp.Format(time.RFC3339), srcDir, prefixUri.String()}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("backup failed: %s\n%s", err.Error(), stderr.String())
+	}
+	match := uploadedRegexp.FindStringSubmatch(stdout.String())
+	if match == nil {
+		t.Fatalf("backup did not report the stored object:\n%s", stdout.String())
+	}
+	objectUri, err := url.ParseRequestURI(match[1])
+	if err != nil {
+		t.Fatalf("could not parse object URI: %s", err.Error())
+	}
+	return objectUri
+}
+
+// helper function: names of the backup archives stored under `prefixUri`.
+func integrationArchives(t *testing.T, backend common.StorageBackend, prefixUri *url.URL) []string {
+	files, err := backend.ListFiles(prefixUri)
+	if err != nil {
+		t.Fatalf("could not list remote files: %s", err.Error())
+	}
+	var names []string
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".tar.gz") {
+			names = append(names, path.Base(file.Name()))
+		}
+	}
+	return names
+}
+
+// helper function: check the object at `objectUri` holds `size` bytes.
+func assertIntegrationObject(t *testing.T, backend common.StorageBackend, objectUri *url.URL, size uint64, name string) {
+	fileinfo, err := backend.GetFileInfo(objectUri)
+	if err != nil {
+		t.Fatalf("%s: could not get file info: %s", name, err.Error())
+	}
+	assertEquals(t, true, fileinfo.IsFile(), name+".IsFile")
+	assertEquals(t, size, fileinfo.Size(), name+".Size")
+
+	var buf bytes.Buffer
+	if err = backend.RetrieveFile(&buf, objectUri); err != nil {
+		t.Fatalf("%s: could not retrieve file: %s", name, err.Error())
+	}
+	assertEquals(t, size, uint64(buf.Len()), name+".Len")
+}
+
+// TestIntegration runs the backup pipeline end to end against the bucket prefix given by
+// SQUIRRELUP_IT_URI, e.g. a B2 bucket or a local MinIO server set with SQUIRRELUP_S3_ENDPOINT.
+// Credentials are read from SQUIRRELUP_S3_ID and SQUIRRELUP_S3_SECRET. Everything runs below
+// a fresh prefix, which is removed once the test finishes, including after failures.
+// Run with: go test -tags integration -run TestIntegration ./cmd/squirrelup
+func TestIntegration(t *testing.T) {
+	fmt.Println("Running TestIntegration...")
+
+	base := os.Getenv("SQUIRRELUP_IT_URI")
+	if base == "" {
+		t.Skip("SQUIRRELUP_IT_URI is not set")
+	}
+	if os.Getenv("SQUIRRELUP_S3_ID") == "" || os.Getenv("SQUIRRELUP_S3_SECRET") == "" {
+		t.Skip("SQUIRRELUP_S3_ID and SQUIRRELUP_S3_SECRET are required")
+	}
+	baseUri, err := url.ParseRequestURI(strings.TrimSuffix(base, "/") + "/")
+	if err != nil {
+		t.Fatalf("could not parse SQUIRRELUP_IT_URI: %s", err.Error())
+	}
+	prefixUri, err := baseUri.Parse(fmt.Sprintf("squirrelup-it-%d/", time.Now().UnixNano()))
+	if err != nil {
+		t.Fatalf("could not construct the test prefix: %s", err.Error())
+	}
+
+	// Setup Test
+	defaultConfigFilepath = ""
+	t.Setenv("SQUIRRELUP_PUBKEY", "")
+	t.Setenv("SQUIRRELUP_BACKUP_HOURS", "24")
+	t.Setenv("SQUIRRELUP_S3_PART_SIZE_BYTES", strconv.Itoa(integrationPartSize))
+
+	var cfg common.Config
+	if err = cfg.SetDefaultValues(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if err = cfg.LoadConfigFromEnv(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	cfg.Internal.Reporter = &common.DummyProgressReporter{}
+	backend, err := common.CreateStorageBackend(prefixUri, &cfg)
+	if err != nil {
+		t.Fatalf("failed to create backend: %s", err.Error())
+	}
+	t.Cleanup(func() {
+		files, err := backend.ListFiles(prefixUri)
+		if err != nil {
+			t.Errorf("could not list %q to clean up: %s", prefixUri, err.Error())
+			return
+		}
+		for _, file := range files {
+			if err := backend.RemoveFile(file.URI()); err != nil {
+				t.Errorf("could not remove %q: %s", file.URI(), err.Error())
+			}
+		}
+	})
+
+	srcDir := t.TempDir()
+	if err = os.WriteFile(filepath.Join(srcDir, "file.txt"), []byte("test content"), 0600); err != nil {
+		t.Fatalf("could not write to temporary file: %s", err.Error())
+	}
+	start := time.Now().UTC().Truncate(time.Hour)
+
+	// Perform the test
+	/* small upload */
+	smallUri := runIntegrationBackup(t, srcDir, prefixUri, start)
+	smallInfo, err := backend.GetFileInfo(smallUri)
+	if err != nil {
+		t.Fatalf("could not get file info: %s", err.Error())
+	}
+	assertEquals(t, true, smallInfo.Size() < integrationPartSize, "TestIntegration.small.Size")
+	assertIntegrationObject(t, backend, smallUri, smallInfo.Size(), "TestIntegration.small")
+	assertEquals(t, path.Base(smallUri.Path), strings.Join(integrationArchives(t, backend, prefixUri), ","), "TestIntegration.archives")
+
+	/* multipart upload just above the part size, random data does not compress */
+	random := make([]byte, integrationPartSize+64*1024)
+	_, _ = rand.Read(random)
+	if err = os.WriteFile(filepath.Join(srcDir, "random.bin"), random, 0600); err != nil {
+		t.Fatalf("could not write to temporary file: %s", err.Error())
+	}
+	largeUri := runIntegrationBackup(t, srcDir, prefixUri, start.Add(time.Hour))
+	largeInfo, err := backend.GetFileInfo(largeUri)
+	if err != nil {
+		t.Fatalf("could not get file info: %s", err.Error())
+	}
+	assertEquals(t, true, largeInfo.Size() > integrationPartSize, "TestIntegration.large.Size")
+	assertEquals(t, true, largeInfo.Size() < 2*integrationPartSize, "TestIntegration.large.Size")
+	assertIntegrationObject(t, backend, largeUri, largeInfo.Size(), "TestIntegration.large")
+	assertEquals(t, path.Base(smallUri.Path)+","+path.Base(largeUri.Path), strings.Join(integrationArchives(t, backend, prefixUri), ","), "TestIntegration.archives")
+
+	/* list */
+	var stdout, stderr bytes.Buffer
+	if err = run([]string{appname, "list", prefixUri.String()}, nil, io.Writer(&stdout), io.Writer(&stderr)); err != nil {
+		t.Fatalf("list failed: %s\n%s", err.Error(), stderr.String())
+	}
+	assertEquals(t, true, strings.Contains(stdout.String(), "\t"+path.Base(smallUri.Path)+"\n"), "TestIntegration.list")
+	assertEquals(t, true, strings.Contains(stdout.String(), "\t"+path.Base(largeUri.Path)+"\n"), "TestIntegration.list")
+
+	/* retention removes both backups once they are older than 24 hours */
+	if err = os.Remove(filepath.Join(srcDir, "random.bin")); err != nil {
+		t.Fatalf("could not remove temporary file: %s", err.Error())
+	}
+	latestUri := runIntegrationBackup(t, srcDir, prefixUri, start.Add(48*time.Hour))
+	for name, objectUri := range map[string]*url.URL{"small": smallUri, "large": largeUri} {
+		_, err = backend.GetFileInfo(objectUri)
+		assertEquals(t, common.ErrFileNotFound, fmt.Sprintf("%v", err), "TestIntegration."+name+".removed")
+	}
+	assertEquals(t, path.Base(latestUri.Path), strings.Join(integrationArchives(t, backend, prefixUri), ","), "TestIntegration.archives")
+
+	/* object removal */
+	if err = backend.RemoveFile(latestUri); err != nil {
+		t.Fatalf("could not remove remote file: %s", err.Error())
+	}
+	_, err = backend.GetFileInfo(latestUri)
+	assertEquals(t, common.ErrFileNotFound, fmt.Sprintf("%v", err), "TestIntegration.latest.removed")
+	assertEquals(t, 0, len(integrationArchives(t, backend, prefixUri)), "len(TestIntegration.archives)")
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+// maxKeyFilePerm is the loosest permission accepted for files holding recipients.
+const maxKeyFilePerm os.FileMode = 0644
+
+// checkKeyFile warns about properties of the recipients file at `keyPath` that would allow
+// others to replace the recipients of future backups, similar to the checks OpenSSH applies
+// to its key files. Fails instead if `cfg.Encryption.StrictKeyPerms` is set.
+func checkKeyFile(keyPath string, cfg *common.Config, stderr io.Writer) error {
+	info, err := os.Stat(keyPath)
+	if err != nil {
+		// reported when the file is opened
+		return nil
+	}
+
+	var problems []string
+	if permissionBits {
+		if perm := info.Mode().Perm(); info.Mode().IsRegular() && perm&^maxKeyFilePerm != 0 {
+			problems = append(problems, fmt.Sprintf("has permissions %04o, which are looser than %04o", perm, maxKeyFilePerm))
+		}
+	}
+	problems = append(problems, keyFileOwnerProblems(info)...)
+	// the sticky bit keeps others from renaming or removing the file
+	if dirInfo, err := os.Stat(filepath.Dir(keyPath)); permissionBits && err == nil && dirInfo.Mode().Perm()&0002 != 0 && dirInfo.Mode()&os.ModeSticky == 0 {
+		problems = append(problems, fmt.Sprintf("is located in the world-writable directory %q without the sticky bit", filepath.Dir(keyPath)))
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+
+	if cfg.Encryption.StrictKeyPerms {
+		return fmt.Errorf("pubkey file %q is not safe: %s", keyPath, strings.Join(problems, ", "))
+	}
+	for _, problem := range problems {
+		message := fmt.Sprintf("pubkey file %q %s, others may be able to replace the backup recipients", keyPath, problem)
+		fmt.Fprintf(stderr, "WARNING: %s\n", message)
+		cfg.Internal.Warnings.Add(common.WarningPermissions, keyPath, message)
+	}
+	return nil
+}
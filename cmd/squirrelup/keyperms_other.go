@@ -0,0 +1,17 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+)
+
+// permissionBits is false, file modes are derived from the read-only attribute and access is
+// controlled by ACLs on this platform.
+var permissionBits = false
+
+// keyFileOwnerProblems does not check ownership, it is not exposed by os.FileInfo on this
+// platform.
+func keyFileOwnerProblems(info os.FileInfo) []string {
+	return nil
+}
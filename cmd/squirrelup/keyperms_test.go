@@ -0,0 +1,131 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+// helper function: write a recipients file with `perm` to a directory with `dirPerm`.
+func writeKeyFile(t *testing.T, perm, dirPerm os.FileMode) string {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("could not generate identity: %s", err.Error())
+	}
+	dirPath := filepath.Join(t.TempDir(), "keys")
+	keyPath := filepath.Join(dirPath, "recipients.txt")
+	if err = os.Mkdir(dirPath, 0700); err != nil {
+		t.Fatalf("could not create directory: %s", err.Error())
+	}
+	if err = os.WriteFile(keyPath, []byte(identity.Recipient().String()+"\n"), 0600); err != nil {
+		t.Fatalf("could not write to temporary file: %s", err.Error())
+	}
+	if err = os.Chmod(keyPath, perm); err != nil {
+		t.Fatalf("could not change permissions: %s", err.Error())
+	}
+	if err = os.Chmod(dirPath, dirPerm); err != nil {
+		t.Fatalf("could not change permissions: %s", err.Error())
+	}
+	return keyPath
+}
+
+func TestCheckKeyFile(t *testing.T) {
+	fmt.Println("Running TestCheckKeyFile...")
+
+	var cfg common.Config
+	var stderr bytes.Buffer
+
+	/* safe files are accepted silently */
+	for _, perm := range []os.FileMode{0600, 0644, 0400} {
+		keyPath := writeKeyFile(t, perm, 0755)
+		assertEquals(t, nil, checkKeyFile(keyPath, &cfg, &stderr), "TestCheckKeyFile.err")
+		assertEquals(t, "", stderr.String(), "TestCheckKeyFile.stderr")
+	}
+
+	/* loose permissions */
+	keyPath := writeKeyFile(t, 0666, 0755)
+	assertEquals(t, nil, checkKeyFile(keyPath, &cfg, &stderr), "TestCheckKeyFile.err")
+	assertEquals(t, fmt.Sprintf("WARNING: pubkey file %q has permissions 0666, which are looser than 0644, others may be able to replace the backup recipients\n", keyPath), stderr.String(), "TestCheckKeyFile.stderr")
+	stderr.Reset()
+
+	/* world-writable directory, the sticky bit protects the file */
+	keyPath = writeKeyFile(t, 0644, 0777)
+	assertEquals(t, nil, checkKeyFile(keyPath, &cfg, &stderr), "TestCheckKeyFile.err")
+	assertEquals(t, fmt.Sprintf("WARNING: pubkey file %q is located in the world-writable directory %q without the sticky bit, others may be able to replace the backup recipients\n", keyPath, filepath.Dir(keyPath)), stderr.String(), "TestCheckKeyFile.stderr")
+	stderr.Reset()
+
+	keyPath = writeKeyFile(t, 0644, 0777|os.ModeSticky)
+	assertEquals(t, nil, checkKeyFile(keyPath, &cfg, &stderr), "TestCheckKeyFile.err")
+	assertEquals(t, "", stderr.String(), "TestCheckKeyFile.stderr")
+
+	/* strict mode fails */
+	cfg.Encryption.StrictKeyPerms = true
+	keyPath = writeKeyFile(t, 0664, 0777)
+	err := checkKeyFile(keyPath, &cfg, &stderr)
+	if err == nil {
+		t.Fatalf("checkKeyFile was supposed to fail")
+	}
+	assertEquals(t, fmt.Sprintf("pubkey file %q is not safe: has permissions 0664, which are looser than 0644, is located in the world-writable directory %q without the sticky bit", keyPath, filepath.Dir(keyPath)), err.Error(), "TestCheckKeyFile.err")
+	assertEquals(t, "", stderr.String(), "TestCheckKeyFile.stderr")
+
+	/* missing files are reported when opened */
+	assertEquals(t, nil, checkKeyFile(filepath.Join(t.TempDir(), "missing"), &cfg, &stderr), "TestCheckKeyFile.err")
+}
+
+func TestCheckKeyFileWithoutPermissionBits(t *testing.T) {
+	fmt.Println("Running TestCheckKeyFileWithoutPermissionBits...")
+
+	var cfg common.Config
+	var stderr bytes.Buffer
+	keyPath := writeKeyFile(t, 0666, 0777)
+	permissionBits = false
+	t.Cleanup(func() { permissionBits = true })
+
+	/* modes are not checked where they do not restrict access, like on Windows */
+	cfg.Encryption.StrictKeyPerms = true
+	assertEquals(t, nil, checkKeyFile(keyPath, &cfg, &stderr), "TestCheckKeyFileWithoutPermissionBits.err")
+	assertEquals(t, "", stderr.String(), "TestCheckKeyFileWithoutPermissionBits.stderr")
+}
+
+func TestCheckKeyFileOwner(t *testing.T) {
+	fmt.Println("Running TestCheckKeyFileOwner...")
+	if os.Getuid() != 0 {
+		t.Skip("changing the owner of files requires root")
+	}
+
+	var cfg common.Config
+	var stderr bytes.Buffer
+	keyPath := writeKeyFile(t, 0644, 0755)
+	if err := os.Chown(keyPath, 65534, 65534); err != nil {
+		t.Fatalf("could not change owner: %s", err.Error())
+	}
+
+	assertEquals(t, nil, checkKeyFile(keyPath, &cfg, &stderr), "TestCheckKeyFileOwner.err")
+	assertEquals(t, true, strings.Contains(stderr.String(), "is owned by another user (uid 65534)"), "TestCheckKeyFileOwner.stderr")
+}
+
+func TestMainStrictKeyPerms(t *testing.T) {
+	fmt.Println("Running TestMainStrictKeyPerms...")
+	pinClock(t)
+
+	// Setup Test
+	defaultConfigFilepath = ""
+	t.Setenv("SQUIRRELUP_PUBKEY", writeKeyFile(t, 0666, 0755))
+	t.Setenv("SQUIRRELUP_ENCRYPTION_STRICT_KEY_PERMS", "true")
+
+	// Perform the test
+	var stdout, stderr bytes.Buffer
+	err := run([]string{appname, ".", "dummy://bucket/prefix/"}, nil, &stdout, &stderr)
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, true, strings.HasSuffix(err.Error(), "has permissions 0666, which are looser than 0644"), "TestMainStrictKeyPerms.Error")
+}
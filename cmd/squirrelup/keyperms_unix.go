@@ -0,0 +1,26 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// permissionBits is true if file modes report who may access a file, can be overridden in
+// tests.
+var permissionBits = true
+
+// keyFileOwnerProblems reports if the file described by `info` is owned by a user other
+// than the current one or root.
+func keyFileOwnerProblems(info os.FileInfo) []string {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	if uid := int(stat.Uid); uid != 0 && uid != os.Getuid() {
+		return []string{fmt.Sprintf("is owned by another user (uid %d)", uid)}
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+func TestBackupLease(t *testing.T) {
+	fmt.Println("Running TestBackupLease...")
+
+	// Setup Test
+	memory := common.NewMemoryBackend()
+	setupBackend(t, memory, map[string]string{
+		"SQUIRRELUP_BACKUP_HOURS":    "0",
+		"SQUIRRELUP_BACKUP_LEASE":    "true",
+		"SQUIRRELUP_BACKUP_HOSTNAME": "host-a",
+	})
+	leaseUri, _ := url.ParseRequestURI("dummy://bucket/prefix/" + common.LeaseObjectName)
+	var stdout, stderr bytes.Buffer
+
+	/* the lease is removed once the backup is done */
+	err := run([]string{appname, ".", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	if _, err = memory.GetFileInfo(leaseUri); err == nil {
+		t.Fatalf("lease was supposed to be removed")
+	}
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* a backup fails while another host holds the lease */
+	data, _ := json.Marshal(&common.Lease{Host: "host-b", PID: 42, Expires: common.Now().Add(time.Hour)})
+	if err = memory.StoreFile(context.Background(), common.StoreRequest{URI: leaseUri, BodyAt: bytes.NewReader(data), Length: int64(len(data))}); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	err = run([]string{appname, "--timestamp", "2024-05-01T04:00:00Z", ".", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, true, strings.HasPrefix(err.Error(), `could not acquire lease: prefix "dummy://bucket/prefix/" is being written by host host-b (pid 42) until 2024-05-01T04:00:00Z`), "TestBackupLease.Error")
+	backupUri, _ := url.ParseRequestURI("dummy://bucket/prefix/2024-05-01T04+0000.tar.gz")
+	if _, err = memory.GetFileInfo(backupUri); err == nil {
+		t.Fatalf("backup was not supposed to be stored")
+	}
+}
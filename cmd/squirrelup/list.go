@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+// runList lists backups stored under a prefix with common.List. The catalog is used if
+// present, otherwise the backups are listed from the prefix contents.
+func runList(cli_args *cliArgs, stdout, stderr io.Writer) error {
+	backend, prefixUri, keys, cfg, err := prefixBackend(cli_args, stdout, stderr)
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	}
+
+	uri, err := catalogUri(prefixUri)
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	}
+	backups, err := common.List(context.Background(), prefixUri, cfg, common.ListOptions{
+		Backend: backend,
+		Recorded: func(ctx context.Context, backend common.StorageBackend) ([]common.BackupInfo, bool) {
+			catalog, err := readCatalog(backend, uri, keys)
+			if err != nil {
+				if err.Error() != common.ErrFileNotFound {
+					fmt.Fprintf(stderr, "warning: %s, listing objects instead\n", err.Error())
+				} else if cli_args.Verbose {
+					fmt.Fprintf(stderr, "no backup catalog found, listing objects instead\n")
+				}
+				return nil, false
+			}
+			return catalog.backups(prefixUri), true
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	}
+
+	for _, backup := range backups {
+		if backup.Verified == nil {
+			fmt.Fprintf(stdout, "%s\t%d\t%s\n", backup.Time.Format(time.RFC3339), backup.Size, backup.Key)
+			continue
+		}
+		// append the outcome of the last verification
+		var outcome string = "passed"
+		if !backup.Verified.Passed {
+			outcome = "failed"
+		}
+		fmt.Fprintf(stdout, "%s\t%d\t%s\tverified %s %s\n", backup.Time.Format(time.RFC3339), backup.Size, backup.Key, backup.Verified.Time.Format(time.RFC3339), outcome)
+	}
+	return nil
+}
+
+// runRebuildCatalog replaces the catalog stored under a prefix with one built from its contents.
+func runRebuildCatalog(cli_args *cliArgs, stdout, stderr io.Writer) error {
+	backend, prefixUri, keys, _, err := prefixBackend(cli_args, stdout, stderr)
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	}
+
+	catalog, err := rebuildCatalog(backend, prefixUri, keys)
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	}
+	fmt.Fprintf(stdout, "rebuilt catalog of %q with %d entries\n", prefixUri, len(catalog.Entries))
+	return nil
+}
+
+// prefixBackend loads the configuration and initializes the backend for the prefix URI
+// given as the only positional argument, along with the keys for auxiliary objects and the
+// configuration.
+func prefixBackend(cli_args *cliArgs, stdout, stderr io.Writer) (common.StorageBackend, *url.URL, *auxiliaryKeys, *common.Config, error) {
+	prefixUri, err := parsePrefixUri(cli_args.PositionalArgs[0], cli_args.Verbose, stderr)
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("could not parse prefix URI: %s", err.Error())
+	}
+
+	var cfg common.Config
+	err = loadConfig(cli_args, &cfg, stdout, stderr)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	keys, err := initAuxiliaryKeys(&cfg, stdout, stderr)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	if cli_args.Verbose {
+		fmt.Fprintf(stderr, "intializing backend & verifying settings...\n")
+	}
+	backend, err := common.CreateStorageBackend(prefixUri, &cfg)
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("failed to create backend: %s", err.Error())
+	}
+	return backend, prefixUri, keys, &cfg, nil
+}
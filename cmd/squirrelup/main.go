@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"errors"
 	"fmt"
@@ -10,46 +11,111 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	"filippo.io/age"
 	"github.com/breezerider/squirrel-up/pkg/common"
-	"github.com/mholt/archiver/v4"
 )
 
 type (
 	cliArgs struct {
-		Verbose        bool
-		ConfigFilepath string
-		PositionalArgs []string
+		Command             string
+		Verbose             bool
+		NoProgress          bool
+		StrictEnv           bool
+		DryRun              bool
+		AllowEmpty          bool
+		AllowNested         bool
+		Decrypt             bool
+		ConfigFilepath      string
+		Filter              string
+		Timestamp           string
+		RestoreOwner        string
+		ResumeUpload        string
+		List                bool
+		Include             []string
+		Exclude             []string
+		Overwrite           string
+		PreserveOwner       bool
+		NoPreservePerms     bool
+		PreserveSpecial     bool
+		AllowDevices        bool
+		Hash                bool
+		Ignore              []string
+		Sample              string
+		Seed                string
+		Latest              bool
+		MaxAge              string
+		Record              bool
+		InputFormat         string
+		NotifyDesktop       bool
+		PrintPlan           bool
+		PlanOnly            bool
+		KeepLocal           string
+		Also                []string
+		EncryptionRoundtrip bool
+		Prefix              string
+		Limit               string
+		JSON                bool
+		Yes                 bool
+		NoPreflight         bool
+		StatPrefix          bool
+		PositionalArgs      []string
+
+		// reporter displays progress in verbose mode, it is closed when run returns.
+		reporter common.ProgressReporter
+		// stdin provides the backup source if it is read from standard input
+		stdin io.Reader
 	}
 
 	progressWriter struct {
 		common.ProgressReporter
 		Index int
 	}
+
+	// warningError reports a backup that is stored safely, but whose follow-up steps failed
+	// or whose size is suspicious.
+	warningError struct {
+		message string
+	}
+
+	// timeoutError reports a backup aborted after exceeding backup.max_duration_minutes.
+	timeoutError struct {
+		message string
+	}
 )
 
 const (
 	appname = "SquirrelUp"
 
-	usage = `Usage: %s <backup_dir> <output_prefix_uri>
-    Create an (optionally) encrypted gzip-compressed TAR file and upload it to storage backend.
-    At the moment only BackBlaze B2 cloud storage is implemented.
-
-Required arguments:
-    <backup_dir>                  Path to local directory that serves as backup root.
-    <output_prefix_uri>           Remote URI prefix.
-
-Optional arguments:
-    --config, -c <config_file>    Path to local config file.
-    --verbose, -v                 Verbose output.
-
-BackBlaze B2 Backend:
-    <output_prefix_uri> must follow the pattern 'b2://<bucket>/<path>/<to>/<prefix>/'.
-
-Default configuration is stored under %s.
-`
+	commandBackup  = "backup"
+	commandDecrypt = "decrypt"
+	commandRekey   = "rekey"
+	commandGet     = "get"
+	commandDaemon  = "daemon"
+	commandCheck   = "check"
+	commandList    = "list"
+	commandRebuild = "rebuild-catalog"
+	commandDiff    = "diff"
+	commandVerify  = "verify-prefix"
+	commandConfig  = "config"
+	commandCreds   = "credentials"
+	commandHistory = "history"
+
+	// exitWarning is the exit code used when the backup is stored, but cleanup failed or its
+	// size deviates from previous backups.
+	exitWarning = 2
+
+	// exitTimeout is the exit code used when the backup exceeded its maximum duration.
+	exitTimeout = 3
+
+	// stdinSourcePath reads the backup source from standard input instead of a directory.
+	stdinSourcePath = "-"
+
+	// maxRecipients is the maximum number of recipients accepted from a pubkey file, every
+	// recipient adds a stanza to the header of each encrypted archive.
+	maxRecipients = 20
 )
 
 var (
@@ -59,19 +125,20 @@ var (
 	defaultConfigFilepath string
 )
 
+func (we *warningError) Error() string {
+	return we.message
+}
+
+func (te *timeoutError) Error() string {
+	return te.message
+}
+
 func (pw *progressWriter) Write(p []byte) (n int, err error) {
 	n = len(p)
 	err = pw.AdvanceTask(pw.Index, int64(n))
 	return
 }
 
-// return the usage string.
-func usageString(name string) string {
-	var builder strings.Builder
-	fmt.Fprintf(&builder, usage, name, defaultConfigFilepath)
-	return builder.String()
-}
-
 // isDirectory returns true if a path points to a directory.
 func isDirectory(path string) (bool, error) {
 	fileInfo, err := os.Stat(path)
@@ -84,8 +151,18 @@ func isDirectory(path string) (bool, error) {
 
 // see https://pace.dev/blog/2020/02/12/why-you-shouldnt-use-func-main-in-golang-by-mat-ryer.html
 func main() {
+	if len(defaultConfigFilepath) == 0 {
+		defaultConfigFilepath = runtimeConfigFilepath()
+	}
 	if err := run(os.Args, os.Stdin, os.Stdout, os.Stderr); err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
+		var warning *warningError
+		var timeout *timeoutError
+		if errors.As(err, &warning) {
+			os.Exit(exitWarning)
+		} else if errors.As(err, &timeout) {
+			os.Exit(exitTimeout)
+		}
 		os.Exit(1)
 	}
 }
@@ -93,45 +170,168 @@ func main() {
 func run(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
 	/* handle input arguments */
 	var cli_args cliArgs
-	var err error
 
 	if terminate, err := parseArgs(args, &cli_args, stdout, stderr); err != nil {
 		return fmt.Errorf("%s", err.Error())
 	} else if terminate {
 		return nil
 	}
+	defer closeReporter(&cli_args)
+	cli_args.stdin = stdin
+
+	switch cli_args.Command {
+	case commandDecrypt:
+		return runDecrypt(&cli_args, stdout, stderr)
+	case commandRekey:
+		return runRekey(&cli_args, stdout, stderr)
+	case commandGet:
+		return runGet(&cli_args, stdout, stderr)
+	case commandDaemon:
+		return runDaemon(&cli_args, stdout, stderr)
+	case commandCheck:
+		return runCheck(&cli_args, stdout, stderr)
+	case commandList:
+		return runList(&cli_args, stdout, stderr)
+	case commandRebuild:
+		return runRebuildCatalog(&cli_args, stdout, stderr)
+	case commandDiff:
+		return runDiff(&cli_args, stdout, stderr)
+	case commandVerify:
+		return runVerifyPrefix(&cli_args, stdout, stderr)
+	case commandConfig:
+		return runConfig(&cli_args, stdout, stderr)
+	case commandCreds:
+		return runCredentials(&cli_args, stdout, stderr)
+	case commandHistory:
+		return runHistory(&cli_args, stdout, stderr)
+	}
 
-	// process first input argument
+	return runBackup(&cli_args, stdout, stderr)
+}
+
+// runBackup creates a backup of the input directory and uploads it under the output prefix.
+// The outcome is sent as notification if configured, see common.SendNotification.
+func runBackup(cli_args *cliArgs, stdout, stderr io.Writer) (err error) {
+	notification := newRunNotification(cli_args.PositionalArgs[0], cli_args.PositionalArgs[1], stderr)
+	notification.desktop = cli_args.NotifyDesktop
+	defer func() { notification.send(err, stderr) }()
+	stderr = notification.log
+
+	// process first input argument, a TAR stream is read from standard input instead of '-'
 	var inputDirectory string = cli_args.PositionalArgs[0]
-	if isDir, err := isDirectory(inputDirectory); !isDir {
-		if err != nil {
-			return fmt.Errorf("first argument must be a valid directory path: %s", err.Error())
-		} else {
-			return fmt.Errorf("first argument must be a valid directory path")
+	streamed, err := streamedSource(cli_args)
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	}
+	if !streamed {
+		if isDir, err := isDirectory(inputDirectory); !isDir {
+			if err != nil {
+				return fmt.Errorf("first argument must be a valid directory path: %s", err.Error())
+			} else {
+				return fmt.Errorf("first argument must be a valid directory path")
+			}
 		}
 	}
 
+	// removing old backups is confirmed when run on a terminal
+	confirm := cleanupConfirmation(cli_args, streamed, stderr)
+
 	// process second input argument
-	outputPrefixUri, err := url.ParseRequestURI(cli_args.PositionalArgs[1])
+	outputPrefixUri, err := parsePrefixUri(cli_args.PositionalArgs[1], cli_args.Verbose, stderr)
 	if err != nil {
 		return fmt.Errorf("could not parse output URI: %s", err.Error())
 	}
 
-	/* load configuration */
+	// determine nominal time of the backup
+	var nominalTime time.Time = common.Now()
+	if len(cli_args.Timestamp) > 0 {
+		nominalTime, err = time.Parse(time.RFC3339, cli_args.Timestamp)
+		if err != nil {
+			return fmt.Errorf("could not parse timestamp, expecting RFC3339 format: %s", err.Error())
+		}
+	}
+
+	/* load configuration, warnings of the run are summarized once it ends */
 	var cfg common.Config
+	cfg.Internal.Warnings = new(common.Warnings)
+	cfg.Internal.LongRunning = cli_args.Command == commandDaemon
 
-	if cli_args.Verbose {
-		fmt.Fprintf(stderr, "loading configuration...\n")
-	}
-	if len(cli_args.ConfigFilepath) == 0 {
-		cli_args.ConfigFilepath = defaultConfigFilepath
-	}
-	err = initConfig(&cfg, cli_args.ConfigFilepath, stdout, stderr)
+	err = loadConfig(cli_args, &cfg, stdout, stderr)
 	if err != nil {
 		return fmt.Errorf("%s", err.Error())
 	}
-	if cli_args.Verbose {
-		cfg.Internal.Reporter = common.NewMultiProgressbarReporter(stdout)
+	notification.cfg = &cfg
+
+	/* initialize encryption, refusing unencrypted backups before touching the backup
+	   directory or the backend if encryption is required */
+	var recipients []age.Recipient
+	if len(cli_args.ResumeUpload) == 0 {
+		if cli_args.Verbose {
+			fmt.Fprintf(stderr, "initializing encryption...\n")
+		}
+		recipients, err = initEncryption(&cfg, stdout, stderr)
+		if err != nil {
+			return fmt.Errorf("%s", err.Error())
+		}
+		err = common.CheckEncryptionPolicy(&cfg, recipients)
+		if err != nil {
+			return fmt.Errorf("%s", err.Error())
+		}
+	}
+
+	/* scope the output prefix to this host */
+	if cfg.Backup.PerHostPrefix {
+		outputPrefixUri, err = hostPrefixUri(outputPrefixUri, &cfg)
+		if err != nil {
+			return fmt.Errorf("%s", err.Error())
+		}
+		if cli_args.Verbose {
+			fmt.Fprintf(stderr, "using per-host output prefix %q\n", outputPrefixUri)
+		}
+	}
+	notification.summary.Destination = outputPrefixUri.String()
+
+	/* the backup is copied to mirrors once stored under the output prefix */
+	var mirrors []common.BackupMirror
+	for _, mirror := range cfg.Backup.Mirrors {
+		mirrorUri, err := parsePrefixUri(mirror, cli_args.Verbose, stderr)
+		if err != nil {
+			return fmt.Errorf("could not parse mirror URI: %s", err.Error())
+		}
+		if cfg.Backup.PerHostPrefix {
+			mirrorUri, err = hostPrefixUri(mirrorUri, &cfg)
+			if err != nil {
+				return fmt.Errorf("%s", err.Error())
+			}
+		}
+		if len(cli_args.ResumeUpload) == 0 && !streamed && !cli_args.AllowNested {
+			if err = checkNestedDestination(inputDirectory, mirrorUri); err != nil {
+				return fmt.Errorf("%s", err.Error())
+			}
+		}
+		mirrors = append(mirrors, common.BackupMirror{Destination: mirrorUri})
+	}
+
+	/* refuse to archive previous backups stored inside the input directory */
+	if len(cli_args.ResumeUpload) == 0 && !streamed {
+		if !cli_args.AllowNested {
+			err = checkNestedDestination(inputDirectory, outputPrefixUri)
+			if err != nil {
+				return fmt.Errorf("%s", err.Error())
+			}
+		}
+		warnNestedTempDir(inputDirectory, stderr)
+	}
+
+	/* check the input directory is not (nearly) empty */
+	if !cli_args.AllowEmpty && len(cli_args.ResumeUpload) == 0 && !streamed {
+		if cli_args.Verbose {
+			fmt.Fprintf(stderr, "checking backup directory size...\n")
+		}
+		err = checkDirectorySize(inputDirectory, &cfg)
+		if err != nil {
+			return fmt.Errorf("%s", err.Error())
+		}
 	}
 
 	/* initialize the backend */
@@ -142,163 +342,462 @@ func run(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
 	if err != nil {
 		return fmt.Errorf("failed to create backend: %s", err.Error())
 	}
+	if cli_args.Verbose {
+		if err = probeBackend(cli_args, backend, outputPrefixUri, stderr, stderr); err != nil {
+			return err
+		}
+	}
 
-	/* validate output URI */
-	fileinfo, err := backend.GetFileInfo(outputPrefixUri)
+	/* validate output URI, keys restricted to a name prefix may not be allowed to list it */
+	listable, err := validateOutputPrefix(cli_args, backend, &cfg, outputPrefixUri, stdout, stderr)
 	if err != nil {
-		if err.Error() == common.ErrFileNotFound {
-			fmt.Fprintf(stderr, "file %q not found\n", outputPrefixUri)
-		} else {
-			return fmt.Errorf("backend operation failed: %s", err.Error())
+		return err
+	}
+
+	/* complete an interrupted upload instead of creating a new backup */
+	if len(cli_args.ResumeUpload) > 0 {
+		release, err := holdLease(backend, &cfg, outputPrefixUri, stderr)
+		if err != nil {
+			return err
 		}
-	} else {
-		fmt.Fprintf(stdout, "file info: %+v\n", *fileinfo)
-		if fileinfo.IsFile() {
-			return fmt.Errorf("output URI must be a directory prefix, but a file path was specified: %q", outputPrefixUri)
+		defer release()
+		return resumeUpload(backend, &cfg, nominalTime, outputPrefixUri, cli_args.ResumeUpload, confirm, stdout, stderr)
+	}
+
+	/* identities are only needed to read encrypted auxiliary objects and the backup index,
+	   backups do not wait for passphrases of identity files */
+	var identities []age.Identity
+	cfg.Internal.NoPrompt = true
+	identities, err = initIdentities(&cfg, stdout, stderr)
+	if err != nil {
+		if cfg.Backup.ObfuscateNames {
+			return fmt.Errorf("%s", err.Error())
 		}
+		cfg.Internal.Warnings.Report(stderr, common.WarningEncryption, "", fmt.Sprintf("%s, encrypted auxiliary objects cannot be read", err.Error()))
 	}
+	keys := &auxiliaryKeys{recipients, identities}
 
-	/* initialize encryption */
-	if cli_args.Verbose {
-		fmt.Fprintf(stderr, "initializing encryption...\n")
+	/* describe the backup before changing anything */
+	if cli_args.PrintPlan || cli_args.PlanOnly {
+		plan, err := newBackupPlan(backend, &cfg, inputDirectory, outputPrefixUri, nominalTime, keys, listable)
+		if err != nil {
+			return fmt.Errorf("%s", err.Error())
+		}
+		if err = printPlan(plan, stdout); err != nil {
+			return err
+		}
+		if cli_args.PlanOnly {
+			// nothing was backed up, so there is nothing to notify about
+			notification.cfg, notification.desktop = nil, false
+			return nil
+		}
 	}
-	var recipients []age.Recipient
-	recipients, err = initEncryption(&cfg, stdout, stderr)
+
+	/* announce this host as the writer of the prefix */
+	release, err := holdLease(backend, &cfg, outputPrefixUri, stderr)
 	if err != nil {
-		return fmt.Errorf("%s", err.Error())
+		return err
 	}
+	defer release()
 
-	/* create an archive from the input directory */
-	if cli_args.Verbose {
-		fmt.Fprintf(stderr, "generating backup archive...\n")
+	/* report backups aborted by previous runs */
+	if listable {
+		err = reportAbortedMarkers(backend, outputPrefixUri, keys, stderr)
+		if err != nil {
+			return fmt.Errorf("%s", err.Error())
+		}
 	}
-	var outputArchivePath string
-	outputArchivePath, err = archiveDirectory(inputDirectory, &cfg)
+
+	/* upload a marker if the backup gets interrupted */
+	state := &backupState{stage: stageInitializing, reporter: cli_args.reporter, keys: keys, release: release}
+	state.name, err = cfg.BackupName(nominalTime)
 	if err != nil {
-		_ = os.Remove(outputArchivePath)
 		return fmt.Errorf("%s", err.Error())
 	}
-
-	/* encrypt the output file */
-	var outputEncryptedPath, outputFileExtension string
-	if len(recipients) > 0 {
+	notification.summary.Name = state.name
+	var grace time.Duration
+	if cli_args.Command == commandDaemon {
+		grace = time.Duration(cfg.Backup.ShutdownGrace * float64(time.Second))
+	}
+	stopWatching := watchSignals(backend, outputPrefixUri, state, grace, stderr)
+	defer stopWatching()
+
+	/* skip the backup if the input directory did not change */
+	var fingerprint string
+	var fingerprintObjectUri *url.URL
+	if cfg.Backup.Passthrough && streamed {
+		cfg.Internal.Warnings.Report(stderr, common.WarningConfiguration, "backup.passthrough", "backup.passthrough does not apply to backup sources read from standard input")
+	}
+	if cfg.Backup.SkipUnchanged && streamed {
+		cfg.Internal.Warnings.Report(stderr, common.WarningConfiguration, "backup.skip_unchanged", "backup.skip_unchanged does not apply to backup sources read from standard input")
+	} else if cfg.Backup.SkipUnchanged {
 		if cli_args.Verbose {
-			fmt.Fprintf(stderr, "encrypting backup archive for recipients: %+v\n", recipients)
+			fmt.Fprintf(stderr, "computing backup directory fingerprint...\n")
 		}
-		outputEncryptedPath, err = encryptFile(outputArchivePath, recipients, &cfg)
+		fingerprint, err = fingerprintDirectory(inputDirectory, &cfg)
 		if err != nil {
-			_ = os.Remove(outputArchivePath)
-			_ = os.Remove(outputEncryptedPath)
 			return fmt.Errorf("%s", err.Error())
 		}
-		outputFileExtension = ".tar.gz.age"
-	} else {
-		// report no pubkey
-		if cli_args.Verbose {
-			fmt.Fprintf(stderr, "no pubkey found, encryption disabled\n")
+		fingerprintObjectUri, err = fingerprintUri(outputPrefixUri)
+		if err != nil {
+			return fmt.Errorf("%s", err.Error())
+		}
+		var previousFingerprint string
+		previousFingerprint, err = readFingerprint(backend, fingerprintObjectUri, keys, stderr)
+		if err != nil {
+			return fmt.Errorf("%s", err.Error())
 		}
-		outputEncryptedPath = outputArchivePath
-		outputFileExtension = ".tar.gz"
-	}
 
-	/* store output file */
-	if cli_args.Verbose {
-		fmt.Fprintf(stderr, "uploading backup archive...\n")
-	}
-	var errorMessage string
-	var outputFile *os.File
-	outputFile, err = os.Open(filepath.Clean(outputEncryptedPath))
-	if err == nil {
-		var relativeUri *url.URL
-		relativeUri, err = outputPrefixUri.Parse(time.Now().Format(cfg.Backup.Name) + outputFileExtension)
-		if err == nil {
-			if cli_args.Verbose {
-				fmt.Fprintf(stderr, "uploading backup archive of %q to %q\n", inputDirectory, relativeUri)
+		if fingerprintMatches(previousFingerprint, fingerprint, keys) {
+			fmt.Fprintf(stdout, "backup directory %q unchanged, skipped\n", inputDirectory)
+			notification.summary.Skipped = true
+			notification.summary.Upload, notification.summary.Cleanup = common.StepSkipped, common.StepSkipped
+
+			if cfg.Backup.Hours > 0.0 {
+				// no backup is stored, so the last one must survive however old it is
+				options := cleanupOptions(nil, confirm, stdout, stderr)
+				options.KeepNewest = true
+				cleanup, err := common.Prune(context.Background(), outputPrefixUri, &cfg, common.PruneOptions{Backend: backend, Now: nominalTime, Cleanup: options})
+				if err != nil {
+					notification.summary.Cleanup = common.StepFailed
+					return cleanupFailure(&cfg, "backup was skipped", err)
+				}
+				notification.summary.Cleanup = common.StepSucceeded
+				if listable && !cfg.Backup.ObfuscateNames {
+					if catalogErr := updateCatalog(backend, outputPrefixUri, nil, keys, stderr); catalogErr != nil {
+						cfg.Internal.Warnings.Report(stderr, common.WarningCatalog, outputPrefixUri.String(), catalogErr.Error())
+					}
+				}
+				return cleanupDeferred("backup was skipped", cleanup)
 			}
+			return nil
+		} else if cli_args.Verbose {
+			fmt.Fprintf(stderr, "backup directory fingerprint changed from %q to %q\n", previousFingerprint, fingerprint)
+		}
+	}
 
-			var fileInfo os.FileInfo
-			fileInfo, err = outputFile.Stat()
-			if err == nil {
-				err = backend.StoreFile(io.ReaderAt(outputFile), fileInfo.Size(), relativeUri)
-			}
+	/* initialize name obfuscation */
+	var nameKey []byte
+	var index *backupIndex
+	var indexObjectUri *url.URL
+	if cfg.Backup.ObfuscateNames {
+		if len(recipients) == 0 {
+			return fmt.Errorf("obfuscated names require a pubkey to encrypt the backup index")
 		}
+		if len(identities) == 0 {
+			return fmt.Errorf("obfuscated names require an identity to read the backup index")
+		}
+		nameKey, err = backupNameKey(&cfg, identities)
 		if err != nil {
-			errorMessage = fmt.Sprintf("unable to write backup archive of %q to %q: %s", inputDirectory, relativeUri, err.Error())
-		} else {
-			fmt.Fprintf(stdout, "uploaded backup archive of %q to %q\n", inputDirectory, relativeUri)
+			return fmt.Errorf("%s", err.Error())
+		}
+		state.setMarkerName(obfuscateName(nameKey, state.name))
+		indexObjectUri, err = indexUri(outputPrefixUri)
+		if err != nil {
+			return fmt.Errorf("%s", err.Error())
+		}
+		index, err = loadIndex(backend, indexObjectUri, identities, stderr)
+		if err != nil {
+			return fmt.Errorf("%s", err.Error())
 		}
-	} else {
-		errorMessage = fmt.Sprintf("could not open output file: %s", err.Error())
 	}
 
-	/* clean up */
-	_ = outputFile.Close()
-	_ = os.Remove(outputArchivePath)
-	_ = os.Remove(outputEncryptedPath)
+	/* name encrypted chunks of deduplicated backups with a secret key */
+	var chunkKey []byte
+	if cfg.Backup.Dedup && len(recipients) > 0 {
+		chunkKey, err = dedupChunkKey(&cfg, identities)
+		if err != nil {
+			return fmt.Errorf("%s", err.Error())
+		}
+	}
 
-	/* clean up remote backup prefix */
-	if err == nil && cfg.Backup.Hours > 0.0 {
-		err = cleanupBackupPrefix(backend, cfg.Backup.Hours, outputPrefixUri, stdout, stderr)
+	/* archive, encrypt and store the input directory, then remove old backups. Streams are
+	   stored as given, without excluded entries or the archive metadata. */
+	var filter common.ArchiveFilter
+	if !streamed {
+		filter, err = newArchiveFilter(inputDirectory, &cfg)
 		if err != nil {
-			errorMessage = fmt.Sprintf("failed to clean up backup prefix: %s", err.Error())
+			return fmt.Errorf("%s", err.Error())
+		}
+		filter.Metadata = common.NewArchiveMetadata(&cfg, version, commit)
+	}
+	options := common.BackupOptions{
+		Source:      inputDirectory,
+		Destination: outputPrefixUri,
+		Config:      &cfg,
+		Backend:     backend,
+		Time:        nominalTime,
+		Recipients:  recipients,
+		ChunkKey:    chunkKey,
+		Filter:      filter,
+		Cleanup:     cleanupOptions(index, confirm, stdout, stderr),
+		Mirrors:     mirrors,
+		Stage: func(stage string, object *url.URL) {
+			state.setStage(stage)
+			if object != nil {
+				state.setObject(object)
+			}
+		},
+		TempFile: state.addTempFile,
+		Uploaded: &state.uploaded,
+		Verbose:  cli_args.Verbose,
+		Stdout:   stdout,
+		Stderr:   stderr,
+	}
+	if streamed {
+		options.Input = cli_args.stdin
+		options.InputFormat = cli_args.InputFormat
+	}
+	if index != nil {
+		options.ObjectName = func(name string) string {
+			objectName := obfuscateName(nameKey, name)
+			index.add(backupIndexEntry{objectName, name, nominalTime})
+			return objectName
+		}
+	}
+	if len(fingerprint) > 0 {
+		/* update the fingerprint after a successful upload */
+		options.Stored = func(result *common.BackupResult) error {
+			return storeFingerprint(backend, fingerprintObjectUri, fingerprint, keys)
+		}
+	}
+	ctx := context.Background()
+	if maxDuration := cfg.BackupMaxDuration(); maxDuration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, maxDuration)
+		defer cancel()
+	}
+
+	/* read the input directory from a snapshot, which is removed once archived */
+	if len(cfg.Backup.SnapshotType) > 0 && streamed {
+		cfg.Internal.Warnings.Report(stderr, common.WarningConfiguration, "backup.snapshot_type", "backup.snapshot_type does not apply to backup sources read from standard input")
+	} else if len(cfg.Backup.SnapshotType) > 0 {
+		if cli_args.Verbose {
+			fmt.Fprintf(stderr, "creating %s snapshot...\n", cfg.Backup.SnapshotType)
+		}
+		snapshot, err := common.CreateSnapshot(ctx, inputDirectory, appname+"-"+common.TempFileTag(nil, nominalTime), &cfg)
+		if err != nil && !cfg.Backup.SnapshotOptional {
+			return fmt.Errorf("%s", err.Error())
+		} else if err != nil {
+			cfg.Internal.Warnings.Report(stderr, common.WarningSnapshot, inputDirectory, fmt.Sprintf("%s, backing up the live directory", err.Error()))
+		} else {
+			state.setSnapshot(snapshot)
+			defer state.removeSnapshot(stderr)
+			options.SourceSnapshot = snapshot.Path
+			if cli_args.Verbose {
+				fmt.Fprintf(stderr, "reading backup directory from snapshot %q\n", snapshot.Path)
+			}
+		}
+	}
+
+	result, err := common.Backup(ctx, options)
+	notification.summary.Result = &result
+	state.removeSnapshot(stderr)
+	fmt.Fprintf(stderr, "stage timings: %s\n", result.Timings)
+	var cleanupErr *common.CleanupError
+	notification.summary.Upload, notification.summary.Cleanup = stepOutcomes(&result, err)
+	if errors.As(err, &cleanupErr) {
+		err = nil
+	} else if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return &timeoutError{fmt.Sprintf("deadline exceeded: backup did not finish within %s: %s", cfg.BackupMaxDuration(), err.Error())}
+	}
+
+	/* update the index of obfuscated names */
+	if result.Stored && index != nil {
+		if result.Cleanup != nil && result.Cleanup.Remaining != nil {
+			index.prune(result.Cleanup.Remaining)
+		}
+		if indexErr := storeIndex(backend, indexObjectUri, index, recipients); indexErr != nil && err == nil {
+			err = indexErr
 		}
 	}
 
+	/* record the backup in the catalog, failures never fail the backup. The catalog is
+	   not maintained for obfuscated names as it would reveal their nominal times. The size
+	   of single-object backups is compared to the backups recorded before. */
+	var sizeWarning string
+	if result.Stored && listable && !cfg.Backup.ObfuscateNames {
+		catalogErr := modifyCatalog(backend, outputPrefixUri, keys, stderr, func(catalog *backupCatalog) {
+			/* passthrough backups may store several objects, each gets an entry */
+			for _, object := range result.Objects {
+				backupEntry := newCatalogEntry(&cfg, object.Object, nominalTime, inputDirectory, object.Sizes, recipients)
+				backupEntry.Checksum = object.Checksum
+				if object.ManifestSize > 0 {
+					// the catalog records the size of the stored manifest, not of the new chunks
+					backupEntry.Size = object.ManifestSize
+				}
+				backupEntry.Timings = newCatalogTimings(result.Timings)
+				if len(result.Objects) == 1 && cfg.Backup.SizeHistory > 0 {
+					history := sizeHistory(catalog, backupEntry, int(cfg.Backup.SizeHistory))
+					sizeWarning = sizeAnomaly(backupEntry.Size, history, cfg.Backup.SizeMinFraction, cfg.Backup.SizeMaxMultiple)
+				}
+				catalog.add(*backupEntry)
+			}
+		})
+		if catalogErr != nil {
+			cfg.Internal.Warnings.Report(stderr, common.WarningCatalog, outputPrefixUri.String(), catalogErr.Error())
+		}
+	}
+
+	if len(sizeWarning) > 0 {
+		cfg.Internal.Warnings.Add(common.WarningSizeAnomaly, result.Object.String(), sizeWarning)
+	}
 	if err != nil {
-		return fmt.Errorf(errorMessage)
+		return fmt.Errorf("%s", err.Error())
+	}
+	if cleanupErr != nil {
+		if len(sizeWarning) > 0 {
+			fmt.Fprintf(stderr, "warning: %s\n", sizeWarning)
+		}
+		return cleanupFailure(&cfg, "backup archive was uploaded", cleanupErr.Err)
+	}
+	if len(sizeWarning) > 0 {
+		return &warningError{fmt.Sprintf("warning: %s", sizeWarning)}
 	}
 
-	return nil
+	return cleanupDeferred("backup archive was uploaded", result.Cleanup)
 }
 
-func parseArgs(args []string, cli_args *cliArgs, stdout, stderr io.Writer) (bool, error) {
-	var storeConfig bool = false
-	var positionalArgs []string = []string{}
+// stepOutcomes returns the outcomes of the upload and of the cleanup of a backup returning
+// `result` and `err`, see RunSummary. A backup is uploaded before old ones are removed, so a
+// failed cleanup leaves the upload succeeded.
+func stepOutcomes(result *common.BackupResult, err error) (upload, cleanup string) {
+	var cleanupErr *common.CleanupError
+	upload, cleanup = common.StepSkipped, common.StepSkipped
+	if result.Stored {
+		upload = common.StepSucceeded
+	} else if err != nil {
+		upload = common.StepFailed
+	}
+	if errors.As(err, &cleanupErr) {
+		cleanup = common.StepFailed
+	} else if result.Cleanup != nil {
+		cleanup = common.StepSucceeded
+	}
+	return upload, cleanup
+}
 
-argsLoop:
-	for _, arg := range args[1:] {
-		if storeConfig {
-			cli_args.ConfigFilepath = arg
-			storeConfig = false
-			continue
-		}
+// cleanupFailure reports a failed cleanup of the backup prefix after the backup was stored.
+// The failure is returned as a warning unless `cfg.Backup.CleanupErrorsFatal` is set.
+func cleanupFailure(cfg *common.Config, outcome string, err error) error {
+	if cfg.Backup.CleanupErrorsFatal {
+		return fmt.Errorf("failed to clean up backup prefix: %s", err.Error())
+	}
+	cfg.Internal.Warnings.Add(common.WarningCleanup, "", fmt.Sprintf("failed to clean up backup prefix: %s", err.Error()))
+	return &warningError{fmt.Sprintf("warning: %s, but failed to clean up backup prefix: %s", outcome, err.Error())}
+}
 
-		if strings.HasPrefix(arg, "-") {
-			switch arg {
-			case "--help", "-h":
-				fmt.Fprintf(stdout, "%s\n", usageString(args[0]))
-				return true, nil
-			case "--version", "-V":
-				fmt.Fprintf(stdout, "%s v%s (commit hash:%s | date:%s)\n", appname, version, commit, date)
-				return true, nil
-			case "--verbose", "-v":
-				cli_args.Verbose = true
-			case "--config", "-c":
-				storeConfig = true
-			default:
-				return true, fmt.Errorf("unrecognize command line option '%s'", arg)
-			}
-		} else {
-			positionalArgs = append(positionalArgs, arg)
+// printBackendHint prints a remediation hint for backend errors caused by the bucket or credentials.
+func printBackendHint(err error, uri *url.URL, stderr io.Writer) {
+	switch err.Error() {
+	case common.ErrBucketNotFound:
+		fmt.Fprintf(stderr, "hint: bucket %q does not exist, check the bucket name in the URI\n", uri.Host)
+	case common.ErrInvalidCredentials:
+		fmt.Fprintf(stderr, "hint: credentials were rejected by the backend, check SQUIRRELUP_S3_ID and SQUIRRELUP_S3_SECRET\n")
+	}
+}
 
-			if len(positionalArgs) > 2 {
-				break argsLoop
-			}
+// loadConfig loads configuration from the file given on command line (or default one) and environment.
+func loadConfig(cli_args *cliArgs, cfg *common.Config, stdout, stderr io.Writer) error {
+	if cli_args.Verbose {
+		fmt.Fprintf(stderr, "loading configuration...\n")
+	}
+	if len(cli_args.ConfigFilepath) == 0 {
+		cli_args.ConfigFilepath = defaultConfigFilepath
+	}
+	cfg.Internal.StrictEnv = cli_args.StrictEnv
+	err := initConfig(cfg, cli_args.ConfigFilepath, stdout, stderr)
+	if err != nil {
+		return err
+	}
+	if cli_args.Command != commandCreds && cli_args.Command != commandHistory {
+		common.ResolveCredentials(cfg, common.SystemKeyring, stderr)
+	}
+	if cli_args.NoProgress {
+		cfg.Progress.Enabled = false
+		cfg.SetSource("progress.enabled", common.ConfigSourceFlag)
+	}
+	if cli_args.NoPreflight {
+		cfg.Backup.Preflight = false
+		cfg.SetSource("backup.preflight", common.ConfigSourceFlag)
+	}
+	if len(cli_args.KeepLocal) > 0 {
+		cfg.Backup.KeepLocalDir = cli_args.KeepLocal
+		cfg.SetSource("backup.keep_local_dir", common.ConfigSourceFlag)
+		if err := cfg.Validate(); err != nil {
+			return fmt.Errorf("invalid configuration: %s", err.Error())
+		}
+	}
+	if len(cli_args.Also) > 0 {
+		cfg.Backup.Mirrors = append(cfg.Backup.Mirrors, cli_args.Also...)
+		cfg.SetSource("backup.mirrors", common.ConfigSourceFlag)
+		if err := cfg.Validate(); err != nil {
+			return fmt.Errorf("invalid configuration: %s", err.Error())
 		}
 	}
+	if cli_args.Verbose {
+		closeReporter(cli_args)
+		cli_args.reporter = common.NewProgressReporter(stdout, cfg)
+		cfg.Internal.Reporter = cli_args.reporter
+	}
 
-	if storeConfig {
-		return true, fmt.Errorf("invalid use of the configuration switch, must provide a value")
+	return nil
+}
+
+// closeReporter clears progressbars and restores the cursor if a progress reporter was created.
+func closeReporter(cli_args *cliArgs) {
+	if closer, ok := cli_args.reporter.(io.Closer); ok {
+		_ = closer.Close()
 	}
+}
 
-	if len(positionalArgs) != 2 {
-		fmt.Fprintf(stderr, "%s\n", usageString(args[0]))
-		return true, fmt.Errorf("wrong number of arguments, expecting exactly 2 positional arguments")
-	} else {
-		cli_args.PositionalArgs = positionalArgs
+// streamedSource returns true if the backup source is a TAR stream read from standard input,
+// which requires the stream format to be given.
+func streamedSource(cli_args *cliArgs) (bool, error) {
+	var streamed bool = cli_args.PositionalArgs[0] == stdinSourcePath
+	switch {
+	case len(cli_args.InputFormat) > 0 && cli_args.InputFormat != common.InputFormatTar && cli_args.InputFormat != common.InputFormatTarGz:
+		return false, fmt.Errorf("invalid input format %q, expecting '%s' or '%s'", cli_args.InputFormat, common.InputFormatTar, common.InputFormatTarGz)
+	case streamed && len(cli_args.InputFormat) == 0:
+		return false, fmt.Errorf("reading the backup source from standard input requires --input-format")
+	case !streamed && len(cli_args.InputFormat) > 0:
+		return false, fmt.Errorf("--input-format requires '%s' as first argument to read the backup source from standard input", stdinSourcePath)
+	case streamed && cli_args.stdin == nil:
+		return false, fmt.Errorf("standard input is not available to read the backup source from")
 	}
+	return streamed, nil
+}
 
-	return false, nil
+// checkDirectorySize walks the input directory and verifies it contains at least
+// `cfg.Backup.MinFiles` files with a total size of at least `cfg.Backup.MinSizeBytes` bytes.
+func checkDirectorySize(inputDirectory string, cfg *common.Config) error {
+	var files, size int64
+
+	err := filepath.WalkDir(inputDirectory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		files++
+		size += info.Size()
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not scan backup directory: %s", err.Error())
+	}
+
+	if files < cfg.Backup.MinFiles || size < cfg.Backup.MinSizeBytes {
+		return fmt.Errorf("backup directory %q is too small: found %d files (%d bytes), expected at least %d files (%d bytes), use --allow-empty to override",
+			inputDirectory, files, size, cfg.Backup.MinFiles, cfg.Backup.MinSizeBytes)
+	}
+
+	return nil
 }
 
 func initConfig(cfg *common.Config, cfgFilepath string, stdout, stderr io.Writer) error {
@@ -335,160 +834,282 @@ func initConfig(cfg *common.Config, cfgFilepath string, stdout, stderr io.Writer
 		return fmt.Errorf("could not load configuration from environment: %s", err.Error())
 	}
 
+	err = cfg.Validate()
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %s", err.Error())
+	}
+	for _, warning := range cfg.NameWarnings() {
+		cfg.Internal.Warnings.Report(stderr, common.WarningConfiguration, "backup.name", warning)
+	}
+
 	return nil
 }
 
 func initEncryption(cfg *common.Config, stdout, stderr io.Writer) ([]age.Recipient, error) {
 	var recipients []age.Recipient
 
-	if len(cfg.Encryption.Pubkey) > 0 {
-		if r, err := age.ParseX25519Recipient(cfg.Encryption.Pubkey); err == nil {
+	pubkey := strings.TrimSpace(cfg.Encryption.Pubkey)
+	if len(cfg.Encryption.PubkeyURL) > 0 {
+		return initURLRecipients(cfg.Encryption.PubkeyURL, cfg, stderr)
+	}
+	if len(pubkey) > 0 {
+		switch {
+		case strings.HasPrefix(pubkey, "https://"):
+			return initURLRecipients(pubkey, cfg, stderr)
+		case strings.HasPrefix(pubkey, agePublicKeyPrefix):
+			r, err := age.ParseX25519Recipient(pubkey)
+			if err != nil {
+				return nil, fmt.Errorf("parsing pubkey as age recipient failed: %s", err.Error())
+			}
 			recipients = append(recipients, r)
-		} else {
+		case isSSHPublicKey(pubkey):
+			return nil, fmt.Errorf("parsing pubkey as SSH public key failed: SSH recipients are not supported, use an age recipient")
+		case isPlausiblePath(pubkey):
 			fmt.Fprintf(stderr, "pubkey parsing failed, assuming it is path to file\n")
+			if err := checkKeyFile(pubkey, cfg, stderr); err != nil {
+				return nil, err
+			}
 
-			pubkeyFile, err := os.Open(cfg.Encryption.Pubkey)
+			pubkeyFile, err := os.Open(pubkey)
 			if err != nil {
 				return nil, fmt.Errorf("could not open pubkey file: %s", err.Error())
 			}
+			defer pubkeyFile.Close()
 
-			recipients, err = age.ParseRecipients(pubkeyFile)
+			recipients, err = parseRecipientsFile(pubkeyFile)
 			if err != nil {
 				return nil, fmt.Errorf("parsing pubkey file failed: %s", err.Error())
 			}
+		default:
+			return nil, fmt.Errorf("invalid pubkey: expecting an age recipient starting with %q or a path to a recipients file", agePublicKeyPrefix)
 		}
 	}
 
 	return recipients, nil
 }
 
-func archiveDirectory(dirPath string, cfg *common.Config) (string, error) {
-	// map files on disk to their paths in the archive
-	files, err := archiver.FilesFromDisk(nil, map[string]string{
-		dirPath: "",
-	})
-	if err != nil {
-		return "", fmt.Errorf("could not initialize archive files structure: %s", err.Error())
-	}
-
-	// create the output file we'll write to
-	tmp, err := os.CreateTemp("", appname+"-backup-")
-	if err != nil {
-		return "", fmt.Errorf("could not create temporary file: %s", err.Error())
-	}
-
-	// we can use the CompressedArchive type to gzip a tarball
-	// (compression is not required; you could use Tar directly)
-	format := archiver.CompressedArchive{
-		Compression: archiver.Gz{},
-		Archival:    archiver.Tar{NumericUIDGID: true},
-	}
-
-	// create the archive
-	var index int = 0
-	var archiveOutput io.Writer
-	if cfg.Internal.Reporter != nil {
-		index, _ = cfg.Internal.Reporter.CreateFileTask(-1)
-		_ = cfg.Internal.Reporter.DescribeTask(index, "archiving")
-		archiveOutput = io.MultiWriter(
-			io.Writer(tmp),
-			&progressWriter{
-				cfg.Internal.Reporter,
-				index,
-			},
-		)
-	} else {
-		archiveOutput = io.Writer(tmp)
+// parseRecipientsFile reads one age recipient per line from `r`. Surrounding whitespace, blank
+// lines and lines starting with "#" are ignored, duplicate recipients are only returned once.
+func parseRecipientsFile(r io.Reader) ([]age.Recipient, error) {
+	var recipients []age.Recipient
+	seen := make(map[string]bool)
+
+	scanner := bufio.NewScanner(r)
+	var n int
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		recipient, err := age.ParseX25519Recipient(line)
+		if err != nil {
+			return nil, fmt.Errorf("malformed recipient at line %d: %s", n, err.Error())
+		}
+		if seen[recipient.String()] {
+			continue
+		}
+		seen[recipient.String()] = true
+		recipients = append(recipients, recipient)
 	}
-	err = format.Archive(context.Background(), archiveOutput, files)
-	if err != nil {
-		return "", fmt.Errorf("failed to generate archive: %s", err.Error())
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read recipients: %s", err.Error())
 	}
-	if index > 0 {
-		cfg.Internal.Reporter.FinishTask(index)
+
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no recipients found")
+	} else if len(recipients) > maxRecipients {
+		return nil, fmt.Errorf("too many recipients: found %d, at most %d are supported", len(recipients), maxRecipients)
 	}
+	return recipients, nil
+}
 
-	// close the file
-	_ = tmp.Close()
+// isSSHPublicKey returns true if `key` looks like an SSH public key in authorized_keys format.
+func isSSHPublicKey(key string) bool {
+	for _, prefix := range []string{"ssh-", "ecdsa-sha2-", "sk-ssh-", "sk-ecdsa-"} {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
 
-	return tmp.Name(), nil
+// isPlausiblePath returns true if `value` contains a path separator or names an existing file.
+func isPlausiblePath(value string) bool {
+	if strings.ContainsRune(value, '/') || strings.ContainsRune(value, filepath.Separator) {
+		return true
+	}
+	_, err := os.Stat(value)
+	return err == nil
 }
 
-func encryptFile(filePath string, recipients []age.Recipient, cfg *common.Config) (string, error) {
-	// get input file size
-	fileInfo, err := os.Stat(filepath.Clean(filePath))
+// newArchiveFilter drops entries excluded by configured patterns and ignore files and
+// normalizes ownership and permissions of the remaining ones.
+func newArchiveFilter(dirPath string, cfg *common.Config) (common.ArchiveFilter, error) {
+	var filter common.ArchiveFilter
+
+	excluded, err := excludedPaths(dirPath, cfg)
 	if err != nil {
-		return "", fmt.Errorf("could not stat input file %s: %s", filePath, err.Error())
+		return filter, err
+	}
+	if len(excluded) > 0 {
+		filter.Exclude = func(nameInArchive string) bool {
+			return isExcluded(excluded, archiveRelPath(nameInArchive, dirPath))
+		}
 	}
 
-	// open input file
-	input, err := os.Open(filepath.Clean(filePath))
+	hook, err := newHeaderHook(cfg)
 	if err != nil {
-		return "", fmt.Errorf("could not open input file %s: %s", filePath, err.Error())
+		return filter, err
+	}
+	if hook != nil {
+		filter.Normalize = func(fileInfo fs.FileInfo, linkTarget string) (fs.FileInfo, error) {
+			return normalizeFileInfo(fileInfo, linkTarget, hook)
+		}
 	}
 
-	// create the output file we'll write to
-	tmp, err := os.CreateTemp("", appname+"-encrypted-")
+	return filter, nil
+}
+
+// parsePrefixUri parses the prefix URI `arg`. Prefixes are directories, a trailing slash is
+// appended if missing, so object names are added below the last segment rather than
+// replacing it. The bucket root is given as 'b2://bucket' or 'b2://bucket/'.
+func parsePrefixUri(arg string, verbose bool, stderr io.Writer) (*url.URL, error) {
+	uri, err := url.ParseRequestURI(arg)
 	if err != nil {
-		return "", fmt.Errorf("could not create temporary file: %s", err.Error())
+		return nil, err
+	}
+	if !strings.HasSuffix(uri.Path, "/") {
+		given := uri.String()
+		uri.Path += "/"
+		uri.RawPath = ""
+		if verbose && given != uri.Scheme+"://"+uri.Host {
+			fmt.Fprintf(stderr, "prefix URI %q has no trailing slash, using %q\n", given, uri)
+		}
 	}
+	return uri, nil
+}
 
-	// create the encrypted writer
-	encryptedWriter, err := age.Encrypt(tmp, recipients...)
+// hostPrefixUri appends the sanitized host name as a directory to the output prefix.
+func hostPrefixUri(outputPrefixUri *url.URL, cfg *common.Config) (*url.URL, error) {
+	hostname, err := cfg.BackupHostname()
 	if err != nil {
-		return "", fmt.Errorf("could not initlize encryption for file '%s': %s", tmp.Name(), err.Error())
-	}
-
-	// encrypt the file
-	var encryptedOutput io.Writer
-	if cfg.Internal.Reporter != nil {
-		var index int
-		index, _ = cfg.Internal.Reporter.CreateFileTask(fileInfo.Size())
-		_ = cfg.Internal.Reporter.DescribeTask(index, "encrypting")
-		encryptedOutput = io.MultiWriter(
-			encryptedWriter,
-			&progressWriter{
-				cfg.Internal.Reporter,
-				index,
-			},
-		)
+		return nil, err
+	}
+	uri := *outputPrefixUri
+	uri.Path = strings.TrimSuffix(uri.Path, "/") + "/" + hostname + "/"
+	uri.RawPath = ""
+	return &uri, nil
+}
+
+// validateOutputPrefix checks that `uri` can be reached by listing at most one object under
+// it, --stat-prefix lists all of them to print the size of the prefix instead. The output
+// prefix as given without a trailing slash must not name an object, which would have been
+// meant as a file path. Returns false if listing the prefix is not permitted.
+func validateOutputPrefix(cli_args *cliArgs, backend common.StorageBackend, cfg *common.Config, uri *url.URL, stdout, stderr io.Writer) (bool, error) {
+	var err error
+	if cli_args.StatPrefix {
+		var fileinfo *common.FileInfo
+		if fileinfo, err = backend.GetFileInfo(uri); err == nil {
+			// keep the plan the only output on stdout
+			if cli_args.PrintPlan || cli_args.PlanOnly {
+				fmt.Fprintf(stderr, "file info: %s\n", fileinfo)
+			} else {
+				fmt.Fprintf(stdout, "file info: %s\n", fileinfo)
+			}
+		}
 	} else {
-		encryptedOutput = encryptedWriter
+		_, err = common.ListFilesLimit(backend, uri, 1)
 	}
-	numWritten, err := io.Copy(encryptedOutput, input)
 	if err != nil {
-		return "", fmt.Errorf("could not write file '%s' to encrypted file '%s': %s", input.Name(), tmp.Name(), err.Error())
-	} else if numWritten == 0 {
-		return "", fmt.Errorf("zero bytes written to encrypted archive")
+		switch err.Error() {
+		case common.ErrFileNotFound:
+			fmt.Fprintf(stderr, "file %q not found\n", uri)
+		case common.ErrAccessDenied:
+			warnListingDenied(cfg, uri, "assuming a key restricted to writing", stderr)
+			return false, nil
+		default:
+			printBackendHint(err, uri, stderr)
+			return false, fmt.Errorf("backend operation failed: %s", err.Error())
+		}
 	}
-	_ = encryptedWriter.Close()
 
-	return tmp.Name(), nil
+	arg := cli_args.PositionalArgs[1]
+	fileUri, err := url.ParseRequestURI(arg)
+	if err != nil || strings.HasSuffix(arg, "/") || strings.Trim(fileUri.Path, "/") == "" {
+		return true, nil
+	}
+	// the object named like the prefix is listed first, errors are left to the backup
+	filelist, _ := common.ListFilesLimit(backend, fileUri, 1)
+	if len(filelist) > 0 && filelist[0].Name() == strings.TrimPrefix(fileUri.Path, "/") {
+		return false, fmt.Errorf("output URI must be a directory prefix, but a file path was specified: %q", fileUri)
+	}
+	return true, nil
 }
 
-func cleanupBackupPrefix(backend common.StorageBackend, hours float64, outputPrefixUri *url.URL, stdout, stderr io.Writer) error {
-	/* list prefix contents */
-	filelist, err := backend.ListFiles(outputPrefixUri)
+// holdLease acquires the lease on `uri` if backup.lease is set and returns the function
+// releasing it, a lease that cannot be released is reported with a warning. The lease is
+// released once, however often the function is called.
+func holdLease(backend common.StorageBackend, cfg *common.Config, uri *url.URL, stderr io.Writer) (func(), error) {
+	if !cfg.Backup.Lease {
+		return func() {}, nil
+	}
+	lease, err := common.AcquireLease(backend, cfg, uri, stderr)
 	if err != nil {
-		return fmt.Errorf("could not list remote files: %s", err.Error())
-	}
-
-	/* remove old files */
-	timeNow := time.Now()
-	for _, fileinfo := range filelist {
-		diff := timeNow.Sub(fileinfo.Modified())
-		fmt.Fprintf(stderr, "file %s, time diff = %.0f h\n", fileinfo.Name(), diff.Hours())
-		if diff.Hours() >= hours {
-			relativeUri, err := outputPrefixUri.Parse("/" + fileinfo.Name())
-			if err == nil {
-				fmt.Fprintf(stdout, "removing file %q\n", relativeUri)
-				err = backend.RemoveFile(relativeUri)
-			}
-			if err != nil {
-				fmt.Fprintf(stderr, "could not remove remote file %q: %s\n", relativeUri, err.Error())
+		return nil, fmt.Errorf("could not acquire lease: %s", err.Error())
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if err := lease.Release(); err != nil {
+				cfg.Internal.Warnings.Report(stderr, common.WarningLease, uri.String(), err.Error())
 			}
+		})
+	}, nil
+}
+
+// warnListingDenied reports that listing `uri` is forbidden and what is done instead, unless
+// `cfg.S3.AssumeWriteOnly` declares that the key is not expected to list.
+func warnListingDenied(cfg *common.Config, uri *url.URL, consequence string, stderr io.Writer) {
+	if !cfg.S3.AssumeWriteOnly {
+		cfg.Internal.Warnings.Report(stderr, common.WarningListing, uri.String(), fmt.Sprintf("listing %q is not permitted, %s", uri, consequence))
+	}
+}
+
+// cleanupOptions configures the cleanup of the backup prefix, auxiliary objects are kept.
+// If `index` is given, nominal times of obfuscated backups are taken from it.
+func cleanupOptions(index *backupIndex, confirm func(objects []string) error, stdout, stderr io.Writer) common.CleanupOptions {
+	options := common.CleanupOptions{
+		Keep:    []string{fingerprintObjectName, indexObjectName, catalogObjectName, common.LeaseObjectName},
+		Confirm: confirm,
+		Stdout:  stdout,
+		Stderr:  stderr,
+	}
+	if index != nil {
+		options.Resolve = func(key string) (string, time.Time, bool) {
+			entry, ok := index.lookupKey(key)
+			return entry.Name, entry.Time, ok
 		}
 	}
+	return options
+}
 
-	return nil
+// cleanupBackupPrefix removes backups older than the configured retention period.
+// If `index` is given, nominal times of obfuscated backups are taken from it and
+// entries of removed or missing objects are dropped from it.
+func cleanupBackupPrefix(backend common.StorageBackend, cfg *common.Config, now time.Time, outputPrefixUri *url.URL, index *backupIndex, confirm func(objects []string) error, stdout, stderr io.Writer) (*common.CleanupResult, error) {
+	result, err := common.Prune(context.Background(), outputPrefixUri, cfg, common.PruneOptions{Backend: backend, Now: now, Cleanup: cleanupOptions(index, confirm, stdout, stderr)})
+	if index != nil && result != nil && result.Remaining != nil {
+		index.prune(result.Remaining)
+	}
+	return result, err
+}
+
+// cleanupDeferred returns a warning if the cleanup described by `result` left expired objects
+// for later runs, see backup.max_deletions_per_run, so monitoring notices a lagging cleanup.
+func cleanupDeferred(outcome string, result *common.CleanupResult) error {
+	if result == nil || result.Deferred == 0 {
+		return nil
+	}
+	return &warningError{fmt.Sprintf("warning: %s, but %d expired objects remain for later runs", outcome, result.Deferred)}
 }
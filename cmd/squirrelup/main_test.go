@@ -1,28 +1,177 @@
 package main
 
 import (
+	"archive/tar"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"runtime"
 	"runtime/debug"
+	"strings"
 	"testing"
 	"time"
 
+	"filippo.io/age"
 	"github.com/breezerider/squirrel-up/pkg/common"
 )
 
-const expected_usage string = `Usage: SquirrelUp <backup_dir> <output_prefix_uri>
+const expected_usage string = `Usage: SquirrelUp [backup] <backup_dir> <output_prefix_uri>
+       SquirrelUp decrypt [--restore-owner <mode>] [--overwrite <policy>] [--include <glob>] [--exclude <glob>] [--list] <input_file> [output_dir]
+       SquirrelUp rekey [--filter <glob>] [--dry-run] [--yes] <prefix_uri>
+       SquirrelUp get [--decrypt] <uri> [local_path|-]
+       SquirrelUp daemon <backup_dir> <output_prefix_uri>
+       SquirrelUp check [--encryption-roundtrip] [--no-preflight] [<output_prefix_uri>]
+       SquirrelUp list <prefix_uri>
+       SquirrelUp rebuild-catalog <prefix_uri>
+       SquirrelUp diff [--hash] [--ignore <glob>] <backup_uri> <local_dir>
+       SquirrelUp verify-prefix [--sample <n>] [--seed <n>] [--latest] [--max-age <age>] [--record] <prefix_uri>
+       SquirrelUp config
+       SquirrelUp credentials set|delete
+       SquirrelUp history [--prefix <uri>] [--limit <n>] [--json]
     Create an (optionally) encrypted gzip-compressed TAR file and upload it to storage backend.
     At the moment only BackBlaze B2 cloud storage is implemented.
+    Backups are named after backup.name, a Go time layout such as '2006-01-02T15-0700', or a
+    strftime pattern with backup.name_format: strftime. Names with strftime directives in a Go
+    layout are rejected, names without a time component are reported (rejected with
+    backup.name_strict).
 
 Required arguments:
-    <backup_dir>                  Path to local directory that serves as backup root.
+    <backup_dir>                  Path to local directory that serves as backup root, or '-' to read
+                                  a TAR stream from standard input along with --input-format.
     <output_prefix_uri>           Remote URI prefix.
 
 Optional arguments:
     --config, -c <config_file>    Path to local config file.
     --verbose, -v                 Verbose output.
+    --no-progress                 Do not display progress in verbose mode.
+    --strict-env                  Fail on unknown SQUIRRELUP_ environment variables.
+    --allow-empty                 Skip the minimum size check of <backup_dir>.
+    --allow-nested                Allow a file:// <output_prefix_uri> inside <backup_dir> or vice versa.
+    --timestamp <RFC3339>         Nominal time of the backup (defaults to current time).
+    --resume-upload <file>        Complete an interrupted upload using its recovery file.
+    --input-format <format>       Format of the stream read instead of <backup_dir>: 'tar' is compressed
+                                  (re-compressed if gzipped), 'tar.gz' is stored as given.
+    --notify-desktop              Show a desktop notification with the outcome once the backup ends.
+    --print-plan                  Print what the backup is going to do as JSON before starting it.
+    --plan-only                   Print the plan like --print-plan and exit without backing up.
+    --keep-local <dir>            Keep the uploaded backup in a local directory (backup.keep_local_dir).
+    --also <uri>                  Also upload the backup to another prefix, repeatable (backup.mirrors).
+    --yes                         Remove old backups without asking when run on a terminal.
+    --no-preflight                Skip the backend probe of verbose mode and the readability check of
+                                  files (backup.preflight).
+    --stat-prefix                 List all objects under <output_prefix_uri> and print its size,
+                                  only the first object is listed to validate it by default.
+    --help, -h                    Print this help, '<command> --help' prints the help of a single command.
+    --                            Treat all following arguments as positional arguments.
+
+Decrypt command:
+    Decrypt a local age-encrypted backup archive using the configured identity and extract it.
+    <input_file>                  Path to local encrypted backup archive.
+    [output_dir]                  Output directory (defaults to the directory of <input_file>).
+    --restore-owner <mode>        Ownership of extracted files: 'skip' (default) or 'preserve'.
+    --preserve-owner              Same as --restore-owner preserve.
+    --preserve-perms              Apply permissions recorded in the archive (default).
+    --no-preserve-perms           Leave permissions of extracted files to the umask.
+    --preserve-special            Keep setuid and setgid bits, they are stripped by default.
+    --allow-devices               Create device and FIFO entries, they are skipped by default.
+    --overwrite <policy>          Existing files: 'always' (default), 'older' or 'never'.
+    --include <glob>              Only extract entries matching the pattern or inside a matching directory, repeatable.
+    --exclude <glob>              Do not extract entries matching the pattern or inside a matching directory, repeatable.
+    --list                        Only print names of the selected entries.
+                                  Patterns are anchored at the archive root, '**' matches any number of directories.
+
+Rekey command:
+    Re-encrypt remote backup archives with the configured identity to the configured recipients.
+    <prefix_uri>                  Remote URI prefix.
+    --filter <glob>               Only re-encrypt files with names matching the pattern.
+    --dry-run                     Only list files that would be re-encrypted.
+    --yes                         Replace the files without asking, required without a terminal.
+
+Get command:
+    Download a single remote backup object to a local file or standard output.
+    <uri>                         Remote object URI.
+    [local_path|-]                Output file path or '-' for standard output (defaults to the object name).
+    --decrypt                     Decrypt the object using the configured identity.
+
+Daemon command:
+    Keep running and create backups on the schedule configured in backup.schedule.
+    Send SIGUSR1 to start a backup immediately.
+    --notify-desktop              Show a desktop notification with the outcome of every backup.
+    --keep-local <dir>            Keep every uploaded backup in a local directory (backup.keep_local_dir).
+    --also <uri>                  Also upload every backup to another prefix, repeatable (backup.mirrors).
+    --no-preflight                Skip the backend probe of verbose mode and the readability check of
+                                  files (backup.preflight).
+    --stat-prefix                 List all objects under <output_prefix_uri> and print its size.
+
+Check command:
+    Verify configuration and access to the backend without creating a backup. The backend is
+    probed with a single request first, its endpoint, region and round trip are printed.
+    <output_prefix_uri>           Remote URI prefix.
+    --encryption-roundtrip        Encrypt a probe to the configured recipients and decrypt it with the
+                                  configured identity, without network access.
+    --no-preflight                Skip the backend probe.
+
+List command:
+    List backups stored under a prefix using its catalog, or its contents if there is no catalog.
+    <prefix_uri>                  Remote URI prefix.
+
+Rebuild-catalog command:
+    Replace the catalog of backups stored under a prefix with one built from its contents.
+    <prefix_uri>                  Remote URI prefix.
+
+Diff command:
+    Compare a remote backup archive against a local directory and list added (+), removed (-)
+    and changed (~) files. Fails if differences are found.
+    <backup_uri>                  Remote backup archive URI.
+    <local_dir>                   Local directory the backup was created from.
+    --hash                        Compare contents of files with equal sizes as well.
+    --ignore <glob>               Do not compare entries matching the pattern, repeatable.
+
+Verify-prefix command:
+    Verify a random sample of the backups stored under a prefix: download each, compare it against
+    the catalog and read the archive to the end, decrypting it if an identity is configured.
+    Fails if any sampled backup fails verification.
+    <prefix_uri>                  Remote URI prefix.
+    --sample <n>                  Number of backups to verify (defaults to 1).
+    --seed <n>                    Seed of the random sample, printed in verbose mode.
+    --latest                      Verify the most recent backup in addition to the sample.
+    --max-age <age>               Only sample backups newer than the age, e.g. '36h' or '30d'.
+    --record                      Record the outcome in the catalog, shown by the list command.
+
+Config command:
+    Print the effective configuration with secrets redacted. Every value is followed by where
+    it was set: default, file, env along with the variable, flag, or keyring.
+
+Credentials command:
+    Store the S3 key ID and secret in the keyring of the operating system, or remove them. The
+    entry is named by s3.keyring_service and s3.keyring_account and read if s3.credential_source
+    is 'keyring'.
+    set                           Store the key ID and secret prompted for on the terminal, or read
+                                  from standard input one per line.
+    delete                        Remove the stored key ID and secret.
+
+History command:
+    Print the backup runs recorded in the local journal (backup.journal_path), oldest first,
+    without accessing the backend.
+    --prefix <uri>                Only print runs whose output prefix starts with the URI.
+    --limit <n>                   Only print the last n runs.
+    --json                        Print every run as a JSON object on its own line.
+
+Exit status:
+    0 on success, 1 on failure and 2 if the backup is stored, but removing old backups failed
+    (unless backup.cleanup_errors_fatal is set) or its size deviates from recent backups as
+    configured by backup.size_*. 3 if the backup did not finish within backup.max_duration_minutes.
+
+Storage backends:
+    URL schemes supported by this build: b2, dummy.
 
 BackBlaze B2 Backend:
     <output_prefix_uri> must follow the pattern 'b2://<bucket>/<path>/<to>/<prefix>/'.
@@ -31,6 +180,132 @@ Default configuration is stored under .
 
 `
 
+// undeletableBackend is a MemoryBackend that refuses to remove selected keys.
+type undeletableBackend struct {
+	*common.MemoryBackend
+	undeletable map[string]bool
+}
+
+// unwritableBackend is a MemoryBackend that refuses to store files.
+type unwritableBackend struct {
+	*undeletableBackend
+}
+
+func (u *unwritableBackend) StoreFile(ctx context.Context, req common.StoreRequest) error {
+	return errors.New(common.ErrAccessDenied)
+}
+
+// slowBackend is a MemoryBackend that reads uploaded data slowly.
+type slowBackend struct {
+	*common.MemoryBackend
+}
+
+func (s *slowBackend) StoreFile(ctx context.Context, req common.StoreRequest) error {
+	buf := make([]byte, 1)
+	for offset := int64(0); offset < req.Length; offset++ {
+		if _, err := req.BodyAt.ReadAt(buf, offset); err != nil {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return s.MemoryBackend.StoreFile(ctx, req)
+}
+
+// restrictedBackend is a MemoryBackend refusing to list prefixes, like B2 application keys
+// restricted to a name prefix.
+type restrictedBackend struct {
+	*common.MemoryBackend
+}
+
+func (r *restrictedBackend) GetFileInfo(uri *url.URL) (*common.FileInfo, error) {
+	if strings.HasSuffix(uri.Path, "/") {
+		return nil, errors.New(common.ErrAccessDenied)
+	}
+	return r.MemoryBackend.GetFileInfo(uri)
+}
+
+func (r *restrictedBackend) ListFiles(uri *url.URL) ([]common.FileInfo, error) {
+	return nil, errors.New(common.ErrAccessDenied)
+}
+
+// bucketUnwritableBackend is a MemoryBackend that refuses to store files in one bucket.
+type bucketUnwritableBackend struct {
+	*common.MemoryBackend
+	bucket string
+}
+
+func (b *bucketUnwritableBackend) StoreFile(ctx context.Context, req common.StoreRequest) error {
+	if req.URI.Host == b.bucket {
+		return errors.New(common.ErrAccessDenied)
+	}
+	return b.MemoryBackend.StoreFile(ctx, req)
+}
+
+func (u *undeletableBackend) RemoveFile(uri *url.URL) error {
+	if u.undeletable[uri.Path] {
+		return errors.New(common.ErrAccessDenied)
+	}
+	return u.MemoryBackend.RemoveFile(uri)
+}
+
+// progressRecorder records sizes of created tasks and the progress made on them.
+type progressRecorder struct {
+	common.DummyProgressReporter
+	sizes    []int64
+	advanced map[int]int64
+}
+
+func (pr *progressRecorder) CreateFileTask(size int64) (int, error) {
+	pr.sizes = append(pr.sizes, size)
+	return len(pr.sizes), nil
+}
+
+func (pr *progressRecorder) AdvanceTask(index int, increment int64) error {
+	pr.advanced[index] += increment
+	return nil
+}
+
+// pinClock fixes the wall-clock time to 2024-05-01T03:00:00Z and the backup time zone to UTC.
+func pinClock(t *testing.T) {
+	common.Now = func() time.Time {
+		return time.Date(2024, time.May, 1, 3, 0, 0, 0, time.UTC)
+	}
+	common.StageClock = common.Now
+	os.Setenv("SQUIRRELUP_BACKUP_TIMEZONE", "UTC")
+	t.Cleanup(func() {
+		common.Now = time.Now
+		common.StageClock = time.Now
+		os.Setenv("SQUIRRELUP_BACKUP_TIMEZONE", "")
+	})
+}
+
+// setupBackend prepares a test running commands against dummy:// URIs: it pins the clock,
+// makes dummy:// URIs resolve to `backend`, ignores the default configuration file and sets
+// the environment variables in `env` until the test ends. The test fails if a nil `backend`
+// is created. Returns a function switching dummy:// URIs to another backend.
+func setupBackend(t *testing.T, backend common.StorageBackend, env map[string]string) func(common.StorageBackend) {
+	pinClock(t)
+
+	common.CreateDummyBackend = func(cfg *common.Config) common.StorageBackend {
+		if backend == nil {
+			t.Fatalf("the backend must not be created")
+		}
+		return backend
+	}
+	t.Cleanup(func() { common.CreateDummyBackend = nil })
+	defaultConfigFilepath = ""
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+
+	return func(other common.StorageBackend) {
+		backend = other
+	}
+}
+
+// backupSizesPattern matches the sizes reported after an upload, see maskBackupSizes.
+var backupSizesPattern = regexp.MustCompile(`backup sizes: source \d+ bytes, archive \d+ bytes, uploaded \d+ bytes`)
+
 func assertEquals(t *testing.T, expected any, actual any, description string) {
 	if actual != expected {
 		t.Log(string(debug.Stack()))
@@ -38,6 +313,33 @@ func assertEquals(t *testing.T, expected any, actual any, description string) {
 	}
 }
 
+// helper function: replace the sizes reported after an upload with `N`, archives record the
+// modification times of their files, so their sizes vary between runs.
+func maskBackupSizes(output string) string {
+	return backupSizesPattern.ReplaceAllString(output, "backup sizes: source N bytes, archive N bytes, uploaded N bytes")
+}
+
+// helper function: check the permission bits of the file at `filePath`, they are only
+// compared on platforms where they restrict access.
+func assertPerm(t *testing.T, expected os.FileMode, filePath string, description string) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatalf("could not stat file: %s", err.Error())
+	}
+	if permissionBits {
+		assertEquals(t, expected, info.Mode().Perm(), description)
+	}
+}
+
+// helper function: archive `dirPath` applying the configured filters.
+func archiveDirectory(dirPath string, cfg *common.Config) (string, int64, error) {
+	filter, err := newArchiveFilter(dirPath, cfg)
+	if err != nil {
+		return "", 0, err
+	}
+	return common.ArchiveDirectory(context.Background(), dirPath, cfg, filter)
+}
+
 /* test cases for main */
 func TestMainVersion(t *testing.T) {
 	fmt.Println("Running TestMainVersion...")
@@ -168,6 +470,9 @@ func TestMainInvalidDir(t *testing.T) {
 	assertEquals(t, 0, len(stderr.String()), "TestMainInvalidDir.stderr")
 
 	/* test with an inaccessible directory */
+	if !permissionBits {
+		t.Skip("permission bits do not restrict access on " + runtime.GOOS)
+	}
 	tmpDir, err := os.MkdirTemp("", appname+"-testing-")
 	if err != nil {
 		t.Fatalf("could not create temporary directory: %s", err.Error())
@@ -188,14 +493,85 @@ func TestMainInvalidDir(t *testing.T) {
 		t.Fatalf("%s was supposed to fail 2\n", appname)
 	}
 	assertEquals(t,
-		fmt.Sprintf("could not initialize archive files structure: open %s: permission denied", tmpDir),
+		fmt.Sprintf("could not scan backup directory: open %s: permission denied", tmpDir),
 		err.Error(), "TestMainInvalidDir.Error")
-	assertEquals(t, `file info: {name:path/ size:0 modified:{wall:0 ext:62135596800 loc:<nil>} isfile:false}
-`, stdout.String(), "TestMainInvalidURI.stdout")
+	assertEquals(t, 0, len(stdout.String()), "TestMainInvalidURI.stdout")
 	assertEquals(t, `default configuration path is empty
 `, stderr.String(), "TestMainInvalidURI.stderr")
 }
 
+func TestMainEmptyDir(t *testing.T) {
+	fmt.Println("Running TestMainEmptyDir...")
+	pinClock(t)
+
+	defaultConfigFilepath = ""
+	var stdout, stderr bytes.Buffer
+
+	var backendCreated bool = false
+	common.CreateDummyBackend = func(cfg *common.Config) common.StorageBackend {
+		backendCreated = true
+		return &common.DummyBackend{}
+	}
+
+	/* test with an empty directory */
+	tmpDir := t.TempDir()
+
+	// run main
+	args := []string{appname, tmpDir, "dummy://path/"}
+
+	err := run(args, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail\n", appname)
+	}
+	assertEquals(t,
+		fmt.Sprintf("backup directory %q is too small: found 0 files (0 bytes), expected at least 1 files (1 bytes), use --allow-empty to override", tmpDir),
+		err.Error(), "TestMainEmptyDir.Error")
+	assertEquals(t, false, backendCreated, "TestMainEmptyDir.backendCreated")
+	assertEquals(t, 0, len(stdout.String()), "TestMainEmptyDir.stdout")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* test with a directory below the size threshold */
+	if err = os.WriteFile(filepath.Join(tmpDir, "file"), []byte("test"), 0600); err != nil {
+		t.Fatalf("could not write to temporary file: %s", err.Error())
+	}
+
+	os.Setenv("SQUIRRELUP_BACKUP_MIN_SIZE_BYTES", "1024")
+	err = run(args, nil, io.Writer(&stdout), io.Writer(&stderr))
+	os.Setenv("SQUIRRELUP_BACKUP_MIN_SIZE_BYTES", "")
+	if err == nil {
+		t.Fatalf("%s was supposed to fail\n", appname)
+	}
+	assertEquals(t,
+		fmt.Sprintf("backup directory %q is too small: found 1 files (4 bytes), expected at least 1 files (1024 bytes), use --allow-empty to override", tmpDir),
+		err.Error(), "TestMainEmptyDir.Error")
+	assertEquals(t, false, backendCreated, "TestMainEmptyDir.backendCreated")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* test with an empty directory and --allow-empty */
+	emptyDir := t.TempDir()
+	args = []string{appname, "--allow-empty", emptyDir, "dummy://path/"}
+
+	os.Setenv("SQUIRRELUP_BACKUP_HOURS", "0")
+	err = run(args, nil, io.Writer(&stdout), io.Writer(&stderr))
+	os.Setenv("SQUIRRELUP_BACKUP_HOURS", "")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assertEquals(t, true, backendCreated, "TestMainEmptyDir.backendCreated")
+	assertEquals(t, fmt.Sprintf(`uploaded backup archive of %q to "dummy://path/2024-05-01T03+0000.tar.gz"
+backup sizes: source N bytes, archive N bytes, uploaded N bytes
+`, emptyDir), maskBackupSizes(stdout.String()), "TestMainEmptyDir.stdout")
+
+	// clean up test
+	common.CreateDummyBackend = nil
+}
+
 func TestMainInvalidURI(t *testing.T) {
 	fmt.Println("Running TestMainInvalidURI...")
 
@@ -260,6 +636,112 @@ func TestMainInvalidEncryptionConfig(t *testing.T) {
 	}
 }
 
+func TestMainPubkeyHeuristics(t *testing.T) {
+	fmt.Println("Running TestMainPubkeyHeuristics...")
+
+	// Setup Test
+	const pubkey = "age1xmwwc06ly3ee5rytxm9mflaz2u56jjj36s0mypdrwsvlul66mv4q47ryef"
+	workDir, _ := os.Getwd()
+	defer func() { _ = os.Chdir(workDir) }()
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatalf("could not change directory: %s", err.Error())
+	}
+	if err := os.WriteFile("recipients.txt", []byte(pubkey+"\n"), 0600); err != nil {
+		t.Fatalf("could not write file: %s", err.Error())
+	}
+
+	tests := []struct {
+		pubkey     string
+		recipients int
+		err        string
+		stderr     string
+	}{
+		/* surrounding whitespace is ignored */
+		{pubkey + "\n", 1, "", ""},
+		{"  " + pubkey + "\t", 1, "", ""},
+		/* malformed age recipients are not looked up on disk */
+		{"age1typo", 0, `parsing pubkey as age recipient failed: malformed recipient "age1typo": `, ""},
+		{pubkey[:len(pubkey)-1], 0, `parsing pubkey as age recipient failed: malformed recipient "` + pubkey[:len(pubkey)-1] + `": `, ""},
+		/* SSH public keys */
+		{"ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIHsKLqeplhpW+uObz5dvMgjz1OxfM/XXUB+VHtZ6isGN user@host", 0, "parsing pubkey as SSH public key failed: SSH recipients are not supported, use an age recipient", ""},
+		{"ecdsa-sha2-nistp256 AAAAE2VjZHNh", 0, "parsing pubkey as SSH public key failed: ", ""},
+		/* paths */
+		{"recipients.txt", 1, "", "pubkey parsing failed, assuming it is path to file\n"},
+		{"./missing.txt", 0, "could not open pubkey file: open ./missing.txt: no such file or directory", "pubkey parsing failed, assuming it is path to file\n"},
+		/* neither a key nor a path */
+		{"not-a-key", 0, `invalid pubkey: expecting an age recipient starting with "age1" or a path to a recipients file`, ""},
+	}
+
+	// Perform the test
+	for _, test := range tests {
+		var stdout, stderr bytes.Buffer
+		var cfg common.Config
+		cfg.Encryption.Pubkey = test.pubkey
+
+		recipients, err := initEncryption(&cfg, io.Writer(&stdout), io.Writer(&stderr))
+		description := fmt.Sprintf("TestMainPubkeyHeuristics(%q)", test.pubkey)
+		if len(test.err) > 0 {
+			if err == nil {
+				t.Fatalf("%s was supposed to fail", description)
+			}
+			assertEquals(t, true, strings.HasPrefix(err.Error(), test.err), description+".Error: "+err.Error())
+		} else if err != nil {
+			t.Fatalf("%s: unexpected error: %s", description, err.Error())
+		}
+		assertEquals(t, test.recipients, len(recipients), description+".recipients")
+		assertEquals(t, test.stderr, stderr.String(), description+".stderr")
+	}
+}
+
+func TestParseRecipientsFile(t *testing.T) {
+	fmt.Println("Running TestParseRecipientsFile...")
+
+	// Setup Test
+	var pubkeys []string
+	for i := 0; i <= maxRecipients; i++ {
+		identity, err := age.GenerateX25519Identity()
+		if err != nil {
+			t.Fatalf("could not generate identity: %s", err.Error())
+		}
+		pubkeys = append(pubkeys, identity.Recipient().String())
+	}
+
+	tests := []struct {
+		name       string
+		content    string
+		recipients []string
+		err        string
+	}{
+		{"single", pubkeys[0] + "\n", pubkeys[:1], ""},
+		{"duplicates", pubkeys[0] + "\n" + pubkeys[1] + "\n" + pubkeys[0] + "\n", pubkeys[:2], ""},
+		{"comments", "# backup keys\n\n  " + pubkeys[0] + "  \r\n\t# retired\n" + pubkeys[1], pubkeys[:2], ""},
+		{"only comments", "# backup keys\n\n", nil, "no recipients found"},
+		{"malformed", "# backup keys\n" + pubkeys[0] + "\nage1typo\n", nil, `malformed recipient at line 3: malformed recipient "age1typo": `},
+		{"limit", strings.Join(pubkeys[:maxRecipients], "\n"), pubkeys[:maxRecipients], ""},
+		{"limit with duplicates", strings.Join(append(pubkeys[:maxRecipients:maxRecipients], pubkeys[0]), "\n"), pubkeys[:maxRecipients], ""},
+		{"too many", strings.Join(pubkeys, "\n"), nil, fmt.Sprintf("too many recipients: found %d, at most %d are supported", maxRecipients+1, maxRecipients)},
+	}
+
+	// Perform the test
+	for _, test := range tests {
+		description := "TestParseRecipientsFile." + test.name
+		recipients, err := parseRecipientsFile(strings.NewReader(test.content))
+		if len(test.err) > 0 {
+			if err == nil {
+				t.Fatalf("%s was supposed to fail", description)
+			}
+			assertEquals(t, true, strings.HasPrefix(err.Error(), test.err), description+".Error: "+err.Error())
+		} else if err != nil {
+			t.Fatalf("%s: unexpected error: %s", description, err.Error())
+		}
+		var actual []string
+		for _, recipient := range recipients {
+			actual = append(actual, recipient.(*age.X25519Recipient).String())
+		}
+		assertEquals(t, strings.Join(test.recipients, " "), strings.Join(actual, " "), description+".recipients")
+	}
+}
+
 func TestMainInvalidConfig(t *testing.T) {
 	fmt.Println("Running TestMainInvalidConfig...")
 
@@ -324,6 +806,7 @@ func TestMainRun(t *testing.T) {
 	defaultConfigFilepath = ""
 
 	fmt.Println("Running TestMainRun...")
+	pinClock(t)
 	args := []string{appname, ".", "dummy://path/to/dir/"}
 	var stdout, stderr bytes.Buffer
 
@@ -339,17 +822,18 @@ func TestMainRun(t *testing.T) {
 	if err != nil {
 		t.Fatalf(err.Error())
 	} else {
-		diff := time.Now().Sub(time.Unix(0, 0))
-
-		assertEquals(t, fmt.Sprintf(`file info: {name:path/to/dir/ size:0 modified:{wall:0 ext:62135596800 loc:<nil>} isfile:false}
-uploaded backup archive of "." to "dummy://path/to/dir/%s.tar.gz"
+		assertEquals(t, `uploaded backup archive of "." to "dummy://path/to/dir/2024-05-01T03+0000.tar.gz"
+backup sizes: source N bytes, archive N bytes, uploaded N bytes
 removing file "dummy://path/to/dir/A"
 removing file "dummy://path/to/dir/B"
-`, time.Now().Format("2006-01-02T15-0700")), stdout.String(), "TestMainRun.stdout")
-		assertEquals(t, fmt.Sprintf(`default configuration path is empty
-file to/dir/A, time diff = %.0f h
-file to/dir/B, time diff = %.0f h
-`, diff.Hours(), diff.Hours()), stderr.String(), "TestMainRun.stderr")
+`, maskBackupSizes(stdout.String()), "TestMainRun.stdout")
+		assertEquals(t, `default configuration path is empty
+warning: no pubkey found, encryption disabled
+file to/dir/A, time diff = 476259 h
+file to/dir/B, time diff = 476259 h
+stage timings: archive=0s encrypt=0s upload=0s cleanup=0s total=0s
+1 warning (encryption: 1)
+`, stderr.String(), "TestMainRun.stderr")
 	}
 
 	// clean up
@@ -362,17 +846,16 @@ file to/dir/B, time diff = %.0f h
 	if err != nil {
 		t.Fatalf(err.Error())
 	} else {
-		diff := time.Now().Sub(time.Unix(0, 0))
-
-		assertEquals(t, fmt.Sprintf(`file info: {name:path/to/dir/ size:0 modified:{wall:0 ext:62135596800 loc:<nil>} isfile:false}
-uploaded backup archive of "." to "dummy://path/to/dir/%s.tar.gz.age"
+		assertEquals(t, `uploaded backup archive of "." to "dummy://path/to/dir/2024-05-01T03+0000.tar.gz.age"
+backup sizes: source N bytes, archive N bytes, uploaded N bytes
 removing file "dummy://path/to/dir/A"
 removing file "dummy://path/to/dir/B"
-`, time.Now().Format("2006-01-02T15-0700")), stdout.String(), "TestMainRun.stdout")
-		assertEquals(t, fmt.Sprintf(`default configuration path is empty
-file to/dir/A, time diff = %.0f h
-file to/dir/B, time diff = %.0f h
-`, diff.Hours(), diff.Hours()), stderr.String(), "TestMainRun.stderr")
+`, maskBackupSizes(stdout.String()), "TestMainRun.stdout")
+		assertEquals(t, `default configuration path is empty
+file to/dir/A, time diff = 476259 h
+file to/dir/B, time diff = 476259 h
+stage timings: archive=0s encrypt=0s upload=0s cleanup=0s total=0s
+`, stderr.String(), "TestMainRun.stderr")
 	}
 
 	// clean up
@@ -395,18 +878,17 @@ file to/dir/B, time diff = %.0f h
 	if err != nil {
 		t.Fatalf(err.Error())
 	} else {
-		diff := time.Now().Sub(time.Unix(0, 0))
-
-		assertEquals(t, fmt.Sprintf(`file info: {name:path/to/dir/ size:0 modified:{wall:0 ext:62135596800 loc:<nil>} isfile:false}
-uploaded backup archive of "." to "dummy://path/to/dir/%s.tar.gz.age"
+		assertEquals(t, `uploaded backup archive of "." to "dummy://path/to/dir/2024-05-01T03+0000.tar.gz.age"
+backup sizes: source N bytes, archive N bytes, uploaded N bytes
 removing file "dummy://path/to/dir/A"
 removing file "dummy://path/to/dir/B"
-`, time.Now().Format("2006-01-02T15-0700")), stdout.String(), "TestMainRun.stdout")
-		assertEquals(t, fmt.Sprintf(`default configuration path is empty
+`, maskBackupSizes(stdout.String()), "TestMainRun.stdout")
+		assertEquals(t, `default configuration path is empty
 pubkey parsing failed, assuming it is path to file
-file to/dir/A, time diff = %.0f h
-file to/dir/B, time diff = %.0f h
-`, diff.Hours(), diff.Hours()), stderr.String(), "TestMainRun.stderr")
+file to/dir/A, time diff = 476259 h
+file to/dir/B, time diff = 476259 h
+stage timings: archive=0s encrypt=0s upload=0s cleanup=0s total=0s
+`, stderr.String(), "TestMainRun.stderr")
 	}
 
 	// clean up
@@ -431,17 +913,16 @@ file to/dir/B, time diff = %.0f h
 	if err != nil {
 		t.Fatalf(err.Error())
 	} else {
-		diff := time.Now().Sub(time.Unix(0, 0))
-
-		assertEquals(t, fmt.Sprintf(`file info: {name:path/to/dir/ size:0 modified:{wall:0 ext:62135596800 loc:<nil>} isfile:false}
-uploaded backup archive of "." to "dummy://path/to/dir/%s.tar.gz.age"
+		assertEquals(t, `uploaded backup archive of "." to "dummy://path/to/dir/2024-05-01T03+0000.tar.gz.age"
+backup sizes: source N bytes, archive N bytes, uploaded N bytes
 removing file "dummy://path/to/dir/A"
 removing file "dummy://path/to/dir/B"
-`, time.Now().Format("2006-01-02T15-0700")), stdout.String(), "TestMainRun.stdout")
+`, maskBackupSizes(stdout.String()), "TestMainRun.stdout")
 		assertEquals(t, fmt.Sprintf(`loading configuration from %s
-file to/dir/A, time diff = %.0f h
-file to/dir/B, time diff = %.0f h
-`, tmpCfg.Name(), diff.Hours(), diff.Hours()), stderr.String(), "TestMainRun.stderr")
+file to/dir/A, time diff = 476259 h
+file to/dir/B, time diff = 476259 h
+stage timings: archive=0s encrypt=0s upload=0s cleanup=0s total=0s
+`, tmpCfg.Name()), stderr.String(), "TestMainRun.stderr")
 	}
 
 	// clean up
@@ -459,20 +940,1022 @@ file to/dir/B, time diff = %.0f h
 	if err != nil {
 		t.Fatalf(err.Error())
 	} else {
-		diff := time.Now().Sub(time.Unix(0, 0))
-
-		assertEquals(t, fmt.Sprintf(`file info: {name:path/to/dir/ size:0 modified:{wall:0 ext:62135596800 loc:<nil>} isfile:false}
-uploaded backup archive of "." to "dummy://path/to/dir/%s.tar.gz.age"
+		assertEquals(t, `uploaded backup archive of "." to "dummy://path/to/dir/2024-05-01T03+0000.tar.gz.age"
+backup sizes: source N bytes, archive N bytes, uploaded N bytes
 removing file "dummy://path/to/dir/A"
 removing file "dummy://path/to/dir/B"
-`, time.Now().Format("2006-01-02T15-0700")), stdout.String(), "TestMainRun.stdout")
+`, maskBackupSizes(stdout.String()), "TestMainRun.stdout")
 		assertEquals(t, fmt.Sprintf(`loading configuration from %s
 pubkey parsing failed, assuming it is path to file
-file to/dir/A, time diff = %.0f h
-file to/dir/B, time diff = %.0f h
-`, tmpCfg.Name(), diff.Hours(), diff.Hours()), stderr.String(), "TestMainRun.stderr")
+file to/dir/A, time diff = 476259 h
+file to/dir/B, time diff = 476259 h
+stage timings: archive=0s encrypt=0s upload=0s cleanup=0s total=0s
+`, tmpCfg.Name()), stderr.String(), "TestMainRun.stderr")
 	}
 
 	// clean up test
 	common.CreateDummyBackend = nil
 }
+
+func TestMainRunEncryptWithCommand(t *testing.T) {
+	fmt.Println("Running TestMainRunEncryptWithCommand...")
+	pinClock(t)
+
+	defaultConfigFilepath = ""
+	args := []string{appname, ".", "dummy://path/to/dir/"}
+	var stdout, stderr bytes.Buffer
+
+	os.Setenv("SQUIRRELUP_ENCRYPTION_COMMAND", "/bin/cat")
+	os.Setenv("SQUIRRELUP_ENCRYPTION_COMMAND_SUFFIX", ".enc")
+	os.Setenv("SQUIRRELUP_BACKUP_HOURS", "0")
+	err := run(args, nil, io.Writer(&stdout), io.Writer(&stderr))
+	os.Setenv("SQUIRRELUP_ENCRYPTION_COMMAND", "")
+	os.Setenv("SQUIRRELUP_ENCRYPTION_COMMAND_SUFFIX", "")
+	os.Setenv("SQUIRRELUP_BACKUP_HOURS", "")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	assertEquals(t, `uploaded backup archive of "." to "dummy://path/to/dir/2024-05-01T03+0000.tar.gz.enc"
+backup sizes: source N bytes, archive N bytes, uploaded N bytes
+`, maskBackupSizes(stdout.String()), "TestMainRunEncryptWithCommand.stdout")
+}
+
+func TestMainCleanupFailures(t *testing.T) {
+	fmt.Println("Running TestMainCleanupFailures...")
+
+	var stdout, stderr bytes.Buffer
+	var cfg common.Config
+	if err := cfg.SetDefaultValues(); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Setup Test
+	backend := &undeletableBackend{common.NewMemoryBackend(), map[string]bool{}}
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		uri, _ := url.ParseRequestURI("memory://bucket/to/dir/" + key)
+		if err := backend.StoreFile(context.Background(), common.StoreRequest{URI: uri, BodyAt: bytes.NewReader([]byte(key)), Length: 1}); err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		if err := backend.SetFileModified(uri, time.Unix(0, 0).UTC()); err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		if key != "c" {
+			backend.undeletable[uri.Path] = true
+		}
+	}
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/to/dir/")
+
+	/* aggregate removal failures */
+	_, err := cleanupBackupPrefix(backend, &cfg, common.Now(), prefixUri, nil, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("cleanupBackupPrefix was supposed to fail")
+	}
+	assertEquals(t, "cleanup completed with 4 failures: to/dir/a, to/dir/b, to/dir/d and 1 more", err.Error(), "TestMainCleanupFailures.Error")
+	assertEquals(t, `removing file "memory://bucket/to/dir/a"
+removing file "memory://bucket/to/dir/b"
+removing file "memory://bucket/to/dir/c"
+removing file "memory://bucket/to/dir/d"
+removing file "memory://bucket/to/dir/e"
+`, stdout.String(), "TestMainCleanupFailures.stdout")
+
+	filelist, _ := backend.ListFiles(prefixUri)
+	assertEquals(t, 4, len(filelist), "TestMainCleanupFailures.len(filelist)")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* best effort cleanup ignores removal failures */
+	cfg.Backup.CleanupBestEffort = true
+	_, err = cleanupBackupPrefix(backend, &cfg, common.Now(), prefixUri, nil, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, strings.Contains(stderr.String(), `could not remove remote file "memory://bucket/to/dir/e": access denied`), "TestMainCleanupFailures.stderr")
+}
+
+func TestMainCleanupWarning(t *testing.T) {
+	fmt.Println("Running TestMainCleanupWarning...")
+
+	// Setup Test
+	backend := &undeletableBackend{common.NewMemoryBackend(), map[string]bool{}}
+	useBackend := setupBackend(t, backend, map[string]string{"SQUIRRELUP_BACKUP_HOURS": "1"})
+
+	oldUri, _ := url.ParseRequestURI("dummy://bucket/prefix/2024-04-01T03+0000.tar.gz")
+	if err := backend.StoreFile(context.Background(), common.StoreRequest{URI: oldUri, BodyAt: bytes.NewReader([]byte("old")), Length: 3}); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	if err := backend.SetFileModified(oldUri, time.Date(2024, time.April, 1, 3, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	backend.undeletable[oldUri.Path] = true
+	prefixUri, _ := url.ParseRequestURI("dummy://bucket/prefix/")
+
+	var stdout, stderr bytes.Buffer
+	args := []string{appname, ".", "dummy://bucket/prefix/"}
+
+	/* upload succeeded, cleanup failed */
+	err := run(args, nil, io.Writer(&stdout), io.Writer(&stderr))
+	var warning *warningError
+	if !errors.As(err, &warning) {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "warning: backup archive was uploaded, but failed to clean up backup prefix: cleanup completed with 1 failures: prefix/2024-04-01T03+0000.tar.gz", err.Error(), "TestMainCleanupWarning.Error")
+	assertEquals(t, true, strings.Contains(stdout.String(), "uploaded backup archive of \".\" to \"dummy://bucket/prefix/2024-05-01T03+0000.tar.gz\"\n"), "TestMainCleanupWarning.stdout")
+
+	filelist, _ := backend.ListFiles(prefixUri)
+	assertEquals(t, 3, len(filelist), "TestMainCleanupWarning.len(filelist)")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* cleanup failures are fatal if configured */
+	os.Setenv("SQUIRRELUP_BACKUP_CLEANUP_ERRORS_FATAL", "true")
+	defer os.Setenv("SQUIRRELUP_BACKUP_CLEANUP_ERRORS_FATAL", "")
+	err = run(args, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil || errors.As(err, &warning) {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "failed to clean up backup prefix: cleanup completed with 1 failures: prefix/2024-04-01T03+0000.tar.gz", err.Error(), "TestMainCleanupWarning.Error")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* upload failed, cleanup skipped */
+	useBackend(&unwritableBackend{backend})
+	backend.undeletable = map[string]bool{}
+	err = run(args, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil || errors.As(err, &warning) {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, strings.HasPrefix(err.Error(), "unable to write backup archive of \".\""), "TestMainCleanupWarning.Error")
+	assertEquals(t, false, strings.Contains(stdout.String(), "removing file"), "TestMainCleanupWarning.stdout")
+
+	filelist, _ = backend.ListFiles(prefixUri)
+	assertEquals(t, 3, len(filelist), "TestMainCleanupWarning.len(filelist)")
+}
+
+func TestMainMaxDeletions(t *testing.T) {
+	fmt.Println("Running TestMainMaxDeletions...")
+
+	// Setup Test
+	memory := common.NewMemoryBackend()
+	setupBackend(t, memory, map[string]string{
+		"SQUIRRELUP_BACKUP_HOURS":                 "1",
+		"SQUIRRELUP_BACKUP_MAX_DELETIONS_PER_RUN": "2",
+	})
+
+	for day := 1; day <= 3; day++ {
+		oldUri, _ := url.ParseRequestURI(fmt.Sprintf("dummy://bucket/prefix/2024-04-0%dT03+0000.tar.gz", day))
+		if err := memory.StoreFile(context.Background(), common.StoreRequest{URI: oldUri, BodyAt: bytes.NewReader([]byte("old")), Length: 3}); err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		if err := memory.SetFileModified(oldUri, time.Date(2024, time.April, day, 3, 0, 0, 0, time.UTC)); err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+	}
+	prefixUri, _ := url.ParseRequestURI("dummy://bucket/prefix/")
+
+	var stdout, stderr bytes.Buffer
+	args := []string{appname, ".", "dummy://bucket/prefix/"}
+
+	/* the oldest backups are removed, the run ends with a warning */
+	err := run(args, nil, io.Writer(&stdout), io.Writer(&stderr))
+	var warning *warningError
+	if !errors.As(err, &warning) {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "warning: backup archive was uploaded, but 1 expired objects remain for later runs", err.Error(), "TestMainMaxDeletions.Error")
+	assertEquals(t, true, strings.HasSuffix(stdout.String(), `removing file "dummy://bucket/prefix/2024-04-01T03+0000.tar.gz"
+removing file "dummy://bucket/prefix/2024-04-02T03+0000.tar.gz"
+`), "TestMainMaxDeletions.stdout")
+	assertEquals(t, true, strings.Contains(stderr.String(), "warning: removed at most 2 objects under \"dummy://bucket/prefix/\", 1 expired objects remain for later runs\n"), "TestMainMaxDeletions.stderr")
+
+	// the newest old backup is left along with the new backup and the catalog
+	filelist, _ := memory.ListFiles(prefixUri)
+	assertEquals(t, 3, len(filelist), "TestMainMaxDeletions.len(filelist)")
+	assertEquals(t, "prefix/2024-04-03T03+0000.tar.gz", filelist[1].Name(), "TestMainMaxDeletions.filelist[1]")
+}
+
+func TestMainRestrictedKey(t *testing.T) {
+	fmt.Println("Running TestMainRestrictedKey...")
+
+	// Setup Test
+	memory := common.NewMemoryBackend()
+	setupBackend(t, &restrictedBackend{memory}, map[string]string{"SQUIRRELUP_BACKUP_HOURS": "1"})
+
+	oldUri, _ := url.ParseRequestURI("dummy://bucket/prefix/2024-04-01T03+0000.tar.gz")
+	if err := memory.StoreFile(context.Background(), common.StoreRequest{URI: oldUri, BodyAt: bytes.NewReader([]byte("old")), Length: 3}); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	if err := memory.SetFileModified(oldUri, time.Date(2024, time.April, 1, 3, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	prefixUri, _ := url.ParseRequestURI("dummy://bucket/prefix/")
+
+	var stdout, stderr bytes.Buffer
+	args := []string{appname, ".", "dummy://bucket/prefix/"}
+
+	/* listing is forbidden, the backup is uploaded and cleanup skipped */
+	err := run(args, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, strings.Contains(stdout.String(), "uploaded backup archive of \".\" to \"dummy://bucket/prefix/2024-05-01T03+0000.tar.gz\"\n"), "TestMainRestrictedKey.stdout")
+	assertEquals(t, true, strings.HasSuffix(stderr.String(), "warning: listing \"dummy://bucket/prefix/\" is not permitted, assuming a key restricted to writing\n"+
+		"warning: no pubkey found, encryption disabled\n"+
+		"warning: listing \"dummy://bucket/prefix/\" is not permitted, skipping cleanup of old backups\n"+
+		"stage timings: archive=0s encrypt=0s upload=0s cleanup=0s total=0s\n"+
+		"3 warnings (encryption: 1, listing: 2)\n"), "TestMainRestrictedKey.stderr")
+
+	filelist, _ := memory.ListFiles(prefixUri)
+	assertEquals(t, 2, len(filelist), "TestMainRestrictedKey.len(filelist)")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* warnings are silenced for keys known to be write-only */
+	os.Setenv("SQUIRRELUP_S3_ASSUME_WRITE_ONLY", "true")
+	defer os.Setenv("SQUIRRELUP_S3_ASSUME_WRITE_ONLY", "")
+	err = run(args, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, false, strings.Contains(stderr.String(), "is not permitted"), "TestMainRestrictedKey.stderr")
+}
+
+func TestMainTimezone(t *testing.T) {
+	fmt.Println("Running TestMainTimezone...")
+
+	var cfg common.Config
+	if err := cfg.SetDefaultValues(); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Setup Test
+	fakeNow := time.Date(2023, time.October, 29, 0, 30, 0, 0, time.UTC)
+	common.Now = func() time.Time { return fakeNow }
+	defer func() { common.Now = time.Now }()
+
+	/* backup names */
+	for _, testCase := range []struct {
+		timezone string
+		now      time.Time
+		expected string
+	}{
+		{"UTC", fakeNow, "2023-10-29T00+0000"},
+		{"Asia/Kathmandu", fakeNow, "2023-10-29T06+0545"},
+		// DST transition: 02:30 local time occurs twice
+		{"Europe/Berlin", fakeNow, "2023-10-29T02+0200"},
+		{"Europe/Berlin", fakeNow.Add(time.Hour), "2023-10-29T02+0100"},
+	} {
+		cfg.Backup.Timezone = testCase.timezone
+		name, err := cfg.BackupName(testCase.now)
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		assertEquals(t, testCase.expected, name, "TestMainTimezone.name("+testCase.timezone+")")
+	}
+
+	/* retention decisions */
+	for _, timezone := range []string{"UTC", "Asia/Kathmandu", "Europe/Berlin"} {
+		var stdout, stderr bytes.Buffer
+
+		backend := common.NewMemoryBackend()
+		for key, modified := range map[string]time.Time{
+			"fresh": fakeNow.Add(-239 * time.Hour),
+			"stale": fakeNow.Add(-241 * time.Hour),
+		} {
+			uri, _ := url.ParseRequestURI("memory://bucket/to/dir/" + key)
+			if err := backend.StoreFile(context.Background(), common.StoreRequest{URI: uri, BodyAt: bytes.NewReader([]byte(key)), Length: int64(len(key))}); err != nil {
+				t.Fatalf("unexpected test result: %+v", err)
+			}
+			if err := backend.SetFileModified(uri, modified); err != nil {
+				t.Fatalf("unexpected test result: %+v", err)
+			}
+		}
+		prefixUri, _ := url.ParseRequestURI("memory://bucket/to/dir/")
+
+		cfg.Backup.Timezone = timezone
+		if _, err := cleanupBackupPrefix(backend, &cfg, common.Now(), prefixUri, nil, nil, io.Writer(&stdout), io.Writer(&stderr)); err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		assertEquals(t, `removing file "memory://bucket/to/dir/stale"
+`, stdout.String(), "TestMainTimezone.stdout("+timezone+")")
+	}
+
+	/* backup name in run */
+	var stdout, stderr bytes.Buffer
+	defaultConfigFilepath = ""
+	args := []string{appname, ".", "dummy://path/to/dir/"}
+
+	os.Setenv("SQUIRRELUP_BACKUP_TIMEZONE", "Asia/Kathmandu")
+	os.Setenv("SQUIRRELUP_BACKUP_HOURS", "0")
+	err := run(args, nil, io.Writer(&stdout), io.Writer(&stderr))
+	os.Setenv("SQUIRRELUP_BACKUP_HOURS", "")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assertEquals(t, `uploaded backup archive of "." to "dummy://path/to/dir/2023-10-29T06+0545.tar.gz"
+backup sizes: source N bytes, archive N bytes, uploaded N bytes
+`, maskBackupSizes(stdout.String()), "TestMainTimezone.stdout")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* invalid time zone */
+	os.Setenv("SQUIRRELUP_BACKUP_TIMEZONE", "Mars/Olympus_Mons")
+	err = run(args, nil, io.Writer(&stdout), io.Writer(&stderr))
+	os.Setenv("SQUIRRELUP_BACKUP_TIMEZONE", "")
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, `invalid configuration: invalid backup timezone "Mars/Olympus_Mons": unknown time zone Mars/Olympus_Mons`, err.Error(), "TestMainTimezone.Error")
+	assertEquals(t, 0, len(stdout.String()), "TestMainTimezone.stdout")
+}
+
+func TestMainTimestamp(t *testing.T) {
+	fmt.Println("Running TestMainTimestamp...")
+	pinClock(t)
+
+	defaultConfigFilepath = ""
+	var stdout, stderr bytes.Buffer
+
+	/* pinned nominal time */
+	args := []string{appname, "--timestamp", "2023-01-02T03:04:05+01:00", ".", "dummy://path/to/dir/"}
+
+	os.Setenv("SQUIRRELUP_BACKUP_HOURS", "0")
+	err := run(args, nil, io.Writer(&stdout), io.Writer(&stderr))
+	os.Setenv("SQUIRRELUP_BACKUP_HOURS", "")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assertEquals(t, `uploaded backup archive of "." to "dummy://path/to/dir/2023-01-02T02+0000.tar.gz"
+backup sizes: source N bytes, archive N bytes, uploaded N bytes
+`, maskBackupSizes(stdout.String()), "TestMainTimestamp.stdout")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* invalid timestamp */
+	args = []string{appname, "--timestamp", "yesterday", ".", "dummy://path/to/dir/"}
+
+	err = run(args, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, `could not parse timestamp, expecting RFC3339 format: parsing time "yesterday" as "2006-01-02T15:04:05Z07:00": cannot parse "yesterday" as "2006"`, err.Error(), "TestMainTimestamp.Error")
+	assertEquals(t, 0, len(stdout.String()), "TestMainTimestamp.stdout")
+	assertEquals(t, 0, len(stderr.String()), "TestMainTimestamp.stderr")
+}
+
+func TestMainKeepLocal(t *testing.T) {
+	fmt.Println("Running TestMainKeepLocal...")
+	pinClock(t)
+
+	defaultConfigFilepath = ""
+	t.Setenv("SQUIRRELUP_BACKUP_HOURS", "0")
+	localDir := t.TempDir()
+	var stdout, stderr bytes.Buffer
+
+	/* the uploaded archive is kept locally */
+	args := []string{appname, "--keep-local", localDir, ".", "dummy://path/to/dir/"}
+	err := run(args, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	localPath := filepath.Join(localDir, "2024-05-01T03+0000.tar.gz")
+	assertEquals(t, true, strings.Contains(stdout.String(), fmt.Sprintf("kept local copy of the backup at %q\n", localPath)), "TestMainKeepLocal.stdout")
+	if _, err := os.Stat(localPath); err != nil {
+		t.Fatalf("local copy missing: %s", err.Error())
+	}
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* the flag is validated along with the configuration */
+	t.Setenv("SQUIRRELUP_BACKUP_DEDUP", "true")
+	err = run(args, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, "invalid configuration: deduplicated backups cannot be kept locally", err.Error(), "TestMainKeepLocal.Error")
+}
+
+func TestMainMirrors(t *testing.T) {
+	fmt.Println("Running TestMainMirrors...")
+
+	// Setup Test
+	memory := common.NewMemoryBackend()
+	setupBackend(t, &bucketUnwritableBackend{memory, "offline"}, map[string]string{
+		"SQUIRRELUP_BACKUP_HOURS":   "0",
+		"SQUIRRELUP_BACKUP_MIRRORS": "dummy://bucket/configured/",
+	})
+	var stdout, stderr bytes.Buffer
+
+	/* the backup is stored under the output prefix and every mirror */
+	args := []string{appname, "--also", "dummy://bucket/flag", ".", "dummy://bucket/prefix/"}
+	err := run(args, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	for _, prefix := range []string{"prefix", "configured", "flag"} {
+		objectUri, _ := url.ParseRequestURI("dummy://bucket/" + prefix + "/2024-05-01T03+0000.tar.gz")
+		if _, err := memory.GetFileInfo(objectUri); err != nil {
+			t.Fatalf("backup missing under %q: %s", prefix, err.Error())
+		}
+		assertEquals(t, true, strings.Contains(stdout.String(), fmt.Sprintf("uploaded backup archive of \".\" to %q\n", objectUri)), "TestMainMirrors.stdout")
+	}
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* a mirror that cannot store the backup fails it */
+	args = []string{appname, "--also", "dummy://offline/prefix/", ".", "dummy://bucket/prefix/"}
+	err = run(args, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, true, strings.HasPrefix(err.Error(), "backup was not stored under every mirror: \"dummy://offline/prefix/\": "), "TestMainMirrors.Error")
+	assertEquals(t, true, strings.Contains(stderr.String(), "mirror \"dummy://offline/prefix/\" failed: "), "TestMainMirrors.stderr")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* unless any copy is enough */
+	t.Setenv("SQUIRRELUP_BACKUP_MIRROR_POLICY", "any")
+	err = run(args, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, strings.Contains(stderr.String(), "warning: backup was not stored under mirror \"dummy://offline/prefix/\": "), "TestMainMirrors.stderr")
+}
+
+func TestMainPerHostPrefix(t *testing.T) {
+	fmt.Println("Running TestMainPerHostPrefix...")
+
+	// Setup Test
+	memory := common.NewMemoryBackend()
+	setupBackend(t, memory, map[string]string{
+		"SQUIRRELUP_BACKUP_PER_HOST_PREFIX": "true",
+		"SQUIRRELUP_BACKUP_HOURS":           "0",
+	})
+	common.Hostname = func() (string, error) {
+		return "Web-01.Example.COM", nil
+	}
+	defer func() { common.Hostname = os.Hostname }()
+
+	var stdout, stderr bytes.Buffer
+
+	/* host name reported by the kernel */
+	args := []string{appname, "--verbose", ".", "dummy://bucket/prefix"}
+	err := run(args, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, strings.Contains(stderr.String(), "using per-host output prefix \"dummy://bucket/prefix/web-01.example.com/\"\n"), "TestMainPerHostPrefix.stderr")
+	assertEquals(t, true, strings.HasSuffix(maskBackupSizes(stdout.String()), "uploaded backup archive of \".\" to \"dummy://bucket/prefix/web-01.example.com/2024-05-01T03+0000.tar.gz\"\nbackup sizes: source N bytes, archive N bytes, uploaded N bytes\n"), "TestMainPerHostPrefix.stdout")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* configured host name with characters invalid in object keys */
+	os.Setenv("SQUIRRELUP_BACKUP_HOSTNAME", "db 02/primary")
+	defer os.Setenv("SQUIRRELUP_BACKUP_HOSTNAME", "")
+
+	args = []string{appname, ".", "dummy://bucket/prefix/"}
+	err = run(args, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, strings.HasSuffix(maskBackupSizes(stdout.String()), "uploaded backup archive of \".\" to \"dummy://bucket/prefix/db-02-primary/2024-05-01T03+0000.tar.gz\"\nbackup sizes: source N bytes, archive N bytes, uploaded N bytes\n"), "TestMainPerHostPrefix.stdout")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* host name that is empty after sanitization */
+	os.Setenv("SQUIRRELUP_BACKUP_HOSTNAME", "..")
+
+	err = run(args, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, `invalid configuration: invalid backup hostname "..": empty after sanitization`, err.Error(), "TestMainPerHostPrefix.Error")
+}
+
+func TestParsePrefixUri(t *testing.T) {
+	fmt.Println("Running TestParsePrefixUri...")
+
+	for arg, expected := range map[string]string{
+		"b2://bucket/backups":          "b2://bucket/backups/",
+		"b2://bucket/backups/":         "b2://bucket/backups/",
+		"b2://bucket/Datenbank%20Sich": "b2://bucket/Datenbank%20Sich/",
+		"b2://bucket":                  "b2://bucket/",
+		"b2://bucket/":                 "b2://bucket/",
+	} {
+		var stderr bytes.Buffer
+		uri, err := parsePrefixUri(arg, true, &stderr)
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		assertEquals(t, expected, uri.String(), "TestParsePrefixUri."+arg)
+
+		/* a notice is shown if a slash was appended to a path */
+		var notice string
+		if arg != expected && arg != "b2://bucket" {
+			notice = fmt.Sprintf("prefix URI %q has no trailing slash, using %q\n", arg, expected)
+		}
+		assertEquals(t, notice, stderr.String(), "TestParsePrefixUri.stderr")
+	}
+
+	_, err := parsePrefixUri("bucket/backups", true, io.Discard)
+	assertEquals(t, `parse "bucket/backups": invalid URI for request`, fmt.Sprintf("%v", err), "TestParsePrefixUri.err")
+}
+
+func TestMainPrefixWithoutSlash(t *testing.T) {
+	fmt.Println("Running TestMainPrefixWithoutSlash...")
+
+	// Setup Test
+	memory := setupCatalog(t)
+	var stdout, stderr bytes.Buffer
+
+	// Perform the test
+	for prefix, expected := range map[string]string{
+		"dummy://bucket/backups":  "dummy://bucket/backups/2024-05-01T03+0000.tar.gz",
+		"dummy://bucket/backups/": "dummy://bucket/backups/2024-05-01T03+0000.tar.gz",
+		"dummy://bucket":          "dummy://bucket/2024-05-01T03+0000.tar.gz",
+	} {
+		stdout.Reset()
+		err := run([]string{appname, ".", prefix}, nil, io.Writer(&stdout), io.Writer(&stderr))
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		assertEquals(t, true, strings.HasSuffix(maskBackupSizes(stdout.String()), fmt.Sprintf("uploaded backup archive of \".\" to %q\nbackup sizes: source N bytes, archive N bytes, uploaded N bytes\n", expected)), "TestMainPrefixWithoutSlash.stdout")
+
+		/* the backup is stored below the last segment of the prefix, not next to it */
+		objectUri, _ := url.ParseRequestURI(expected)
+		_, err = memory.GetFileInfo(objectUri)
+		assertEquals(t, nil, err, "TestMainPrefixWithoutSlash.err")
+	}
+}
+
+// countingBackend is a MemoryBackend counting the lookups and bounded listings of prefixes.
+type countingBackend struct {
+	*common.MemoryBackend
+	fileInfos, boundedLists int
+	limits                  []int
+}
+
+func (c *countingBackend) GetFileInfo(uri *url.URL) (*common.FileInfo, error) {
+	if strings.HasSuffix(uri.Path, "/") {
+		c.fileInfos++
+	}
+	return c.MemoryBackend.GetFileInfo(uri)
+}
+
+func (c *countingBackend) ListFilesLimit(uri *url.URL, limit int) ([]common.FileInfo, error) {
+	c.boundedLists++
+	c.limits = append(c.limits, limit)
+	filelist, err := c.MemoryBackend.ListFiles(uri)
+	if len(filelist) > limit {
+		filelist = filelist[:limit]
+	}
+	return filelist, err
+}
+
+func TestMainValidatePrefix(t *testing.T) {
+	fmt.Println("Running TestMainValidatePrefix...")
+
+	// Setup Test
+	memory := common.NewMemoryBackend()
+	counting := &countingBackend{MemoryBackend: memory}
+	setupBackend(t, counting, map[string]string{
+		"SQUIRRELUP_BACKUP_HOURS":    "24",
+		"SQUIRRELUP_BACKUP_HOSTNAME": "host-a",
+	})
+	fileUri, _ := url.ParseRequestURI("dummy://bucket/backups/file")
+	if err := memory.StoreFile(context.Background(), common.StoreRequest{URI: fileUri, BodyAt: bytes.NewReader([]byte("file")), Length: 4}); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	var stdout, stderr bytes.Buffer
+
+	/* by default a single object is listed to validate the prefix */
+	err := run([]string{appname, ".", "dummy://bucket/backups/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 1, counting.boundedLists, "TestMainValidatePrefix.boundedLists")
+	assertEquals(t, "[1]", fmt.Sprint(counting.limits), "TestMainValidatePrefix.limits")
+	assertEquals(t, 0, counting.fileInfos, "TestMainValidatePrefix.fileInfos")
+	assertEquals(t, false, strings.Contains(stdout.String(), "file info:"), "TestMainValidatePrefix.stdout")
+
+	/* --stat-prefix looks up the whole prefix and prints its size */
+	*counting = countingBackend{MemoryBackend: memory}
+	stdout.Reset()
+	err = run([]string{appname, "--stat-prefix", ".", "dummy://bucket/backups/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 0, counting.boundedLists, "TestMainValidatePrefix.boundedLists")
+	assertEquals(t, 1, counting.fileInfos, "TestMainValidatePrefix.fileInfos")
+	assertEquals(t, true, strings.HasPrefix(stdout.String(), "file info: {name:backups/ size:"), "TestMainValidatePrefix.stdout")
+
+	/* a file path is still refused */
+	stdout.Reset()
+	err = run([]string{appname, ".", "dummy://bucket/backups/file"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("This test should throw an error")
+	}
+	assertEquals(t, `output URI must be a directory prefix, but a file path was specified: "dummy://bucket/backups/file"`, err.Error(), "TestMainValidatePrefix.err")
+}
+
+func TestMainBackupSizes(t *testing.T) {
+	fmt.Println("Running TestMainBackupSizes...")
+
+	// Setup Test
+	memory := common.NewMemoryBackend()
+	setupBackend(t, memory, map[string]string{"SQUIRRELUP_BACKUP_HOURS": "0"})
+
+	tmpDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tmpDir, "sub"), 0755); err != nil {
+		t.Fatalf("could not create directory: %s", err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "file"), bytes.Repeat([]byte("a"), 1000), 0600); err != nil {
+		t.Fatalf("could not write to temporary file: %s", err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "sub", "other"), bytes.Repeat([]byte("b"), 234), 0600); err != nil {
+		t.Fatalf("could not write to temporary file: %s", err.Error())
+	}
+
+	identity, _ := age.GenerateX25519Identity()
+	var stdout, stderr bytes.Buffer
+
+	for _, encrypted := range []bool{false, true} {
+		var pubkey, uri string = "", "dummy://bucket/plain/2024-05-01T03+0000.tar.gz"
+		if encrypted {
+			pubkey, uri = identity.Recipient().String(), "dummy://bucket/encrypted/2024-05-01T03+0000.tar.gz.age"
+		}
+		os.Setenv("SQUIRRELUP_PUBKEY", pubkey)
+
+		// Perform the test
+		err := run([]string{appname, tmpDir, strings.TrimSuffix(uri, path.Base(uri))}, nil, io.Writer(&stdout), io.Writer(&stderr))
+		os.Setenv("SQUIRRELUP_PUBKEY", "")
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+
+		mockURI, _ := url.ParseRequestURI(uri)
+		fileinfo, err := memory.GetFileInfo(mockURI)
+		if err != nil {
+			t.Fatalf("could not get file info: %s", err.Error())
+		}
+		var archive string
+		if encrypted {
+			archive, err = retrieveDecrypted(t, memory, uri, identity)
+		} else {
+			var buf bytes.Buffer
+			err = memory.RetrieveFile(&buf, mockURI)
+			archive = buf.String()
+		}
+		if err != nil {
+			t.Fatalf("could not retrieve archive: %s", err.Error())
+		}
+		assertEquals(t, encrypted, int(fileinfo.Size()) != len(archive), "TestMainBackupSizes.encrypted")
+
+		expected := fmt.Sprintf("backup sizes: source 1234 bytes, archive %d bytes, uploaded %d bytes\n", len(archive), fileinfo.Size())
+		assertEquals(t, true, strings.Contains(stdout.String(), expected), "TestMainBackupSizes.stdout")
+
+		// clean up
+		stdout.Reset()
+		stderr.Reset()
+	}
+}
+
+func TestMainArchiveProgress(t *testing.T) {
+	fmt.Println("Running TestMainArchiveProgress...")
+
+	// Setup Test
+	var cfg common.Config
+	if err := cfg.SetDefaultValues(); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	tmpDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tmpDir, "sub"), 0755); err != nil {
+		t.Fatalf("could not create directory: %s", err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "file"), bytes.Repeat([]byte("a"), 1000), 0600); err != nil {
+		t.Fatalf("could not write to temporary file: %s", err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, "sub", "other"), bytes.Repeat([]byte("b"), 234), 0600); err != nil {
+		t.Fatalf("could not write to temporary file: %s", err.Error())
+	}
+	if err := os.Symlink("file", filepath.Join(tmpDir, "link")); err != nil {
+		t.Fatalf("could not create symlink: %s", err.Error())
+	}
+
+	for _, noSizeEstimate := range []bool{false, true} {
+		recorder := &progressRecorder{advanced: map[int]int64{}}
+		cfg.Internal.Reporter = recorder
+		cfg.Progress.NoSizeEstimate = noSizeEstimate
+
+		// Perform the test
+		archivePath, sourceSize, err := archiveDirectory(tmpDir, &cfg)
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		_ = os.Remove(archivePath)
+
+		var expected int64 = 1234
+		if noSizeEstimate {
+			expected = -1
+		}
+		assertEquals(t, int64(1234), sourceSize, "TestMainArchiveProgress.sourceSize")
+		assertEquals(t, 1, len(recorder.sizes), "TestMainArchiveProgress.len(sizes)")
+		assertEquals(t, expected, recorder.sizes[0], "TestMainArchiveProgress.sizes[0]")
+		assertEquals(t, int64(1234), recorder.advanced[1], "TestMainArchiveProgress.advanced")
+	}
+}
+
+func TestMainNoProgress(t *testing.T) {
+	fmt.Println("Running TestMainNoProgress...")
+
+	// Setup Test
+	setupBackend(t, common.NewMemoryBackend(), map[string]string{
+		"SQUIRRELUP_BACKUP_HOURS": "0",
+		"SQUIRRELUP_NO_PROGRESS":  "",
+		"NO_COLOR":                "",
+		"TERM":                    "xterm",
+	})
+
+	var stdout, stderr bytes.Buffer
+
+	/* progress is hidden by the switch */
+	err := run([]string{appname, "--verbose", "--no-progress", ".", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, false, strings.Contains(stdout.String(), "archiving"), "TestMainNoProgress.stdout")
+	assertEquals(t, false, strings.Contains(stdout.String(), "\033"), "TestMainNoProgress.stdout")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* dumb terminals get plain progress */
+	t.Setenv("TERM", "dumb")
+	err = run([]string{appname, "--verbose", ".", "dummy://bucket/other/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, strings.Contains(stdout.String(), "archiving...\n"), "TestMainNoProgress.stdout")
+	assertEquals(t, false, strings.Contains(stdout.String(), "\033"), "TestMainNoProgress.stdout")
+}
+
+func TestMainMaxDuration(t *testing.T) {
+	fmt.Println("Running TestMainMaxDuration...")
+
+	// Setup Test
+	memory := common.NewMemoryBackend()
+	setupBackend(t, &slowBackend{memory}, map[string]string{
+		"SQUIRRELUP_BACKUP_HOURS":                "0",
+		"SQUIRRELUP_BACKUP_MAX_DURATION_MINUTES": "0.001",
+	})
+	prefixUri, _ := url.ParseRequestURI("dummy://bucket/prefix/")
+
+	var stdout, stderr bytes.Buffer
+
+	/* the upload is aborted once the deadline passes */
+	err := run([]string{appname, ".", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	var timeout *timeoutError
+	if !errors.As(err, &timeout) {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, strings.HasPrefix(err.Error(), "deadline exceeded: backup did not finish within 60ms: "), "TestMainMaxDuration.Error")
+	filelist, _ := memory.ListFiles(prefixUri)
+	assertEquals(t, 0, len(filelist), "TestMainMaxDuration.len(filelist)")
+}
+
+func TestMainEncryptionRequired(t *testing.T) {
+	fmt.Println("Running TestMainEncryptionRequired...")
+
+	// Setup Test
+	setupBackend(t, nil, map[string]string{
+		"SQUIRRELUP_ENCRYPTION_REQUIRED": "true",
+		"SQUIRRELUP_PUBKEY":              "",
+	})
+
+	var stdout, stderr bytes.Buffer
+
+	/* the empty backup directory is not scanned and no backend is created */
+	err := run([]string{appname, t.TempDir(), "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, "encryption is required, but no usable recipient was configured", err.Error(), "TestMainEncryptionRequired.Error")
+	assertEquals(t, 0, stdout.Len(), "TestMainEncryptionRequired.stdout")
+}
+
+func TestMainStdinTar(t *testing.T) {
+	fmt.Println("Running TestMainStdinTar...")
+
+	// Setup Test
+	memory := setupCatalog(t)
+	identity, _ := age.GenerateX25519Identity()
+	os.Setenv("SQUIRRELUP_PUBKEY", identity.Recipient().String())
+	defer os.Setenv("SQUIRRELUP_PUBKEY", "")
+	prefixUri, _ := url.ParseRequestURI("dummy://bucket/prefix/")
+
+	var stream bytes.Buffer
+	writer := tar.NewWriter(&stream)
+	_ = writer.WriteHeader(&tar.Header{Name: "data/file.txt", Mode: 0600, Size: 12, Typeflag: tar.TypeReg})
+	_, _ = writer.Write([]byte("test content"))
+	_ = writer.Close()
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, _ = gz.Write(stream.Bytes())
+	_ = gz.Close()
+
+	// Perform the test
+	for _, test := range []struct {
+		timestamp string
+		format    string
+		input     []byte
+	}{
+		{"2024-05-01T01:00:00Z", "tar", stream.Bytes()},
+		{"2024-05-01T02:00:00Z", "tar", compressed.Bytes()},
+		{"2024-05-01T03:00:00Z", "tar.gz", compressed.Bytes()},
+	} {
+		var stdout, stderr bytes.Buffer
+		args := []string{appname, "--input-format", test.format, "--timestamp", test.timestamp, "-", "dummy://bucket/prefix/"}
+		err := run(args, bytes.NewReader(test.input), io.Writer(&stdout), io.Writer(&stderr))
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+
+		/* the stored backup decrypts back to the stream */
+		objectUri, _ := prefixUri.Parse(strings.Replace(test.timestamp[:13], ":", "", 1) + "+0000.tar.gz.age")
+		var encrypted bytes.Buffer
+		if err = memory.RetrieveFile(&encrypted, objectUri); err != nil {
+			t.Fatalf("could not retrieve %q: %s", objectUri, err.Error())
+		}
+		plaintext, err := common.DecryptStream(&encrypted, []age.Identity{identity})
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		decrypted, _ := io.ReadAll(plaintext)
+		if test.format == "tar.gz" {
+			assertEquals(t, true, bytes.Equal(compressed.Bytes(), decrypted), "TestMainStdinTar.decrypted")
+		}
+		reader, err := gzip.NewReader(bytes.NewReader(decrypted))
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		decompressed, _ := io.ReadAll(reader)
+		assertEquals(t, true, bytes.Equal(stream.Bytes(), decompressed), "TestMainStdinTar.decompressed")
+	}
+
+	/* the catalog records standard input as source */
+	catalogObjectUri, _ := catalogUri(prefixUri)
+	catalog, err := readCatalog(memory, catalogObjectUri, &auxiliaryKeys{identities: []age.Identity{identity}})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 3, len(catalog.Entries), "TestMainStdinTar.len(Entries)")
+	assertEquals(t, "(stdin)", catalog.Entries[2].Source, "TestMainStdinTar.Source")
+	assertEquals(t, int64(stream.Len()), catalog.Entries[2].SourceSize, "TestMainStdinTar.SourceSize")
+}
+
+func TestMainStdinTarErrors(t *testing.T) {
+	fmt.Println("Running TestMainStdinTarErrors...")
+
+	// Setup Test
+	setupCatalog(t)
+
+	// Perform the test
+	for _, test := range []struct {
+		args     []string
+		stdin    io.Reader
+		expected string
+	}{
+		{[]string{appname, "-", "dummy://bucket/prefix/"}, strings.NewReader(""), "reading the backup source from standard input requires --input-format"},
+		{[]string{appname, "--input-format", "tar", ".", "dummy://bucket/prefix/"}, strings.NewReader(""), "--input-format requires '-' as first argument to read the backup source from standard input"},
+		{[]string{appname, "--input-format", "zip", "-", "dummy://bucket/prefix/"}, strings.NewReader(""), "invalid input format \"zip\", expecting 'tar' or 'tar.gz'"},
+		{[]string{appname, "--input-format", "tar", "-", "dummy://bucket/prefix/"}, nil, "standard input is not available to read the backup source from"},
+		{[]string{appname, "--input-format", "tar", "-", "dummy://bucket/prefix/"}, strings.NewReader("not a TAR stream"), "input is not a TAR stream"},
+	} {
+		var stdout, stderr bytes.Buffer
+		err := run(test.args, test.stdin, io.Writer(&stdout), io.Writer(&stderr))
+		assertEquals(t, test.expected, fmt.Sprintf("%v", err), "TestMainStdinTarErrors.err")
+	}
+}
+
+// helper function: write custom snapshot commands, the create command copies the source
+// below `dir` and replaces the content of its file "file", the teardown command removes
+// the copy and records its name in `dir`/removed.
+func writeSnapshotScripts(t *testing.T, dir string) (string, string) {
+	create := filepath.Join(dir, "create.sh")
+	script := "#!/bin/sh\nset -e\n" +
+		"cp -R \"$SQUIRRELUP_SNAPSHOT_SOURCE\" '" + dir + "'/\"$SQUIRRELUP_SNAPSHOT_NAME\"\n" +
+		"echo snapshot > '" + dir + "'/\"$SQUIRRELUP_SNAPSHOT_NAME\"/file\n" +
+		"echo '" + dir + "'/\"$SQUIRRELUP_SNAPSHOT_NAME\"\n"
+	if err := os.WriteFile(create, []byte(script), 0755); err != nil {
+		t.Fatalf("could not write script: %s", err.Error())
+	}
+	teardown := filepath.Join(dir, "teardown.sh")
+	script = "#!/bin/sh\nset -e\n" +
+		"rm -rf \"$SQUIRRELUP_SNAPSHOT_PATH\"\n" +
+		"echo \"$SQUIRRELUP_SNAPSHOT_NAME\" >> '" + dir + "'/removed\n"
+	if err := os.WriteFile(teardown, []byte(script), 0755); err != nil {
+		t.Fatalf("could not write script: %s", err.Error())
+	}
+	return create, teardown
+}
+
+func TestMainSnapshot(t *testing.T) {
+	fmt.Println("Running TestMainSnapshot...")
+
+	// Setup Test
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "file"), []byte("live\n"), 0600); err != nil {
+		t.Fatalf("could not write to temporary file: %s", err.Error())
+	}
+	snapDir := t.TempDir()
+	create, teardown := writeSnapshotScripts(t, snapDir)
+	memory := common.NewMemoryBackend()
+	setupBackend(t, memory, map[string]string{
+		"SQUIRRELUP_BACKUP_HOURS":                     "0",
+		"SQUIRRELUP_BACKUP_SNAPSHOT_TYPE":             "custom",
+		"SQUIRRELUP_BACKUP_SNAPSHOT_CREATE_COMMAND":   create,
+		"SQUIRRELUP_BACKUP_SNAPSHOT_TEARDOWN_COMMAND": teardown,
+	})
+
+	var stdout, stderr bytes.Buffer
+
+	/* the archive is read from the snapshot, entries are named after the source */
+	err := run([]string{appname, "--verbose", srcDir, "dummy://bucket/snapshot/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	name := appname + "-" + common.TempFileTag(nil, common.Now())
+	assertEquals(t, true, strings.Contains(stderr.String(), "creating custom snapshot...\n"), "TestMainSnapshot.stderr")
+	assertEquals(t, true, strings.Contains(stderr.String(), fmt.Sprintf("reading backup directory from snapshot %q\n", filepath.Join(snapDir, name))), "TestMainSnapshot.stderr")
+
+	archiveUri, _ := url.ParseRequestURI("dummy://bucket/snapshot/2024-05-01T03+0000.tar.gz")
+	var archive bytes.Buffer
+	if err = memory.RetrieveFile(&archive, archiveUri); err != nil {
+		t.Fatalf("could not retrieve archive: %s", err.Error())
+	}
+	archivePath := filepath.Join(t.TempDir(), "archive.tar.gz")
+	if err = os.WriteFile(archivePath, archive.Bytes(), 0600); err != nil {
+		t.Fatalf("could not write archive: %s", err.Error())
+	}
+	headers := readArchiveHeaders(t, archivePath)
+	header, prs := headers[filepath.Base(srcDir)+"/file"]
+	assertEquals(t, true, prs, "TestMainSnapshot.header")
+	if prs {
+		assertEquals(t, int64(len("snapshot\n")), header.Size, "TestMainSnapshot.Size")
+	}
+
+	removed, err := os.ReadFile(filepath.Join(snapDir, "removed"))
+	assertEquals(t, nil, err, "TestMainSnapshot.removed")
+	assertEquals(t, name+"\n", string(removed), "TestMainSnapshot.removed")
+	_, err = os.Stat(filepath.Join(snapDir, name))
+	assertEquals(t, true, os.IsNotExist(err), "TestMainSnapshot.snapshot")
+
+	/* the backup fails if the snapshot cannot be created */
+	t.Setenv("SQUIRRELUP_BACKUP_SNAPSHOT_CREATE_COMMAND", "false")
+	stderr.Reset()
+	err = run([]string{appname, srcDir, "dummy://bucket/failed/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("run was supposed to fail")
+	}
+	assertEquals(t, true, strings.HasPrefix(err.Error(), "could not create custom snapshot of "), "TestMainSnapshot.Error")
+	prefixUri, _ := url.ParseRequestURI("dummy://bucket/failed/")
+	filelist, _ := memory.ListFiles(prefixUri)
+	assertEquals(t, 0, len(filelist), "TestMainSnapshot.len(filelist)")
+
+	/* optional snapshots fall back to the live directory */
+	t.Setenv("SQUIRRELUP_BACKUP_SNAPSHOT_OPTIONAL", "true")
+	stderr.Reset()
+	err = run([]string{appname, srcDir, "dummy://bucket/optional/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, strings.Contains(stderr.String(), "\nwarning: could not create custom snapshot of "), "TestMainSnapshot.stderr")
+	assertEquals(t, true, strings.Contains(stderr.String(), ", backing up the live directory\n"), "TestMainSnapshot.stderr")
+	prefixUri, _ = url.ParseRequestURI("dummy://bucket/optional/")
+	filelist, _ = memory.ListFiles(prefixUri)
+	assertEquals(t, true, len(filelist) > 0, "TestMainSnapshot.len(filelist)")
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// checkNestedDestination fails if the output prefix of a file:// URI is inside the backup
+// directory, so every backup would archive the previous ones, or if the backup directory is
+// inside the output prefix. Both paths are compared with symbolic links resolved. Output
+// prefixes of other schemes are not checked.
+func checkNestedDestination(inputDirectory string, outputPrefixUri *url.URL) error {
+	if outputPrefixUri.Scheme != "file" {
+		return nil
+	}
+
+	source, err := resolvePath(inputDirectory)
+	if err != nil {
+		return fmt.Errorf("could not resolve backup directory %q: %s", inputDirectory, err.Error())
+	}
+	destination, err := resolvePath(filePrefixPath(outputPrefixUri))
+	if err != nil {
+		return fmt.Errorf("could not resolve output prefix %q: %s", outputPrefixUri, err.Error())
+	}
+
+	if isNestedPath(source, destination) {
+		return fmt.Errorf("output prefix %q is inside the backup directory %q, use --allow-nested to override", outputPrefixUri, inputDirectory)
+	} else if isNestedPath(destination, source) {
+		return fmt.Errorf("backup directory %q is inside the output prefix %q, use --allow-nested to override", inputDirectory, outputPrefixUri)
+	}
+	return nil
+}
+
+// warnNestedTempDir warns if the directory holding temporary archives is inside the backup
+// directory, where archives in progress could be picked up by later backups.
+func warnNestedTempDir(inputDirectory string, stderr io.Writer) {
+	source, err := resolvePath(inputDirectory)
+	if err != nil {
+		return
+	}
+	tempDir, err := resolvePath(os.TempDir())
+	if err == nil && isNestedPath(source, tempDir) {
+		fmt.Fprintf(stderr, "warning: temporary directory %q is inside the backup directory %q, set %s to a directory outside of it\n", os.TempDir(), inputDirectory, tempDirVariable(runtime.GOOS))
+	}
+}
+
+// tempDirVariable returns the environment variable os.TempDir reads the temporary directory
+// from on `goos`.
+func tempDirVariable(goos string) string {
+	if goos == "windows" {
+		return "TMP"
+	}
+	return "TMPDIR"
+}
+
+// filePrefixPath returns the local path of a file:// URI. Opaque URIs like file:backups/
+// and URIs with a host other than localhost, like file://backups/, are relative paths.
+func filePrefixPath(uri *url.URL) string {
+	if len(uri.Opaque) > 0 {
+		return uri.Opaque
+	} else if len(uri.Host) > 0 && uri.Host != "localhost" {
+		return uri.Host + uri.Path
+	}
+	return uri.Path
+}
+
+// resolvePath returns the absolute path of `path` with symbolic links resolved. Trailing
+// components that do not exist yet, like an output prefix created by the first backup, are
+// appended to their closest existing parent.
+func resolvePath(path string) (string, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	var missing []string
+	for {
+		resolved, err := filepath.EvalSymlinks(absPath)
+		if err == nil {
+			return filepath.Join(append([]string{resolved}, missing...)...), nil
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(absPath)
+		if parent == absPath {
+			return "", err
+		}
+		missing = append([]string{filepath.Base(absPath)}, missing...)
+		absPath = parent
+	}
+}
+
+// isNestedPath returns true if `path` is `parent` or one of its descendants.
+func isNestedPath(parent, path string) bool {
+	if path == parent {
+		return true
+	}
+	return strings.HasPrefix(path, strings.TrimSuffix(parent, string(filepath.Separator))+string(filepath.Separator))
+}
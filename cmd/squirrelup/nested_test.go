@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// helper function: directory tree with a backup directory `src`, a sibling `out` and a symbolic
+// link `link` pointing to `src`, all with symbolic links resolved.
+func setupNested(t *testing.T) string {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatalf("could not resolve temporary directory: %s", err.Error())
+	}
+	for _, dir := range []string{"src/data", "out"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0700); err != nil {
+			t.Fatalf("could not create directory: %s", err.Error())
+		}
+	}
+	if err := os.Symlink(filepath.Join(root, "src"), filepath.Join(root, "link")); err != nil {
+		t.Fatalf("could not create symbolic link: %s", err.Error())
+	}
+	return root
+}
+
+func TestResolvePath(t *testing.T) {
+	fmt.Println("Running TestResolvePath...")
+
+	// Setup Test
+	root := setupNested(t)
+	workDir, _ := os.Getwd()
+	defer func() { _ = os.Chdir(workDir) }()
+	if err := os.Chdir(filepath.Join(root, "out")); err != nil {
+		t.Fatalf("could not change directory: %s", err.Error())
+	}
+
+	// Perform the test
+	for path, expected := range map[string]string{
+		filepath.Join(root, "src"):                        filepath.Join(root, "src"),
+		filepath.Join(root, "link", "data"):               filepath.Join(root, "src", "data"),
+		filepath.Join(root, "link", "missing", "prefix"):  filepath.Join(root, "src", "missing", "prefix"),
+		filepath.Join(root, "out", "..", "link", "data/"): filepath.Join(root, "src", "data"),
+		"../link":      filepath.Join(root, "src"),
+		".":            filepath.Join(root, "out"),
+		"backups/2024": filepath.Join(root, "out", "backups", "2024"),
+	} {
+		resolved, err := resolvePath(path)
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		assertEquals(t, expected, resolved, "TestResolvePath."+path)
+	}
+}
+
+func TestIsNestedPath(t *testing.T) {
+	fmt.Println("Running TestIsNestedPath...")
+
+	assertEquals(t, true, isNestedPath("/srv/data", "/srv/data"), "TestIsNestedPath.same")
+	assertEquals(t, true, isNestedPath("/srv/data", "/srv/data/backups"), "TestIsNestedPath.child")
+	assertEquals(t, true, isNestedPath("/", "/srv"), "TestIsNestedPath.root")
+	assertEquals(t, false, isNestedPath("/srv/data", "/srv/database"), "TestIsNestedPath.sibling")
+	assertEquals(t, false, isNestedPath("/srv/data/backups", "/srv/data"), "TestIsNestedPath.parent")
+}
+
+func TestTempDirVariable(t *testing.T) {
+	fmt.Println("Running TestTempDirVariable...")
+
+	assertEquals(t, "TMPDIR", tempDirVariable("linux"), "TestTempDirVariable.linux")
+	assertEquals(t, "TMPDIR", tempDirVariable("darwin"), "TestTempDirVariable.darwin")
+	assertEquals(t, "TMP", tempDirVariable("windows"), "TestTempDirVariable.windows")
+}
+
+func TestFilePrefixPath(t *testing.T) {
+	fmt.Println("Running TestFilePrefixPath...")
+
+	for uri, expected := range map[string]string{
+		"file:///srv/backups/":          "/srv/backups/",
+		"file://localhost/srv/backups/": "/srv/backups/",
+		"file://backups/host-a/":        "backups/host-a/",
+		"file:backups/":                 "backups/",
+	} {
+		parsedUri, err := url.ParseRequestURI(uri)
+		if err != nil {
+			t.Fatalf("could not parse URI: %s", err.Error())
+		}
+		assertEquals(t, expected, filePrefixPath(parsedUri), "TestFilePrefixPath."+uri)
+	}
+}
+
+func TestCheckNestedDestination(t *testing.T) {
+	fmt.Println("Running TestCheckNestedDestination...")
+
+	// Setup Test
+	root := setupNested(t)
+	srcDir := filepath.Join(root, "src")
+
+	// Perform the test
+	for uri, expected := range map[string]string{
+		"file://" + root + "/out/":         "<nil>",
+		"file://" + root + "/src/backups/": fmt.Sprintf("output prefix %q is inside the backup directory %q, use --allow-nested to override", "file://"+root+"/src/backups/", srcDir),
+		"file://" + root + "/link/data/":   fmt.Sprintf("output prefix %q is inside the backup directory %q, use --allow-nested to override", "file://"+root+"/link/data/", srcDir),
+		"file://" + root + "/src/":         fmt.Sprintf("output prefix %q is inside the backup directory %q, use --allow-nested to override", "file://"+root+"/src/", srcDir),
+		"file://" + root + "/":             fmt.Sprintf("backup directory %q is inside the output prefix %q, use --allow-nested to override", srcDir, "file://"+root+"/"),
+		"dummy://bucket" + root + "/src/":  "<nil>",
+		"b2://bucket/src/backups/":         "<nil>",
+	} {
+		outputPrefixUri, err := url.ParseRequestURI(uri)
+		if err != nil {
+			t.Fatalf("could not parse URI: %s", err.Error())
+		}
+		err = checkNestedDestination(srcDir, outputPrefixUri)
+		assertEquals(t, expected, fmt.Sprintf("%v", err), "TestCheckNestedDestination."+uri)
+	}
+
+	/* relative output prefixes are resolved against the working directory */
+	workDir, _ := os.Getwd()
+	defer func() { _ = os.Chdir(workDir) }()
+	if err := os.Chdir(srcDir); err != nil {
+		t.Fatalf("could not change directory: %s", err.Error())
+	}
+	outputPrefixUri, _ := url.ParseRequestURI("file:backups/")
+	err := checkNestedDestination("../link", outputPrefixUri)
+	assertEquals(t, `output prefix "file:backups/" is inside the backup directory "../link", use --allow-nested to override`, fmt.Sprintf("%v", err), "TestCheckNestedDestination.relative")
+}
+
+func TestMainNestedDestination(t *testing.T) {
+	fmt.Println("Running TestMainNestedDestination...")
+
+	// Setup Test
+	setupCatalog(t)
+	root := setupNested(t)
+	srcDir := filepath.Join(root, "src")
+	if err := os.WriteFile(filepath.Join(srcDir, "data", "file.txt"), []byte("test content"), 0600); err != nil {
+		t.Fatalf("could not write file: %s", err.Error())
+	}
+	var stdout, stderr bytes.Buffer
+
+	/* nested output prefixes are refused before creating the backend */
+	outputPrefix := "file://" + srcDir + "/backups/"
+	err := run([]string{appname, srcDir, outputPrefix}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	assertEquals(t, fmt.Sprintf("output prefix %q is inside the backup directory %q, use --allow-nested to override", outputPrefix, srcDir), fmt.Sprintf("%v", err), "TestMainNestedDestination.err")
+
+	/* the check can be overridden */
+	err = run([]string{appname, "--allow-nested", srcDir, outputPrefix}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	assertEquals(t, "failed to create backend: unknown URL scheme file", fmt.Sprintf("%v", err), "TestMainNestedDestination.err")
+
+	/* temporary directories inside the backup directory are reported */
+	t.Setenv("TMPDIR", filepath.Join(srcDir, "tmp"))
+	if err := os.Mkdir(filepath.Join(srcDir, "tmp"), 0700); err != nil {
+		t.Fatalf("could not create directory: %s", err.Error())
+	}
+	stderr.Reset()
+	err = run([]string{appname, srcDir, "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, strings.Contains(stderr.String(), fmt.Sprintf("warning: temporary directory %q is inside the backup directory %q, set TMPDIR to a directory outside of it\n", filepath.Join(srcDir, "tmp"), srcDir)), "TestMainNestedDestination.stderr")
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+type (
+	// logTail passes output through to a writer and keeps its last lines.
+	logTail struct {
+		lock   sync.Mutex
+		output io.Writer
+		// complete lines, at most `limit` of them
+		lines []string
+		// line not terminated yet
+		partial string
+		limit   int
+	}
+
+	// runNotification collects the outcome of a backup run, sent once the run ends.
+	runNotification struct {
+		// set once the configuration was loaded
+		cfg     *common.Config
+		summary common.RunSummary
+		log     *logTail
+		// the outcome is shown as desktop notification as well, see notifyDesktop
+		desktop bool
+	}
+)
+
+// newLogTail returns a writer passing output through to `output` that keeps up to `limit`
+// of the last lines written.
+func newLogTail(output io.Writer, limit int) *logTail {
+	return &logTail{output: output, limit: limit}
+}
+
+func (tail *logTail) Write(p []byte) (n int, err error) {
+	tail.lock.Lock()
+	defer tail.lock.Unlock()
+
+	lines := strings.Split(tail.partial+string(p), "\n")
+	tail.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		/* keep what was printed last on lines redrawn with carriage returns */
+		if index := strings.LastIndex(strings.TrimRight(line, "\r"), "\r"); index >= 0 {
+			line = line[index+1:]
+		}
+		tail.lines = append(tail.lines, strings.TrimRight(line, "\r"))
+	}
+	if excess := len(tail.lines) - tail.limit; excess > 0 {
+		tail.lines = tail.lines[excess:]
+	}
+	return tail.output.Write(p)
+}
+
+// Lines returns up to `limit` of the last lines written, the last one may be incomplete.
+func (tail *logTail) Lines(limit int) []string {
+	tail.lock.Lock()
+	defer tail.lock.Unlock()
+
+	lines := append([]string{}, tail.lines...)
+	if len(tail.partial) > 0 {
+		lines = append(lines, tail.partial)
+	}
+	if limit < len(lines) {
+		lines = lines[len(lines)-limit:]
+	}
+	return lines
+}
+
+// newRunNotification starts collecting the outcome of the backup of `source` to
+// `destination`, output written to stderr is passed through `log`.
+func newRunNotification(source, destination string, stderr io.Writer) *runNotification {
+	return &runNotification{
+		summary: common.RunSummary{
+			Source:      source,
+			Destination: destination,
+			Started:     common.Now(),
+		},
+		log: newLogTail(stderr, common.MaxNotifyLogLines),
+	}
+}
+
+// send records the outcome `err` of the run in the journal, see recordJournal, and reports it
+// by email if configured and on the desktop if requested. Failures are printed to stderr and
+// never change the outcome of the run.
+func (notification *runNotification) send(err error, stderr io.Writer) {
+	summary := &notification.summary
+	summary.Finished = common.Now()
+	summary.Err = err
+	if notification.cfg != nil {
+		summary.Warnings = notification.cfg.Internal.Warnings.List()
+	}
+	if len(summary.Warnings) > 0 {
+		fmt.Fprintf(stderr, "%s\n", common.WarningsSummary(summary.Warnings))
+	}
+	var warning *warningError
+	if err == nil {
+		summary.Status = common.RunSucceeded
+	} else if errors.As(err, &warning) {
+		summary.Status = common.RunWarning
+	} else {
+		summary.Status = common.RunFailed
+	}
+
+	if notification.cfg != nil {
+		recordJournal(notification.cfg, summary, stderr)
+	}
+
+	emailed := notification.cfg != nil && len(notification.cfg.Notify.SMTPHost) > 0
+	if notification.desktop {
+		notifyDesktop(summary, stderr)
+	}
+	if emailed {
+		if summary.Status == common.RunFailed {
+			summary.Log = notification.log.Lines(int(notification.cfg.Notify.LogLines))
+		}
+		if notifyErr := common.SendNotification(notification.cfg, summary); notifyErr != nil {
+			fmt.Fprintf(stderr, "warning: %s\n", notifyErr.Error())
+		}
+	}
+}
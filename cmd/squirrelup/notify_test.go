@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+func TestLogTail(t *testing.T) {
+	fmt.Println("Running TestLogTail...")
+
+	// Setup Test
+	var output bytes.Buffer
+	tail := newLogTail(&output, 3)
+
+	// Perform the test
+	for _, chunk := range []string{"first\nsec", "ond\n", "progress 10%\rprogress 100%\r\n", "fourth\n", "partial"} {
+		n, err := tail.Write([]byte(chunk))
+		assertEquals(t, nil, err, "TestLogTail.err")
+		assertEquals(t, len(chunk), n, "TestLogTail.n")
+	}
+	assertEquals(t, "first\nsecond\nprogress 10%\rprogress 100%\r\nfourth\npartial", output.String(), "TestLogTail.output")
+	assertEquals(t, "second|progress 100%|fourth|partial", strings.Join(tail.Lines(4), "|"), "TestLogTail.Lines(4)")
+	assertEquals(t, "fourth|partial", strings.Join(tail.Lines(2), "|"), "TestLogTail.Lines(2)")
+	assertEquals(t, 0, len(tail.Lines(0)), "TestLogTail.Lines(0)")
+}
+
+func TestMainNotifyFailure(t *testing.T) {
+	fmt.Println("Running TestMainNotifyFailure...")
+
+	// Setup Test
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err.Error())
+	}
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	listener.Close()
+
+	srcDir := t.TempDir()
+	if err = os.WriteFile(filepath.Join(srcDir, "file"), []byte("data"), 0600); err != nil {
+		t.Fatalf("could not write to temporary file: %s", err.Error())
+	}
+
+	setupBackend(t, common.NewMemoryBackend(), map[string]string{
+		"SQUIRRELUP_BACKUP_HOURS":         "0",
+		"SQUIRRELUP_NOTIFY_SMTP_HOST":     "127.0.0.1",
+		"SQUIRRELUP_NOTIFY_SMTP_PORT":     port,
+		"SQUIRRELUP_NOTIFY_SMTP_SECURITY": "none",
+		"SQUIRRELUP_NOTIFY_SMTP_FROM":     "squirrelup@example.com",
+		"SQUIRRELUP_NOTIFY_SMTP_TO":       "admin@example.com",
+	})
+
+	var stdout, stderr bytes.Buffer
+	expected := "warning: could not send notification via 127.0.0.1:" + port + ": "
+
+	/* failing notifications do not fail successful backups */
+	err = run([]string{appname, srcDir, "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	assertEquals(t, nil, err, "TestMainNotifyFailure.err")
+	assertEquals(t, true, strings.Contains(stderr.String(), expected), "TestMainNotifyFailure.stderr")
+
+	/* nor change the error of failed backups */
+	t.Setenv("SQUIRRELUP_ENCRYPTION_REQUIRED", "true")
+	stderr.Reset()
+	err = run([]string{appname, srcDir, "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	assertEquals(t, common.ErrEncryptionRequired, fmt.Sprintf("%v", err), "TestMainNotifyFailure.err")
+	assertEquals(t, true, strings.Contains(stderr.String(), expected), "TestMainNotifyFailure.stderr")
+	t.Setenv("SQUIRRELUP_ENCRYPTION_REQUIRED", "false")
+
+	/* successful backups are not reported if only failures are */
+	t.Setenv("SQUIRRELUP_NOTIFY_ONLY_ON_FAILURE", "true")
+	stderr.Reset()
+	err = run([]string{appname, srcDir, "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	assertEquals(t, nil, err, "TestMainNotifyFailure.err")
+	assertEquals(t, false, strings.Contains(stderr.String(), "notification"), "TestMainNotifyFailure.stderr")
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"time"
+
+	"filippo.io/age"
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+type (
+	// backupIndex maps obfuscated object keys to logical backup names and nominal times.
+	backupIndex struct {
+		Entries []backupIndexEntry `json:"entries"`
+	}
+
+	backupIndexEntry struct {
+		Key  string    `json:"key"`
+		Name string    `json:"name"`
+		Time time.Time `json:"time"`
+	}
+)
+
+const (
+	// indexObjectName is the name of the encrypted object mapping obfuscated keys to logical names.
+	indexObjectName = common.IndexObjectName
+)
+
+// lookupKey returns the index entry for an obfuscated key.
+func (index *backupIndex) lookupKey(key string) (backupIndexEntry, bool) {
+	for _, entry := range index.Entries {
+		if entry.Key == key {
+			return entry, true
+		}
+	}
+	return backupIndexEntry{}, false
+}
+
+// lookupName returns the index entry for a logical name.
+func (index *backupIndex) lookupName(name string) (backupIndexEntry, bool) {
+	for _, entry := range index.Entries {
+		if entry.Name == name {
+			return entry, true
+		}
+	}
+	return backupIndexEntry{}, false
+}
+
+// add inserts an entry, replacing any entry with the same key.
+func (index *backupIndex) add(entry backupIndexEntry) {
+	index.remove(entry.Key)
+	index.Entries = append(index.Entries, entry)
+}
+
+// remove drops the entry for an obfuscated key.
+func (index *backupIndex) remove(key string) {
+	entries := index.Entries[:0]
+	for _, entry := range index.Entries {
+		if entry.Key != key {
+			entries = append(entries, entry)
+		}
+	}
+	index.Entries = entries
+}
+
+// prune drops entries whose objects are not in `keys`.
+func (index *backupIndex) prune(keys map[string]bool) {
+	for _, entry := range append([]backupIndexEntry{}, index.Entries...) {
+		if !keys[entry.Key] {
+			index.remove(entry.Key)
+		}
+	}
+}
+
+// backupNameKey returns the key used to obfuscate backup names. Defaults to a key
+// derived from the first configured X25519 identity.
+func backupNameKey(cfg *common.Config, identities []age.Identity) ([]byte, error) {
+	if len(cfg.Backup.NameKey) > 0 {
+		return []byte(cfg.Backup.NameKey), nil
+	}
+	for _, identity := range identities {
+		if x25519, ok := identity.(*age.X25519Identity); ok {
+			derived := hmac.New(sha256.New, []byte("squirrelup-name-key"))
+			_, _ = io.WriteString(derived, x25519.String())
+			return derived.Sum(nil), nil
+		}
+	}
+	return nil, fmt.Errorf("no name key configured and no X25519 identity to derive it from")
+}
+
+// dedupChunkKey returns the key naming encrypted chunks of deduplicated backups, derived
+// from the key used to obfuscate backup names.
+func dedupChunkKey(cfg *common.Config, identities []age.Identity) ([]byte, error) {
+	nameKey, err := backupNameKey(cfg, identities)
+	if err != nil {
+		return nil, fmt.Errorf("encrypted deduplicated backups need a key to name their chunks: %s", err.Error())
+	}
+	derived := hmac.New(sha256.New, nameKey)
+	_, _ = io.WriteString(derived, "squirrelup-chunk-key")
+	return derived.Sum(nil), nil
+}
+
+// obfuscateName derives the object key of a backup from its logical name.
+func obfuscateName(key []byte, name string) string {
+	mac := hmac.New(sha256.New, key)
+	_, _ = io.WriteString(mac, name)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// indexUri returns URI of the index object under the output prefix.
+func indexUri(outputPrefixUri *url.URL) (*url.URL, error) {
+	uri, err := outputPrefixUri.Parse(indexObjectName)
+	if err != nil {
+		return nil, fmt.Errorf("could not construct index URI: %s", err.Error())
+	}
+	return uri, nil
+}
+
+// readIndex returns the stored index or an empty one if there is none.
+func readIndex(backend common.StorageBackend, uri *url.URL, identities []age.Identity) (*backupIndex, error) {
+	var buf bytes.Buffer
+	err := backend.RetrieveFile(&buf, uri)
+	if err != nil {
+		if err.Error() == common.ErrFileNotFound {
+			return &backupIndex{}, nil
+		}
+		return nil, fmt.Errorf("could not read backup index: %s", err.Error())
+	}
+	return parseIndex(&buf, identities)
+}
+
+// parseIndex decrypts and decodes an index.
+func parseIndex(input io.Reader, identities []age.Identity) (*backupIndex, error) {
+	plaintext, err := common.DecryptStream(input, identities)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt backup index: %s", err.Error())
+	}
+	var index backupIndex
+	err = json.NewDecoder(plaintext).Decode(&index)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse backup index: %s", err.Error())
+	}
+	return &index, nil
+}
+
+// storeIndex replaces the stored index with a single object upload.
+func storeIndex(backend common.StorageBackend, uri *url.URL, index *backupIndex, recipients []age.Recipient) error {
+	var buf bytes.Buffer
+	encryptedWriter, err := age.Encrypt(&buf, recipients...)
+	if err == nil {
+		err = json.NewEncoder(encryptedWriter).Encode(index)
+	}
+	if err == nil {
+		err = encryptedWriter.Close()
+	}
+	if err == nil {
+		err = backend.StoreFile(context.Background(), common.StoreRequest{URI: uri, BodyAt: bytes.NewReader(buf.Bytes()), Length: int64(buf.Len()), Quiet: true})
+	}
+	if err != nil {
+		return fmt.Errorf("could not store backup index: %s", err.Error())
+	}
+	return nil
+}
+
+// loadIndex reads the index for the output prefix. A corrupted index is reported as a warning,
+// preserved under a separate name and replaced by an empty one.
+func loadIndex(backend common.StorageBackend, uri *url.URL, identities []age.Identity, stderr io.Writer) (*backupIndex, error) {
+	var buf bytes.Buffer
+	err := backend.RetrieveFile(&buf, uri)
+	if err != nil {
+		if err.Error() == common.ErrFileNotFound {
+			return &backupIndex{}, nil
+		}
+		return nil, fmt.Errorf("could not read backup index: %s", err.Error())
+	}
+
+	index, err := parseIndex(&buf, identities)
+	if err != nil {
+		fmt.Fprintf(stderr, "warning: %s, starting a new index\n", err.Error())
+		if corruptUri, err := uri.Parse(indexObjectName + common.CorruptObjectSuffix); err == nil {
+			_ = backend.CopyFile(uri, corruptUri)
+		}
+		index = &backupIndex{}
+	}
+	return index, nil
+}
+
+// resolveObfuscatedUri maps the logical name in `uri` to its obfuscated key using the index
+// stored next to it. The URI is returned unchanged if the name is not indexed.
+func resolveObfuscatedUri(backend common.StorageBackend, uri *url.URL, identities []age.Identity, stderr io.Writer) *url.URL {
+	indexObjectUri, err := uri.Parse(indexObjectName)
+	if err != nil {
+		return uri
+	}
+	index, err := readIndex(backend, indexObjectUri, identities)
+	if err != nil {
+		fmt.Fprintf(stderr, "warning: %s, using raw object keys\n", err.Error())
+		return uri
+	}
+	if entry, ok := index.lookupName(path.Base(uri.Path)); ok {
+		return common.ResolveObjectURI(&url.URL{Scheme: uri.Scheme, User: uri.User, Host: uri.Host, Path: path.Dir(uri.Path)}, entry.Key)
+	}
+	return uri
+}
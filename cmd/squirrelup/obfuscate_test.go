@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+func TestObfuscateName(t *testing.T) {
+	fmt.Println("Running TestObfuscateName...")
+
+	// Setup Test
+	var cfg common.Config
+	if err := cfg.SetDefaultValues(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	identity, _ := age.GenerateX25519Identity()
+	otherIdentity, _ := age.GenerateX25519Identity()
+
+	// Perform the test
+	derivedKey, err := backupNameKey(&cfg, []age.Identity{identity})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	otherKey, _ := backupNameKey(&cfg, []age.Identity{otherIdentity})
+
+	name := obfuscateName(derivedKey, "2024-05-01T03+0000.tar.gz.age")
+	assertEquals(t, 64, len(name), "TestObfuscateName.len")
+	assertEquals(t, name, obfuscateName(derivedKey, "2024-05-01T03+0000.tar.gz.age"), "TestObfuscateName.stable")
+	assertEquals(t, false, name == obfuscateName(derivedKey, "2024-05-01T04+0000.tar.gz.age"), "TestObfuscateName.name")
+	assertEquals(t, false, name == obfuscateName(otherKey, "2024-05-01T03+0000.tar.gz.age"), "TestObfuscateName.key")
+
+	/* configured key takes precedence */
+	cfg.Backup.NameKey = "secret"
+	configuredKey, _ := backupNameKey(&cfg, []age.Identity{identity})
+	assertEquals(t, "secret", string(configuredKey), "TestObfuscateName.configured")
+
+	/* no key available */
+	cfg.Backup.NameKey = ""
+	_, err = backupNameKey(&cfg, nil)
+	if err == nil {
+		t.Fatalf("backupNameKey was supposed to fail")
+	}
+	assertEquals(t, "no name key configured and no X25519 identity to derive it from", err.Error(), "TestObfuscateName.Error")
+}
+
+func TestObfuscateRun(t *testing.T) {
+	fmt.Println("Running TestObfuscateRun...")
+
+	// Setup Test
+	identity, _ := age.GenerateX25519Identity()
+	memory := common.NewMemoryBackend()
+	setupBackend(t, memory, map[string]string{
+		"SQUIRRELUP_BACKUP_OBFUSCATE_NAMES": "true",
+		"SQUIRRELUP_BACKUP_HOURS":           "24",
+		"SQUIRRELUP_PUBKEY":                 identity.Recipient().String(),
+		"SQUIRRELUP_IDENTITY":               identity.String(),
+	})
+
+	prefixUri, _ := url.ParseRequestURI("dummy://bucket/prefix/")
+	indexObjectUri, _ := indexUri(prefixUri)
+	listKeys := func() []string {
+		filelist, _ := memory.ListFiles(prefixUri)
+		var keys []string
+		for _, fileinfo := range filelist {
+			keys = append(keys, path.Base(fileinfo.Name()))
+		}
+		return keys
+	}
+
+	var stdout, stderr bytes.Buffer
+
+	/* two backups, the older one is pruned by its nominal time */
+	for _, timestamp := range []string{"2024-04-30T00:00:00Z", "2024-05-01T03:00:00Z"} {
+		err := run([]string{appname, "--timestamp", timestamp, ".", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+	}
+	keys := listKeys()
+	assertEquals(t, 2, len(keys), "TestObfuscateRun.len(keys)")
+	assertEquals(t, indexObjectName, keys[0], "TestObfuscateRun.keys[0]")
+	assertEquals(t, 64, len(keys[1]), "TestObfuscateRun.keys[1]")
+	assertEquals(t, true, strings.Contains(stderr.String(), "file 2024-04-30T00+0000.tar.gz.age (prefix/"), "TestObfuscateRun.stderr")
+
+	index, err := readIndex(memory, indexObjectUri, []age.Identity{identity})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 1, len(index.Entries), "TestObfuscateRun.len(index.Entries)")
+	assertEquals(t, keys[1], index.Entries[0].Key, "TestObfuscateRun.Key")
+	assertEquals(t, "2024-05-01T03+0000.tar.gz.age", index.Entries[0].Name, "TestObfuscateRun.Name")
+	assertEquals(t, "2024-05-01 03:00:00 +0000 UTC", index.Entries[0].Time.String(), "TestObfuscateRun.Time")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* download by logical name */
+	outputPath := filepath.Join(t.TempDir(), "backup.tar.gz")
+	err = run([]string{appname, "get", "--decrypt", "dummy://bucket/prefix/2024-05-01T03+0000.tar.gz.age", outputPath}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, fmt.Sprintf("downloaded \"dummy://bucket/prefix/%s\" to %q\n", keys[1], outputPath), stdout.String(), "TestObfuscateRun.stdout")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* corrupted index is preserved and replaced */
+	if err := memory.StoreFile(context.Background(), common.StoreRequest{URI: indexObjectUri, BodyAt: strings.NewReader("garbage"), Length: 7}); err != nil {
+		t.Fatalf("could not store file: %s", err.Error())
+	}
+	err = run([]string{appname, "--timestamp", "2024-05-01T04:00:00Z", ".", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, strings.Contains(stderr.String(), "warning: could not decrypt backup index: "), "TestObfuscateRun.stderr")
+	keys = listKeys()
+	assertEquals(t, 4, len(keys), "TestObfuscateRun.len(keys)")
+	assertEquals(t, indexObjectName+".corrupt", keys[1], "TestObfuscateRun.keys[1]")
+
+	index, _ = readIndex(memory, indexObjectUri, []age.Identity{identity})
+	assertEquals(t, 1, len(index.Entries), "TestObfuscateRun.len(index.Entries)")
+	assertEquals(t, "2024-05-01T04+0000.tar.gz.age", index.Entries[0].Name, "TestObfuscateRun.Name")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* index cannot be encrypted without a pubkey */
+	os.Setenv("SQUIRRELUP_PUBKEY", "")
+	err = run([]string{appname, ".", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, "obfuscated names require a pubkey to encrypt the backup index", err.Error(), "TestObfuscateRun.Error")
+}
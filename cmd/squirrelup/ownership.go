@@ -0,0 +1,129 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"strconv"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+type (
+	// headerHook mutates a TAR header before it is written to the archive.
+	headerHook func(*tar.Header)
+
+	// normalizedFileInfo overrides ownership and permissions of a file in the archive.
+	// archive/tar uses the header returned by Sys() to populate ownership fields.
+	normalizedFileInfo struct {
+		fs.FileInfo
+		header *tar.Header
+	}
+)
+
+const (
+	restoreOwnerSkip     = "skip"
+	restoreOwnerPreserve = "preserve"
+)
+
+// Mode returns the file mode with permissions taken from the normalized header.
+func (nfi *normalizedFileInfo) Mode() fs.FileMode {
+	mode := nfi.FileInfo.Mode() &^ (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+	mode |= fs.FileMode(nfi.header.Mode) & fs.ModePerm
+	if nfi.header.Mode&04000 != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if nfi.header.Mode&02000 != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if nfi.header.Mode&01000 != 0 {
+		mode |= fs.ModeSticky
+	}
+	return mode
+}
+
+// Sys returns the normalized header.
+func (nfi *normalizedFileInfo) Sys() any {
+	return nfi.header
+}
+
+// Uname returns the normalized user name.
+func (nfi *normalizedFileInfo) Uname() (string, error) {
+	return nfi.header.Uname, nil
+}
+
+// Gname returns the normalized group name.
+func (nfi *normalizedFileInfo) Gname() (string, error) {
+	return nfi.header.Gname, nil
+}
+
+// normalizeFileInfo applies `hook` to the TAR header derived from `fileInfo`.
+func normalizeFileInfo(fileInfo fs.FileInfo, linkTarget string, hook headerHook) (fs.FileInfo, error) {
+	header, err := tar.FileInfoHeader(fileInfo, linkTarget)
+	if err != nil {
+		return nil, err
+	}
+	hook(header)
+	return &normalizedFileInfo{fileInfo, header}, nil
+}
+
+// newHeaderHook returns a hook forcing the configured owner, group and permission mask,
+// or nil if no normalization is configured.
+func newHeaderHook(cfg *common.Config) (headerHook, error) {
+	if len(cfg.Backup.Owner) == 0 && len(cfg.Backup.Group) == 0 && len(cfg.Backup.ModeMask) == 0 {
+		return nil, nil
+	}
+
+	var uid, gid int = -1, -1
+	var uname, gname string
+	if len(cfg.Backup.Owner) > 0 {
+		if id, err := strconv.Atoi(cfg.Backup.Owner); err == nil {
+			uid = id
+		} else if u, err := user.Lookup(cfg.Backup.Owner); err == nil {
+			uid, _ = strconv.Atoi(u.Uid)
+			uname = u.Username
+		} else {
+			return nil, fmt.Errorf("unknown archive owner %q: %s", cfg.Backup.Owner, err.Error())
+		}
+	}
+	if len(cfg.Backup.Group) > 0 {
+		if id, err := strconv.Atoi(cfg.Backup.Group); err == nil {
+			gid = id
+		} else if g, err := user.LookupGroup(cfg.Backup.Group); err == nil {
+			gid, _ = strconv.Atoi(g.Gid)
+			gname = g.Name
+		} else {
+			return nil, fmt.Errorf("unknown archive group %q: %s", cfg.Backup.Group, err.Error())
+		}
+	}
+	var mask int64 = 07777
+	if len(cfg.Backup.ModeMask) > 0 {
+		value, err := strconv.ParseUint(cfg.Backup.ModeMask, 8, 12)
+		if err != nil {
+			return nil, fmt.Errorf("invalid archive mode mask %q: %s", cfg.Backup.ModeMask, err.Error())
+		}
+		mask = int64(value)
+	}
+
+	return func(header *tar.Header) {
+		if uid >= 0 {
+			header.Uid = uid
+			header.Uname = uname
+		}
+		if gid >= 0 {
+			header.Gid = gid
+			header.Gname = gname
+		}
+		header.Mode &= mask
+	}, nil
+}
+
+// restoreOwnership applies ownership stored in the TAR header to an extracted file.
+func restoreOwnership(target string, header *tar.Header, restoreOwner string) error {
+	if restoreOwner != restoreOwnerPreserve {
+		return nil
+	}
+	return os.Lchown(target, header.Uid, header.Gid)
+}
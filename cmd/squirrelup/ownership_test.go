@@ -0,0 +1,168 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/breezerider/squirrel-up/pkg/common"
+	"github.com/mholt/archiver/v4"
+)
+
+// helper function: read all TAR headers of a gzip-compressed archive.
+func readArchiveHeaders(t *testing.T, archivePath string) map[string]*tar.Header {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		t.Fatalf("could not open archive: %s", err.Error())
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("could not read archive: %s", err.Error())
+	}
+
+	headers := map[string]*tar.Header{}
+	reader := tar.NewReader(gz)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("could not read archive: %s", err.Error())
+		}
+		headers[header.Name] = header
+	}
+	return headers
+}
+
+func TestOwnershipNormalization(t *testing.T) {
+	fmt.Println("Running TestOwnershipNormalization...")
+
+	// Setup Test
+	srcDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(srcDir, "sub"), 0755); err != nil {
+		t.Fatalf("could not create directory: %s", err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "sub", "script.sh"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatalf("could not write file: %s", err.Error())
+	}
+
+	var cfg common.Config
+	if err := cfg.SetDefaultValues(); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	/* numeric owner, group and mode mask */
+	cfg.Backup.Owner = "1234"
+	cfg.Backup.Group = "5678"
+	cfg.Backup.ModeMask = "0750"
+	archivePath, _, err := archiveDirectory(srcDir, &cfg)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	defer os.Remove(archivePath)
+
+	headers := readArchiveHeaders(t, archivePath)
+	assertEquals(t, 3, len(headers), "TestOwnershipNormalization.len(headers)")
+	for name, header := range headers {
+		assertEquals(t, 1234, header.Uid, "TestOwnershipNormalization.Uid("+name+")")
+		assertEquals(t, 5678, header.Gid, "TestOwnershipNormalization.Gid("+name+")")
+		assertEquals(t, "", header.Uname, "TestOwnershipNormalization.Uname("+name+")")
+		assertEquals(t, "", header.Gname, "TestOwnershipNormalization.Gname("+name+")")
+	}
+	script := headers[filepath.Base(srcDir)+"/sub/script.sh"]
+	if script == nil {
+		t.Fatalf("archive is missing the script entry: %+v", headers)
+	}
+	assertEquals(t, int64(0750), script.Mode, "TestOwnershipNormalization.Mode")
+	assertEquals(t, byte(tar.TypeReg), script.Typeflag, "TestOwnershipNormalization.Typeflag")
+	assertEquals(t, int64(10), script.Size, "TestOwnershipNormalization.Size")
+
+	/* owner and group names */
+	cfg.Backup.Owner = "root"
+	cfg.Backup.Group = ""
+	cfg.Backup.ModeMask = ""
+	cfg.Backup.NumericUIDGID = false
+	archivePath, _, err = archiveDirectory(srcDir, &cfg)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	defer os.Remove(archivePath)
+
+	headers = readArchiveHeaders(t, archivePath)
+	script = headers[filepath.Base(srcDir)+"/sub/script.sh"]
+	assertEquals(t, 0, script.Uid, "TestOwnershipNormalization.Uid")
+	assertEquals(t, "root", script.Uname, "TestOwnershipNormalization.Uname")
+	assertEquals(t, int64(0755), script.Mode, "TestOwnershipNormalization.Mode")
+
+	/* unknown owner */
+	cfg.Backup.Owner = "no-such-user-squirrelup"
+	_, _, err = archiveDirectory(srcDir, &cfg)
+	if err == nil {
+		t.Fatalf("archiveDirectory was supposed to fail")
+	}
+	assertEquals(t, `unknown archive owner "no-such-user-squirrelup": user: unknown user no-such-user-squirrelup`, err.Error(), "TestOwnershipNormalization.Error")
+}
+
+func TestOwnershipRestore(t *testing.T) {
+	fmt.Println("Running TestOwnershipRestore...")
+
+	// Setup Test
+	outDir := t.TempDir()
+	header := &tar.Header{
+		Name:     "file.txt",
+		Typeflag: tar.TypeReg,
+		Mode:     0600,
+		Size:     4,
+		Uid:      os.Getuid(),
+		Gid:      os.Getgid(),
+	}
+	file := archiver.File{
+		FileInfo:      header.FileInfo(),
+		Header:        header,
+		NameInArchive: "file.txt",
+		Open: func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader([]byte("test"))), nil
+		},
+	}
+
+	// Perform the test
+	for _, restoreOwner := range []string{restoreOwnerSkip, restoreOwnerPreserve} {
+		err := extractFileHandler(outDir, &extractOptions{restoreOwner: restoreOwner})(context.Background(), file)
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		data, err := os.ReadFile(filepath.Join(outDir, "file.txt"))
+		if err != nil {
+			t.Fatalf("could not read extracted file: %s", err.Error())
+		}
+		assertEquals(t, "test", string(data), "TestOwnershipRestore.content")
+	}
+
+	/* invalid restore owner mode */
+	var stdout, stderr bytes.Buffer
+	identity, _ := age.GenerateX25519Identity()
+	os.Setenv("SQUIRRELUP_IDENTITY", identity.String())
+	defer os.Setenv("SQUIRRELUP_IDENTITY", "")
+
+	err := run([]string{appname, "decrypt", "--restore-owner=keep", "input.tar.gz.age", outDir}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, `invalid restore owner mode "keep", must be "skip" or "preserve"`, err.Error(), "TestOwnershipRestore.Error")
+
+	/* switch without a value */
+	err = run([]string{appname, "decrypt", "--verbose=true", "input.tar.gz.age", outDir}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, "invalid use of the verbose switch, does not accept a value", err.Error(), "TestOwnershipRestore.Error")
+}
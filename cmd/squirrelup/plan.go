@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+
+	"filippo.io/age"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+type (
+	// backupPlan describes what a backup is going to do, printed by --print-plan and --plan-only.
+	backupPlan struct {
+		Source      string `json:"source"`
+		Destination string `json:"destination"`
+		// logical name of the backup object and URI it is stored under, the URI is left
+		// out for passthrough backups which store files under names of their own
+		Name       string                     `json:"name"`
+		Object     string                     `json:"object,omitempty"`
+		Time       time.Time                  `json:"time"`
+		Encryption planEncryption             `json:"encryption"`
+		Retention  planRetention              `json:"retention"`
+		Config     map[string]planConfigValue `json:"config"`
+	}
+
+	planEncryption struct {
+		Enabled bool   `json:"enabled"`
+		Command string `json:"command,omitempty"`
+		// SHA-256 fingerprints of the recipient public keys
+		Recipients []string `json:"recipients"`
+	}
+
+	planRetention struct {
+		Enabled bool    `json:"enabled"`
+		Hours   float64 `json:"hours"`
+		// objects the cleanup would remove at the time of the backup
+		Remove []planObject `json:"remove"`
+		// why the objects to remove could not be determined
+		Error string `json:"error,omitempty"`
+	}
+
+	planObject struct {
+		Object string    `json:"object"`
+		Name   string    `json:"name"`
+		Time   time.Time `json:"time"`
+	}
+
+	planConfigValue struct {
+		Value  string `json:"value"`
+		Source string `json:"source"`
+	}
+)
+
+// newBackupPlan describes the backup of `source` to `outputPrefixUri` at `nominalTime` without
+// changing anything. Objects the cleanup would remove are only listed if `listable` is set.
+func newBackupPlan(backend common.StorageBackend, cfg *common.Config, source string, outputPrefixUri *url.URL, nominalTime time.Time, keys *auxiliaryKeys, listable bool) (*backupPlan, error) {
+	name, err := cfg.BackupName(nominalTime)
+	if err != nil {
+		return nil, err
+	}
+	plan := &backupPlan{
+		Source:      source,
+		Destination: outputPrefixUri.String(),
+		Name:        common.ArchiveObjectName(cfg, name, len(keys.recipients) > 0),
+		Time:        nominalTime,
+		Encryption: planEncryption{
+			Enabled:    len(keys.recipients) > 0 || len(cfg.Encryption.Command) > 0,
+			Command:    cfg.Encryption.Command,
+			Recipients: recipientFingerprints(keys.recipients),
+		},
+		Retention: planRetention{
+			Enabled: cfg.Backup.Hours > 0.0,
+			Hours:   cfg.Backup.Hours,
+			Remove:  []planObject{},
+		},
+		Config: map[string]planConfigValue{},
+	}
+	for _, field := range cfg.Fields() {
+		plan.Config[field.Key] = planConfigValue{field.Value, field.Source}
+	}
+
+	/* obfuscated backups are stored under a key derived from their name, and the cleanup
+	   takes their nominal times from the backup index */
+	var index *backupIndex
+	objectName := plan.Name
+	if cfg.Backup.ObfuscateNames && len(plan.Name) > 0 {
+		nameKey, err := backupNameKey(cfg, keys.identities)
+		if err != nil {
+			return nil, err
+		}
+		objectName = obfuscateName(nameKey, plan.Name)
+		index = readPlanIndex(backend, outputPrefixUri, keys.identities)
+	}
+	if len(objectName) > 0 {
+		plan.Object = common.ResolveObjectURI(outputPrefixUri, objectName).String()
+	}
+
+	switch {
+	case !plan.Retention.Enabled:
+	case !listable:
+		plan.Retention.Error = fmt.Sprintf("listing %q is not permitted", outputPrefixUri)
+	default:
+		expired, err := common.ExpiredObjects(backend, cfg, nominalTime, outputPrefixUri, cleanupOptions(index, nil, nil, nil))
+		if err != nil {
+			plan.Retention.Error = err.Error()
+		}
+		for _, object := range expired {
+			plan.Retention.Remove = append(plan.Retention.Remove, planObject{object.URI.String(), object.Name, object.Modified})
+		}
+	}
+	return plan, nil
+}
+
+// readPlanIndex reads the backup index under `outputPrefixUri`, unlike loadIndex it leaves
+// an unreadable index in place and returns an empty one instead.
+func readPlanIndex(backend common.StorageBackend, outputPrefixUri *url.URL, identities []age.Identity) *backupIndex {
+	uri, err := indexUri(outputPrefixUri)
+	if err != nil {
+		return &backupIndex{}
+	}
+	var buf bytes.Buffer
+	if err := backend.RetrieveFile(&buf, uri); err != nil {
+		return &backupIndex{}
+	}
+	index, err := parseIndex(&buf, identities)
+	if err != nil {
+		return &backupIndex{}
+	}
+	return index
+}
+
+// recipientFingerprints returns the SHA-256 fingerprint of each recipient public key.
+func recipientFingerprints(recipients []age.Recipient) []string {
+	fingerprints := []string{}
+	for _, recipient := range recipients {
+		if stringer, ok := recipient.(fmt.Stringer); ok {
+			sum := sha256.Sum256([]byte(stringer.String()))
+			fingerprints = append(fingerprints, "sha256:"+hex.EncodeToString(sum[:]))
+		}
+	}
+	return fingerprints
+}
+
+// printPlan writes `plan` to `stdout` as indented JSON.
+func printPlan(plan *backupPlan, stdout io.Writer) error {
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(plan); err != nil {
+		return fmt.Errorf("could not print backup plan: %s", err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+// helper function: set up a memory backend behind dummy:// URIs holding an expired backup,
+// a recent backup and a fingerprint, along with a backup directory.
+func setupPlan(t *testing.T) (*common.MemoryBackend, string) {
+	memory := common.NewMemoryBackend()
+	setupBackend(t, memory, map[string]string{"SQUIRRELUP_BACKUP_HOURS": "24"})
+
+	now := common.Now()
+	for key, modified := range map[string]time.Time{
+		"old.tar.gz":          now.Add(-48 * time.Hour),
+		"recent.tar.gz":       now.Add(-time.Hour),
+		fingerprintObjectName: now.Add(-48 * time.Hour),
+	} {
+		uri, _ := url.ParseRequestURI("dummy://bucket/prefix/" + key)
+		if err := memory.StoreFile(context.Background(), common.StoreRequest{URI: uri, BodyAt: bytes.NewReader([]byte(key)), Length: int64(len(key))}); err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		if err := memory.SetFileModified(uri, modified); err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+	}
+
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "file.txt"), []byte("content"), 0600); err != nil {
+		t.Fatalf("could not write to temporary file: %s", err.Error())
+	}
+	return memory, srcDir
+}
+
+// helper function: list the keys stored in `memory` under the test prefix.
+func listPlanKeys(t *testing.T, memory *common.MemoryBackend) string {
+	prefixUri, _ := url.ParseRequestURI("dummy://bucket/prefix/")
+	files, err := memory.ListFiles(prefixUri)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	var keys []string
+	for _, fileinfo := range files {
+		keys = append(keys, fileinfo.Name())
+	}
+	return strings.Join(keys, " ")
+}
+
+func TestPlanOnly(t *testing.T) {
+	fmt.Println("Running TestPlanOnly...")
+
+	// Setup Test
+	memory, srcDir := setupPlan(t)
+	before := listPlanKeys(t, memory)
+	var stdout, stderr bytes.Buffer
+
+	// Perform the test
+	err := run([]string{appname, "--plan-only", "--allow-empty", srcDir, "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	var plan backupPlan
+	if err := json.Unmarshal(stdout.Bytes(), &plan); err != nil {
+		t.Fatalf("plan is not valid JSON: %s\n%s", err.Error(), stdout.String())
+	}
+	assertEquals(t, srcDir, plan.Source, "TestPlanOnly.Source")
+	assertEquals(t, "dummy://bucket/prefix/", plan.Destination, "TestPlanOnly.Destination")
+	assertEquals(t, "2024-05-01T03+0000.tar.gz", plan.Name, "TestPlanOnly.Name")
+	assertEquals(t, "dummy://bucket/prefix/2024-05-01T03+0000.tar.gz", plan.Object, "TestPlanOnly.Object")
+	assertEquals(t, true, plan.Time.Equal(common.Now()), "TestPlanOnly.Time")
+	assertEquals(t, false, plan.Encryption.Enabled, "TestPlanOnly.Encryption.Enabled")
+	assertEquals(t, 0, len(plan.Encryption.Recipients), "TestPlanOnly.Encryption.Recipients")
+	assertEquals(t, true, plan.Retention.Enabled, "TestPlanOnly.Retention.Enabled")
+	assertEquals(t, 24.0, plan.Retention.Hours, "TestPlanOnly.Retention.Hours")
+	assertEquals(t, "", plan.Retention.Error, "TestPlanOnly.Retention.Error")
+	assertEquals(t, 1, len(plan.Retention.Remove), "TestPlanOnly.len(Retention.Remove)")
+	assertEquals(t, "dummy://bucket/prefix/old.tar.gz", plan.Retention.Remove[0].Object, "TestPlanOnly.Retention.Remove")
+	assertEquals(t, true, plan.Retention.Remove[0].Time.Equal(common.Now().Add(-48*time.Hour)), "TestPlanOnly.Retention.Remove.Time")
+	assertEquals(t, planConfigValue{"24", common.ConfigSourceEnv}, plan.Config["backup.hours"], "TestPlanOnly.Config")
+
+	/* nothing was stored or removed */
+	assertEquals(t, before, listPlanKeys(t, memory), "TestPlanOnly.keys")
+}
+
+func TestPlanEncryption(t *testing.T) {
+	fmt.Println("Running TestPlanEncryption...")
+
+	// Setup Test
+	memory, srcDir := setupPlan(t)
+	identity, _ := age.GenerateX25519Identity()
+	t.Setenv("SQUIRRELUP_PUBKEY", identity.Recipient().String())
+	t.Setenv("SQUIRRELUP_BACKUP_HOURS", "0")
+	before := listPlanKeys(t, memory)
+	var stdout, stderr bytes.Buffer
+
+	// Perform the test
+	err := run([]string{appname, "--plan-only", "--allow-empty", srcDir, "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	var plan backupPlan
+	if err := json.Unmarshal(stdout.Bytes(), &plan); err != nil {
+		t.Fatalf("plan is not valid JSON: %s\n%s", err.Error(), stdout.String())
+	}
+	sum := sha256.Sum256([]byte(identity.Recipient().String()))
+	assertEquals(t, "dummy://bucket/prefix/2024-05-01T03+0000.tar.gz.age", plan.Object, "TestPlanEncryption.Object")
+	assertEquals(t, true, plan.Encryption.Enabled, "TestPlanEncryption.Encryption.Enabled")
+	assertEquals(t, 1, len(plan.Encryption.Recipients), "TestPlanEncryption.len(Encryption.Recipients)")
+	assertEquals(t, "sha256:"+hex.EncodeToString(sum[:]), plan.Encryption.Recipients[0], "TestPlanEncryption.Encryption.Recipients")
+	assertEquals(t, false, plan.Retention.Enabled, "TestPlanEncryption.Retention.Enabled")
+	assertEquals(t, 0, len(plan.Retention.Remove), "TestPlanEncryption.len(Retention.Remove)")
+	assertEquals(t, before, listPlanKeys(t, memory), "TestPlanEncryption.keys")
+}
+
+func TestPrintPlan(t *testing.T) {
+	fmt.Println("Running TestPrintPlan...")
+
+	// Setup Test
+	memory, srcDir := setupPlan(t)
+	var stdout, stderr bytes.Buffer
+
+	// Perform the test
+	err := run([]string{appname, "--print-plan", "--allow-empty", srcDir, "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	/* the plan is printed first, then the backup runs as planned */
+	var plan backupPlan
+	decoder := json.NewDecoder(&stdout)
+	if err := decoder.Decode(&plan); err != nil {
+		t.Fatalf("plan is not valid JSON: %s", err.Error())
+	}
+	rest, _ := io.ReadAll(io.MultiReader(decoder.Buffered(), &stdout))
+	assertEquals(t, true, strings.Contains(string(rest), fmt.Sprintf("uploaded backup archive of %q to %q", srcDir, plan.Object)), "TestPrintPlan.stdout")
+	assertEquals(t, true, strings.Contains(string(rest), fmt.Sprintf("removing file %q", plan.Retention.Remove[0].Object)), "TestPrintPlan.stdout")
+	assertEquals(t, "prefix/.fingerprint prefix/"+catalogObjectName+" prefix/2024-05-01T03+0000.tar.gz prefix/recent.tar.gz", listPlanKeys(t, memory), "TestPrintPlan.keys")
+}
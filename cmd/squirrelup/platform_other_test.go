@@ -0,0 +1,25 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+	"runtime"
+	"testing"
+)
+
+// helper function: skip the test, there is no umask on this platform.
+func setUmask(t *testing.T, mask int) {
+	t.Skip("umask is not supported on " + runtime.GOOS)
+}
+
+// helper function: skip the test, signals cannot be sent to a process on this platform.
+func sendSignal(t *testing.T, sig os.Signal) {
+	t.Skip("signals cannot be sent on " + runtime.GOOS)
+}
+
+// helper function: device number of the device file described by `info`, device files are
+// not supported on this platform.
+func deviceNumber(info os.FileInfo) uint64 {
+	return 0
+}
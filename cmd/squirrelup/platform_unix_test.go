@@ -0,0 +1,27 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"testing"
+)
+
+// helper function: set the umask to `mask` for the duration of the test.
+func setUmask(t *testing.T, mask int) {
+	oldMask := syscall.Umask(mask)
+	t.Cleanup(func() { syscall.Umask(oldMask) })
+}
+
+// helper function: send `sig` to the test process.
+func sendSignal(t *testing.T, sig os.Signal) {
+	if err := syscall.Kill(os.Getpid(), sig.(syscall.Signal)); err != nil {
+		t.Fatalf("could not send signal: %s", err.Error())
+	}
+}
+
+// helper function: device number of the device file described by `info`.
+func deviceNumber(info os.FileInfo) uint64 {
+	return uint64(info.Sys().(*syscall.Stat_t).Rdev)
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"time"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+// probeBackend times a cheap request of backends implementing common.Prober and reports the
+// endpoint, region and round trip to `out`, so that bucket and credential errors fail before
+// archiving starts. Keys restricted to writing may not list the prefix, a denied probe is left
+// to the lookup of the prefix that follows. Nothing is done with --no-preflight.
+func probeBackend(cli_args *cliArgs, backend common.StorageBackend, uri *url.URL, out, stderr io.Writer) error {
+	prober, ok := common.AsBackend[common.Prober](backend)
+	if cli_args.NoPreflight || !ok {
+		return nil
+	}
+	result, err := prober.Probe(uri)
+	if err != nil {
+		if err.Error() == common.ErrAccessDenied {
+			return nil
+		}
+		printBackendHint(err, uri, stderr)
+		return fmt.Errorf("backend probe failed: %s", err.Error())
+	}
+
+	description := fmt.Sprintf("backend: %s", result.Endpoint)
+	if len(result.Region) > 0 {
+		description += fmt.Sprintf(", region %s", result.Region)
+	}
+	fmt.Fprintf(out, "%s, round trip %s\n", description, result.Latency.Round(time.Millisecond))
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+// probingBackend is a MemoryBackend answering probes with a fixed result or error.
+type probingBackend struct {
+	*common.MemoryBackend
+	err    string
+	probes int
+}
+
+func (pb *probingBackend) Probe(uri *url.URL) (common.ProbeResult, error) {
+	pb.probes++
+	result := common.ProbeResult{Endpoint: "https://s3.example.com", Region: "eu-central-003", Latency: 42 * time.Millisecond}
+	if len(pb.err) > 0 {
+		return result, errors.New(pb.err)
+	}
+	return result, nil
+}
+
+func TestProbeCheck(t *testing.T) {
+	fmt.Println("Running TestProbeCheck...")
+
+	// Setup Test
+	backend := &probingBackend{MemoryBackend: common.NewMemoryBackend()}
+	setupBackend(t, backend, nil)
+	var stdout, stderr bytes.Buffer
+
+	/* check always probes the backend */
+	err := run([]string{appname, "check", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "backend: https://s3.example.com, region eu-central-003, round trip 42ms\ncheck of \"dummy://bucket/prefix/\" passed\n", stdout.String(), "TestProbeCheck.stdout")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* unless skipped */
+	err = run([]string{appname, "check", "--no-preflight", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "check of \"dummy://bucket/prefix/\" passed\n", stdout.String(), "TestProbeCheck.stdout")
+	assertEquals(t, 1, backend.probes, "TestProbeCheck.probes")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* rejected credentials fail with a hint */
+	backend.err = common.ErrInvalidCredentials
+	err = run([]string{appname, "check", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, "backend probe failed: invalid credentials", err.Error(), "TestProbeCheck.Error")
+	assertEquals(t, true, strings.Contains(stderr.String(), "hint: credentials were rejected by the backend"), "TestProbeCheck.stderr")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* keys restricted to writing may not be allowed to list */
+	backend.err = common.ErrAccessDenied
+	err = run([]string{appname, "check", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "check of \"dummy://bucket/prefix/\" passed\n", stdout.String(), "TestProbeCheck.stdout")
+}
+
+func TestProbeBackup(t *testing.T) {
+	fmt.Println("Running TestProbeBackup...")
+
+	// Setup Test
+	backend := &probingBackend{MemoryBackend: common.NewMemoryBackend()}
+	setupBackend(t, backend, map[string]string{
+		"SQUIRRELUP_BACKUP_HOURS":     "0",
+		"SQUIRRELUP_PROGRESS_ENABLED": "false",
+	})
+	var stdout, stderr bytes.Buffer
+
+	/* backups are probed in verbose mode only */
+	err := run([]string{appname, ".", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 0, backend.probes, "TestProbeBackup.probes")
+	err = run([]string{appname, "--verbose", ".", "dummy://bucket/other/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, strings.Contains(stderr.String(), "intializing backend & verifying settings...\nbackend: https://s3.example.com, region eu-central-003, round trip 42ms\n"), "TestProbeBackup.stderr")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* a missing bucket fails the backup before anything is archived */
+	backend.err = common.ErrBucketNotFound
+	err = run([]string{appname, "-v", ".", "dummy://missing/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, "backend probe failed: bucket not found", err.Error(), "TestProbeBackup.Error")
+	assertEquals(t, true, strings.Contains(stderr.String(), "hint: bucket \"missing\" does not exist"), "TestProbeBackup.stderr")
+	missingUri, _ := url.ParseRequestURI("dummy://missing/prefix/")
+	if files, _ := backend.ListFiles(missingUri); len(files) > 0 {
+		t.Fatalf("nothing was supposed to be stored: %+v", files)
+	}
+
+	/* --no-preflight skips the probe and the readability check of files */
+	probes := backend.probes
+	err = run([]string{appname, "-v", "--no-preflight", ".", "dummy://missing/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, probes, backend.probes, "TestProbeBackup.probes")
+	var cfg common.Config
+	if err = loadConfig(&cliArgs{NoPreflight: true}, &cfg, &stdout, &stderr); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, false, cfg.Backup.Preflight, "TestProbeBackup.Preflight")
+	assertEquals(t, common.ConfigSourceFlag, cfg.Source("backup.preflight"), "TestProbeBackup.Source")
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+const (
+	// pubkeyFetchTimeout limits the time spent fetching recipients from a URL.
+	pubkeyFetchTimeout = 10 * time.Second
+
+	// maxRecipientsFileSize is the largest response accepted from a pubkey URL.
+	maxRecipientsFileSize = 64 * 1024
+
+	// pubkeyCacheKind names the state stored in the cache of recipients fetched from a URL.
+	pubkeyCacheKind = "recipients"
+)
+
+// pubkeyHTTPClient fetches recipients from a pubkey URL, requests time out after pubkeyFetchTimeout.
+var pubkeyHTTPClient *http.Client = &http.Client{}
+
+// initURLRecipients fetches recipients from `pubkeyURL`, parsed like a recipients file, and
+// caches them on disk. If fetching fails, recipients are read from the cache with a warning.
+// Both the response and the cache must match `cfg.Encryption.PubkeyURLHash`, if set. Without
+// usable recipients the error is returned if encryption is required, otherwise it is reported
+// as a warning and no recipients are returned.
+func initURLRecipients(pubkeyURL string, cfg *common.Config, stderr io.Writer) ([]age.Recipient, error) {
+	cachePath, cacheErr := pubkeyCachePath(pubkeyURL, cfg)
+
+	data, err := fetchPubkeyURL(pubkeyURL)
+	var recipients []age.Recipient
+	if err == nil {
+		recipients, err = parsePinnedRecipients(data, cfg.Encryption.PubkeyURLHash)
+	}
+	if err == nil {
+		if cacheErr == nil {
+			cacheErr = writePubkeyCache(cachePath, data, cfg)
+		}
+		if cacheErr != nil {
+			fmt.Fprintf(stderr, "warning: could not cache recipients from pubkey URL: %s\n", cacheErr.Error())
+		}
+		return recipients, nil
+	}
+	err = fmt.Errorf("could not fetch recipients from pubkey URL %q: %s", pubkeyURL, err.Error())
+
+	// fall back to the recipients fetched last
+	if cacheErr == nil {
+		var cached []byte
+		cached, cacheErr = os.ReadFile(cachePath)
+		if cacheErr == nil {
+			cached, cacheErr = common.DecodeStateFile(pubkeyCacheKind, cached)
+		}
+		if cacheErr == nil {
+			recipients, cacheErr = parsePinnedRecipients(cached, cfg.Encryption.PubkeyURLHash)
+		}
+		if cacheErr == nil {
+			fmt.Fprintf(stderr, "warning: %s, using cached recipients\n", err.Error())
+			return recipients, nil
+		}
+	}
+	if !os.IsNotExist(cacheErr) {
+		err = fmt.Errorf("%s, no usable cache: %s", err.Error(), cacheErr.Error())
+	}
+
+	if cfg.Encryption.Required {
+		return nil, err
+	}
+	fmt.Fprintf(stderr, "warning: %s, backups are not encrypted\n", err.Error())
+	return nil, nil
+}
+
+// fetchPubkeyURL returns the body of a successful response to a GET request for `pubkeyURL`.
+func fetchPubkeyURL(pubkeyURL string) ([]byte, error) {
+	if !strings.HasPrefix(pubkeyURL, "https://") {
+		return nil, fmt.Errorf("only https:// URLs are supported")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), pubkeyFetchTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, pubkeyURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := pubkeyHTTPClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response status %q", response.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(response.Body, maxRecipientsFileSize+1))
+	if err != nil {
+		return nil, err
+	} else if len(data) > maxRecipientsFileSize {
+		return nil, fmt.Errorf("response exceeds %d bytes", maxRecipientsFileSize)
+	}
+	return data, nil
+}
+
+// parsePinnedRecipients parses `data` like a recipients file after checking that its SHA-256
+// checksum matches `pinnedHash`, unless it is empty.
+func parsePinnedRecipients(data []byte, pinnedHash string) ([]age.Recipient, error) {
+	if len(pinnedHash) > 0 {
+		sum := sha256.Sum256(data)
+		if hash := hex.EncodeToString(sum[:]); !strings.EqualFold(hash, pinnedHash) {
+			return nil, fmt.Errorf("SHA-256 checksum %s does not match the pinned checksum %s", hash, pinnedHash)
+		}
+	}
+	recipients, err := parseRecipientsFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("parsing recipients failed: %s", err.Error())
+	}
+	return recipients, nil
+}
+
+// pubkeyCachePath returns the path of the file caching recipients fetched from `pubkeyURL`,
+// located in `cfg.Encryption.PubkeyCacheDir` or the user cache directory.
+func pubkeyCachePath(pubkeyURL string, cfg *common.Config) (string, error) {
+	cacheDir := cfg.Encryption.PubkeyCacheDir
+	if len(cacheDir) == 0 {
+		userCacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return "", err
+		}
+		cacheDir = filepath.Join(userCacheDir, strings.ToLower(appname))
+	}
+	sum := sha256.Sum256([]byte(pubkeyURL))
+	return filepath.Join(cacheDir, "recipients-"+hex.EncodeToString(sum[:8])), nil
+}
+
+// writePubkeyCache atomically replaces the cache file at `cachePath` with `data`, prefixed by
+// a state file header to detect truncated or foreign files.
+func writePubkeyCache(cachePath string, data []byte, cfg *common.Config) error {
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0700); err != nil {
+		return err
+	}
+	return common.AtomicWriteFile(cachePath, common.EncodeStateFile(pubkeyCacheKind, data), cfg.FileMode(common.StateFile))
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+// pubkeyServer serves a recipients file over HTTPS, or fails with status 500.
+type pubkeyServer struct {
+	*httptest.Server
+	body    atomic.Value
+	failing atomic.Bool
+}
+
+// helper function: serve `body` over HTTPS and trust the server for pubkey URLs.
+func setupPubkeyServer(t *testing.T, body string) *pubkeyServer {
+	server := &pubkeyServer{}
+	server.body.Store(body)
+	server.Server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if server.failing.Load() {
+			http.Error(w, "unavailable", http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, server.body.Load())
+	}))
+	oldClient := pubkeyHTTPClient
+	pubkeyHTTPClient = server.Client()
+	t.Cleanup(func() {
+		pubkeyHTTPClient = oldClient
+		server.Close()
+	})
+	return server
+}
+
+func TestInitEncryptionPubkeyURL(t *testing.T) {
+	fmt.Println("Running TestInitEncryptionPubkeyURL...")
+
+	// Setup Test
+	identity1, _ := age.GenerateX25519Identity()
+	identity2, _ := age.GenerateX25519Identity()
+	body := "# rotated backup keys\n" + identity1.Recipient().String() + "\n" + identity2.Recipient().String() + "\n"
+	server := setupPubkeyServer(t, body)
+
+	var cfg common.Config
+	cfg.Encryption.PubkeyURL = server.URL + "/recipients.txt"
+	cfg.Encryption.PubkeyCacheDir = t.TempDir()
+	var stdout, stderr bytes.Buffer
+
+	// Perform the test
+	recipients, err := initEncryption(&cfg, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, fmt.Sprintf("[%s %s]", identity1.Recipient(), identity2.Recipient()), fmt.Sprint(recipients), "TestInitEncryptionPubkeyURL.recipients")
+	assertEquals(t, "", stderr.String(), "TestInitEncryptionPubkeyURL.stderr")
+
+	/* the response is cached for the owner only */
+	cachePath, _ := pubkeyCachePath(cfg.Encryption.PubkeyURL, &cfg)
+	assertPerm(t, 0600, cachePath, "TestInitEncryptionPubkeyURL.perm")
+	raw, _ := os.ReadFile(cachePath)
+	cached, err := common.DecodeStateFile(pubkeyCacheKind, raw)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, body, string(cached), "TestInitEncryptionPubkeyURL.cached")
+
+	/* the pubkey setting accepts URLs as well */
+	cfg.Encryption.Pubkey, cfg.Encryption.PubkeyURL = cfg.Encryption.PubkeyURL, ""
+	recipients, err = initEncryption(&cfg, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 2, len(recipients), "TestInitEncryptionPubkeyURL.len(recipients)")
+}
+
+func TestInitEncryptionPubkeyURLPinned(t *testing.T) {
+	fmt.Println("Running TestInitEncryptionPubkeyURLPinned...")
+
+	// Setup Test
+	identity, _ := age.GenerateX25519Identity()
+	body := identity.Recipient().String() + "\n"
+	server := setupPubkeyServer(t, body)
+	sum := sha256.Sum256([]byte(body))
+
+	var cfg common.Config
+	cfg.Encryption.PubkeyURL = server.URL + "/recipients.txt"
+	cfg.Encryption.PubkeyCacheDir = t.TempDir()
+	var stdout, stderr bytes.Buffer
+
+	/* the response matches the pinned checksum */
+	cfg.Encryption.PubkeyURLHash = strings.ToUpper(hex.EncodeToString(sum[:]))
+	recipients, err := initEncryption(&cfg, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 1, len(recipients), "TestInitEncryptionPubkeyURLPinned.len(recipients)")
+
+	/* a swapped response is rejected along with the cache, which does not match either */
+	cfg.Encryption.PubkeyURLHash = strings.Repeat("0", 64)
+	cfg.Encryption.Required = true
+	mismatch := fmt.Sprintf("SHA-256 checksum %s does not match the pinned checksum %s", hex.EncodeToString(sum[:]), cfg.Encryption.PubkeyURLHash)
+	_, err = initEncryption(&cfg, io.Writer(&stdout), io.Writer(&stderr))
+	assertEquals(t, fmt.Sprintf("could not fetch recipients from pubkey URL %q: %s, no usable cache: %s", cfg.Encryption.PubkeyURL, mismatch, mismatch), fmt.Sprintf("%v", err), "TestInitEncryptionPubkeyURLPinned.err")
+
+	/* backups are not encrypted unless encryption is required */
+	cfg.Encryption.Required = false
+	recipients, err = initEncryption(&cfg, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 0, len(recipients), "TestInitEncryptionPubkeyURLPinned.len(recipients)")
+	assertEquals(t, true, strings.HasSuffix(stderr.String(), ", backups are not encrypted\n"), "TestInitEncryptionPubkeyURLPinned.stderr")
+}
+
+func TestInitEncryptionPubkeyURLCache(t *testing.T) {
+	fmt.Println("Running TestInitEncryptionPubkeyURLCache...")
+
+	// Setup Test
+	identity, _ := age.GenerateX25519Identity()
+	server := setupPubkeyServer(t, identity.Recipient().String()+"\n")
+
+	var cfg common.Config
+	cfg.Encryption.PubkeyURL = server.URL + "/recipients.txt"
+	cfg.Encryption.PubkeyCacheDir = t.TempDir()
+	cfg.Encryption.Required = true
+	var stdout, stderr bytes.Buffer
+
+	/* no cache yet */
+	server.failing.Store(true)
+	_, err := initEncryption(&cfg, io.Writer(&stdout), io.Writer(&stderr))
+	assertEquals(t, fmt.Sprintf("could not fetch recipients from pubkey URL %q: unexpected response status \"500 Internal Server Error\"", cfg.Encryption.PubkeyURL), fmt.Sprintf("%v", err), "TestInitEncryptionPubkeyURLCache.err")
+
+	/* recipients fetched last are used while the URL is unavailable */
+	server.failing.Store(false)
+	if _, err = initEncryption(&cfg, io.Writer(&stdout), io.Writer(&stderr)); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	server.failing.Store(true)
+	recipients, err := initEncryption(&cfg, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, fmt.Sprintf("[%s]", identity.Recipient()), fmt.Sprint(recipients), "TestInitEncryptionPubkeyURLCache.recipients")
+	assertEquals(t, fmt.Sprintf("warning: could not fetch recipients from pubkey URL %q: unexpected response status \"500 Internal Server Error\", using cached recipients\n", cfg.Encryption.PubkeyURL), stderr.String(), "TestInitEncryptionPubkeyURLCache.stderr")
+
+	/* invalid responses are not cached */
+	stderr.Reset()
+	server.failing.Store(false)
+	server.body.Store("not a recipient\n")
+	recipients, err = initEncryption(&cfg, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 1, len(recipients), "TestInitEncryptionPubkeyURLCache.len(recipients)")
+	assertEquals(t, true, strings.Contains(stderr.String(), "parsing recipients failed: malformed recipient at line 1: "), "TestInitEncryptionPubkeyURLCache.stderr")
+
+	/* truncated caches are detected */
+	cachePath, _ := pubkeyCachePath(cfg.Encryption.PubkeyURL, &cfg)
+	raw, _ := os.ReadFile(cachePath)
+	if err := os.WriteFile(cachePath, raw[:len(raw)-1], 0600); err != nil {
+		t.Fatalf("could not write cache: %s", err.Error())
+	}
+	server.failing.Store(true)
+	_, err = initEncryption(&cfg, io.Writer(&stdout), io.Writer(&stderr))
+	assertEquals(t, true, strings.HasSuffix(fmt.Sprintf("%v", err), ", no usable cache: "+common.ErrStateFileCorrupted), "TestInitEncryptionPubkeyURLCache.err")
+}
+
+func TestFetchPubkeyURLErrors(t *testing.T) {
+	fmt.Println("Running TestFetchPubkeyURLErrors...")
+
+	// Setup Test
+	server := setupPubkeyServer(t, strings.Repeat("#", maxRecipientsFileSize+1))
+
+	// Perform the test
+	_, err := fetchPubkeyURL("http://example.com/recipients.txt")
+	assertEquals(t, "only https:// URLs are supported", fmt.Sprintf("%v", err), "TestFetchPubkeyURLErrors.err")
+	_, err = fetchPubkeyURL(server.URL)
+	assertEquals(t, "response exceeds 65536 bytes", fmt.Sprintf("%v", err), "TestFetchPubkeyURLErrors.err")
+}
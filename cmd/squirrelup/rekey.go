@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+
+	"filippo.io/age"
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+const rekeyTempSuffix = ".rekey"
+
+func runRekey(cli_args *cliArgs, stdout, stderr io.Writer) error {
+	var err error
+
+	// process input arguments
+	prefixUri, err := parsePrefixUri(cli_args.PositionalArgs[0], cli_args.Verbose, stderr)
+	if err != nil {
+		return fmt.Errorf("could not parse prefix URI: %s", err.Error())
+	}
+	if _, err = path.Match(cli_args.Filter, ""); err != nil {
+		return fmt.Errorf("invalid filter pattern %q: %s", cli_args.Filter, err.Error())
+	}
+
+	/* load configuration */
+	var cfg common.Config
+
+	err = loadConfig(cli_args, &cfg, stdout, stderr)
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	}
+
+	/* initialize encryption */
+	if cli_args.Verbose {
+		fmt.Fprintf(stderr, "initializing encryption...\n")
+	}
+	var identities []age.Identity
+	identities, err = initIdentities(&cfg, stdout, stderr)
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	} else if len(identities) == 0 {
+		return fmt.Errorf("no identity configured, decryption is not possible")
+	}
+	var recipients []age.Recipient
+	recipients, err = initEncryption(&cfg, stdout, stderr)
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	} else if len(recipients) == 0 {
+		return fmt.Errorf("no pubkey configured, encryption is not possible")
+	}
+
+	/* initialize the backend */
+	if cli_args.Verbose {
+		fmt.Fprintf(stderr, "intializing backend & verifying settings...\n")
+	}
+	backend, err := common.CreateStorageBackend(prefixUri, &cfg)
+	if err != nil {
+		return fmt.Errorf("failed to create backend: %s", err.Error())
+	}
+
+	/* list prefix contents */
+	filelist, err := backend.ListFiles(prefixUri)
+	if err != nil {
+		return fmt.Errorf("could not list remote files: %s", err.Error())
+	}
+
+	var candidates []*url.URL
+	for _, fileinfo := range filelist {
+		name := path.Base(fileinfo.Name())
+		if path.Ext(name) == rekeyTempSuffix || name == fingerprintObjectName || name == catalogObjectName {
+			continue
+		}
+		if len(cli_args.Filter) > 0 {
+			if matched, _ := path.Match(cli_args.Filter, name); !matched {
+				continue
+			}
+		}
+
+		candidates = append(candidates, fileinfo.URI())
+	}
+
+	/* confirm replacing the files */
+	if !cli_args.DryRun {
+		var objects []string
+		for _, fileUri := range candidates {
+			objects = append(objects, fileUri.String())
+		}
+		if err = confirmDestructive(cli_args, "re-encrypt and replace", objects, stderr); err != nil {
+			return fmt.Errorf("%s", err.Error())
+		}
+	}
+
+	/* re-encrypt files */
+	var index int = 0
+	if common.ProgressEnabled(cfg.Internal.Reporter) && !cli_args.DryRun {
+		index, _ = cfg.Internal.Reporter.CreateFileTask(int64(len(candidates)))
+	}
+
+	var failed []string
+	for i, fileUri := range candidates {
+		if cli_args.DryRun {
+			fmt.Fprintf(stdout, "would re-encrypt %q\n", fileUri)
+			continue
+		}
+
+		if index > 0 {
+			_ = cfg.Internal.Reporter.DescribeTask(index, fmt.Sprintf("re-encrypting file %d of %d", i+1, len(candidates)))
+		} else if cli_args.Verbose {
+			fmt.Fprintf(stderr, "re-encrypting file %d of %d: %q\n", i+1, len(candidates), fileUri)
+		}
+
+		err = rekeyFile(backend, fileUri, identities, recipients, &cfg)
+		if err != nil {
+			fmt.Fprintf(stderr, "skipping %q: %s\n", fileUri, err.Error())
+			failed = append(failed, fmt.Sprintf("%q: %s", fileUri, err.Error()))
+		} else {
+			fmt.Fprintf(stdout, "re-encrypted %q\n", fileUri)
+		}
+
+		if index > 0 {
+			_ = cfg.Internal.Reporter.AdvanceTask(index, 1)
+		}
+	}
+
+	/* report summary */
+	if cli_args.DryRun {
+		fmt.Fprintf(stdout, "%d files would be re-encrypted\n", len(candidates))
+		return nil
+	}
+
+	fmt.Fprintf(stdout, "re-encrypted %d of %d files\n", len(candidates)-len(failed), len(candidates))
+	if len(failed) > 0 {
+		for _, message := range failed {
+			fmt.Fprintf(stderr, "failed to re-encrypt %s\n", message)
+		}
+		return fmt.Errorf("failed to re-encrypt %d files", len(failed))
+	}
+
+	return nil
+}
+
+// rekeyFile downloads an encrypted file, re-encrypts it to `recipients` and replaces the
+// original object with a copy of a temporary object whose size is verified first. The
+// temporary object is removed once the copy is verified.
+func rekeyFile(backend common.StorageBackend, uri *url.URL, identities []age.Identity, recipients []age.Recipient, cfg *common.Config) error {
+	// download the encrypted file
+	download, err := common.CreateTempFile("", appname+"-download-", cfg.FileMode(common.SecretFile))
+	if err != nil {
+		return fmt.Errorf("could not create temporary file: %s", err.Error())
+	}
+	defer os.Remove(download.Name())
+	defer download.Close()
+
+	err = backend.RetrieveFile(download, uri)
+	if err != nil {
+		return fmt.Errorf("could not download file: %s", err.Error())
+	}
+	_, err = download.Seek(0, io.SeekStart)
+	if err != nil {
+		return fmt.Errorf("could not rewind temporary file: %s", err.Error())
+	}
+
+	// decrypt the file and encrypt it to the new recipients
+	plaintext, err := common.DecryptStream(download, identities)
+	if err != nil {
+		return fmt.Errorf("could not decrypt file: %s", err.Error())
+	}
+
+	rekeyed, err := common.CreateTempFile("", appname+"-encrypted-", cfg.FileMode(common.SecretFile))
+	if err != nil {
+		return fmt.Errorf("could not create temporary file: %s", err.Error())
+	}
+	defer os.Remove(rekeyed.Name())
+	defer rekeyed.Close()
+
+	encryptedWriter, err := age.Encrypt(rekeyed, recipients...)
+	if err != nil {
+		return fmt.Errorf("could not initialize encryption: %s", err.Error())
+	}
+	var encryptedOutput io.Writer = encryptedWriter
+	if common.ProgressEnabled(cfg.Internal.Reporter) {
+		var index int
+		index, _ = cfg.Internal.Reporter.CreateFileTask(-1)
+		_ = cfg.Internal.Reporter.DescribeTask(index, "re-encrypting")
+		encryptedOutput = io.MultiWriter(
+			encryptedWriter,
+			&progressWriter{
+				cfg.Internal.Reporter,
+				index,
+			},
+		)
+		defer cfg.Internal.Reporter.FinishTask(index)
+	}
+	_, err = common.CopyBuffer(encryptedOutput, plaintext, cfg.BufferSize())
+	if err != nil {
+		return fmt.Errorf("could not decrypt file: %s", err.Error())
+	}
+	err = encryptedWriter.Close()
+	if err != nil {
+		return fmt.Errorf("could not finalize encryption: %s", err.Error())
+	}
+
+	fileInfo, err := rekeyed.Stat()
+	if err != nil {
+		return fmt.Errorf("could not stat temporary file: %s", err.Error())
+	}
+
+	// upload to a temporary object and verify it
+	var tempUri url.URL = *uri
+	tempUri.Path += rekeyTempSuffix
+	tempUri.RawPath = ""
+
+	contentType := common.ContentTypeAge
+	if len(cfg.Backup.ContentType) > 0 {
+		contentType = cfg.Backup.ContentType
+	}
+	err = backend.StoreFile(context.Background(), common.StoreRequest{URI: &tempUri, BodyAt: rekeyed, Length: fileInfo.Size(), ContentType: contentType})
+	if err == nil {
+		err = verifyRemoteSize(backend, &tempUri, fileInfo.Size())
+	}
+	if err != nil {
+		_ = backend.RemoveFile(&tempUri)
+		return fmt.Errorf("could not upload re-encrypted file: %s", err.Error())
+	}
+
+	// replace the original object by copying over it, so it is never missing
+	err = backend.CopyFile(&tempUri, uri)
+	if err != nil {
+		_ = backend.RemoveFile(&tempUri)
+		return fmt.Errorf("could not replace original file: %s", err.Error())
+	}
+	err = verifyRemoteSize(backend, uri, fileInfo.Size())
+	if err != nil {
+		return fmt.Errorf("could not replace original file, re-encrypted copy is kept at %q: %s", tempUri.String(), err.Error())
+	}
+
+	err = backend.RemoveFile(&tempUri)
+	if err != nil {
+		return fmt.Errorf("could not remove temporary file %q: %s", tempUri.String(), err.Error())
+	}
+
+	// versioned buckets keep the original as a prior version, still encrypted to the old
+	// recipients
+	if pruner, ok := common.AsBackend[common.VersionPruner](backend); ok {
+		_, err = pruner.RemovePriorVersions(uri)
+		if err != nil {
+			return fmt.Errorf("could not remove prior versions of %q: %s", uri.String(), err.Error())
+		}
+	}
+
+	return nil
+}
+
+// verifyRemoteSize checks that the object under `uri` has the expected size.
+func verifyRemoteSize(backend common.StorageBackend, uri *url.URL, size int64) error {
+	fileinfo, err := backend.GetFileInfo(uri)
+	if err != nil {
+		return fmt.Errorf("could not verify remote file %q: %s", uri, err.Error())
+	}
+	if fileinfo.Size() != uint64(size) {
+		return fmt.Errorf("size mismatch for remote file %q: expected %d, got %d", uri, size, fileinfo.Size())
+	}
+	return nil
+}
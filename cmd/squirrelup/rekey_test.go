@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+// helper function: store `content` encrypted to `recipient` under `uri` in a memory backend.
+func storeEncrypted(t *testing.T, memory *common.MemoryBackend, uri string, content string, recipient age.Recipient) {
+	var buf bytes.Buffer
+	if recipient != nil {
+		encryptedWriter, err := age.Encrypt(&buf, recipient)
+		if err != nil {
+			t.Fatalf("could not initialize encryption: %s", err.Error())
+		}
+		_, _ = encryptedWriter.Write([]byte(content))
+		_ = encryptedWriter.Close()
+	} else {
+		buf.WriteString(content)
+	}
+
+	mockURI, _ := url.ParseRequestURI(uri)
+	if err := memory.StoreFile(context.Background(), common.StoreRequest{URI: mockURI, BodyAt: bytes.NewReader(buf.Bytes()), Length: int64(buf.Len())}); err != nil {
+		t.Fatalf("could not store file: %s", err.Error())
+	}
+}
+
+// helper function: decrypt an object stored under `uri` in a memory backend.
+func retrieveDecrypted(t *testing.T, memory *common.MemoryBackend, uri string, identity age.Identity) (string, error) {
+	var buf bytes.Buffer
+	mockURI, _ := url.ParseRequestURI(uri)
+	if err := memory.RetrieveFile(&buf, mockURI); err != nil {
+		t.Fatalf("could not retrieve file: %s", err.Error())
+	}
+
+	plaintext, err := common.DecryptStream(&buf, []age.Identity{identity})
+	if err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(plaintext)
+	return string(data), err
+}
+
+func TestRekeyRun(t *testing.T) {
+	fmt.Println("Running TestRekeyRun...")
+
+	// Setup Test
+	oldIdentity, _ := age.GenerateX25519Identity()
+	newIdentity, _ := age.GenerateX25519Identity()
+
+	memory := common.NewMemoryBackend()
+	storeEncrypted(t, memory, "dummy://bucket/prefix/a.tar.gz.age", "content a", oldIdentity.Recipient())
+	storeEncrypted(t, memory, "dummy://bucket/prefix/b.tar.gz.age", "content b", oldIdentity.Recipient())
+	storeEncrypted(t, memory, "dummy://bucket/prefix/c.tar.gz", "content c", nil)
+	storeEncrypted(t, memory, "dummy://bucket/other/d.tar.gz.age", "content d", oldIdentity.Recipient())
+	setupBackend(t, memory, map[string]string{
+		"SQUIRRELUP_IDENTITY": oldIdentity.String(),
+		"SQUIRRELUP_PUBKEY":   newIdentity.Recipient().String(),
+	})
+
+	/* dry run */
+	var stdout, stderr bytes.Buffer
+	err := run([]string{appname, "rekey", "--dry-run", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, `would re-encrypt "dummy://bucket/prefix/a.tar.gz.age"
+would re-encrypt "dummy://bucket/prefix/b.tar.gz.age"
+would re-encrypt "dummy://bucket/prefix/c.tar.gz"
+3 files would be re-encrypted
+`, stdout.String(), "TestRekeyRun.stdout")
+
+	content, err := retrieveDecrypted(t, memory, "dummy://bucket/prefix/a.tar.gz.age", oldIdentity)
+	if err != nil {
+		t.Fatalf("dry run must not modify files: %+v", err)
+	}
+	assertEquals(t, "content a", content, "TestRekeyRun.content")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* replacing files requires --yes without a terminal */
+	err = run([]string{appname, "rekey", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, "refusing to re-encrypt and replace 3 objects without confirmation, pass --yes to proceed without a terminal", err.Error(), "TestRekeyRun.Error")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* re-encrypt all files, one of them can not be decrypted */
+	err = run([]string{appname, "rekey", "--yes", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, "failed to re-encrypt 1 files", err.Error(), "TestRekeyRun.Error")
+	assertEquals(t, `re-encrypted "dummy://bucket/prefix/a.tar.gz.age"
+re-encrypted "dummy://bucket/prefix/b.tar.gz.age"
+re-encrypted 2 of 3 files
+`, stdout.String(), "TestRekeyRun.stdout")
+	if !strings.Contains(stderr.String(), `failed to re-encrypt "dummy://bucket/prefix/c.tar.gz": could not decrypt file`) {
+		t.Fatalf("unexpected test result: %s", stderr.String())
+	}
+
+	for _, key := range []string{"a", "b"} {
+		content, err = retrieveDecrypted(t, memory, "dummy://bucket/prefix/"+key+".tar.gz.age", newIdentity)
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		assertEquals(t, "content "+key, content, "TestRekeyRun.content")
+	}
+	_, err = retrieveDecrypted(t, memory, "dummy://bucket/other/d.tar.gz.age", oldIdentity)
+	if err != nil {
+		t.Fatalf("files outside of prefix must not be modified: %+v", err)
+	}
+
+	prefixURI, _ := url.ParseRequestURI("dummy://bucket/")
+	filelist, _ := memory.ListFiles(prefixURI)
+	assertEquals(t, 4, len(filelist), "TestRekeyRun.len(filelist)")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* filter files */
+	err = run([]string{appname, "rekey", "--dry-run", "--filter", "b.*", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, `would re-encrypt "dummy://bucket/prefix/b.tar.gz.age"
+1 files would be re-encrypted
+`, stdout.String(), "TestRekeyRun.stdout")
+}
+
+func TestRekeyWrongCliArgs(t *testing.T) {
+	fmt.Println("Running TestRekeyWrongCliArgs...")
+
+	var stdout, stderr bytes.Buffer
+
+	/* test without prefix */
+	err := run([]string{appname, "rekey"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, "wrong number of arguments, rekey expects exactly 1 positional argument", err.Error(), "TestRekeyWrongCliArgs.Error")
+
+	/* test filter switch without value */
+	err = run([]string{appname, "rekey", "dummy://bucket/prefix/", "--filter"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, "invalid use of the filter switch, must provide a value", err.Error(), "TestRekeyWrongCliArgs.Error")
+
+	/* test invalid filter */
+	err = run([]string{appname, "rekey", "--filter", "[", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, `invalid filter pattern "[": syntax error in pattern`, err.Error(), "TestRekeyWrongCliArgs.Error")
+}
+
+// failingCopyBackend is a MemoryBackend whose copies fail.
+type failingCopyBackend struct {
+	*common.MemoryBackend
+}
+
+func (fcb *failingCopyBackend) CopyFile(source *url.URL, destination *url.URL) error {
+	return fmt.Errorf("%s", common.ErrAccessDenied)
+}
+
+func TestRekeyFileCopyFails(t *testing.T) {
+	fmt.Println("Running TestRekeyFileCopyFails...")
+
+	// Setup Test
+	oldIdentity, _ := age.GenerateX25519Identity()
+	newIdentity, _ := age.GenerateX25519Identity()
+	memory := common.NewMemoryBackend()
+	storeEncrypted(t, memory, "dummy://bucket/prefix/a.tar.gz.age", "content a", oldIdentity.Recipient())
+	uri, _ := url.ParseRequestURI("dummy://bucket/prefix/a.tar.gz.age")
+	cfg := new(common.Config)
+
+	// Perform the test
+	err := rekeyFile(&failingCopyBackend{memory}, uri, []age.Identity{oldIdentity}, []age.Recipient{newIdentity.Recipient()}, cfg)
+	if err == nil {
+		t.Fatalf("rekeyFile was supposed to fail")
+	}
+	assertEquals(t, "could not replace original file: access denied", err.Error(), "TestRekeyFileCopyFails.Error")
+
+	/* the original object is left as it was, the re-encrypted copy is removed */
+	content, err := retrieveDecrypted(t, memory, "dummy://bucket/prefix/a.tar.gz.age", oldIdentity)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "content a", content, "TestRekeyFileCopyFails.content")
+	tempUri, _ := url.ParseRequestURI("dummy://bucket/prefix/a.tar.gz.age.rekey")
+	if _, err = memory.GetFileInfo(tempUri); err == nil {
+		t.Fatalf("re-encrypted copy was supposed to be removed")
+	}
+}
+
+// versionedBackend is a MemoryBackend recording the objects whose prior versions were removed.
+type versionedBackend struct {
+	*common.MemoryBackend
+	pruned []string
+	err    error
+}
+
+func (vb *versionedBackend) RemovePriorVersions(uri *url.URL) (int, error) {
+	if vb.err != nil {
+		return 0, vb.err
+	}
+	vb.pruned = append(vb.pruned, uri.String())
+	return 1, nil
+}
+
+func TestRekeyFilePriorVersions(t *testing.T) {
+	fmt.Println("Running TestRekeyFilePriorVersions...")
+
+	// Setup Test
+	oldIdentity, _ := age.GenerateX25519Identity()
+	newIdentity, _ := age.GenerateX25519Identity()
+	memory := common.NewMemoryBackend()
+	storeEncrypted(t, memory, "dummy://bucket/prefix/a.tar.gz.age", "content a", oldIdentity.Recipient())
+	uri, _ := url.ParseRequestURI("dummy://bucket/prefix/a.tar.gz.age")
+	backend := &versionedBackend{MemoryBackend: memory}
+	cfg := new(common.Config)
+
+	// Perform the test
+	err := rekeyFile(backend, uri, []age.Identity{oldIdentity}, []age.Recipient{newIdentity.Recipient()}, cfg)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	/* the versions encrypted to the old recipients are removed once the original was replaced */
+	assertEquals(t, "[dummy://bucket/prefix/a.tar.gz.age]", fmt.Sprint(backend.pruned), "TestRekeyFilePriorVersions.pruned")
+	content, err := retrieveDecrypted(t, memory, "dummy://bucket/prefix/a.tar.gz.age", newIdentity)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "content a", content, "TestRekeyFilePriorVersions.content")
+
+	/* failures to remove them fail the file */
+	backend.err = fmt.Errorf("%s", common.ErrAccessDenied)
+	err = rekeyFile(backend, uri, []age.Identity{newIdentity}, []age.Recipient{newIdentity.Recipient()}, cfg)
+	if err == nil {
+		t.Fatalf("rekeyFile was supposed to fail")
+	}
+	assertEquals(t, `could not remove prior versions of "dummy://bucket/prefix/a.tar.gz.age": access denied`, err.Error(), "TestRekeyFilePriorVersions.Error")
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+// resumeUpload completes an upload recorded in a recovery file and cleans up the backup prefix,
+// asking `confirm` before old backups are removed if set.
+func resumeUpload(backend common.StorageBackend, cfg *common.Config, now time.Time, outputPrefixUri *url.URL, recoveryFilepath string, confirm func(objects []string) error, stdout, stderr io.Writer) error {
+	resumable, ok := common.AsBackend[common.ResumableBackend](backend)
+	if !ok {
+		return fmt.Errorf("backend for %q does not support resuming uploads", outputPrefixUri)
+	}
+
+	uri, err := resumable.ResumeUpload(recoveryFilepath)
+	if err != nil {
+		return fmt.Errorf("could not resume upload: %s", err.Error())
+	}
+	if !strings.HasPrefix(uri.String(), outputPrefixUri.String()) {
+		fmt.Fprintf(stderr, "resumed upload %q is outside of the output prefix %q\n", uri, outputPrefixUri)
+	}
+	fmt.Fprintf(stdout, "completed upload of %q\n", uri)
+
+	/* clean up remote backup prefix */
+	if cfg.Backup.Hours > 0.0 {
+		cleanup, err := cleanupBackupPrefix(backend, cfg, now, outputPrefixUri, nil, confirm, stdout, stderr)
+		if err != nil {
+			return fmt.Errorf("failed to clean up backup prefix: %s", err.Error())
+		}
+		return cleanupDeferred("upload was completed", cleanup)
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+// resumableBackend is a MemoryBackend that completes uploads by storing the recovery file contents.
+type resumableBackend struct {
+	*common.MemoryBackend
+}
+
+func (rb *resumableBackend) ResumeUpload(recoveryFilepath string) (*url.URL, error) {
+	data, err := os.ReadFile(recoveryFilepath)
+	if err != nil {
+		return nil, errors.New("could not read recovery file")
+	}
+	uri, _ := url.ParseRequestURI(strings.TrimSpace(string(data)))
+	err = rb.StoreFile(context.Background(), common.StoreRequest{URI: uri, BodyAt: bytes.NewReader(data), Length: int64(len(data))})
+	if err != nil {
+		return nil, err
+	}
+	return uri, nil
+}
+
+func TestResumeUploadRun(t *testing.T) {
+	fmt.Println("Running TestResumeUploadRun...")
+
+	// Setup Test
+	memory := common.NewMemoryBackend()
+	useBackend := setupBackend(t, memory, map[string]string{"SQUIRRELUP_BACKUP_HOURS": "0"})
+
+	recoveryFilepath := filepath.Join(t.TempDir(), "recovery.json")
+	if err := os.WriteFile(recoveryFilepath, []byte("dummy://bucket/prefix/2024-05-01T03+0000.tar.gz\n"), 0600); err != nil {
+		t.Fatalf("could not write recovery file: %s", err.Error())
+	}
+
+	var stdout, stderr bytes.Buffer
+	args := []string{appname, "--resume-upload", recoveryFilepath, ".", "dummy://bucket/prefix/"}
+
+	/* backend does not support resuming uploads */
+	err := run(args, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, `backend for "dummy://bucket/prefix/" does not support resuming uploads`, err.Error(), "TestResumeUploadRun.Error")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* upload is completed without creating a new archive */
+	useBackend(&resumableBackend{memory})
+	err = run(args, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, strings.HasSuffix(stdout.String(), "completed upload of \"dummy://bucket/prefix/2024-05-01T03+0000.tar.gz\"\n"), "TestResumeUploadRun.stdout")
+
+	prefixUri, _ := url.ParseRequestURI("dummy://bucket/prefix/")
+	filelist, _ := memory.ListFiles(prefixUri)
+	assertEquals(t, 1, len(filelist), "TestResumeUploadRun.len(filelist)")
+
+	// clean up
+	stdout.Reset()
+	stderr.Reset()
+
+	/* missing recovery file */
+	args = []string{appname, "--resume-upload=" + recoveryFilepath + ".missing", ".", "dummy://bucket/prefix/"}
+	err = run(args, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err == nil {
+		t.Fatalf("%s was supposed to fail", appname)
+	}
+	assertEquals(t, "could not resume upload: could not read recovery file", err.Error(), "TestResumeUploadRun.Error")
+}
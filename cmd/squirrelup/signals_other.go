@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+)
+
+// runNowSignal is nil, there is no user-defined signal to start a backup on this platform.
+var runNowSignal os.Signal
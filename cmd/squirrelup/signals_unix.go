@@ -0,0 +1,11 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// runNowSignal makes the daemon start a backup right away.
+var runNowSignal os.Signal = syscall.SIGUSR1
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+// minSizeHistory is the number of previous backups required to compare the size of a backup.
+const minSizeHistory = 3
+
+// sizeAnomaly compares `size` to the median of the sizes of previous backups in `history`.
+// Returns a warning if it is smaller than `minFraction` of the median or larger than
+// `maxMultiple` times the median, an empty string otherwise or if the history is shorter
+// than minSizeHistory. Bounds that are zero are not checked.
+func sizeAnomaly(size int64, history []int64, minFraction, maxMultiple float64) string {
+	if len(history) < minSizeHistory {
+		return ""
+	}
+	sorted := append([]int64{}, history...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	median := float64(sorted[len(sorted)/2])
+	if len(sorted)%2 == 0 {
+		median = (float64(sorted[len(sorted)/2-1]) + median) / 2
+	}
+	if median <= 0 {
+		return ""
+	}
+
+	ratio := float64(size) / median
+	if minFraction > 0 && ratio < minFraction {
+		return fmt.Sprintf("backup size of %d bytes is %.0f%% of the median size of the last %d backups (%.0f bytes), check the backup directory for missing data",
+			size, ratio*100, len(history), median)
+	} else if maxMultiple > 0 && ratio > maxMultiple {
+		return fmt.Sprintf("backup size of %d bytes is %.1f times the median size of the last %d backups (%.0f bytes)",
+			size, ratio, len(history), median)
+	}
+	return ""
+}
+
+// sizeHistory returns the sizes of up to `limit` of the most recent backups in the catalog
+// created from `entry.Source` on `entry.Host`, along with entries whose origin is unknown.
+// The entry itself is left out.
+func sizeHistory(catalog *backupCatalog, entry *catalogEntry, limit int) []int64 {
+	var history []int64
+	for index := len(catalog.Entries) - 1; index >= 0 && len(history) < limit; index-- {
+		previous := catalog.Entries[index]
+		if previous.Key == entry.Key || !common.IsBackupObject(previous.Key) || previous.Size <= 0 {
+			continue
+		}
+		if (len(previous.Source) > 0 && previous.Source != entry.Source) || (len(previous.Host) > 0 && previous.Host != entry.Host) {
+			continue
+		}
+		history = append(history, previous.Size)
+	}
+	return history
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+func TestSizeAnomaly(t *testing.T) {
+	fmt.Println("Running TestSizeAnomaly...")
+
+	var tests = []struct {
+		size     int64
+		history  []int64
+		expected string
+	}{
+		/* sizes close to the median pass */
+		{1000, []int64{900, 1000, 1100}, ""},
+		{600, []int64{1000, 1000, 1000}, ""},
+		{3900, []int64{1000, 1000, 1000}, ""},
+		/* the median ignores outliers */
+		{1000, []int64{1, 1000, 1100, 1200, 1000000}, ""},
+		/* shrinking backups are reported */
+		{400, []int64{1000, 1000, 1000}, "backup size of 400 bytes is 40% of the median size of the last 3 backups (1000 bytes), check the backup directory for missing data"},
+		{100, []int64{1000, 1200, 800, 1100}, "backup size of 100 bytes is 10% of the median size of the last 4 backups (1050 bytes), check the backup directory for missing data"},
+		/* so are growing ones */
+		{5000, []int64{1000, 1000, 1000}, "backup size of 5000 bytes is 5.0 times the median size of the last 3 backups (1000 bytes)"},
+		/* short histories are not compared */
+		{1, []int64{1000, 1000}, ""},
+		{1, nil, ""},
+	}
+
+	for _, test := range tests {
+		assertEquals(t, test.expected, sizeAnomaly(test.size, test.history, 0.5, 4), fmt.Sprintf("TestSizeAnomaly(%d, %v)", test.size, test.history))
+	}
+
+	/* zero bounds are not checked */
+	assertEquals(t, "", sizeAnomaly(1, []int64{1000, 1000, 1000}, 0, 4), "TestSizeAnomaly.minFraction")
+	assertEquals(t, "", sizeAnomaly(100000, []int64{1000, 1000, 1000}, 0.5, 0), "TestSizeAnomaly.maxMultiple")
+}
+
+func TestSizeHistory(t *testing.T) {
+	fmt.Println("Running TestSizeHistory...")
+
+	// Setup Test
+	catalog := &backupCatalog{Entries: []catalogEntry{
+		{Key: "1.tar.gz", Source: "/data", Host: "host", Size: 100},
+		{Key: "2.tar.gz", Source: "/other", Host: "host", Size: 200},
+		{Key: "3.tar.gz", Source: "/data", Host: "other", Size: 300},
+		{Key: "4.tar.gz", Size: 400},
+		{Key: catalogObjectName, Size: 500},
+		{Key: "6.tar.gz", Source: "/data", Host: "host", Size: 600},
+		{Key: "7.tar.gz", Source: "/data", Host: "host", Size: 700},
+	}}
+	entry := &catalogEntry{Key: "7.tar.gz", Source: "/data", Host: "host"}
+
+	// Perform the test
+	assertEquals(t, "[600 400 100]", fmt.Sprint(sizeHistory(catalog, entry, 5)), "TestSizeHistory.history")
+	assertEquals(t, "[600 400]", fmt.Sprint(sizeHistory(catalog, entry, 2)), "TestSizeHistory.limit")
+}
+
+func TestMainSizeAnomaly(t *testing.T) {
+	fmt.Println("Running TestMainSizeAnomaly...")
+
+	// Setup Test
+	memory := common.NewMemoryBackend()
+	setupBackend(t, memory, map[string]string{
+		"SQUIRRELUP_BACKUP_HOURS":        "0",
+		"SQUIRRELUP_BACKUP_SIZE_HISTORY": "3",
+	})
+
+	srcDir := t.TempDir()
+	data := make([]byte, 64*1024)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatalf("could not generate data: %s", err.Error())
+	}
+	writeData := func(size int) {
+		if err := os.WriteFile(filepath.Join(srcDir, "file"), data[:size], 0600); err != nil {
+			t.Fatalf("could not write to temporary file: %s", err.Error())
+		}
+	}
+	backup := func(day int) error {
+		timestamp := fmt.Sprintf("2024-05-%02dT03:00:00Z", day)
+		var stdout, stderr bytes.Buffer
+		return run([]string{appname, "--timestamp", timestamp, srcDir, "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	}
+
+	/* backups of similar sizes build the history */
+	writeData(len(data))
+	for day := 1; day <= 3; day++ {
+		assertEquals(t, nil, backup(day), fmt.Sprintf("TestMainSizeAnomaly.backup(%d)", day))
+	}
+	assertEquals(t, nil, backup(4), "TestMainSizeAnomaly.backup(4)")
+
+	/* a backup shrinking sharply is stored with a warning */
+	writeData(len(data) / 8)
+	err := backup(5)
+	var warning *warningError
+	assertEquals(t, true, errors.As(err, &warning), "TestMainSizeAnomaly.warning")
+	assertEquals(t, true, strings.HasPrefix(err.Error(), "warning: backup size of "), "TestMainSizeAnomaly.Error")
+	assertEquals(t, true, strings.Contains(err.Error(), "% of the median size of the last 3 backups ("), "TestMainSizeAnomaly.Error")
+	objectUri, _ := url.ParseRequestURI("dummy://bucket/prefix/2024-05-05T03+0000.tar.gz")
+	_, statErr := memory.GetFileInfo(objectUri)
+	assertEquals(t, nil, statErr, "TestMainSizeAnomaly.stored")
+
+	/* the check can be disabled */
+	t.Setenv("SQUIRRELUP_BACKUP_SIZE_HISTORY", "0")
+	assertEquals(t, nil, backup(6), "TestMainSizeAnomaly.disabled")
+}
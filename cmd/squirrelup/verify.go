@@ -0,0 +1,303 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+type (
+	// verifyResult is the outcome of verifying a single backup.
+	verifyResult struct {
+		entry catalogEntry
+		// number of archive entries read, zero if the contents were not checked
+		entries int
+		err     error
+	}
+
+	// countingWriter passes writes on and adds up their size.
+	countingWriter struct {
+		io.Writer
+		count *int64
+	}
+)
+
+const (
+	// verifyDefaultSample is the number of backups verified by verify-prefix unless --sample is given.
+	verifyDefaultSample = 1
+)
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.Writer.Write(p)
+	*cw.count += int64(n)
+	return n, err
+}
+
+// runVerifyPrefix verifies a sample of the backups stored under a prefix and reports the
+// outcome per backup. Fails if any sampled backup fails verification.
+func runVerifyPrefix(cli_args *cliArgs, stdout, stderr io.Writer) error {
+	var err error
+
+	// process input arguments
+	var sample int = verifyDefaultSample
+	if len(cli_args.Sample) > 0 {
+		sample, err = strconv.Atoi(cli_args.Sample)
+		if err != nil || sample < 1 {
+			return fmt.Errorf("invalid sample size %q, must be a positive integer", cli_args.Sample)
+		}
+	}
+	var seed int64 = common.Now().UnixNano()
+	if len(cli_args.Seed) > 0 {
+		seed, err = strconv.ParseInt(cli_args.Seed, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid seed %q, must be an integer", cli_args.Seed)
+		}
+	}
+	var maxAge time.Duration
+	if len(cli_args.MaxAge) > 0 {
+		maxAge, err = parseMaxAge(cli_args.MaxAge)
+		if err != nil {
+			return fmt.Errorf("%s", err.Error())
+		}
+	}
+
+	backend, prefixUri, keys, _, err := prefixBackend(cli_args, stdout, stderr)
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	}
+
+	/* collect candidates from the catalog, or the prefix contents if there is no catalog */
+	uri, err := catalogUri(prefixUri)
+	if err != nil {
+		return fmt.Errorf("%s", err.Error())
+	}
+	catalog, err := readCatalog(backend, uri, keys)
+	if err != nil {
+		if err.Error() != common.ErrFileNotFound {
+			fmt.Fprintf(stderr, "warning: %s, listing objects instead\n", err.Error())
+		}
+		var filelist []common.FileInfo
+		filelist, err = backend.ListFiles(prefixUri)
+		if err != nil {
+			return fmt.Errorf("could not list remote files: %s", err.Error())
+		}
+		catalog = &backupCatalog{}
+		catalog.reconcile(filelist)
+	}
+	candidates := catalog.Entries
+	if maxAge > 0 {
+		candidates = newerEntries(candidates, common.Now().Add(-maxAge))
+	}
+	if len(candidates) == 0 {
+		return fmt.Errorf("no backups to verify under %q", prefixUri)
+	}
+
+	/* verify the sampled backups one at a time */
+	var identities []age.Identity
+	if keys != nil {
+		identities = keys.identities
+	}
+	selected := sampleEntries(candidates, sample, cli_args.Latest, rand.New(rand.NewSource(seed)))
+	if cli_args.Verbose {
+		fmt.Fprintf(stderr, "verifying %d of %d backups under %q (seed %d)...\n", len(selected), len(candidates), prefixUri, seed)
+	}
+	var results []verifyResult
+	var failed int
+	for _, entry := range selected {
+		result := verifyResult{entry: entry}
+		result.entries, result.err = verifyBackup(backend, common.ResolveObjectURI(prefixUri, entry.Key), entry, identities, stderr)
+		if result.err != nil {
+			failed++
+			fmt.Fprintf(stdout, "FAIL\t%s\t%s\n", entry.Key, result.err.Error())
+		} else {
+			fmt.Fprintf(stdout, "PASS\t%s\n", entry.Key)
+		}
+		results = append(results, result)
+	}
+	fmt.Fprintf(stdout, "verified %d backups under %q: %d passed, %d failed\n", len(results), prefixUri, len(results)-failed, failed)
+
+	if cli_args.Record {
+		if err = recordVerification(backend, prefixUri, results, keys, stderr); err != nil {
+			fmt.Fprintf(stderr, "warning: %s\n", err.Error())
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d sampled backups failed verification", failed, len(results))
+	}
+	return nil
+}
+
+// parseMaxAge parses a duration like time.ParseDuration, with an additional unit 'd' for days.
+func parseMaxAge(value string) (time.Duration, error) {
+	var maxAge time.Duration
+	var err error
+	if days, found := strings.CutSuffix(value, "d"); found {
+		var count float64
+		count, err = strconv.ParseFloat(days, 64)
+		maxAge = time.Duration(count * float64(24*time.Hour))
+	} else {
+		maxAge, err = time.ParseDuration(value)
+	}
+	if err != nil || maxAge <= 0 {
+		return 0, fmt.Errorf("invalid maximum age %q, must be a positive duration like '36h' or '30d'", value)
+	}
+	return maxAge, nil
+}
+
+// newerEntries returns the entries of backups created at or after `since`.
+func newerEntries(entries []catalogEntry, since time.Time) []catalogEntry {
+	var newer []catalogEntry
+	for _, entry := range entries {
+		if !entry.Time.Before(since) {
+			newer = append(newer, entry)
+		}
+	}
+	return newer
+}
+
+// sampleEntries picks `count` entries at random using `rng`. With `latest` the most recent
+// entry is picked in addition to `count` random ones. Entries are returned in their original
+// order, which is the order of backup times for catalog entries.
+func sampleEntries(entries []catalogEntry, count int, latest bool, rng *rand.Rand) []catalogEntry {
+	var picked []int
+	candidates := len(entries)
+	if latest && candidates > 0 {
+		candidates--
+		picked = append(picked, candidates)
+	}
+	picked = append(picked, rng.Perm(candidates)[:min(count, candidates)]...)
+	sort.Ints(picked)
+
+	sampled := make([]catalogEntry, 0, len(picked))
+	for _, index := range picked {
+		sampled = append(sampled, entries[index])
+	}
+	return sampled
+}
+
+// verifyBackup downloads the backup under `uri` and checks its size and checksum against
+// the catalog `entry`, if known. The contents of gzip-compressed TAR archives are read to
+// the end, decrypting age-encrypted archives with `identities`, which checks the integrity
+// of the encryption, the compression and the archive structure. Encrypted archives are only
+// compared against the catalog without identities. Returns the number of archive entries read.
+func verifyBackup(backend common.StorageBackend, uri *url.URL, entry catalogEntry, identities []age.Identity, stderr io.Writer) (int, error) {
+	pipeReader, writer := io.Pipe()
+	defer pipeReader.Close()
+	go func() {
+		writer.CloseWithError(backend.RetrieveFile(writer, uri))
+	}()
+
+	// the checksum covers the object as stored
+	hash := sha256.New()
+	var size int64
+	raw := bufio.NewReader(io.TeeReader(pipeReader, &countingWriter{hash, &size}))
+
+	var entries int
+	var err error
+	archived := strings.HasSuffix(strings.TrimSuffix(entry.Key, ageFileSuffix), ".tar.gz")
+	if archived {
+		var contents io.Reader = raw
+		if common.SniffEncryption(raw, entry.Key, stderr) {
+			if len(identities) == 0 {
+				contents = nil
+			} else if contents, err = common.DecryptStream(raw, identities); err != nil {
+				return 0, fmt.Errorf("could not decrypt backup: %s", err.Error())
+			}
+		}
+		if contents != nil {
+			entries, err = readArchive(contents, stderr)
+			if err != nil {
+				return entries, err
+			}
+		}
+	}
+
+	// read what is left, e.g. of objects whose contents are not checked
+	if _, err = io.Copy(io.Discard, raw); err != nil {
+		return entries, fmt.Errorf("could not download backup: %s", err.Error())
+	}
+	if entry.Size > 0 && size != entry.Size {
+		return entries, fmt.Errorf("size mismatch: catalog records %d bytes, got %d", entry.Size, size)
+	}
+	if checksum := hex.EncodeToString(hash.Sum(nil)); len(entry.Checksum) > 0 && checksum != entry.Checksum {
+		return entries, fmt.Errorf("checksum mismatch: catalog records %s, got %s", entry.Checksum, checksum)
+	}
+	return entries, nil
+}
+
+// readArchive reads a gzip-compressed TAR archive to the end. Returns the number of entries,
+// not counting the archive metadata, whose warnings are written to `stderr`.
+func readArchive(input io.Reader, stderr io.Writer) (int, error) {
+	gz, err := gzip.NewReader(input)
+	if err != nil {
+		return 0, fmt.Errorf("could not decompress archive: %s", err.Error())
+	}
+	var entries int
+	var header *tar.Header
+	reader := tar.NewReader(gz)
+	for first := true; ; first = false {
+		header, err = reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return entries, fmt.Errorf("could not read archive entry %d: %s", entries+1, err.Error())
+		}
+		// the archive metadata is only recognized as the first entry and not counted
+		metadata := first && header.Name == common.ArchiveMetadataName
+		if metadata {
+			warnArchiveMetadata(reader, stderr)
+		}
+		if _, err = io.Copy(io.Discard, reader); err != nil {
+			return entries, fmt.Errorf("could not read archive entry %d: %s", entries+1, err.Error())
+		}
+		if !metadata {
+			entries++
+		}
+	}
+	// the checksum of the compressed stream is verified at its end
+	if _, err = io.Copy(io.Discard, gz); err != nil {
+		return entries, fmt.Errorf("could not decompress archive: %s", err.Error())
+	}
+	// the last chunk of an encrypted stream is authenticated at its end
+	if _, err = io.Copy(io.Discard, input); err != nil {
+		return entries, fmt.Errorf("could not read archive: %s", err.Error())
+	}
+	return entries, nil
+}
+
+// recordVerification stores the outcome of `results` in the catalog under the prefix. Backups
+// missing from the catalog are added along with their outcome.
+func recordVerification(backend common.StorageBackend, prefixUri *url.URL, results []verifyResult, keys *auxiliaryKeys, stderr io.Writer) error {
+	verified := common.Now().UTC()
+	return modifyCatalog(backend, prefixUri, keys, stderr, func(catalog *backupCatalog) {
+		for _, result := range results {
+			outcome := &catalogVerification{Time: verified, Passed: result.err == nil}
+			if result.err != nil {
+				outcome.Error = result.err.Error()
+			}
+			index := slices.IndexFunc(catalog.Entries, func(entry catalogEntry) bool { return entry.Key == result.entry.Key })
+			if index < 0 {
+				entry := result.entry
+				entry.Verified = outcome
+				catalog.add(entry)
+			} else {
+				catalog.Entries[index].Verified = outcome
+			}
+		}
+	})
+}
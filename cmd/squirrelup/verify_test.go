@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+// helper function: store encrypted backups of the current directory at `timestamps` and
+// configure the identity to read them back.
+func setupVerify(t *testing.T, timestamps []string) *common.MemoryBackend {
+	memory := setupCatalog(t)
+	identity, _ := age.GenerateX25519Identity()
+	os.Setenv("SQUIRRELUP_PUBKEY", identity.Recipient().String())
+	os.Setenv("SQUIRRELUP_IDENTITY", identity.String())
+	t.Cleanup(func() {
+		os.Setenv("SQUIRRELUP_PUBKEY", "")
+		os.Setenv("SQUIRRELUP_IDENTITY", "")
+	})
+
+	var stdout, stderr bytes.Buffer
+	for _, timestamp := range timestamps {
+		err := run([]string{appname, "--timestamp", timestamp, ".", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+		if err != nil {
+			t.Fatalf("could not create backup: %s", err.Error())
+		}
+	}
+	return memory
+}
+
+func TestParseMaxAge(t *testing.T) {
+	fmt.Println("Running TestParseMaxAge...")
+
+	for value, expected := range map[string]time.Duration{"30d": 30 * 24 * time.Hour, "1.5d": 36 * time.Hour, "90m": 90 * time.Minute} {
+		maxAge, err := parseMaxAge(value)
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		assertEquals(t, expected, maxAge, "TestParseMaxAge."+value)
+	}
+
+	for _, value := range []string{"", "d", "30", "-1d", "0h", "week"} {
+		_, err := parseMaxAge(value)
+		assertEquals(t, fmt.Sprintf("invalid maximum age %q, must be a positive duration like '36h' or '30d'", value), fmt.Sprintf("%v", err), "TestParseMaxAge.err")
+	}
+}
+
+func TestSampleEntries(t *testing.T) {
+	fmt.Println("Running TestSampleEntries...")
+
+	// Setup Test
+	var entries []catalogEntry
+	for index := 0; index < 10; index++ {
+		entries = append(entries, catalogEntry{Key: fmt.Sprintf("%02d.tar.gz", index)})
+	}
+	keys := func(sampled []catalogEntry) string {
+		var names []string
+		for _, entry := range sampled {
+			names = append(names, strings.TrimSuffix(entry.Key, ".tar.gz"))
+		}
+		return strings.Join(names, ",")
+	}
+
+	/* the same seed picks the same entries, in their original order */
+	sampled := keys(sampleEntries(entries, 3, false, rand.New(rand.NewSource(42))))
+	assertEquals(t, sampled, keys(sampleEntries(entries, 3, false, rand.New(rand.NewSource(42)))), "TestSampleEntries.seed")
+	assertEquals(t, 8, len(sampled), "TestSampleEntries.len(sampled)")
+	assertEquals(t, true, sampled[0:2] < sampled[3:5] && sampled[3:5] < sampled[6:8], "TestSampleEntries.order")
+
+	/* the latest entry is picked in addition to the sample */
+	for seed := int64(0); seed < 10; seed++ {
+		sampled = keys(sampleEntries(entries, 2, true, rand.New(rand.NewSource(seed))))
+		assertEquals(t, 8, len(sampled), "TestSampleEntries.len(sampled)")
+		assertEquals(t, true, strings.HasSuffix(sampled, ",09"), "TestSampleEntries.latest")
+		assertEquals(t, false, strings.HasPrefix(sampled, "09"), "TestSampleEntries.latest")
+	}
+
+	/* samples larger than the candidates pick every entry */
+	assertEquals(t, "00,01,02,03,04,05,06,07,08,09", keys(sampleEntries(entries, 20, true, rand.New(rand.NewSource(1)))), "TestSampleEntries.all")
+	assertEquals(t, "", keys(sampleEntries(nil, 3, true, rand.New(rand.NewSource(1)))), "TestSampleEntries.empty")
+}
+
+func TestVerifyPrefixRun(t *testing.T) {
+	fmt.Println("Running TestVerifyPrefixRun...")
+
+	// Setup Test
+	memory := setupVerify(t, []string{"2024-05-01T00:00:00Z", "2024-05-01T01:00:00Z", "2024-05-01T02:00:00Z"})
+	var stdout, stderr bytes.Buffer
+
+	// Perform the test
+	err := run([]string{appname, "verify-prefix", "--sample", "3", "--record", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "PASS\t2024-05-01T00+0000.tar.gz.age\nPASS\t2024-05-01T01+0000.tar.gz.age\nPASS\t2024-05-01T02+0000.tar.gz.age\n"+
+		"verified 3 backups under \"dummy://bucket/prefix/\": 3 passed, 0 failed\n", stdout.String(), "TestVerifyPrefixRun.stdout")
+
+	/* list shows the recorded outcome */
+	stdout.Reset()
+	err = run([]string{appname, "list", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 3, strings.Count(stdout.String(), "\tverified 2024-05-01T03:00:00Z passed\n"), "TestVerifyPrefixRun.list")
+
+	/* a corrupted backup fails verification */
+	objectUri, _ := url.ParseRequestURI("dummy://bucket/prefix/2024-05-01T01+0000.tar.gz.age")
+	var buf bytes.Buffer
+	if err := memory.RetrieveFile(&buf, objectUri); err != nil {
+		t.Fatalf("could not retrieve file: %s", err.Error())
+	}
+	data := buf.Bytes()
+	data[len(data)-1] ^= 0xff
+	if err := memory.StoreFile(context.Background(), common.StoreRequest{URI: objectUri, BodyAt: bytes.NewReader(data), Length: int64(len(data))}); err != nil {
+		t.Fatalf("could not store file: %s", err.Error())
+	}
+	stdout.Reset()
+	err = run([]string{appname, "verify-prefix", "--sample=5", "--record", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	assertEquals(t, "1 of 3 sampled backups failed verification", fmt.Sprintf("%v", err), "TestVerifyPrefixRun.err")
+	assertEquals(t, true, strings.Contains(stdout.String(), "FAIL\t2024-05-01T01+0000.tar.gz.age\tcould not read archive"), "TestVerifyPrefixRun.stdout")
+	assertEquals(t, true, strings.Contains(stdout.String(), common.ErrTruncatedCiphertext), "TestVerifyPrefixRun.stdout")
+	assertEquals(t, true, strings.HasSuffix(stdout.String(), ": 2 passed, 1 failed\n"), "TestVerifyPrefixRun.stdout")
+
+	stdout.Reset()
+	err = run([]string{appname, "list", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, strings.Contains(stdout.String(), "\t2024-05-01T01+0000.tar.gz.age\tverified 2024-05-01T03:00:00Z failed\n"), "TestVerifyPrefixRun.list")
+
+	/* only recent backups are sampled, the latest is always included */
+	stdout.Reset()
+	err = run([]string{appname, "verify-prefix", "--max-age", "90m", "--latest", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "PASS\t2024-05-01T02+0000.tar.gz.age\nverified 1 backups under \"dummy://bucket/prefix/\": 1 passed, 0 failed\n", stdout.String(), "TestVerifyPrefixRun.stdout")
+}
+
+func TestVerifyPrefixChecksum(t *testing.T) {
+	fmt.Println("Running TestVerifyPrefixChecksum...")
+
+	// Setup Test
+	memory := setupVerify(t, []string{"2024-05-01T00:00:00Z"})
+	os.Setenv("SQUIRRELUP_IDENTITY", "")
+	prefixUri, _ := url.ParseRequestURI("dummy://bucket/prefix/")
+	catalogObjectUri, _ := catalogUri(prefixUri)
+	var stdout, stderr bytes.Buffer
+
+	/* without identities the catalog is plaintext for this test and only the checksum is compared */
+	catalog := &backupCatalog{Entries: []catalogEntry{{Key: "2024-05-01T00+0000.tar.gz.age", Time: common.Now(), Checksum: "0123"}}}
+	if err := storeCatalog(memory, catalogObjectUri, catalog, nil); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	// Perform the test
+	err := run([]string{appname, "verify-prefix", "dummy://bucket/prefix/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+	assertEquals(t, "1 of 1 sampled backups failed verification", fmt.Sprintf("%v", err), "TestVerifyPrefixChecksum.err")
+	assertEquals(t, true, strings.HasPrefix(stdout.String(), "FAIL\t2024-05-01T00+0000.tar.gz.age\tchecksum mismatch: catalog records 0123, got "), "TestVerifyPrefixChecksum.stdout")
+}
+
+func TestVerifyPrefixErrors(t *testing.T) {
+	fmt.Println("Running TestVerifyPrefixErrors...")
+
+	// Setup Test
+	setupCatalog(t)
+	var stdout, stderr bytes.Buffer
+
+	// Perform the test
+	for args, expected := range map[string]string{
+		"--sample 0":     `invalid sample size "0", must be a positive integer`,
+		"--sample many":  `invalid sample size "many", must be a positive integer`,
+		"--seed x":       `invalid seed "x", must be an integer`,
+		"--max-age 30":   `invalid maximum age "30", must be a positive duration like '36h' or '30d'`,
+		"--max-age 365d": `no backups to verify under "dummy://bucket/prefix/"`,
+	} {
+		cmdline := append([]string{appname, "verify-prefix"}, strings.Fields(args)...)
+		err := run(append(cmdline, "dummy://bucket/prefix/"), nil, io.Writer(&stdout), io.Writer(&stderr))
+		assertEquals(t, expected, fmt.Sprintf("%v", err), "TestVerifyPrefixErrors.err")
+	}
+}
+
+func TestVerifyReadArchiveMetadata(t *testing.T) {
+	fmt.Println("Running TestVerifyReadArchiveMetadata...")
+
+	// Setup Test
+	srcDir := t.TempDir()
+	if err := os.WriteFile(srcDir+"/file.txt", []byte("test content"), 0600); err != nil {
+		t.Fatalf("could not write file: %s", err.Error())
+	}
+	var cfg common.Config
+	version = "1.0.0"
+	defer func() { version = "" }()
+
+	// Perform the test
+	var counts []int
+	for _, metadata := range []*common.ArchiveMetadata{nil, common.NewArchiveMetadata(&cfg, "2.0.0", "")} {
+		archivePath, _, err := common.ArchiveDirectory(context.Background(), srcDir, &cfg, common.ArchiveFilter{Metadata: metadata})
+		if err != nil {
+			t.Fatalf("could not archive directory: %s", err.Error())
+		}
+		defer os.Remove(archivePath)
+		input, err := os.Open(archivePath)
+		if err != nil {
+			t.Fatalf("could not open archive: %s", err.Error())
+		}
+		defer input.Close()
+
+		var stderr bytes.Buffer
+		entries, err := readArchive(input, &stderr)
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		counts = append(counts, entries)
+		if metadata != nil {
+			assertEquals(t, "warning: archive was created by SquirrelUp 2.0.0, which is newer than this version 1.0.0\n", stderr.String(), "TestVerifyReadArchiveMetadata.stderr")
+		} else {
+			assertEquals(t, "", stderr.String(), "TestVerifyReadArchiveMetadata.stderr")
+		}
+	}
+	/* the metadata entry is not counted */
+	assertEquals(t, counts[0], counts[1], "TestVerifyReadArchiveMetadata.entries")
+}
+
+func TestVerifyPrefixSpecialCharacters(t *testing.T) {
+	fmt.Println("Running TestVerifyPrefixSpecialCharacters...")
+
+	// Setup Test
+	os.Setenv("SQUIRRELUP_BACKUP_FILENAME", "2006-01-02T15 Sicherung #ü %+")
+	t.Cleanup(func() { os.Setenv("SQUIRRELUP_BACKUP_FILENAME", "") })
+	memory := setupCatalog(t)
+	identity, _ := age.GenerateX25519Identity()
+	os.Setenv("SQUIRRELUP_PUBKEY", identity.Recipient().String())
+	os.Setenv("SQUIRRELUP_IDENTITY", identity.String())
+	t.Cleanup(func() {
+		os.Setenv("SQUIRRELUP_PUBKEY", "")
+		os.Setenv("SQUIRRELUP_IDENTITY", "")
+	})
+	var stdout, stderr bytes.Buffer
+	for _, timestamp := range []string{"2024-05-01T00:00:00Z", "2024-05-01T01:00:00Z"} {
+		err := run([]string{appname, "--timestamp", timestamp, ".", "dummy://bucket/Datenbank Sicherung/ü/"}, nil, io.Writer(&stdout), io.Writer(&stderr))
+		if err != nil {
+			t.Fatalf("could not create backup: %s", err.Error())
+		}
+	}
+
+	/* keys hold the decoded prefix and the backup name as they are */
+	prefixUri, _ := url.ParseRequestURI("dummy://bucket/Datenbank%20Sicherung/%C3%BC/")
+	filelist, _ := memory.ListFiles(prefixUri)
+	var keys []string
+	for _, fileinfo := range filelist {
+		keys = append(keys, fileinfo.Name())
+	}
+	assertEquals(t, true, strings.Contains(strings.Join(keys, "\n"), "Datenbank Sicherung/ü/2024-05-01T00 Sicherung #ü %+.tar.gz.age\n"), "TestVerifyPrefixSpecialCharacters.keys")
+	assertEquals(t, true, strings.Contains(stdout.String(), `to "dummy://bucket/Datenbank%20Sicherung/%C3%BC/2024-05-01T01%20Sicherung%20%23%C3%BC%20%25+.tar.gz.age"`), "TestVerifyPrefixSpecialCharacters.stdout")
+
+	// Perform the test
+	/* catalog entries address the stored objects, whether the prefix is given encoded or not */
+	for _, prefix := range []string{"dummy://bucket/Datenbank Sicherung/ü/", prefixUri.String()} {
+		stdout.Reset()
+		err := run([]string{appname, "verify-prefix", "--sample", "2", prefix}, nil, io.Writer(&stdout), io.Writer(&stderr))
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		assertEquals(t, "PASS\t2024-05-01T00 Sicherung #ü %+.tar.gz.age\nPASS\t2024-05-01T01 Sicherung #ü %+.tar.gz.age\n"+
+			fmt.Sprintf("verified 2 backups under %q: 2 passed, 0 failed\n", prefixUri), stdout.String(), "TestVerifyPrefixSpecialCharacters.stdout")
+	}
+}
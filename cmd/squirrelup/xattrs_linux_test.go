@@ -0,0 +1,80 @@
+//go:build linux
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+func TestExtractXattrs(t *testing.T) {
+	fmt.Println("Running TestExtractXattrs...")
+
+	// Setup Test
+	srcDir := filepath.Join(t.TempDir(), "data")
+	if err := os.Mkdir(srcDir, 0750); err != nil {
+		t.Fatalf("could not create directory: %s", err.Error())
+	}
+	filePath := filepath.Join(srcDir, "file.txt")
+	if err := os.WriteFile(filePath, []byte("test content"), 0640); err != nil {
+		t.Fatalf("could not write file: %s", err.Error())
+	}
+	if err := unix.Lsetxattr(filePath, "user.squirrelup.label", []byte("blue"), 0); err != nil {
+		t.Skipf("could not set extended attribute: %s", err.Error())
+	}
+	var cfg common.Config
+	cfg.Backup.Xattrs = true
+	cfg.Backup.Owner = "4242"
+	filter, err := newArchiveFilter(srcDir, &cfg)
+	if err != nil {
+		t.Fatalf("could not create archive filter: %s", err.Error())
+	}
+	archivePath, _, err := common.ArchiveDirectory(context.Background(), srcDir, &cfg, filter)
+	if err != nil {
+		t.Fatalf("could not archive directory: %s", err.Error())
+	}
+	defer os.Remove(archivePath)
+
+	// Perform the test
+	/* extended attributes are restored along with normalized ownership */
+	var report bytes.Buffer
+	outDir := t.TempDir()
+	options := &extractOptions{restoreOwner: restoreOwnerPreserve, preservePerms: true, report: &report}
+	if _, err = decryptFile(archivePath, outDir, nil, options, &cfg, io.Discard); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	value := make([]byte, 16)
+	size, err := unix.Lgetxattr(filepath.Join(outDir, "data", "file.txt"), "user.squirrelup.label", value)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "blue", string(value[:size]), "TestExtractXattrs.label")
+	assertEquals(t, "", report.String(), "TestExtractXattrs.report")
+	if os.Geteuid() == 0 {
+		info, _ := os.Stat(filepath.Join(outDir, "data", "file.txt"))
+		assertEquals(t, uint32(4242), info.Sys().(*syscall.Stat_t).Uid, "TestExtractXattrs.owner")
+	}
+
+	/* attributes that cannot be set are reported, the entry is restored anyway */
+	archivePath = writeTarArchive(t, []*tar.Header{
+		{Name: "other.txt", Typeflag: tar.TypeReg, Mode: 0600, PAXRecords: map[string]string{"SCHILY.xattr.bogus.name": "value"}},
+	}, false)
+	report.Reset()
+	options = &extractOptions{restoreOwner: restoreOwnerSkip, preservePerms: true, report: &report}
+	if _, err = decryptFile(archivePath, outDir, nil, options, &cfg, io.Discard); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "warning: could not restore extended attribute of \"other.txt\": bogus.name: operation not supported\n", report.String(), "TestExtractXattrs.report")
+	assertEquals(t, 1, options.restored, "TestExtractXattrs.restored")
+}
@@ -1,14 +1,29 @@
 package common
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"net"
+	"net/http"
 	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
@@ -19,18 +34,61 @@ import (
 )
 
 // B2Backend is struct that holds active B2 session.
+//
+// A B2Backend may be used by multiple goroutines simultaneously. Its fields are not
+// modified after construction, every call keeps its transfer state local and uploads
+// in progress are tracked in a sync.Map. The progress reporter must be safe for
+// concurrent use, as MultiProgressbarReporter is.
+//
+// Parts of multipart uploads are retried by the B2Backend itself, beneath the retries of
+// whole requests by a RetryingBackend wrapping it if retry.max_attempts is set.
 type (
 	B2Backend struct {
 		s3iface.S3API
-		pr ProgressReporter
+		pr           ProgressReporter
+		maxDownloads int
+		recoveryDir  string
+		pending      *sync.Map
+		partSize     int64
+		maxPartSize  int64
+		// number of parts of a multipart upload held in memory and uploaded at once, parts
+		// are streamed from the input and read twice if zero
+		bufferedParts int
+		// size of buffers used to copy downloaded data, the default size if zero
+		bufferSize int
+		// mode of recovery files
+		fileMode fs.FileMode
+		// remove all versions of objects rather than hiding them with a delete marker
+		deleteAllVersions bool
+		// waits before retrying a failed request, defaults to sleeping
+		wait func(time.Duration)
+		// cancels an upload attempt of a part that is not read for this long while it is
+		// being sent, or a download not receiving data for this long, zero disables stall
+		// detection
+		stallTimeout time.Duration
+		// returns a channel receiving the time once the duration passed, defaults to time.After
+		after func(time.Duration) <-chan time.Time
 	}
 
 	progressSectionReader struct {
-		sr    *io.SectionReader
+		sr    io.ReadSeeker
+		size  int64
 		pr    ProgressReporter
 		part  string
 		index int
 		read  int64
+		// aggregate progress of a multipart upload, advanced by the bytes read for uploading
+		summary *uploadSummary
+		// bytes read by the current upload attempt and how many of them were read for
+		// signing, -1 until signing is done, see startAttempt
+		attemptRead   atomic.Int64
+		attemptSigned atomic.Int64
+	}
+
+	// downloadReader counts the bytes read from the body of a download for watchStall.
+	downloadReader struct {
+		io.Reader
+		read atomic.Int64
 	}
 
 	partUploadResult struct {
@@ -39,6 +97,19 @@ type (
 	}
 
 	byPartNum []*s3.CompletedPart
+
+	// uploadRecovery holds the state required to complete a multipart upload
+	// whose parts were uploaded successfully.
+	uploadRecovery struct {
+		Uri      string               `json:"uri"`
+		UploadId string               `json:"upload_id"`
+		Parts    []uploadRecoveryPart `json:"parts"`
+	}
+
+	uploadRecoveryPart struct {
+		PartNumber int64  `json:"part_number"`
+		ETag       string `json:"etag"`
+	}
 )
 
 const (
@@ -46,23 +117,50 @@ const (
 	multipart_upload_wait_seconds  = 5
 	multipart_upload_max_attempts  = 5
 	multipart_upload_max_concurent = 4
+	multipart_upload_max_parts     = 10000
+	multipart_upload_min_part_size = 5 * 1024 * 1024
+	// size of the largest object copied by a single CopyObject request, larger objects are
+	// copied in parts
+	copy_object_max_size = 5 * 1024 * 1024 * 1024
+	// number of checks for progress of a part upload per stall timeout
+	stall_check_intervals = 4
+	// kind of state stored in recovery files
+	upload_recovery_kind = "upload-recovery"
+	// endpoint of B2 used unless s3.endpoint or s3.endpoint_template is configured
+	b2_endpoint_template = "https://s3.{region}.backblazeb2.com"
 )
 
 var (
 	checkS3Client func(*s3.S3)
-
-	waitfunc func(time.Duration) = func(seconds time.Duration) {
-		time.Sleep(time.Duration(time.Second * seconds))
-	}
+	// ETags holding the MD5 digest of an object, followed by the number of parts of objects
+	// uploaded in parts
+	etag_pattern = regexp.MustCompile(`^([0-9a-fA-F]{32})(?:-([0-9]+))?$`)
 )
 
+// sleepSeconds is the default wait function of a B2Backend.
+func sleepSeconds(seconds time.Duration) {
+	time.Sleep(time.Duration(time.Second * seconds))
+}
+
 // NewReader return a new Reader with a given progress bar.
 func newProgressSectionReader(sr *io.SectionReader, pr ProgressReporter, partNumber int) *progressSectionReader {
+	return newProgressReader(sr, sr.Size(), pr, partNumber)
+}
+
+// newProgressPartReader returns a new Reader of a buffered part with a given progress bar.
+func newProgressPartReader(bp *bufferedPart, pr ProgressReporter, partNumber int) *progressSectionReader {
+	return newProgressReader(bp, bp.Size(), pr, partNumber)
+}
+
+// newProgressReader returns a new Reader of `size` bytes from `sr` with a given progress bar.
+func newProgressReader(sr io.ReadSeeker, size int64, pr ProgressReporter, partNumber int) *progressSectionReader {
 	var index int = 0
 	var part string = ""
 
-	if pr != nil {
-		index, _ = pr.CreateFileTask(sr.Size() * 2)
+	if !ProgressEnabled(pr) {
+		pr = nil
+	} else {
+		index, _ = pr.CreateFileTask(size * 2)
 		if partNumber > 0 {
 			part = fmt.Sprintf(" part #%d", partNumber)
 		}
@@ -70,6 +168,7 @@ func newProgressSectionReader(sr *io.SectionReader, pr ProgressReporter, partNum
 
 	return &progressSectionReader{
 		sr:    sr,
+		size:  size,
 		pr:    pr,
 		part:  part,
 		index: index,
@@ -80,16 +179,23 @@ func newProgressSectionReader(sr *io.SectionReader, pr ProgressReporter, partNum
 // Read will read the data and add the number of bytes to the progressbar for sgnign and uploading.
 func (psr *progressSectionReader) Read(p []byte) (n int, err error) {
 	n, err = psr.sr.Read(p)
+	if read := psr.attemptRead.Add(int64(n)); read >= psr.size {
+		// the SDK reads parts without checksums once to sign them before sending them
+		psr.attemptSigned.CompareAndSwap(-1, psr.size)
+	}
 
 	if psr.pr != nil {
 		if psr.read == 0 {
 			_ = psr.pr.DescribeTask(psr.index, "signing"+psr.part)
 		}
 
+		// bytes read after signing are uploaded, those read again by retries are not counted
+		previous := max(psr.read, psr.size)
 		psr.read += int64(n)
 		_ = psr.pr.AdvanceTask(psr.index, int64(n))
+		psr.summary.advance(min(psr.read, 2*psr.size) - previous)
 
-		if psr.read == psr.sr.Size() {
+		if psr.read == psr.size {
 			_ = psr.pr.DescribeTask(psr.index, "uploading"+psr.part)
 		}
 	}
@@ -102,34 +208,306 @@ func (psr *progressSectionReader) Seek(offset int64, whence int) (int64, error)
 	return psr.sr.Seek(offset, whence)
 }
 
+// checksums forwards the call to a buffered part, reading it counts as signing. The checksums
+// of streamed parts are not known, empty strings are returned for these.
+func (psr *progressSectionReader) checksums() (string, string, error) {
+	part, ok := psr.sr.(partChecksummer)
+	if !ok {
+		return "", "", nil
+	}
+	if psr.pr != nil && psr.read == 0 {
+		_ = psr.pr.DescribeTask(psr.index, "signing"+psr.part)
+	}
+	md5sum, sha256sum, err := part.checksums()
+	if err == nil {
+		// parts with checksums are sent without being read for signing
+		psr.attemptSigned.CompareAndSwap(-1, psr.attemptRead.Load())
+	}
+	if err == nil && psr.pr != nil && psr.read == 0 {
+		psr.read = psr.size
+		_ = psr.pr.AdvanceTask(psr.index, psr.size)
+		_ = psr.pr.DescribeTask(psr.index, "uploading"+psr.part)
+	}
+	return md5sum, sha256sum, err
+}
+
+// startAttempt resets the stall detection state before the part is sent again.
+func (psr *progressSectionReader) startAttempt() {
+	psr.attemptRead.Store(0)
+	psr.attemptSigned.Store(-1)
+}
+
+// sending returns the number of bytes read by the current upload attempt and whether the
+// part is being sent, that is it was signed but not read completely yet.
+func (psr *progressSectionReader) sending() (int64, bool) {
+	read, signed := psr.attemptRead.Load(), psr.attemptSigned.Load()
+	return read, signed >= 0 && read-signed < psr.size
+}
+
+// describeRetry reports that the part is sent again, `attempt` counts from zero.
+func (psr *progressSectionReader) describeRetry(attempt int, stalled bool) {
+	if psr.pr == nil {
+		return
+	}
+	var reason string = "failed"
+	if stalled {
+		reason = "stalled"
+	}
+	_ = psr.pr.DescribeTask(psr.index, fmt.Sprintf("retrying%s after it %s, attempt %d of %d", psr.part, reason, attempt+1, multipart_upload_max_attempts))
+}
+
+// Read the download body by forwarding the call and count the bytes read.
+func (dr *downloadReader) Read(p []byte) (int, error) {
+	n, err := dr.Reader.Read(p)
+	dr.read.Add(int64(n))
+	return n, err
+}
+
+// progress returns the number of bytes read, a download is in progress until it is done.
+func (dr *downloadReader) progress() (int64, bool) {
+	return dr.read.Load(), true
+}
+
+// ParseProxyURL parses an explicitly configured proxy URL. Credentials for proxies
+// requiring basic authentication can be embedded in the URL.
+func ParseProxyURL(proxyURL string) (*url.URL, error) {
+	uri, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %s", err.Error())
+	}
+	switch uri.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("invalid proxy URL %q: unsupported scheme %q", uri.Redacted(), uri.Scheme)
+	}
+	if len(uri.Host) == 0 {
+		return nil, fmt.Errorf("invalid proxy URL %q: missing host", uri.Redacted())
+	}
+	return uri, nil
+}
+
+// parseEndpointURL parses an explicitly configured endpoint of an S3-compatible service, e.g.
+// 'http://localhost:9000' for a local MinIO server.
+func parseEndpointURL(endpoint string) (*url.URL, error) {
+	uri, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint URL: %s", err.Error())
+	}
+	if uri.Scheme != "http" && uri.Scheme != "https" {
+		return nil, fmt.Errorf("invalid endpoint URL %q: unsupported scheme %q", uri.Redacted(), uri.Scheme)
+	}
+	if len(uri.Host) == 0 {
+		return nil, fmt.Errorf("invalid endpoint URL %q: missing host", uri.Redacted())
+	}
+	return uri, nil
+}
+
+// b2Endpoint returns the endpoint requests are sent to: the configured endpoint, otherwise the
+// endpoint template with {region} replaced by the configured region, otherwise the B2 endpoint
+// of the configured region.
+func b2Endpoint(cfg *Config) string {
+	if len(cfg.S3.Endpoint) > 0 {
+		return strings.TrimSuffix(cfg.S3.Endpoint, "/")
+	}
+	template := cfg.S3.EndpointTemplate
+	if len(template) == 0 {
+		template = b2_endpoint_template
+	}
+	return strings.TrimSuffix(strings.ReplaceAll(template, "{region}", cfg.S3.Region), "/")
+}
+
+// bypassProxy returns true if `host` matches an entry of the NO_PROXY list.
+func bypassProxy(host string, noProxy string) bool {
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if len(entry) == 0 {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if name, _, err := net.SplitHostPort(entry); err == nil {
+			entry = name
+		}
+		// ".example.com" only matches subdomains, "example.com" matches the domain as well
+		entry = strings.TrimPrefix(entry, "*")
+		if strings.HasPrefix(entry, ".") {
+			if strings.HasSuffix(host, entry) {
+				return true
+			}
+		} else if host == entry || strings.HasSuffix(host, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+// b2Proxy returns the proxy function of the B2 HTTP client. An explicitly configured
+// proxy URL takes precedence over HTTPS_PROXY and HTTP_PROXY, hosts listed in NO_PROXY
+// are reached directly in either case.
+func b2Proxy(cfg *Config) func(*http.Request) (*url.URL, error) {
+	if len(cfg.S3.ProxyURL) == 0 {
+		return http.ProxyFromEnvironment
+	}
+	proxyURL, err := ParseProxyURL(cfg.S3.ProxyURL)
+	return func(req *http.Request) (*url.URL, error) {
+		if err != nil {
+			return nil, err
+		}
+		noProxy := os.Getenv("NO_PROXY")
+		if len(noProxy) == 0 {
+			noProxy = os.Getenv("no_proxy")
+		}
+		if bypassProxy(req.URL.Host, noProxy) {
+			return nil, nil
+		}
+		return proxyURL, nil
+	}
+}
+
+// newB2HTTPClient returns an HTTP client honoring the configured timeouts, so that
+// requests stuck on a dead connection fail and get retried. Zero disables a timeout. The
+// request timeout bounds the wait for response headers only, bodies of downloads may take
+// as long as they keep making progress, see watchStall.
+func newB2HTTPClient(cfg *Config) *http.Client {
+	connectTimeout := time.Duration(cfg.S3.ConnectTimeoutSeconds * float64(time.Second))
+	maxIdleConns := int(cfg.S3.MaxIdleConns)
+	if maxIdleConns < 0 {
+		maxIdleConns = 0
+	}
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy: b2Proxy(cfg),
+			DialContext: (&net.Dialer{
+				Timeout:   connectTimeout,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			TLSHandshakeTimeout:   connectTimeout,
+			ResponseHeaderTimeout: time.Duration(cfg.S3.RequestTimeoutSeconds * float64(time.Second)),
+			MaxIdleConns:          maxIdleConns,
+			MaxIdleConnsPerHost:   maxIdleConns,
+			IdleConnTimeout:       90 * time.Second,
+			ExpectContinueTimeout: time.Second,
+		},
+	}
+}
+
 // CreateB2Backend is the B2Backend factory function.
 func CreateB2Backend(cfg *Config) *B2Backend {
 	s3Client := s3.New(session.Must(session.NewSession(&aws.Config{
 		Credentials:      credentials.NewStaticCredentials(cfg.S3.ID, cfg.S3.Secret, cfg.S3.Token),
-		Endpoint:         aws.String(fmt.Sprintf("https://s3.%s.backblazeb2.com", cfg.S3.Region)),
+		Endpoint:         aws.String(b2Endpoint(cfg)),
 		Region:           aws.String(cfg.S3.Region),
-		S3ForcePathStyle: aws.Bool(true),
+		S3ForcePathStyle: aws.Bool(cfg.S3.PathStyle),
+		HTTPClient:       newB2HTTPClient(cfg),
+		MaxRetries:       aws.Int(int(cfg.S3.MaxRetries)),
 	})))
+	// buffered parts provide their checksums, so the SDK does not read them to compute these
+	s3Client.Handlers.Build.PushBack(setPartChecksums)
 	if checkS3Client != nil {
 		checkS3Client(s3Client)
 	}
+	maxDownloads := int(cfg.S3.MaxConcurrentDownloads)
+	if maxDownloads < 1 {
+		maxDownloads = 1
+	}
 	return &B2Backend{
 		s3Client,
 		cfg.Internal.Reporter,
+		maxDownloads,
+		cfg.S3.RecoveryDir,
+		new(sync.Map),
+		cfg.S3.PartSizeBytes,
+		cfg.S3.MaxPartSizeBytes,
+		int(cfg.S3.MaxBufferedParts),
+		cfg.BufferSize(),
+		cfg.FileMode(StateFile),
+		cfg.S3.DeleteAllVersions,
+		sleepSeconds,
+		time.Duration(cfg.S3.StallTimeoutSeconds * float64(time.Second)),
+		time.After,
 	}
 }
 
+// sleep waits for `seconds` before a request is retried.
+func (b2 *B2Backend) sleep(seconds time.Duration) {
+	if b2.wait == nil {
+		sleepSeconds(seconds)
+		return
+	}
+	b2.wait(seconds)
+}
+
+// Proxy returns the proxy used to reach the B2 endpoint or nil for a direct connection.
+func (b2 *B2Backend) Proxy() (*url.URL, error) {
+	s3Client, ok := b2.S3API.(*s3.S3)
+	if !ok || s3Client.Config.HTTPClient == nil || s3Client.Config.Endpoint == nil {
+		return nil, nil
+	}
+	transport, ok := s3Client.Config.HTTPClient.Transport.(*http.Transport)
+	if !ok || transport.Proxy == nil {
+		return nil, nil
+	}
+	req, err := http.NewRequest(http.MethodHead, *s3Client.Config.Endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not construct endpoint request: %s", err.Error())
+	}
+	return transport.Proxy(req)
+}
+
+// Probe lists at most one object under the prefix of `uri` to verify that the bucket exists and
+// the credentials are accepted, the request is timed. Fails with ErrBucketNotFound,
+// ErrAccessDenied or ErrInvalidCredentials like other operations, an empty prefix passes.
+func (b2 *B2Backend) Probe(uri *url.URL) (ProbeResult, error) {
+	var result ProbeResult
+	if s3Client, ok := b2.S3API.(*s3.S3); ok {
+		result.Endpoint = aws.StringValue(s3Client.Config.Endpoint)
+		result.Region = aws.StringValue(s3Client.Config.Region)
+	}
+
+	start := time.Now()
+	_, err := b2.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:  aws.String(uri.Host),
+		Prefix:  aws.String(strings.TrimPrefix(uri.Path, "/")),
+		MaxKeys: aws.Int64(1),
+	})
+	result.Latency = time.Since(start)
+	if err != nil {
+		// a prefix without objects is not an error, new prefixes are created by the first backup
+		if err = handleError(err); err.Error() != ErrFileNotFound {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
 func handleError(err error) error {
 	if aerr, ok := err.(awserr.Error); ok {
 		switch aerr.Code() {
 		case "NotFound":
 			fallthrough
-		case s3.ErrCodeNoSuchBucket:
-			fallthrough
 		case s3.ErrCodeNoSuchKey:
 			return errors.New(ErrFileNotFound)
+		case s3.ErrCodeNoSuchBucket:
+			return errors.New(ErrBucketNotFound)
 		case "AccessDenied":
 			return errors.New(ErrAccessDenied)
+		case "InvalidAccessKeyId":
+			fallthrough
+		case "SignatureDoesNotMatch":
+			return errors.New(ErrInvalidCredentials)
 		case "MissingRegion":
 			fallthrough
 		case "EmptyStaticCreds":
@@ -154,21 +532,31 @@ func (s byPartNum) Less(i, j int) bool {
 	return *s[i].PartNumber < *s[j].PartNumber
 }
 
-// uploadPart upload a given part of a multipart upload.
-func (b2 *B2Backend) uploadPart(wg *sync.WaitGroup, result chan partUploadResult, semaphone chan bool, partNum int, input io.ReadSeeker, length int64, createOutput *s3.CreateMultipartUploadOutput) {
+// uploadPart upload a given part of a multipart upload. The buffer of `part` is released
+// once done, it is nil if the part is streamed from the input. Attempts that stall are
+// cancelled and retried like failed ones.
+func (b2 *B2Backend) uploadPart(wg *sync.WaitGroup, result chan partUploadResult, semaphone chan bool, partNum int, input *progressSectionReader, part *bufferedPart, length int64, createOutput *s3.CreateMultipartUploadOutput) {
 	defer wg.Done()
 	<-semaphone
+	defer part.release()
 
 	var uploadOutput *s3.UploadPartOutput
 	var attempt int
 	var err error
+	var stalled bool
 
 uploadCycle:
 	for attempt = 0; attempt < multipart_upload_max_attempts; attempt++ {
+		if attempt > 0 {
+			input.describeRetry(attempt, stalled)
+		}
 		// seek to the beginning of the stream
 		_, _ = input.Seek(0, io.SeekStart)
+		input.startAttempt()
 
-		uploadOutput, err = b2.UploadPart(&s3.UploadPartInput{
+		ctx, cancel := context.WithCancel(context.Background())
+		stopWatching := b2.watchStall(input.sending, cancel)
+		uploadOutput, err = b2.UploadPartWithContext(ctx, &s3.UploadPartInput{
 			Body:          input,
 			Bucket:        createOutput.Bucket,
 			Key:           createOutput.Key,
@@ -176,22 +564,75 @@ uploadCycle:
 			UploadId:      createOutput.UploadId,
 			ContentLength: aws.Int64(length),
 		})
+		stalled = stopWatching()
+		cancel()
 
 		if err == nil {
 			// upload attempt succeeded
 			break uploadCycle
 		} else {
+			if stalled {
+				err = fmt.Errorf("upload of part #%d stalled: no progress for %s", partNum, b2.stallTimeout)
+			}
 			// wait before the next attempt
-			waitfunc(multipart_upload_wait_seconds)
+			b2.sleep(multipart_upload_wait_seconds)
 		}
 	}
 
-	result <- partUploadResult{
-		&s3.CompletedPart{
+	var completedPart *s3.CompletedPart
+	if err == nil {
+		completedPart = &s3.CompletedPart{
 			ETag:       uploadOutput.ETag,
 			PartNumber: aws.Int64(int64(partNum)),
-		},
-		err,
+		}
+	}
+	result <- partUploadResult{completedPart, err}
+}
+
+// watchStall calls `cancel` once the byte count returned by `progress` did not change for
+// the stall timeout while it reports a transfer in progress, e.g. time spent reading a part
+// for signing does not count. Progress is checked stall_check_intervals times per stall
+// timeout, so a stall is detected within a quarter of the timeout after it passed. The
+// returned function stops watching and returns true if the attempt stalled.
+func (b2 *B2Backend) watchStall(progress func() (int64, bool), cancel context.CancelFunc) func() bool {
+	if b2.stallTimeout <= 0 {
+		return func() bool { return false }
+	}
+	after := b2.after
+	if after == nil {
+		after = time.After
+	}
+
+	done := make(chan struct{})
+	var stalled atomic.Bool
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		var last int64 = -1
+		var idle int
+		for {
+			select {
+			case <-done:
+				return
+			case <-after(b2.stallTimeout / stall_check_intervals):
+			}
+			read, sending := progress()
+			if !sending || read != last {
+				last, idle = read, 0
+				continue
+			}
+			if idle++; idle >= stall_check_intervals {
+				stalled.Store(true)
+				cancel()
+				return
+			}
+		}
+	}()
+	return func() bool {
+		close(done)
+		wg.Wait()
+		return stalled.Load()
 	}
 }
 
@@ -204,9 +645,10 @@ func (b2 *B2Backend) GetFileInfo(uri *url.URL) (*FileInfo, error) {
 	var keysize uint64 = 0
 	var modifieddate time.Time
 	var isfile bool
+	var etag, storageClass string
 
-	// is this a prefix path?
-	if strings.HasSuffix(key, "/") {
+	// is this a prefix path? the bucket root is one too
+	if key == "" || strings.HasSuffix(key, "/") {
 		isfile = false
 
 		filelist, err := b2.ListFiles(uri)
@@ -240,56 +682,149 @@ func (b2 *B2Backend) GetFileInfo(uri *url.URL) (*FileInfo, error) {
 		keysize = uint64(filesize)
 
 		modifieddate = *resp.LastModified
+		etag = aws.StringValue(resp.ETag)
+		// S3 omits the storage class of objects in the default class
+		storageClass = aws.StringValue(resp.StorageClass)
+		if len(storageClass) == 0 {
+			storageClass = s3.StorageClassStandard
+		}
 	}
 
 	return &FileInfo{
-		name:     key,
-		size:     keysize,
-		modified: modifieddate,
-		isfile:   isfile,
+		name:         key,
+		size:         keysize,
+		modified:     modifieddate,
+		isfile:       isfile,
+		uri:          objectURI(uri, key),
+		etag:         etag,
+		storageClass: storageClass,
 	}, nil
 }
 
 // ListFiles return an array of FileInfo structs filled with information
-// about objects defined by the input URI.
+// about objects defined by the input URI, sorted by key.
 // Input URI must follow the pattern: b2://bucket/path/to/prefix.
 func (b2 *B2Backend) ListFiles(uri *url.URL) ([]FileInfo, error) {
 	var bucket string = uri.Host
 	var prefix string = strings.TrimPrefix(uri.Path, "/")
 
-	// list object stored under given prefix
+	// list object stored under given prefix, an empty prefix lists the whole bucket,
+	// which takes more than one page for buckets holding over a thousand objects
+	result := []FileInfo{}
+	var token *string
+	for {
+		objects, err := b2.ListObjectsV2(&s3.ListObjectsV2Input{
+			Bucket:            aws.String(bucket),
+			Prefix:            aws.String(prefix),
+			ContinuationToken: token,
+		})
+		if err != nil {
+			return nil, handleError(err)
+		}
+
+		for _, item := range objects.Contents {
+			result = append(result, b2FileInfo(uri, item))
+		}
+		if !aws.BoolValue(objects.IsTruncated) || aws.StringValue(objects.NextContinuationToken) == "" {
+			break
+		}
+		token = objects.NextContinuationToken
+	}
+	// S3 lists keys in UTF-8 binary order, which is not guaranteed by all compatible services
+	sortFileInfos(result)
+
+	return result, nil
+}
+
+// ListFilesLimit returns up to `limit` FileInfo structs of the first objects defined by the
+// input URI, sorted by key, with a single request. Limits above 1000 are capped by the service.
+// Input URI must follow the pattern: b2://bucket/path/to/prefix.
+func (b2 *B2Backend) ListFilesLimit(uri *url.URL, limit int) ([]FileInfo, error) {
 	objects, err := b2.ListObjectsV2(&s3.ListObjectsV2Input{
-		Bucket: aws.String(bucket),
-		Prefix: aws.String(prefix),
+		Bucket:  aws.String(uri.Host),
+		Prefix:  aws.String(strings.TrimPrefix(uri.Path, "/")),
+		MaxKeys: aws.Int64(int64(limit)),
 	})
 	if err != nil {
 		return nil, handleError(err)
 	}
 
-	result := make([]FileInfo, len(objects.Contents))
-	for index, item := range objects.Contents {
-		result[index].name = *item.Key
-		result[index].size = uint64(*item.Size)
-		result[index].modified = *item.LastModified
-		result[index].isfile = true
+	result := []FileInfo{}
+	for _, item := range objects.Contents {
+		result = append(result, b2FileInfo(uri, item))
 	}
+	sortFileInfos(result)
+	return truncateFileInfos(result, limit), nil
+}
 
-	return result, nil
+// b2FileInfo describes the listed object `item` of the bucket of `uri`.
+func b2FileInfo(uri *url.URL, item *s3.Object) FileInfo {
+	return FileInfo{
+		name:         *item.Key,
+		size:         uint64(*item.Size),
+		modified:     *item.LastModified,
+		isfile:       true,
+		uri:          objectURI(uri, *item.Key),
+		etag:         aws.StringValue(item.ETag),
+		storageClass: aws.StringValue(item.StorageClass),
+	}
 }
 
-// StoreFile writes data from `input` to output URI.
+// StoreFile writes the body of the request to its URI, along with its metadata and storage
+// class. A body given as an io.Reader is copied to a temporary file first, the checksum of
+// the request is not verified. The upload stops starting new parts once `ctx` is cancelled.
 // Output URI must follow the pattern: b2://bucket/path/to/key.
-func (b2 *B2Backend) StoreFile(inputStream io.ReaderAt, contentLength int64, uri *url.URL) error {
+func (b2 *B2Backend) StoreFile(ctx context.Context, req StoreRequest) error {
 	var err error
+	if err = req.validate(); err != nil {
+		return err
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	uri := req.URI
 	var bucket string = uri.Host
 	var key string = strings.TrimPrefix(uri.Path, "/")
 
-	if contentLength > multipart_upload_part_size {
+	// multipart uploads need random access to the input
+	inputStream, contentLength, cleanup, err := req.spoolBody()
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	partSize, err := multipartPartSize(contentLength, b2.partSize, b2.maxPartSize)
+	if err != nil {
+		return err
+	}
+
+	pr := b2.pr
+	if req.Quiet {
+		pr = nil
+	}
+	var metadata map[string]*string
+	if len(req.Metadata) > 0 {
+		metadata = aws.StringMap(req.Metadata)
+	}
+	var storageClass *string
+	if req.StorageClass != "" {
+		storageClass = aws.String(req.StorageClass)
+	}
+	var contentType *string
+	if req.ContentType != "" {
+		contentType = aws.String(req.ContentType)
+	}
+
+	if contentLength > partSize {
 		// upload in chunks
 		var createOutput *s3.CreateMultipartUploadOutput
 		createOutput, err = b2.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
-			Bucket: aws.String(bucket),
-			Key:    aws.String(key),
+			Bucket:       aws.String(bucket),
+			Key:          aws.String(key),
+			Metadata:     metadata,
+			StorageClass: storageClass,
+			ContentType:  contentType,
 		})
 		if err != nil {
 			return handleError(err)
@@ -297,21 +832,38 @@ func (b2 *B2Backend) StoreFile(inputStream io.ReaderAt, contentLength int64, uri
 			return handleError(errors.New("multipart upload failed: no upload id found in server response"))
 		}
 
-		// split input into individual parts for upload
+		// track the upload until StoreFile returns
+		b2.pending.Store(uri.String(), aws.StringValue(createOutput.UploadId))
+		defer b2.pending.Delete(uri.String())
+
+		// report the aggregate upload rate of all parts
+		summary := startUploadSummary(pr, contentLength, time.Now)
+		defer summary.stop()
+
+		// split input into individual parts for upload, buffered parts are held in memory
+		// while uploading, so at most `workers` times `partSize` bytes are in use
+		workers := multipart_upload_max_concurent
+		if b2.bufferedParts > 0 {
+			workers = b2.bufferedParts
+		}
 		wg := new(sync.WaitGroup)
 		result := make(chan partUploadResult)
-		semaphore := make(chan bool, multipart_upload_max_concurent)
+		semaphore := make(chan bool, workers)
 
 		var jobsStarted int
-		for jobsStarted = 0; jobsStarted < multipart_upload_max_concurent; jobsStarted++ {
+		for jobsStarted = 0; jobsStarted < workers; jobsStarted++ {
 			// put a value into the semaphore
 			semaphore <- true
 		}
 
 		var partNum int
 		var position, length int64
-		length = multipart_upload_part_size
-		for position = 0; position < contentLength; position += multipart_upload_part_size {
+		length = partSize
+		for position = 0; position < contentLength; position += partSize {
+			// stop starting parts once the upload is cancelled
+			if err = ctx.Err(); err != nil {
+				break
+			}
 			if (position + length) >= contentLength {
 				length = contentLength - position
 			}
@@ -321,10 +873,18 @@ func (b2 *B2Backend) StoreFile(inputStream io.ReaderAt, contentLength int64, uri
 			partNum++
 
 			// create a section reader with progress tracking for current part
-			psr := newProgressSectionReader(io.NewSectionReader(inputStream, position, length), b2.pr, int(partNum))
+			var part *bufferedPart
+			var psr *progressSectionReader
+			if b2.bufferedParts > 0 {
+				part = newBufferedPart(io.NewSectionReader(inputStream, position, length))
+				psr = newProgressPartReader(part, pr, int(partNum))
+			} else {
+				psr = newProgressSectionReader(io.NewSectionReader(inputStream, position, length), pr, int(partNum))
+			}
+			psr.summary = summary
 
 			// upload part in a coroutine
-			go b2.uploadPart(wg, result, semaphore, partNum, psr, length, createOutput)
+			go b2.uploadPart(wg, result, semaphore, partNum, psr, part, length, createOutput)
 		}
 
 		// clean up
@@ -363,25 +923,24 @@ func (b2 *B2Backend) StoreFile(inputStream io.ReaderAt, contentLength int64, uri
 			sort.Sort(byPartNum(completedParts))
 
 			// finalize multipart upload
-			//var completeOutput *s3.CompleteMultipartUploadOutput
-			_, err = b2.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
-				Bucket:   aws.String(bucket),
-				Key:      aws.String(key),
-				UploadId: createOutput.UploadId,
-				MultipartUpload: &s3.CompletedMultipartUpload{
-					Parts: completedParts,
-				},
-			})
+			err = b2.completeMultipartUpload(bucket, key, createOutput.UploadId, completedParts)
+			if err != nil {
+				// keep the uploaded parts and persist the state required to resume
+				return b2.writeUploadRecovery(uri, createOutput.UploadId, completedParts, err)
+			}
 		}
 	} else {
 		// create a section reader with progress tracking for whole file
-		psr := newProgressSectionReader(io.NewSectionReader(inputStream, 0, contentLength), b2.pr, 0)
+		psr := newProgressSectionReader(io.NewSectionReader(inputStream, 0, contentLength), pr, 0)
 
 		// upload reader contents to S3 bucket as an object with the given key
 		_, err = b2.PutObject(&s3.PutObjectInput{
-			Bucket: aws.String(bucket),
-			Key:    aws.String(key),
-			Body:   psr,
+			Bucket:       aws.String(bucket),
+			Key:          aws.String(key),
+			Body:         psr,
+			Metadata:     metadata,
+			StorageClass: storageClass,
+			ContentType:  contentType,
 		})
 	}
 
@@ -391,30 +950,684 @@ func (b2 *B2Backend) StoreFile(inputStream io.ReaderAt, contentLength int64, uri
 	return nil
 }
 
-// RemoveFile removes an object under the given URI.
-// Object URI must follow the pattern: b2://bucket/path/to/key.
-func (b2 *B2Backend) RemoveFile(uri *url.URL) error {
+// multipartPartSize returns the part size used to upload `contentLength` bytes. The configured
+// `partSize` (defaults to 100 MiB) is scaled up in whole MiB to stay within the limit of
+// 10,000 parts, but not beyond `maxPartSize`.
+func multipartPartSize(contentLength, partSize, maxPartSize int64) (int64, error) {
+	if partSize <= 0 {
+		partSize = multipart_upload_part_size
+	} else if partSize < multipart_upload_min_part_size {
+		partSize = multipart_upload_min_part_size
+	}
+
+	required := (contentLength + multipart_upload_max_parts - 1) / multipart_upload_max_parts
+	if required <= partSize {
+		return partSize, nil
+	}
+
+	const mebibyte = 1024 * 1024
+	scaled := (required + mebibyte - 1) / mebibyte * mebibyte
+	if maxPartSize > 0 && scaled > maxPartSize {
+		return 0, fmt.Errorf("file of %d bytes needs parts of at least %d bytes to stay within %d parts, but the maximum part size is %d bytes, increase max_part_size_bytes",
+			contentLength, scaled, multipart_upload_max_parts, maxPartSize)
+	}
+	return scaled, nil
+}
+
+// completeMultipartUpload finalizes a multipart upload, retrying with an exponential backoff.
+func (b2 *B2Backend) completeMultipartUpload(bucket, key string, uploadId *string, completedParts []*s3.CompletedPart) error {
+	var err error
+	for attempt := 0; attempt < multipart_upload_max_attempts; attempt++ {
+		if attempt > 0 {
+			// wait before the next attempt
+			b2.sleep(multipart_upload_wait_seconds << (attempt - 1))
+		}
+		_, err = b2.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+			Bucket:   aws.String(bucket),
+			Key:      aws.String(key),
+			UploadId: uploadId,
+			MultipartUpload: &s3.CompletedMultipartUpload{
+				Parts: completedParts,
+			},
+		})
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// listUploadedParts returns all parts of a multipart upload known to the server.
+func (b2 *B2Backend) listUploadedParts(bucket, key string, uploadId *string) ([]*s3.CompletedPart, error) {
+	var completedParts []*s3.CompletedPart
+	var marker *int64
+	for {
+		listOutput, err := b2.ListParts(&s3.ListPartsInput{
+			Bucket:           aws.String(bucket),
+			Key:              aws.String(key),
+			UploadId:         uploadId,
+			PartNumberMarker: marker,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, part := range listOutput.Parts {
+			completedParts = append(completedParts, &s3.CompletedPart{
+				ETag:       part.ETag,
+				PartNumber: part.PartNumber,
+			})
+		}
+		if !aws.BoolValue(listOutput.IsTruncated) {
+			return completedParts, nil
+		}
+		marker = listOutput.NextPartNumberMarker
+	}
+}
+
+// writeUploadRecovery persists the state of a multipart upload that could not be completed
+// to a recovery file and returns an error pointing to it.
+func (b2 *B2Backend) writeUploadRecovery(uri *url.URL, uploadId *string, completedParts []*s3.CompletedPart, completeErr error) error {
 	var bucket string = uri.Host
 	var key string = strings.TrimPrefix(uri.Path, "/")
 
-	// get object properties stored in S3 bucket under key
-	resp, err := b2.HeadObject(&s3.HeadObjectInput{
+	// prefer the server view of the uploaded parts, fall back to the local one
+	if listedParts, err := b2.listUploadedParts(bucket, key, uploadId); err == nil && len(listedParts) == len(completedParts) {
+		sort.Sort(byPartNum(listedParts))
+		completedParts = listedParts
+	}
+
+	recovery := uploadRecovery{
+		Uri:      uri.String(),
+		UploadId: aws.StringValue(uploadId),
+	}
+	for _, part := range completedParts {
+		recovery.Parts = append(recovery.Parts, uploadRecoveryPart{
+			PartNumber: aws.Int64Value(part.PartNumber),
+			ETag:       aws.StringValue(part.ETag),
+		})
+	}
+
+	data, err := json.MarshalIndent(&recovery, "", "  ")
+	if err == nil {
+		// upload ids are unique, so are the names of recovery files
+		recoveryDir := b2.recoveryDir
+		if len(recoveryDir) == 0 {
+			recoveryDir = os.TempDir()
+		}
+		sum := sha256.Sum256([]byte(recovery.UploadId))
+		recoveryFilepath := filepath.Join(recoveryDir, "squirrelup-upload-"+hex.EncodeToString(sum[:8])+".json")
+		err = AtomicWriteFile(recoveryFilepath, EncodeStateFile(upload_recovery_kind, data), b2.fileMode)
+		if err == nil {
+			return fmt.Errorf("could not complete multipart upload, recovery state written to %q: %s", recoveryFilepath, handleError(completeErr).Error())
+		}
+	}
+	return fmt.Errorf("could not complete multipart upload, failed to write recovery file (%s): %s", err.Error(), handleError(completeErr).Error())
+}
+
+// ResumeUpload completes a multipart upload using the state stored in a recovery file.
+// The recovery file is removed after the upload has been completed.
+func (b2 *B2Backend) ResumeUpload(recoveryFilepath string) (*url.URL, error) {
+	data, err := os.ReadFile(filepath.Clean(recoveryFilepath))
+	if err != nil {
+		return nil, fmt.Errorf("could not read recovery file: %s", err.Error())
+	}
+
+	// recovery files written by earlier versions hold the plain JSON document
+	if !bytes.HasPrefix(data, []byte("{")) {
+		data, err = DecodeStateFile(upload_recovery_kind, data)
+		if err != nil {
+			return nil, fmt.Errorf("could not read recovery file: %s", err.Error())
+		}
+	}
+
+	var recovery uploadRecovery
+	err = json.Unmarshal(data, &recovery)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse recovery file: %s", err.Error())
+	}
+	uri, err := url.ParseRequestURI(recovery.Uri)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse recovery file: %s", err.Error())
+	} else if len(recovery.UploadId) == 0 || len(recovery.Parts) == 0 {
+		return nil, fmt.Errorf("could not parse recovery file: missing upload id or parts")
+	}
+
+	var completedParts []*s3.CompletedPart
+	for _, part := range recovery.Parts {
+		completedParts = append(completedParts, &s3.CompletedPart{
+			ETag:       aws.String(part.ETag),
+			PartNumber: aws.Int64(part.PartNumber),
+		})
+	}
+	sort.Sort(byPartNum(completedParts))
+
+	err = b2.completeMultipartUpload(uri.Host, strings.TrimPrefix(uri.Path, "/"), aws.String(recovery.UploadId), completedParts)
+	if err != nil {
+		return nil, handleError(err)
+	}
+	_ = os.Remove(recoveryFilepath)
+
+	return uri, nil
+}
+
+// PendingUploadId returns the id of a multipart upload to `uri` that is in progress.
+func (b2 *B2Backend) PendingUploadId(uri *url.URL) (string, bool) {
+	if uploadId, ok := b2.pending.Load(uri.String()); ok {
+		return uploadId.(string), true
+	}
+	return "", false
+}
+
+// RetrieveFile writes data stored under input URI to `output`.
+// Objects larger than the multipart part size are downloaded in concurrent byte ranges
+// if `output` implements io.WriterAt and io.ReaderAt, the joined ranges are read back to
+// verify them against the ETag of the object, see verifyDownload.
+// Input URI must follow the pattern: b2://bucket/path/to/key.
+func (b2 *B2Backend) RetrieveFile(output io.Writer, uri *url.URL) error {
+	var bucket string = uri.Host
+	var key string = strings.TrimPrefix(uri.Path, "/")
+
+	if outputAt, ok := output.(interface {
+		io.ReaderAt
+		io.WriterAt
+	}); ok {
+		resp, err := b2.HeadObject(&s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return handleError(err)
+		}
+		if aws.Int64Value(resp.ContentLength) > multipart_upload_part_size {
+			return b2.retrieveFileRanges(outputAt, bucket, key, aws.Int64Value(resp.ContentLength), resp.ETag)
+		}
+	}
+
+	// get object stored in S3 bucket under key
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resp, err := b2.GetObjectWithContext(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
 	})
 	if err != nil {
 		return handleError(err)
 	}
+	defer resp.Body.Close()
+	body := &downloadReader{Reader: resp.Body}
 
-	// remove object with the given key from S3 bucket
-	_, err = b2.DeleteObject(&s3.DeleteObjectInput{
-		Bucket:    aws.String(bucket),
-		Key:       aws.String(key),
-		VersionId: resp.VersionId,
+	// track download progress
+	if ProgressEnabled(b2.pr) {
+		var index int
+		index, _ = b2.pr.CreateFileTask(aws.Int64Value(resp.ContentLength))
+		_ = b2.pr.DescribeTask(index, "downloading")
+		output = io.MultiWriter(output, &progressTaskWriter{b2.pr, index})
+		defer b2.pr.FinishTask(index)
+	}
+
+	stopWatching := b2.watchStall(body.progress, cancel)
+	_, err = CopyBuffer(output, body, b2.bufferSize)
+	if stopWatching() {
+		return fmt.Errorf("download of %q stalled: no progress for %s", key, b2.stallTimeout)
+	}
+	if err != nil {
+		return handleError(err)
+	}
+	return nil
+}
+
+// retrieveFileRanges downloads an object of `contentLength` bytes in concurrent byte ranges
+// and verifies the joined ranges.
+func (b2 *B2Backend) retrieveFileRanges(output interface {
+	io.ReaderAt
+	io.WriterAt
+}, bucket, key string, contentLength int64, etag *string) error {
+	// preallocate output file
+	if truncater, ok := output.(interface{ Truncate(int64) error }); ok {
+		if err := truncater.Truncate(contentLength); err != nil {
+			return fmt.Errorf("could not preallocate output: %s", err.Error())
+		}
+	}
+
+	// track aggregate download progress
+	var aggregate *progressTaskWriter
+	if ProgressEnabled(b2.pr) {
+		var index int
+		index, _ = b2.pr.CreateFileTask(contentLength)
+		_ = b2.pr.DescribeTask(index, "downloading")
+		aggregate = &progressTaskWriter{b2.pr, index}
+		defer b2.pr.FinishTask(index)
+	}
+
+	// download individual ranges
+	wg := new(sync.WaitGroup)
+	semaphore := make(chan bool, b2.maxDownloads)
+	var numParts int64 = (contentLength + multipart_upload_part_size - 1) / multipart_upload_part_size
+	var results []error = make([]error, numParts)
+	var written []int64 = make([]int64, numParts)
+
+	var partNum int
+	var position, length int64
+	length = multipart_upload_part_size
+	for position = 0; position < contentLength; position += multipart_upload_part_size {
+		if (position + length) >= contentLength {
+			length = contentLength - position
+		}
+
+		wg.Add(1)
+		partNum++
+
+		go func(partNum int, position, length int64) {
+			defer wg.Done()
+			semaphore <- true
+			defer func() { <-semaphore }()
+
+			written[partNum-1], results[partNum-1] = b2.retrieveRange(output, bucket, key, etag, partNum, position, length, aggregate)
+		}(partNum, position, length)
+	}
+	wg.Wait()
+
+	// verify results
+	var total int64
+	for index, err := range results {
+		if err != nil {
+			return handleError(err)
+		}
+		total += written[index]
+	}
+	if total != contentLength {
+		return fmt.Errorf("size mismatch for downloaded object: expected %d, got %d", contentLength, total)
+	}
+
+	return b2.verifyDownload(output, bucket, key, contentLength, aws.StringValue(etag))
+}
+
+// verifyDownload compares the `contentLength` bytes written to `output` with the ETag of the
+// object, which is the MD5 digest of its contents or, for objects uploaded in parts, the MD5
+// digest of the digests of its parts followed by their number. The size of the parts is
+// looked up with the first part of the object. ETags of another form, like those of objects
+// encrypted with customer keys, are not verified.
+func (b2 *B2Backend) verifyDownload(output io.ReaderAt, bucket, key string, contentLength int64, etag string) error {
+	match := etag_pattern.FindStringSubmatch(strings.Trim(etag, `"`))
+	if match == nil {
+		return nil
+	}
+
+	var partSize int64 = contentLength
+	if len(match[2]) > 0 {
+		numParts, err := strconv.ParseInt(match[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("could not verify downloaded object %q: %s", key, err.Error())
+		}
+		resp, err := b2.HeadObject(&s3.HeadObjectInput{
+			Bucket:     aws.String(bucket),
+			Key:        aws.String(key),
+			PartNumber: aws.Int64(1),
+			IfMatch:    aws.String(etag),
+		})
+		if err != nil {
+			return handleError(err)
+		}
+		partSize = aws.Int64Value(resp.ContentLength)
+		if partSize <= 0 || (contentLength+partSize-1)/partSize != numParts {
+			return fmt.Errorf("could not verify downloaded object %q: parts of %d bytes do not add up to %d parts", key, partSize, numParts)
+		}
+	}
+
+	// #nosec G401 -- MD5 is what the ETag is made of
+	hash := md5.New()
+	var digests []byte
+	for position := int64(0); position < contentLength; position += partSize {
+		hash.Reset()
+		if _, err := CopyBuffer(hash, io.NewSectionReader(output, position, min(partSize, contentLength-position)), b2.bufferSize); err != nil {
+			return fmt.Errorf("could not verify downloaded object %q: %s", key, err.Error())
+		}
+		digests = hash.Sum(digests)
+	}
+	if len(match[2]) > 0 {
+		sum := md5.Sum(digests) // #nosec G401
+		digests = sum[:]
+	}
+	if !strings.EqualFold(hex.EncodeToString(digests), match[1]) {
+		return fmt.Errorf("downloaded object %q is corrupted: %s", key, ErrChecksumMismatch)
+	}
+	return nil
+}
+
+// retrieveRange downloads a given byte range of an object and writes it at the same offset to `output`.
+func (b2 *B2Backend) retrieveRange(output io.WriterAt, bucket, key string, etag *string, partNum int, position, length int64, aggregate *progressTaskWriter) (int64, error) {
+	var index int
+	if ProgressEnabled(b2.pr) {
+		index, _ = b2.pr.CreateFileTask(length)
+		_ = b2.pr.DescribeTask(index, fmt.Sprintf("downloading part #%d", partNum))
+		defer b2.pr.FinishTask(index)
+	}
+
+	var written int64
+	var err error
+	for attempt := 0; attempt < multipart_upload_max_attempts; attempt++ {
+		if attempt > 0 {
+			// wait before the next attempt
+			b2.sleep(multipart_upload_wait_seconds)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		var resp *s3.GetObjectOutput
+		resp, err = b2.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket:  aws.String(bucket),
+			Key:     aws.String(key),
+			Range:   aws.String(fmt.Sprintf("bytes=%d-%d", position, position+length-1)),
+			IfMatch: etag,
+		})
+		if err != nil {
+			cancel()
+			continue
+		}
+
+		var writer io.Writer = io.NewOffsetWriter(output, position)
+		if ProgressEnabled(b2.pr) {
+			writer = io.MultiWriter(writer, &progressTaskWriter{b2.pr, index}, aggregate)
+		}
+		body := &downloadReader{Reader: resp.Body}
+		stopWatching := b2.watchStall(body.progress, cancel)
+		written, err = CopyBuffer(writer, io.LimitReader(body, length), b2.bufferSize)
+		if stopWatching() {
+			err = fmt.Errorf("download of part #%d stalled: no progress for %s", partNum, b2.stallTimeout)
+		}
+		_ = resp.Body.Close()
+		cancel()
+		if err == nil && written != length {
+			err = io.ErrUnexpectedEOF
+		}
+		if err == nil {
+			// download attempt succeeded
+			break
+		}
+		if ProgressEnabled(b2.pr) && written > 0 {
+			// the range is downloaded from its start again
+			_ = b2.pr.AdvanceTask(index, -written)
+			_ = aggregate.AdvanceTask(aggregate.Index, -written)
+		}
+	}
+
+	return written, err
+}
+
+// CopyFile copies an object from source URI to destination URI within the same backend.
+// Objects larger than CopyObject allows are copied with a multipart upload, see copyMultipart.
+// Both URIs must follow the pattern: b2://bucket/path/to/key.
+func (b2 *B2Backend) CopyFile(source *url.URL, destination *url.URL) error {
+	var copySource *url.URL = &url.URL{Path: source.Host + source.Path}
+	// '+' is decoded as a space by some services
+	var escapedSource string = strings.ReplaceAll(copySource.EscapedPath(), "+", "%2B")
+	var bucket string = destination.Host
+	var key string = strings.TrimPrefix(destination.Path, "/")
+
+	head, err := b2.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(source.Host),
+		Key:    aws.String(strings.TrimPrefix(source.Path, "/")),
 	})
+	if err != nil {
+		return handleError(err)
+	}
+	if aws.Int64Value(head.ContentLength) > copy_object_max_size {
+		return b2.copyMultipart(escapedSource, bucket, key, head)
+	}
 
+	// copy object to the destination key
+	_, err = b2.CopyObject(&s3.CopyObjectInput{
+		Bucket:     aws.String(bucket),
+		Key:        aws.String(key),
+		CopySource: aws.String(escapedSource),
+	})
 	if err != nil {
 		return handleError(err)
 	}
 	return nil
 }
+
+// copyMultipart copies the object `copySource` described by `head` to `key` in `bucket` with
+// UploadPartCopy requests for parts of multipartPartSize bytes, keeping its metadata, content
+// type and storage class. The upload is aborted if any part fails.
+func (b2 *B2Backend) copyMultipart(copySource, bucket, key string, head *s3.HeadObjectOutput) error {
+	var size int64 = aws.Int64Value(head.ContentLength)
+	partSize, err := multipartPartSize(size, b2.partSize, b2.maxPartSize)
+	if err != nil {
+		return err
+	}
+
+	createOutput, err := b2.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:       aws.String(bucket),
+		Key:          aws.String(key),
+		Metadata:     head.Metadata,
+		ContentType:  head.ContentType,
+		StorageClass: head.StorageClass,
+	})
+	if err != nil {
+		return handleError(err)
+	}
+
+	var completedParts []*s3.CompletedPart
+	for position, partNum := int64(0), int64(1); position < size; position, partNum = position+partSize, partNum+1 {
+		var resp *s3.UploadPartCopyOutput
+		resp, err = b2.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket:            aws.String(bucket),
+			Key:               aws.String(key),
+			UploadId:          createOutput.UploadId,
+			PartNumber:        aws.Int64(partNum),
+			CopySource:        aws.String(copySource),
+			CopySourceRange:   aws.String(fmt.Sprintf("bytes=%d-%d", position, min(position+partSize, size)-1)),
+			CopySourceIfMatch: head.ETag,
+		})
+		if err != nil {
+			break
+		}
+		completedParts = append(completedParts, &s3.CompletedPart{
+			ETag:       resp.CopyPartResult.ETag,
+			PartNumber: aws.Int64(partNum),
+		})
+	}
+	if err == nil {
+		err = b2.completeMultipartUpload(bucket, key, createOutput.UploadId, completedParts)
+	}
+	if err != nil {
+		_, _ = b2.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(bucket),
+			Key:      aws.String(key),
+			UploadId: createOutput.UploadId,
+		})
+		return handleError(err)
+	}
+	return nil
+}
+
+// RemoveFile removes an object under the given URI. On versioned buckets, a delete marker
+// hides the object unless all versions are to be deleted, see RemoveFiles.
+// Object URI must follow the pattern: b2://bucket/path/to/key.
+func (b2 *B2Backend) RemoveFile(uri *url.URL) error {
+	if b2.deleteAllVersions {
+		return b2.RemoveFiles([]*url.URL{uri})[0].Err
+	}
+
+	// remove object with the given key from S3 bucket
+	_, err := b2.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(uri.Host),
+		Key:    aws.String(strings.TrimPrefix(uri.Path, "/")),
+	})
+	if err != nil {
+		return handleError(err)
+	}
+	return nil
+}
+
+// RemoveFiles removes up to MaxBulkRemoveFiles objects with DeleteObjects requests and returns
+// the result for each object. Objects are removed like by RemoveFile, unless all versions
+// are to be deleted. In that case, the versions and delete markers of all objects are taken
+// from one listing and removed up to MaxBulkRemoveFiles per request, objects without any
+// version fail with ErrFileNotFound.
+// Object URIs must follow the pattern: b2://bucket/path/to/key.
+func (b2 *B2Backend) RemoveFiles(uris []*url.URL) []RemoveResult {
+	results := make([]RemoveResult, len(uris))
+	if len(uris) > MaxBulkRemoveFiles {
+		for index := range results {
+			results[index].Err = fmt.Errorf("cannot remove more than %d files at once", MaxBulkRemoveFiles)
+		}
+		return results
+	}
+
+	// group objects by bucket, keeping the order of buckets
+	var buckets []string
+	indices := map[string][]int{}
+	for index, uri := range uris {
+		if _, prs := indices[uri.Host]; !prs {
+			buckets = append(buckets, uri.Host)
+		}
+		indices[uri.Host] = append(indices[uri.Host], index)
+	}
+	for _, bucket := range buckets {
+		b2.removeObjects(bucket, uris, indices[bucket], results)
+	}
+	return results
+}
+
+// removeObjects removes the objects of `uris` at `indices` from `bucket` and stores their
+// results in `results` at the same indices, see RemoveFiles.
+func (b2 *B2Backend) removeObjects(bucket string, uris []*url.URL, indices []int, results []RemoveResult) {
+	keys := make(map[string]int, len(indices))
+	for _, index := range indices {
+		keys[strings.TrimPrefix(uris[index].Path, "/")] = index
+	}
+
+	var objects []*s3.ObjectIdentifier
+	var versions map[string]int
+	if b2.deleteAllVersions {
+		identifiers, counts, err := b2.objectVersions(bucket, keys, false)
+		if err != nil {
+			for _, index := range indices {
+				results[index].Err = handleError(err)
+			}
+			return
+		}
+		for _, index := range indices {
+			key := strings.TrimPrefix(uris[index].Path, "/")
+			if len(identifiers[key]) == 0 {
+				results[index].Err = errors.New(ErrFileNotFound)
+			}
+			objects = append(objects, identifiers[key]...)
+		}
+		versions = counts
+	} else {
+		for _, index := range indices {
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(strings.TrimPrefix(uris[index].Path, "/"))})
+		}
+	}
+
+	// remove objects, responses list failed objects only
+	for start := 0; start < len(objects); start += MaxBulkRemoveFiles {
+		batch := objects[start:min(start+MaxBulkRemoveFiles, len(objects))]
+		resp, err := b2.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &s3.Delete{Objects: batch, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			for _, object := range batch {
+				if index := keys[*object.Key]; results[index].Err == nil {
+					results[index].Err = handleError(err)
+				}
+			}
+			continue
+		}
+		for _, failure := range resp.Errors {
+			if index, prs := keys[aws.StringValue(failure.Key)]; prs && results[index].Err == nil {
+				results[index].Err = handleError(awserr.New(aws.StringValue(failure.Code), aws.StringValue(failure.Message), nil))
+			}
+		}
+	}
+
+	for key, index := range keys {
+		if results[index].Err == nil {
+			results[index].Versions = versions[key]
+		}
+	}
+}
+
+// RemovePriorVersions removes the versions and delete markers of an object except the current
+// version, using the same listing as RemoveFiles, and returns the number of versions removed.
+// Objects of unversioned buckets have no prior versions.
+// Object URI must follow the pattern: b2://bucket/path/to/key.
+func (b2 *B2Backend) RemovePriorVersions(uri *url.URL) (int, error) {
+	key := strings.TrimPrefix(uri.Path, "/")
+	identifiers, counts, err := b2.objectVersions(uri.Host, map[string]int{key: 0}, true)
+	if err != nil {
+		return 0, handleError(err)
+	}
+
+	// remove versions, responses list failed versions only
+	objects := identifiers[key]
+	for start := 0; start < len(objects); start += MaxBulkRemoveFiles {
+		resp, err := b2.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(uri.Host),
+			Delete: &s3.Delete{Objects: objects[start:min(start+MaxBulkRemoveFiles, len(objects))], Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return 0, handleError(err)
+		}
+		if len(resp.Errors) > 0 {
+			failure := resp.Errors[0]
+			return 0, handleError(awserr.New(aws.StringValue(failure.Code), aws.StringValue(failure.Message), nil))
+		}
+	}
+	return counts[key], nil
+}
+
+// objectVersions lists the versions and delete markers of `keys` in `bucket` under the longest
+// common prefix of `keys`, only those that are not the latest if `prior` is set. It returns
+// their identifiers and the number of versions, delete markers excluded, for each key.
+func (b2 *B2Backend) objectVersions(bucket string, keys map[string]int, prior bool) (map[string][]*s3.ObjectIdentifier, map[string]int, error) {
+	var prefix, last string
+	first := true
+	for key := range keys {
+		if first {
+			prefix, last, first = key, key, false
+			continue
+		}
+		for !strings.HasPrefix(key, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+		last = max(last, key)
+	}
+	for !utf8.ValidString(prefix) {
+		prefix = prefix[:len(prefix)-1]
+	}
+
+	identifiers := make(map[string][]*s3.ObjectIdentifier, len(keys))
+	counts := make(map[string]int, len(keys))
+	input := &s3.ListObjectVersionsInput{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}
+	for {
+		resp, err := b2.ListObjectVersions(input)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, version := range resp.Versions {
+			if _, prs := keys[aws.StringValue(version.Key)]; prs && !(prior && aws.BoolValue(version.IsLatest)) {
+				identifiers[*version.Key] = append(identifiers[*version.Key], &s3.ObjectIdentifier{Key: version.Key, VersionId: version.VersionId})
+				counts[*version.Key]++
+			}
+		}
+		for _, marker := range resp.DeleteMarkers {
+			if _, prs := keys[aws.StringValue(marker.Key)]; prs && !(prior && aws.BoolValue(marker.IsLatest)) {
+				identifiers[*marker.Key] = append(identifiers[*marker.Key], &s3.ObjectIdentifier{Key: marker.Key, VersionId: marker.VersionId})
+			}
+		}
+
+		// versions are listed in key order, stop once past the last key
+		if !aws.BoolValue(resp.IsTruncated) || aws.StringValue(resp.NextKeyMarker) > last {
+			return identifiers, counts, nil
+		}
+		input.KeyMarker = resp.NextKeyMarker
+		input.VersionIdMarker = resp.NextVersionIdMarker
+	}
+}
@@ -2,16 +2,31 @@ package common
 
 import (
 	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 )
@@ -26,21 +41,50 @@ type (
 		ContentLength int64
 		LastModified  time.Time
 		VersionId     string
+		ETag          *string
+		StorageClass  *string
 	}
 
 	mockB2KeyInfo struct {
 		Key          string
 		Size         int64
 		LastModified time.Time
+		ETag         string
+		StorageClass string
 	}
 
 	mockReadSeeker struct {
 		position int
 		length   int
 	}
+
+	// mockRangeReader produces `remaining` zero bytes, optionally waiting for a signal first.
+	mockRangeReader struct {
+		remaining int64
+		wait      chan bool
+		done      func()
+	}
+
+	// mockWriterAt counts bytes written at arbitrary offsets and reads back zero bytes, the
+	// only bytes produced by mockRangeReader.
+	mockWriterAt struct {
+		lock    sync.Mutex
+		size    int64
+		written int64
+	}
 )
 
-const test_num_multipart_parts = 5
+const (
+	test_concurrent_prefix   = "valid/concurrent/"
+	test_content_type_prefix = "valid/content/type/"
+	test_num_multipart_parts = 5
+	test_ranged_length       = 2*multipart_upload_part_size + 10
+	test_bulk_prefix         = "bulk/"
+	// number of versions listed per page by mockS3Client.ListObjectVersions
+	test_versions_page_size = 1000
+	// size of "valid/copy/huge/source", copied in parts
+	test_copy_huge_length = copy_object_max_size + 10
+)
 
 var (
 	expected_keys = map[string]mockB2ObjectInfo{
@@ -48,6 +92,7 @@ var (
 			ContentLength: 0,
 			LastModified:  time.Unix(0, 0).UTC(),
 			VersionId:     "valid-key-version",
+			ETag:          aws.String(`"valid-key-etag"`),
 		},
 		"invalid/key/size": {
 			ContentLength: -1,
@@ -67,11 +112,15 @@ var (
 				Key:          "valid/prefix/key1",
 				Size:         1,
 				LastModified: time.Unix(1, 0).UTC(),
+				ETag:         `"key1-etag"`,
+				StorageClass: "STANDARD",
 			},
 			{
 				Key:          "valid/prefix/key2",
 				Size:         2,
 				LastModified: time.Unix(2, 0).UTC(),
+				ETag:         `"key2-etag"`,
+				StorageClass: "GLACIER",
 			},
 		},
 	}
@@ -84,6 +133,50 @@ var (
 	}
 
 	uploadpart_mutex sync.Mutex
+
+	actual_multipart_complete_calls = map[string]int{}
+
+	mock_upload_part_hook func()
+
+	actual_multipart_part_sizes = map[int64]int{}
+
+	actual_ranged_getobject_calls = map[string][3]int{
+		"valid/ranged/key":              {0, 0, 0},
+		"valid/ranged/key/fails/part/2": {0, 0, 0},
+		"valid/ranged/key/out/of/order": {0, 0, 0},
+	}
+	actual_ranged_completion_order []int
+	ranged_last_part_done          chan bool
+	// ETags of ranged keys other than "mock-etag"
+	mock_ranged_etags = map[string]string{}
+
+	getobject_mutex sync.Mutex
+
+	// keys listed by mockS3Client.ListObjectVersions under `test_bulk_prefix`, sorted
+	mock_bulk_keys []string
+	// keys of every DeleteObjects request and pages of every ListObjectVersions request
+	actual_delete_objects_calls [][]string
+	actual_list_versions_calls  int
+	bulk_mutex                  sync.Mutex
+
+	// number of parts stored under keys with `test_concurrent_prefix`
+	actual_concurrent_parts sync.Map
+
+	// last request and body stored under "valid/new/options/key"
+	actual_options_put_input *s3.PutObjectInput
+	actual_options_put_body  []byte
+
+	// last request creating a multipart upload under "valid/new/multipart/key"
+	actual_multipart_create_input *s3.CreateMultipartUploadInput
+
+	// content types of objects stored under keys with `test_content_type_prefix`
+	actual_content_types sync.Map
+
+	// ranges of the parts copied by UploadPartCopy, the last request creating a multipart
+	// upload to copy an object and whether the copy was aborted
+	actual_copy_part_ranges  []string
+	actual_copy_create_input *s3.CreateMultipartUploadInput
+	actual_copy_aborted      bool
 )
 
 func (m *mockReadSeeker) Read(p []byte) (n int, err error) {
@@ -127,6 +220,60 @@ func (m *mockReadSeeker) Seek(offset int64, whence int) (int64, error) {
 	return int64(m.position), nil
 }
 
+func (m *mockRangeReader) Read(p []byte) (n int, err error) {
+	if m.wait != nil {
+		<-m.wait
+		m.wait = nil
+	}
+	if m.remaining == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > m.remaining {
+		p = p[:m.remaining]
+	}
+	clear(p)
+	m.remaining -= int64(len(p))
+	if m.remaining == 0 && m.done != nil {
+		m.done()
+	}
+	return len(p), nil
+}
+
+func (m *mockWriterAt) WriteAt(p []byte, off int64) (n int, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if off+int64(len(p)) > m.size {
+		return 0, errors.New("write outside of preallocated range")
+	}
+	m.written += int64(len(p))
+	return len(p), nil
+}
+
+func (m *mockWriterAt) ReadAt(p []byte, off int64) (n int, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if off >= m.size {
+		return 0, io.EOF
+	}
+	n = int(min(int64(len(p)), m.size-off))
+	clear(p[:n])
+	if n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (m *mockWriterAt) Write(p []byte) (n int, err error) {
+	return 0, errors.New("mockWriterAt.Write should not be called")
+}
+
+func (m *mockWriterAt) Truncate(size int64) error {
+	m.size = size
+	return nil
+}
+
 func (m *mockS3Client) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
 	switch *input.Key {
 	case "valid/key", "valid/deletable/key", "valid/undeletable/key", "invalid/key/size":
@@ -135,6 +282,38 @@ func (m *mockS3Client) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutp
 			ContentLength: &mockInfo.ContentLength,
 			LastModified:  &mockInfo.LastModified,
 			VersionId:     &mockInfo.VersionId,
+			ETag:          mockInfo.ETag,
+			StorageClass:  mockInfo.StorageClass,
+		}, nil
+	case "valid/ranged/key", "valid/ranged/key/fails/part/2", "valid/ranged/key/out/of/order":
+		return &s3.HeadObjectOutput{
+			ContentLength: aws.Int64(test_ranged_length),
+			ETag:          aws.String("mock-etag"),
+		}, nil
+	case "valid/ranged/key/md5", "valid/ranged/key/parts", "valid/ranged/key/corrupted", "valid/ranged/key/interrupted/part/2":
+		etag := mock_ranged_etags[*input.Key]
+		if input.PartNumber != nil {
+			if aws.StringValue(input.IfMatch) != etag {
+				return nil, awserr.New("PreconditionFailed", "", nil)
+			}
+			/* objects were uploaded in parts of the default size */
+			return &s3.HeadObjectOutput{
+				ContentLength: aws.Int64(multipart_upload_part_size),
+				ETag:          aws.String(etag),
+			}, nil
+		}
+		return &s3.HeadObjectOutput{
+			ContentLength: aws.Int64(test_ranged_length),
+			ETag:          aws.String(etag),
+		}, nil
+	case "valid/key with spaces", "valid/a+b c#d":
+		return &s3.HeadObjectOutput{ContentLength: aws.Int64(1)}, nil
+	case "valid/copy/huge/source":
+		return &s3.HeadObjectOutput{
+			ContentLength: aws.Int64(test_copy_huge_length),
+			ETag:          aws.String(`"huge-etag"`),
+			ContentType:   aws.String(ContentTypeAge),
+			Metadata:      map[string]*string{"sha256": aws.String("mock-digest")},
 		}, nil
 	case "access/denied":
 		return nil, awserr.New("AccessDenied", "", nil)
@@ -160,18 +339,62 @@ func (m *mockS3Client) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObje
 			s3Object.Key = &expected_prefixes[*input.Prefix][index].Key
 			s3Object.Size = &expected_prefixes[*input.Prefix][index].Size
 			s3Object.LastModified = &expected_prefixes[*input.Prefix][index].LastModified
+			s3Object.ETag = &expected_prefixes[*input.Prefix][index].ETag
+			s3Object.StorageClass = &expected_prefixes[*input.Prefix][index].StorageClass
 
 			contents[index] = s3Object
 		}
 
 		return &s3.ListObjectsV2Output{Contents: contents}, nil
+	case "unsorted/prefix/":
+		var contents []*s3.Object
+		for _, key := range []string{"unsorted/prefix/key2", "unsorted/prefix/key10", "unsorted/prefix/key1"} {
+			contents = append(contents, &s3.Object{Key: aws.String(key), Size: aws.Int64(1), LastModified: aws.Time(time.Unix(1, 0).UTC())})
+		}
+		return &s3.ListObjectsV2Output{Contents: contents}, nil
+	case "":
+		// the bucket root is listed in two pages
+		if input.ContinuationToken == nil {
+			return &s3.ListObjectsV2Output{
+				Contents: []*s3.Object{
+					{Key: aws.String("root-key"), Size: aws.Int64(1), LastModified: aws.Time(time.Unix(1, 0).UTC())},
+					{Key: aws.String("nested/key"), Size: aws.Int64(2), LastModified: aws.Time(time.Unix(3, 0).UTC())},
+				},
+				IsTruncated:           aws.Bool(true),
+				NextContinuationToken: aws.String("page-2"),
+			}, nil
+		} else if *input.ContinuationToken == "page-2" {
+			return &s3.ListObjectsV2Output{
+				Contents: []*s3.Object{
+					{Key: aws.String("another-key"), Size: aws.Int64(4), LastModified: aws.Time(time.Unix(2, 0).UTC())},
+				},
+				IsTruncated: aws.Bool(false),
+			}, nil
+		}
+		return nil, fmt.Errorf("mockS3Client.ListObjectsV2 got an unexpected continuation token %s", *input.ContinuationToken)
 	case "invalid/prefix/":
 		return &s3.ListObjectsV2Output{}, awserr.New("NotFound", "", nil)
+	case "restricted/prefix/":
+		return &s3.ListObjectsV2Output{}, awserr.New("AccessDenied", "", nil)
+	case "missing/bucket/":
+		return &s3.ListObjectsV2Output{}, awserr.New(s3.ErrCodeNoSuchBucket, "", nil)
 	}
 	return nil, fmt.Errorf("mockS3Client.ListObjectsV2 got an unexpected prefix %s", *input.Prefix)
 }
 
 func (m *mockS3Client) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	if strings.HasPrefix(*input.Key, test_concurrent_prefix) {
+		err := readTwice(input.Body)
+		if err == nil {
+			actual_concurrent_parts.Store(*input.Key, 1)
+		}
+		return &s3.PutObjectOutput{}, err
+	}
+	if strings.HasPrefix(*input.Key, test_content_type_prefix) {
+		actual_content_types.Store(*input.Key, aws.StringValue(input.ContentType))
+		_, err := io.ReadAll(input.Body)
+		return &s3.PutObjectOutput{}, err
+	}
 	switch *input.Key {
 	case "valid/new/key":
 		var err error
@@ -183,6 +406,11 @@ func (m *mockS3Client) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput,
 			}
 		}
 		return &s3.PutObjectOutput{}, err
+	case "valid/new/options/key":
+		var err error
+		actual_options_put_input = input
+		actual_options_put_body, err = io.ReadAll(input.Body)
+		return &s3.PutObjectOutput{}, err
 	case "invalid/new/key":
 		return &s3.PutObjectOutput{}, awserr.New("NotFound", "", nil)
 	}
@@ -190,18 +418,210 @@ func (m *mockS3Client) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput,
 }
 
 func (m *mockS3Client) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	if input.VersionId != nil {
+		return nil, fmt.Errorf("mockS3Client.DeleteObject got an unexpected version id %s", *input.VersionId)
+	}
 	switch *input.Key {
 	case "valid/deletable/key":
 		return &s3.DeleteObjectOutput{}, nil
 	case "valid/undeletable/key":
 		return &s3.DeleteObjectOutput{}, awserr.New("AccessDenied", "", nil)
+	case "invalid/key":
+		return &s3.DeleteObjectOutput{}, awserr.New(s3.ErrCodeNoSuchKey, "", nil)
 	}
 	return nil, fmt.Errorf("mockS3Client.DeleteObject got an unexpected key %s", *input.Key)
 }
 
+func (m *mockS3Client) ListObjectVersions(input *s3.ListObjectVersionsInput) (*s3.ListObjectVersionsOutput, error) {
+	bulk_mutex.Lock()
+	defer bulk_mutex.Unlock()
+	actual_list_versions_calls++
+
+	if !strings.HasPrefix(test_bulk_prefix, *input.Prefix) && !strings.HasPrefix(*input.Prefix, test_bulk_prefix) {
+		return nil, awserr.New("AccessDenied", "", nil)
+	}
+	// every key has a current and a previous version, keys containing "hidden" have a delete
+	// marker as well, versions of a key are never split across pages
+	output := &s3.ListObjectVersionsOutput{IsTruncated: aws.Bool(false)}
+	for _, key := range mock_bulk_keys {
+		if !strings.HasPrefix(key, *input.Prefix) || key <= aws.StringValue(input.KeyMarker) {
+			continue
+		}
+		if len(output.Versions) >= test_versions_page_size {
+			output.IsTruncated = aws.Bool(true)
+			output.NextKeyMarker = output.Versions[len(output.Versions)-1].Key
+			output.NextVersionIdMarker = output.Versions[len(output.Versions)-1].VersionId
+			break
+		}
+		hidden := strings.Contains(key, "hidden")
+		output.Versions = append(output.Versions,
+			&s3.ObjectVersion{Key: aws.String(key), VersionId: aws.String("current-" + key), IsLatest: aws.Bool(!hidden)},
+			&s3.ObjectVersion{Key: aws.String(key), VersionId: aws.String("previous-" + key), IsLatest: aws.Bool(false)})
+		if hidden {
+			output.DeleteMarkers = append(output.DeleteMarkers,
+				&s3.DeleteMarkerEntry{Key: aws.String(key), VersionId: aws.String("marker-" + key), IsLatest: aws.Bool(true)})
+		}
+	}
+	return output, nil
+}
+
+func (m *mockS3Client) DeleteObjects(input *s3.DeleteObjectsInput) (*s3.DeleteObjectsOutput, error) {
+	var keys []string
+	output := &s3.DeleteObjectsOutput{}
+	for _, object := range input.Delete.Objects {
+		versionId := aws.StringValue(object.VersionId)
+		if object.VersionId == nil {
+			keys = append(keys, *object.Key)
+		} else {
+			keys = append(keys, *object.Key+"@"+strings.TrimSuffix(versionId, "-"+*object.Key))
+		}
+		if object.VersionId != nil && !slices.Contains([]string{"current-", "previous-", "marker-"}, strings.TrimSuffix(versionId, *object.Key)) {
+			output.Errors = append(output.Errors, &s3.Error{Key: object.Key, Code: aws.String("NoSuchVersion")})
+		} else if strings.Contains(*object.Key, "undeletable") {
+			output.Errors = append(output.Errors, &s3.Error{Key: object.Key, Code: aws.String("AccessDenied"), Message: aws.String("not permitted")})
+		}
+	}
+	bulk_mutex.Lock()
+	actual_delete_objects_calls = append(actual_delete_objects_calls, keys)
+	bulk_mutex.Unlock()
+
+	if len(input.Delete.Objects) > MaxBulkRemoveFiles {
+		return nil, awserr.New("MalformedXML", "too many objects", nil)
+	}
+	return output, nil
+}
+
+func (m *mockS3Client) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	switch *input.Key {
+	case "valid/key":
+		var contentLength int64 = 4
+		return &s3.GetObjectOutput{
+			Body:          io.NopCloser(strings.NewReader("test")),
+			ContentLength: &contentLength,
+		}, nil
+	case "invalid/key":
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "", nil)
+	case "valid/ranged/key", "valid/ranged/key/fails/part/2", "valid/ranged/key/out/of/order",
+		"valid/ranged/key/md5", "valid/ranged/key/parts", "valid/ranged/key/corrupted", "valid/ranged/key/interrupted/part/2":
+		var start, end int64
+		if _, err := fmt.Sscanf(aws.StringValue(input.Range), "bytes=%d-%d", &start, &end); err != nil {
+			return nil, fmt.Errorf("mockS3Client.GetObject got an unexpected range %s", aws.StringValue(input.Range))
+		}
+		etag := "mock-etag"
+		if mockETag, ok := mock_ranged_etags[*input.Key]; ok {
+			etag = mockETag
+		}
+		if aws.StringValue(input.IfMatch) != etag {
+			return nil, awserr.New("PreconditionFailed", "", nil)
+		}
+		partNum := int(start/multipart_upload_part_size) + 1
+
+		// bump number of calls
+		getobject_mutex.Lock()
+		num_calls := actual_ranged_getobject_calls[*input.Key]
+		num_calls[partNum-1] += 1
+		actual_ranged_getobject_calls[*input.Key] = num_calls
+		getobject_mutex.Unlock()
+
+		if *input.Key == "valid/ranged/key/fails/part/2" && partNum == 2 {
+			return nil, awserr.New("RequestTimeout", "", nil)
+		}
+
+		reader := &mockRangeReader{remaining: end - start + 1}
+		if *input.Key == "valid/ranged/key/out/of/order" {
+			// first range completes only after the last one
+			if partNum == 1 {
+				reader.wait = ranged_last_part_done
+			}
+			reader.done = func() {
+				getobject_mutex.Lock()
+				actual_ranged_completion_order = append(actual_ranged_completion_order, partNum)
+				getobject_mutex.Unlock()
+				if partNum == 3 {
+					close(ranged_last_part_done)
+				}
+			}
+		}
+		var body io.Reader = reader
+		if *input.Key == "valid/ranged/key/interrupted/part/2" && partNum == 2 && num_calls[1] == 1 {
+			/* the first attempt breaks off after a few bytes */
+			body = io.MultiReader(io.LimitReader(reader, 1000), iotest.ErrReader(errors.New("connection reset by peer")))
+		}
+		return &s3.GetObjectOutput{
+			Body:          io.NopCloser(body),
+			ContentLength: aws.Int64(end - start + 1),
+		}, nil
+	}
+	return nil, fmt.Errorf("mockS3Client.GetObject got an unexpected key %s", *input.Key)
+}
+
+func (m *mockS3Client) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	if *input.Key == "valid/stalled/key" {
+		// the body stops after the first bytes until the request is cancelled
+		return &s3.GetObjectOutput{
+			Body:          io.NopCloser(io.MultiReader(strings.NewReader("te"), &stalledReader{ctx})),
+			ContentLength: aws.Int64(4),
+		}, nil
+	}
+	return m.GetObject(input)
+}
+
+// stalledReader blocks until `ctx` is done and fails with its error.
+type stalledReader struct {
+	ctx aws.Context
+}
+
+func (sr *stalledReader) Read(p []byte) (int, error) {
+	<-sr.ctx.Done()
+	return 0, sr.ctx.Err()
+}
+
+func (m *mockS3Client) CopyObject(input *s3.CopyObjectInput) (*s3.CopyObjectOutput, error) {
+	switch *input.Key {
+	case "valid/copy/key":
+		if *input.CopySource != "test-bucket/valid/key%20with%20spaces" {
+			return nil, fmt.Errorf("mockS3Client.CopyObject got an unexpected source %s", *input.CopySource)
+		}
+		return &s3.CopyObjectOutput{}, nil
+	case "valid/copy/plus":
+		if *input.CopySource != "test-bucket/valid/a%2Bb%20c%23d" {
+			return nil, fmt.Errorf("mockS3Client.CopyObject got an unexpected source %s", *input.CopySource)
+		}
+		return &s3.CopyObjectOutput{}, nil
+	case "restricted/copy/key":
+		return nil, awserr.New("AccessDenied", "", nil)
+	}
+	return nil, fmt.Errorf("mockS3Client.CopyObject got an unexpected key %s", *input.Key)
+}
+
+func (m *mockS3Client) UploadPartCopy(input *s3.UploadPartCopyInput) (*s3.UploadPartCopyOutput, error) {
+	if *input.CopySource != "test-bucket/valid/copy/huge/source" || aws.StringValue(input.CopySourceIfMatch) != `"huge-etag"` {
+		return nil, fmt.Errorf("mockS3Client.UploadPartCopy got an unexpected source %s", *input.CopySource)
+	}
+	actual_copy_part_ranges = append(actual_copy_part_ranges, *input.CopySourceRange)
+	switch *input.Key {
+	case "valid/copy/huge":
+		return &s3.UploadPartCopyOutput{CopyPartResult: &s3.CopyPartResult{ETag: aws.String(fmt.Sprintf("part%d", *input.PartNumber))}}, nil
+	case "restricted/copy/huge":
+		return nil, awserr.New("AccessDenied", "", nil)
+	}
+	return nil, fmt.Errorf("mockS3Client.UploadPartCopy got an unexpected key %s", *input.Key)
+}
+
 func (m *mockS3Client) CreateMultipartUpload(input *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+	if strings.HasPrefix(*input.Key, test_concurrent_prefix) {
+		return &s3.CreateMultipartUploadOutput{Bucket: input.Bucket, Key: input.Key, UploadId: aws.String(*input.Key)}, nil
+	}
+	if *input.Key == "valid/new/multipart/key" {
+		actual_multipart_create_input = input
+	}
 	switch *input.Key {
-	case "valid/new/multipart/key", "valid/new/multipart/key/fails/all/parts":
+	case "valid/new/multipart/key", "valid/new/multipart/key/fails/all/parts",
+		"valid/new/multipart/key/complete/fails/twice", "valid/new/multipart/key/complete/fails/always",
+		"valid/new/multipart/key/pending", "valid/new/multipart/key/huge":
+		return &s3.CreateMultipartUploadOutput{Bucket: input.Bucket, Key: input.Key, UploadId: &expected_multipart_upload_id}, nil
+	case "valid/copy/huge", "restricted/copy/huge":
+		actual_copy_create_input = input
 		return &s3.CreateMultipartUploadOutput{Bucket: input.Bucket, Key: input.Key, UploadId: &expected_multipart_upload_id}, nil
 	case "invalid/server/response":
 		return &s3.CreateMultipartUploadOutput{}, nil
@@ -212,11 +632,25 @@ func (m *mockS3Client) CreateMultipartUpload(input *s3.CreateMultipartUploadInpu
 }
 
 func (m *mockS3Client) UploadPart(input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	if strings.HasPrefix(*input.Key, test_concurrent_prefix) {
+		// parts of concurrent uploads are not serialized
+		if *input.UploadId != *input.Key {
+			return nil, fmt.Errorf("mockS3Client.UploadPart got upload id %s for key %s", *input.UploadId, *input.Key)
+		}
+		etag := fmt.Sprintf("part%d", *input.PartNumber)
+		return &s3.UploadPartOutput{ETag: &etag}, readTwice(input.Body)
+	}
+
 	uploadpart_mutex.Lock()
 	defer uploadpart_mutex.Unlock()
 
 	switch *input.Key {
-	case "valid/new/multipart/key", "valid/new/multipart/key/fails/all/parts":
+	case "valid/new/multipart/key", "valid/new/multipart/key/fails/all/parts",
+		"valid/new/multipart/key/complete/fails/twice", "valid/new/multipart/key/complete/fails/always",
+		"valid/new/multipart/key/pending":
+		if mock_upload_part_hook != nil {
+			mock_upload_part_hook()
+		}
 		var buf []byte = make([]byte, *input.ContentLength)
 		var err error
 		var n int
@@ -247,13 +681,31 @@ func (m *mockS3Client) UploadPart(input *s3.UploadPartInput) (*s3.UploadPartOutp
 		// ETag
 		etag := fmt.Sprintf("part%d", *input.PartNumber)
 		return &s3.UploadPartOutput{ETag: &etag}, err
+	case "valid/new/multipart/key/huge":
+		// record the part size without reading the content
+		actual_multipart_part_sizes[*input.ContentLength] += 1
+		etag := fmt.Sprintf("part%d", *input.PartNumber)
+		return &s3.UploadPartOutput{ETag: &etag}, nil
 	case "restricted/new/multipart/key":
 		return &s3.UploadPartOutput{}, awserr.New("NotFound", "", nil)
 	}
 	return nil, fmt.Errorf("mockS3Client.UploadPart got an unexpected key %s", *input.Key)
 }
 
+func (m *mockS3Client) UploadPartWithContext(ctx aws.Context, input *s3.UploadPartInput, opts ...request.Option) (*s3.UploadPartOutput, error) {
+	return m.UploadPart(input)
+}
+
 func (m *mockS3Client) CompleteMultipartUpload(input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	if strings.HasPrefix(*input.Key, test_concurrent_prefix) {
+		for i, c := range input.MultipartUpload.Parts {
+			if *c.PartNumber != int64(i+1) || *c.ETag != fmt.Sprintf("part%d", i+1) {
+				return nil, awserr.New("InvalidPartOrder", "The list of parts was not in ascending order. Parts must be ordered by part number.", nil)
+			}
+		}
+		actual_concurrent_parts.Store(*input.Key, len(input.MultipartUpload.Parts))
+		return &s3.CompleteMultipartUploadOutput{}, nil
+	}
 	switch *input.Key {
 	case "valid/new/multipart/key":
 		for i, c := range input.MultipartUpload.Parts {
@@ -262,6 +714,29 @@ func (m *mockS3Client) CompleteMultipartUpload(input *s3.CompleteMultipartUpload
 			}
 		}
 		return &s3.CompleteMultipartUploadOutput{}, nil
+	case "valid/new/multipart/key/pending":
+		return &s3.CompleteMultipartUploadOutput{}, nil
+	case "valid/copy/huge":
+		for i, c := range input.MultipartUpload.Parts {
+			if *c.PartNumber != int64(i+1) || *c.ETag != fmt.Sprintf("part%d", i+1) {
+				return nil, awserr.New("InvalidPartOrder", "The list of parts was not in ascending order. Parts must be ordered by part number.", nil)
+			}
+		}
+		return &s3.CompleteMultipartUploadOutput{}, nil
+	case "valid/new/multipart/key/complete/fails/twice":
+		actual_multipart_complete_calls[*input.Key] += 1
+		if actual_multipart_complete_calls[*input.Key] <= 2 {
+			return nil, awserr.New("InternalError", "An internal error occurred.", nil)
+		}
+		return &s3.CompleteMultipartUploadOutput{}, nil
+	case "valid/new/multipart/key/huge":
+		if len(input.MultipartUpload.Parts) > multipart_upload_max_parts {
+			return nil, awserr.New("InvalidArgument", "Part number must be an integer between 1 and 10000, inclusive", nil)
+		}
+		return &s3.CompleteMultipartUploadOutput{}, nil
+	case "valid/new/multipart/key/complete/fails/always":
+		actual_multipart_complete_calls[*input.Key] += 1
+		return nil, awserr.New("InternalError", "An internal error occurred.", nil)
 	case "restricted/new/multipart/key":
 		return &s3.CompleteMultipartUploadOutput{}, awserr.New("AccessDenied", "", nil)
 	}
@@ -272,16 +747,156 @@ func (m *mockS3Client) AbortMultipartUpload(input *s3.AbortMultipartUploadInput)
 	switch *input.Key {
 	case "valid/new/multipart/key/fails/all/parts":
 		return &s3.AbortMultipartUploadOutput{}, nil
+	case "restricted/copy/huge":
+		actual_copy_aborted = true
+		return &s3.AbortMultipartUploadOutput{}, nil
 	}
 	return nil, fmt.Errorf("mockS3Client.AbortMultipartUpload got an unexpected key %s", *input.Key)
 }
 
+func (m *mockS3Client) ListParts(input *s3.ListPartsInput) (*s3.ListPartsOutput, error) {
+	switch *input.Key {
+	case "valid/new/multipart/key/complete/fails/always":
+		// return parts in two pages
+		var first int64 = aws.Int64Value(input.PartNumberMarker) + 1
+		var last int64 = first + 1
+		if last > 2 {
+			last = 2
+		}
+		var parts []*s3.Part
+		for partNum := first; partNum <= last; partNum++ {
+			parts = append(parts, &s3.Part{
+				ETag:       aws.String(fmt.Sprintf("part%d", partNum)),
+				PartNumber: aws.Int64(partNum),
+			})
+		}
+		return &s3.ListPartsOutput{
+			Parts:                parts[:1],
+			IsTruncated:          aws.Bool(first < 2),
+			NextPartNumberMarker: aws.Int64(first),
+		}, nil
+	}
+	return nil, fmt.Errorf("mockS3Client.ListParts got an unexpected key %s", *input.Key)
+}
+
+// helper function: read `body` twice to emulate signing & upload
+func readTwice(body io.ReadSeeker) error {
+	if _, err := io.Copy(io.Discard, body); err != nil {
+		return err
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.Copy(io.Discard, body)
+	return err
+}
+
 // helper function
 func setupB2Backend() *B2Backend {
 	return &B2Backend{
 		&mockS3Client{},
 		&DummyProgressReporter{},
+		multipart_upload_max_concurent,
+		"",
+		new(sync.Map),
+		0,
+		0,
+		0,
+		0,
+		0600,
+		false,
+		func(time.Duration) {},
+		0,
+		nil,
+	}
+}
+
+// stallingS3Client is a mockS3Client whose first attempt to upload part #1 pauses while the
+// part is read for signing and stops reading it halfway through sending it, until the
+// attempt is cancelled.
+type stallingS3Client struct {
+	mockS3Client
+	// receive a value once the first attempt pauses signing and stops sending the part,
+	// signing resumes once resumeSigning is closed
+	signingPaused, sendingStalled chan struct{}
+	resumeSigning                 chan struct{}
+	// number of attempts to upload part #1 and whether the first one was cancelled
+	// while it was signed
+	attempts         atomic.Int64
+	cancelledSigning atomic.Bool
+}
+
+func (ssc *stallingS3Client) UploadPartWithContext(ctx aws.Context, input *s3.UploadPartInput, opts ...request.Option) (*s3.UploadPartOutput, error) {
+	etag := fmt.Sprintf("part%d", *input.PartNumber)
+	if *input.PartNumber != 1 || ssc.attempts.Add(1) > 1 {
+		return &s3.UploadPartOutput{ETag: &etag}, readTwice(input.Body)
+	}
+
+	/* signing reads the whole part */
+	half := make([]byte, *input.ContentLength/2)
+	if _, err := io.ReadFull(input.Body, half); err != nil {
+		return nil, err
+	}
+	ssc.signingPaused <- struct{}{}
+	<-ssc.resumeSigning
+	ssc.cancelledSigning.Store(ctx.Err() != nil)
+	if _, err := io.Copy(io.Discard, input.Body); err != nil {
+		return nil, err
+	}
+
+	/* sending stops halfway through */
+	if _, err := input.Body.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(input.Body, half); err != nil {
+		return nil, err
+	}
+	ssc.sendingStalled <- struct{}{}
+	<-ctx.Done()
+	return nil, awserr.New(request.CanceledErrorCode, "request context canceled", ctx.Err())
+}
+
+// stallClock is a fake clock for stall detection, channels returned by after receive the
+// time once advance is called.
+type stallClock struct {
+	lock    sync.Mutex
+	waiting []chan time.Time
+	ticks   int
+}
+
+func (sc *stallClock) after(d time.Duration) <-chan time.Time {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	tick := make(chan time.Time, 1)
+	sc.waiting = append(sc.waiting, tick)
+	return tick
+}
+
+// advance fires the channels returned so far, it returns the number of channels fired.
+func (sc *stallClock) advance() int {
+	sc.lock.Lock()
+	defer sc.lock.Unlock()
+	for _, tick := range sc.waiting {
+		tick <- time.Time{}
 	}
+	fired := len(sc.waiting)
+	sc.ticks += fired
+	sc.waiting = nil
+	return fired
+}
+
+// describingReporter is a DummyProgressReporter recording task descriptions.
+type describingReporter struct {
+	DummyProgressReporter
+	lock         sync.Mutex
+	descriptions []string
+}
+
+func (dr *describingReporter) DescribeTask(index int, description string) error {
+	dr.lock.Lock()
+	defer dr.lock.Unlock()
+	dr.descriptions = append(dr.descriptions, description)
+	return nil
 }
 
 /* test cases for progressSectionReader */
@@ -318,10 +933,45 @@ func TestProgressSectionReader(t *testing.T) {
 	}
 }
 
+func TestProgressSectionReaderSending(t *testing.T) {
+	data := []byte("test")
+
+	/* parts without checksums are read once for signing before they are sent */
+	psr := newProgressSectionReader(io.NewSectionReader(bytes.NewReader(data), 0, 4), nil, 1)
+	psr.startAttempt()
+	buf := make([]byte, 2)
+	for _, expected := range []struct {
+		read    int64
+		sending bool
+	}{{2, false}, {4, true}, {6, true}, {8, false}} {
+		if expected.read == 6 {
+			_, _ = psr.Seek(0, io.SeekStart)
+		}
+		if _, err := psr.Read(buf); err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		read, sending := psr.sending()
+		assertEquals(t, expected.read, read, "read")
+		assertEquals(t, expected.sending, sending, fmt.Sprintf("sending after %d bytes", read))
+	}
+
+	/* parts with checksums are sent right away */
+	psr = newProgressPartReader(newBufferedPart(io.NewSectionReader(bytes.NewReader(data), 0, 4)), nil, 1)
+	psr.startAttempt()
+	_, sending := psr.sending()
+	assertEquals(t, false, sending, "sending before checksums")
+	if _, _, err := psr.checksums(); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	_, sending = psr.sending()
+	assertEquals(t, true, sending, "sending after checksums")
+}
+
 /* test cases for CreateB2Backend */
 func TestCreateB2Backend(t *testing.T) {
 	cfg := new(Config)
 	cfg.S3.Region = "mock-region"
+	cfg.S3.PathStyle = true
 	cfg.S3.ID = "mock-id"
 	cfg.S3.Secret = "mock-secret"
 	cfg.S3.Token = "mock-token"
@@ -334,307 +984,1623 @@ func TestCreateB2Backend(t *testing.T) {
 		// assertEquals(t, "mock-token", *s3Client.Config.Credentials.SessionToken, "aws.Config.Credentials.SessionToken")
 	}
 
+	b2 := CreateB2Backend(cfg)
+	assertEquals(t, 1, b2.maxDownloads, "b2.maxDownloads")
+
+	cfg.S3.MaxConcurrentDownloads = 8
+	b2 = CreateB2Backend(cfg)
+	assertEquals(t, 8, b2.maxDownloads, "b2.maxDownloads")
+
+	/* HTTP client settings */
+	cfg.S3.RequestTimeoutSeconds = 120
+	cfg.S3.ConnectTimeoutSeconds = 2.5
+	cfg.S3.MaxIdleConns = 32
+	cfg.S3.MaxRetries = 7
+	checkS3Client = func(s3Client *s3.S3) {
+		assertEquals(t, 7, *s3Client.Config.MaxRetries, "aws.Config.MaxRetries")
+		assertEquals(t, time.Duration(0), s3Client.Config.HTTPClient.Timeout, "http.Client.Timeout")
+		transport, ok := s3Client.Config.HTTPClient.Transport.(*http.Transport)
+		if !ok {
+			t.Fatalf("unexpected transport type %T", s3Client.Config.HTTPClient.Transport)
+		}
+		assertEquals(t, 120*time.Second, transport.ResponseHeaderTimeout, "http.Transport.ResponseHeaderTimeout")
+		assertEquals(t, 2500*time.Millisecond, transport.TLSHandshakeTimeout, "http.Transport.TLSHandshakeTimeout")
+		assertEquals(t, 32, transport.MaxIdleConns, "http.Transport.MaxIdleConns")
+		assertEquals(t, 32, transport.MaxIdleConnsPerHost, "http.Transport.MaxIdleConnsPerHost")
+	}
 	_ = CreateB2Backend(cfg)
-}
 
-/* test cases for handleError */
-func TestB2HandleErrorAWSError(t *testing.T) {
-	tests := map[string]string{
-		"NotFound":             ErrFileNotFound,
-		s3.ErrCodeNoSuchBucket: ErrFileNotFound,
-		s3.ErrCodeNoSuchKey:    ErrFileNotFound,
-		"AccessDenied":         ErrAccessDenied,
-		"MissingRegion":        ErrInvalidConfig,
-		"EmptyStaticCreds":     ErrInvalidConfig,
-		"UnknownError":         "unknown B2 error (UnknownError: ).",
+	/* endpoint template, e.g. of a custom domain per region */
+	cfg.S3.EndpointTemplate = "https://b2-{region}.example.com/"
+	checkS3Client = func(s3Client *s3.S3) {
+		assertEquals(t, "https://b2-mock-region.example.com", *s3Client.Config.Endpoint, "aws.Config.Endpoint")
 	}
+	_ = CreateB2Backend(cfg)
 
-	// Iterate over all keys in a sorted order
-	for key, val := range tests {
-		t.Run(key, func(t *testing.T) {
-			assertEquals(t, val, handleError(awserr.New(key, "", nil)).Error(), "err.Error")
-		})
+	/* custom endpoint, e.g. of a local MinIO server, takes precedence over the template */
+	cfg.S3.Endpoint = "http://localhost:9000/"
+	checkS3Client = func(s3Client *s3.S3) {
+		assertEquals(t, "http://localhost:9000", *s3Client.Config.Endpoint, "aws.Config.Endpoint")
+		assertEquals(t, true, *s3Client.Config.S3ForcePathStyle, "aws.Config.S3ForcePathStyle")
+	}
+	_ = CreateB2Backend(cfg)
+
+	/* virtual-hosted style requests */
+	cfg.S3.PathStyle = false
+	checkS3Client = func(s3Client *s3.S3) {
+		assertEquals(t, false, *s3Client.Config.S3ForcePathStyle, "aws.Config.S3ForcePathStyle")
 	}
+	_ = CreateB2Backend(cfg)
+
+	checkS3Client = nil
 }
 
-/* test cases for B2Backend.GetFileInfo */
-func TestB2GetFileInfoValidKey(t *testing.T) {
+func TestB2HTTPClientTimeout(t *testing.T) {
 	// Setup Test
-	mockB2 := &B2Backend{
-		&mockS3Client{},
-		&DummyProgressReporter{},
-	}
-	mockURI, err := url.ParseRequestURI("b2://test-bucket/valid/key")
-	if err != nil {
-		t.Fatalf(err.Error())
-	}
+	release := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
 
-	// Perform the test
-	fileinfo, err := mockB2.GetFileInfo(mockURI)
+	cfg := new(Config)
+	cfg.S3.RequestTimeoutSeconds = 0.05
+	cfg.S3.ConnectTimeoutSeconds = 1
 
-	if fileinfo == nil || err != nil {
-		t.Fatalf("unexpected test result: %+v, %+v", fileinfo, err)
-	} else {
-		assertEquals(t, "valid/key", fileinfo.name, "fileinfo.name")
-		assertEquals(t, uint64(0), fileinfo.size, "fileinfo.size")
-		assertEquals(t, time.Unix(0, 0).UTC(), fileinfo.modified, "fileinfo.modified")
-		assertEquals(t, true, fileinfo.isfile, "fileinfo.isfile")
+	// Perform the test
+	start := time.Now()
+	_, err := newB2HTTPClient(cfg).Get(server.URL)
+	if err == nil {
+		t.Fatalf("request was supposed to time out")
 	}
+	assertEquals(t, true, strings.Contains(err.Error(), "timeout awaiting response headers"), "err.Error")
+	assertEquals(t, true, time.Since(start) < 5*time.Second, "elapsed")
 }
 
-func TestB2GetFileInfoValidPrefix(t *testing.T) {
+func TestB2HTTPClientSlowBody(t *testing.T) {
 	// Setup Test
-	mockB2 := setupB2Backend()
-	mockURI, err := url.ParseRequestURI("b2://test-bucket/valid/prefix/")
-	if err != nil {
-		t.Fatalf(err.Error())
-	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "4")
+		w.WriteHeader(http.StatusOK)
+		for _, b := range []byte("test") {
+			_, _ = w.Write([]byte{b})
+			w.(http.Flusher).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}))
+	defer server.Close()
 
-	// Perform the test
-	fileinfo, err := mockB2.GetFileInfo(mockURI)
+	cfg := new(Config)
+	cfg.S3.RequestTimeoutSeconds = 0.05
+	cfg.S3.ConnectTimeoutSeconds = 1
 
-	if fileinfo == nil || err != nil {
-		t.Fatalf("unexpected test result: %+v, %+v", fileinfo, err)
-	} else {
-		assertEquals(t, "valid/prefix/", fileinfo.name, "fileinfo.name")
-		assertEquals(t, uint64(3), fileinfo.size, "fileinfo.size")
-		assertEquals(t, time.Unix(2, 0).UTC(), fileinfo.modified, "fileinfo.modified")
-		assertEquals(t, false, fileinfo.isfile, "fileinfo.isfile")
+	// Perform the test
+	/* a body taking longer than the request timeout is read completely */
+	resp, err := newB2HTTPClient(cfg).Get(server.URL)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
 	}
+	assertEquals(t, "test", string(body), "body")
 }
 
-func TestB2GetFileInfoInvalidKey(t *testing.T) {
+func TestB2RetrieveFileStall(t *testing.T) {
 	// Setup Test
+	clock := &stallClock{}
 	mockB2 := setupB2Backend()
-	mockURI, err := url.ParseRequestURI("b2://test-bucket/invalid/key")
-	if err != nil {
-		t.Fatalf(err.Error())
-	}
+	mockB2.stallTimeout = time.Minute
+	mockB2.after = clock.after
+	mockURI, _ := url.ParseRequestURI("b2://test-bucket/valid/stalled/key")
 
 	// Perform the test
-	fileinfo, err := mockB2.GetFileInfo(mockURI)
+	errs := make(chan error, 1)
+	go func() {
+		var buf bytes.Buffer
+		errs <- mockB2.RetrieveFile(&buf, mockURI)
+	}()
 
-	if fileinfo != nil || err == nil {
-		t.Fatalf("unexpected test result: GetFileInfo was supposed to fail, but instead returned %+v, %+v", fileinfo, err)
-	} else {
-		assertEquals(t, ErrFileNotFound, err.Error(), "err.Error")
+	/* the stalled download is cancelled */
+	var err error
+	for finished := false; !finished; {
+		select {
+		case err = <-errs:
+			finished = true
+		default:
+			clock.advance()
+			time.Sleep(time.Millisecond)
+		}
 	}
+	if err == nil {
+		t.Fatalf("This test should throw an error")
+	}
+	assertEquals(t, `download of "valid/stalled/key" stalled: no progress for 1m0s`, err.Error(), "err.Error")
+}
+
+/* test cases for proxy support */
+func TestB2Proxy(t *testing.T) {
+	// Setup Test
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "direct")
+	}))
+	defer target.Close()
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !r.URL.IsAbs() || r.Header.Get("Proxy-Authorization") != "Basic dXNlcjpwYXNz" {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		_, _ = io.WriteString(w, "proxied")
+	}))
+	defer proxy.Close()
+
+	proxyUri, _ := url.Parse(proxy.URL)
+	cfg := new(Config)
+	cfg.S3.ProxyURL = "http://user:pass@" + proxyUri.Host
+	t.Setenv("NO_PROXY", "")
+	t.Setenv("no_proxy", "")
+
+	get := func() string {
+		resp, err := newB2HTTPClient(cfg).Get(target.URL)
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	// Perform the test
+	assertEquals(t, "proxied", get(), "request through proxy")
+
+	/* NO_PROXY exclusions */
+	t.Setenv("NO_PROXY", "example.com,127.0.0.0/8")
+	assertEquals(t, "direct", get(), "request excluded by NO_PROXY")
+
+	/* proxy of the B2 endpoint */
+	t.Setenv("NO_PROXY", "")
+	b2 := CreateB2Backend(cfg)
+	reported, err := b2.Proxy()
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "http://user:xxxxx@"+proxyUri.Host, reported.Redacted(), "b2.Proxy")
+
+	t.Setenv("NO_PROXY", ".backblazeb2.com")
+	reported, err = b2.Proxy()
+	if err != nil || reported != nil {
+		t.Fatalf("unexpected test result: %+v, %+v", reported, err)
+	}
+
+	/* invalid proxy URL fails requests */
+	cfg.S3.ProxyURL = "ftp://proxy"
+	_, err = CreateB2Backend(cfg).Proxy()
+	if err == nil {
+		t.Fatalf("This test should throw an error")
+	}
+	assertEquals(t, `invalid proxy URL "ftp://proxy": unsupported scheme "ftp"`, err.Error(), "err.Error")
+}
+
+func TestB2BypassProxy(t *testing.T) {
+	for _, testCase := range []struct {
+		host, noProxy string
+		expected      bool
+	}{
+		{"s3.eu.backblazeb2.com", "", false},
+		{"s3.eu.backblazeb2.com", "*", true},
+		{"s3.eu.backblazeb2.com", "backblazeb2.com", true},
+		{"backblazeb2.com", "backblazeb2.com", true},
+		{"s3.eu.backblazeb2.com", ".backblazeb2.com", true},
+		{"backblazeb2.com", ".backblazeb2.com", false},
+		{"s3.eu.backblazeb2.com:443", "example.com, BackBlazeB2.com", true},
+		{"notbackblazeb2.com", "backblazeb2.com", false},
+		{"10.1.2.3:8080", "10.0.0.0/8", true},
+		{"192.168.1.1", "10.0.0.0/8", false},
+		{"192.168.1.1", "192.168.1.1:3128", true},
+	} {
+		assertEquals(t, testCase.expected, bypassProxy(testCase.host, testCase.noProxy), fmt.Sprintf("bypassProxy(%q, %q)", testCase.host, testCase.noProxy))
+	}
+}
+
+func TestParseProxyURLInvalid(t *testing.T) {
+	for _, testCase := range []struct{ proxyURL, expected string }{
+		{"proxy:3128", `invalid proxy URL "proxy:3128": unsupported scheme "proxy"`},
+		{"http://", `invalid proxy URL "http:": missing host`},
+		{"http://proxy:port", `invalid proxy URL: parse "http://proxy:port": invalid port ":port" after host`},
+	} {
+		if _, err := ParseProxyURL(testCase.proxyURL); err == nil {
+			t.Fatalf("This test should throw an error")
+		} else {
+			assertEquals(t, testCase.expected, err.Error(), "ParseProxyURL("+testCase.proxyURL+")")
+		}
+	}
+}
+
+func TestParseEndpointURLInvalid(t *testing.T) {
+	for _, testCase := range []struct{ endpoint, expected string }{
+		{"localhost:9000", `invalid endpoint URL "localhost:9000": unsupported scheme "localhost"`},
+		{"ftp://minio", `invalid endpoint URL "ftp://minio": unsupported scheme "ftp"`},
+		{"https://", `invalid endpoint URL "https:": missing host`},
+		{"http://minio:port", `invalid endpoint URL: parse "http://minio:port": invalid port ":port" after host`},
+	} {
+		if _, err := parseEndpointURL(testCase.endpoint); err == nil {
+			t.Fatalf("This test should throw an error")
+		} else {
+			assertEquals(t, testCase.expected, err.Error(), "parseEndpointURL("+testCase.endpoint+")")
+		}
+	}
+}
+
+/* test cases for handleError */
+func TestB2HandleErrorAWSError(t *testing.T) {
+	tests := map[string]string{
+		"NotFound":              ErrFileNotFound,
+		s3.ErrCodeNoSuchBucket:  ErrBucketNotFound,
+		s3.ErrCodeNoSuchKey:     ErrFileNotFound,
+		"AccessDenied":          ErrAccessDenied,
+		"InvalidAccessKeyId":    ErrInvalidCredentials,
+		"SignatureDoesNotMatch": ErrInvalidCredentials,
+		"MissingRegion":         ErrInvalidConfig,
+		"EmptyStaticCreds":      ErrInvalidConfig,
+		"UnknownError":          "unknown B2 error (UnknownError: ).",
+	}
+
+	// Iterate over all keys in a sorted order
+	for key, val := range tests {
+		t.Run(key, func(t *testing.T) {
+			assertEquals(t, val, handleError(awserr.New(key, "", nil)).Error(), "err.Error")
+		})
+	}
+}
+
+/* test cases for B2Backend.GetFileInfo */
+func TestB2GetFileInfoValidKey(t *testing.T) {
+	// Setup Test
+	mockB2 := setupB2Backend()
+	mockURI, err := url.ParseRequestURI("b2://test-bucket/valid/key")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Perform the test
+	fileinfo, err := mockB2.GetFileInfo(mockURI)
+
+	if fileinfo == nil || err != nil {
+		t.Fatalf("unexpected test result: %+v, %+v", fileinfo, err)
+	} else {
+		assertEquals(t, "valid/key", fileinfo.name, "fileinfo.name")
+		assertEquals(t, uint64(0), fileinfo.size, "fileinfo.size")
+		assertEquals(t, time.Unix(0, 0).UTC(), fileinfo.modified, "fileinfo.modified")
+		assertEquals(t, true, fileinfo.isfile, "fileinfo.isfile")
+		assertEquals(t, "b2://test-bucket/valid/key", fileinfo.URI().String(), "fileinfo.URI")
+		assertEquals(t, `"valid-key-etag"`, fileinfo.ETag(), "fileinfo.ETag")
+		assertEquals(t, "STANDARD", fileinfo.StorageClass(), "fileinfo.StorageClass")
+	}
+}
+
+func TestB2GetFileInfoValidPrefix(t *testing.T) {
+	// Setup Test
+	mockB2 := setupB2Backend()
+	mockURI, err := url.ParseRequestURI("b2://test-bucket/valid/prefix/")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Perform the test
+	fileinfo, err := mockB2.GetFileInfo(mockURI)
+
+	if fileinfo == nil || err != nil {
+		t.Fatalf("unexpected test result: %+v, %+v", fileinfo, err)
+	} else {
+		assertEquals(t, "valid/prefix/", fileinfo.name, "fileinfo.name")
+		assertEquals(t, uint64(3), fileinfo.size, "fileinfo.size")
+		assertEquals(t, time.Unix(2, 0).UTC(), fileinfo.modified, "fileinfo.modified")
+		assertEquals(t, false, fileinfo.isfile, "fileinfo.isfile")
+		assertEquals(t, "b2://test-bucket/valid/prefix/", fileinfo.URI().String(), "fileinfo.URI")
+		assertEquals(t, "", fileinfo.ETag(), "fileinfo.ETag")
+		assertEquals(t, "", fileinfo.StorageClass(), "fileinfo.StorageClass")
+	}
+}
+
+func TestB2GetFileInfoBucketRoot(t *testing.T) {
+	// Setup Test
+	mockB2 := setupB2Backend()
+
+	// Perform the test
+	for _, rawURI := range []string{"b2://test-bucket", "b2://test-bucket/"} {
+		mockURI, err := url.ParseRequestURI(rawURI)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		/* the bucket root is a directory holding every object */
+		fileinfo, err := mockB2.GetFileInfo(mockURI)
+		if fileinfo == nil || err != nil {
+			t.Fatalf("unexpected test result: %+v, %+v", fileinfo, err)
+		}
+		assertEquals(t, "", fileinfo.name, "fileinfo.name")
+		assertEquals(t, uint64(7), fileinfo.size, "fileinfo.size")
+		assertEquals(t, time.Unix(3, 0).UTC(), fileinfo.modified, "fileinfo.modified")
+		assertEquals(t, false, fileinfo.isfile, "fileinfo.isfile")
+		assertEquals(t, "b2://test-bucket/", fileinfo.URI().String(), "fileinfo.URI")
+	}
+}
+
+func TestB2GetFileInfoInvalidKey(t *testing.T) {
+	// Setup Test
+	mockB2 := setupB2Backend()
+	mockURI, err := url.ParseRequestURI("b2://test-bucket/invalid/key")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Perform the test
+	fileinfo, err := mockB2.GetFileInfo(mockURI)
+
+	if fileinfo != nil || err == nil {
+		t.Fatalf("unexpected test result: GetFileInfo was supposed to fail, but instead returned %+v, %+v", fileinfo, err)
+	} else {
+		assertEquals(t, ErrFileNotFound, err.Error(), "err.Error")
+	}
+}
+
+func TestB2GetFileInfoInvalidPrefix(t *testing.T) {
+	// Setup Test
+	mockB2 := setupB2Backend()
+	mockURI, err := url.ParseRequestURI("b2://test-bucket/invalid/prefix/")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Perform the test
+	fileinfo, err := mockB2.GetFileInfo(mockURI)
+
+	if fileinfo != nil || err == nil {
+		t.Fatalf("unexpected test result: GetFileInfo was supposed to fail, but instead returned %+v, %+v", fileinfo, err)
+	} else {
+		assertEquals(t, ErrFileNotFound, err.Error(), "err.Error")
+	}
+}
+
+func TestB2GetFileInfoRestrictedPrefix(t *testing.T) {
+	// Setup Test
+	mockB2 := setupB2Backend()
+	mockURI, err := url.ParseRequestURI("b2://test-bucket/restricted/prefix/")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Perform the test
+	fileinfo, err := mockB2.GetFileInfo(mockURI)
+
+	if fileinfo != nil || err == nil {
+		t.Fatalf("unexpected test result: GetFileInfo was supposed to fail, but instead returned %+v, %+v", fileinfo, err)
+	} else {
+		assertEquals(t, ErrAccessDenied, err.Error(), "err.Error")
+	}
+}
+
+func TestB2GetFileInfoInvalidKeySize(t *testing.T) {
+	// Setup Test
+	mockB2 := setupB2Backend()
+	mockURI, err := url.ParseRequestURI("b2://test-bucket/invalid/key/size")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Perform the test
+	fileinfo, err := mockB2.GetFileInfo(mockURI)
+
+	if fileinfo != nil || err == nil {
+		t.Fatalf("unexpected test result: GetFileInfo was supposed to fail, but instead returned %+v, %+v", fileinfo, err)
+	} else {
+		assertEquals(t, "invalid file info", err.Error(), "err.Error")
+	}
+}
+
+/* test cases for B2Backend.ListFiles */
+func TestB2ListFilesValidPrefix(t *testing.T) {
+	// Setup Test
+	mockB2 := setupB2Backend()
+	mockURI, err := url.ParseRequestURI("b2://test-bucket/valid/prefix/")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Perform the test
+	fileinfo, err := mockB2.ListFiles(mockURI)
+
+	if fileinfo == nil || err != nil {
+		t.Fatalf("unexpected test result: %+v, %+v", fileinfo, err)
+	} else {
+		assertEquals(t, 2, len(fileinfo), "len(fileinfo)")
+
+		assertEquals(t, "valid/prefix/key1", fileinfo[0].name, "fileinfo[0].name")
+		assertEquals(t, uint64(1), fileinfo[0].size, "fileinfo[0].size")
+		assertEquals(t, time.Unix(1, 0).UTC(), fileinfo[0].modified, "fileinfo[0].modified")
+		assertEquals(t, true, fileinfo[0].isfile, "fileinfo[0].isfile")
+		assertEquals(t, "b2://test-bucket/valid/prefix/key1", fileinfo[0].URI().String(), "fileinfo[0].URI")
+		assertEquals(t, `"key1-etag"`, fileinfo[0].ETag(), "fileinfo[0].ETag")
+		assertEquals(t, "STANDARD", fileinfo[0].StorageClass(), "fileinfo[0].StorageClass")
+
+		assertEquals(t, "valid/prefix/key2", fileinfo[1].name, "fileinfo[1].name")
+		assertEquals(t, uint64(2), fileinfo[1].size, "fileinfo[1].size")
+		assertEquals(t, time.Unix(2, 0).UTC(), fileinfo[1].modified, "fileinfo[1].modified")
+		assertEquals(t, true, fileinfo[1].isfile, "fileinfo[1].isfile")
+		assertEquals(t, "b2://test-bucket/valid/prefix/key2", fileinfo[1].URI().String(), "fileinfo[1].URI")
+		assertEquals(t, `"key2-etag"`, fileinfo[1].ETag(), "fileinfo[1].ETag")
+		assertEquals(t, "GLACIER", fileinfo[1].StorageClass(), "fileinfo[1].StorageClass")
+	}
+}
+
+func TestB2Probe(t *testing.T) {
+	// Setup Test
+	mockB2 := setupB2Backend()
+
+	/* listing the prefix succeeds, also if it holds no objects */
+	for _, rawURI := range []string{"b2://test-bucket/valid/prefix/", "b2://test-bucket/invalid/prefix/"} {
+		mockURI, _ := url.ParseRequestURI(rawURI)
+		result, err := mockB2.Probe(mockURI)
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		assertEquals(t, "", result.Endpoint, "result.Endpoint")
+		assertEquals(t, true, result.Latency >= 0, "result.Latency")
+	}
+
+	/* access and bucket errors are reported */
+	for _, testCase := range []struct{ uri, expected string }{
+		{"b2://test-bucket/restricted/prefix/", ErrAccessDenied},
+		{"b2://test-bucket/missing/bucket/", ErrBucketNotFound},
+	} {
+		mockURI, _ := url.ParseRequestURI(testCase.uri)
+		if _, err := mockB2.Probe(mockURI); err == nil {
+			t.Fatalf("This test should throw an error")
+		} else {
+			assertEquals(t, testCase.expected, err.Error(), "err.Error")
+		}
+	}
+
+	/* endpoint and region are taken from the client */
+	cfg := new(Config)
+	cfg.S3.Region = "eu-central-003"
+	s3Client, _ := CreateB2Backend(cfg).S3API.(*s3.S3)
+	assertEquals(t, "https://s3.eu-central-003.backblazeb2.com", aws.StringValue(s3Client.Config.Endpoint), "Config.Endpoint")
+}
+
+func TestB2ListFilesSorted(t *testing.T) {
+	// Setup Test
+	mockB2 := setupB2Backend()
+	mockURI, err := url.ParseRequestURI("b2://test-bucket/unsorted/prefix/")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Perform the test
+	fileinfo, err := mockB2.ListFiles(mockURI)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v, %+v", fileinfo, err)
+	}
+	assertEquals(t, 3, len(fileinfo), "len(fileinfo)")
+	assertEquals(t, "unsorted/prefix/key1", fileinfo[0].name, "fileinfo[0].name")
+	assertEquals(t, "unsorted/prefix/key10", fileinfo[1].name, "fileinfo[1].name")
+	assertEquals(t, "unsorted/prefix/key2", fileinfo[2].name, "fileinfo[2].name")
+}
+
+func TestB2ListFilesBucketRoot(t *testing.T) {
+	// Setup Test
+	mockB2 := setupB2Backend()
+
+	// Perform the test
+	for _, rawURI := range []string{"b2://test-bucket", "b2://test-bucket/"} {
+		mockURI, err := url.ParseRequestURI(rawURI)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		/* every page of the whole bucket is listed */
+		fileinfo, err := mockB2.ListFiles(mockURI)
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v, %+v", fileinfo, err)
+		}
+		assertEquals(t, 3, len(fileinfo), "len(fileinfo)")
+		assertEquals(t, "another-key", fileinfo[0].name, "fileinfo[0].name")
+		assertEquals(t, "b2://test-bucket/another-key", fileinfo[0].URI().String(), "fileinfo[0].URI")
+		assertEquals(t, "nested/key", fileinfo[1].name, "fileinfo[1].name")
+		assertEquals(t, "b2://test-bucket/nested/key", fileinfo[1].URI().String(), "fileinfo[1].URI")
+		assertEquals(t, "root-key", fileinfo[2].name, "fileinfo[2].name")
+		assertEquals(t, "b2://test-bucket/root-key", fileinfo[2].URI().String(), "fileinfo[2].URI")
+	}
+}
+
+func TestB2ListFilesInvalidPrefix(t *testing.T) {
+	// Setup Test
+	mockB2 := setupB2Backend()
+	mockURI, err := url.ParseRequestURI("b2://test-bucket/invalid/prefix/")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Perform the test
+	fileinfo, err := mockB2.ListFiles(mockURI)
+
+	if fileinfo != nil || err == nil {
+		t.Fatalf("unexpected test result: ListFiles was supposed to fail, but instead returned %+v, %+v", fileinfo, err)
+	} else {
+		assertEquals(t, ErrFileNotFound, err.Error(), "err.Error")
+	}
+}
+
+func TestB2ListFilesRestrictedPrefix(t *testing.T) {
+	// Setup Test
+	mockB2 := setupB2Backend()
+	mockURI, err := url.ParseRequestURI("b2://test-bucket/restricted/prefix/")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Perform the test
+	fileinfo, err := mockB2.ListFiles(mockURI)
+
+	if fileinfo != nil || err == nil {
+		t.Fatalf("unexpected test result: ListFiles was supposed to fail, but instead returned %+v, %+v", fileinfo, err)
+	} else {
+		assertEquals(t, ErrAccessDenied, err.Error(), "err.Error")
+	}
+}
+
+func TestB2ListFilesLimit(t *testing.T) {
+	// Setup Test
+	mockB2 := setupB2Backend()
+	mockURI, err := url.ParseRequestURI("b2://test-bucket/unsorted/prefix/")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Perform the test
+	fileinfo, err := mockB2.ListFilesLimit(mockURI, 1)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v, %+v", fileinfo, err)
+	}
+	assertEquals(t, 1, len(fileinfo), "len(fileinfo)")
+	assertEquals(t, "unsorted/prefix/key1", fileinfo[0].name, "fileinfo[0].name")
+
+	/* errors are handled like those of ListFiles */
+	mockURI, _ = url.ParseRequestURI("b2://test-bucket/restricted/prefix/")
+	if _, err = mockB2.ListFilesLimit(mockURI, 1); err == nil {
+		t.Fatalf("This test should throw an error")
+	} else {
+		assertEquals(t, ErrAccessDenied, err.Error(), "err.Error")
+	}
+}
+
+/* test cases for B2Backend.StoreFile */
+func TestB2StoreFileValidKey(t *testing.T) {
+	// Setup Test
+	mockB2 := setupB2Backend()
+	mockURI, err := url.ParseRequestURI("b2://test-bucket/valid/new/key")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Perform the test
+	data := []byte("test")
+	err = mockB2.StoreFile(context.Background(), StoreRequest{URI: mockURI, BodyAt: bytes.NewReader(data), Length: 4})
+
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+}
+
+func TestB2StoreFileRequestOptions(t *testing.T) {
+	// Setup Test
+	mockB2 := setupB2Backend()
+	mockURI, err := url.ParseRequestURI("b2://test-bucket/valid/new/options/key")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Perform the test
+	err = mockB2.StoreFile(context.Background(), StoreRequest{
+		URI:          mockURI,
+		BodyAt:       bytes.NewReader([]byte("test")),
+		Length:       4,
+		Metadata:     map[string]string{"source": "/home"},
+		StorageClass: "STANDARD_IA",
+		ContentType:  ContentTypeAge,
+	})
+
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "/home", aws.StringValue(actual_options_put_input.Metadata["source"]), "Metadata.source")
+	assertEquals(t, "STANDARD_IA", aws.StringValue(actual_options_put_input.StorageClass), "StorageClass")
+	assertEquals(t, "application/age-encryption", aws.StringValue(actual_options_put_input.ContentType), "ContentType")
+	assertEquals(t, "test", string(actual_options_put_body), "body")
+
+	/* zero values leave the request as before */
+	err = mockB2.StoreFile(context.Background(), StoreRequest{URI: mockURI, BodyAt: bytes.NewReader([]byte("test")), Length: 4})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 0, len(actual_options_put_input.Metadata), "len(Metadata)")
+	assertEquals(t, true, actual_options_put_input.StorageClass == nil, "StorageClass == nil")
+	assertEquals(t, true, actual_options_put_input.ContentType == nil, "ContentType == nil")
+}
+
+func TestB2StoreFileBody(t *testing.T) {
+	// Setup Test
+	mockB2 := setupB2Backend()
+	mockURI, err := url.ParseRequestURI("b2://test-bucket/valid/new/options/key")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	/* body of unknown length */
+	err = mockB2.StoreFile(context.Background(), StoreRequest{URI: mockURI, Body: strings.NewReader("streamed"), Length: -1})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "streamed", string(actual_options_put_body), "body")
+
+	/* body shorter than its length */
+	err = mockB2.StoreFile(context.Background(), StoreRequest{URI: mockURI, Body: strings.NewReader("short"), Length: 8})
+	if err == nil {
+		t.Fatalf("This test should throw an error")
+	}
+	assertEquals(t, "input of 5 bytes does not match the expected length of 8 bytes", err.Error(), "err.Error")
+
+	/* cancelled context */
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = mockB2.StoreFile(ctx, StoreRequest{URI: mockURI, Body: strings.NewReader("streamed"), Length: -1})
+	assertEquals(t, context.Canceled, err, "err")
+}
+
+func TestB2MultipartPartSize(t *testing.T) {
+	const mebibyte = 1024 * 1024
+
+	for _, testCase := range []struct {
+		contentLength, partSize, maxPartSize, expected int64
+	}{
+		/* configured part size is sufficient */
+		{0, 0, 0, multipart_upload_part_size},
+		{1000 * multipart_upload_part_size, multipart_upload_part_size, 0, multipart_upload_part_size},
+		{10000 * multipart_upload_part_size, multipart_upload_part_size, 0, multipart_upload_part_size},
+		/* part size below the S3 minimum */
+		{mebibyte, 1, 0, multipart_upload_min_part_size},
+		/* scaled up in whole MiB */
+		{10000*multipart_upload_part_size + 1, multipart_upload_part_size, 0, multipart_upload_part_size + mebibyte},
+		{2 * 1024 * 1024 * mebibyte, multipart_upload_part_size, 5 * 1024 * mebibyte, 210 * mebibyte},
+		{2 * 1024 * 1024 * mebibyte, 64 * mebibyte, 210 * mebibyte, 210 * mebibyte},
+	} {
+		partSize, err := multipartPartSize(testCase.contentLength, testCase.partSize, testCase.maxPartSize)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		assertEquals(t, testCase.expected, partSize, fmt.Sprintf("multipartPartSize(%d, %d, %d)", testCase.contentLength, testCase.partSize, testCase.maxPartSize))
+	}
+
+	/* part size limit exceeded */
+	_, err := multipartPartSize(2*1024*1024*mebibyte, multipart_upload_part_size, multipart_upload_part_size)
+	if err == nil {
+		t.Fatalf("This test should throw an error")
+	}
+	assertEquals(t, "file of 2199023255552 bytes needs parts of at least 220200960 bytes to stay within 10000 parts, but the maximum part size is 104857600 bytes, increase max_part_size_bytes", err.Error(), "err.Error")
+}
+
+func TestB2StoreFileMultipartHuge(t *testing.T) {
+	// Setup Test
+	const contentLength = 2 * 1024 * 1024 * 1024 * 1024
+	mockB2 := setupB2Backend()
+	mockB2.maxPartSize = 5 * 1024 * 1024 * 1024
+	mockURI, err := url.ParseRequestURI("b2://test-bucket/valid/new/multipart/key/huge")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Perform the test
+	err = mockB2.StoreFile(context.Background(), StoreRequest{URI: mockURI, BodyAt: &mockReadSeeker{position: 0, length: contentLength}, Length: contentLength})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 2, len(actual_multipart_part_sizes), "len(actual_multipart_part_sizes)")
+	assertEquals(t, 9986, actual_multipart_part_sizes[220200960], "actual_multipart_part_sizes[220200960]")
+	assertEquals(t, 1, actual_multipart_part_sizes[96468992], "actual_multipart_part_sizes[96468992]")
+
+	/* fail before starting the upload if the part size cannot be scaled */
+	mockB2.maxPartSize = multipart_upload_part_size
+	err = mockB2.StoreFile(context.Background(), StoreRequest{URI: mockURI, BodyAt: &mockReadSeeker{position: 0, length: contentLength}, Length: contentLength})
+	if err == nil {
+		t.Fatalf("This test should throw an error")
+	}
+	assertEquals(t, true, strings.HasPrefix(err.Error(), "file of 2199023255552 bytes needs parts of at least 220200960 bytes"), "err.Error")
+	assertEquals(t, 9987, actual_multipart_part_sizes[220200960]+actual_multipart_part_sizes[96468992], "no parts uploaded")
+}
+
+func TestB2StoreFileMultipartValidKey(t *testing.T) {
+	// Setup Test
+	mockB2 := setupB2Backend()
+	mockURI, err := url.ParseRequestURI("b2://test-bucket/valid/new/multipart/key")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Perform the test
+	err = mockB2.StoreFile(context.Background(), StoreRequest{
+		URI: mockURI,
+		BodyAt: &mockReadSeeker{
+			position: 0,
+			length:   test_num_multipart_parts * multipart_upload_part_size,
+		},
+		Length:      test_num_multipart_parts * multipart_upload_part_size,
+		ContentType: ContentTypeGzip,
+	})
+
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	} else {
+		for i := 0; i < test_num_multipart_parts; i++ {
+			assertEquals(t, 1, actual_mutlipart_uploadpart_calls["valid/new/multipart/key"][i],
+				fmt.Sprintf("actual_mutlipart_uploadpart_calls_%d", i))
+		}
+	}
+	assertEquals(t, "application/gzip", aws.StringValue(actual_multipart_create_input.ContentType), "ContentType")
+}
+
+func TestB2StoreFileMultipartValidKeyFailsAllParts(t *testing.T) {
+	// Setup Test
+	mockB2 := setupB2Backend()
+	mockURI, err := url.ParseRequestURI("b2://test-bucket/valid/new/multipart/key/fails/all/parts")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Perform the test
+	err = mockB2.StoreFile(context.Background(), StoreRequest{
+		URI: mockURI,
+		BodyAt: &mockReadSeeker{
+			position: 0,
+			length:   test_num_multipart_parts * multipart_upload_part_size,
+		},
+		Length: test_num_multipart_parts * multipart_upload_part_size,
+	})
+
+	if err == nil {
+		t.Fatalf("unexpected test result: StoreFile was supposed to fail")
+	} else {
+		assertEquals(t, ErrOperationTimeout, err.Error(), "err.Error")
+
+		for i := 0; i < test_num_multipart_parts; i++ {
+			assertEquals(t, 5, actual_mutlipart_uploadpart_calls["valid/new/multipart/key/fails/all/parts"][i],
+				fmt.Sprintf("actual_mutlipart_uploadpart_calls_%d", i))
+		}
+	}
+}
+
+func TestB2StoreFileMultipartCompleteRetries(t *testing.T) {
+	// Setup Test
+	mockB2 := setupB2Backend()
+	mockURI, err := url.ParseRequestURI("b2://test-bucket/valid/new/multipart/key/complete/fails/twice")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Perform the test
+	var waits []time.Duration
+	mockB2.wait = func(seconds time.Duration) { waits = append(waits, seconds) }
+	err = mockB2.StoreFile(context.Background(), StoreRequest{
+		URI: mockURI,
+		BodyAt: &mockReadSeeker{
+			position: 0,
+			length:   2 * multipart_upload_part_size,
+		},
+		Length: 2 * multipart_upload_part_size,
+	})
+
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 3, actual_multipart_complete_calls["valid/new/multipart/key/complete/fails/twice"], "actual_multipart_complete_calls")
+	assertEquals(t, fmt.Sprint([]time.Duration{multipart_upload_wait_seconds, 2 * multipart_upload_wait_seconds}), fmt.Sprint(waits), "waits")
+}
+
+func TestB2StoreFileMultipartStall(t *testing.T) {
+	// Setup Test
+	client := &stallingS3Client{
+		signingPaused:  make(chan struct{}),
+		sendingStalled: make(chan struct{}),
+		resumeSigning:  make(chan struct{}),
+	}
+	clock := &stallClock{}
+	reporter := &describingReporter{}
+	mockB2 := setupB2Backend()
+	mockB2.S3API = client
+	mockB2.pr = reporter
+	mockB2.partSize = multipart_upload_min_part_size
+	mockB2.stallTimeout = time.Minute
+	mockB2.after = clock.after
+	var waits []time.Duration
+	mockB2.wait = func(seconds time.Duration) { waits = append(waits, seconds) }
+	mockURI, _ := url.ParseRequestURI("b2://test-bucket/valid/new/multipart/key")
+	data := conformanceData(2*multipart_upload_min_part_size, 1)
+
+	// Perform the test
+	errs := make(chan error, 1)
+	go func() {
+		errs <- mockB2.StoreFile(context.Background(), StoreRequest{URI: mockURI, BodyAt: bytes.NewReader(data), Length: int64(len(data))})
+	}()
+
+	/* the stall timeout does not run while the part is read for signing */
+	<-client.signingPaused
+	for clock.ticks < 3*stall_check_intervals {
+		clock.advance()
+		time.Sleep(time.Millisecond)
+	}
+	close(client.resumeSigning)
+
+	/* the stalled attempt is cancelled and retried */
+	<-client.sendingStalled
+	var err error
+	for finished := false; !finished; {
+		select {
+		case err = <-errs:
+			finished = true
+		default:
+			clock.advance()
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, false, client.cancelledSigning.Load(), "cancelledSigning")
+	assertEquals(t, int64(2), client.attempts.Load(), "attempts")
+	assertEquals(t, fmt.Sprint([]time.Duration{multipart_upload_wait_seconds}), fmt.Sprint(waits), "waits")
+	assertEquals(t, true, slices.Contains(reporter.descriptions, "retrying part #1 after it stalled, attempt 2 of 5"), "descriptions")
+}
+
+func TestB2StoreFileMultipartCompleteFails(t *testing.T) {
+	// Setup Test
+	mockB2 := setupB2Backend()
+	mockB2.recoveryDir = t.TempDir()
+	mockURI, err := url.ParseRequestURI("b2://test-bucket/valid/new/multipart/key/complete/fails/always")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Perform the test
+	err = mockB2.StoreFile(context.Background(), StoreRequest{
+		URI: mockURI,
+		BodyAt: &mockReadSeeker{
+			position: 0,
+			length:   2 * multipart_upload_part_size,
+		},
+		Length: 2 * multipart_upload_part_size,
+	})
+
+	if err == nil {
+		t.Fatalf("unexpected test result: StoreFile was supposed to fail")
+	}
+	assertEquals(t, multipart_upload_max_attempts, actual_multipart_complete_calls["valid/new/multipart/key/complete/fails/always"], "actual_multipart_complete_calls")
+
+	recoveryFiles, _ := filepath.Glob(filepath.Join(mockB2.recoveryDir, "squirrelup-upload-*.json"))
+	assertEquals(t, 1, len(recoveryFiles), "len(recoveryFiles)")
+	assertEquals(t, fmt.Sprintf("could not complete multipart upload, recovery state written to %q: unknown B2 error (InternalError: An internal error occurred.).", recoveryFiles[0]), err.Error(), "err.Error")
+	if info, _ := os.Stat(recoveryFiles[0]); runtime.GOOS != "windows" {
+		assertEquals(t, os.FileMode(0600), info.Mode().Perm(), "perm(recovery)")
+	}
+
+	raw, _ := os.ReadFile(recoveryFiles[0])
+	data, err := DecodeStateFile(upload_recovery_kind, raw)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, `{
+  "uri": "b2://test-bucket/valid/new/multipart/key/complete/fails/always",
+  "upload_id": "mock_upload_id",
+  "parts": [
+    {
+      "part_number": 1,
+      "etag": "part1"
+    },
+    {
+      "part_number": 2,
+      "etag": "part2"
+    }
+  ]
+}`, string(data), "recovery")
+}
+
+func TestB2StoreFileMultipartPendingUploadId(t *testing.T) {
+	// Setup Test
+	mockB2 := setupB2Backend()
+	mockURI, err := url.ParseRequestURI("b2://test-bucket/valid/new/multipart/key/pending")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Perform the test
+	var pendingIds []string
+	mock_upload_part_hook = func() {
+		uploadId, _ := mockB2.PendingUploadId(mockURI)
+		pendingIds = append(pendingIds, uploadId)
+	}
+	err = mockB2.StoreFile(context.Background(), StoreRequest{
+		URI: mockURI,
+		BodyAt: &mockReadSeeker{
+			position: 0,
+			length:   2 * multipart_upload_part_size,
+		},
+		Length: 2 * multipart_upload_part_size,
+	})
+	mock_upload_part_hook = nil
+
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "[mock_upload_id mock_upload_id]", fmt.Sprint(pendingIds), "pendingIds")
+	_, pending := mockB2.PendingUploadId(mockURI)
+	assertEquals(t, false, pending, "pending")
+}
+
+func TestB2StoreFileMultipartRestrictedKey(t *testing.T) {
+	// Setup Test
+	mockB2 := setupB2Backend()
+	mockURI, err := url.ParseRequestURI("b2://test-bucket/restricted/new/multipart/key")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Perform the test
+	data := []byte("test")
+	err = mockB2.StoreFile(context.Background(), StoreRequest{URI: mockURI, BodyAt: bytes.NewReader(data), Length: 2 * multipart_upload_part_size})
+
+	if err == nil {
+		t.Fatalf("unexpected test result: StoreFile was supposed to fail")
+	} else {
+		assertEquals(t, ErrFileNotFound, err.Error(), "err.Error")
+	}
+}
+
+// helper function: store a multipart and a single part object per worker concurrently on one backend
+func storeConcurrently(mockB2 *B2Backend, workers int, run string) error {
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*workers)
+	for w := 0; w < workers; w++ {
+		for _, size := range []int{3 * multipart_upload_min_part_size, 10} {
+			wg.Add(1)
+			go func(w, size int) {
+				defer wg.Done()
+				mockURI, _ := url.ParseRequestURI(fmt.Sprintf("b2://test-bucket/%s%s/%d/%d", test_concurrent_prefix, run, w, size))
+				errs <- mockB2.StoreFile(context.Background(), StoreRequest{URI: mockURI, BodyAt: &mockReadSeeker{length: size}, Length: int64(size)})
+			}(w, size)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestB2ConcurrentCalls(t *testing.T) {
+	const workers = 4
+
+	// Setup Test
+	mockB2 := setupB2Backend()
+	mockB2.pr = NewMultiProgressbarReporter(io.Discard)
+	mockB2.partSize = multipart_upload_min_part_size
+	listURI, _ := url.ParseRequestURI("b2://test-bucket/valid/prefix/")
+	removeURI, _ := url.ParseRequestURI("b2://test-bucket/valid/deletable/key")
+
+	// Perform the test
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*workers+1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		errs <- storeConcurrently(mockB2, workers, "test")
+	}()
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := mockB2.ListFiles(listURI)
+			errs <- err
+			errs <- mockB2.RemoveFile(removeURI)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+	}
+	for w := 0; w < workers; w++ {
+		for size, parts := range map[int]int{3 * multipart_upload_min_part_size: 3, 10: 1} {
+			key := fmt.Sprintf("%stest/%d/%d", test_concurrent_prefix, w, size)
+			stored, _ := actual_concurrent_parts.Load(key)
+			assertEquals(t, parts, stored, key)
+		}
+	}
+	pending := 0
+	mockB2.pending.Range(func(key, value any) bool { pending++; return true })
+	assertEquals(t, 0, pending, "pending")
 }
 
-func TestB2GetFileInfoInvalidPrefix(t *testing.T) {
+func BenchmarkB2StoreFileConcurrent(b *testing.B) {
 	// Setup Test
 	mockB2 := setupB2Backend()
-	mockURI, err := url.ParseRequestURI("b2://test-bucket/invalid/prefix/")
+	mockB2.pr = NewMultiProgressbarReporter(io.Discard)
+	mockB2.partSize = multipart_upload_min_part_size
+
+	// Perform the test
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := storeConcurrently(mockB2, 4, "benchmark"); err != nil {
+			b.Fatalf("unexpected test result: %+v", err)
+		}
+	}
+}
+
+// stubS3Transport answers the requests of uploads without a server, request bodies are
+// discarded after checking their Content-MD5 header. Escaped paths of PUT requests are recorded.
+type stubS3Transport struct {
+	parts      atomic.Int64
+	received   atomic.Int64
+	mismatches atomic.Int64
+	lock       sync.Mutex
+	paths      []string
+}
+
+func (st *stubS3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	hash := md5.New()
+	if req.Body != nil {
+		n, _ := io.Copy(hash, req.Body)
+		_ = req.Body.Close()
+		if req.Method == http.MethodPut {
+			st.received.Add(n)
+		}
+	}
+	if expected := req.Header.Get("Content-Md5"); len(expected) > 0 && expected != base64.StdEncoding.EncodeToString(hash.Sum(nil)) {
+		st.mismatches.Add(1)
+	}
+
+	var body string
+	header := http.Header{"Content-Type": []string{"application/xml"}}
+	query := req.URL.Query()
+	switch {
+	case req.Method == http.MethodPost && query.Has("uploads"):
+		body = `<InitiateMultipartUploadResult><Bucket>test-bucket</Bucket><Key>key</Key><UploadId>stub-upload-id</UploadId></InitiateMultipartUploadResult>`
+	case req.Method == http.MethodPost && query.Has("uploadId"):
+		body = `<CompleteMultipartUploadResult><Bucket>test-bucket</Bucket><Key>key</Key></CompleteMultipartUploadResult>`
+	case req.Method == http.MethodPut:
+		st.lock.Lock()
+		st.paths = append(st.paths, req.URL.EscapedPath())
+		st.lock.Unlock()
+		if query.Has("partNumber") {
+			st.parts.Add(1)
+		}
+		header.Set("ETag", fmt.Sprintf(`"%x"`, hash.Sum(nil)))
+	default:
+		return nil, fmt.Errorf("stubS3Transport got an unexpected request %s %s", req.Method, req.URL)
+	}
+	return &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}, nil
+}
+
+// helper function: create a B2Backend with an actual S3 client, which sends its requests to a stubS3Transport.
+func setupStubB2Backend(cfg *Config) (*B2Backend, *stubS3Transport) {
+	cfg.S3.Region = "stub-region"
+	cfg.S3.ID = "stub-id"
+	cfg.S3.Secret = "stub-secret"
+	cfg.S3.PathStyle = true
+	transport := &stubS3Transport{}
+	checkS3Client = func(s3Client *s3.S3) {
+		s3Client.Config.HTTPClient.Transport = transport
+	}
+	defer func() { checkS3Client = nil }()
+
+	b2 := CreateB2Backend(cfg)
+	b2.wait = func(time.Duration) {}
+	return b2, transport
+}
+
+func TestB2StoreFileBufferedParts(t *testing.T) {
+	const contentLength = 3*multipart_upload_min_part_size + 1024
+	data := conformanceData(contentLength, 1)
+	mockURI, _ := url.ParseRequestURI("b2://test-bucket/valid/new/multipart/key")
+
+	for _, test := range []struct {
+		name          string
+		bufferedParts int64
+		read          int64
+	}{
+		/* the SDK reads streamed parts to compute their checksums before sending them */
+		{"streamed", 0, 2 * contentLength},
+		{"buffered", 2, contentLength},
+	} {
+		// Setup Test
+		cfg := new(Config)
+		cfg.S3.PartSizeBytes = multipart_upload_min_part_size
+		cfg.S3.MaxBufferedParts = test.bufferedParts
+		mockB2, transport := setupStubB2Backend(cfg)
+		var read atomic.Int64
+		input := &countingReaderAt{bytes.NewReader(data), &read}
+
+		// Perform the test
+		err := mockB2.StoreFile(context.Background(), StoreRequest{URI: mockURI, BodyAt: input, Length: contentLength})
+		if err != nil {
+			t.Fatalf("%s: unexpected test result: %+v", test.name, err)
+		}
+		assertEquals(t, test.read, read.Load(), test.name+".read")
+		assertEquals(t, int64(4), transport.parts.Load(), test.name+".parts")
+		assertEquals(t, int64(contentLength), transport.received.Load(), test.name+".received")
+		assertEquals(t, int64(0), transport.mismatches.Load(), test.name+".mismatches")
+	}
+}
+
+func TestB2StoreFileSpecialCharacters(t *testing.T) {
+	// Setup Test
+	mockB2, transport := setupStubB2Backend(new(Config))
+	mockURI, _ := url.ParseRequestURI("b2://test-bucket/Datenbank%20Sicherung/%C3%BC/2024-05-01T03+0000%20%231%20100%25.tar.gz")
+
+	// Perform the test
+	err := mockB2.StoreFile(context.Background(), StoreRequest{URI: mockURI, BodyAt: bytes.NewReader([]byte("data")), Length: 4})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	/* the key is sent decoded, escaped once in the request path */
+	assertEquals(t, 1, len(transport.paths), "len(paths)")
+	assertEquals(t, "/test-bucket/Datenbank%20Sicherung/%C3%BC/2024-05-01T03%2B0000%20%231%20100%25.tar.gz", transport.paths[0], "paths[0]")
+}
+
+func TestB2StoreFileBucketRoot(t *testing.T) {
+	// Setup Test
+	mockB2, transport := setupStubB2Backend(new(Config))
+
+	// Perform the test
+	for _, rawURI := range []string{"b2://test-bucket", "b2://test-bucket/"} {
+		prefixUri, _ := url.ParseRequestURI(rawURI)
+		err := mockB2.StoreFile(context.Background(), StoreRequest{URI: ResolveObjectURI(prefixUri, "2024-05-01T03.tar.gz"), BodyAt: bytes.NewReader([]byte("data")), Length: 4})
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+	}
+
+	/* keys of objects at the bucket root have no leading slash */
+	assertEquals(t, 2, len(transport.paths), "len(paths)")
+	assertEquals(t, "/test-bucket/2024-05-01T03.tar.gz", transport.paths[0], "paths[0]")
+	assertEquals(t, "/test-bucket/2024-05-01T03.tar.gz", transport.paths[1], "paths[1]")
+}
+
+func TestB2ConcurrentCallsBuffered(t *testing.T) {
+	// Setup Test
+	mockB2 := setupB2Backend()
+	mockB2.pr = NewMultiProgressbarReporter(io.Discard)
+	mockB2.partSize = multipart_upload_min_part_size
+	mockB2.bufferedParts = 2
+
+	// Perform the test
+	if err := storeConcurrently(mockB2, 4, "buffered"); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	for w := 0; w < 4; w++ {
+		key := fmt.Sprintf("%sbuffered/%d/%d", test_concurrent_prefix, w, 3*multipart_upload_min_part_size)
+		stored, _ := actual_concurrent_parts.Load(key)
+		assertEquals(t, 3, stored, key)
+	}
+}
+
+// BenchmarkB2StoreFile measures uploads through an actual S3 client at several part sizes,
+// with parts streamed from the input and buffered in memory. The input/byte metric reports
+// how often each byte of the input is read.
+func BenchmarkB2StoreFile(b *testing.B) {
+	const contentLength = 64 * 1024 * 1024
+	data := bytes.NewReader(make([]byte, contentLength))
+	mockURI, _ := url.ParseRequestURI("b2://test-bucket/benchmark/key")
+
+	for _, partSize := range []int64{multipart_upload_min_part_size, 16 * 1024 * 1024, 32 * 1024 * 1024} {
+		for _, bufferedParts := range []int64{0, multipart_upload_max_concurent} {
+			name := fmt.Sprintf("part=%dMiB/buffered=%d", partSize/1024/1024, bufferedParts)
+			b.Run(name, func(b *testing.B) {
+				// Setup Test
+				cfg := new(Config)
+				cfg.S3.PartSizeBytes = partSize
+				cfg.S3.MaxBufferedParts = bufferedParts
+				mockB2, _ := setupStubB2Backend(cfg)
+				var read atomic.Int64
+				input := &countingReaderAt{data, &read}
+
+				// Perform the test
+				b.SetBytes(contentLength)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if err := mockB2.StoreFile(context.Background(), StoreRequest{URI: mockURI, BodyAt: input, Length: contentLength}); err != nil {
+						b.Fatalf("unexpected test result: %+v", err)
+					}
+				}
+				b.ReportMetric(float64(read.Load())/float64(b.N)/contentLength, "input/byte")
+			})
+		}
+	}
+}
+
+/* test cases for B2Backend.ResumeUpload */
+func TestB2ResumeUploadValid(t *testing.T) {
+	// Setup Test
+	mockB2 := setupB2Backend()
+	recoveryFilepath := filepath.Join(t.TempDir(), "recovery.json")
+	err := os.WriteFile(recoveryFilepath, []byte(`{"uri":"b2://test-bucket/valid/new/multipart/key","upload_id":"mock_upload_id","parts":[{"part_number":2,"etag":"part2"},{"part_number":1,"etag":"part1"}]}`), 0600)
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
 
 	// Perform the test
-	fileinfo, err := mockB2.GetFileInfo(mockURI)
+	uri, err := mockB2.ResumeUpload(recoveryFilepath)
 
-	if fileinfo != nil || err == nil {
-		t.Fatalf("unexpected test result: GetFileInfo was supposed to fail, but instead returned %+v, %+v", fileinfo, err)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "b2://test-bucket/valid/new/multipart/key", uri.String(), "uri")
+	_, err = os.Stat(recoveryFilepath)
+	assertEquals(t, true, os.IsNotExist(err), "os.IsNotExist")
+}
+
+func TestB2ResumeUploadInvalid(t *testing.T) {
+	// Setup Test
+	mockB2 := setupB2Backend()
+	tmpDir := t.TempDir()
+	encoded := string(EncodeStateFile(upload_recovery_kind, []byte(`{"uri":""}`)))
+
+	// Perform the test
+	for content, expected := range map[string]string{
+		"":                       "could not read recovery file: open %s: no such file or directory",
+		"not json":               "could not read recovery file: unknown state file format",
+		encoded[:len(encoded)-2]: "could not read recovery file: state file is corrupted",
+		string(EncodeStateFile(upload_recovery_kind, []byte("not json"))): "could not parse recovery file: invalid character 'o' in literal null (expecting 'u')",
+		`{"uri":""}`: "could not parse recovery file: parse \"\": empty url",
+		`{"uri":"b2://test-bucket/valid/new/multipart/key"}`: "could not parse recovery file: missing upload id or parts",
+	} {
+		recoveryFilepath := filepath.Join(tmpDir, "recovery.json")
+		_ = os.Remove(recoveryFilepath)
+		if len(content) > 0 {
+			if err := os.WriteFile(recoveryFilepath, []byte(content), 0600); err != nil {
+				t.Fatalf(err.Error())
+			}
+		} else {
+			expected = fmt.Sprintf(expected, recoveryFilepath)
+		}
+
+		_, err := mockB2.ResumeUpload(recoveryFilepath)
+		if err == nil {
+			t.Fatalf("unexpected test result: ResumeUpload was supposed to fail")
+		}
+		assertEquals(t, expected, err.Error(), "err.Error")
+	}
+}
+
+func TestB2StoreFileInvalidKey(t *testing.T) {
+	// Setup Test
+	mockB2 := setupB2Backend()
+	mockURI, err := url.ParseRequestURI("b2://test-bucket/invalid/new/key")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Perform the test
+	data := []byte("test")
+	err = mockB2.StoreFile(context.Background(), StoreRequest{URI: mockURI, BodyAt: bytes.NewReader(data), Length: 4})
+
+	if err == nil {
+		t.Fatalf("unexpected test result: StoreFile was supposed to fail")
 	} else {
 		assertEquals(t, ErrFileNotFound, err.Error(), "err.Error")
 	}
 }
 
-func TestB2GetFileInfoInvalidKeySize(t *testing.T) {
+func TestB2StoreFileInvalidServerResponse(t *testing.T) {
 	// Setup Test
 	mockB2 := setupB2Backend()
-	mockURI, err := url.ParseRequestURI("b2://test-bucket/invalid/key/size")
+	mockURI, err := url.ParseRequestURI("b2://test-bucket/invalid/server/response")
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
 
 	// Perform the test
-	fileinfo, err := mockB2.GetFileInfo(mockURI)
+	data := []byte("test")
+	err = mockB2.StoreFile(context.Background(), StoreRequest{URI: mockURI, BodyAt: bytes.NewReader(data), Length: 2 * multipart_upload_part_size})
 
-	if fileinfo != nil || err == nil {
-		t.Fatalf("unexpected test result: GetFileInfo was supposed to fail, but instead returned %+v, %+v", fileinfo, err)
+	if err == nil {
+		t.Fatalf("unexpected test result: StoreFile was supposed to fail")
 	} else {
-		assertEquals(t, "invalid file info", err.Error(), "err.Error")
+		assertEquals(t, "unknown B2 error (multipart upload failed: no upload id found in server response).", err.Error(), "err.Error")
 	}
 }
 
-/* test cases for B2Backend.ListFiles */
-func TestB2ListFilesValidPrefix(t *testing.T) {
+/* test cases for B2Backend.RetrieveFile */
+func TestB2RetrieveFileValidKey(t *testing.T) {
 	// Setup Test
 	mockB2 := setupB2Backend()
-	mockURI, err := url.ParseRequestURI("b2://test-bucket/valid/prefix/")
+	mockURI, err := url.ParseRequestURI("b2://test-bucket/valid/key")
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
 
 	// Perform the test
-	fileinfo, err := mockB2.ListFiles(mockURI)
+	var output bytes.Buffer
+	err = mockB2.RetrieveFile(&output, mockURI)
 
-	if fileinfo == nil || err != nil {
-		t.Fatalf("unexpected test result: %+v, %+v", fileinfo, err)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
 	} else {
-		assertEquals(t, 2, len(fileinfo), "len(fileinfo)")
-
-		assertEquals(t, "valid/prefix/key1", fileinfo[0].name, "fileinfo[0].name")
-		assertEquals(t, uint64(1), fileinfo[0].size, "fileinfo[0].size")
-		assertEquals(t, time.Unix(1, 0).UTC(), fileinfo[0].modified, "fileinfo[0].modified")
-		assertEquals(t, true, fileinfo[0].isfile, "fileinfo[0].isfile")
+		assertEquals(t, "test", output.String(), "output")
+	}
 
-		assertEquals(t, "valid/prefix/key2", fileinfo[1].name, "fileinfo[1].name")
-		assertEquals(t, uint64(2), fileinfo[1].size, "fileinfo[1].size")
-		assertEquals(t, time.Unix(2, 0).UTC(), fileinfo[1].modified, "fileinfo[1].modified")
-		assertEquals(t, true, fileinfo[1].isfile, "fileinfo[1].isfile")
+	/* the download task is finished */
+	reporter := &recordingReporter{}
+	mockB2.pr = reporter
+	output.Reset()
+	if err = mockB2.RetrieveFile(&output, mockURI); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
 	}
+	assertEquals(t, int64(4), reporter.advanced, "reporter.advanced")
+	assertEquals(t, "[1]", fmt.Sprint(reporter.finished), "reporter.finished")
 }
 
-func TestB2ListFilesInvalidPrefix(t *testing.T) {
+func TestB2RetrieveFileInvalidKey(t *testing.T) {
 	// Setup Test
 	mockB2 := setupB2Backend()
-	mockURI, err := url.ParseRequestURI("b2://test-bucket/invalid/prefix/")
+	mockURI, err := url.ParseRequestURI("b2://test-bucket/invalid/key")
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
 
 	// Perform the test
-	fileinfo, err := mockB2.ListFiles(mockURI)
+	var output bytes.Buffer
+	err = mockB2.RetrieveFile(&output, mockURI)
 
-	if fileinfo != nil || err == nil {
-		t.Fatalf("unexpected test result: ListFiles was supposed to fail, but instead returned %+v, %+v", fileinfo, err)
+	if err == nil {
+		t.Fatalf("unexpected test result: RetrieveFile was supposed to fail")
 	} else {
 		assertEquals(t, ErrFileNotFound, err.Error(), "err.Error")
 	}
 }
 
-/* test cases for B2Backend.StoreFile */
-func TestB2StoreFileValidKey(t *testing.T) {
+func TestB2RetrieveFileRangedValidKey(t *testing.T) {
 	// Setup Test
 	mockB2 := setupB2Backend()
-	mockURI, err := url.ParseRequestURI("b2://test-bucket/valid/new/key")
+	mockURI, err := url.ParseRequestURI("b2://test-bucket/valid/ranged/key")
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
 
 	// Perform the test
-	data := []byte("test")
-	err = mockB2.StoreFile(bytes.NewReader(data), 4, mockURI)
+	output := &mockWriterAt{}
+	err = mockB2.RetrieveFile(output, mockURI)
 
 	if err != nil {
 		t.Fatalf("unexpected test result: %+v", err)
+	} else {
+		assertEquals(t, int64(test_ranged_length), output.size, "output.size")
+		assertEquals(t, int64(test_ranged_length), output.written, "output.written")
+		for i := 0; i < 3; i++ {
+			assertEquals(t, 1, actual_ranged_getobject_calls["valid/ranged/key"][i],
+				fmt.Sprintf("actual_ranged_getobject_calls_%d", i))
+		}
 	}
 }
 
-func TestB2StoreFileMultipartValidKey(t *testing.T) {
+func TestB2RetrieveFileRangedOutOfOrder(t *testing.T) {
 	// Setup Test
 	mockB2 := setupB2Backend()
-	mockURI, err := url.ParseRequestURI("b2://test-bucket/valid/new/multipart/key")
+	mockURI, err := url.ParseRequestURI("b2://test-bucket/valid/ranged/key/out/of/order")
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
+	ranged_last_part_done = make(chan bool)
 
 	// Perform the test
-	old_waitfunc := waitfunc
-	waitfunc = func(time.Duration) {}
-	err = mockB2.StoreFile(&mockReadSeeker{
-		position: 0,
-		length:   test_num_multipart_parts * multipart_upload_part_size,
-	},
-		test_num_multipart_parts*multipart_upload_part_size, mockURI)
-	waitfunc = old_waitfunc
+	output := &mockWriterAt{}
+	err = mockB2.RetrieveFile(output, mockURI)
 
 	if err != nil {
 		t.Fatalf("unexpected test result: %+v", err)
 	} else {
-		for i := 0; i < test_num_multipart_parts; i++ {
-			assertEquals(t, 1, actual_mutlipart_uploadpart_calls["valid/new/multipart/key"][i],
-				fmt.Sprintf("actual_mutlipart_uploadpart_calls_%d", i))
-		}
+		assertEquals(t, int64(test_ranged_length), output.written, "output.written")
+		assertEquals(t, 3, len(actual_ranged_completion_order), "len(actual_ranged_completion_order)")
+		assertEquals(t, true, slices.Index(actual_ranged_completion_order, 3) < slices.Index(actual_ranged_completion_order, 1),
+			"actual_ranged_completion_order")
 	}
 }
 
-func TestB2StoreFileMultipartValidKeyFailsAllParts(t *testing.T) {
+func TestB2RetrieveFileRangedFailsPart(t *testing.T) {
 	// Setup Test
 	mockB2 := setupB2Backend()
-	mockURI, err := url.ParseRequestURI("b2://test-bucket/valid/new/multipart/key/fails/all/parts")
+	mockURI, err := url.ParseRequestURI("b2://test-bucket/valid/ranged/key/fails/part/2")
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
 
 	// Perform the test
-	old_waitfunc := waitfunc
-	waitfunc = func(time.Duration) {}
-	err = mockB2.StoreFile(&mockReadSeeker{
-		position: 0,
-		length:   test_num_multipart_parts * multipart_upload_part_size,
-	},
-		test_num_multipart_parts*multipart_upload_part_size, mockURI)
-	waitfunc = old_waitfunc
+	output := &mockWriterAt{}
+	err = mockB2.RetrieveFile(output, mockURI)
 
 	if err == nil {
-		t.Fatalf("unexpected test result: StoreFile was supposed to fail")
+		t.Fatalf("unexpected test result: RetrieveFile was supposed to fail")
 	} else {
 		assertEquals(t, ErrOperationTimeout, err.Error(), "err.Error")
+		assertEquals(t, 1, actual_ranged_getobject_calls["valid/ranged/key/fails/part/2"][0], "actual_ranged_getobject_calls_0")
+		assertEquals(t, 5, actual_ranged_getobject_calls["valid/ranged/key/fails/part/2"][1], "actual_ranged_getobject_calls_1")
+		assertEquals(t, 1, actual_ranged_getobject_calls["valid/ranged/key/fails/part/2"][2], "actual_ranged_getobject_calls_2")
+	}
+}
 
-		for i := 0; i < test_num_multipart_parts; i++ {
-			assertEquals(t, 5, actual_mutlipart_uploadpart_calls["valid/new/multipart/key/fails/all/parts"][i],
-				fmt.Sprintf("actual_mutlipart_uploadpart_calls_%d", i))
+func TestB2RetrieveFileRangedChecksum(t *testing.T) {
+	// Setup Test
+	mockB2 := setupB2Backend()
+	zeros := func(length, partSize int64) []byte {
+		var digests []byte
+		hash := md5.New()
+		for position := int64(0); position < length; position += partSize {
+			hash.Reset()
+			_, _ = io.CopyN(hash, &mockRangeReader{remaining: min(partSize, length-position)}, partSize)
+			digests = hash.Sum(digests)
+		}
+		return digests
+	}
+	singleETag := hex.EncodeToString(zeros(test_ranged_length, test_ranged_length))
+	partsSum := md5.Sum(zeros(test_ranged_length, multipart_upload_part_size))
+	partsETag := hex.EncodeToString(partsSum[:]) + "-3"
+	otherSum := md5.Sum([]byte("other"))
+
+	for _, testCase := range []struct {
+		key      string
+		etag     string
+		expected string
+	}{
+		{"valid/ranged/key/md5", `"` + singleETag + `"`, "<nil>"},
+		{"valid/ranged/key/parts", `"` + partsETag + `"`, "<nil>"},
+		{"valid/ranged/key/corrupted", hex.EncodeToString(otherSum[:]), `downloaded object "valid/ranged/key/corrupted" is corrupted: checksum mismatch`},
+		{"valid/ranged/key/corrupted", hex.EncodeToString(otherSum[:]) + "-3", `downloaded object "valid/ranged/key/corrupted" is corrupted: checksum mismatch`},
+		{"valid/ranged/key/corrupted", partsETag[:32] + "-4", `could not verify downloaded object "valid/ranged/key/corrupted": parts of 104857600 bytes do not add up to 4 parts`},
+	} {
+		mock_ranged_etags[testCase.key] = testCase.etag
+		mockURI, err := url.ParseRequestURI("b2://test-bucket/" + testCase.key)
+		if err != nil {
+			t.Fatalf(err.Error())
 		}
+
+		// Perform the test
+		output := &mockWriterAt{}
+		err = mockB2.RetrieveFile(output, mockURI)
+
+		assertEquals(t, testCase.expected, fmt.Sprintf("%v", err), "err "+testCase.etag)
+		assertEquals(t, int64(test_ranged_length), output.written, "output.written")
 	}
 }
 
-func TestB2StoreFileMultipartRestrictedKey(t *testing.T) {
+func TestB2RetrieveFileRangedRetryProgress(t *testing.T) {
 	// Setup Test
 	mockB2 := setupB2Backend()
-	mockURI, err := url.ParseRequestURI("b2://test-bucket/restricted/new/multipart/key")
+	reporter := &recordingReporter{}
+	mockB2.pr = reporter
+	mock_ranged_etags["valid/ranged/key/interrupted/part/2"] = "mock-etag"
+	mockURI, err := url.ParseRequestURI("b2://test-bucket/valid/ranged/key/interrupted/part/2")
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
 
 	// Perform the test
-	data := []byte("test")
-	err = mockB2.StoreFile(bytes.NewReader(data), 2*multipart_upload_part_size, mockURI)
+	output := &mockWriterAt{}
+	err = mockB2.RetrieveFile(output, mockURI)
 
-	if err == nil {
-		t.Fatalf("unexpected test result: StoreFile was supposed to fail")
-	} else {
-		assertEquals(t, ErrFileNotFound, err.Error(), "err.Error")
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
 	}
+	assertEquals(t, 2, actual_ranged_getobject_calls["valid/ranged/key/interrupted/part/2"][1], "actual_ranged_getobject_calls_1")
+	/* bytes of the broken off attempt are taken back from the part and aggregate tasks */
+	assertEquals(t, int64(2*test_ranged_length), reporter.advanced, "reporter.advanced")
+	assertEquals(t, 4, len(reporter.finished), "len(reporter.finished)")
 }
 
-func TestB2StoreFileInvalidKey(t *testing.T) {
+/* test cases for B2Backend.CopyFile */
+func TestB2CopyFileValidKey(t *testing.T) {
 	// Setup Test
 	mockB2 := setupB2Backend()
-	mockURI, err := url.ParseRequestURI("b2://test-bucket/invalid/new/key")
+	sourceURI, err := url.ParseRequestURI("b2://test-bucket/valid/key%20with%20spaces")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	destinationURI, err := url.ParseRequestURI("b2://test-bucket/valid/copy/key")
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
 
 	// Perform the test
-	data := []byte("test")
-	err = mockB2.StoreFile(bytes.NewReader(data), 4, mockURI)
+	err = mockB2.CopyFile(sourceURI, destinationURI)
 
-	if err == nil {
-		t.Fatalf("unexpected test result: StoreFile was supposed to fail")
-	} else {
-		assertEquals(t, ErrFileNotFound, err.Error(), "err.Error")
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	/* '+' is escaped in the copy source */
+	sourceURI, _ = url.ParseRequestURI("b2://test-bucket/valid/a+b%20c%23d")
+	destinationURI, _ = url.ParseRequestURI("b2://test-bucket/valid/copy/plus")
+	err = mockB2.CopyFile(sourceURI, destinationURI)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
 	}
 }
 
-func TestB2StoreFileInvalidServerResponse(t *testing.T) {
+func TestB2CopyFileRestrictedKey(t *testing.T) {
 	// Setup Test
 	mockB2 := setupB2Backend()
-	mockURI, err := url.ParseRequestURI("b2://test-bucket/invalid/server/response")
+	sourceURI, err := url.ParseRequestURI("b2://test-bucket/valid/key")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	destinationURI, err := url.ParseRequestURI("b2://test-bucket/restricted/copy/key")
 	if err != nil {
 		t.Fatalf(err.Error())
 	}
 
 	// Perform the test
-	data := []byte("test")
-	err = mockB2.StoreFile(bytes.NewReader(data), 2*multipart_upload_part_size, mockURI)
+	err = mockB2.CopyFile(sourceURI, destinationURI)
 
 	if err == nil {
-		t.Fatalf("unexpected test result: StoreFile was supposed to fail")
+		t.Fatalf("unexpected test result: CopyFile was supposed to fail")
 	} else {
-		assertEquals(t, "unknown B2 error (multipart upload failed: no upload id found in server response).", err.Error(), "err.Error")
+		assertEquals(t, ErrAccessDenied, err.Error(), "err.Error")
+	}
+}
+
+func TestB2CopyFileMultipart(t *testing.T) {
+	// Setup Test
+	mockB2 := setupB2Backend()
+	sourceURI, _ := url.ParseRequestURI("b2://test-bucket/valid/copy/huge/source")
+	destinationURI, _ := url.ParseRequestURI("b2://test-bucket/valid/copy/huge")
+	actual_copy_part_ranges = nil
+
+	// Perform the test
+	err := mockB2.CopyFile(sourceURI, destinationURI)
+
+	/* objects over the CopyObject limit are copied in parts, keeping their metadata */
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	numParts := (test_copy_huge_length + multipart_upload_part_size - 1) / multipart_upload_part_size
+	assertEquals(t, numParts, len(actual_copy_part_ranges), "len(actual_copy_part_ranges)")
+	assertEquals(t, fmt.Sprintf("bytes=0-%d", multipart_upload_part_size-1), actual_copy_part_ranges[0], "actual_copy_part_ranges[0]")
+	assertEquals(t, fmt.Sprintf("bytes=%d-%d", (numParts-1)*multipart_upload_part_size, test_copy_huge_length-1), actual_copy_part_ranges[numParts-1], "actual_copy_part_ranges[last]")
+	assertEquals(t, ContentTypeAge, aws.StringValue(actual_copy_create_input.ContentType), "ContentType")
+	assertEquals(t, "mock-digest", aws.StringValue(actual_copy_create_input.Metadata["sha256"]), "Metadata")
+
+	/* the upload is aborted if a part cannot be copied */
+	actual_copy_aborted = false
+	destinationURI, _ = url.ParseRequestURI("b2://test-bucket/restricted/copy/huge")
+	err = mockB2.CopyFile(sourceURI, destinationURI)
+	if err == nil {
+		t.Fatalf("unexpected test result: CopyFile was supposed to fail")
 	}
+	assertEquals(t, ErrAccessDenied, err.Error(), "err.Error")
+	assertEquals(t, true, actual_copy_aborted, "actual_copy_aborted")
 }
 
 /* test cases for B2Backend.RemoveFile */
@@ -689,3 +2655,156 @@ func TestB2RemoveFileUndeletableKey(t *testing.T) {
 		assertEquals(t, ErrAccessDenied, err.Error(), "err.Error")
 	}
 }
+
+/* test cases for B2Backend.RemoveFiles */
+
+// helper function: URIs of `count` keys under `test_bulk_prefix`, listed by the mock client.
+func setupBulkKeys(t *testing.T, count int, extra ...string) []*url.URL {
+	var uris []*url.URL
+	mock_bulk_keys = nil
+	for index := 0; index < count; index++ {
+		mock_bulk_keys = append(mock_bulk_keys, fmt.Sprintf("%skey%05d", test_bulk_prefix, index))
+	}
+	mock_bulk_keys = append(mock_bulk_keys, extra...)
+	sort.Strings(mock_bulk_keys)
+	for _, key := range mock_bulk_keys {
+		uris = append(uris, &url.URL{Scheme: "b2", Host: "test-bucket", Path: "/" + key})
+	}
+	actual_delete_objects_calls = nil
+	actual_list_versions_calls = 0
+	t.Cleanup(func() { mock_bulk_keys = nil })
+	return uris
+}
+
+// helper function: URIs of `keys` under `test_bulk_prefix`.
+func bulkURIs(keys ...string) []*url.URL {
+	var uris []*url.URL
+	for _, key := range keys {
+		uris = append(uris, &url.URL{Scheme: "b2", Host: "test-bucket", Path: "/" + test_bulk_prefix + key})
+	}
+	return uris
+}
+
+func TestB2RemoveFilesBatch(t *testing.T) {
+	// Setup Test
+	mockB2 := setupB2Backend()
+	uris := setupBulkKeys(t, MaxBulkRemoveFiles)
+
+	// Perform the test
+	results := mockB2.RemoveFiles(uris)
+
+	assertEquals(t, MaxBulkRemoveFiles, len(results), "len(results)")
+	for index, result := range results {
+		assertEquals(t, RemoveResult{}, result, "results["+uris[index].Path+"]")
+	}
+	/* a single request creates delete markers, versions are not listed */
+	assertEquals(t, 1, len(actual_delete_objects_calls), "len(actual_delete_objects_calls)")
+	assertEquals(t, MaxBulkRemoveFiles, len(actual_delete_objects_calls[0]), "len(actual_delete_objects_calls[0])")
+	assertEquals(t, "bulk/key00000", actual_delete_objects_calls[0][0], "actual_delete_objects_calls[0][0]")
+	assertEquals(t, 0, actual_list_versions_calls, "actual_list_versions_calls")
+}
+
+func TestB2RemoveFilesAllVersions(t *testing.T) {
+	// Setup Test
+	mockB2 := setupB2Backend()
+	mockB2.deleteAllVersions = true
+	uris := setupBulkKeys(t, MaxBulkRemoveFiles)
+
+	// Perform the test
+	results := mockB2.RemoveFiles(uris)
+
+	for index, result := range results {
+		assertEquals(t, RemoveResult{Versions: 2}, result, "results["+uris[index].Path+"]")
+	}
+	/* versions are listed in two pages and removed in two requests */
+	assertEquals(t, 2, actual_list_versions_calls, "actual_list_versions_calls")
+	assertEquals(t, 2, len(actual_delete_objects_calls), "len(actual_delete_objects_calls)")
+	assertEquals(t, MaxBulkRemoveFiles, len(actual_delete_objects_calls[0]), "len(actual_delete_objects_calls[0])")
+	assertEquals(t, MaxBulkRemoveFiles, len(actual_delete_objects_calls[1]), "len(actual_delete_objects_calls[1])")
+	assertEquals(t, "[bulk/key00000@current bulk/key00000@previous]", fmt.Sprint(actual_delete_objects_calls[0][:2]), "actual_delete_objects_calls[0]")
+
+	/* delete markers are removed too, the listing stops past the last key */
+	setupBulkKeys(t, 2*MaxBulkRemoveFiles, test_bulk_prefix+"hidden/key")
+	results = mockB2.RemoveFiles(bulkURIs("hidden/key", "key00001", "key00001-missing"))
+	assertEquals(t, fmt.Sprintf("[{2 <nil>} {2 <nil>} {0 %s}]", ErrFileNotFound), fmt.Sprint(results), "results")
+	assertEquals(t, "[[bulk/hidden/key@current bulk/hidden/key@previous bulk/hidden/key@marker bulk/key00001@current bulk/key00001@previous]]", fmt.Sprint(actual_delete_objects_calls), "actual_delete_objects_calls")
+	assertEquals(t, 1, actual_list_versions_calls, "actual_list_versions_calls")
+
+	/* objects whose versions cannot be listed are not removed */
+	actual_delete_objects_calls = nil
+	results = mockB2.RemoveFiles([]*url.URL{{Scheme: "b2", Host: "test-bucket", Path: "/restricted/key"}})
+	assertEquals(t, fmt.Sprintf("[{0 %s}]", ErrAccessDenied), fmt.Sprint(results), "results")
+	assertEquals(t, 0, len(actual_delete_objects_calls), "len(actual_delete_objects_calls)")
+
+	/* single objects are removed the same way */
+	assertEquals(t, nil, mockB2.RemoveFile(bulkURIs("key00002")[0]), "RemoveFile")
+	assertEquals(t, ErrFileNotFound, fmt.Sprintf("%v", mockB2.RemoveFile(bulkURIs("missing/key")[0])), "RemoveFile")
+}
+
+func TestB2RemovePriorVersions(t *testing.T) {
+	// Setup Test
+	mockB2 := setupB2Backend()
+	setupBulkKeys(t, 2, test_bulk_prefix+"hidden/key", test_bulk_prefix+"undeletable/key")
+
+	// Perform the test
+	versions, err := mockB2.RemovePriorVersions(bulkURIs("key00001")[0])
+
+	/* the current version is kept */
+	assertEquals(t, nil, err, "err")
+	assertEquals(t, 1, versions, "versions")
+	assertEquals(t, "[[bulk/key00001@previous]]", fmt.Sprint(actual_delete_objects_calls), "actual_delete_objects_calls")
+
+	/* versions hidden by a current delete marker are prior versions */
+	actual_delete_objects_calls = nil
+	versions, err = mockB2.RemovePriorVersions(bulkURIs("hidden/key")[0])
+	assertEquals(t, nil, err, "err")
+	assertEquals(t, 2, versions, "versions")
+	assertEquals(t, "[[bulk/hidden/key@current bulk/hidden/key@previous]]", fmt.Sprint(actual_delete_objects_calls), "actual_delete_objects_calls")
+
+	/* objects without prior versions are left alone */
+	actual_delete_objects_calls = nil
+	versions, err = mockB2.RemovePriorVersions(bulkURIs("missing/key")[0])
+	assertEquals(t, nil, err, "err")
+	assertEquals(t, 0, versions, "versions")
+
+	/* failures to list or remove versions are returned */
+	_, err = mockB2.RemovePriorVersions(&url.URL{Scheme: "b2", Host: "test-bucket", Path: "/restricted/key"})
+	assertEquals(t, ErrAccessDenied, fmt.Sprintf("%v", err), "err")
+	_, err = mockB2.RemovePriorVersions(bulkURIs("undeletable/key")[0])
+	assertEquals(t, ErrAccessDenied, fmt.Sprintf("%v", err), "err")
+}
+
+func TestB2RemoveFilesTooMany(t *testing.T) {
+	// Setup Test
+	mockB2 := setupB2Backend()
+	uris := setupBulkKeys(t, MaxBulkRemoveFiles+1)
+
+	// Perform the test
+	results := mockB2.RemoveFiles(uris)
+
+	assertEquals(t, MaxBulkRemoveFiles+1, len(results), "len(results)")
+	assertEquals(t, "cannot remove more than 1000 files at once", fmt.Sprintf("%v", results[0].Err), "results[0]")
+	assertEquals(t, "cannot remove more than 1000 files at once", fmt.Sprintf("%v", results[MaxBulkRemoveFiles].Err), "results[1000]")
+	assertEquals(t, 0, len(actual_delete_objects_calls), "len(actual_delete_objects_calls)")
+}
+
+func TestB2RemoveFilesPartialFailure(t *testing.T) {
+	// Setup Test
+	mockB2 := setupB2Backend()
+	setupBulkKeys(t, 2, test_bulk_prefix+"undeletable/key")
+	uris := bulkURIs("key00000", "undeletable/key", "missing/key", "key00001")
+
+	// Perform the test
+	results := mockB2.RemoveFiles(uris)
+
+	/* removing missing objects succeeds like plain deletes do */
+	assertEquals(t, fmt.Sprintf("[{0 <nil>} {0 %s} {0 <nil>} {0 <nil>}]", ErrAccessDenied), fmt.Sprint(results), "results")
+	assertEquals(t, "[[bulk/key00000 bulk/undeletable/key bulk/missing/key bulk/key00001]]", fmt.Sprint(actual_delete_objects_calls), "actual_delete_objects_calls")
+
+	/* with all versions, failures of any version fail the object */
+	mockB2.deleteAllVersions = true
+	actual_delete_objects_calls = nil
+	results = mockB2.RemoveFiles(uris)
+	assertEquals(t, fmt.Sprintf("[{2 <nil>} {0 %s} {0 %s} {2 <nil>}]", ErrAccessDenied, ErrFileNotFound), fmt.Sprint(results), "results")
+	assertEquals(t, 1, len(actual_delete_objects_calls), "len(actual_delete_objects_calls)")
+}
@@ -0,0 +1,1233 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"filippo.io/age"
+	"github.com/mholt/archiver/v4"
+)
+
+type (
+	// BackupOptions configures a backup created by Backup.
+	BackupOptions struct {
+		// directory to back up
+		Source string
+		// directory holding a copy of Source, like a filesystem snapshot, read instead of
+		// Source if set. Archive entries are named as if read from Source.
+		SourceSnapshot string
+		// prefix the backup is stored under
+		Destination *url.URL
+		// backup configuration, it is not modified
+		Config *Config
+		// stores the backup, created for Destination if not set
+		Backend StorageBackend
+		// displays progress, overrides Config.Internal.Reporter if set
+		Reporter ProgressReporter
+		// the archive is created and encrypted, but neither stored nor are old backups removed
+		DryRun bool
+		// nominal time of the backup, defaults to Now()
+		Time time.Time
+		// the archive is encrypted for these recipients after Config.Encryption.Command was applied
+		Recipients []age.Recipient
+		// selects and rewrites archive entries
+		Filter ArchiveFilter
+		// TAR stream backed up instead of the Source directory if set, Filter does not apply
+		Input io.Reader
+		// format of Input, either InputFormatTar or InputFormatTarGz
+		InputFormat string
+		// maps the name of the backup object to the key it is stored under, if set
+		ObjectName func(name string) string
+		// key of the HMAC naming encrypted chunks of deduplicated backups, required with
+		// Recipients if Config.Backup.Dedup is set
+		ChunkKey []byte
+		// configures removal of backups older than Config.Backup.Hours
+		Cleanup CleanupOptions
+		// prefixes the backup is copied to once stored under Destination, old backups are
+		// removed under each of them as well
+		Mirrors []BackupMirror
+		// called whenever the backup enters another stage, `object` is set once it is known
+		Stage func(stage string, object *url.URL)
+		// called with the path of every temporary file created for the backup, if set
+		TempFile func(path string)
+		// counts bytes read by the backend while storing the backup, if set
+		Uploaded *atomic.Int64
+		// called once the backup was stored, before old backups are removed. An error fails
+		// the backup and skips the cleanup.
+		Stored func(result *BackupResult) error
+		// progress messages are written to Stderr if set
+		Verbose bool
+		// receive messages, they are discarded if not set
+		Stdout io.Writer
+		Stderr io.Writer
+	}
+
+	// BackupSizes holds sizes of the source tree, the compressed archive and the uploaded object.
+	BackupSizes struct {
+		Source   int64
+		Archive  int64
+		Uploaded int64
+	}
+
+	// BackupObject describes an object stored by Backup.
+	BackupObject struct {
+		// URI of the stored object, or of the object that would be stored in a dry run
+		Object *url.URL
+		// name of the object before BackupOptions.ObjectName was applied
+		Name  string
+		Sizes BackupSizes
+		// SHA-256 checksum of the stored object
+		Checksum string
+		// size of the manifest of deduplicated backups, the uploaded size includes new chunks
+		ManifestSize int64
+		// MIME type of the stored object, see archiveContentType
+		ContentType string
+	}
+
+	// BackupResult describes a backup created by Backup. Backups are stored as a single object
+	// unless passthrough backups store several files individually.
+	BackupResult struct {
+		// URI of the (first) stored object, or of the object that would be stored in a dry run
+		Object *url.URL
+		// name of the backup object before BackupOptions.ObjectName was applied
+		Name string
+		// sizes summed up over all objects
+		Sizes BackupSizes
+		// SHA-256 checksum of the stored object
+		Checksum string
+		// every object stored, or that would be stored in a dry run
+		Objects []BackupObject
+		// true once the backup, or any of its objects, was stored
+		Stored bool
+		// outcome of the removal of old backups, nil if it did not run
+		Cleanup *CleanupResult
+		// outcome of the backup under each mirror, in the order of BackupOptions.Mirrors
+		Mirrors []MirrorResult
+		// problems that did not fail the backup
+		Warnings []string
+		// how long the stages of the backup took
+		Timings StageTimings
+	}
+
+	// ArchiveFilter selects and rewrites entries of archives created by ArchiveDirectory.
+	ArchiveFilter struct {
+		// leaves out entries by their name in the archive, if set
+		Exclude func(nameInArchive string) bool
+		// rewrites attributes of archive entries, if set
+		Normalize func(info fs.FileInfo, linkTarget string) (fs.FileInfo, error)
+		// written as the first entry of the archive, see ArchiveMetadataName, if set
+		Metadata *ArchiveMetadata
+		// receives problems that do not fail the archive, like extended attributes that
+		// cannot be read, if set
+		Warn func(message string)
+	}
+
+	// CleanupError reports a backup that was stored, but removing old backups failed.
+	CleanupError struct {
+		Err error
+	}
+
+	// EncryptionVerifyError reports an encrypted archive that failed verification before it
+	// was uploaded. The unencrypted archive is kept under Plaintext rather than removed.
+	EncryptionVerifyError struct {
+		Plaintext string
+		Err       error
+	}
+
+	// progressReadCloser advances a progress task by the number of bytes read.
+	progressReadCloser struct {
+		io.ReadCloser
+		reporter ProgressReporter
+		index    int
+	}
+
+	// archiveFileCounter describes the archiving task with the number of files written to the
+	// archive, out of `total` files unless it is negative. The description is updated at most
+	// every archiveDescribeInterval, and for the last file.
+	archiveFileCounter struct {
+		reporter  ProgressReporter
+		index     int
+		total     int64
+		lock      sync.Mutex
+		count     int64
+		described time.Time
+	}
+
+	// countingReaderAt counts bytes read by the storage backend.
+	countingReaderAt struct {
+		io.ReaderAt
+		count *atomic.Int64
+	}
+
+	// contextReaderAt fails reads once the context is done, which aborts uploads in progress.
+	contextReaderAt struct {
+		ctx context.Context
+		io.ReaderAt
+	}
+)
+
+const (
+	// stages of a backup reported through BackupOptions.Stage
+	StageArchiving  = "archiving"
+	StageEncrypting = "encrypting"
+	StageUploading  = "uploading"
+	StageCleanup    = "cleanup"
+
+	// tempFilePrefix prefixes names of temporary files holding archives.
+	tempFilePrefix = "SquirrelUp"
+	// length limit of the destination in names of temporary files
+	tempFileDestinationLength = 32
+	// minimum time between updates of the number of archived files in the progress description
+	archiveDescribeInterval = time.Second
+
+	// MIME types of stored objects, see StoreRequest.ContentType
+	ContentTypeGzip        = "application/gzip"
+	ContentTypeTar         = "application/x-tar"
+	ContentTypeZstd        = "application/zstd"
+	ContentTypeAge         = "application/age-encryption"
+	ContentTypeJSON        = "application/json"
+	ContentTypeOctetStream = "application/octet-stream"
+
+	// sizes of the parts of age encrypted files, see VerifyEncryptedFile
+	ageChunkSize     = 64 * 1024
+	ageNonceSize     = 16
+	ageTagSize       = 16
+	ageMACSize       = 32
+	maxAgeHeaderSize = 1024 * 1024
+)
+
+var (
+	// verifyEncrypted verifies the encrypted file at `encryptedPath` against the file at
+	// `plaintextPath` it was encrypted from, can be overridden in tests.
+	verifyEncrypted = func(encryptedPath, plaintextPath string) error {
+		plaintextInfo, err := os.Stat(plaintextPath)
+		if err != nil {
+			return fmt.Errorf("could not stat unencrypted file: %s", err.Error())
+		}
+		return VerifyEncryptedFile(encryptedPath, plaintextInfo.Size())
+	}
+)
+
+// addObject records an object of the backup, the first one is described by Object, Name and
+// Checksum as well.
+func (result *BackupResult) addObject(object BackupObject) {
+	if len(result.Objects) == 0 {
+		result.Object, result.Name, result.Checksum = object.Object, object.Name, object.Checksum
+	}
+	result.Objects = append(result.Objects, object)
+	result.Sizes.Uploaded += object.Sizes.Uploaded
+}
+
+func (ce *CleanupError) Error() string {
+	return ce.Err.Error()
+}
+
+func (ce *CleanupError) Unwrap() error {
+	return ce.Err
+}
+
+func (eve *EncryptionVerifyError) Error() string {
+	return fmt.Sprintf("encrypted backup archive failed verification: %s, kept the unencrypted archive %q", eve.Err.Error(), eve.Plaintext)
+}
+
+func (eve *EncryptionVerifyError) Unwrap() error {
+	return eve.Err
+}
+
+func (prc *progressReadCloser) Read(p []byte) (n int, err error) {
+	n, err = prc.ReadCloser.Read(p)
+	_ = prc.reporter.AdvanceTask(prc.index, int64(n))
+	return
+}
+
+// add counts a file opened by the archive writer.
+func (afc *archiveFileCounter) add() {
+	afc.lock.Lock()
+	defer afc.lock.Unlock()
+	afc.count++
+	if now := time.Now(); now.Sub(afc.described) >= archiveDescribeInterval || afc.count == afc.total {
+		afc.described = now
+		afc.describe()
+	}
+}
+
+// finish describes the task with the final number of files.
+func (afc *archiveFileCounter) finish() {
+	afc.lock.Lock()
+	defer afc.lock.Unlock()
+	afc.describe()
+}
+
+func (afc *archiveFileCounter) describe() {
+	description := "archiving, files " + formatCount(afc.count)
+	if afc.total >= 0 {
+		description += "/" + formatCount(afc.total)
+	}
+	_ = afc.reporter.DescribeTask(afc.index, description)
+}
+
+func (cra *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := cra.ReaderAt.ReadAt(p, off)
+	cra.count.Add(int64(n))
+	return n, err
+}
+
+func (cra *contextReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if err := cra.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cra.ReaderAt.ReadAt(p, off)
+}
+
+// writerOrDiscard returns `writer`, or io.Discard if it is not set.
+func writerOrDiscard(writer io.Writer) io.Writer {
+	if writer == nil {
+		return io.Discard
+	}
+	return writer
+}
+
+// Backup archives the source directory, or the input stream if set, encrypts the archive,
+// stores it under the destination prefix and removes backups older than the configured
+// retention period. Passthrough backups, see Config.Backup.Passthrough, store the files of
+// the source directory without archiving them. Deduplicated backups, see Config.Backup.Dedup,
+// store the chunks of the archive missing under the destination prefix along with a manifest.
+// Stored files are kept in Config.Backup.KeepLocalDir if set, failures to keep them are
+// warnings. Once stored, the backup is copied to every mirror and old backups are removed under
+// each of them independently. If the backup was not stored under every mirror, the result is
+// returned along with a *MirrorError unless Config.Backup.MirrorPolicy is MirrorPolicyAny. If
+// the backup was stored, but removing old backups failed, the result is returned along with a
+// *CleanupError.
+func Backup(ctx context.Context, opts BackupOptions) (result BackupResult, err error) {
+	timer := newStageTimer(&result.Timings)
+	defer timer.stop()
+
+	if opts.Config == nil {
+		return result, fmt.Errorf("no backup configuration given")
+	}
+	cfg := *opts.Config
+	if opts.Reporter != nil {
+		cfg.Internal.Reporter = opts.Reporter
+	}
+	stdout, stderr := writerOrDiscard(opts.Stdout), writerOrDiscard(opts.Stderr)
+	stage := func(stage string, object *url.URL) {
+		if opts.Stage != nil {
+			opts.Stage(stage, object)
+		}
+	}
+	nominalTime := opts.Time
+	if nominalTime.IsZero() {
+		nominalTime = Now()
+	}
+	cfg.Internal.TempFileTag = TempFileTag(opts.Destination, nominalTime)
+	cfg.Internal.TempFileCreated = func(path string) {
+		if opts.Verbose {
+			fmt.Fprintf(stderr, "using temporary file %q\n", path)
+		}
+		if opts.TempFile != nil {
+			opts.TempFile(path)
+		}
+	}
+	backupName, err := cfg.BackupName(nominalTime)
+	if err != nil {
+		return result, err
+	}
+	if err = CheckEncryptionPolicy(&cfg, opts.Recipients); err != nil {
+		return result, err
+	}
+	if len(opts.Mirrors) > 0 && cfg.Backup.Dedup {
+		return result, fmt.Errorf("deduplicated backups cannot be mirrored")
+	}
+	if cfg.Backup.Dedup && len(opts.Recipients) > 0 && len(opts.ChunkKey) == 0 {
+		return result, fmt.Errorf("encrypted deduplicated backups require a key to name their chunks")
+	}
+	backend := opts.Backend
+	if backend == nil && !opts.DryRun {
+		backend, err = CreateStorageBackend(opts.Destination, &cfg)
+		if err != nil {
+			return result, fmt.Errorf("failed to create backend: %s", err.Error())
+		}
+	}
+
+	var mirrorBackends []StorageBackend
+	if !opts.DryRun {
+		result.Mirrors, mirrorBackends = newMirrors(opts.Mirrors, &cfg, stderr)
+	}
+
+	/* create an archive from the input directory, passthrough backups store its files as they are.
+	   Files are read from the snapshot of the input directory if given, but named after it. */
+	stage(StageArchiving, nil)
+	timer.begin(&result.Timings.Archive)
+	var artifacts []backupArtifact
+	sourcePath := opts.Source
+	if len(opts.SourceSnapshot) > 0 {
+		sourcePath = opts.SourceSnapshot
+	}
+	if opts.Input == nil && cfg.Backup.Passthrough {
+		artifacts, err = passthroughArtifacts(sourcePath, archiveRoot(opts.Source), backupName, &cfg, opts.Filter)
+		if err != nil {
+			return result, err
+		}
+	} else {
+		if opts.Verbose {
+			fmt.Fprintf(stderr, "generating backup archive...\n")
+		}
+		var archivePath string
+		var sourceSize int64
+		if opts.Input != nil {
+			archivePath, sourceSize, err = ArchiveStream(ctx, opts.Input, opts.InputFormat, &cfg)
+		} else {
+			var skipped FileErrors
+			filter := opts.Filter
+			if opts.Verbose && filter.Warn == nil {
+				filter.Warn = func(message string) {
+					cfg.Internal.Warnings.Report(stderr, WarningSkippedFile, "", message)
+				}
+			}
+			archivePath, sourceSize, skipped, err = archiveDirectory(ctx, sourcePath, archiveRoot(opts.Source), &cfg, filter)
+			// list files left out of the archive once the backup is done
+			defer func() {
+				for _, fileErr := range skipped {
+					warning := fmt.Sprintf("skipped unreadable %s", fileErr.Error())
+					cfg.Internal.Warnings.Report(stderr, WarningSkippedFile, fileErr.Path, warning)
+					result.Warnings = append(result.Warnings, warning)
+				}
+			}()
+		}
+		if err != nil {
+			_ = os.Remove(archivePath)
+			return result, err
+		}
+		artifacts = []backupArtifact{{path: archivePath, name: backupName + ".tar.gz", sourceSize: sourceSize, temporary: true}}
+	}
+	removeArtifacts := func() {
+		for _, artifact := range artifacts {
+			if artifact.temporary {
+				_ = os.Remove(artifact.path)
+			}
+		}
+	}
+	archiveSizes := make([]int64, len(artifacts))
+	for index, artifact := range artifacts {
+		archiveInfo, err := os.Stat(artifact.path)
+		if err != nil {
+			removeArtifacts()
+			return result, fmt.Errorf("could not stat backup archive: %s", err.Error())
+		}
+		archiveSizes[index] = archiveInfo.Size()
+		result.Sizes.Source += artifact.sourceSize
+		result.Sizes.Archive += archiveInfo.Size()
+	}
+
+	for index, artifact := range artifacts {
+		/* deduplicated backups store the chunks of the archive along with a manifest */
+		if cfg.Backup.Dedup {
+			object := BackupObject{
+				Name:  strings.TrimSuffix(artifact.name, ".tar.gz") + DedupManifestSuffix,
+				Sizes: BackupSizes{Source: artifact.sourceSize, Archive: archiveSizes[index]},
+			}
+			var objectName string = object.Name
+			if opts.ObjectName != nil {
+				objectName = opts.ObjectName(object.Name)
+			}
+			object.Object = ResolveObjectURI(opts.Destination, objectName)
+			if index == 0 {
+				result.Object, result.Name = object.Object, object.Name
+			}
+			if opts.DryRun {
+				result.addObject(object)
+				fmt.Fprintf(stdout, "dry run, chunks of the backup archive of %q would be uploaded to %q\n", opts.Source, object.Object)
+				continue
+			}
+
+			stage(StageUploading, object.Object)
+			timer.begin(&result.Timings.Upload)
+			err = storeDedupArchive(ctx, backend, artifact.path, opts.Recipients, &object, &opts, &cfg, stdout, stderr)
+			if err != nil {
+				result.Sizes.Uploaded += object.Sizes.Uploaded
+				break
+			}
+			result.addObject(object)
+			result.Stored = true
+			continue
+		}
+
+		/* encrypt the archive */
+		stage(StageEncrypting, nil)
+		timer.begin(&result.Timings.Encrypt)
+		var encryptedPath, extension string
+		encryptedPath, extension, err = encryptArchive(ctx, artifact.path, opts.Recipients, &cfg, opts.Verbose, stderr)
+		if err != nil {
+			// archives whose encryption failed verification are kept to be looked into
+			var verifyErr *EncryptionVerifyError
+			if !errors.As(err, &verifyErr) {
+				removeArtifacts()
+			}
+			return result, err
+		}
+		removeEncrypted := func() {
+			if encryptedPath != artifact.path {
+				_ = os.Remove(encryptedPath)
+			}
+		}
+
+		object := BackupObject{
+			Name:        artifact.name + extension,
+			Sizes:       BackupSizes{Source: artifact.sourceSize, Archive: archiveSizes[index]},
+			ContentType: archiveContentType(&cfg, artifact, extension),
+		}
+		var objectName string = object.Name
+		if opts.ObjectName != nil {
+			objectName = opts.ObjectName(object.Name)
+		}
+		object.Object = ResolveObjectURI(opts.Destination, objectName)
+		if index == 0 {
+			result.Object, result.Name = object.Object, object.Name
+		}
+
+		if opts.DryRun {
+			var encryptedInfo os.FileInfo
+			encryptedInfo, err = os.Stat(encryptedPath)
+			removeEncrypted()
+			if err != nil {
+				removeArtifacts()
+				return result, fmt.Errorf("could not stat backup archive: %s", err.Error())
+			}
+			object.Sizes.Uploaded = encryptedInfo.Size()
+			result.addObject(object)
+			fmt.Fprintf(stdout, "dry run, backup archive of %q would be uploaded to %q\n", opts.Source, object.Object)
+			for _, mirror := range opts.Mirrors {
+				fmt.Fprintf(stdout, "dry run, backup archive of %q would be copied to %q\n", opts.Source, ResolveObjectURI(mirror.Destination, objectName))
+			}
+			continue
+		}
+
+		/* store the archive */
+		stage(StageUploading, nil)
+		timer.begin(&result.Timings.Upload)
+		if opts.Verbose {
+			fmt.Fprintf(stderr, "uploading backup archive...\n")
+		}
+		err = storeArchive(ctx, backend, encryptedPath, &object, &opts, stage, stdout, stderr)
+		if err == nil && len(result.Mirrors) > 0 {
+			storeMirrors(ctx, result.Mirrors, mirrorBackends, encryptedPath, objectName, &object, &opts, &cfg, stdout, stderr)
+		}
+		if err == nil && len(cfg.Backup.KeepLocalDir) > 0 {
+			// files of passthrough backups stored as they are must stay in place
+			keepSource := encryptedPath == artifact.path && !artifact.temporary
+			keepLocal(encryptedPath, object.Name, keepSource, &cfg, &result, stdout, stderr)
+		}
+		removeEncrypted()
+		if err != nil {
+			result.Sizes.Uploaded += object.Sizes.Uploaded
+			break
+		}
+		result.addObject(object)
+		result.Stored = true
+	}
+	removeArtifacts()
+	if opts.DryRun {
+		return result, nil
+	}
+
+	/* run follow-up steps of the caller */
+	if err == nil && opts.Stored != nil {
+		err = opts.Stored(&result)
+	}
+
+	/* remove old local copies */
+	if err == nil && len(cfg.Backup.KeepLocalDir) > 0 && cfg.Backup.KeepLocalCleanup && cfg.Backup.Hours > 0.0 {
+		removed, pruneErr := pruneLocalCopies(&cfg, nominalTime)
+		for _, localPath := range removed {
+			fmt.Fprintf(stdout, "removed local copy %q\n", localPath)
+		}
+		if pruneErr != nil {
+			warning := fmt.Sprintf("%s, old local copies were not all removed", pruneErr.Error())
+			cfg.Internal.Warnings.Report(stderr, WarningKeepLocal, cfg.Backup.KeepLocalDir, warning)
+			result.Warnings = append(result.Warnings, warning)
+		}
+	}
+
+	/* remove old backups */
+	stage(StageCleanup, result.Object)
+	var cleanupErr error
+	if err == nil && cfg.Backup.Hours > 0.0 {
+		timer.begin(&result.Timings.Cleanup)
+		cleanup := opts.Cleanup
+		if cleanup.Context == nil {
+			cleanup.Context = ctx
+		}
+		if cleanup.Stdout == nil {
+			cleanup.Stdout = stdout
+		}
+		if cleanup.Stderr == nil {
+			cleanup.Stderr = stderr
+		}
+		result.Cleanup, cleanupErr = CleanupPrefix(backend, &cfg, nominalTime, opts.Destination, cleanup)
+		if result.Cleanup != nil {
+			result.Warnings = append(result.Warnings, result.Cleanup.Warnings...)
+		}
+		cleanupMirrors(mirrorBackends, &cfg, nominalTime, cleanup, &result, stderr)
+	}
+
+	/* mirrors the backup was not stored under fail it, unless any copy is enough */
+	if err == nil {
+		err = mirrorFailure(&cfg, &result, stderr)
+	}
+	if err == nil && cleanupErr != nil {
+		return result, &CleanupError{cleanupErr}
+	} else if cleanupErr != nil {
+		cfg.Internal.Warnings.Report(stderr, WarningCleanup, opts.Destination.String(), fmt.Sprintf("failed to clean up backup prefix: %s", cleanupErr.Error()))
+	}
+
+	return result, err
+}
+
+// TempFileTag returns the part of temporary file names identifying a run: a sanitized short
+// form of `destination` followed by the nominal time of the backup in UTC. Only the time is
+// used without `destination`.
+func TempFileTag(destination *url.URL, nominalTime time.Time) string {
+	var tag string
+	if destination != nil {
+		var builder strings.Builder
+		for _, char := range destination.Host + destination.Path {
+			if (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') || (char >= '0' && char <= '9') || char == '.' || char == '_' {
+				builder.WriteRune(char)
+			} else if builder.Len() > 0 && !strings.HasSuffix(builder.String(), "-") {
+				builder.WriteRune('-')
+			}
+		}
+		// keep the end of long destinations, it differs between profiles more likely
+		tag = strings.Trim(builder.String(), "-")
+		if cut := len(tag) - tempFileDestinationLength; cut > 0 {
+			// drop the component cut in half
+			if _, after, found := strings.Cut(tag[cut:], "-"); found && tag[cut-1] != '-' {
+				tag = after
+			} else {
+				tag = strings.TrimLeft(tag[cut:], "-")
+			}
+		}
+	}
+	if len(tag) > 0 {
+		tag += "-"
+	}
+	return tag + nominalTime.UTC().Format("20060102T150405Z")
+}
+
+// createTempFile creates a temporary file for `kind` of data, named after the run if
+// `cfg.Internal.TempFileTag` is set, and reports it to `cfg.Internal.TempFileCreated`.
+func createTempFile(cfg *Config, kind string) (*os.File, error) {
+	var pattern string = tempFilePrefix + "-"
+	if len(cfg.Internal.TempFileTag) > 0 {
+		pattern += cfg.Internal.TempFileTag + "-"
+	}
+	tmp, err := CreateTempFile("", pattern+kind+"-", cfg.FileMode(SecretFile))
+	if err == nil && cfg.Internal.TempFileCreated != nil {
+		cfg.Internal.TempFileCreated(tmp.Name())
+	}
+	return tmp, err
+}
+
+// CheckEncryptionPolicy fails if `cfg.Encryption.Required` is set, but there are no `recipients`
+// to encrypt backups to.
+func CheckEncryptionPolicy(cfg *Config, recipients []age.Recipient) error {
+	if cfg.Encryption.Required && len(recipients) == 0 {
+		return fmt.Errorf("%s", ErrEncryptionRequired)
+	}
+	return nil
+}
+
+// ArchiveObjectName returns the name of the object Backup stores for the archive of the backup
+// named `backupName`, with age encryption applied if `encrypted` is set. Passthrough backups
+// store files under names of their own, an empty name is returned for them.
+func ArchiveObjectName(cfg *Config, backupName string, encrypted bool) string {
+	switch {
+	case cfg.Backup.Passthrough:
+		return ""
+	case cfg.Backup.Dedup:
+		return backupName + DedupManifestSuffix
+	}
+	name := backupName + ".tar.gz"
+	if len(cfg.Encryption.Command) > 0 {
+		name += cfg.Encryption.CommandSuffix
+	}
+	if encrypted {
+		name += ".age"
+	}
+	return name
+}
+
+// archiveContentType returns the MIME type of the backup object stored from `artifact`, with
+// `extension` appended to its name by encryptArchive. Archives created by Backup are
+// gzip-compressed TAR archives, the type of files of passthrough backups is told by their
+// first bytes. Output of encryption commands is of unknown type. Config.Backup.ContentType
+// overrides the type if set.
+func archiveContentType(cfg *Config, artifact backupArtifact, extension string) string {
+	switch {
+	case len(cfg.Backup.ContentType) > 0:
+		return cfg.Backup.ContentType
+	case strings.HasSuffix(extension, ".age"):
+		return ContentTypeAge
+	case len(cfg.Encryption.Command) > 0:
+		return ContentTypeOctetStream
+	case artifact.temporary:
+		return ContentTypeGzip
+	}
+	return fileContentType(artifact.path)
+}
+
+// fileContentType returns the MIME type of the file at `path` told by its first bytes:
+// gzip, zstd or TAR, or application/octet-stream for any other file.
+func fileContentType(path string) string {
+	file, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return ContentTypeOctetStream
+	}
+	defer file.Close()
+
+	block := make([]byte, tar_block_size)
+	n, _ := io.ReadFull(file, block)
+	block = block[:n]
+	switch {
+	case bytes.HasPrefix(block, gzipMagic):
+		return ContentTypeGzip
+	case bytes.HasPrefix(block, zstdMagic):
+		return ContentTypeZstd
+	case n > 0 && isTarHeader(block):
+		return ContentTypeTar
+	}
+	return ContentTypeOctetStream
+}
+
+// encryptArchive applies the configured encryption command and age encryption to the archive
+// at `archivePath`. Returns the path of the encrypted file, which is `archivePath` if encryption
+// is disabled, and the file extensions appended to the name of the backup object by the
+// encryption. Intermediate files are removed. If the age encrypted file fails verification, it
+// is removed and an *EncryptionVerifyError is returned, the input of age encryption is kept.
+func encryptArchive(ctx context.Context, archivePath string, recipients []age.Recipient, cfg *Config, verbose bool, stderr io.Writer) (string, string, error) {
+	var encryptedPath string = archivePath
+	var extension string
+	if len(cfg.Encryption.Command) > 0 {
+		if verbose {
+			fmt.Fprintf(stderr, "encrypting backup archive with command: %s\n", cfg.Encryption.Command)
+		}
+		commandPath, err := EncryptFileWithCommand(ctx, encryptedPath, cfg)
+		if err != nil {
+			_ = os.Remove(commandPath)
+			return "", "", err
+		}
+		encryptedPath = commandPath
+		extension += cfg.Encryption.CommandSuffix
+	}
+	if len(recipients) > 0 {
+		if verbose {
+			fmt.Fprintf(stderr, "encrypting backup archive for recipients: %s\n", formatRecipients(recipients))
+		}
+		agePath, err := encryptFile(ctx, encryptedPath, recipients, cfg)
+		if err == nil {
+			if err = verifyEncrypted(agePath, encryptedPath); err != nil {
+				_ = os.Remove(agePath)
+				return "", "", &EncryptionVerifyError{Plaintext: encryptedPath, Err: err}
+			}
+		}
+		if encryptedPath != archivePath {
+			_ = os.Remove(encryptedPath)
+		}
+		if err != nil {
+			_ = os.Remove(agePath)
+			return "", "", err
+		}
+		encryptedPath = agePath
+		extension += ".age"
+	} else if len(cfg.Encryption.Command) == 0 {
+		// report no pubkey
+		cfg.Internal.Warnings.Report(stderr, WarningEncryption, "", "no pubkey found, encryption disabled")
+	}
+	return encryptedPath, extension, nil
+}
+
+// storeArchive uploads the file at `filePath` to `object.Object` and records its size and checksum.
+func storeArchive(ctx context.Context, backend StorageBackend, filePath string, object *BackupObject, opts *BackupOptions, stage func(string, *url.URL), stdout, stderr io.Writer) error {
+	outputFile, err := os.Open(filepath.Clean(filePath))
+	if err != nil {
+		return fmt.Errorf("could not open output file: %s", err.Error())
+	}
+	defer outputFile.Close()
+
+	if opts.Verbose {
+		fmt.Fprintf(stderr, "uploading backup archive of %q to %q\n", opts.Source, object.Object)
+	}
+	fileInfo, err := outputFile.Stat()
+	if err == nil {
+		object.Sizes.Uploaded = fileInfo.Size()
+		stage(StageUploading, object.Object)
+		var input io.ReaderAt = &contextReaderAt{ctx, outputFile}
+		if opts.Uploaded != nil {
+			input = &countingReaderAt{input, opts.Uploaded}
+		}
+		err = backend.StoreFile(ctx, StoreRequest{URI: object.Object, BodyAt: input, Length: fileInfo.Size(), ContentType: object.ContentType})
+	}
+	if err != nil {
+		return fmt.Errorf("unable to write backup archive of %q to %q: %s", opts.Source, object.Object, err.Error())
+	}
+
+	fmt.Fprintf(stdout, "uploaded backup archive of %q to %q\n", opts.Source, object.Object)
+	fmt.Fprintf(stdout, "backup sizes: source %d bytes, archive %d bytes, uploaded %d bytes\n", object.Sizes.Source, object.Sizes.Archive, object.Sizes.Uploaded)
+	object.Checksum, _ = fileChecksum(outputFile, object.Sizes.Uploaded, opts.Config.BufferSize())
+	return nil
+}
+
+// fileChecksum returns the SHA-256 checksum of the first `size` bytes of `input`, read in
+// chunks of `bufferSize` bytes.
+func fileChecksum(input io.ReaderAt, size int64, bufferSize int) (string, error) {
+	hash := sha256.New()
+	_, err := CopyBuffer(hash, io.NewSectionReader(input, 0, size), bufferSize)
+	if err != nil {
+		return "", fmt.Errorf("could not compute checksum: %s", err.Error())
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// ArchiveDirectory creates a gzip-compressed TAR archive of `dirPath` in a temporary file.
+// Returns its path and the total size of regular files in the archive. Progress is reported
+// to `cfg.Internal.Reporter` on the input side against that size. Paths that cannot be read
+// fail the archive with FileErrors listing all of them, unless `cfg.Backup.IgnoreFileErrors`
+// is set, in which case they are left out of the archive.
+func ArchiveDirectory(ctx context.Context, dirPath string, cfg *Config, filter ArchiveFilter) (string, int64, error) {
+	archivePath, sourceSize, _, err := archiveDirectory(ctx, dirPath, archiveRoot(dirPath), cfg, filter)
+	return archivePath, sourceSize, err
+}
+
+// archiveDirectory is ArchiveDirectory with entries named below `rootInArchive`, it also
+// returns the paths left out of the archive because they could not be read.
+func archiveDirectory(ctx context.Context, dirPath, rootInArchive string, cfg *Config, filter ArchiveFilter) (string, int64, FileErrors, error) {
+	// map files on disk to their paths in the archive, dropping excluded entries
+	files, problems, err := sourceFiles(dirPath, rootInArchive, filter.Exclude)
+	if err != nil {
+		return "", 0, nil, fmt.Errorf("could not initialize archive files structure: %s", err.Error())
+	}
+
+	// open files once to find unreadable ones before writing the archive
+	if cfg.Backup.Preflight {
+		var unreadable FileErrors
+		files, unreadable = checkSourceFiles(files)
+		problems = append(problems, unreadable...)
+	}
+	if len(problems) > 0 && !cfg.Backup.IgnoreFileErrors {
+		return "", 0, nil, problems
+	}
+
+	// sum up sizes and count regular files in the source tree
+	var sourceSize, regularFiles int64
+	for _, file := range files {
+		if file.Mode().IsRegular() {
+			sourceSize += file.Size()
+			regularFiles++
+		}
+	}
+
+	// record extended attributes and ACLs before the headers are normalized
+	if cfg.Backup.Xattrs {
+		if err = attachXattrs(files, dirPath, rootInArchive, filter.Warn); err != nil {
+			return "", 0, nil, err
+		}
+	}
+
+	// normalize ownership and permissions of archive entries
+	if filter.Normalize != nil {
+		for index := range files {
+			files[index].FileInfo, err = filter.Normalize(files[index].FileInfo, files[index].LinkTarget)
+			if err != nil {
+				return "", 0, nil, fmt.Errorf("could not normalize archive entry %q: %s", files[index].NameInArchive, err.Error())
+			}
+		}
+	}
+
+	// create the output file we'll write to
+	tmp, err := createTempFile(cfg, "backup")
+	if err != nil {
+		return "", 0, nil, fmt.Errorf("could not create temporary file: %s", err.Error())
+	}
+
+	// we can use the CompressedArchive type to gzip a tarball
+	// (compression is not required; you could use Tar directly)
+	format := archiver.CompressedArchive{
+		Compression: archiver.Gz{},
+		Archival:    archiver.Tar{NumericUIDGID: cfg.Backup.NumericUIDGID},
+	}
+
+	// read small files ahead of the archive writer
+	if cfg.Backup.ReadConcurrency > 0 {
+		stop := prefetchFiles(ctx, files, int(cfg.Backup.ReadConcurrency), prefetch_max_file_size, prefetch_budget)
+		defer stop()
+	}
+
+	// abort reading large files once the context is done
+	for i := range files {
+		if !files[i].Mode().IsRegular() {
+			continue
+		}
+		open := files[i].Open
+		files[i].Open = func() (io.ReadCloser, error) {
+			file, err := open()
+			if err != nil {
+				return nil, err
+			}
+			return struct {
+				io.Reader
+				io.Closer
+			}{&contextReader{ctx, file}, file}, nil
+		}
+	}
+
+	// create the archive, progress is counted on the input side against the source size,
+	// regular files are counted against their number as they are opened
+	var index int = 0
+	var counter *archiveFileCounter
+	if ProgressEnabled(cfg.Internal.Reporter) {
+		var total, totalFiles int64 = sourceSize, regularFiles
+		if cfg.Progress.NoSizeEstimate {
+			total, totalFiles = -1, -1
+		}
+		index, _ = cfg.Internal.Reporter.CreateFileTask(total)
+		_ = cfg.Internal.Reporter.DescribeTask(index, "archiving")
+		counter = &archiveFileCounter{reporter: cfg.Internal.Reporter, index: index, total: totalFiles}
+		for i := range files {
+			if !files[i].Mode().IsRegular() {
+				continue
+			}
+			open := files[i].Open
+			files[i].Open = func() (io.ReadCloser, error) {
+				file, err := open()
+				if err != nil {
+					return nil, err
+				}
+				counter.add()
+				return &progressReadCloser{file, cfg.Internal.Reporter, index}, nil
+			}
+		}
+	}
+
+	// describe the archive in its first entry
+	if filter.Metadata != nil {
+		metadataFile, err := filter.Metadata.archiveFile()
+		if err != nil {
+			_ = tmp.Close()
+			return tmp.Name(), 0, nil, err
+		}
+		files = append([]archiver.File{metadataFile}, files...)
+	}
+
+	err = format.Archive(ctx, tmp, files)
+	if err != nil {
+		_ = tmp.Close()
+		// report the path on disk rather than the name in the archive
+		var fileErr *FileError
+		if errors.As(err, &fileErr) {
+			err = fileErr
+		}
+		return tmp.Name(), 0, nil, fmt.Errorf("failed to generate archive: %s", err.Error())
+	}
+	if index > 0 {
+		counter.finish()
+		cfg.Internal.Reporter.FinishTask(index)
+	}
+
+	// close the file
+	_ = tmp.Close()
+
+	return tmp.Name(), sourceSize, problems, nil
+}
+
+// EncryptFile encrypts the file at `filePath` for `recipients` into a temporary file and returns its path.
+func EncryptFile(filePath string, recipients []age.Recipient, cfg *Config) (string, error) {
+	return encryptFile(context.Background(), filePath, recipients, cfg)
+}
+
+// formatRecipients lists `recipients` by their public key, recipients that cannot be printed
+// are listed by type.
+func formatRecipients(recipients []age.Recipient) string {
+	names := make([]string, 0, len(recipients))
+	for _, recipient := range recipients {
+		if stringer, ok := recipient.(fmt.Stringer); ok {
+			names = append(names, stringer.String())
+		} else {
+			names = append(names, fmt.Sprintf("%T", recipient))
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// encryptFile is EncryptFile, encryption is aborted once `ctx` is done.
+func encryptFile(ctx context.Context, filePath string, recipients []age.Recipient, cfg *Config) (string, error) {
+	// get input file size
+	fileInfo, err := os.Stat(filepath.Clean(filePath))
+	if err != nil {
+		return "", fmt.Errorf("could not stat input file %s: %s", filePath, err.Error())
+	}
+
+	// open input file
+	input, err := os.Open(filepath.Clean(filePath))
+	if err != nil {
+		return "", fmt.Errorf("could not open input file %s: %s", filePath, err.Error())
+	}
+	defer input.Close()
+
+	// create the output file we'll write to
+	tmp, err := createTempFile(cfg, "encrypted")
+	if err != nil {
+		return "", fmt.Errorf("could not create temporary file: %s", err.Error())
+	}
+	defer tmp.Close()
+
+	// create the encrypted writer
+	encryptedWriter, err := age.Encrypt(tmp, recipients...)
+	if err != nil {
+		return tmp.Name(), fmt.Errorf("could not initlize encryption for file '%s': %s", tmp.Name(), err.Error())
+	}
+
+	// encrypt the file
+	var encryptedOutput io.Writer
+	if ProgressEnabled(cfg.Internal.Reporter) {
+		var index int
+		index, _ = cfg.Internal.Reporter.CreateFileTask(fileInfo.Size())
+		_ = cfg.Internal.Reporter.DescribeTask(index, "encrypting")
+		encryptedOutput = io.MultiWriter(
+			encryptedWriter,
+			&progressTaskWriter{
+				cfg.Internal.Reporter,
+				index,
+			},
+		)
+	} else {
+		encryptedOutput = encryptedWriter
+	}
+	numWritten, err := CopyBuffer(encryptedOutput, &contextReader{ctx, input}, cfg.BufferSize())
+	if err != nil {
+		return tmp.Name(), fmt.Errorf("could not write file '%s' to encrypted file '%s': %s", input.Name(), tmp.Name(), err.Error())
+	} else if numWritten == 0 {
+		return tmp.Name(), fmt.Errorf("zero bytes written to encrypted archive")
+	}
+	// the last chunk is written on close, failing if the disk is full
+	if err = encryptedWriter.Close(); err != nil {
+		return tmp.Name(), fmt.Errorf("could not finish encrypted file '%s': %s", tmp.Name(), err.Error())
+	}
+	if err = tmp.Close(); err != nil {
+		return tmp.Name(), fmt.Errorf("could not close encrypted file '%s': %s", tmp.Name(), err.Error())
+	}
+
+	return tmp.Name(), nil
+}
+
+// VerifyEncryptedFile checks that the file at `path` is a binary age file of `plaintextSize`
+// bytes of plaintext without decrypting it: that it begins with the age header, the header is
+// complete and the payload has the size age encryption produces for the plaintext. Encrypted
+// files cut short, e.g. by a full disk, fail verification.
+func VerifyEncryptedFile(path string, plaintextSize int64) error {
+	input, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return fmt.Errorf("could not open encrypted file: %s", err.Error())
+	}
+	defer input.Close()
+	fileInfo, err := input.Stat()
+	if err != nil {
+		return fmt.Errorf("could not stat encrypted file: %s", err.Error())
+	}
+
+	headerSize, err := ageHeaderSize(bufio.NewReader(io.LimitReader(input, maxAgeHeaderSize)))
+	if err != nil {
+		return err
+	}
+
+	/* the payload is a nonce followed by chunks of 64 KiB of plaintext, each with a tag */
+	chunks := (plaintextSize + ageChunkSize - 1) / ageChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	expected := ageNonceSize + plaintextSize + chunks*ageTagSize
+	if payload := fileInfo.Size() - headerSize; payload < expected {
+		return fmt.Errorf("encrypted file is truncated, its payload has %d bytes instead of %d for %d bytes of plaintext", payload, expected, plaintextSize)
+	} else if payload > expected {
+		return fmt.Errorf("encrypted file is too long, its payload has %d bytes instead of %d for %d bytes of plaintext", payload, expected, plaintextSize)
+	}
+	return nil
+}
+
+// ageHeaderSize returns the size of the age header read from `input`: the version line,
+// recipient stanzas and the line of the header MAC.
+func ageHeaderSize(input *bufio.Reader) (int64, error) {
+	var size int64
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := input.ReadString('\n')
+		size += int64(len(line))
+		if err == io.EOF {
+			if lineNumber == 1 && !strings.HasPrefix(AgeHeaderPrefix+"\n", line) {
+				return 0, fmt.Errorf("encrypted file does not begin with the age header %q", AgeHeaderPrefix)
+			}
+			return 0, fmt.Errorf("age header of encrypted file is truncated after %d bytes", size)
+		} else if err != nil {
+			return 0, fmt.Errorf("could not read encrypted file: %s", err.Error())
+		}
+
+		switch {
+		case lineNumber == 1:
+			if line != AgeHeaderPrefix+"\n" {
+				return 0, fmt.Errorf("encrypted file does not begin with the age header %q", AgeHeaderPrefix)
+			}
+		case lineNumber == 2 && !strings.HasPrefix(line, "-> "):
+			return 0, fmt.Errorf("age header of encrypted file has no recipient stanza")
+		case strings.HasPrefix(line, "---"):
+			mac := strings.TrimSuffix(strings.TrimPrefix(line, "--- "), "\n")
+			if decoded, err := base64.RawStdEncoding.Strict().DecodeString(mac); err != nil || len(decoded) != ageMACSize {
+				return 0, fmt.Errorf("age header of encrypted file has an invalid MAC on line %d", lineNumber)
+			}
+			return size, nil
+		}
+	}
+}
+
+// EncryptFileWithCommand pipes the file at `filePath` through the configured encryption command
+// into a temporary file and returns its path. The path is returned on failure as well.
+func EncryptFileWithCommand(ctx context.Context, filePath string, cfg *Config) (string, error) {
+	// get input file size
+	fileInfo, err := os.Stat(filepath.Clean(filePath))
+	if err != nil {
+		return "", fmt.Errorf("could not stat input file %s: %s", filePath, err.Error())
+	}
+
+	// open input file
+	input, err := os.Open(filepath.Clean(filePath))
+	if err != nil {
+		return "", fmt.Errorf("could not open input file %s: %s", filePath, err.Error())
+	}
+	defer input.Close()
+
+	// create the output file we'll write to
+	tmp, err := createTempFile(cfg, "encrypted")
+	if err != nil {
+		return "", fmt.Errorf("could not create temporary file: %s", err.Error())
+	}
+	defer tmp.Close()
+
+	// set up the encryption command
+	commandArgs, err := splitCommandLine(cfg.Encryption.Command)
+	if err != nil {
+		return tmp.Name(), fmt.Errorf("could not parse encryption command: %s", err.Error())
+	}
+	if len(commandArgs) == 0 {
+		return tmp.Name(), fmt.Errorf("encryption command is empty")
+	}
+	if cfg.Encryption.CommandTimeout > 0.0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(cfg.Encryption.CommandTimeout*float64(time.Second)))
+		defer cancel()
+	}
+	// #nosec G204 -- the command is provided by the user configuration
+	cmd := exec.CommandContext(ctx, commandArgs[0], commandArgs[1:]...)
+
+	// pipe the file through the command
+	var commandStderr bytes.Buffer
+	cmd.Stdout = tmp
+	cmd.Stderr = &commandStderr
+	if ProgressEnabled(cfg.Internal.Reporter) {
+		var index int
+		index, _ = cfg.Internal.Reporter.CreateFileTask(fileInfo.Size())
+		defer cfg.Internal.Reporter.FinishTask(index)
+		_ = cfg.Internal.Reporter.DescribeTask(index, "encrypting")
+		cmd.Stdin = io.TeeReader(
+			input,
+			&progressTaskWriter{
+				cfg.Internal.Reporter,
+				index,
+			},
+		)
+	} else {
+		cmd.Stdin = input
+	}
+
+	err = cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return tmp.Name(), fmt.Errorf("encryption command timed out after %g seconds", cfg.Encryption.CommandTimeout)
+	} else if err != nil {
+		return tmp.Name(), fmt.Errorf("encryption command failed: %s: %s", err.Error(), strings.TrimSpace(commandStderr.String()))
+	}
+
+	return tmp.Name(), nil
+}
+
+// splitCommandLine splits `command` into arguments at unquoted whitespace like a POSIX shell
+// does, without expanding anything. Single quotes keep everything up to the next single quote,
+// double quotes keep everything up to the next double quote except for backslash escapes of
+// `"` and `\`, and a backslash outside quotes escapes the next character.
+func splitCommandLine(command string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	var inArg bool
+	runes := []rune(command)
+	for i := 0; i < len(runes); i++ {
+		switch r := runes[i]; {
+		case r == '\'':
+			inArg = true
+			end := i + 1
+			for end < len(runes) && runes[end] != '\'' {
+				end++
+			}
+			if end == len(runes) {
+				return nil, errors.New("unterminated single quote")
+			}
+			arg.WriteString(string(runes[i+1 : end]))
+			i = end
+		case r == '"':
+			inArg = true
+			for i++; ; i++ {
+				if i == len(runes) {
+					return nil, errors.New("unterminated double quote")
+				}
+				if runes[i] == '"' {
+					break
+				}
+				if runes[i] == '\\' && i+1 < len(runes) && (runes[i+1] == '"' || runes[i+1] == '\\') {
+					i++
+				}
+				arg.WriteRune(runes[i])
+			}
+		case r == '\\':
+			if i+1 == len(runes) {
+				return nil, errors.New("trailing backslash")
+			}
+			inArg = true
+			i++
+			arg.WriteRune(runes[i])
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			inArg = true
+			arg.WriteRune(r)
+		}
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
@@ -0,0 +1,930 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+)
+
+// failingRemoveBackend is a MemoryBackend that cannot remove objects.
+type failingRemoveBackend struct {
+	*MemoryBackend
+}
+
+func (frb *failingRemoveBackend) RemoveFile(uri *url.URL) error {
+	return fmt.Errorf("%s", ErrAccessDenied)
+}
+
+// slowStoreBackend is a MemoryBackend that reads uploaded data slowly.
+type slowStoreBackend struct {
+	*MemoryBackend
+}
+
+func (ssb *slowStoreBackend) StoreFile(ctx context.Context, req StoreRequest) error {
+	buf := make([]byte, 1)
+	for offset := int64(0); offset < req.Length; offset++ {
+		if _, err := req.BodyAt.ReadAt(buf, offset); err != nil {
+			return err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return ssb.MemoryBackend.StoreFile(ctx, req)
+}
+
+// helper function: configuration storing backups named after UTC hours.
+func setupBackupConfig(t *testing.T) *Config {
+	var cfg Config
+	if err := cfg.SetDefaultValues(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	cfg.Backup.Name = "2006-01-02T15"
+	cfg.Backup.Timezone = "UTC"
+	cfg.Internal.Reporter = &DummyProgressReporter{}
+	return &cfg
+}
+
+// helper function: source directory holding a single file.
+func setupBackupSource(t *testing.T) string {
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "file.txt"), []byte("test content"), 0600); err != nil {
+		t.Fatalf("could not write to temporary file: %s", err.Error())
+	}
+	return srcDir
+}
+
+/* test cases for TempFileTag */
+func TestTempFileTag(t *testing.T) {
+	// Setup Test
+	nominalTime := time.Date(2024, 5, 1, 5, 30, 0, 0, time.FixedZone("CEST", 2*60*60))
+
+	// Perform the test
+	for uri, expected := range map[string]string{
+		"b2://bucket/hosts/web-1/":                          "bucket-hosts-web-1-20240501T033000Z",
+		"b2://bucket/":                                      "bucket-20240501T033000Z",
+		"memory://bucket/a b/%C3%A4/":                       "bucket-a-b-20240501T033000Z",
+		"b2://bucket/a/very/long/prefix/of/nested/folders/": "long-prefix-of-nested-folders-20240501T033000Z",
+		"file:///": "20240501T033000Z",
+	} {
+		destination, _ := url.ParseRequestURI(uri)
+		assertEquals(t, expected, TempFileTag(destination, nominalTime), "TempFileTag("+uri+")")
+	}
+	assertEquals(t, "20240501T033000Z", TempFileTag(nil, nominalTime), "TempFileTag(nil)")
+}
+
+/* test cases for Backup */
+func TestBackupTempFiles(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	srcDir := setupBackupSource(t)
+	tmpDir := t.TempDir()
+	t.Setenv("TMPDIR", tmpDir)
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("could not generate identity: %s", err.Error())
+	}
+	var tempFiles []string
+	var stderr bytes.Buffer
+
+	// Perform the test
+	_, err = Backup(context.Background(), BackupOptions{
+		Source:      srcDir,
+		Destination: prefixUri,
+		Config:      cfg,
+		Backend:     NewMemoryBackend(),
+		Time:        time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC),
+		Recipients:  []age.Recipient{identity.Recipient()},
+		TempFile: func(path string) {
+			tempFiles = append(tempFiles, path)
+		},
+		Verbose: true,
+		Stderr:  &stderr,
+	})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	/* names identify the destination and the run */
+	assertEquals(t, 2, len(tempFiles), "len(tempFiles)")
+	pattern := regexp.MustCompile(`^SquirrelUp-bucket-prefix-20240501T030000Z-(backup|encrypted)-[0-9]+$`)
+	for index, kind := range []string{"backup", "encrypted"} {
+		assertEquals(t, tmpDir, filepath.Dir(tempFiles[index]), "filepath.Dir(tempFiles)")
+		name := filepath.Base(tempFiles[index])
+		assertEquals(t, true, pattern.MatchString(name) && strings.Contains(name, "-"+kind+"-"), "pattern.MatchString("+name+")")
+		assertEquals(t, true, strings.Contains(stderr.String(), fmt.Sprintf("using temporary file %q\n", tempFiles[index])), "stderr")
+	}
+
+	/* temporary files are removed once the backup is stored */
+	entries, _ := os.ReadDir(tmpDir)
+	assertEquals(t, 0, len(entries), "len(entries)")
+}
+
+/* test cases for Backup */
+func TestBackupStore(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	srcDir := setupBackupSource(t)
+	memory := NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	nominalTime := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("could not generate identity: %s", err.Error())
+	}
+
+	var stages []string
+	var uploaded atomic.Int64
+	var stored *BackupResult
+	var stdout bytes.Buffer
+
+	// Perform the test
+	result, err := Backup(context.Background(), BackupOptions{
+		Source:      srcDir,
+		Destination: prefixUri,
+		Config:      cfg,
+		Backend:     memory,
+		Time:        nominalTime,
+		Recipients:  []age.Recipient{identity.Recipient()},
+		ObjectName:  strings.ToUpper,
+		Stage: func(stage string, object *url.URL) {
+			stages = append(stages, fmt.Sprintf("%s %v", stage, object))
+		},
+		Uploaded: &uploaded,
+		Stored: func(result *BackupResult) error {
+			stored = result
+			return nil
+		},
+		Stdout: &stdout,
+	})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	objectUri := "memory://bucket/prefix/2024-05-01T03.TAR.GZ.AGE"
+	assertEquals(t, objectUri, result.Object.String(), "result.Object")
+	assertEquals(t, "2024-05-01T03.tar.gz.age", result.Name, "result.Name")
+	assertEquals(t, true, result.Stored, "result.Stored")
+	assertEquals(t, int64(12), result.Sizes.Source, "result.Sizes.Source")
+	assertEquals(t, uploaded.Load(), result.Sizes.Uploaded, "result.Sizes.Uploaded")
+	assertEquals(t, true, stored != nil && stored.Stored, "Stored")
+	assertEquals(t, true, result.Cleanup != nil, "result.Cleanup")
+	assertEquals(t, "archiving <nil>,encrypting <nil>,uploading <nil>,uploading "+objectUri+",cleanup "+objectUri, strings.Join(stages, ","), "stages")
+	assertEquals(t, fmt.Sprintf("uploaded backup archive of %q to %q\nbackup sizes: source 12 bytes, archive %d bytes, uploaded %d bytes\n", srcDir, objectUri, result.Sizes.Archive, result.Sizes.Uploaded), stdout.String(), "stdout")
+
+	var buf bytes.Buffer
+	if err = memory.RetrieveFile(&buf, result.Object); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	assertEquals(t, hex.EncodeToString(sum[:]), result.Checksum, "result.Checksum")
+	reader, err := age.Decrypt(&buf, identity)
+	if err != nil {
+		t.Fatalf("could not decrypt backup: %s", err.Error())
+	}
+	archive, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("could not decrypt backup: %s", err.Error())
+	}
+	assertEquals(t, result.Sizes.Archive, int64(len(archive)), "result.Sizes.Archive")
+}
+
+func TestBackupSpecialCharacters(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	cfg.Backup.Name = "2006-01-02T15 Sicherung #ü %+"
+	cfg.Backup.Hours = 24
+	srcDir := setupBackupSource(t)
+	memory := NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/Datenbank Sicherung/ü/")
+
+	// Perform the test
+	var objects []*url.URL
+	for _, nominalTime := range []time.Time{time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC), time.Date(2024, 5, 3, 3, 0, 0, 0, time.UTC)} {
+		result, err := Backup(context.Background(), BackupOptions{
+			Source:      srcDir,
+			Destination: prefixUri,
+			Config:      cfg,
+			Backend:     memory,
+			Time:        nominalTime,
+		})
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		_ = memory.SetFileModified(result.Object, nominalTime)
+		objects = append(objects, result.Object)
+	}
+
+	/* names are stored as they are below the decoded prefix */
+	assertEquals(t, "/Datenbank Sicherung/ü/2024-05-01T03 Sicherung #ü %+.tar.gz", objects[0].Path, "objects[0].Path")
+	assertEquals(t, "memory://bucket/Datenbank%20Sicherung/%C3%BC/2024-05-01T03%20Sicherung%20%23%C3%BC%20%25+.tar.gz", objects[0].String(), "objects[0]")
+
+	/* cleanup removes the listed object that was stored */
+	_, err := memory.GetFileInfo(objects[0])
+	assertEquals(t, ErrFileNotFound, fmt.Sprintf("%v", err), "err")
+	files, _ := memory.ListFiles(prefixUri)
+	assertEquals(t, 1, len(files), "len(files)")
+	assertEquals(t, "Datenbank Sicherung/ü/2024-05-03T03 Sicherung #ü %+.tar.gz", files[0].Name(), "files[0].Name()")
+	assertEquals(t, objects[1].String(), files[0].URI().String(), "files[0].URI()")
+}
+
+func TestBackupBucketRoot(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	cfg.Backup.Hours = 24
+	srcDir := setupBackupSource(t)
+	memory := NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/")
+
+	// Perform the test
+	var objects []*url.URL
+	for _, nominalTime := range []time.Time{time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC), time.Date(2024, 5, 3, 3, 0, 0, 0, time.UTC)} {
+		result, err := Backup(context.Background(), BackupOptions{
+			Source:      srcDir,
+			Destination: prefixUri,
+			Config:      cfg,
+			Backend:     memory,
+			Time:        nominalTime,
+		})
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		_ = memory.SetFileModified(result.Object, nominalTime)
+		objects = append(objects, result.Object)
+	}
+
+	/* objects are stored at the bucket root */
+	assertEquals(t, "memory://bucket/2024-05-01T03.tar.gz", objects[0].String(), "objects[0]")
+
+	/* cleanup removes the root-level object that expired */
+	_, err := memory.GetFileInfo(objects[0])
+	assertEquals(t, ErrFileNotFound, fmt.Sprintf("%v", err), "err")
+	files, _ := memory.ListFiles(prefixUri)
+	assertEquals(t, 1, len(files), "len(files)")
+	assertEquals(t, "2024-05-03T03.tar.gz", files[0].Name(), "files[0].Name()")
+	assertEquals(t, objects[1].String(), files[0].URI().String(), "files[0].URI()")
+}
+
+func TestBackupDryRun(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	srcDir := setupBackupSource(t)
+	memory := NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	var stdout bytes.Buffer
+
+	// Perform the test
+	result, err := Backup(context.Background(), BackupOptions{
+		Source:      srcDir,
+		Destination: prefixUri,
+		Config:      cfg,
+		Backend:     memory,
+		DryRun:      true,
+		Time:        time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC),
+		Stdout:      &stdout,
+	})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	assertEquals(t, "memory://bucket/prefix/2024-05-01T03.tar.gz", result.Object.String(), "result.Object")
+	assertEquals(t, false, result.Stored, "result.Stored")
+	assertEquals(t, result.Sizes.Archive, result.Sizes.Uploaded, "result.Sizes.Uploaded")
+	assertEquals(t, fmt.Sprintf("dry run, backup archive of %q would be uploaded to %q\n", srcDir, result.Object), stdout.String(), "stdout")
+	files, _ := memory.ListFiles(prefixUri)
+	assertEquals(t, 0, len(files), "len(files)")
+}
+
+/* test cases for ArchiveObjectName */
+func TestArchiveObjectName(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+
+	// Perform the test
+	assertEquals(t, "name.tar.gz", ArchiveObjectName(cfg, "name", false), "ArchiveObjectName")
+	assertEquals(t, "name.tar.gz.age", ArchiveObjectName(cfg, "name", true), "ArchiveObjectName(encrypted)")
+	cfg.Encryption.Command = "gpg --encrypt"
+	cfg.Encryption.CommandSuffix = ".gpg"
+	assertEquals(t, "name.tar.gz.gpg.age", ArchiveObjectName(cfg, "name", true), "ArchiveObjectName(command)")
+	cfg.Encryption.Command = ""
+	cfg.Backup.Dedup = true
+	assertEquals(t, "name"+DedupManifestSuffix, ArchiveObjectName(cfg, "name", true), "ArchiveObjectName(dedup)")
+	cfg.Backup.Dedup = false
+	cfg.Backup.Passthrough = true
+	assertEquals(t, "", ArchiveObjectName(cfg, "name", true), "ArchiveObjectName(passthrough)")
+}
+
+func TestBackupSourceSnapshot(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	srcDir := filepath.Join(t.TempDir(), "data")
+	snapshotDir := filepath.Join(t.TempDir(), "snapshot", "data-copy")
+	for dir, content := range map[string]string{srcDir: "live content", snapshotDir: "snapshot content"} {
+		_ = os.MkdirAll(dir, 0700)
+		if err := os.WriteFile(filepath.Join(dir, "file.txt"), []byte(content), 0600); err != nil {
+			t.Fatalf("could not write to temporary file: %s", err.Error())
+		}
+	}
+	memory := NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+
+	// Perform the test
+	for _, source := range []string{srcDir, srcDir + string(filepath.Separator)} {
+		result, err := Backup(context.Background(), BackupOptions{
+			Source:         source,
+			SourceSnapshot: snapshotDir,
+			Destination:    prefixUri,
+			Config:         cfg,
+			Backend:        memory,
+			Time:           time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC),
+		})
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		assertEquals(t, int64(16), result.Sizes.Source, "result.Sizes.Source")
+
+		/* entries are read from the snapshot, but named after the source */
+		archivePath := filepath.Join(t.TempDir(), "backup.tar.gz")
+		archive, _ := os.Create(archivePath)
+		err = memory.RetrieveFile(archive, result.Object)
+		archive.Close()
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		expected := "data,data/file.txt"
+		if HasTrailingSeparator(source) {
+			expected = "file.txt"
+		}
+		assertEquals(t, expected, strings.Join(archiveEntries(t, archivePath), ","), "entries")
+	}
+}
+
+func TestBackupStoredHookError(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	srcDir := setupBackupSource(t)
+	memory := NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+
+	// Perform the test
+	result, err := Backup(context.Background(), BackupOptions{
+		Source:      srcDir,
+		Destination: prefixUri,
+		Config:      cfg,
+		Backend:     memory,
+		Time:        time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC),
+		Stored: func(result *BackupResult) error {
+			return fmt.Errorf("fingerprint not stored")
+		},
+	})
+	if err == nil {
+		t.Fatalf("Backup was supposed to fail")
+	}
+	assertEquals(t, "fingerprint not stored", err.Error(), "err")
+	assertEquals(t, true, result.Stored, "result.Stored")
+	assertEquals(t, true, result.Cleanup == nil, "result.Cleanup")
+}
+
+func TestBackupCleanupError(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	cfg.Backup.Hours = 1
+	srcDir := setupBackupSource(t)
+	memory := NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	oldUri, _ := prefixUri.Parse("2024-04-01T03.tar.gz")
+	_ = memory.StoreFile(context.Background(), StoreRequest{URI: oldUri, BodyAt: bytes.NewReader([]byte("old")), Length: 3})
+	_ = memory.SetFileModified(oldUri, time.Date(2024, 4, 1, 3, 0, 0, 0, time.UTC))
+
+	// Perform the test
+	result, err := Backup(context.Background(), BackupOptions{
+		Source:      srcDir,
+		Destination: prefixUri,
+		Config:      cfg,
+		Backend:     &failingRemoveBackend{memory},
+		Time:        time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC),
+	})
+	var cleanupErr *CleanupError
+	if !errors.As(err, &cleanupErr) {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "cleanup completed with 1 failures: prefix/2024-04-01T03.tar.gz", cleanupErr.Error(), "cleanupErr")
+	assertEquals(t, true, result.Stored, "result.Stored")
+	assertEquals(t, true, result.Cleanup.Remaining["2024-04-01T03.tar.gz"], "result.Cleanup.Remaining")
+}
+
+func TestBackupInvalidSource(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	memory := NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+
+	// Perform the test
+	result, err := Backup(context.Background(), BackupOptions{
+		Source:      filepath.Join(t.TempDir(), "missing"),
+		Destination: prefixUri,
+		Config:      cfg,
+		Backend:     memory,
+	})
+	if err == nil {
+		t.Fatalf("Backup was supposed to fail")
+	}
+	assertEquals(t, false, result.Stored, "result.Stored")
+
+	_, err = Backup(context.Background(), BackupOptions{Source: ".", Destination: prefixUri})
+	if err == nil {
+		t.Fatalf("Backup was supposed to fail")
+	}
+	assertEquals(t, "no backup configuration given", err.Error(), "err")
+}
+
+/* test cases for EncryptFileWithCommand */
+func TestBackupEncryptionRequired(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	cfg.Encryption.Required = true
+	memory := NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("could not generate identity: %s", err.Error())
+	}
+
+	// Perform the test
+	assertEquals(t, nil, CheckEncryptionPolicy(cfg, []age.Recipient{identity.Recipient()}), "CheckEncryptionPolicy")
+
+	/* the source is never read without recipients */
+	_, err = Backup(context.Background(), BackupOptions{
+		Source:      filepath.Join(t.TempDir(), "missing"),
+		Destination: prefixUri,
+		Config:      cfg,
+		Backend:     memory,
+	})
+	if err == nil {
+		t.Fatalf("Backup was supposed to fail")
+	}
+	assertEquals(t, ErrEncryptionRequired, err.Error(), "err")
+
+	/* without the policy unencrypted backups are reported */
+	var stderr bytes.Buffer
+	cfg.Encryption.Required = false
+	_, err = Backup(context.Background(), BackupOptions{
+		Source:      setupBackupSource(t),
+		Destination: prefixUri,
+		Config:      cfg,
+		Backend:     memory,
+		Stderr:      &stderr,
+	})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, strings.HasPrefix(stderr.String(), "warning: no pubkey found, encryption disabled\n"), "stderr")
+}
+
+func TestBackupDeadline(t *testing.T) {
+	// Setup Test
+	t.Setenv("TMPDIR", t.TempDir())
+	cfg := setupBackupConfig(t)
+	srcDir := setupBackupSource(t)
+	memory := NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("could not generate identity: %s", err.Error())
+	}
+	options := BackupOptions{
+		Source:      srcDir,
+		Destination: prefixUri,
+		Config:      cfg,
+		Backend:     &slowStoreBackend{memory},
+		Time:        time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC),
+		Recipients:  []age.Recipient{identity.Recipient()},
+	}
+
+	// Perform the test
+	/* the upload is aborted once the deadline passes */
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	result, err := Backup(ctx, options)
+	if err == nil {
+		t.Fatalf("Backup was supposed to fail")
+	}
+	assertEquals(t, true, strings.HasSuffix(err.Error(), context.DeadlineExceeded.Error()), "err")
+	assertEquals(t, false, result.Stored, "result.Stored")
+	filelist, _ := memory.ListFiles(prefixUri)
+	assertEquals(t, 0, len(filelist), "len(filelist)")
+
+	/* archiving and encryption are not started after the deadline */
+	_, err = Backup(ctx, options)
+	if err == nil {
+		t.Fatalf("Backup was supposed to fail")
+	}
+	assertEquals(t, "failed to generate archive: context deadline exceeded", err.Error(), "err")
+
+	/* encryption is aborted */
+	encryptedPath, err := encryptFile(ctx, filepath.Join(srcDir, "file.txt"), options.Recipients, cfg)
+	_ = os.Remove(encryptedPath)
+	if err == nil {
+		t.Fatalf("encryptFile was supposed to fail")
+	}
+	assertEquals(t, true, strings.HasSuffix(err.Error(), context.DeadlineExceeded.Error()), "err")
+
+	/* temporary files are removed */
+	entries, _ := os.ReadDir(os.TempDir())
+	assertEquals(t, 0, len(entries), "len(entries)")
+}
+
+func TestVerifyEncryptedFile(t *testing.T) {
+	// Setup Test
+	t.Setenv("TMPDIR", t.TempDir())
+	cfg := setupBackupConfig(t)
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("could not generate identity: %s", err.Error())
+	}
+	recipients := []age.Recipient{identity.Recipient(), identity.Recipient()}
+	encrypt := func(size int) []byte {
+		plaintextPath := filepath.Join(t.TempDir(), "plaintext")
+		if err := os.WriteFile(plaintextPath, bytes.Repeat([]byte("x"), size), 0600); err != nil {
+			t.Fatalf("could not write to temporary file: %s", err.Error())
+		}
+		encryptedPath, err := encryptFile(context.Background(), plaintextPath, recipients, cfg)
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		defer os.Remove(encryptedPath)
+		if err = verifyEncrypted(encryptedPath, plaintextPath); err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		encrypted, err := os.ReadFile(encryptedPath)
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		return encrypted
+	}
+	verify := func(encrypted []byte, size int64) error {
+		encryptedPath := filepath.Join(t.TempDir(), "encrypted")
+		if err := os.WriteFile(encryptedPath, encrypted, 0600); err != nil {
+			t.Fatalf("could not write to temporary file: %s", err.Error())
+		}
+		return VerifyEncryptedFile(encryptedPath, size)
+	}
+
+	// Perform the test
+	/* files encrypted completely pass, including those ending on a full chunk */
+	for _, size := range []int{1, 1000, ageChunkSize, ageChunkSize + 1, 3 * ageChunkSize} {
+		encrypted := encrypt(size)
+		if err = verify(encrypted, int64(size)); err != nil {
+			t.Fatalf("unexpected test result for %d bytes: %+v", size, err)
+		}
+	}
+
+	encrypted := encrypt(100000)
+	headerSize := bytes.Index(encrypted, []byte("\n---")) + 1
+	headerSize += bytes.IndexByte(encrypted[headerSize:], '\n') + 1
+	corrupted := func(offset int, value string) []byte {
+		fixture := append([]byte(nil), encrypted...)
+		copy(fixture[offset:], value)
+		return fixture
+	}
+	noStanza := append([]byte(AgeHeaderPrefix+"\n"), encrypted[bytes.Index(encrypted, []byte("\n---"))+1:]...)
+
+	testCases := []struct {
+		name      string
+		encrypted []byte
+		size      int64
+		expected  string
+	}{
+		{"truncated payload", encrypted[:len(encrypted)-1], 100000, "encrypted file is truncated, its payload has 100047 bytes instead of 100048 for 100000 bytes of plaintext"},
+		{"truncated chunk", encrypted[:headerSize+ageNonceSize+ageChunkSize], 100000, fmt.Sprintf("encrypted file is truncated, its payload has %d bytes instead of 100048 for 100000 bytes of plaintext", ageNonceSize+ageChunkSize)},
+		{"payload missing", encrypted[:headerSize], 100000, "encrypted file is truncated, its payload has 0 bytes instead of 100048 for 100000 bytes of plaintext"},
+		{"truncated header", encrypted[:headerSize-10], 100000, fmt.Sprintf("age header of encrypted file is truncated after %d bytes", headerSize-10)},
+		{"truncated version", encrypted[:10], 100000, "age header of encrypted file is truncated after 10 bytes"},
+		{"empty", nil, 100000, "age header of encrypted file is truncated after 0 bytes"},
+		{"appended data", append(append([]byte(nil), encrypted...), 0), 100000, "encrypted file is too long, its payload has 100049 bytes instead of 100048 for 100000 bytes of plaintext"},
+		{"other plaintext size", encrypted, 100001, "encrypted file is truncated, its payload has 100048 bytes instead of 100049 for 100001 bytes of plaintext"},
+		{"corrupted version", corrupted(0, "AGE"), 100000, `encrypted file does not begin with the age header "age-encryption.org/v1"`},
+		{"plaintext", []byte("test content\n"), 13, `encrypted file does not begin with the age header "age-encryption.org/v1"`},
+		{"corrupted MAC", corrupted(headerSize-5, "!"), 100000, "age header of encrypted file has an invalid MAC on line 6"},
+		{"no stanza", noStanza, 100000, "age header of encrypted file has no recipient stanza"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			if err := verify(testCase.encrypted, testCase.size); err == nil {
+				t.Fatalf("This test should throw an error")
+			} else {
+				assertEquals(t, testCase.expected, err.Error(), "err.Error")
+			}
+		})
+	}
+}
+
+func TestBackupEncryptionVerify(t *testing.T) {
+	// Setup Test
+	tmpDir := t.TempDir()
+	t.Setenv("TMPDIR", tmpDir)
+	cfg := setupBackupConfig(t)
+	srcDir := setupBackupSource(t)
+	memory := NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("could not generate identity: %s", err.Error())
+	}
+	/* the encrypted file is cut short */
+	verify := verifyEncrypted
+	defer func() { verifyEncrypted = verify }()
+	verifyEncrypted = func(encryptedPath, plaintextPath string) error {
+		encryptedInfo, _ := os.Stat(encryptedPath)
+		_ = os.Truncate(encryptedPath, encryptedInfo.Size()-1)
+		plaintextInfo, _ := os.Stat(plaintextPath)
+		return VerifyEncryptedFile(encryptedPath, plaintextInfo.Size())
+	}
+	var tempFiles []string
+
+	// Perform the test
+	result, err := Backup(context.Background(), BackupOptions{
+		Source:      srcDir,
+		Destination: prefixUri,
+		Config:      cfg,
+		Backend:     memory,
+		Time:        time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC),
+		Recipients:  []age.Recipient{identity.Recipient()},
+		TempFile: func(path string) {
+			tempFiles = append(tempFiles, path)
+		},
+	})
+	if err == nil {
+		t.Fatalf("Backup was supposed to fail")
+	}
+
+	/* the backup is not uploaded, the unencrypted archive is kept */
+	var verifyErr *EncryptionVerifyError
+	assertEquals(t, true, errors.As(err, &verifyErr), "errors.As")
+	assertEquals(t, tempFiles[0], verifyErr.Plaintext, "verifyErr.Plaintext")
+	assertEquals(t, true, strings.HasPrefix(err.Error(), "encrypted backup archive failed verification: encrypted file is truncated, its payload has "), "err.Error")
+	assertEquals(t, true, strings.HasSuffix(err.Error(), fmt.Sprintf(", kept the unencrypted archive %q", tempFiles[0])), "err.Error")
+	assertEquals(t, false, result.Stored, "result.Stored")
+	filelist, _ := memory.ListFiles(prefixUri)
+	assertEquals(t, 0, len(filelist), "len(filelist)")
+	entries, _ := os.ReadDir(tmpDir)
+	assertEquals(t, 1, len(entries), "len(entries)")
+	assertEquals(t, filepath.Base(tempFiles[0]), entries[0].Name(), "entries[0].Name")
+}
+
+func TestBackupContentType(t *testing.T) {
+	// Setup Test
+	t.Setenv("TMPDIR", t.TempDir())
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("could not generate identity: %s", err.Error())
+	}
+	tarHeader := make([]byte, 512)
+	copy(tarHeader[257:], "ustar")
+	files := map[string][]byte{
+		"text":  []byte("test content"),
+		"gzip":  {0x1f, 0x8b, 0x08, 0x00},
+		"zstd":  {0x28, 0xb5, 0x2f, 0xfd, 0x00},
+		"tar":   tarHeader,
+		"empty": {},
+	}
+
+	testCases := []struct {
+		name        string
+		file        string
+		command     string
+		encrypted   bool
+		contentType string
+		expected    string
+	}{
+		{"archive", "", "", false, "", "application/gzip"},
+		{"archive encrypted", "", "", true, "", "application/age-encryption"},
+		{"archive command", "", "/bin/cat", false, "", "application/octet-stream"},
+		{"archive command encrypted", "", "/bin/cat", true, "", "application/age-encryption"},
+		{"passthrough gzip", "gzip", "", false, "", "application/gzip"},
+		{"passthrough zstd", "zstd", "", false, "", "application/zstd"},
+		{"passthrough tar", "tar", "", false, "", "application/x-tar"},
+		{"passthrough text", "text", "", false, "", "application/octet-stream"},
+		{"passthrough empty", "empty", "", false, "", "application/octet-stream"},
+		{"passthrough zstd encrypted", "zstd", "", true, "", "application/age-encryption"},
+		{"passthrough zstd command", "zstd", "/bin/cat", false, "", "application/octet-stream"},
+		{"override", "", "", true, "application/x-custom", "application/x-custom"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			cfg := setupBackupConfig(t)
+			cfg.Backup.Hours = 0
+			cfg.Backup.MinSizeBytes = 0
+			cfg.Encryption.Command = testCase.command
+			cfg.Backup.ContentType = testCase.contentType
+			srcDir := setupBackupSource(t)
+			if len(testCase.file) > 0 {
+				cfg.Backup.Passthrough = true
+				srcDir = t.TempDir()
+				if err := os.WriteFile(filepath.Join(srcDir, "file"), files[testCase.file], 0600); err != nil {
+					t.Fatalf("could not write to temporary file: %s", err.Error())
+				}
+			}
+			var recipients []age.Recipient
+			if testCase.encrypted {
+				recipients = []age.Recipient{identity.Recipient()}
+			}
+			prefix := test_content_type_prefix + strings.ReplaceAll(testCase.name, " ", "-") + "/"
+			prefixUri, _ := url.ParseRequestURI("b2://test-bucket/" + prefix)
+
+			// Perform the test
+			result, err := Backup(context.Background(), BackupOptions{
+				Source:      srcDir,
+				Destination: prefixUri,
+				Config:      cfg,
+				Backend:     setupB2Backend(),
+				Time:        time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC),
+				Recipients:  recipients,
+			})
+			if err != nil {
+				t.Fatalf("unexpected test result: %+v", err)
+			}
+
+			/* the upload request carries the type of the stored object */
+			contentType, _ := actual_content_types.Load(prefix + result.Name)
+			assertEquals(t, testCase.expected, contentType, "ContentType")
+			assertEquals(t, testCase.expected, result.Objects[0].ContentType, "result.Objects[0].ContentType")
+		})
+	}
+}
+
+type opaqueRecipient struct{}
+
+func (opaqueRecipient) Wrap(fileKey []byte) ([]*age.Stanza, error) { return nil, nil }
+
+func TestFormatRecipients(t *testing.T) {
+	const pubkey = "age1xmwwc06ly3ee5rytxm9mflaz2u56jjj36s0mypdrwsvlul66mv4q47ryef"
+	recipient, err := age.ParseX25519Recipient(pubkey)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	assertEquals(t, "", formatRecipients(nil), "formatRecipients(nil)")
+	assertEquals(t, pubkey, formatRecipients([]age.Recipient{recipient}), "formatRecipients(recipient)")
+	assertEquals(t, pubkey+", common.opaqueRecipient", formatRecipients([]age.Recipient{recipient, opaqueRecipient{}}), "formatRecipients(opaque)")
+}
+
+func TestEncryptFileWithCommand(t *testing.T) {
+	var cfg Config
+	if err := cfg.SetDefaultValues(); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Setup Test
+	tmpDir := t.TempDir()
+	inputPath := filepath.Join(tmpDir, "input")
+	if err := os.WriteFile(inputPath, []byte("test content"), 0600); err != nil {
+		t.Fatalf("could not write to temporary file: %s", err.Error())
+	}
+	failingScript := filepath.Join(tmpDir, "failing.sh")
+	if err := os.WriteFile(failingScript, []byte("#!/bin/sh\necho 'kms unavailable' >&2\nexit 3\n"), 0700); err != nil {
+		t.Fatalf("could not write to temporary file: %s", err.Error())
+	}
+
+	/* pass through /bin/cat */
+	cfg.Encryption.Command = "/bin/cat"
+	cfg.Internal.Reporter = &DummyProgressReporter{}
+	outputPath, err := EncryptFileWithCommand(context.Background(), inputPath, &cfg)
+	defer os.Remove(outputPath)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	data, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatalf("could not read output file: %s", err.Error())
+	}
+	assertEquals(t, "test content", string(data), "content")
+
+	/* failing command */
+	cfg.Encryption.Command = failingScript
+	outputPath, err = EncryptFileWithCommand(context.Background(), inputPath, &cfg)
+	defer os.Remove(outputPath)
+	if err == nil {
+		t.Fatalf("EncryptFileWithCommand was supposed to fail")
+	}
+	assertEquals(t, "encryption command failed: exit status 3: kms unavailable", err.Error(), "Error")
+
+	/* command exceeding the timeout */
+	cfg.Encryption.Command = "sleep 5"
+	cfg.Encryption.CommandTimeout = 0.1
+	outputPath, err = EncryptFileWithCommand(context.Background(), inputPath, &cfg)
+	defer os.Remove(outputPath)
+	if err == nil {
+		t.Fatalf("EncryptFileWithCommand was supposed to fail")
+	}
+	assertEquals(t, "encryption command timed out after 0.1 seconds", err.Error(), "Error")
+
+	/* quoted arguments and paths with spaces, the progress task is finished */
+	spacedDir := filepath.Join(tmpDir, "with space")
+	if err := os.Mkdir(spacedDir, 0700); err != nil {
+		t.Fatalf("could not create directory: %s", err.Error())
+	}
+	prefixScript := filepath.Join(spacedDir, "prefix.sh")
+	if err := os.WriteFile(prefixScript, []byte("#!/bin/sh\nprintf '%s|' \"$1\"\ncat\n"), 0700); err != nil {
+		t.Fatalf("could not write to temporary file: %s", err.Error())
+	}
+	reporter := &recordingReporter{}
+	cfg.Internal.Reporter = reporter
+	cfg.Encryption.Command = `"` + prefixScript + `" 'Backup Key'`
+	cfg.Encryption.CommandTimeout = 3600
+	outputPath, err = EncryptFileWithCommand(context.Background(), inputPath, &cfg)
+	defer os.Remove(outputPath)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	data, err = os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatalf("could not read output file: %s", err.Error())
+	}
+	assertEquals(t, "Backup Key|test content", string(data), "content")
+	assertEquals(t, "[1]", fmt.Sprintf("%v", reporter.finished), "reporter.finished")
+
+	/* unterminated quotes */
+	cfg.Encryption.Command = `"` + prefixScript
+	outputPath, err = EncryptFileWithCommand(context.Background(), inputPath, &cfg)
+	defer os.Remove(outputPath)
+	if err == nil {
+		t.Fatalf("EncryptFileWithCommand was supposed to fail")
+	}
+	assertEquals(t, "could not parse encryption command: unterminated double quote", err.Error(), "Error")
+}
+
+func TestSplitCommandLine(t *testing.T) {
+	for _, testCase := range []struct {
+		command  string
+		expected []string
+		err      string
+	}{
+		{"", nil, ""},
+		{"  gpg   --encrypt\t-r key ", []string{"gpg", "--encrypt", "-r", "key"}, ""},
+		{`'/opt/my tools/encrypt' --recipient "Backup Key"`, []string{"/opt/my tools/encrypt", "--recipient", "Backup Key"}, ""},
+		{`/opt/my\ tools/encrypt --label=a'b c'd ""`, []string{"/opt/my tools/encrypt", "--label=ab cd", ""}, ""},
+		{`encrypt "say \"hi\" \\ \n" 'keep \ as is'`, []string{"encrypt", `say "hi" \ \n`, `keep \ as is`}, ""},
+		{`encrypt 'key`, nil, "unterminated single quote"},
+		{`encrypt "key`, nil, "unterminated double quote"},
+		{`encrypt key\`, nil, "trailing backslash"},
+	} {
+		args, err := splitCommandLine(testCase.command)
+		if len(testCase.err) > 0 {
+			assertEquals(t, testCase.err, fmt.Sprintf("%v", err), "err "+testCase.command)
+			continue
+		}
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		assertEquals(t, fmt.Sprintf("%q", testCase.expected), fmt.Sprintf("%q", args), "splitCommandLine "+testCase.command)
+	}
+}
+
+/* test cases for the number of archived files */
+func TestArchiveDirectoryFileCount(t *testing.T) {
+	// Setup Test
+	srcDir := t.TempDir()
+	writeSmallFiles(t, srcDir, 1500, 16)
+	cfg := setupBackupConfig(t)
+
+	for _, testCase := range []struct {
+		noSizeEstimate bool
+		expected       string
+	}{
+		{false, "archiving, files 1,500/1,500"},
+		{true, "archiving, files 1,500"},
+	} {
+		reporter := &recordingReporter{}
+		cfg.Internal.Reporter = reporter
+		cfg.Progress.NoSizeEstimate = testCase.noSizeEstimate
+
+		// Perform the test
+		archivePath, _, err := ArchiveDirectory(context.Background(), srcDir, cfg, ArchiveFilter{})
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		_ = os.Remove(archivePath)
+
+		/* the last description holds the final number of files */
+		assertEquals(t, true, len(reporter.descriptions) > 1, "len(descriptions)")
+		assertEquals(t, "archiving", reporter.descriptions[0], "descriptions[0]")
+		assertEquals(t, testCase.expected, reporter.descriptions[len(reporter.descriptions)-1], "description")
+		assertEquals(t, "[1]", fmt.Sprint(reporter.finished), "finished")
+	}
+}
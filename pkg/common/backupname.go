@@ -0,0 +1,160 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// NameFormatGo interprets backup.name as a Go time layout.
+	NameFormatGo = "go"
+	// NameFormatStrftime interprets backup.name as strftime pattern, translated to a Go time layout.
+	NameFormatStrftime = "strftime"
+)
+
+var (
+	// strftimeLayouts maps strftime directives to their Go time layout equivalents.
+	strftimeLayouts = map[byte]string{
+		'Y': "2006",
+		'y': "06",
+		'm': "01",
+		'd': "02",
+		'e': "_2",
+		'j': "002",
+		'H': "15",
+		'I': "03",
+		'M': "04",
+		'S': "05",
+		'p': "PM",
+		'b': "Jan",
+		'h': "Jan",
+		'B': "January",
+		'a': "Mon",
+		'A': "Monday",
+		'z': "-0700",
+		'Z': "MST",
+		'F': "2006-01-02",
+		'T': "15:04:05",
+		'R': "15:04",
+		'D': "01/02/06",
+	}
+
+	// nameProbeTime is formatted with literal parts of backup names to detect time components, no
+	// component of it formats the same as any layout element.
+	nameProbeTime = time.Date(2024, time.November, 28, 1, 47, 59, 123456789, time.UTC)
+)
+
+// TranslateStrftime returns the Go time layout equivalent to the strftime `pattern`. Fails on
+// directives without a Go equivalent and on literal text Go would read as a time component,
+// such as digits or month names, since Go layouts cannot escape it.
+func TranslateStrftime(pattern string) (string, error) {
+	var layout, literal strings.Builder
+	flush := func() error {
+		text := literal.String()
+		literal.Reset()
+		if nameProbeTime.Format(text) != text {
+			return fmt.Errorf("literal text %q of backup name %q would be read as a time component", text, pattern)
+		}
+		layout.WriteString(text)
+		return nil
+	}
+	for index := 0; index < len(pattern); index++ {
+		if pattern[index] != '%' {
+			literal.WriteByte(pattern[index])
+			continue
+		}
+		if index+1 == len(pattern) {
+			return "", fmt.Errorf("backup name %q ends with an incomplete directive", pattern)
+		}
+		index++
+		if pattern[index] == '%' {
+			literal.WriteByte('%')
+			continue
+		}
+		goLayout, prs := strftimeLayouts[pattern[index]]
+		if !prs {
+			return "", fmt.Errorf("strftime directive %%%c of backup name %q has no Go equivalent", pattern[index], pattern)
+		}
+		if err := flush(); err != nil {
+			return "", err
+		}
+		layout.WriteString(goLayout)
+	}
+	if err := flush(); err != nil {
+		return "", err
+	}
+	return layout.String(), nil
+}
+
+// NameLayout returns the Go time layout of backup names, backup.name translated according to
+// backup.name_format.
+func (cfg *Config) NameLayout() (string, error) {
+	switch cfg.Backup.NameFormat {
+	case NameFormatGo:
+		return cfg.Backup.Name, nil
+	case NameFormatStrftime:
+		return TranslateStrftime(cfg.Backup.Name)
+	}
+	return "", fmt.Errorf("invalid backup name format %q, expecting %q or %q", cfg.Backup.NameFormat, NameFormatGo, NameFormatStrftime)
+}
+
+// validateName checks backup.name: Go layouts must not contain strftime directives, which Go
+// copies into names verbatim, and strftime patterns must translate to a Go layout. A layout
+// without any time component names every backup the same, which is an error with
+// backup.name_strict and reported by NameWarnings otherwise.
+func (cfg *Config) validateName() error {
+	layout, err := cfg.NameLayout()
+	if err != nil {
+		return err
+	}
+	if cfg.Backup.NameFormat == NameFormatGo {
+		if directive, goLayout, found := strftimeDirective(layout); found && len(goLayout) > 0 {
+			return fmt.Errorf("backup name %q contains strftime directive %s, use the Go layout %q or set backup.name_format to '%s'", layout, directive, goLayout, NameFormatStrftime)
+		} else if found {
+			return fmt.Errorf("backup name %q contains strftime directive %s, use a Go layout such as %q", layout, directive, "2006-01-02T15-0700")
+		}
+	}
+	if cfg.Backup.NameStrict && constantLayout(layout) {
+		return fmt.Errorf("backup name %q contains no time component, every backup would overwrite the previous one", cfg.Backup.Name)
+	}
+	return nil
+}
+
+// NameWarnings returns problems of backup.name that do not fail validation, that is a name
+// without any time component, which replaces the previous backup each time.
+func (cfg *Config) NameWarnings() []string {
+	layout, err := cfg.NameLayout()
+	if err != nil {
+		return nil
+	}
+	if constantLayout(layout) {
+		return []string{fmt.Sprintf("backup name %q contains no time component, every backup overwrites the previous one, set backup.name_strict to fail instead", cfg.Backup.Name)}
+	}
+	return nil
+}
+
+// constantLayout reports whether formatting times differing in every component with `layout`
+// yields the same name.
+func constantLayout(layout string) bool {
+	later := nameProbeTime.AddDate(1, 1, 1).Add(time.Hour + time.Minute + time.Second)
+	return nameProbeTime.Format(layout) == later.Format(layout)
+}
+
+// strftimeDirective returns the first strftime directive found in `layout` along with the Go
+// layout the whole name translates to, empty if it cannot be translated.
+func strftimeDirective(layout string) (string, string, bool) {
+	for index := 0; index+1 < len(layout); index++ {
+		if layout[index] != '%' {
+			continue
+		}
+		if _, prs := strftimeLayouts[layout[index+1]]; prs {
+			goLayout, err := TranslateStrftime(layout)
+			if err != nil {
+				goLayout = ""
+			}
+			return layout[index : index+2], goLayout, true
+		}
+	}
+	return "", "", false
+}
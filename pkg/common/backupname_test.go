@@ -0,0 +1,95 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+/* test cases for TranslateStrftime */
+func TestTranslateStrftime(t *testing.T) {
+	for _, testCase := range []struct{ pattern, expected string }{
+		{"%Y-%m-%dT%H-%M", "2006-01-02T15-04"},
+		{"backup-%Y%m%d", "backup-20060102"},
+		{"%F_%H%M%S", "2006-01-02_150405"},
+		{"%d.%b.%y %I%p", "02.Jan.06 03PM"},
+		{"%A %e %B, week of %j", "Monday _2 January, week of 002"},
+		{"%FT%T%z", "2006-01-02T15:04:05-0700"},
+		{"%Y-%m-%d (%%)", "2006-01-02 (%)"},
+	} {
+		layout, err := TranslateStrftime(testCase.pattern)
+		if err != nil {
+			t.Fatalf("unexpected test result for %q: %+v", testCase.pattern, err)
+		}
+		assertEquals(t, testCase.expected, layout, "TranslateStrftime("+testCase.pattern+")")
+	}
+
+	/* directives without Go equivalent and literal text read as time components are rejected */
+	for _, testCase := range []struct{ pattern, expected string }{
+		{"backup-%s", `strftime directive %s of backup name "backup-%s" has no Go equivalent`},
+		{"week-%V", `strftime directive %V of backup name "week-%V" has no Go equivalent`},
+		{"backup-%", `backup name "backup-%" ends with an incomplete directive`},
+		{"host1-%Y", `literal text "host1-" of backup name "host1-%Y" would be read as a time component`},
+		{"Jan-%Y", `literal text "Jan-" of backup name "Jan-%Y" would be read as a time component`},
+	} {
+		if _, err := TranslateStrftime(testCase.pattern); err == nil {
+			t.Fatalf("This test should throw an error")
+		} else {
+			assertEquals(t, testCase.expected, err.Error(), "err.Error")
+		}
+	}
+}
+
+/* test cases for validateName */
+func TestValidateName(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	now := time.Date(2024, time.May, 1, 3, 4, 5, 0, time.UTC)
+
+	/* strftime directives in Go layouts are rejected with the Go equivalent */
+	for _, testCase := range []struct{ name, expected string }{
+		{"backup-%Y%m%d", `backup name "backup-%Y%m%d" contains strftime directive %Y, use the Go layout "backup-20060102" or set backup.name_format to 'strftime'`},
+		{"%F_%H-%M", `backup name "%F_%H-%M" contains strftime directive %F, use the Go layout "2006-01-02_15-04" or set backup.name_format to 'strftime'`},
+		{"%Y-%s", `backup name "%Y-%s" contains strftime directive %Y, use a Go layout such as "2006-01-02T15-0700"`},
+	} {
+		cfg.Backup.Name = testCase.name
+		if err := cfg.validateName(); err == nil {
+			t.Fatalf("This test should throw an error")
+		} else {
+			assertEquals(t, testCase.expected, err.Error(), "err.Error")
+		}
+	}
+
+	/* strftime patterns are translated */
+	cfg.Backup.Name, cfg.Backup.NameFormat = "backup-%Y%m%d-%H%M", NameFormatStrftime
+	if err := cfg.validateName(); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	name, err := cfg.BackupName(now)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "backup-20240501-0304", name, "cfg.BackupName")
+
+	/* layouts without time component are reported, and rejected with backup.name_strict */
+	for _, testCase := range []struct {
+		name, format string
+		constant     bool
+	}{
+		{"backup", NameFormatGo, true},
+		{"backup-%%", NameFormatStrftime, true},
+		{"latest.tar", NameFormatGo, true},
+		{"2006-01-02T15-0700", NameFormatGo, false},
+		{"Monday", NameFormatGo, false},
+		{"%H%M", NameFormatStrftime, false},
+	} {
+		cfg.Backup.Name, cfg.Backup.NameFormat, cfg.Backup.NameStrict = testCase.name, testCase.format, false
+		assertEquals(t, nil, cfg.validateName(), "cfg.validateName("+testCase.name+")")
+		assertEquals(t, testCase.constant, len(cfg.NameWarnings()) > 0, "cfg.NameWarnings("+testCase.name+")")
+		cfg.Backup.NameStrict = true
+		assertEquals(t, testCase.constant, cfg.validateName() != nil, "cfg.validateName("+testCase.name+")")
+	}
+
+	/* unknown formats are rejected */
+	cfg.Backup.NameFormat = "posix"
+	assertEquals(t, `invalid backup name format "posix", expecting "go" or "strftime"`, cfg.validateName().Error(), "err.Error")
+}
@@ -1,67 +1,284 @@
 package common
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net/url"
+	"os"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
 type (
 	// FileInfo contains file information.
 	FileInfo struct {
-		name     string
-		size     uint64
-		modified time.Time
-		isfile   bool
+		name         string
+		size         uint64
+		modified     time.Time
+		isfile       bool
+		uri          *url.URL
+		etag         string
+		storageClass string
 	}
 
 	// StorageBackend is a generic interface to storage backends.
 	// Currently, it provisions following methods:
 	//   * GetFileInfo to get file information in FileInfo struct.
-	//   * ListFiles to list files under a given URI.
-	//   * StoreFile to store data to a given URI.
+	//   * ListFiles to list files under a given URI in ascending key order.
+	//   * StoreFile to store data described by a StoreRequest.
+	//   * RetrieveFile to write data stored under a given URI to an output stream.
+	//   * CopyFile to copy data between two URIs on the same backend.
 	//   * RemoveFile to remove files under a given URI.
 	StorageBackend interface {
 		GetFileInfo(*url.URL) (*FileInfo, error)
 		ListFiles(*url.URL) ([]FileInfo, error)
-		StoreFile(io.ReaderAt, int64, *url.URL) error
+		StoreFile(context.Context, StoreRequest) error
+		RetrieveFile(io.Writer, *url.URL) error
+		CopyFile(*url.URL, *url.URL) error
 		RemoveFile(*url.URL) error
 	}
 
+	// StoreRequest describes an object stored with StorageBackend.StoreFile.
+	//
+	// New fields are only ever added to StoreRequest, never removed or repurposed, and the
+	// zero value of each field keeps the behaviour backends had before the field existed.
+	// Backends ignore fields they do not support, so callers must not rely on them being
+	// honoured unless the backend documents it.
+	StoreRequest struct {
+		// destination of the object
+		URI *url.URL
+		// body of the object, read from offset zero up to Length bytes; preferred over Body
+		BodyAt io.ReaderAt
+		// body of the object, read until EOF when BodyAt is nil
+		Body io.Reader
+		// size of the body in bytes, required with BodyAt, -1 if unknown with Body
+		Length int64
+		// user-defined metadata stored along with the object
+		Metadata map[string]string
+		// hex encoded SHA-256 digest of the body, the upload fails if the data differs
+		Checksum string
+		// storage class of the object, the backend default if empty
+		StorageClass string
+		// MIME type of the object, the backend default if empty
+		ContentType string
+		// do not report progress of the upload, for small objects stored alongside backups
+		Quiet bool
+	}
+
+	// ResumableBackend is implemented by storage backends able to complete
+	// an interrupted upload from the recovery file written by StoreFile.
+	ResumableBackend interface {
+		ResumeUpload(string) (*url.URL, error)
+	}
+
+	// PendingUploadReporter is implemented by storage backends able to report
+	// the id of an upload that is in progress.
+	PendingUploadReporter interface {
+		PendingUploadId(*url.URL) (string, bool)
+	}
+
+	// BulkRemover is implemented by storage backends able to remove several objects with
+	// a single request. RemoveFiles accepts up to MaxBulkRemoveFiles URIs and returns the
+	// result of removing each of them.
+	BulkRemover interface {
+		RemoveFiles([]*url.URL) []RemoveResult
+	}
+
+	// RemoveResult is the result of removing an object with BulkRemover.
+	RemoveResult struct {
+		// number of object versions removed, zero if the object was removed without
+		// deleting versions, like by a delete marker
+		Versions int
+		// nil if the object was removed
+		Err error
+	}
+
+	// VersionPruner is implemented by storage backends keeping prior versions of objects.
+	// RemovePriorVersions removes the versions and delete markers of an object except the
+	// current version and returns the number of versions removed.
+	VersionPruner interface {
+		RemovePriorVersions(*url.URL) (int, error)
+	}
+
+	// ProxyReporter is implemented by storage backends able to report the proxy
+	// used to reach the remote service, nil stands for a direct connection.
+	ProxyReporter interface {
+		Proxy() (*url.URL, error)
+	}
+
+	// Prober is implemented by storage backends able to verify cheaply that the bucket of a
+	// URI can be reached with the configured credentials, before any data is sent.
+	Prober interface {
+		Probe(*url.URL) (ProbeResult, error)
+	}
+
+	// BoundedLister is implemented by storage backends able to list the first objects under
+	// a URI, in ascending key order, without listing all of them.
+	BoundedLister interface {
+		ListFilesLimit(*url.URL, int) ([]FileInfo, error)
+	}
+
+	// BackendWrapper is implemented by storage backends decorating another one, like
+	// RetryingBackend and CachingBackend. Optional interfaces are looked up on the wrapped backend by AsBackend.
+	BackendWrapper interface {
+		Unwrap() StorageBackend
+	}
+
+	// ProbeResult describes how a storage backend was reached by Prober.Probe.
+	ProbeResult struct {
+		// endpoint and region the requests were sent to, empty if not applicable
+		Endpoint string
+		Region   string
+		// round-trip time of the probe request
+		Latency time.Duration
+	}
+
 	// DummyBackend defines a dummy backend.
 	DummyBackend struct {
 		dummyFiles []FileInfo
 		dummyError error
 	}
+
+	// BackendFactory creates the StorageBackend of an URL scheme, see RegisterBackend.
+	BackendFactory func(cfg *Config) (StorageBackend, error)
 )
 
-// Common error definitions.
 const (
-	ErrFileNotFound     = "file not found"
-	ErrAccessDenied     = "access denied"
-	ErrInvalidConfig    = "invalid backend configuration"
-	ErrOperationTimeout = "operation timeout"
+	// MaxBulkRemoveFiles is the maximum number of objects removed by BulkRemover.RemoveFiles
+	// at once, S3 DeleteObjects requests are limited to the same number of keys.
+	MaxBulkRemoveFiles = 1000
+
+	// Common error definitions.
+	ErrFileNotFound       = "file not found"
+	ErrBucketNotFound     = "bucket not found"
+	ErrAccessDenied       = "access denied"
+	ErrInvalidCredentials = "invalid credentials"
+	ErrInvalidConfig      = "invalid backend configuration"
+	ErrOperationTimeout   = "operation timeout"
+	ErrEncryptionRequired = "encryption is required, but no usable recipient was configured"
+	ErrChecksumMismatch   = "checksum mismatch"
+
+	// defaultStorageClass is the storage class reported for objects of backends without
+	// storage classes, S3 uses the same name for its default class.
+	defaultStorageClass = "STANDARD"
 )
 
-// CreateDummyBackend function that returns a pre-initialized DummyBackend.
-var CreateDummyBackend func(cfg *Config) StorageBackend = nil
+var (
+	// CreateDummyBackend function that returns a pre-initialized DummyBackend.
+	//
+	// Deprecated: the factory of the dummy scheme registered with RegisterBackend calls it if
+	// set, register a factory under another scheme instead.
+	CreateDummyBackend func(cfg *Config) StorageBackend = nil
 
-// CreateStorageBackend is a StorageBackend factory function.
-func CreateStorageBackend(uri *url.URL, cfg *Config) (StorageBackend, error) {
-	switch uri.Scheme {
-	case "dummy":
+	// Now returns the current wall-clock time, can be overridden to pin the clock.
+	Now func() time.Time = time.Now
+
+	// Hostname returns the host name reported by the kernel, can be overridden in tests.
+	Hostname func() (string, error) = os.Hostname
+
+	// factories of storage backends by URL scheme, see RegisterBackend
+	backendFactories     = map[string]BackendFactory{}
+	backendFactoriesLock sync.RWMutex
+)
+
+func init() {
+	if err := RegisterBackend("b2", func(cfg *Config) (StorageBackend, error) {
+		return cachingBackend(retryingBackend(CreateB2Backend(cfg), cfg), cfg), nil
+	}); err != nil {
+		panic(err)
+	}
+	if err := RegisterBackend("dummy", func(cfg *Config) (StorageBackend, error) {
 		if CreateDummyBackend != nil {
 			return CreateDummyBackend(cfg), nil
-		} else {
-			return &DummyBackend{}, nil
 		}
-	case "b2":
-		return CreateB2Backend(cfg), nil
-	default:
+		return &DummyBackend{}, nil
+	}); err != nil {
+		panic(err)
+	}
+}
+
+// RegisterBackend makes CreateStorageBackend create backends for URIs of `scheme` with
+// `factory`. Backends maintained outside of this module register themselves from an init
+// function of their package. Fails if a factory is registered for `scheme` already.
+func RegisterBackend(scheme string, factory BackendFactory) error {
+	if scheme == "" || factory == nil {
+		return fmt.Errorf("invalid storage backend registration for URL scheme %q", scheme)
+	}
+
+	backendFactoriesLock.Lock()
+	defer backendFactoriesLock.Unlock()
+	if _, prs := backendFactories[scheme]; prs {
+		return fmt.Errorf("storage backend for URL scheme %s is already registered", scheme)
+	}
+	backendFactories[scheme] = factory
+	return nil
+}
+
+// RegisteredSchemes returns the URL schemes of registered storage backends in ascending order.
+func RegisteredSchemes() []string {
+	backendFactoriesLock.RLock()
+	defer backendFactoriesLock.RUnlock()
+
+	schemes := make([]string, 0, len(backendFactories))
+	for scheme := range backendFactories {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// CreateStorageBackend is a StorageBackend factory function, it creates the backend
+// registered for the scheme of `uri` with RegisterBackend.
+func CreateStorageBackend(uri *url.URL, cfg *Config) (StorageBackend, error) {
+	backendFactoriesLock.RLock()
+	factory, prs := backendFactories[uri.Scheme]
+	backendFactoriesLock.RUnlock()
+	if !prs {
 		return nil, fmt.Errorf("unknown URL scheme %s", uri.Scheme)
 	}
+	return factory(cfg)
+}
+
+// retryingBackend wraps `backend` in a RetryingBackend if `cfg.Retry` allows more than one
+// attempt per request.
+func retryingBackend(backend StorageBackend, cfg *Config) StorageBackend {
+	if cfg.Retry.MaxAttempts < 2 {
+		return backend
+	}
+	return NewRetryingBackend(backend, RetryPolicyFromConfig(cfg))
+}
+
+// cachingBackend wraps `backend` in a CachingBackend if `cfg.Performance` enables caching.
+// Backends of long-running processes only cache results with a TTL.
+func cachingBackend(backend StorageBackend, cfg *Config) StorageBackend {
+	if !cfg.Performance.CacheListings || (cfg.Internal.LongRunning && cfg.Performance.CacheTTLSeconds == 0) {
+		return backend
+	}
+	return NewCachingBackend(backend, time.Duration(cfg.Performance.CacheTTLSeconds*float64(time.Second)))
+}
+
+// AsBackend returns `backend`, or the first backend wrapped by it, if it implements T.
+// Optional interfaces of storage backends are looked up with it, so that they are found
+// through wrappers like RetryingBackend.
+func AsBackend[T any](backend StorageBackend) (T, bool) {
+	for backend != nil {
+		if target, ok := backend.(T); ok {
+			return target, true
+		}
+		wrapper, ok := backend.(BackendWrapper)
+		if !ok {
+			break
+		}
+		backend = wrapper.Unwrap()
+	}
+	var zero T
+	return zero, false
 }
 
 // Name returns name of the file object.
@@ -84,6 +301,142 @@ func (fi *FileInfo) IsFile() bool {
 	return fi.isfile
 }
 
+// URI returns the full URI of the file object, nil if the backend did not report it.
+func (fi *FileInfo) URI() *url.URL {
+	if fi.uri == nil {
+		return nil
+	}
+	uri := *fi.uri
+	return &uri
+}
+
+// ETag returns the entity tag of the file object as reported by the backend, if any.
+func (fi *FileInfo) ETag() string {
+	return fi.etag
+}
+
+// StorageClass returns the storage class of the file object as reported by the backend, if any.
+func (fi *FileInfo) StorageClass() string {
+	return fi.storageClass
+}
+
+// String describes the file object in the style of the %+v verb, the URI is printed as text.
+func (fi *FileInfo) String() string {
+	var uri string
+	if fi.uri != nil {
+		uri = fi.uri.String()
+	}
+	return fmt.Sprintf("{name:%s size:%d modified:%s isfile:%t uri:%s etag:%s storageClass:%s}",
+		fi.name, fi.size, fi.modified, fi.isfile, uri, fi.etag, fi.storageClass)
+}
+
+// StoreFileAt stores `length` bytes from `input` to `uri` with the given backend.
+//
+// Deprecated: StoreFileAt keeps the former signature of StorageBackend.StoreFile for one
+// release, call StoreFile with a StoreRequest instead.
+func StoreFileAt(backend StorageBackend, input io.ReaderAt, length int64, uri *url.URL) error {
+	return backend.StoreFile(context.Background(), StoreRequest{URI: uri, BodyAt: input, Length: length})
+}
+
+// validate checks that the request has a destination and a body of a usable length.
+func (req *StoreRequest) validate() error {
+	if req.URI == nil {
+		return errors.New("store request has no destination URI")
+	}
+	if req.BodyAt != nil {
+		if req.Length < 0 {
+			return errors.New("store request has a body without a length")
+		}
+	} else if req.Body == nil {
+		return errors.New("store request has no body")
+	}
+	return nil
+}
+
+// spoolBody returns the body of the request as an io.ReaderAt and its length. A body given
+// as an io.Reader is copied to a temporary file, which is removed by the returned function.
+func (req *StoreRequest) spoolBody() (io.ReaderAt, int64, func(), error) {
+	if req.BodyAt != nil {
+		return req.BodyAt, req.Length, func() {}, nil
+	}
+
+	spool, err := CreateTempFile("", "squirrelup-upload-", 0600)
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("could not create temporary file: %s", err.Error())
+	}
+	cleanup := func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}
+
+	length, err := io.Copy(spool, req.Body)
+	if err != nil {
+		cleanup()
+		return nil, 0, nil, fmt.Errorf("could not read input: %s", err.Error())
+	}
+	if req.Length >= 0 && length != req.Length {
+		cleanup()
+		return nil, 0, nil, fmt.Errorf("input of %d bytes does not match the expected length of %d bytes", length, req.Length)
+	}
+	return spool, length, cleanup, nil
+}
+
+// verifyChecksum compares `data` with the checksum of the request, if any.
+func (req *StoreRequest) verifyChecksum(data []byte) error {
+	if req.Checksum == "" {
+		return nil
+	}
+	digest := sha256.Sum256(data)
+	if !strings.EqualFold(hex.EncodeToString(digest[:]), req.Checksum) {
+		return errors.New(ErrChecksumMismatch)
+	}
+	return nil
+}
+
+// objectURI returns the URI of `key` in the bucket of `uri`.
+func objectURI(uri *url.URL, key string) *url.URL {
+	return &url.URL{Scheme: uri.Scheme, Host: uri.Host, Path: "/" + strings.TrimPrefix(key, "/")}
+}
+
+// ResolveObjectURI returns the URI of the object `name` below the directory `prefix`, which
+// is taken as a directory whether it ends with a slash or not. `name` is taken literally:
+// characters such as spaces, '%', '#', '?' and '+' become part of the key instead of escape
+// sequences, a fragment or a query. Names starting with a slash are keys relative to the bucket.
+func ResolveObjectURI(prefix *url.URL, name string) *url.URL {
+	resolved := &url.URL{Scheme: prefix.Scheme, User: prefix.User, Host: prefix.Host}
+	if strings.HasPrefix(name, "/") {
+		resolved.Path = name
+	} else {
+		resolved.Path = strings.TrimSuffix(prefix.Path, "/") + "/" + name
+	}
+	return resolved
+}
+
+// sortFileInfos sorts `filelist` in ascending key order, as returned by ListFiles.
+func sortFileInfos(filelist []FileInfo) {
+	sort.SliceStable(filelist, func(i, j int) bool {
+		return filelist[i].name < filelist[j].name
+	})
+}
+
+// truncateFileInfos returns the first `limit` entries of `filelist`.
+func truncateFileInfos(filelist []FileInfo, limit int) []FileInfo {
+	if len(filelist) > limit {
+		return filelist[:limit]
+	}
+	return filelist
+}
+
+// ListFilesLimit lists up to `limit` files under `uri` in ascending key order, with a single
+// request on backends implementing BoundedLister. Other backends list all files.
+func ListFilesLimit(backend StorageBackend, uri *url.URL, limit int) ([]FileInfo, error) {
+	if lister, ok := AsBackend[BoundedLister](backend); ok {
+		return lister.ListFilesLimit(uri, limit)
+	}
+	filelist, err := backend.ListFiles(uri)
+	return truncateFileInfos(filelist, limit), err
+}
+
 // GenerateDummyFiles generate dummy file info list.
 func (d *DummyBackend) GenerateDummyFiles(path string, number uint64) {
 	d.dummyFiles = make([]FileInfo, number)
@@ -114,33 +467,66 @@ func (d *DummyBackend) GetDummyError() error {
 
 // GetFileInfo returns a FileInfo struct filled with information
 // about object defined by the input URI.
-// Input URI must follow the pattern: dummy://path/to/file.
+// Input URI must follow the pattern: dummy://bucket/path/to/file.
 func (d *DummyBackend) GetFileInfo(uri *url.URL) (*FileInfo, error) {
-	var path string = uri.Host + uri.Path
+	var key string = strings.TrimPrefix(uri.Path, "/")
 
-	return &FileInfo{
-		name:     path,
+	fileinfo := &FileInfo{
+		name:     key,
 		size:     uint64(0),
 		modified: time.Unix(0, 0).UTC(),
-		isfile:   !strings.HasSuffix(uri.Path, "/"),
-	}, d.dummyError
+		isfile:   key != "" && !strings.HasSuffix(key, "/"),
+		uri:      objectURI(uri, key),
+	}
+	// prefixes have no storage class
+	if fileinfo.isfile {
+		fileinfo.storageClass = defaultStorageClass
+	}
+	return fileinfo, d.dummyError
 }
 
 // ListFiles return an array of FileInfo structs filled with information
-// about objects defined by the input URI.
-// Input URI must follow the pattern: dummy://path/to/dir.
+// about objects defined by the input URI, sorted by key.
+// Input URI must follow the pattern: dummy://bucket/path/to/dir.
 func (d *DummyBackend) ListFiles(uri *url.URL) ([]FileInfo, error) {
-	return d.dummyFiles, d.dummyError
+	if d.dummyFiles == nil {
+		return nil, d.dummyError
+	}
+	result := append([]FileInfo{}, d.dummyFiles...)
+	for index := range result {
+		result[index].uri = objectURI(uri, result[index].name)
+		result[index].storageClass = defaultStorageClass
+	}
+	sortFileInfos(result)
+	return result, d.dummyError
 }
 
-// StoreFile writes a data from `input` to output URI.
-// Output URI must follow the pattern: dummy://path/to/file.
-func (d *DummyBackend) StoreFile(input io.ReaderAt, length int64, uri *url.URL) error {
+// StoreFile writes the body of the request to its URI.
+// Output URI must follow the pattern: dummy://bucket/path/to/file.
+func (d *DummyBackend) StoreFile(ctx context.Context, req StoreRequest) error {
+	return d.dummyError
+}
+
+// RetrieveFile writes data stored under input URI to `output`.
+// Input URI must follow the pattern: dummy://bucket/path/to/file.
+func (d *DummyBackend) RetrieveFile(output io.Writer, uri *url.URL) error {
+	return d.dummyError
+}
+
+// CopyFile copies an object from source URI to destination URI.
+// Both URIs must follow the pattern: dummy://bucket/path/to/file.
+func (d *DummyBackend) CopyFile(source *url.URL, destination *url.URL) error {
 	return d.dummyError
 }
 
 // RemoveFile remove objects defined by the input URI.
-// Input URI must follow the pattern: dummy://path/to/dir.
+// Input URI must follow the pattern: dummy://bucket/path/to/dir.
 func (d *DummyBackend) RemoveFile(uri *url.URL) error {
 	return d.dummyError
 }
+
+// Probe reports the dummy error, if any, as the result of reaching the bucket.
+// Input URI must follow the pattern: dummy://bucket/path/to/dir.
+func (d *DummyBackend) Probe(uri *url.URL) (ProbeResult, error) {
+	return ProbeResult{Endpoint: "dummy://" + uri.Host}, d.dummyError
+}
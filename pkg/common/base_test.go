@@ -1,8 +1,14 @@
 package common
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/url"
+	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -26,7 +32,48 @@ func TestFileInfo(t *testing.T) {
 	assertEquals(t, uint64(0), fileinfo.Size(), "fileinfo.Size")
 	assertEquals(t, time.Unix(0, 0).UTC(), fileinfo.Modified(), "fileinfo.Modified")
 	assertEquals(t, true, fileinfo.IsFile(), "fileinfo.IsFile")
+	assertEquals(t, (*url.URL)(nil), fileinfo.URI(), "fileinfo.URI")
+	assertEquals(t, "", fileinfo.ETag(), "fileinfo.ETag")
+	assertEquals(t, "", fileinfo.StorageClass(), "fileinfo.StorageClass")
+
+	/* callers get a copy of the URI */
+	fileinfo.uri, _ = url.ParseRequestURI("b2://bucket/path/to/file")
+	fileinfo.etag = `"etag"`
+	fileinfo.storageClass = "STANDARD"
+	fileinfo.URI().Path = "/changed"
+	assertEquals(t, "b2://bucket/path/to/file", fileinfo.URI().String(), "fileinfo.URI")
+	assertEquals(t, `"etag"`, fileinfo.ETag(), "fileinfo.ETag")
+	assertEquals(t, "STANDARD", fileinfo.StorageClass(), "fileinfo.StorageClass")
+	assertEquals(t, `{name:path/to/file size:0 modified:1970-01-01 00:00:00 +0000 UTC isfile:true uri:b2://bucket/path/to/file etag:"etag" storageClass:STANDARD}`, fileinfo.String(), "fileinfo.String")
+}
+
+/* test cases for ResolveObjectURI */
+func TestResolveObjectURI(t *testing.T) {
+	for _, testCase := range []struct{ prefix, name, key, expected string }{
+		{"b2://bucket/Datenbank Sicherung/ü/", "2024-05-01T03+0000.tar.gz",
+			"/Datenbank Sicherung/ü/2024-05-01T03+0000.tar.gz", "b2://bucket/Datenbank%20Sicherung/%C3%BC/2024-05-01T03+0000.tar.gz"},
+		{"b2://bucket/Datenbank%20Sicherung/%C3%BC/", "100% #1?.tar.gz",
+			"/Datenbank Sicherung/ü/100% #1?.tar.gz", "b2://bucket/Datenbank%20Sicherung/%C3%BC/100%25%20%231%3F.tar.gz"},
+		{"b2://bucket/a+b/c%23d/", "e+f", "/a+b/c#d/e+f", "b2://bucket/a+b/c%23d/e+f"},
+		/* prefixes are directories with or without a trailing slash */
+		{"b2://bucket/backups", "name", "/backups/name", "b2://bucket/backups/name"},
+		{"b2://bucket", "name", "/name", "b2://bucket/name"},
+		{"b2://bucket/", "name", "/name", "b2://bucket/name"},
+		/* names starting with a slash are relative to the bucket */
+		{"b2://bucket/dir/", "/root #1", "/root #1", "b2://bucket/root%20%231"},
+	} {
+		prefix, err := url.ParseRequestURI(testCase.prefix)
+		if err != nil {
+			t.Fatalf("could not parse %q: %s", testCase.prefix, err.Error())
+		}
+		resolved := ResolveObjectURI(prefix, testCase.name)
+		assertEquals(t, testCase.key, resolved.Path, "ResolveObjectURI("+testCase.name+").Path")
+		assertEquals(t, testCase.expected, resolved.String(), "ResolveObjectURI("+testCase.name+")")
 
+		/* URIs survive a round trip through their string form */
+		parsed, _ := url.ParseRequestURI(resolved.String())
+		assertEquals(t, testCase.key, parsed.Path, "ParseRequestURI("+resolved.String()+").Path")
+	}
 }
 
 /* test cases for CreateStorageBackend */
@@ -103,6 +150,62 @@ func TestCreateStorageBackendUnknown(t *testing.T) {
 	}
 }
 
+func TestRegisterBackend(t *testing.T) {
+	memory := NewMemoryBackend()
+	factory := func(cfg *Config) (StorageBackend, error) {
+		return memory, nil
+	}
+	defer func() {
+		backendFactoriesLock.Lock()
+		delete(backendFactories, "mock")
+		backendFactoriesLock.Unlock()
+	}()
+
+	/* built-in backends are registered */
+	assertEquals(t, "[b2 dummy]", fmt.Sprint(RegisteredSchemes()), "RegisteredSchemes")
+
+	if err := RegisterBackend("mock", factory); err != nil {
+		t.Fatalf(err.Error())
+	}
+	assertEquals(t, "[b2 dummy mock]", fmt.Sprint(RegisteredSchemes()), "RegisteredSchemes")
+
+	mockURI, _ := url.ParseRequestURI("mock://bucket/path/to/key")
+	backend, err := CreateStorageBackend(mockURI, new(Config))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assertEquals(t, StorageBackend(memory), backend, "backend")
+
+	/* schemes are registered once */
+	for _, scheme := range []string{"mock", "b2", "dummy"} {
+		if err := RegisterBackend(scheme, factory); err == nil {
+			t.Fatalf("This test should throw an error")
+		} else {
+			assertEquals(t, fmt.Sprintf("storage backend for URL scheme %s is already registered", scheme), err.Error(), "err.Error")
+		}
+	}
+	if err := RegisterBackend("", factory); err == nil {
+		t.Fatalf("This test should throw an error")
+	} else {
+		assertEquals(t, `invalid storage backend registration for URL scheme ""`, err.Error(), "err.Error")
+	}
+	if err := RegisterBackend("other", nil); err == nil {
+		t.Fatalf("This test should throw an error")
+	}
+
+	/* errors of factories are returned */
+	backendFactoriesLock.Lock()
+	backendFactories["mock"] = func(cfg *Config) (StorageBackend, error) {
+		return nil, errors.New(ErrInvalidConfig)
+	}
+	backendFactoriesLock.Unlock()
+	if _, err = CreateStorageBackend(mockURI, new(Config)); err == nil {
+		t.Fatalf("This test should throw an error")
+	} else {
+		assertEquals(t, ErrInvalidConfig, err.Error(), "err.Error")
+	}
+}
+
 /* test cases for DummyBackend.GetFileInfo */
 func TestDummyGetFileInfoFile(t *testing.T) {
 	// Setup Test
@@ -123,10 +226,12 @@ func TestDummyGetFileInfoFile(t *testing.T) {
 	} else {
 		assertEquals(t, err, dummy.GetDummyError(), "dummyError")
 
-		assertEquals(t, "path/to/file", fileinfo.name, "fileinfo.name")
+		assertEquals(t, "to/file", fileinfo.name, "fileinfo.name")
 		assertEquals(t, uint64(0), fileinfo.size, "fileinfo.size")
 		assertEquals(t, time.Unix(0, 0).UTC(), fileinfo.modified, "fileinfo.modified")
 		assertEquals(t, true, fileinfo.isfile, "fileinfo.isfile")
+		assertEquals(t, "dummy://path/to/file", fileinfo.URI().String(), "fileinfo.URI")
+		assertEquals(t, "STANDARD", fileinfo.StorageClass(), "fileinfo.StorageClass")
 	}
 }
 
@@ -149,10 +254,34 @@ func TestDummyGetFileInfoDir(t *testing.T) {
 	} else {
 		assertEquals(t, err, dummy.GetDummyError(), "dummyError")
 
-		assertEquals(t, "path/to/dir/", fileinfo.name, "fileinfo.name")
+		assertEquals(t, "to/dir/", fileinfo.name, "fileinfo.name")
 		assertEquals(t, uint64(0), fileinfo.size, "fileinfo.size")
 		assertEquals(t, time.Unix(0, 0).UTC(), fileinfo.modified, "fileinfo.modified")
 		assertEquals(t, false, fileinfo.isfile, "fileinfo.isfile")
+		assertEquals(t, "dummy://path/to/dir/", fileinfo.URI().String(), "fileinfo.URI")
+		assertEquals(t, "", fileinfo.StorageClass(), "fileinfo.StorageClass")
+	}
+}
+
+func TestDummyGetFileInfoRoot(t *testing.T) {
+	// Setup Test
+	dummy := &DummyBackend{}
+
+	// Perform the test
+	for _, rawURI := range []string{"dummy://bucket", "dummy://bucket/"} {
+		mockURI, err := url.ParseRequestURI(rawURI)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		fileinfo, err := dummy.GetFileInfo(mockURI)
+		if fileinfo == nil || err != nil {
+			t.Fatalf("unexpected test result: %+v, %+v", fileinfo, err)
+		}
+		assertEquals(t, "", fileinfo.name, "fileinfo.name")
+		assertEquals(t, false, fileinfo.isfile, "fileinfo.isfile")
+		assertEquals(t, "dummy://bucket/", fileinfo.URI().String(), "fileinfo.URI")
+		assertEquals(t, "", fileinfo.StorageClass(), "fileinfo.StorageClass")
 	}
 }
 
@@ -204,6 +333,8 @@ func TestDummyListFilesMock(t *testing.T) {
 			assertEquals(t, dummyFiles[index].Size(), fileinfo.Size(), "fileinfo.size")
 			assertEquals(t, dummyFiles[index].Modified(), fileinfo.Modified(), "fileinfo.modified")
 			assertEquals(t, dummyFiles[index].IsFile(), fileinfo.IsFile(), "fileinfo.isfile")
+			assertEquals(t, "dummy://path/"+dummyFiles[index].Name(), fileinfo.URI().String(), "fileinfo.URI")
+			assertEquals(t, "STANDARD", fileinfo.StorageClass(), "fileinfo.StorageClass")
 		}
 	}
 }
@@ -221,7 +352,106 @@ func TestDummyStoreFile(t *testing.T) {
 	}
 
 	// Perform the test
-	err = dummy.StoreFile(nil, 0, mockURI)
+	err = dummy.StoreFile(context.Background(), StoreRequest{URI: mockURI})
+	assertEquals(t, err, dummy.GetDummyError(), "dummyError")
+}
+
+/* test cases for StoreRequest */
+func TestStoreRequestValidate(t *testing.T) {
+	mockURI, _ := url.ParseRequestURI("memory://bucket/key")
+	for _, testCase := range []struct {
+		req      StoreRequest
+		expected string
+	}{
+		{StoreRequest{URI: mockURI, BodyAt: strings.NewReader("data"), Length: 4}, ""},
+		{StoreRequest{URI: mockURI, Body: strings.NewReader("data"), Length: -1}, ""},
+		{StoreRequest{BodyAt: strings.NewReader("data"), Length: 4}, "store request has no destination URI"},
+		{StoreRequest{URI: mockURI, BodyAt: strings.NewReader("data"), Length: -1}, "store request has a body without a length"},
+		{StoreRequest{URI: mockURI}, "store request has no body"},
+	} {
+		var actual string
+		if err := testCase.req.validate(); err != nil {
+			actual = err.Error()
+		}
+		assertEquals(t, testCase.expected, actual, fmt.Sprintf("validate(%+v)", testCase.req))
+	}
+}
+
+func TestStoreRequestSpoolBody(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+	t.Setenv("TMP", dir)
+
+	// Perform the test
+	req := StoreRequest{Body: strings.NewReader("streamed"), Length: -1}
+	input, length, cleanup, err := req.spoolBody()
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, int64(8), length, "length")
+	data, _ := io.ReadAll(io.NewSectionReader(input, 0, length))
+	assertEquals(t, "streamed", string(data), "data")
+
+	cleanup()
+	entries, _ := os.ReadDir(dir)
+	assertEquals(t, 0, len(entries), "len(entries)")
+
+	/* bodies given as io.ReaderAt are not copied */
+	bodyAt := strings.NewReader("data")
+	req = StoreRequest{BodyAt: bodyAt, Length: 4}
+	input, length, cleanup, _ = req.spoolBody()
+	defer cleanup()
+	assertEquals(t, io.ReaderAt(bodyAt), input, "input")
+	assertEquals(t, int64(4), length, "length")
+}
+
+func TestStoreFileAt(t *testing.T) {
+	// Setup Test
+	memory := NewMemoryBackend()
+	mockURI, _ := url.ParseRequestURI("memory://bucket/key")
+
+	// Perform the test
+	if err := StoreFileAt(memory, strings.NewReader("data"), 4, mockURI); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	var output bytes.Buffer
+	if err := memory.RetrieveFile(&output, mockURI); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "data", output.String(), "output")
+}
+
+/* test cases for DummyBackend.RetrieveFile */
+func TestDummyRetrieveFile(t *testing.T) {
+	// Setup Test
+	dummy := &DummyBackend{}
+	dummyErr := fmt.Errorf("dummy error")
+	dummy.SetDummyError(dummyErr)
+
+	mockURI, err := url.ParseRequestURI("dummy://path/to/file")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Perform the test
+	err = dummy.RetrieveFile(nil, mockURI)
+	assertEquals(t, err, dummy.GetDummyError(), "dummyError")
+}
+
+/* test cases for DummyBackend.CopyFile */
+func TestDummyCopyFile(t *testing.T) {
+	// Setup Test
+	dummy := &DummyBackend{}
+	dummyErr := fmt.Errorf("dummy error")
+	dummy.SetDummyError(dummyErr)
+
+	mockURI, err := url.ParseRequestURI("dummy://path/to/file")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Perform the test
+	err = dummy.CopyFile(mockURI, mockURI)
 	assertEquals(t, err, dummy.GetDummyError(), "dummyError")
 }
 
@@ -252,3 +482,20 @@ func TestDummyError(t *testing.T) {
 	dummy.SetDummyError(err)
 	assertEquals(t, err, dummy.GetDummyError(), "dummyError")
 }
+
+/* test cases for DummyBackend.Probe */
+func TestDummyBackendProbe(t *testing.T) {
+	// Setup Test
+	dummy := &DummyBackend{}
+	uri, _ := url.ParseRequestURI("dummy://bucket/prefix/")
+
+	// Perform the test
+	var prober Prober = dummy
+	result, err := prober.Probe(uri)
+	assertEquals(t, nil, err, "err")
+	assertEquals(t, "dummy://bucket", result.Endpoint, "result.Endpoint")
+
+	dummy.SetDummyError(fmt.Errorf(ErrAccessDenied))
+	_, err = prober.Probe(uri)
+	assertEquals(t, ErrAccessDenied, err.Error(), "err.Error")
+}
@@ -0,0 +1,35 @@
+package common
+
+import (
+	"io"
+	"sync"
+)
+
+const (
+	// size of copy buffers unless configured otherwise, same as io.Copy
+	default_buffer_size = 32 * 1024
+	// upper bound of the configured size of copy buffers in KiB
+	max_buffer_kb = 16 * 1024
+)
+
+// copyBufferPool holds buffers of finished copies, see CopyBuffer.
+var copyBufferPool sync.Pool
+
+// CopyBuffer copies from `src` to `dst` until EOF or an error like io.Copy, but through a
+// buffer of `size` bytes taken from a pool, default_buffer_size if `size` is not positive.
+// Unlike io.CopyBuffer the buffer is used even if `src` implements io.WriterTo or `dst`
+// implements io.ReaderFrom, so each copy holds exactly one buffer of the configured size.
+func CopyBuffer(dst io.Writer, src io.Reader, size int) (int64, error) {
+	if size <= 0 {
+		size = default_buffer_size
+	}
+	buf, _ := copyBufferPool.Get().(*[]byte)
+	if buf == nil || cap(*buf) < size {
+		// buffers of smaller sizes are dropped
+		data := make([]byte, size)
+		buf = &data
+	}
+	defer copyBufferPool.Put(buf)
+
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, (*buf)[:size])
+}
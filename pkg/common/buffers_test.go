@@ -0,0 +1,112 @@
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+// patternReader produces `remaining` bytes of a fixed pattern without allocating, recording
+// the largest read requested.
+type patternReader struct {
+	remaining int64
+	maxRead   int
+}
+
+func (pr *patternReader) Read(p []byte) (int, error) {
+	if pr.remaining <= 0 {
+		return 0, io.EOF
+	}
+	pr.maxRead = max(pr.maxRead, len(p))
+	n := int(min(int64(len(p)), pr.remaining))
+	for i := range p[:n] {
+		p[i] = byte(i)
+	}
+	pr.remaining -= int64(n)
+	return n, nil
+}
+
+/* test cases for CopyBuffer */
+func TestCopyBuffer(t *testing.T) {
+	/* reads use the given size even if the writer implements io.ReaderFrom */
+	input := &patternReader{remaining: 1024 * 1024}
+	var output bytes.Buffer
+	written, err := CopyBuffer(&output, input, 256*1024)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, int64(1024*1024), written, "written")
+	assertEquals(t, 1024*1024, output.Len(), "output.Len")
+	assertEquals(t, 256*1024, input.maxRead, "input.maxRead")
+
+	/* the default size is used otherwise */
+	input = &patternReader{remaining: 1024 * 1024}
+	_, err = CopyBuffer(io.Discard, input, 0)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, default_buffer_size, input.maxRead, "input.maxRead")
+
+	/* content is copied unchanged */
+	output.Reset()
+	written, err = CopyBuffer(&output, strings.NewReader("test content"), 4)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, int64(12), written, "written")
+	assertEquals(t, "test content", output.String(), "output")
+}
+
+// TestCopyBufferMemory encrypts and hashes a 256 MiB stream the way backups are encrypted and
+// checked, verifying that memory allocated does not grow with the size of the stream.
+func TestCopyBufferMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("streams 256 MiB")
+	}
+
+	// Setup Test
+	var cfg Config
+	if err := cfg.SetDefaultValues(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	const size = 256 * 1024 * 1024
+	// bounded by a copy buffer, age's chunk buffers and its header
+	const limit = 512 * 1024
+
+	// Perform the test
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	hash := sha256.New()
+	encryptedWriter, err := age.Encrypt(hash, identity.Recipient())
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	written, err := CopyBuffer(encryptedWriter, &patternReader{remaining: size}, cfg.BufferSize())
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	_ = encryptedWriter.Close()
+	_, err = CopyBuffer(hash, &patternReader{remaining: size}, cfg.BufferSize())
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	runtime.ReadMemStats(&after)
+	assertEquals(t, int64(size), written, "written")
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > limit {
+		t.Fatalf("allocated %d bytes to stream %d bytes, expected at most %d", allocated, size, limit)
+	} else {
+		t.Logf("allocated %d bytes to stream %d bytes twice", allocated, size)
+	}
+}
@@ -0,0 +1,192 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// CachingBackend is a StorageBackend memoizing the results of GetFileInfo and ListFiles of
+	// the backend it wraps, so that the lookups and listings of a run done by the conflict
+	// check, the cleanup and the catalog update do not send the same requests again. Results
+	// are dropped when StoreFile, CopyFile, RemoveFile or RemoveFiles change an object they
+	// cover, and after the TTL if it is not zero. It is safe for concurrent use.
+	CachingBackend struct {
+		StorageBackend
+		ttl   time.Duration
+		lock  sync.Mutex
+		infos map[string]cachedFileInfo
+		lists map[string]cachedFileList
+		// incremented on every invalidation, results fetched meanwhile are not cached
+		generation uint64
+	}
+
+	cachedFileInfo struct {
+		fileinfo *FileInfo
+		err      error
+		expires  time.Time
+	}
+
+	cachedFileList struct {
+		filelist []FileInfo
+		expires  time.Time
+	}
+)
+
+// NewCachingBackend returns `backend` wrapped to cache lookups and listings for `ttl`, or as
+// long as the CachingBackend is used if `ttl` is zero.
+func NewCachingBackend(backend StorageBackend, ttl time.Duration) *CachingBackend {
+	return &CachingBackend{
+		StorageBackend: backend,
+		ttl:            ttl,
+		infos:          map[string]cachedFileInfo{},
+		lists:          map[string]cachedFileList{},
+	}
+}
+
+// cacheKey identifies the object or prefix `uri` points to.
+func cacheKey(uri *url.URL) string {
+	return uri.Scheme + "://" + uri.Host + uri.Path
+}
+
+// fresh tells whether a result expiring at `expires` may still be used.
+func (cb *CachingBackend) fresh(expires time.Time) bool {
+	return cb.ttl == 0 || Now().Before(expires)
+}
+
+// Unwrap returns the wrapped backend. Objects changed through it are not noticed, so the
+// CachingBackend implements optional interfaces changing objects, like BulkRemover, itself.
+func (cb *CachingBackend) Unwrap() StorageBackend {
+	return cb.StorageBackend
+}
+
+// invalidate drops cached results of objects and prefixes starting with `key`, or all of
+// them if it is empty, along with those of the prefixes containing `key`.
+func (cb *CachingBackend) invalidate(key string) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	cb.generation++
+	for cached := range cb.infos {
+		if strings.HasPrefix(cached, key) || strings.HasPrefix(key, cached) {
+			delete(cb.infos, cached)
+		}
+	}
+	for cached := range cb.lists {
+		if strings.HasPrefix(cached, key) || strings.HasPrefix(key, cached) {
+			delete(cb.lists, cached)
+		}
+	}
+}
+
+// GetFileInfo returns the FileInfo of `uri`, looked up once until it changes. Missing
+// objects are cached as well, other errors are not.
+func (cb *CachingBackend) GetFileInfo(uri *url.URL) (*FileInfo, error) {
+	key := cacheKey(uri)
+
+	cb.lock.Lock()
+	cached, prs := cb.infos[key]
+	generation := cb.generation
+	cb.lock.Unlock()
+	if prs && cb.fresh(cached.expires) {
+		if cached.err != nil {
+			return nil, cached.err
+		}
+		fileinfo := *cached.fileinfo
+		return &fileinfo, nil
+	}
+
+	fileinfo, err := cb.StorageBackend.GetFileInfo(uri)
+	if err != nil && err.Error() != ErrFileNotFound {
+		return fileinfo, err
+	}
+
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if generation == cb.generation {
+		cached = cachedFileInfo{err: err, expires: Now().Add(cb.ttl)}
+		if err == nil {
+			copied := *fileinfo
+			cached.fileinfo = &copied
+		} else {
+			cached.err = errors.New(ErrFileNotFound)
+		}
+		cb.infos[key] = cached
+	}
+	return fileinfo, err
+}
+
+// ListFiles lists the files under `uri`, listed once until one of them changes.
+func (cb *CachingBackend) ListFiles(uri *url.URL) ([]FileInfo, error) {
+	key := cacheKey(uri)
+
+	cb.lock.Lock()
+	cached, prs := cb.lists[key]
+	generation := cb.generation
+	cb.lock.Unlock()
+	if prs && cb.fresh(cached.expires) {
+		return append([]FileInfo(nil), cached.filelist...), nil
+	}
+
+	filelist, err := cb.StorageBackend.ListFiles(uri)
+	if err != nil {
+		return filelist, err
+	}
+
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+	if generation == cb.generation {
+		cb.lists[key] = cachedFileList{
+			filelist: append([]FileInfo(nil), filelist...),
+			expires:  Now().Add(cb.ttl),
+		}
+	}
+	return filelist, nil
+}
+
+// ListFilesLimit lists up to `limit` files under `uri` with ListFilesLimit of the wrapped
+// backend, the bounded listing is not cached.
+func (cb *CachingBackend) ListFilesLimit(uri *url.URL, limit int) ([]FileInfo, error) {
+	return ListFilesLimit(cb.StorageBackend, uri, limit)
+}
+
+// StoreFile stores `req` and drops the cached results covering its destination.
+func (cb *CachingBackend) StoreFile(ctx context.Context, req StoreRequest) error {
+	defer cb.invalidate(cacheKey(req.URI))
+	return cb.StorageBackend.StoreFile(ctx, req)
+}
+
+// CopyFile copies `src` to `dst` and drops the cached results covering `dst`.
+func (cb *CachingBackend) CopyFile(src, dst *url.URL) error {
+	defer cb.invalidate(cacheKey(dst))
+	return cb.StorageBackend.CopyFile(src, dst)
+}
+
+// RemoveFile removes `uri` and drops the cached results covering it.
+func (cb *CachingBackend) RemoveFile(uri *url.URL) error {
+	defer cb.invalidate(cacheKey(uri))
+	return cb.StorageBackend.RemoveFile(uri)
+}
+
+// RemoveFiles removes `uris` with RemoveFiles of the wrapped backend if it implements
+// BulkRemover, one at a time with RemoveFile otherwise, and drops the cached results
+// covering them.
+func (cb *CachingBackend) RemoveFiles(uris []*url.URL) []RemoveResult {
+	defer func() {
+		for _, uri := range uris {
+			cb.invalidate(cacheKey(uri))
+		}
+	}()
+	if remover, ok := AsBackend[BulkRemover](cb.StorageBackend); ok {
+		return remover.RemoveFiles(uris)
+	}
+	results := make([]RemoveResult, len(uris))
+	for index, uri := range uris {
+		results[index].Err = cb.StorageBackend.RemoveFile(uri)
+	}
+	return results
+}
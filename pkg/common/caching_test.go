@@ -0,0 +1,230 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingBackend is a MemoryBackend counting the lookups and listings sent to it.
+type countingBackend struct {
+	*MemoryBackend
+	lock                 sync.Mutex
+	fileInfos, listFiles int
+}
+
+func (cb *countingBackend) GetFileInfo(uri *url.URL) (*FileInfo, error) {
+	cb.lock.Lock()
+	cb.fileInfos++
+	cb.lock.Unlock()
+	return cb.MemoryBackend.GetFileInfo(uri)
+}
+
+func (cb *countingBackend) ListFiles(uri *url.URL) ([]FileInfo, error) {
+	cb.lock.Lock()
+	cb.listFiles++
+	cb.lock.Unlock()
+	return cb.MemoryBackend.ListFiles(uri)
+}
+
+func TestCachingBackend(t *testing.T) {
+	counting := &countingBackend{MemoryBackend: NewMemoryBackend()}
+	backend := NewCachingBackend(counting, 0)
+
+	prefix, _ := url.Parse("memory://bucket/backups/")
+	first, _ := url.Parse("memory://bucket/backups/first")
+	second, _ := url.Parse("memory://bucket/backups/second")
+	other, _ := url.Parse("memory://bucket/other/file")
+	data := []byte("mock-data")
+
+	if err := StoreFileAt(backend, bytes.NewReader(data), int64(len(data)), first); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	/* repeated lookups and listings are sent once */
+	for i := 0; i < 3; i++ {
+		filelist, err := backend.ListFiles(prefix)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		assertEquals(t, 1, len(filelist), "len(filelist)")
+		fileinfo, err := backend.GetFileInfo(first)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		assertEquals(t, uint64(len(data)), fileinfo.Size(), "fileinfo.Size")
+		if _, err = backend.GetFileInfo(second); err == nil {
+			t.Fatalf("This test should throw an error")
+		} else {
+			assertEquals(t, ErrFileNotFound, err.Error(), "err.Error")
+		}
+	}
+	assertEquals(t, 1, counting.listFiles, "counting.listFiles")
+	assertEquals(t, 2, counting.fileInfos, "counting.fileInfos")
+
+	/* changes of objects outside of the prefix keep its results */
+	if err := StoreFileAt(backend, bytes.NewReader(data), int64(len(data)), other); err != nil {
+		t.Fatalf(err.Error())
+	}
+	backend.ListFiles(prefix)
+	backend.GetFileInfo(first)
+	assertEquals(t, 1, counting.listFiles, "counting.listFiles")
+	assertEquals(t, 2, counting.fileInfos, "counting.fileInfos")
+
+	/* storing an object drops the listing of its prefix and its lookup, not those of others */
+	if err := StoreFileAt(backend, bytes.NewReader(data), int64(len(data)), second); err != nil {
+		t.Fatalf(err.Error())
+	}
+	filelist, err := backend.ListFiles(prefix)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assertEquals(t, 2, len(filelist), "len(filelist)")
+	if _, err = backend.GetFileInfo(second); err != nil {
+		t.Fatalf(err.Error())
+	}
+	backend.GetFileInfo(first)
+	assertEquals(t, 2, counting.listFiles, "counting.listFiles")
+	assertEquals(t, 3, counting.fileInfos, "counting.fileInfos")
+
+	/* so does removing and copying one */
+	if err = backend.RemoveFile(first); err != nil {
+		t.Fatalf(err.Error())
+	}
+	filelist, _ = backend.ListFiles(prefix)
+	assertEquals(t, 1, len(filelist), "len(filelist)")
+	if err = backend.CopyFile(second, first); err != nil {
+		t.Fatalf(err.Error())
+	}
+	filelist, _ = backend.ListFiles(prefix)
+	assertEquals(t, 2, len(filelist), "len(filelist)")
+	assertEquals(t, 4, counting.listFiles, "counting.listFiles")
+
+	/* results are copied, callers cannot change the cached ones */
+	filelist[0] = FileInfo{}
+	filelist, _ = backend.ListFiles(prefix)
+	assertEquals(t, "backups/first", filelist[0].Name(), "filelist[0].Name")
+
+	/* looking up the wrapped backend keeps the results */
+	wrapped, ok := AsBackend[*countingBackend](backend)
+	assertEquals(t, true, ok, "ok")
+	assertEquals(t, counting, wrapped, "wrapped")
+	backend.ListFiles(prefix)
+	assertEquals(t, 4, counting.listFiles, "counting.listFiles")
+
+	/* removing objects in bulk drops their results, backends without BulkRemover remove them
+	   one at a time */
+	remover, ok := AsBackend[BulkRemover](backend)
+	assertEquals(t, true, ok, "ok")
+	assertEquals(t, BulkRemover(backend), remover, "remover")
+	results := remover.RemoveFiles([]*url.URL{first, other})
+	assertEquals(t, 2, len(results), "len(results)")
+	assertEquals(t, nil, results[0].Err, "results[0].Err")
+	assertEquals(t, nil, results[1].Err, "results[1].Err")
+	filelist, _ = backend.ListFiles(prefix)
+	assertEquals(t, 1, len(filelist), "len(filelist)")
+	assertEquals(t, 5, counting.listFiles, "counting.listFiles")
+	if _, err = backend.GetFileInfo(first); err == nil {
+		t.Fatalf("This test should throw an error")
+	}
+}
+
+func TestCachingBackendBulkRemove(t *testing.T) {
+	brb := &bulkRemoveBackend{MemoryBackend: NewMemoryBackend()}
+	backend := NewCachingBackend(brb, 0)
+	prefix, _ := url.Parse("memory://bucket/backups/")
+	first, _ := url.Parse("memory://bucket/backups/first")
+	undeletable, _ := url.Parse("memory://bucket/backups/undeletable")
+	data := []byte("mock-data")
+	for _, uri := range []*url.URL{first, undeletable} {
+		if err := StoreFileAt(backend, bytes.NewReader(data), int64(len(data)), uri); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	filelist, _ := backend.ListFiles(prefix)
+	assertEquals(t, 2, len(filelist), "len(filelist)")
+
+	/* removals are forwarded to the wrapped BulkRemover */
+	results := backend.RemoveFiles([]*url.URL{first, undeletable})
+	assertEquals(t, "[2]", fmt.Sprint(brb.batches), "brb.batches")
+	assertEquals(t, nil, results[0].Err, "results[0].Err")
+	assertEquals(t, ErrAccessDenied, results[1].Err.Error(), "results[1].Err")
+	filelist, _ = backend.ListFiles(prefix)
+	assertEquals(t, 1, len(filelist), "len(filelist)")
+	assertEquals(t, "backups/undeletable", filelist[0].Name(), "filelist[0].Name")
+}
+
+func TestCachingBackendTTL(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	Now = func() time.Time { return now }
+	defer func() { Now = time.Now }()
+
+	counting := &countingBackend{MemoryBackend: NewMemoryBackend()}
+	backend := NewCachingBackend(counting, time.Minute)
+	prefix, _ := url.Parse("memory://bucket/backups/")
+
+	backend.ListFiles(prefix)
+	now = now.Add(59 * time.Second)
+	backend.ListFiles(prefix)
+	assertEquals(t, 1, counting.listFiles, "counting.listFiles")
+	now = now.Add(time.Second)
+	backend.ListFiles(prefix)
+	assertEquals(t, 2, counting.listFiles, "counting.listFiles")
+}
+
+func TestCachingBackendConcurrent(t *testing.T) {
+	counting := &countingBackend{MemoryBackend: NewMemoryBackend()}
+	backend := NewCachingBackend(counting, 0)
+	prefix, _ := url.Parse("memory://bucket/backups/")
+	data := []byte("mock-data")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			uri := objectURI(prefix, "backups/"+string(rune('a'+i)))
+			if err := StoreFileAt(backend, bytes.NewReader(data), int64(len(data)), uri); err != nil {
+				t.Errorf(err.Error())
+			}
+			backend.ListFiles(prefix)
+			backend.GetFileInfo(uri)
+		}(i)
+	}
+	wg.Wait()
+
+	/* results fetched while objects changed were not cached */
+	filelist, err := backend.ListFiles(prefix)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assertEquals(t, 8, len(filelist), "len(filelist)")
+}
+
+func TestCreateStorageBackendCaching(t *testing.T) {
+	cfg := new(Config)
+	cfg.S3.Region = "mock-region"
+	cfg.Performance.CacheListings = true
+	mockURI, _ := url.ParseRequestURI("b2://bucket/path/to/key")
+
+	backend, err := CreateStorageBackend(mockURI, cfg)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	_, ok := backend.(*CachingBackend)
+	assertEquals(t, true, ok, "ok")
+
+	/* long-running processes only cache results with a TTL */
+	cfg.Internal.LongRunning = true
+	backend, _ = CreateStorageBackend(mockURI, cfg)
+	_, ok = backend.(*B2Backend)
+	assertEquals(t, true, ok, "ok")
+
+	cfg.Performance.CacheTTLSeconds = 60
+	backend, _ = CreateStorageBackend(mockURI, cfg)
+	_, ok = backend.(*CachingBackend)
+	assertEquals(t, true, ok, "ok")
+}
@@ -0,0 +1,468 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// CleanupOptions configures removal of old backups by CleanupPrefix.
+	CleanupOptions struct {
+		// stops the cleanup once done, if set
+		Context context.Context
+		// names of objects under the prefix that are never removed
+		Keep []string
+		// keeps the newest backup regardless of its age, for runs that did not store one
+		KeepNewest bool
+		// returns the nominal name and time of the object stored under `key`, if known
+		Resolve func(key string) (name string, nominal time.Time, ok bool)
+		// called with the URIs of expired backups before they are removed, the cleanup stops
+		// with its error, if set
+		Confirm func(objects []string) error
+		// receive messages, they are discarded if not set
+		Stdout io.Writer
+		Stderr io.Writer
+	}
+
+	// cleanupCandidate is an object considered for removal by CleanupPrefix.
+	cleanupCandidate struct {
+		fileinfo FileInfo
+		key      string
+		// name and time reported for the object, nominal ones if known
+		name     string
+		modified time.Time
+	}
+
+	// CleanupResult describes the removal of old backups by CleanupPrefix.
+	CleanupResult struct {
+		// URIs of removed objects
+		Removed []string
+		// number of object versions removed, zero unless the backend deleted versions
+		Versions int
+		// names of objects left under the prefix, nil if the prefix could not be listed
+		Remaining map[string]bool
+		// number of expired objects left for later runs, see Config.Backup.MaxDeletionsPerRun
+		Deferred int
+		// problems that did not fail the cleanup
+		Warnings []string
+	}
+
+	// ExpiredObject is an object CleanupPrefix would remove, see ExpiredObjects.
+	ExpiredObject struct {
+		// URI of the object
+		URI *url.URL
+		// name reported for the object, along with its nominal name if known
+		Name string
+		// time compared against the retention period, the nominal time if known
+		Modified time.Time
+	}
+
+	// cleanupTask reports the removal of objects by CleanupPrefix as a task of a progress
+	// reporter, it reports nothing if progress is disabled. Reporters are safe for concurrent
+	// use, so are its methods.
+	cleanupTask struct {
+		pr    ProgressReporter
+		index int
+	}
+
+	// rateLimiter spaces out requests evenly to at most a given number per second.
+	rateLimiter struct {
+		interval time.Duration
+		next     time.Time
+	}
+)
+
+const (
+	// maxReportedFailures limits the number of failed keys listed in an error message.
+	maxReportedFailures = 3
+)
+
+var (
+	// errCleanupSkipped marks objects that were not removed because the cleanup was stopped.
+	errCleanupSkipped = errors.New("cleanup stopped")
+
+	// cleanupWait waits for `d` or until `ctx` is done, tests replace it to avoid sleeping.
+	cleanupWait = func(ctx context.Context, d time.Duration) error {
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			return nil
+		}
+	}
+)
+
+// CleanupPrefix removes objects under `prefix` older than the configured retention period.
+// Chunks of deduplicated backups are removed once no remaining manifest refers to them.
+// A prefix that cannot be listed is skipped with a warning. At most
+// `cfg.Backup.MaxDeletionsPerRun` objects are removed if it is set, oldest first, the others
+// are left for later runs with a warning. Removal failures are collected and reported at the
+// end unless `cfg.Backup.CleanupBestEffort` is set, the result is returned in either case.
+// Once the context of `opts` is done, no further objects are removed and the context error is
+// returned.
+func CleanupPrefix(backend StorageBackend, cfg *Config, now time.Time, prefix *url.URL, opts CleanupOptions) (*CleanupResult, error) {
+	stdout, stderr := writerOrDiscard(opts.Stdout), writerOrDiscard(opts.Stderr)
+	result := &CleanupResult{}
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	/* list prefix contents */
+	filelist, err := backend.ListFiles(prefix)
+	if err != nil {
+		if err.Error() == ErrAccessDenied {
+			if !cfg.S3.AssumeWriteOnly {
+				warning := fmt.Sprintf("listing %q is not permitted, skipping cleanup of old backups", prefix)
+				cfg.Internal.Warnings.Report(stderr, WarningListing, prefix.String(), warning)
+				result.Warnings = append(result.Warnings, warning)
+			}
+			return result, nil
+		}
+		return nil, fmt.Errorf("could not list remote files: %s", err.Error())
+	}
+
+	/* remove old files */
+	var failed []string
+	candidates, expired, chunks, err := selectCleanup(filelist, cfg, now, opts, stderr)
+	if err != nil {
+		return nil, err
+	}
+	result.Remaining = map[string]bool{}
+	for _, candidate := range candidates {
+		result.Remaining[candidate.key] = true
+	}
+	// keeps the oldest expired objects still permitted in this run, the others are deferred
+	var permitted int64 = cfg.Backup.MaxDeletionsPerRun
+	limit := func(expired []cleanupCandidate) []cleanupCandidate {
+		if cfg.Backup.MaxDeletionsPerRun <= 0 {
+			return expired
+		}
+		count := min(int64(len(expired)), permitted)
+		permitted -= count
+		result.Deferred += len(expired) - int(count)
+		return expired[:count]
+	}
+	expired = limit(expired)
+	// removes the expired objects of `considered` ones, progress is reported as a task of its own
+	remove := func(expired []cleanupCandidate, considered int) {
+		task := newCleanupTask(cfg.Internal.Reporter, len(expired))
+		removals := removeCandidates(ctx, backend, cfg, expired, stdout, task)
+		var removed, failures int
+		for index, candidate := range expired {
+			objectUri := candidate.fileinfo.URI()
+			if err := removals[index].Err; err == errCleanupSkipped {
+				continue
+			} else if err != nil {
+				fmt.Fprintf(stderr, "could not remove remote file %q: %s\n", objectUri, err.Error())
+				failed = append(failed, candidate.fileinfo.Name())
+				failures++
+			} else {
+				delete(result.Remaining, candidate.key)
+				result.Removed = append(result.Removed, objectUri.String())
+				result.Versions += removals[index].Versions
+				removed++
+			}
+		}
+		task.finish(removed, considered-removed-failures, failures)
+	}
+	if opts.Confirm != nil && len(expired) > 0 {
+		var objects []string
+		for _, candidate := range expired {
+			objects = append(objects, candidate.fileinfo.URI().String())
+		}
+		if err := opts.Confirm(objects); err != nil {
+			return result, err
+		}
+	}
+	remove(expired, len(candidates))
+
+	/* remove chunks of deduplicated backups no longer referenced by any manifest */
+	if len(chunks) > 0 && ctx.Err() == nil {
+		removed := map[string]bool{}
+		for _, objectUri := range result.Removed {
+			removed[objectUri] = true
+		}
+		manifests := liveManifests(filelist, removed)
+		unreferenced, err := unreferencedChunks(backend, manifests, chunks, now)
+		if err != nil {
+			warning := fmt.Sprintf("%s, skipping removal of unreferenced chunks", err.Error())
+			cfg.Internal.Warnings.Report(stderr, WarningCleanup, prefix.String(), warning)
+			result.Warnings = append(result.Warnings, warning)
+		} else {
+			var expired []cleanupCandidate
+			for _, fileinfo := range unreferenced {
+				expired = append(expired, cleanupCandidate{fileinfo, path.Base(fileinfo.Name()), fileinfo.Name(), fileinfo.Modified()})
+			}
+			remove(limit(expired), len(chunks))
+		}
+	}
+	if result.Deferred > 0 {
+		warning := fmt.Sprintf("removed at most %d objects under %q, %d expired objects remain for later runs", cfg.Backup.MaxDeletionsPerRun, prefix, result.Deferred)
+		cfg.Internal.Warnings.Report(stderr, WarningCleanup, prefix.String(), warning)
+		result.Warnings = append(result.Warnings, warning)
+	}
+	if result.Versions > 0 {
+		fmt.Fprintf(stdout, "removed %d versions of %d files\n", result.Versions, len(result.Removed))
+	}
+
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+
+	/* report failures */
+	if len(failed) > 0 && !cfg.Backup.CleanupBestEffort {
+		var keys string
+		if len(failed) > maxReportedFailures {
+			keys = fmt.Sprintf("%s and %d more", strings.Join(failed[:maxReportedFailures], ", "), len(failed)-maxReportedFailures)
+		} else {
+			keys = strings.Join(failed, ", ")
+		}
+		return result, fmt.Errorf("cleanup completed with %d failures: %s", len(failed), keys)
+	}
+
+	return result, nil
+}
+
+// ExpiredObjects returns the objects under `prefix` that CleanupPrefix would remove at `now`,
+// oldest first and followed by unreferenced chunks of deduplicated backups, without removing
+// anything. Chunks are left out if the manifests referring to them cannot be read. Like
+// CleanupPrefix, at most `cfg.Backup.MaxDeletionsPerRun` objects are returned if it is set.
+func ExpiredObjects(backend StorageBackend, cfg *Config, now time.Time, prefix *url.URL, opts CleanupOptions) ([]ExpiredObject, error) {
+	filelist, err := backend.ListFiles(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("could not list remote files: %s", err.Error())
+	}
+	_, expired, chunks, err := selectCleanup(filelist, cfg, now, opts, writerOrDiscard(opts.Stderr))
+	if err != nil {
+		return nil, err
+	}
+	limit := cfg.Backup.MaxDeletionsPerRun
+	if limit > 0 && int64(len(expired)) > limit {
+		expired = expired[:limit]
+	}
+
+	var objects []ExpiredObject
+	removed := map[string]bool{}
+	for _, candidate := range expired {
+		objects = append(objects, ExpiredObject{candidate.fileinfo.URI(), candidate.name, candidate.modified})
+		removed[candidate.fileinfo.URI().String()] = true
+	}
+	if len(chunks) > 0 {
+		unreferenced, err := unreferencedChunks(backend, liveManifests(filelist, removed), chunks, now)
+		if err == nil {
+			for _, fileinfo := range unreferenced {
+				objects = append(objects, ExpiredObject{fileinfo.URI(), fileinfo.Name(), fileinfo.Modified()})
+			}
+		}
+	}
+	if limit > 0 && int64(len(objects)) > limit {
+		objects = objects[:limit]
+	}
+	return objects, nil
+}
+
+// selectCleanup sorts the objects of `filelist` not listed in `opts.Keep` into candidates
+// for removal, oldest first, and chunks of deduplicated backups. Candidates older than the
+// retention period at `now` are returned as expired, except for the newest backup if
+// `opts.KeepNewest` is set.
+func selectCleanup(filelist []FileInfo, cfg *Config, now time.Time, opts CleanupOptions, stderr io.Writer) (candidates, expired []cleanupCandidate, chunks []FileInfo, err error) {
+	location, err := cfg.BackupLocation()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	now = now.In(location)
+	for _, fileinfo := range filelist {
+		var key string = path.Base(fileinfo.Name())
+		if slices.Contains(opts.Keep, key) {
+			continue
+		}
+		// chunks are removed once no manifest refers to them
+		if IsChunkObject(key) {
+			chunks = append(chunks, fileinfo)
+			continue
+		}
+
+		candidate := cleanupCandidate{fileinfo, key, fileinfo.Name(), fileinfo.Modified()}
+		if opts.Resolve != nil {
+			if nominalName, nominalTime, ok := opts.Resolve(key); ok {
+				candidate.modified = nominalTime
+				candidate.name = fmt.Sprintf("%s (%s)", nominalName, fileinfo.Name())
+			}
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	/* remove the oldest files first, so an interrupted cleanup keeps newer backups */
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].modified.Before(candidates[j].modified)
+	})
+	newest := -1
+	if opts.KeepNewest {
+		for index := len(candidates) - 1; index >= 0; index-- {
+			if IsBackupObject(candidates[index].key) {
+				newest = index
+				break
+			}
+		}
+	}
+	for index, candidate := range candidates {
+		diff := now.Sub(candidate.modified.In(location))
+		fmt.Fprintf(stderr, "file %s, time diff = %.0f h\n", candidate.name, diff.Hours())
+		if diff.Hours() >= cfg.Backup.Hours && index != newest {
+			expired = append(expired, candidate)
+		}
+	}
+	return candidates, expired, chunks, nil
+}
+
+// liveManifests returns the manifests of deduplicated backups in `filelist` whose URI is
+// not marked in `removed`.
+func liveManifests(filelist []FileInfo, removed map[string]bool) []FileInfo {
+	var manifests []FileInfo
+	for _, fileinfo := range filelist {
+		if IsDedupManifest(fileinfo.Name()) && !removed[fileinfo.URI().String()] {
+			manifests = append(manifests, fileinfo)
+		}
+	}
+	return manifests
+}
+
+// removeCandidates removes the objects of `expired` and returns the result for each of them,
+// objects skipped once `ctx` is done fail with errCleanupSkipped. Backends implementing
+// BulkRemover remove up to MaxBulkRemoveFiles objects per request, others one object per
+// request. Requests are started in the order of `expired`, at most
+// `cfg.Backup.CleanupConcurrency` at a time and at most `cfg.Backup.CleanupRateLimit` per
+// second if it is set. `task` is advanced once a request completes.
+func removeCandidates(ctx context.Context, backend StorageBackend, cfg *Config, expired []cleanupCandidate, stdout io.Writer, task *cleanupTask) []RemoveResult {
+	removals := make([]RemoveResult, len(expired))
+	batchSize := 1
+	bulkRemover, bulk := AsBackend[BulkRemover](backend)
+	if bulk {
+		batchSize = MaxBulkRemoveFiles
+	}
+
+	limiter := newRateLimiter(cfg.Backup.CleanupRateLimit)
+	workers := make(chan struct{}, max(cfg.Backup.CleanupConcurrency, 1))
+	var wg sync.WaitGroup
+	for start := 0; start < len(expired); start += batchSize {
+		batch := expired[start:min(start+batchSize, len(expired))]
+		if err := limiter.wait(ctx); err != nil {
+			for index := start; index < len(expired); index++ {
+				removals[index].Err = errCleanupSkipped
+			}
+			break
+		}
+		uris := make([]*url.URL, len(batch))
+		for index, candidate := range batch {
+			uris[index] = candidate.fileinfo.URI()
+			fmt.Fprintf(stdout, "removing file %q\n", uris[index])
+		}
+		task.describe(batch[0].key, len(batch))
+
+		workers <- struct{}{}
+		wg.Add(1)
+		go func(start int, uris []*url.URL) {
+			defer func() { <-workers; wg.Done() }()
+			if bulk {
+				results := bulkRemover.RemoveFiles(uris)
+				for index := range uris {
+					if len(results) == len(uris) {
+						removals[start+index] = results[index]
+					} else {
+						removals[start+index].Err = fmt.Errorf("backend reported %d results for %d files", len(results), len(uris))
+					}
+				}
+			} else {
+				removals[start].Err = backend.RemoveFile(uris[0])
+			}
+			task.advance(len(uris))
+		}(start, uris)
+	}
+	wg.Wait()
+
+	return removals
+}
+
+// newCleanupTask creates the task of removing `total` objects.
+func newCleanupTask(pr ProgressReporter, total int) *cleanupTask {
+	if !ProgressEnabled(pr) || total == 0 {
+		return &cleanupTask{}
+	}
+	index, err := pr.CreateFileTask(int64(total))
+	if err != nil {
+		return &cleanupTask{}
+	}
+	return &cleanupTask{pr, index}
+}
+
+// describe shows the key of the object being removed, along with the number of further
+// objects removed by the same request.
+func (ct *cleanupTask) describe(key string, count int) {
+	if ct.pr == nil {
+		return
+	}
+	description := fmt.Sprintf("removing %s", key)
+	if count > 1 {
+		description += fmt.Sprintf(" and %d more", count-1)
+	}
+	_ = ct.pr.DescribeTask(ct.index, description)
+}
+
+// advance counts `count` objects whose removal completed, whether it succeeded or not.
+func (ct *cleanupTask) advance(count int) {
+	if ct.pr != nil {
+		_ = ct.pr.AdvanceTask(ct.index, int64(count))
+	}
+}
+
+// finish shows the final counts of the cleanup and finishes the task.
+func (ct *cleanupTask) finish(removed, kept, failed int) {
+	if ct.pr == nil {
+		return
+	}
+	_ = ct.pr.DescribeTask(ct.index, fmt.Sprintf("cleanup: %d removed, %d kept, %d failed", removed, kept, failed))
+	_ = ct.pr.FinishTask(ct.index)
+}
+
+// newRateLimiter returns a rateLimiter allowing `rate` requests per second, it does not
+// limit requests if `rate` is zero.
+func newRateLimiter(rate float64) *rateLimiter {
+	if rate <= 0 {
+		return &rateLimiter{}
+	}
+	return &rateLimiter{interval: time.Duration(float64(time.Second) / rate)}
+}
+
+// wait blocks until the next request may be started or `ctx` is done.
+func (rl *rateLimiter) wait(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if rl.interval == 0 {
+		return nil
+	}
+	now := Now()
+	if delay := rl.next.Sub(now); delay > 0 {
+		if err := cleanupWait(ctx, delay); err != nil {
+			return err
+		}
+		now = rl.next
+	}
+	rl.next = now.Add(rl.interval)
+	return nil
+}
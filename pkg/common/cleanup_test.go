@@ -0,0 +1,614 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// deniedListingBackend is a MemoryBackend that may not list objects.
+type deniedListingBackend struct {
+	*MemoryBackend
+}
+
+func (dlb *deniedListingBackend) ListFiles(uri *url.URL) ([]FileInfo, error) {
+	return nil, fmt.Errorf("%s", ErrAccessDenied)
+}
+
+// bulkRemoveBackend is a MemoryBackend removing objects in batches, objects with keys
+// containing "undeletable" cannot be removed. Every object has `versions` versions.
+type bulkRemoveBackend struct {
+	*MemoryBackend
+	versions int
+	lock     sync.Mutex
+	batches  []int
+	active   int
+	peak     int
+}
+
+func (brb *bulkRemoveBackend) RemoveFile(uri *url.URL) error {
+	return fmt.Errorf("RemoveFile called for %s", uri)
+}
+
+func (brb *bulkRemoveBackend) RemoveFiles(uris []*url.URL) []RemoveResult {
+	brb.lock.Lock()
+	brb.batches = append(brb.batches, len(uris))
+	brb.active++
+	brb.peak = max(brb.peak, brb.active)
+	brb.lock.Unlock()
+
+	results := make([]RemoveResult, len(uris))
+	for index, uri := range uris {
+		if strings.Contains(uri.Path, "undeletable") {
+			results[index].Err = fmt.Errorf("%s", ErrAccessDenied)
+		} else if results[index].Err = brb.MemoryBackend.RemoveFile(uri); results[index].Err == nil {
+			results[index].Versions = brb.versions
+		}
+	}
+	time.Sleep(time.Millisecond)
+
+	brb.lock.Lock()
+	brb.active--
+	brb.lock.Unlock()
+	return results
+}
+
+// helper function: store `key` under `prefixUri` with the given modification time.
+func storeAged(t *testing.T, memory *MemoryBackend, prefixUri *url.URL, key string, modified time.Time) {
+	uri, _ := prefixUri.Parse(key)
+	if err := memory.StoreFile(context.Background(), StoreRequest{URI: uri, BodyAt: bytes.NewReader([]byte("data")), Length: 4}); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	if err := memory.SetFileModified(uri, modified); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+}
+
+/* test cases for CleanupPrefix */
+func TestCleanupPrefix(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	cfg.Backup.Hours = 24
+	memory := NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	now := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	storeAged(t, memory, prefixUri, "old", now.Add(-48*time.Hour))
+	storeAged(t, memory, prefixUri, "recent", now.Add(-time.Hour))
+	storeAged(t, memory, prefixUri, "kept", now.Add(-48*time.Hour))
+	storeAged(t, memory, prefixUri, "resolved", now.Add(-48*time.Hour))
+
+	var stdout, stderr bytes.Buffer
+
+	// Perform the test
+	result, err := CleanupPrefix(memory, cfg, now, prefixUri, CleanupOptions{
+		Keep: []string{"kept"},
+		Resolve: func(key string) (string, time.Time, bool) {
+			if key == "resolved" {
+				return "nominal", now.Add(-2 * time.Hour), true
+			}
+			return "", time.Time{}, false
+		},
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	assertEquals(t, 1, len(result.Removed), "len(result.Removed)")
+	assertEquals(t, "memory://bucket/prefix/old", result.Removed[0], "result.Removed")
+	assertEquals(t, 2, len(result.Remaining), "len(result.Remaining)")
+	assertEquals(t, true, result.Remaining["recent"] && result.Remaining["resolved"], "result.Remaining")
+	assertEquals(t, "removing file \"memory://bucket/prefix/old\"\n", stdout.String(), "stdout")
+	assertEquals(t, true, bytes.Contains(stderr.Bytes(), []byte("file nominal (prefix/resolved), time diff = 2 h\n")), "stderr")
+
+	files, _ := memory.ListFiles(prefixUri)
+	assertEquals(t, 3, len(files), "len(files)")
+}
+
+// recordingReporter is a DummyProgressReporter recording the lifecycle of its tasks.
+type recordingReporter struct {
+	DummyProgressReporter
+	lock         sync.Mutex
+	totals       []int64
+	advanced     int64
+	descriptions []string
+	finished     []int
+}
+
+func (rr *recordingReporter) CreateFileTask(size int64) (int, error) {
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+	rr.totals = append(rr.totals, size)
+	return len(rr.totals), nil
+}
+
+func (rr *recordingReporter) AdvanceTask(index int, increment int64) error {
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+	rr.advanced += increment
+	return nil
+}
+
+func (rr *recordingReporter) DescribeTask(index int, description string) error {
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+	rr.descriptions = append(rr.descriptions, description)
+	return nil
+}
+
+func (rr *recordingReporter) FinishTask(index int) error {
+	rr.lock.Lock()
+	defer rr.lock.Unlock()
+	rr.finished = append(rr.finished, index)
+	return nil
+}
+
+func TestCleanupPrefixProgress(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	cfg.Backup.Hours = 24
+	cfg.Backup.CleanupConcurrency = 4
+	reporter := &recordingReporter{}
+	cfg.Internal.Reporter = reporter
+	dummy := &DummyBackend{}
+	dummy.GenerateDummyFiles("prefix/", 50)
+	prefixUri, _ := url.ParseRequestURI("dummy://bucket/prefix/")
+	now := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+
+	// Perform the test
+	result, err := CleanupPrefix(dummy, cfg, now, prefixUri, CleanupOptions{Keep: []string{"A"}})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 49, len(result.Removed), "len(result.Removed)")
+
+	/* one task counts every removal, describes the current key and ends with the counts */
+	assertEquals(t, 1, len(reporter.totals), "len(reporter.totals)")
+	assertEquals(t, int64(49), reporter.totals[0], "reporter.totals")
+	assertEquals(t, int64(49), reporter.advanced, "reporter.advanced")
+	assertEquals(t, 50, len(reporter.descriptions), "len(reporter.descriptions)")
+	assertEquals(t, "removing B", reporter.descriptions[0], "reporter.descriptions")
+	assertEquals(t, "cleanup: 49 removed, 0 kept, 0 failed", reporter.descriptions[49], "reporter.descriptions")
+	assertEquals(t, "[1]", fmt.Sprint(reporter.finished), "reporter.finished")
+
+	/* failures are counted, nothing is reported without expired objects */
+	reporter = &recordingReporter{}
+	cfg.Internal.Reporter = reporter
+	cfg.Backup.CleanupBestEffort = true
+	memory := NewMemoryBackend()
+	memoryUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	for _, key := range []string{"a", "b", "c"} {
+		storeAged(t, memory, memoryUri, key, now.Add(-48*time.Hour))
+	}
+	storeAged(t, memory, memoryUri, "recent", now.Add(-time.Hour))
+	if _, err = CleanupPrefix(&failingRemoveBackend{memory}, cfg, now, memoryUri, CleanupOptions{}); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "cleanup: 0 removed, 1 kept, 3 failed", reporter.descriptions[len(reporter.descriptions)-1], "reporter.descriptions")
+	reporter = &recordingReporter{}
+	cfg.Internal.Reporter = reporter
+	cfg.Backup.Hours = 1e6
+	if _, err = CleanupPrefix(dummy, cfg, now, prefixUri, CleanupOptions{}); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 0, len(reporter.totals), "len(reporter.totals)")
+}
+
+func TestCleanupPrefixConfirm(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	cfg.Backup.Hours = 24
+	memory := NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	now := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	storeAged(t, memory, prefixUri, "old", now.Add(-48*time.Hour))
+	storeAged(t, memory, prefixUri, "recent", now.Add(-time.Hour))
+	var confirmed []string
+
+	/* nothing is removed if the removal is not confirmed */
+	result, err := CleanupPrefix(memory, cfg, now, prefixUri, CleanupOptions{
+		Confirm: func(objects []string) error {
+			confirmed = objects
+			return fmt.Errorf("not confirmed")
+		},
+	})
+	assertEquals(t, "not confirmed", fmt.Sprintf("%v", err), "err")
+	assertEquals(t, "memory://bucket/prefix/old", strings.Join(confirmed, ","), "confirmed")
+	assertEquals(t, 0, len(result.Removed), "len(result.Removed)")
+	files, _ := memory.ListFiles(prefixUri)
+	assertEquals(t, 2, len(files), "len(files)")
+
+	/* confirmed objects are removed */
+	result, err = CleanupPrefix(memory, cfg, now, prefixUri, CleanupOptions{
+		Confirm: func(objects []string) error { return nil },
+	})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 1, len(result.Removed), "len(result.Removed)")
+}
+
+/* test cases for ExpiredObjects */
+func TestExpiredObjects(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	cfg.Backup.Hours = 24
+	memory := NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	now := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	chunk := "chunks/" + strings.Repeat("ab", 32) + dedup_chunk_suffix
+	storeAged(t, memory, prefixUri, "old", now.Add(-48*time.Hour))
+	storeAged(t, memory, prefixUri, "older", now.Add(-72*time.Hour))
+	storeAged(t, memory, prefixUri, "recent", now.Add(-time.Hour))
+	storeAged(t, memory, prefixUri, "kept", now.Add(-48*time.Hour))
+	storeAged(t, memory, prefixUri, chunk, now.Add(-48*time.Hour))
+
+	// Perform the test
+	expired, err := ExpiredObjects(memory, cfg, now, prefixUri, CleanupOptions{Keep: []string{"kept"}})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	/* oldest first, followed by unreferenced chunks */
+	assertEquals(t, 3, len(expired), "len(expired)")
+	assertEquals(t, "memory://bucket/prefix/older", expired[0].URI.String(), "expired[0].URI")
+	assertEquals(t, "prefix/older", expired[0].Name, "expired[0].Name")
+	assertEquals(t, now.Add(-72*time.Hour), expired[0].Modified, "expired[0].Modified")
+	assertEquals(t, "memory://bucket/prefix/old", expired[1].URI.String(), "expired[1].URI")
+	assertEquals(t, "memory://bucket/prefix/"+chunk, expired[2].URI.String(), "expired[2].URI")
+
+	/* nothing is removed */
+	files, _ := memory.ListFiles(prefixUri)
+	assertEquals(t, 5, len(files), "len(files)")
+
+	/* listing failures are reported */
+	_, err = ExpiredObjects(&deniedListingBackend{memory}, cfg, now, prefixUri, CleanupOptions{})
+	if err == nil {
+		t.Fatalf("ExpiredObjects was supposed to fail")
+	}
+	assertEquals(t, "could not list remote files: access denied", err.Error(), "err")
+}
+
+func TestCleanupPrefixFailures(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	cfg.Backup.Hours = 1
+	memory := NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	now := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		storeAged(t, memory, prefixUri, key, now.Add(-48*time.Hour))
+	}
+	backend := &failingRemoveBackend{memory}
+
+	// Perform the test
+	result, err := CleanupPrefix(backend, cfg, now, prefixUri, CleanupOptions{})
+	if err == nil {
+		t.Fatalf("CleanupPrefix was supposed to fail")
+	}
+	assertEquals(t, "cleanup completed with 4 failures: prefix/a, prefix/b, prefix/c and 1 more", err.Error(), "err")
+	assertEquals(t, 4, len(result.Remaining), "len(result.Remaining)")
+
+	cfg.Backup.CleanupBestEffort = true
+	_, err = CleanupPrefix(backend, cfg, now, prefixUri, CleanupOptions{})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+}
+
+func TestCleanupPrefixOldestFirst(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	cfg.Backup.Hours = 24
+	memory := NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	now := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	storeAged(t, memory, prefixUri, "a", now.Add(-48*time.Hour))
+	storeAged(t, memory, prefixUri, "b", now.Add(-96*time.Hour))
+	storeAged(t, memory, prefixUri, "c", now.Add(-72*time.Hour))
+	storeAged(t, memory, prefixUri, "d", now.Add(-96*time.Hour))
+
+	var stdout bytes.Buffer
+
+	// Perform the test
+	result, err := CleanupPrefix(memory, cfg, now, prefixUri, CleanupOptions{
+		Resolve: func(key string) (string, time.Time, bool) {
+			if key == "a" {
+				return "nominal", now.Add(-120 * time.Hour), true
+			}
+			return "", time.Time{}, false
+		},
+		Stdout: &stdout,
+	})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	/* nominal times take precedence, ties keep the key order */
+	assertEquals(t, "[memory://bucket/prefix/a memory://bucket/prefix/b memory://bucket/prefix/d memory://bucket/prefix/c]", fmt.Sprint(result.Removed), "result.Removed")
+	assertEquals(t, `removing file "memory://bucket/prefix/a"
+removing file "memory://bucket/prefix/b"
+removing file "memory://bucket/prefix/d"
+removing file "memory://bucket/prefix/c"
+`, stdout.String(), "stdout")
+}
+
+func TestCleanupPrefixKeepNewest(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	cfg.Backup.Hours = 24
+	memory := NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	now := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	storeAged(t, memory, prefixUri, "a", now.Add(-96*time.Hour))
+	storeAged(t, memory, prefixUri, "b", now.Add(-72*time.Hour))
+	storeAged(t, memory, prefixUri, "b"+AbortedMarkerSuffix, now.Add(-48*time.Hour))
+
+	// Perform the test
+	result, err := CleanupPrefix(memory, cfg, now, prefixUri, CleanupOptions{KeepNewest: true})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	/* the newest backup survives, markers do not count as backups */
+	assertEquals(t, "[memory://bucket/prefix/a memory://bucket/prefix/b.aborted]", fmt.Sprint(result.Removed), "result.Removed")
+	filelist, _ := memory.ListFiles(prefixUri)
+	assertEquals(t, 1, len(filelist), "len(filelist)")
+	assertEquals(t, "prefix/b", filelist[0].Name(), "filelist[0].Name")
+}
+
+func TestCleanupPrefixMaxDeletions(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	cfg.Backup.Hours = 24
+	cfg.Backup.MaxDeletionsPerRun = 2
+	cfg.Internal.Warnings = new(Warnings)
+	memory := NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	now := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	storeAged(t, memory, prefixUri, "a", now.Add(-48*time.Hour))
+	storeAged(t, memory, prefixUri, "b", now.Add(-96*time.Hour))
+	storeAged(t, memory, prefixUri, "c", now.Add(-72*time.Hour))
+	storeAged(t, memory, prefixUri, "d", now.Add(-120*time.Hour))
+	storeAged(t, memory, prefixUri, "recent", now.Add(-time.Hour))
+
+	var stderr bytes.Buffer
+
+	// Perform the test
+	expired, err := ExpiredObjects(memory, cfg, now, prefixUri, CleanupOptions{})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 2, len(expired), "len(expired)")
+
+	/* the oldest backups are removed first, the others are left for later runs */
+	result, err := CleanupPrefix(memory, cfg, now, prefixUri, CleanupOptions{Stderr: &stderr})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "[memory://bucket/prefix/d memory://bucket/prefix/b]", fmt.Sprint(result.Removed), "result.Removed")
+	assertEquals(t, 2, result.Deferred, "result.Deferred")
+	assertEquals(t, 3, len(result.Remaining), "len(result.Remaining)")
+	warning := `removed at most 2 objects under "memory://bucket/prefix/", 2 expired objects remain for later runs`
+	assertEquals(t, true, strings.HasSuffix(stderr.String(), "warning: "+warning+"\n"), "stderr")
+	assertEquals(t, warning, result.Warnings[0], "result.Warnings[0]")
+	assertEquals(t, WarningCleanup, cfg.Internal.Warnings.List()[0].Code, "Warnings.Code")
+
+	/* the next run drains the remaining ones */
+	result, err = CleanupPrefix(memory, cfg, now, prefixUri, CleanupOptions{})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "[memory://bucket/prefix/c memory://bucket/prefix/a]", fmt.Sprint(result.Removed), "result.Removed")
+	assertEquals(t, 0, result.Deferred, "result.Deferred")
+	assertEquals(t, 0, len(result.Warnings), "len(result.Warnings)")
+}
+
+func TestCleanupPrefixListingDenied(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	backend := &deniedListingBackend{NewMemoryBackend()}
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	var stderr bytes.Buffer
+
+	// Perform the test
+	result, err := CleanupPrefix(backend, cfg, Now(), prefixUri, CleanupOptions{Stderr: &stderr})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	warning := "listing \"memory://bucket/prefix/\" is not permitted, skipping cleanup of old backups"
+	assertEquals(t, true, result.Remaining == nil, "result.Remaining")
+	assertEquals(t, 1, len(result.Warnings), "len(result.Warnings)")
+	assertEquals(t, warning, result.Warnings[0], "result.Warnings")
+	assertEquals(t, "warning: "+warning+"\n", stderr.String(), "stderr")
+
+	/* the warning is suppressed for keys known to be restricted to writing */
+	stderr.Reset()
+	cfg.S3.AssumeWriteOnly = true
+	result, err = CleanupPrefix(backend, cfg, Now(), prefixUri, CleanupOptions{Stderr: &stderr})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 0, len(result.Warnings), "len(result.Warnings)")
+	assertEquals(t, "", stderr.String(), "stderr")
+}
+
+func TestCleanupPrefixBulk(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	cfg.Backup.Hours = 24
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	now := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+
+	// Perform the test
+	for count, expected := range map[int]string{
+		1:                        "[1]",
+		MaxBulkRemoveFiles - 1:   "[999]",
+		MaxBulkRemoveFiles:       "[1000]",
+		MaxBulkRemoveFiles + 1:   "[1000 1]",
+		2 * MaxBulkRemoveFiles:   "[1000 1000]",
+		2*MaxBulkRemoveFiles + 1: "[1000 1000 1]",
+	} {
+		backend := &bulkRemoveBackend{MemoryBackend: NewMemoryBackend()}
+		for index := 0; index < count; index++ {
+			storeAged(t, backend.MemoryBackend, prefixUri, fmt.Sprintf("key%05d", index), now.Add(-48*time.Hour-time.Duration(index)*time.Second))
+		}
+		storeAged(t, backend.MemoryBackend, prefixUri, "recent", now.Add(-time.Hour))
+
+		result, err := CleanupPrefix(backend, cfg, now, prefixUri, CleanupOptions{})
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		assertEquals(t, expected, fmt.Sprint(backend.batches), fmt.Sprintf("batches(%d)", count))
+		assertEquals(t, count, len(result.Removed), "len(result.Removed)")
+		/* the oldest files are removed first */
+		assertEquals(t, fmt.Sprintf("memory://bucket/prefix/key%05d", count-1), result.Removed[0], "result.Removed[0]")
+		assertEquals(t, "map[recent:true]", fmt.Sprint(result.Remaining), "result.Remaining")
+	}
+}
+
+func TestCleanupPrefixBulkFailures(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	cfg.Backup.Hours = 24
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	now := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	backend := &bulkRemoveBackend{MemoryBackend: NewMemoryBackend()}
+	for _, key := range []string{"a", "b-undeletable", "c", "d-undeletable"} {
+		storeAged(t, backend.MemoryBackend, prefixUri, key, now.Add(-48*time.Hour))
+	}
+	var stderr bytes.Buffer
+
+	// Perform the test
+	result, err := CleanupPrefix(backend, cfg, now, prefixUri, CleanupOptions{Stderr: &stderr})
+	if err == nil {
+		t.Fatalf("CleanupPrefix was supposed to fail")
+	}
+
+	/* failures of a batch are reported per object */
+	assertEquals(t, "cleanup completed with 2 failures: prefix/b-undeletable, prefix/d-undeletable", err.Error(), "err")
+	assertEquals(t, "[4]", fmt.Sprint(backend.batches), "batches")
+	assertEquals(t, "[memory://bucket/prefix/a memory://bucket/prefix/c]", fmt.Sprint(result.Removed), "result.Removed")
+	assertEquals(t, "map[b-undeletable:true d-undeletable:true]", fmt.Sprint(result.Remaining), "result.Remaining")
+	assertEquals(t, true, strings.Contains(stderr.String(), fmt.Sprintf("could not remove remote file %q: %s\n", "memory://bucket/prefix/b-undeletable", ErrAccessDenied)), "stderr")
+}
+
+func TestCleanupPrefixVersions(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	cfg.Backup.Hours = 24
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	now := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	backend := &bulkRemoveBackend{MemoryBackend: NewMemoryBackend(), versions: 3}
+	for _, key := range []string{"a", "b", "c-undeletable"} {
+		storeAged(t, backend.MemoryBackend, prefixUri, key, now.Add(-48*time.Hour))
+	}
+	var stdout bytes.Buffer
+
+	// Perform the test
+	result, _ := CleanupPrefix(backend, cfg, now, prefixUri, CleanupOptions{Stdout: &stdout})
+
+	/* versions of removed objects are counted */
+	assertEquals(t, 6, result.Versions, "result.Versions")
+	assertEquals(t, true, strings.HasSuffix(stdout.String(), "removed 6 versions of 2 files\n"), "stdout")
+
+	/* backends hiding objects report no versions */
+	backend.versions = 0
+	storeAged(t, backend.MemoryBackend, prefixUri, "a", now.Add(-48*time.Hour))
+	stdout.Reset()
+	result, _ = CleanupPrefix(backend, cfg, now, prefixUri, CleanupOptions{Stdout: &stdout})
+	assertEquals(t, 0, result.Versions, "result.Versions")
+	assertEquals(t, false, strings.Contains(stdout.String(), "versions"), "stdout")
+}
+
+func TestCleanupPrefixConcurrency(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	cfg.Backup.Hours = 24
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	now := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	backend := &bulkRemoveBackend{MemoryBackend: NewMemoryBackend()}
+	for index := 0; index < 4*MaxBulkRemoveFiles; index++ {
+		storeAged(t, backend.MemoryBackend, prefixUri, fmt.Sprintf("key%05d", index), now.Add(-48*time.Hour))
+	}
+
+	// Perform the test
+	for _, concurrency := range []int64{1, 2} {
+		cfg.Backup.CleanupConcurrency = concurrency
+		_, err := CleanupPrefix(backend, cfg, now, prefixUri, CleanupOptions{})
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		assertEquals(t, true, backend.peak <= int(concurrency), "backend.peak")
+		for index := 0; index < 2*MaxBulkRemoveFiles; index++ {
+			storeAged(t, backend.MemoryBackend, prefixUri, fmt.Sprintf("key%05d", index), now.Add(-48*time.Hour))
+		}
+	}
+
+	/* backends without BulkRemover remove files one by one */
+	memory := NewMemoryBackend()
+	for index := 0; index < 20; index++ {
+		storeAged(t, memory, prefixUri, fmt.Sprintf("key%05d", index), now.Add(-48*time.Hour))
+	}
+	cfg.Backup.CleanupConcurrency = 4
+	result, err := CleanupPrefix(memory, cfg, now, prefixUri, CleanupOptions{})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 20, len(result.Removed), "len(result.Removed)")
+	assertEquals(t, "map[]", fmt.Sprint(result.Remaining), "result.Remaining")
+}
+
+func TestCleanupPrefixRateLimit(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	cfg.Backup.Hours = 24
+	cfg.Backup.CleanupRateLimit = 4
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	now := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	memory := NewMemoryBackend()
+	for _, key := range []string{"a", "b", "c", "d"} {
+		storeAged(t, memory, prefixUri, key, now.Add(-48*time.Hour))
+	}
+
+	var waits []time.Duration
+	clock := now
+	oldCleanupWait := cleanupWait
+	cleanupWait = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		clock = clock.Add(d)
+		return nil
+	}
+	t.Cleanup(func() { cleanupWait = oldCleanupWait })
+	Now = func() time.Time { return clock }
+	t.Cleanup(func() { Now = time.Now })
+
+	// Perform the test
+	result, err := CleanupPrefix(memory, cfg, now, prefixUri, CleanupOptions{})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 4, len(result.Removed), "len(result.Removed)")
+	/* the first request starts right away */
+	assertEquals(t, "[250ms 250ms 250ms]", fmt.Sprint(waits), "waits")
+
+	/* waiting stops the cleanup once the context is done */
+	for _, key := range []string{"a", "b", "c", "d"} {
+		storeAged(t, memory, prefixUri, key, now.Add(-48*time.Hour))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cleanupWait = func(ctx context.Context, d time.Duration) error {
+		cancel()
+		return ctx.Err()
+	}
+	result, err = CleanupPrefix(memory, cfg, now, prefixUri, CleanupOptions{Context: ctx})
+	assertEquals(t, context.Canceled, err, "err")
+	assertEquals(t, "[memory://bucket/prefix/a]", fmt.Sprint(result.Removed), "result.Removed")
+	assertEquals(t, 3, len(result.Remaining), "len(result.Remaining)")
+}
@@ -1,38 +1,182 @@
 package common
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
+	"net/url"
+	"os"
 	"reflect"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/schollz/progressbar/v3"
 	"github.com/sethvargo/go-envconfig"
 	"gopkg.in/yaml.v3"
 )
 
 // Config struct contains configurations for SQUIRRELUP.
-// Currently it contains four sections:
+// Currently it contains eight sections:
 //   - S3 configuration
 //   - Encryption configuration
 //   - Backup configuration
+//   - Progress reporting configuration
+//   - Performance configuration
+//   - Retry configuration
+//   - Notification configuration
 //   - Internal configuration
 type Config struct {
 	S3 struct {
-		Region string `yaml:"region" env:"SQUIRRELUP_S3_REGION,overwrite" default:""`
-		ID     string `yaml:"id" env:"SQUIRRELUP_S3_ID,overwrite" default:""`
-		Secret string `yaml:"secret" env:"SQUIRRELUP_S3_SECRET,overwrite" default:""`
-		Token  string `yaml:"token" env:"SQUIRRELUP_S3_TOKEN,overwrite" default:""`
+		Region                 string  `yaml:"region" env:"SQUIRRELUP_S3_REGION,overwrite" default:""`
+		ID                     string  `yaml:"id" env:"SQUIRRELUP_S3_ID,overwrite" default:""`
+		Secret                 string  `yaml:"secret" env:"SQUIRRELUP_S3_SECRET,overwrite" default:""`
+		Token                  string  `yaml:"token" env:"SQUIRRELUP_S3_TOKEN,overwrite" default:""`
+		MaxConcurrentDownloads int64   `yaml:"max_concurrent_downloads" env:"SQUIRRELUP_S3_MAX_CONCURRENT_DOWNLOADS,overwrite" default:"4"`
+		RecoveryDir            string  `yaml:"recovery_dir" env:"SQUIRRELUP_S3_RECOVERY_DIR,overwrite" default:""`
+		RequestTimeoutSeconds  float64 `yaml:"request_timeout_seconds" env:"SQUIRRELUP_S3_REQUEST_TIMEOUT_SECONDS,overwrite" default:"900"`
+		ConnectTimeoutSeconds  float64 `yaml:"connect_timeout_seconds" env:"SQUIRRELUP_S3_CONNECT_TIMEOUT_SECONDS,overwrite" default:"30"`
+		MaxIdleConns           int64   `yaml:"max_idle_conns" env:"SQUIRRELUP_S3_MAX_IDLE_CONNS,overwrite" default:"16"`
+		MaxRetries             int64   `yaml:"max_retries" env:"SQUIRRELUP_S3_MAX_RETRIES,overwrite" default:"3"`
+		ProxyURL               string  `yaml:"proxy_url" env:"SQUIRRELUP_S3_PROXY_URL,overwrite" default:""`
+		Endpoint               string  `yaml:"endpoint" env:"SQUIRRELUP_S3_ENDPOINT,overwrite" default:""`
+		EndpointTemplate       string  `yaml:"endpoint_template" env:"SQUIRRELUP_S3_ENDPOINT_TEMPLATE,overwrite" default:""`
+		PathStyle              bool    `yaml:"path_style" env:"SQUIRRELUP_S3_PATH_STYLE,overwrite" default:"true"`
+		PartSizeBytes          int64   `yaml:"part_size_bytes" env:"SQUIRRELUP_S3_PART_SIZE_BYTES,overwrite" default:"104857600"`
+		MaxPartSizeBytes       int64   `yaml:"max_part_size_bytes" env:"SQUIRRELUP_S3_MAX_PART_SIZE_BYTES,overwrite" default:"5368709120"`
+		AssumeWriteOnly        bool    `yaml:"assume_write_only" env:"SQUIRRELUP_S3_ASSUME_WRITE_ONLY,overwrite" default:"false"`
+		MaxBufferedParts       int64   `yaml:"max_buffered_parts" env:"SQUIRRELUP_S3_MAX_BUFFERED_PARTS,overwrite" default:"0"`
+		DeleteAllVersions      bool    `yaml:"delete_all_versions" env:"SQUIRRELUP_S3_DELETE_ALL_VERSIONS,overwrite" default:"false"`
+		StallTimeoutSeconds    float64 `yaml:"stall_timeout_seconds" env:"SQUIRRELUP_S3_STALL_TIMEOUT_SECONDS,overwrite" default:"120"`
+		CredentialSource       string  `yaml:"credential_source" env:"SQUIRRELUP_S3_CREDENTIAL_SOURCE,overwrite" default:"config"`
+		KeyringService         string  `yaml:"keyring_service" env:"SQUIRRELUP_S3_KEYRING_SERVICE,overwrite" default:"squirrelup"`
+		KeyringAccount         string  `yaml:"keyring_account" env:"SQUIRRELUP_S3_KEYRING_ACCOUNT,overwrite" default:"default"`
 	} `yaml:"s3"`
 	Encryption struct {
-		Pubkey string `yaml:"pubkey" env:"SQUIRRELUP_PUBKEY,overwrite" default:""`
+		Pubkey                 string  `yaml:"pubkey" env:"SQUIRRELUP_PUBKEY,overwrite" default:""`
+		Identity               string  `yaml:"identity" env:"SQUIRRELUP_IDENTITY,overwrite" default:""`
+		IdentityPassphraseFile string  `yaml:"identity_passphrase_file" env:"SQUIRRELUP_IDENTITY_PASSPHRASE_FILE,overwrite" default:""`
+		Command                string  `yaml:"command" env:"SQUIRRELUP_ENCRYPTION_COMMAND,overwrite" default:""`
+		CommandSuffix          string  `yaml:"command_suffix" env:"SQUIRRELUP_ENCRYPTION_COMMAND_SUFFIX,overwrite" default:""`
+		CommandTimeout         float64 `yaml:"command_timeout" env:"SQUIRRELUP_ENCRYPTION_COMMAND_TIMEOUT,overwrite" default:"3600"`
+		Required               bool    `yaml:"required" env:"SQUIRRELUP_ENCRYPTION_REQUIRED,overwrite" default:"false"`
+		StrictKeyPerms         bool    `yaml:"strict_key_perms" env:"SQUIRRELUP_ENCRYPTION_STRICT_KEY_PERMS,overwrite" default:"false"`
+		PubkeyURL              string  `yaml:"pubkey_url" env:"SQUIRRELUP_PUBKEY_URL,overwrite" default:""`
+		PubkeyURLHash          string  `yaml:"pubkey_url_hash" env:"SQUIRRELUP_PUBKEY_URL_HASH,overwrite" default:""`
+		PubkeyCacheDir         string  `yaml:"pubkey_cache_dir" env:"SQUIRRELUP_PUBKEY_CACHE_DIR,overwrite" default:""`
 	} `yaml:"encryption"`
 	Backup struct {
-		Hours float64 `yaml:"hours" env:"SQUIRRELUP_BACKUP_HOURS,overwrite" default:"240"`
-		Name  string  `yaml:"name" env:"SQUIRRELUP_BACKUP_FILENAME,overwrite" default:"2006-01-02T15-0700"`
+		Hours               float64  `yaml:"hours" env:"SQUIRRELUP_BACKUP_HOURS,overwrite" default:"240"`
+		Name                string   `yaml:"name" env:"SQUIRRELUP_BACKUP_FILENAME,overwrite" default:"2006-01-02T15-0700"`
+		NameFormat          string   `yaml:"name_format" env:"SQUIRRELUP_BACKUP_NAME_FORMAT,overwrite" default:"go"`
+		NameStrict          bool     `yaml:"name_strict" env:"SQUIRRELUP_BACKUP_NAME_STRICT,overwrite" default:"false"`
+		MinSizeBytes        int64    `yaml:"min_size_bytes" env:"SQUIRRELUP_BACKUP_MIN_SIZE_BYTES,overwrite" default:"1"`
+		MinFiles            int64    `yaml:"min_files" env:"SQUIRRELUP_BACKUP_MIN_FILES,overwrite" default:"1"`
+		CleanupBestEffort   bool     `yaml:"cleanup_best_effort" env:"SQUIRRELUP_BACKUP_CLEANUP_BEST_EFFORT,overwrite" default:"false"`
+		CleanupErrorsFatal  bool     `yaml:"cleanup_errors_fatal" env:"SQUIRRELUP_BACKUP_CLEANUP_ERRORS_FATAL,overwrite" default:"false"`
+		CleanupConcurrency  int64    `yaml:"cleanup_concurrency" env:"SQUIRRELUP_BACKUP_CLEANUP_CONCURRENCY,overwrite" default:"1"`
+		CleanupRateLimit    float64  `yaml:"cleanup_rate_limit" env:"SQUIRRELUP_BACKUP_CLEANUP_RATE_LIMIT,overwrite" default:"0"`
+		MaxDeletionsPerRun  int64    `yaml:"max_deletions_per_run" env:"SQUIRRELUP_BACKUP_MAX_DELETIONS_PER_RUN,overwrite" default:"0"`
+		Timezone            string   `yaml:"timezone" env:"SQUIRRELUP_BACKUP_TIMEZONE,overwrite" default:"Local"`
+		SkipUnchanged       bool     `yaml:"skip_unchanged" env:"SQUIRRELUP_BACKUP_SKIP_UNCHANGED,overwrite" default:"false"`
+		FingerprintParanoid bool     `yaml:"fingerprint_paranoid" env:"SQUIRRELUP_BACKUP_FINGERPRINT_PARANOID,overwrite" default:"false"`
+		Owner               string   `yaml:"owner" env:"SQUIRRELUP_BACKUP_OWNER,overwrite" default:""`
+		Group               string   `yaml:"group" env:"SQUIRRELUP_BACKUP_GROUP,overwrite" default:""`
+		ModeMask            string   `yaml:"mode_mask" env:"SQUIRRELUP_BACKUP_MODE_MASK,overwrite" default:""`
+		FileMode            string   `yaml:"file_mode" env:"SQUIRRELUP_BACKUP_FILE_MODE,overwrite" default:""`
+		NumericUIDGID       bool     `yaml:"numeric_uid_gid" env:"SQUIRRELUP_BACKUP_NUMERIC_UID_GID,overwrite" default:"true"`
+		Xattrs              bool     `yaml:"xattrs" env:"SQUIRRELUP_BACKUP_XATTRS,overwrite" default:"false"`
+		PerHostPrefix       bool     `yaml:"per_host_prefix" env:"SQUIRRELUP_BACKUP_PER_HOST_PREFIX,overwrite" default:"false"`
+		Hostname            string   `yaml:"hostname" env:"SQUIRRELUP_BACKUP_HOSTNAME,overwrite" default:""`
+		Exclude             []string `yaml:"exclude" env:"SQUIRRELUP_BACKUP_EXCLUDE,overwrite"`
+		IgnoreFileName      string   `yaml:"ignore_file_name" env:"SQUIRRELUP_BACKUP_IGNORE_FILE_NAME,overwrite" default:".squirrelignore"`
+		ObfuscateNames      bool     `yaml:"obfuscate_names" env:"SQUIRRELUP_BACKUP_OBFUSCATE_NAMES,overwrite" default:"false"`
+		NameKey             string   `yaml:"name_key" env:"SQUIRRELUP_BACKUP_NAME_KEY,overwrite" default:""`
+		Schedule            string   `yaml:"schedule" env:"SQUIRRELUP_BACKUP_SCHEDULE,overwrite" default:""`
+		ScheduleJitter      float64  `yaml:"schedule_jitter" env:"SQUIRRELUP_BACKUP_SCHEDULE_JITTER,overwrite" default:"0"`
+		ShutdownGrace       float64  `yaml:"shutdown_grace" env:"SQUIRRELUP_BACKUP_SHUTDOWN_GRACE,overwrite" default:"300"`
+		MaxDurationMinutes  float64  `yaml:"max_duration_minutes" env:"SQUIRRELUP_BACKUP_MAX_DURATION_MINUTES,overwrite" default:"0"`
+		ReadConcurrency     int64    `yaml:"read_concurrency" env:"SQUIRRELUP_BACKUP_READ_CONCURRENCY,overwrite" default:"0"`
+		Passthrough         bool     `yaml:"passthrough" env:"SQUIRRELUP_BACKUP_PASSTHROUGH,overwrite" default:"false"`
+		PassthroughMultiple string   `yaml:"passthrough_multiple" env:"SQUIRRELUP_BACKUP_PASSTHROUGH_MULTIPLE,overwrite" default:"reject"`
+		IgnoreFileErrors    bool     `yaml:"ignore_file_errors" env:"SQUIRRELUP_BACKUP_IGNORE_FILE_ERRORS,overwrite" default:"false"`
+		Preflight           bool     `yaml:"preflight" env:"SQUIRRELUP_BACKUP_PREFLIGHT,overwrite" default:"true"`
+		SnapshotType        string   `yaml:"snapshot_type" env:"SQUIRRELUP_BACKUP_SNAPSHOT_TYPE,overwrite" default:""`
+		SnapshotOptional    bool     `yaml:"snapshot_optional" env:"SQUIRRELUP_BACKUP_SNAPSHOT_OPTIONAL,overwrite" default:"false"`
+		SnapshotVolume      string   `yaml:"snapshot_volume" env:"SQUIRRELUP_BACKUP_SNAPSHOT_VOLUME,overwrite" default:""`
+		SnapshotMountpoint  string   `yaml:"snapshot_mountpoint" env:"SQUIRRELUP_BACKUP_SNAPSHOT_MOUNTPOINT,overwrite" default:""`
+		SnapshotDir         string   `yaml:"snapshot_dir" env:"SQUIRRELUP_BACKUP_SNAPSHOT_DIR,overwrite" default:""`
+		SnapshotSize        string   `yaml:"snapshot_size" env:"SQUIRRELUP_BACKUP_SNAPSHOT_SIZE,overwrite" default:"1G"`
+		SnapshotCreate      string   `yaml:"snapshot_create_command" env:"SQUIRRELUP_BACKUP_SNAPSHOT_CREATE_COMMAND,overwrite" default:""`
+		SnapshotTeardown    string   `yaml:"snapshot_teardown_command" env:"SQUIRRELUP_BACKUP_SNAPSHOT_TEARDOWN_COMMAND,overwrite" default:""`
+		SizeHistory         int64    `yaml:"size_history" env:"SQUIRRELUP_BACKUP_SIZE_HISTORY,overwrite" default:"5"`
+		SizeMinFraction     float64  `yaml:"size_min_fraction" env:"SQUIRRELUP_BACKUP_SIZE_MIN_FRACTION,overwrite" default:"0.5"`
+		SizeMaxMultiple     float64  `yaml:"size_max_multiple" env:"SQUIRRELUP_BACKUP_SIZE_MAX_MULTIPLE,overwrite" default:"4"`
+		Dedup               bool     `yaml:"dedup" env:"SQUIRRELUP_BACKUP_DEDUP,overwrite" default:"false"`
+		DedupCacheDir       string   `yaml:"dedup_cache_dir" env:"SQUIRRELUP_BACKUP_DEDUP_CACHE_DIR,overwrite" default:""`
+		KeepLocalDir        string   `yaml:"keep_local_dir" env:"SQUIRRELUP_BACKUP_KEEP_LOCAL_DIR,overwrite" default:""`
+		KeepLocalCleanup    bool     `yaml:"keep_local_cleanup" env:"SQUIRRELUP_BACKUP_KEEP_LOCAL_CLEANUP,overwrite" default:"false"`
+		Mirrors             []string `yaml:"mirrors" env:"SQUIRRELUP_BACKUP_MIRRORS,overwrite"`
+		MirrorConcurrency   int64    `yaml:"mirror_concurrency" env:"SQUIRRELUP_BACKUP_MIRROR_CONCURRENCY,overwrite" default:"1"`
+		MirrorPolicy        string   `yaml:"mirror_policy" env:"SQUIRRELUP_BACKUP_MIRROR_POLICY,overwrite" default:"all-must-succeed"`
+		JournalPath         string   `yaml:"journal_path" env:"SQUIRRELUP_BACKUP_JOURNAL_PATH,overwrite" default:""`
+		JournalMaxEntries   int64    `yaml:"journal_max_entries" env:"SQUIRRELUP_BACKUP_JOURNAL_MAX_ENTRIES,overwrite" default:"1000"`
+		Lease               bool     `yaml:"lease" env:"SQUIRRELUP_BACKUP_LEASE,overwrite" default:"false"`
+		LeaseTTLSeconds     float64  `yaml:"lease_ttl_seconds" env:"SQUIRRELUP_BACKUP_LEASE_TTL_SECONDS,overwrite" default:"600"`
+		LeaseWaitSeconds    float64  `yaml:"lease_wait_seconds" env:"SQUIRRELUP_BACKUP_LEASE_WAIT_SECONDS,overwrite" default:"0"`
+		ContentType         string   `yaml:"content_type" env:"SQUIRRELUP_BACKUP_CONTENT_TYPE,overwrite" default:""`
 	} `yaml:"backup"`
+	Progress struct {
+		Enabled        bool    `yaml:"enabled" env:"SQUIRRELUP_PROGRESS_ENABLED,overwrite" default:"true"`
+		Width          int64   `yaml:"width" env:"SQUIRRELUP_PROGRESS_WIDTH,overwrite" default:"0"`
+		Throttle       float64 `yaml:"throttle" env:"SQUIRRELUP_PROGRESS_THROTTLE,overwrite" default:"0"`
+		NoSizeEstimate bool    `yaml:"no_size_estimate" env:"SQUIRRELUP_PROGRESS_NO_SIZE_ESTIMATE,overwrite" default:"false"`
+	} `yaml:"progress"`
+	Performance struct {
+		BufferKB        int64   `yaml:"buffer_kb" env:"SQUIRRELUP_PERFORMANCE_BUFFER_KB,overwrite" default:"32"`
+		CacheListings   bool    `yaml:"cache_listings" env:"SQUIRRELUP_PERFORMANCE_CACHE_LISTINGS,overwrite" default:"true"`
+		CacheTTLSeconds float64 `yaml:"cache_ttl_seconds" env:"SQUIRRELUP_PERFORMANCE_CACHE_TTL_SECONDS,overwrite" default:"0"`
+	} `yaml:"performance"`
+	Retry struct {
+		MaxAttempts       int64   `yaml:"max_attempts" env:"SQUIRRELUP_RETRY_MAX_ATTEMPTS,overwrite" default:"1"`
+		BackoffSeconds    float64 `yaml:"backoff_seconds" env:"SQUIRRELUP_RETRY_BACKOFF_SECONDS,overwrite" default:"1"`
+		MaxBackoffSeconds float64 `yaml:"max_backoff_seconds" env:"SQUIRRELUP_RETRY_MAX_BACKOFF_SECONDS,overwrite" default:"30"`
+	} `yaml:"retry"`
+	Notify struct {
+		SMTPHost           string   `yaml:"smtp_host" env:"SQUIRRELUP_NOTIFY_SMTP_HOST,overwrite" default:""`
+		SMTPPort           int64    `yaml:"smtp_port" env:"SQUIRRELUP_NOTIFY_SMTP_PORT,overwrite" default:"587"`
+		SMTPSecurity       string   `yaml:"smtp_security" env:"SQUIRRELUP_NOTIFY_SMTP_SECURITY,overwrite" default:"starttls"`
+		SMTPUsername       string   `yaml:"smtp_username" env:"SQUIRRELUP_NOTIFY_SMTP_USERNAME,overwrite" default:""`
+		SMTPPassword       string   `yaml:"smtp_password" env:"SQUIRRELUP_NOTIFY_SMTP_PASSWORD,overwrite" default:""`
+		SMTPPasswordFile   string   `yaml:"smtp_password_file" env:"SQUIRRELUP_NOTIFY_SMTP_PASSWORD_FILE,overwrite" default:""`
+		SMTPFrom           string   `yaml:"smtp_from" env:"SQUIRRELUP_NOTIFY_SMTP_FROM,overwrite" default:""`
+		SMTPTo             []string `yaml:"smtp_to" env:"SQUIRRELUP_NOTIFY_SMTP_TO,overwrite"`
+		SMTPTimeoutSeconds float64  `yaml:"smtp_timeout_seconds" env:"SQUIRRELUP_NOTIFY_SMTP_TIMEOUT_SECONDS,overwrite" default:"30"`
+		OnlyOnFailure      bool     `yaml:"only_on_failure" env:"SQUIRRELUP_NOTIFY_ONLY_ON_FAILURE,overwrite" default:"false"`
+		LogLines           int64    `yaml:"log_lines" env:"SQUIRRELUP_NOTIFY_LOG_LINES,overwrite" default:"20"`
+	} `yaml:"notify"`
 	Internal struct {
 		Reporter ProgressReporter
+		// collects warnings of the run if set, see Warnings
+		Warnings *Warnings
+		// identifies the run in names of temporary files, see TempFileTag
+		TempFileTag string
+		// called with the path of every temporary file created for the run
+		TempFileCreated func(path string)
+		// passphrases of identity files are not prompted for
+		NoPrompt bool
+		// sources of configuration values by key, see Config.Source
+		Sources map[string]string
+		// unknown SQUIRRELUP_ environment variables fail LoadConfigFromEnv, see UnknownEnvVariables
+		StrictEnv bool
+		// storage backends are used by a long-running process, like the daemon, and only cache
+		// lookups and listings if performance.cache_ttl_seconds is set
+		LongRunning bool
 	}
 }
 
@@ -47,6 +191,16 @@ func setDefaultValueField(valueof reflect.Value, tag string) error {
 	// 		valueof.SetInt(intValue)
 	// 	}
 
+	case reflect.Bool:
+		if boolValue, err := strconv.ParseBool(tag); err == nil {
+			valueof.SetBool(boolValue)
+		}
+
+	case reflect.Int64:
+		if intValue, err := strconv.ParseInt(tag, 10, 64); err == nil {
+			valueof.SetInt(intValue)
+		}
+
 	case reflect.Float64:
 		if floatValue, err := strconv.ParseFloat(tag, 64); err == nil {
 			valueof.SetFloat(floatValue)
@@ -115,26 +269,282 @@ func (cfg *Config) SetDefaultValues() error {
 		return fmt.Errorf("SetDefaultValues called on a nil pointer")
 	}
 
+	cfg.Internal.Sources = nil
 	return setDefaultValuesStruct(valueof)
 }
 
 // LoadConfigFromFile loads configuration into a `Config` struct
-// from YAML file.
+// from YAML file. Fields set by the file are recorded, see Config.Source.
 func (cfg *Config) LoadConfigFromFile(file io.Reader) error {
-	decoder := yaml.NewDecoder(file)
-	err := decoder.Decode(cfg)
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return fmt.Errorf("LoadConfigFromFile failed: %s", err.Error())
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	err = decoder.Decode(cfg)
 	if err != nil {
 		return fmt.Errorf("LoadConfigFromFile failed: %s", err.Error())
 	}
+	cfg.recordFileSources(data)
 	return nil
 }
 
 // LoadConfigFromEnv loads configuration into a `Config` struct
-// from environment variables.
+// from environment variables. Fields set by the environment are recorded, see Config.Source.
+// Fails on unknown variables if `cfg.Internal.StrictEnv` is set.
 func (cfg *Config) LoadConfigFromEnv() error {
+	if cfg.Internal.StrictEnv {
+		if unknown := UnknownEnvVariables(os.Environ()); len(unknown) > 0 {
+			return fmt.Errorf("LoadConfigFromEnv failed: unknown environment variables %s", strings.Join(unknown, ", "))
+		}
+	}
 	err := envconfig.Process(context.Background(), cfg)
 	if err != nil {
 		return fmt.Errorf("LoadConfigFromEnv failed: %s", err.Error())
 	}
+	cfg.recordEnvSources()
+	return nil
+}
+
+// BackupLocation returns the time zone used for backup names and retention.
+// Accepts an IANA time zone name, "UTC" or "Local".
+func (cfg *Config) BackupLocation() (*time.Location, error) {
+	location, err := time.LoadLocation(cfg.Backup.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup timezone %q: %s", cfg.Backup.Timezone, err.Error())
+	}
+	return location, nil
+}
+
+// BackupName formats the name of a backup created at `now` in the configured time zone.
+func (cfg *Config) BackupName(now time.Time) (string, error) {
+	location, err := cfg.BackupLocation()
+	if err != nil {
+		return "", err
+	}
+	layout, err := cfg.NameLayout()
+	if err != nil {
+		return "", err
+	}
+	return now.In(location).Format(layout), nil
+}
+
+// BackupHostname returns the host name used to scope the output prefix.
+// Defaults to the host name reported by the kernel. The name is lowercased and
+// characters other than letters, digits, '-', '_' and '.' are replaced by '-'.
+func (cfg *Config) BackupHostname() (string, error) {
+	hostname := cfg.Backup.Hostname
+	if len(hostname) == 0 {
+		var err error
+		hostname, err = Hostname()
+		if err != nil {
+			return "", fmt.Errorf("could not determine host name: %s", err.Error())
+		}
+	}
+
+	sanitized := strings.Trim(strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '-'
+	}, strings.ToLower(strings.TrimSpace(hostname))), ".")
+	if len(sanitized) == 0 {
+		return "", fmt.Errorf("invalid backup hostname %q: empty after sanitization", hostname)
+	}
+	return sanitized, nil
+}
+
+// BackupMaxDuration returns the maximum duration of a backup, zero stands for no limit.
+func (cfg *Config) BackupMaxDuration() time.Duration {
+	return time.Duration(cfg.Backup.MaxDurationMinutes * float64(time.Minute))
+}
+
+// BufferSize returns the size in bytes of buffers used to copy data between stages, such as
+// encryption, hashing and downloads. A nil config uses the default size.
+func (cfg *Config) BufferSize() int {
+	if cfg == nil || cfg.Performance.BufferKB <= 0 {
+		return default_buffer_size
+	}
+	return int(cfg.Performance.BufferKB) * 1024
+}
+
+// BackupSchedule returns the schedule of the daemon mode. Cron expressions are
+// evaluated in the backup time zone.
+func (cfg *Config) BackupSchedule() (Schedule, error) {
+	if len(strings.TrimSpace(cfg.Backup.Schedule)) == 0 {
+		return nil, fmt.Errorf("no backup schedule configured")
+	}
+	location, err := cfg.BackupLocation()
+	if err != nil {
+		return nil, err
+	}
+	return ParseSchedule(cfg.Backup.Schedule, location)
+}
+
+// ProgressbarOptions returns progressbar options matching the progress configuration.
+// Zero width and throttle keep the progressbar defaults.
+func (cfg *Config) ProgressbarOptions() []progressbar.Option {
+	var options []progressbar.Option
+	if cfg.Progress.Width > 0 {
+		options = append(options, progressbar.OptionSetWidth(int(cfg.Progress.Width)))
+	}
+	if cfg.Progress.Throttle > 0 {
+		options = append(options, progressbar.OptionThrottle(time.Duration(cfg.Progress.Throttle*float64(time.Second))))
+	}
+	return options
+}
+
+// Validate checks that configuration values are consistent.
+func (cfg *Config) Validate() error {
+	if _, err := cfg.BackupLocation(); err != nil {
+		return err
+	}
+	if err := cfg.validateName(); err != nil {
+		return err
+	}
+	if len(cfg.Backup.ModeMask) > 0 {
+		if _, err := strconv.ParseUint(cfg.Backup.ModeMask, 8, 12); err != nil {
+			return fmt.Errorf("invalid backup mode mask %q, expecting an octal number", cfg.Backup.ModeMask)
+		}
+	}
+	if len(cfg.Backup.FileMode) > 0 {
+		if _, err := strconv.ParseUint(cfg.Backup.FileMode, 8, 9); err != nil {
+			return fmt.Errorf("invalid backup file mode %q, expecting an octal number up to 0777", cfg.Backup.FileMode)
+		}
+	}
+	if cfg.Backup.PerHostPrefix {
+		if _, err := cfg.BackupHostname(); err != nil {
+			return err
+		}
+	}
+	if len(cfg.S3.ProxyURL) > 0 {
+		if _, err := ParseProxyURL(cfg.S3.ProxyURL); err != nil {
+			return err
+		}
+	}
+	if len(cfg.S3.Endpoint) > 0 || len(cfg.S3.EndpointTemplate) > 0 {
+		if _, err := parseEndpointURL(b2Endpoint(cfg)); err != nil {
+			return err
+		}
+	}
+	if cfg.S3.MaxPartSizeBytes > 0 && cfg.S3.PartSizeBytes > cfg.S3.MaxPartSizeBytes {
+		return fmt.Errorf("part size of %d bytes exceeds the maximum part size of %d bytes", cfg.S3.PartSizeBytes, cfg.S3.MaxPartSizeBytes)
+	}
+	if cfg.S3.MaxBufferedParts < 0 {
+		return errors.New("number of buffered parts must not be negative")
+	}
+	if cfg.S3.CredentialSource != CredentialSourceConfig && cfg.S3.CredentialSource != CredentialSourceKeyring {
+		return fmt.Errorf("invalid credential source %q, expecting %q or %q", cfg.S3.CredentialSource, CredentialSourceConfig, CredentialSourceKeyring)
+	}
+	if len(cfg.S3.KeyringService) == 0 || len(cfg.S3.KeyringAccount) == 0 {
+		return errors.New("keyring service and account must not be empty")
+	}
+	if cfg.S3.StallTimeoutSeconds < 0 {
+		return errors.New("stall timeout must not be negative")
+	}
+	if len(strings.TrimSpace(cfg.Backup.Schedule)) > 0 {
+		if _, err := cfg.BackupSchedule(); err != nil {
+			return err
+		}
+	}
+	if cfg.Backup.ScheduleJitter < 0 || cfg.Backup.ShutdownGrace < 0 {
+		return errors.New("schedule jitter and shutdown grace must not be negative")
+	}
+	if cfg.Backup.MaxDurationMinutes < 0 {
+		return errors.New("maximum backup duration must not be negative")
+	}
+	if cfg.Backup.ReadConcurrency < 0 {
+		return errors.New("read concurrency must not be negative")
+	}
+	if cfg.Backup.SizeHistory < 0 {
+		return errors.New("size history must not be negative")
+	}
+	if cfg.Backup.SizeMinFraction < 0 || cfg.Backup.SizeMinFraction >= 1 {
+		return errors.New("minimum size fraction must be at least 0 and below 1")
+	}
+	if cfg.Backup.SizeMaxMultiple != 0 && cfg.Backup.SizeMaxMultiple <= 1 {
+		return errors.New("maximum size multiple must be 0 or above 1")
+	}
+	if cfg.Backup.Dedup && cfg.Backup.Passthrough {
+		return errors.New("deduplication does not apply to passthrough backups")
+	}
+	if _, err := splitCommandLine(cfg.Encryption.Command); err != nil {
+		return fmt.Errorf("could not parse encryption command: %s", err.Error())
+	}
+	if cfg.Backup.Dedup && len(cfg.Encryption.Command) > 0 {
+		return errors.New("deduplication does not support encryption commands")
+	}
+	if cfg.Backup.Dedup && len(cfg.Backup.KeepLocalDir) > 0 {
+		return errors.New("deduplicated backups cannot be kept locally")
+	}
+	if len(cfg.Backup.Mirrors) > 0 && cfg.Backup.Dedup {
+		return errors.New("deduplicated backups cannot be mirrored")
+	}
+	if len(cfg.Backup.Mirrors) > 0 && cfg.Backup.ObfuscateNames {
+		return errors.New("backups with obfuscated names cannot be mirrored")
+	}
+	if cfg.Backup.MirrorConcurrency < 1 {
+		return errors.New("mirror concurrency must be at least 1")
+	}
+	if cfg.Backup.JournalMaxEntries < 0 {
+		return errors.New("journal size must not be negative")
+	}
+	if cfg.Backup.LeaseTTLSeconds <= 0 || cfg.Backup.LeaseWaitSeconds < 0 {
+		return errors.New("lease TTL must be positive and lease wait must not be negative")
+	}
+	if len(cfg.Backup.ContentType) > 0 {
+		if _, _, err := mime.ParseMediaType(cfg.Backup.ContentType); err != nil {
+			return fmt.Errorf("invalid backup content type %q: %s", cfg.Backup.ContentType, err.Error())
+		}
+	}
+	if cfg.Backup.MirrorPolicy != MirrorPolicyAll && cfg.Backup.MirrorPolicy != MirrorPolicyAny {
+		return fmt.Errorf("invalid mirror policy %q, expecting %q or %q", cfg.Backup.MirrorPolicy, MirrorPolicyAll, MirrorPolicyAny)
+	}
+	if cfg.Backup.PassthroughMultiple != PassthroughMultipleReject && cfg.Backup.PassthroughMultiple != PassthroughMultipleIndividual {
+		return fmt.Errorf("invalid passthrough mode %q for multiple files, expecting %q or %q", cfg.Backup.PassthroughMultiple, PassthroughMultipleReject, PassthroughMultipleIndividual)
+	}
+	if cfg.Backup.CleanupConcurrency < 1 {
+		return errors.New("cleanup concurrency must be at least 1")
+	}
+	if cfg.Backup.CleanupRateLimit < 0 {
+		return errors.New("cleanup rate limit must not be negative")
+	}
+	if cfg.Backup.MaxDeletionsPerRun < 0 {
+		return errors.New("maximum number of deletions per run must not be negative")
+	}
+	if len(cfg.Encryption.PubkeyURL) > 0 {
+		if len(strings.TrimSpace(cfg.Encryption.Pubkey)) > 0 {
+			return errors.New("pubkey and pubkey URL are mutually exclusive")
+		}
+		if uri, err := url.Parse(cfg.Encryption.PubkeyURL); err != nil || uri.Scheme != "https" || len(uri.Host) == 0 {
+			return errors.New("pubkey URL must be an https:// URL")
+		}
+	}
+	if len(cfg.Encryption.PubkeyURLHash) > 0 {
+		if hash, err := hex.DecodeString(cfg.Encryption.PubkeyURLHash); err != nil || len(hash) != sha256.Size {
+			return errors.New("pubkey URL hash must be a hex-encoded SHA-256 digest")
+		}
+	}
+	if cfg.Performance.BufferKB < 1 || cfg.Performance.BufferKB > max_buffer_kb {
+		return fmt.Errorf("buffer size must be between 1 and %d KiB", max_buffer_kb)
+	}
+	if cfg.Performance.CacheTTLSeconds < 0 {
+		return errors.New("cache TTL must not be negative")
+	}
+	if err := cfg.validateSnapshot(); err != nil {
+		return err
+	}
+	if cfg.Retry.MaxAttempts < 1 {
+		return errors.New("maximum number of attempts must be at least 1")
+	}
+	if cfg.Retry.BackoffSeconds < 0 || cfg.Retry.MaxBackoffSeconds < 0 {
+		return errors.New("retry backoff must not be negative")
+	}
+	if err := cfg.validateNotify(); err != nil {
+		return err
+	}
+	if cfg.Progress.Width < 0 || cfg.Progress.Throttle < 0 {
+		return errors.New("progress width and throttle must not be negative")
+	}
 	return nil
 }
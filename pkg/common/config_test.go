@@ -1,6 +1,8 @@
 package common
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"reflect"
 	"strings"
@@ -30,9 +32,95 @@ func TestSetDefaultValuesValid(t *testing.T) {
 		assertEquals(t, "", cfg.S3.ID, "cfg.S3.ID")
 		assertEquals(t, "", cfg.S3.Secret, "cfg.S3.Secret")
 		assertEquals(t, "", cfg.S3.Token, "cfg.S3.Token")
+		assertEquals(t, int64(4), cfg.S3.MaxConcurrentDownloads, "cfg.S3.MaxConcurrentDownloads")
+		assertEquals(t, "", cfg.S3.RecoveryDir, "cfg.S3.RecoveryDir")
+		assertEquals(t, 900.0, cfg.S3.RequestTimeoutSeconds, "cfg.S3.RequestTimeoutSeconds")
+		assertEquals(t, 30.0, cfg.S3.ConnectTimeoutSeconds, "cfg.S3.ConnectTimeoutSeconds")
+		assertEquals(t, int64(16), cfg.S3.MaxIdleConns, "cfg.S3.MaxIdleConns")
+		assertEquals(t, int64(3), cfg.S3.MaxRetries, "cfg.S3.MaxRetries")
+		assertEquals(t, "", cfg.S3.ProxyURL, "cfg.S3.ProxyURL")
+		assertEquals(t, "", cfg.S3.Endpoint, "cfg.S3.Endpoint")
+		assertEquals(t, "", cfg.S3.EndpointTemplate, "cfg.S3.EndpointTemplate")
+		assertEquals(t, true, cfg.S3.PathStyle, "cfg.S3.PathStyle")
+		assertEquals(t, int64(104857600), cfg.S3.PartSizeBytes, "cfg.S3.PartSizeBytes")
+		assertEquals(t, int64(5368709120), cfg.S3.MaxPartSizeBytes, "cfg.S3.MaxPartSizeBytes")
+		assertEquals(t, false, cfg.S3.AssumeWriteOnly, "cfg.S3.AssumeWriteOnly")
+		assertEquals(t, int64(0), cfg.S3.MaxBufferedParts, "cfg.S3.MaxBufferedParts")
+		assertEquals(t, false, cfg.S3.DeleteAllVersions, "cfg.S3.DeleteAllVersions")
+		assertEquals(t, 120.0, cfg.S3.StallTimeoutSeconds, "cfg.S3.StallTimeoutSeconds")
+		assertEquals(t, CredentialSourceConfig, cfg.S3.CredentialSource, "cfg.S3.CredentialSource")
+		assertEquals(t, "squirrelup", cfg.S3.KeyringService, "cfg.S3.KeyringService")
+		assertEquals(t, "default", cfg.S3.KeyringAccount, "cfg.S3.KeyringAccount")
+		assertEquals(t, "", cfg.Backup.KeepLocalDir, "cfg.Backup.KeepLocalDir")
+		assertEquals(t, false, cfg.Backup.KeepLocalCleanup, "cfg.Backup.KeepLocalCleanup")
+		assertEquals(t, 0, len(cfg.Backup.Mirrors), "len(cfg.Backup.Mirrors)")
+		assertEquals(t, int64(1), cfg.Backup.MirrorConcurrency, "cfg.Backup.MirrorConcurrency")
+		assertEquals(t, MirrorPolicyAll, cfg.Backup.MirrorPolicy, "cfg.Backup.MirrorPolicy")
+		assertEquals(t, "", cfg.Backup.JournalPath, "cfg.Backup.JournalPath")
+		assertEquals(t, int64(1000), cfg.Backup.JournalMaxEntries, "cfg.Backup.JournalMaxEntries")
+		assertEquals(t, false, cfg.Backup.Lease, "cfg.Backup.Lease")
+		assertEquals(t, 600.0, cfg.Backup.LeaseTTLSeconds, "cfg.Backup.LeaseTTLSeconds")
+		assertEquals(t, 0.0, cfg.Backup.LeaseWaitSeconds, "cfg.Backup.LeaseWaitSeconds")
+		assertEquals(t, false, cfg.Backup.Xattrs, "cfg.Backup.Xattrs")
 		assertEquals(t, 240.0, cfg.Backup.Hours, "cfg.Backup.Hours")
 		assertEquals(t, "2006-01-02T15-0700", cfg.Backup.Name, "cfg.Backup.Name")
+		assertEquals(t, NameFormatGo, cfg.Backup.NameFormat, "cfg.Backup.NameFormat")
+		assertEquals(t, false, cfg.Backup.NameStrict, "cfg.Backup.NameStrict")
+		assertEquals(t, int64(1), cfg.Backup.MinSizeBytes, "cfg.Backup.MinSizeBytes")
+		assertEquals(t, int64(1), cfg.Backup.MinFiles, "cfg.Backup.MinFiles")
+		assertEquals(t, false, cfg.Backup.CleanupBestEffort, "cfg.Backup.CleanupBestEffort")
+		assertEquals(t, false, cfg.Backup.CleanupErrorsFatal, "cfg.Backup.CleanupErrorsFatal")
+		assertEquals(t, true, cfg.Progress.Enabled, "cfg.Progress.Enabled")
+		assertEquals(t, int64(0), cfg.Progress.Width, "cfg.Progress.Width")
+		assertEquals(t, float64(0), cfg.Progress.Throttle, "cfg.Progress.Throttle")
+		assertEquals(t, false, cfg.Progress.NoSizeEstimate, "cfg.Progress.NoSizeEstimate")
+		assertEquals(t, 0, len(cfg.ProgressbarOptions()), "len(cfg.ProgressbarOptions)")
+		assertEquals(t, int64(32), cfg.Performance.BufferKB, "cfg.Performance.BufferKB")
+		assertEquals(t, 32768, cfg.BufferSize(), "cfg.BufferSize")
+		assertEquals(t, true, cfg.Performance.CacheListings, "cfg.Performance.CacheListings")
+		assertEquals(t, 0.0, cfg.Performance.CacheTTLSeconds, "cfg.Performance.CacheTTLSeconds")
+		assertEquals(t, int64(1), cfg.Retry.MaxAttempts, "cfg.Retry.MaxAttempts")
+		assertEquals(t, 1.0, cfg.Retry.BackoffSeconds, "cfg.Retry.BackoffSeconds")
+		assertEquals(t, 30.0, cfg.Retry.MaxBackoffSeconds, "cfg.Retry.MaxBackoffSeconds")
+		assertEquals(t, "Local", cfg.Backup.Timezone, "cfg.Backup.Timezone")
+		assertEquals(t, false, cfg.Backup.SkipUnchanged, "cfg.Backup.SkipUnchanged")
+		assertEquals(t, false, cfg.Backup.FingerprintParanoid, "cfg.Backup.FingerprintParanoid")
+		assertEquals(t, "", cfg.Backup.Owner, "cfg.Backup.Owner")
+		assertEquals(t, "", cfg.Backup.Group, "cfg.Backup.Group")
+		assertEquals(t, "", cfg.Backup.ModeMask, "cfg.Backup.ModeMask")
+		assertEquals(t, true, cfg.Backup.NumericUIDGID, "cfg.Backup.NumericUIDGID")
+		assertEquals(t, false, cfg.Backup.PerHostPrefix, "cfg.Backup.PerHostPrefix")
+		assertEquals(t, "", cfg.Backup.Hostname, "cfg.Backup.Hostname")
+		assertEquals(t, 0, len(cfg.Backup.Exclude), "cfg.Backup.Exclude")
+		assertEquals(t, ".squirrelignore", cfg.Backup.IgnoreFileName, "cfg.Backup.IgnoreFileName")
+		assertEquals(t, false, cfg.Backup.ObfuscateNames, "cfg.Backup.ObfuscateNames")
+		assertEquals(t, "", cfg.Backup.NameKey, "cfg.Backup.NameKey")
+		assertEquals(t, "", cfg.Backup.Schedule, "cfg.Backup.Schedule")
+		assertEquals(t, 0.0, cfg.Backup.ScheduleJitter, "cfg.Backup.ScheduleJitter")
+		assertEquals(t, 300.0, cfg.Backup.ShutdownGrace, "cfg.Backup.ShutdownGrace")
+		assertEquals(t, 0.0, cfg.Backup.MaxDurationMinutes, "cfg.Backup.MaxDurationMinutes")
+		assertEquals(t, int64(0), cfg.Backup.ReadConcurrency, "cfg.Backup.ReadConcurrency")
+		assertEquals(t, false, cfg.Backup.Passthrough, "cfg.Backup.Passthrough")
+		assertEquals(t, "reject", cfg.Backup.PassthroughMultiple, "cfg.Backup.PassthroughMultiple")
+		assertEquals(t, false, cfg.Backup.IgnoreFileErrors, "cfg.Backup.IgnoreFileErrors")
+		assertEquals(t, true, cfg.Backup.Preflight, "cfg.Backup.Preflight")
+		assertEquals(t, int64(5), cfg.Backup.SizeHistory, "cfg.Backup.SizeHistory")
+		assertEquals(t, 0.5, cfg.Backup.SizeMinFraction, "cfg.Backup.SizeMinFraction")
+		assertEquals(t, 4.0, cfg.Backup.SizeMaxMultiple, "cfg.Backup.SizeMaxMultiple")
+		assertEquals(t, false, cfg.Backup.Dedup, "cfg.Backup.Dedup")
+		assertEquals(t, "", cfg.Backup.DedupCacheDir, "cfg.Backup.DedupCacheDir")
+		assertEquals(t, int64(1), cfg.Backup.CleanupConcurrency, "cfg.Backup.CleanupConcurrency")
+		assertEquals(t, 0.0, cfg.Backup.CleanupRateLimit, "cfg.Backup.CleanupRateLimit")
+		assertEquals(t, int64(0), cfg.Backup.MaxDeletionsPerRun, "cfg.Backup.MaxDeletionsPerRun")
+		assertEquals(t, "", cfg.Backup.ContentType, "cfg.Backup.ContentType")
 		assertEquals(t, "", cfg.Encryption.Pubkey, "cfg.Encryption.Pubkey")
+		assertEquals(t, false, cfg.Encryption.Required, "cfg.Encryption.Required")
+		assertEquals(t, false, cfg.Encryption.StrictKeyPerms, "cfg.Encryption.StrictKeyPerms")
+		assertEquals(t, "", cfg.Encryption.PubkeyURL, "cfg.Encryption.PubkeyURL")
+		assertEquals(t, "", cfg.Encryption.PubkeyURLHash, "cfg.Encryption.PubkeyURLHash")
+		assertEquals(t, "", cfg.Encryption.PubkeyCacheDir, "cfg.Encryption.PubkeyCacheDir")
+		assertEquals(t, "", cfg.Encryption.IdentityPassphraseFile, "cfg.Encryption.IdentityPassphraseFile")
+		assertEquals(t, "", cfg.Backup.FileMode, "cfg.Backup.FileMode")
 	}
 }
 
@@ -77,6 +165,9 @@ func TestLoadConfigFromFileValid(t *testing.T) {
 backup:
   hours: 0.1
   name: "test"
+  exclude:
+    - "*.tmp"
+    - "cache/"
 
 encryption:
   pubkey: "mock-pubkey"
@@ -92,6 +183,7 @@ encryption:
 		assertEquals(t, "mock-token", cfg.S3.Token, "cfg.S3.Token")
 		assertEquals(t, 0.1, cfg.Backup.Hours, "cfg.Backup.Hours")
 		assertEquals(t, "test", cfg.Backup.Name, "cfg.Backup.Name")
+		assertEquals(t, "[*.tmp cache/]", fmt.Sprint(cfg.Backup.Exclude), "cfg.Backup.Exclude")
 		assertEquals(t, "mock-pubkey", cfg.Encryption.Pubkey, "cfg.Encryption.Pubkey")
 	}
 }
@@ -119,6 +211,8 @@ func TestLoadConfigFromEnvValid(t *testing.T) {
 	os.Setenv("SQUIRRELUP_BACKUP_HOURS", "0.1")
 	os.Setenv("SQUIRRELUP_BACKUP_FILENAME", "test")
 	os.Setenv("SQUIRRELUP_PUBKEY", "mock-pubkey")
+	os.Setenv("SQUIRRELUP_BACKUP_EXCLUDE", "*.log,tmp/")
+	defer os.Setenv("SQUIRRELUP_BACKUP_EXCLUDE", "")
 
 	if err := cfg.LoadConfigFromEnv(); err != nil {
 		t.Fatalf(err.Error())
@@ -129,6 +223,7 @@ func TestLoadConfigFromEnvValid(t *testing.T) {
 		assertEquals(t, "mock-token", cfg.S3.Token, "cfg.S3.Token")
 		assertEquals(t, 0.1, cfg.Backup.Hours, "cfg.Backup.Hours")
 		assertEquals(t, "test", cfg.Backup.Name, "cfg.Backup.Name")
+		assertEquals(t, "[*.log tmp/]", fmt.Sprint(cfg.Backup.Exclude), "cfg.Backup.Exclude")
 		assertEquals(t, "mock-pubkey", cfg.Encryption.Pubkey, "cfg.Encryption.Pubkey")
 	}
 }
@@ -143,3 +238,367 @@ func TestLoadConfigFromEnvInvalid(t *testing.T) {
 		assertEquals(t, `LoadConfigFromEnv failed: Backup: Hours("invalid"): strconv.ParseFloat: parsing "invalid": invalid syntax`, err.Error(), "err.Error")
 	}
 }
+
+/* test cases for Validate */
+func TestValidateValid(t *testing.T) {
+	cfg := new(Config)
+	if err := cfg.SetDefaultValues(); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	for _, timezone := range []string{"Local", "UTC", "Asia/Kathmandu"} {
+		cfg.Backup.Timezone = timezone
+		if err := cfg.Validate(); err != nil {
+			t.Fatalf(err.Error())
+		}
+		location, err := cfg.BackupLocation()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		assertEquals(t, timezone, location.String(), "location.String")
+	}
+}
+
+func TestValidateInvalid(t *testing.T) {
+	cfg := new(Config)
+	if err := cfg.SetDefaultValues(); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	cfg.Backup.Timezone = "Mars/Olympus_Mons"
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("This test should throw an error")
+	} else {
+		assertEquals(t, `invalid backup timezone "Mars/Olympus_Mons": unknown time zone Mars/Olympus_Mons`, err.Error(), "err.Error")
+	}
+
+	cfg.Backup.Timezone = "UTC"
+	cfg.Backup.Name = "backup-%Y%m%d"
+	assertEquals(t, `backup name "backup-%Y%m%d" contains strftime directive %Y, use the Go layout "backup-20060102" or set backup.name_format to 'strftime'`, fmt.Sprintf("%v", cfg.Validate()), "err.Error")
+	cfg.Backup.NameFormat = NameFormatStrftime
+	assertEquals(t, nil, cfg.Validate(), "err")
+	cfg.Backup.Name, cfg.Backup.NameFormat = "2006-01-02T15-0700", NameFormatGo
+
+	cfg.Backup.ModeMask = "0789"
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("This test should throw an error")
+	} else {
+		assertEquals(t, `invalid backup mode mask "0789", expecting an octal number`, err.Error(), "err.Error")
+	}
+
+	cfg.Backup.ModeMask = ""
+	cfg.S3.ProxyURL = "socks4://proxy:1080"
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("This test should throw an error")
+	} else {
+		assertEquals(t, `invalid proxy URL "socks4://proxy:1080": unsupported scheme "socks4"`, err.Error(), "err.Error")
+	}
+
+	cfg.S3.ProxyURL = ""
+	cfg.S3.Endpoint = "minio:9000"
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("This test should throw an error")
+	} else {
+		assertEquals(t, `invalid endpoint URL "minio:9000": unsupported scheme "minio"`, err.Error(), "err.Error")
+	}
+
+	cfg.S3.Endpoint = ""
+	cfg.S3.EndpointTemplate = "{region}.example.com"
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("This test should throw an error")
+	} else {
+		assertEquals(t, `invalid endpoint URL ".example.com": unsupported scheme ""`, err.Error(), "err.Error")
+	}
+
+	cfg.S3.EndpointTemplate = ""
+	cfg.S3.PartSizeBytes = cfg.S3.MaxPartSizeBytes + 1
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("This test should throw an error")
+	} else {
+		assertEquals(t, `part size of 5368709121 bytes exceeds the maximum part size of 5368709120 bytes`, err.Error(), "err.Error")
+	}
+
+	cfg.S3.PartSizeBytes = 0
+	cfg.S3.MaxBufferedParts = -1
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("This test should throw an error")
+	} else {
+		assertEquals(t, "number of buffered parts must not be negative", err.Error(), "err.Error")
+	}
+
+	cfg.S3.MaxBufferedParts = 0
+	cfg.S3.StallTimeoutSeconds = -1
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("This test should throw an error")
+	} else {
+		assertEquals(t, "stall timeout must not be negative", err.Error(), "err.Error")
+	}
+
+	cfg.S3.StallTimeoutSeconds = 0
+	cfg.S3.CredentialSource = "vault"
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("This test should throw an error")
+	} else {
+		assertEquals(t, `invalid credential source "vault", expecting "config" or "keyring"`, err.Error(), "err.Error")
+	}
+
+	cfg.S3.CredentialSource, cfg.S3.KeyringAccount = CredentialSourceKeyring, ""
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("This test should throw an error")
+	} else {
+		assertEquals(t, "keyring service and account must not be empty", err.Error(), "err.Error")
+	}
+
+	cfg.S3.CredentialSource, cfg.S3.KeyringAccount = CredentialSourceConfig, "default"
+	cfg.Progress.Throttle = -1
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("This test should throw an error")
+	} else {
+		assertEquals(t, "progress width and throttle must not be negative", err.Error(), "err.Error")
+	}
+
+	cfg.Progress.Throttle = 0.5
+	cfg.Progress.Width = 40
+	assertEquals(t, 2, len(cfg.ProgressbarOptions()), "len(cfg.ProgressbarOptions)")
+
+	cfg.Backup.Schedule = "every day"
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("This test should throw an error")
+	} else {
+		assertEquals(t, `invalid schedule "every day": expecting a duration or a cron expression with 5 fields`, err.Error(), "err.Error")
+	}
+
+	cfg.Backup.Schedule = "6h"
+	cfg.Backup.ShutdownGrace = -1
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("This test should throw an error")
+	} else {
+		assertEquals(t, `schedule jitter and shutdown grace must not be negative`, err.Error(), "err.Error")
+	}
+
+	cfg.Backup.ShutdownGrace = 0
+	cfg.Backup.MaxDurationMinutes = -1
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("This test should throw an error")
+	} else {
+		assertEquals(t, `maximum backup duration must not be negative`, err.Error(), "err.Error")
+	}
+
+	cfg.Backup.MaxDurationMinutes = 0
+	cfg.Backup.ReadConcurrency = -1
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("This test should throw an error")
+	} else {
+		assertEquals(t, `read concurrency must not be negative`, err.Error(), "err.Error")
+	}
+	cfg.Backup.ReadConcurrency = 0
+	for _, testCase := range []struct {
+		history     int64
+		minFraction float64
+		maxMultiple float64
+		expected    string
+	}{
+		{-1, 0.5, 4, "size history must not be negative"},
+		{5, 1, 4, "minimum size fraction must be at least 0 and below 1"},
+		{5, -0.5, 4, "minimum size fraction must be at least 0 and below 1"},
+		{5, 0.5, 0.5, "maximum size multiple must be 0 or above 1"},
+	} {
+		cfg.Backup.SizeHistory, cfg.Backup.SizeMinFraction, cfg.Backup.SizeMaxMultiple = testCase.history, testCase.minFraction, testCase.maxMultiple
+		assertEquals(t, testCase.expected, fmt.Sprintf("%v", cfg.Validate()), "err.Error")
+	}
+	cfg.Backup.SizeHistory, cfg.Backup.SizeMinFraction, cfg.Backup.SizeMaxMultiple = 5, 0.5, 0
+	cfg.Backup.Dedup, cfg.Backup.Passthrough = true, true
+	assertEquals(t, "deduplication does not apply to passthrough backups", fmt.Sprintf("%v", cfg.Validate()), "err.Error")
+	cfg.Backup.Passthrough, cfg.Encryption.Command = false, "gpg --recipient 'Backup Key"
+	assertEquals(t, "could not parse encryption command: unterminated single quote", fmt.Sprintf("%v", cfg.Validate()), "err.Error")
+	cfg.Encryption.Command = "gpg --encrypt"
+	assertEquals(t, "deduplication does not support encryption commands", fmt.Sprintf("%v", cfg.Validate()), "err.Error")
+	cfg.Encryption.Command, cfg.Backup.KeepLocalDir = "", "/var/backups/local"
+	assertEquals(t, "deduplicated backups cannot be kept locally", fmt.Sprintf("%v", cfg.Validate()), "err.Error")
+	cfg.Backup.KeepLocalDir, cfg.Backup.Mirrors = "", []string{"b2://mirror/prefix/"}
+	assertEquals(t, "deduplicated backups cannot be mirrored", fmt.Sprintf("%v", cfg.Validate()), "err.Error")
+	cfg.Backup.Dedup, cfg.Backup.ObfuscateNames = false, true
+	assertEquals(t, "backups with obfuscated names cannot be mirrored", fmt.Sprintf("%v", cfg.Validate()), "err.Error")
+	cfg.Backup.ObfuscateNames, cfg.Backup.MirrorConcurrency = false, 0
+	assertEquals(t, "mirror concurrency must be at least 1", fmt.Sprintf("%v", cfg.Validate()), "err.Error")
+	cfg.Backup.MirrorConcurrency, cfg.Backup.MirrorPolicy = 1, "most"
+	assertEquals(t, `invalid mirror policy "most", expecting "all-must-succeed" or "any"`, fmt.Sprintf("%v", cfg.Validate()), "err.Error")
+	cfg.Backup.Mirrors, cfg.Backup.MirrorPolicy = nil, MirrorPolicyAll
+	cfg.Backup.JournalMaxEntries = -1
+	assertEquals(t, "journal size must not be negative", fmt.Sprintf("%v", cfg.Validate()), "err.Error")
+	cfg.Backup.JournalMaxEntries = 0
+	for _, testCase := range [][2]float64{{0, 0}, {600, -1}} {
+		cfg.Backup.LeaseTTLSeconds, cfg.Backup.LeaseWaitSeconds = testCase[0], testCase[1]
+		assertEquals(t, "lease TTL must be positive and lease wait must not be negative", fmt.Sprintf("%v", cfg.Validate()), "err.Error")
+	}
+	cfg.Backup.LeaseTTLSeconds, cfg.Backup.LeaseWaitSeconds = 600, 0
+	cfg.Backup.PassthroughMultiple = "prefix"
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("This test should throw an error")
+	} else {
+		assertEquals(t, `invalid passthrough mode "prefix" for multiple files, expecting "reject" or "individual"`, err.Error(), "err.Error")
+	}
+	cfg.Backup.PassthroughMultiple = PassthroughMultipleIndividual
+	cfg.Backup.CleanupConcurrency = 0
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("This test should throw an error")
+	} else {
+		assertEquals(t, `cleanup concurrency must be at least 1`, err.Error(), "err.Error")
+	}
+	cfg.Backup.CleanupConcurrency = 1
+	cfg.Backup.CleanupRateLimit = -1
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("This test should throw an error")
+	} else {
+		assertEquals(t, `cleanup rate limit must not be negative`, err.Error(), "err.Error")
+	}
+	cfg.Backup.CleanupRateLimit = 0
+	cfg.Backup.MaxDeletionsPerRun = -1
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("This test should throw an error")
+	} else {
+		assertEquals(t, `maximum number of deletions per run must not be negative`, err.Error(), "err.Error")
+	}
+	cfg.Backup.MaxDeletionsPerRun = 0
+	cfg.Backup.ContentType = "application/"
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("This test should throw an error")
+	} else {
+		assertEquals(t, `invalid backup content type "application/": mime: expected token after slash`, err.Error(), "err.Error")
+	}
+	cfg.Backup.ContentType = "application/x-tar; charset=binary"
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	cfg.Backup.ContentType = ""
+
+	for _, fileMode := range []string{"0689", "01777"} {
+		cfg.Backup.FileMode = fileMode
+		if err := cfg.Validate(); err == nil {
+			t.Fatalf("This test should throw an error")
+		} else {
+			assertEquals(t, fmt.Sprintf("invalid backup file mode %q, expecting an octal number up to 0777", fileMode), err.Error(), "err.Error")
+		}
+	}
+	cfg.Backup.FileMode = ""
+
+	for _, bufferKB := range []int64{0, 16*1024 + 1} {
+		cfg.Performance.BufferKB = bufferKB
+		if err := cfg.Validate(); err == nil {
+			t.Fatalf("This test should throw an error")
+		} else {
+			assertEquals(t, `buffer size must be between 1 and 16384 KiB`, err.Error(), "err.Error")
+		}
+	}
+	cfg.Performance.BufferKB = 1024
+	assertEquals(t, 1048576, cfg.BufferSize(), "cfg.BufferSize")
+	cfg.Performance.BufferKB = 32
+
+	cfg.Retry.MaxAttempts = 0
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("This test should throw an error")
+	} else {
+		assertEquals(t, `maximum number of attempts must be at least 1`, err.Error(), "err.Error")
+	}
+	cfg.Retry.MaxAttempts = 3
+	cfg.Retry.MaxBackoffSeconds = -1
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("This test should throw an error")
+	} else {
+		assertEquals(t, `retry backoff must not be negative`, err.Error(), "err.Error")
+	}
+	cfg.Retry.MaxBackoffSeconds = 30
+
+	cfg.Performance.CacheTTLSeconds = -1
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("This test should throw an error")
+	} else {
+		assertEquals(t, `cache TTL must not be negative`, err.Error(), "err.Error")
+	}
+	cfg.Performance.CacheTTLSeconds = 0
+
+	/* a nil config uses the default size */
+	var nilCfg *Config
+	assertEquals(t, 32768, nilCfg.BufferSize(), "nilCfg.BufferSize")
+
+	cfg.Encryption.Pubkey = "mock-pubkey"
+	cfg.Encryption.PubkeyURL = "https://example.com/recipients.txt"
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("This test should throw an error")
+	} else {
+		assertEquals(t, "pubkey and pubkey URL are mutually exclusive", err.Error(), "err.Error")
+	}
+	cfg.Encryption.Pubkey = ""
+
+	cfg.Encryption.PubkeyURL = "http://example.com/recipients.txt"
+	if err := cfg.Validate(); err == nil {
+		t.Fatalf("This test should throw an error")
+	} else {
+		assertEquals(t, "pubkey URL must be an https:// URL", err.Error(), "err.Error")
+	}
+	cfg.Encryption.PubkeyURL = "https://example.com/recipients.txt"
+
+	for _, hash := range []string{"0123", strings.Repeat("g", 64)} {
+		cfg.Encryption.PubkeyURLHash = hash
+		if err := cfg.Validate(); err == nil {
+			t.Fatalf("This test should throw an error")
+		} else {
+			assertEquals(t, "pubkey URL hash must be a hex-encoded SHA-256 digest", err.Error(), "err.Error")
+		}
+	}
+	cfg.Encryption.PubkeyURLHash = strings.Repeat("A", 64)
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	cfg.Backup.MaxDurationMinutes = 1.5
+	assertEquals(t, "1m30s", cfg.BackupMaxDuration().String(), "cfg.BackupMaxDuration")
+}
+
+/* test cases for BackupHostname */
+func TestBackupHostname(t *testing.T) {
+	cfg := new(Config)
+	if err := cfg.SetDefaultValues(); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Setup Test
+	Hostname = func() (string, error) {
+		return "Kernel-Host", nil
+	}
+	defer func() { Hostname = os.Hostname }()
+
+	// Perform the test
+	for _, testCase := range []struct{ hostname, expected string }{
+		{"", "kernel-host"},
+		{"web01", "web01"},
+		{" Web 01.lan ", "web-01.lan"},
+		{"a/b\\c:d*e", "a-b-c-d-e"},
+		{".hidden.", "hidden"},
+		{"büro", "b-ro"},
+	} {
+		cfg.Backup.Hostname = testCase.hostname
+		hostname, err := cfg.BackupHostname()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		assertEquals(t, testCase.expected, hostname, "BackupHostname("+testCase.hostname+")")
+	}
+
+	cfg.Backup.Hostname = "."
+	if _, err := cfg.BackupHostname(); err == nil {
+		t.Fatalf("This test should throw an error")
+	} else {
+		assertEquals(t, `invalid backup hostname ".": empty after sanitization`, err.Error(), "err.Error")
+	}
+
+	cfg.Backup.Hostname = ""
+	Hostname = func() (string, error) {
+		return "", errors.New("no host name")
+	}
+	if _, err := cfg.BackupHostname(); err == nil {
+		t.Fatalf("This test should throw an error")
+	} else {
+		assertEquals(t, `could not determine host name: no host name`, err.Error(), "err.Error")
+	}
+}
@@ -0,0 +1,189 @@
+package common
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type (
+	// ConfigField describes a configuration value and where it was set.
+	ConfigField struct {
+		// name of the field as in configuration files, like s3.region
+		Key string
+		// environment variable setting the field
+		Env string
+		// value formatted for display, secrets are redacted
+		Value string
+		// one of the ConfigSource constants
+		Source string
+	}
+
+	// configField locates a field of a configuration section.
+	configField struct {
+		key   string
+		env   string
+		value reflect.Value
+	}
+)
+
+const (
+	// ConfigSourceDefault marks configuration values that were not set.
+	ConfigSourceDefault = "default"
+	// ConfigSourceFile marks configuration values set by the configuration file.
+	ConfigSourceFile = "file"
+	// ConfigSourceEnv marks configuration values set by environment variables.
+	ConfigSourceEnv = "env"
+	// ConfigSourceFlag marks configuration values set by command line switches.
+	ConfigSourceFlag = "flag"
+	// ConfigSourceKeyring marks configuration values read from the keyring.
+	ConfigSourceKeyring = "keyring"
+
+	// prefix of environment variables read by SquirrelUp
+	env_prefix = "SQUIRRELUP_"
+	// displayed instead of secret configuration values
+	redacted_value = "<redacted>"
+)
+
+var (
+	// otherEnvVariables lists environment variables read by SquirrelUp that do not set fields of Config.
+	otherEnvVariables = []string{"SQUIRRELUP_NO_PROGRESS"}
+)
+
+// configFields lists the fields of the configuration sections of `cfg` in declaration order.
+func configFields(cfg *Config) []configField {
+	var fields []configField
+	valueof := reflect.ValueOf(cfg).Elem()
+	typeinfo := valueof.Type()
+
+	for i := 0; i < valueof.NumField(); i++ {
+		section, _, _ := strings.Cut(typeinfo.Field(i).Tag.Get("yaml"), ",")
+		if len(section) == 0 {
+			continue
+		}
+		sectionValue := valueof.Field(i)
+		sectionType := sectionValue.Type()
+		for j := 0; j < sectionValue.NumField(); j++ {
+			name, _, _ := strings.Cut(sectionType.Field(j).Tag.Get("yaml"), ",")
+			env, _, _ := strings.Cut(sectionType.Field(j).Tag.Get("env"), ",")
+			fields = append(fields, configField{section + "." + name, env, sectionValue.Field(j)})
+		}
+	}
+
+	return fields
+}
+
+// Source returns where the value of the configuration field `key`, like s3.region, was set.
+// Returns ConfigSourceDefault unless the value was set by a later load stage.
+func (cfg *Config) Source(key string) string {
+	if source, prs := cfg.Internal.Sources[key]; prs {
+		return source
+	}
+	return ConfigSourceDefault
+}
+
+// SetSource records that the value of the configuration field `key` was set by `source`.
+func (cfg *Config) SetSource(key, source string) {
+	if cfg.Internal.Sources == nil {
+		cfg.Internal.Sources = map[string]string{}
+	}
+	cfg.Internal.Sources[key] = source
+}
+
+// recordFileSources records the fields set by the YAML configuration `data`.
+func (cfg *Config) recordFileSources(data []byte) {
+	var present map[string]map[string]any
+	if err := yaml.Unmarshal(data, &present); err != nil {
+		return
+	}
+	for _, field := range configFields(cfg) {
+		section, name, _ := strings.Cut(field.key, ".")
+		if _, prs := present[section][name]; prs {
+			cfg.SetSource(field.key, ConfigSourceFile)
+		}
+	}
+}
+
+// recordEnvSources records the fields set by environment variables. Like LoadConfigFromEnv,
+// empty variables are treated as not set.
+func (cfg *Config) recordEnvSources() {
+	for _, field := range configFields(cfg) {
+		if len(os.Getenv(field.env)) > 0 {
+			cfg.SetSource(field.key, ConfigSourceEnv)
+		}
+	}
+}
+
+// Fields lists the configuration values along with where they were set. Credentials, secret
+// keys and passwords of proxy URLs are redacted.
+func (cfg *Config) Fields() []ConfigField {
+	var fields []ConfigField
+	for _, field := range configFields(cfg) {
+		fields = append(fields, ConfigField{
+			Key:    field.key,
+			Env:    field.env,
+			Value:  formatConfigValue(field.key, field.value),
+			Source: cfg.Source(field.key),
+		})
+	}
+	return fields
+}
+
+// formatConfigValue formats the value of the configuration field `key` for display.
+func formatConfigValue(key string, value reflect.Value) string {
+	switch key {
+	case "s3.id", "s3.secret", "s3.token", "backup.name_key", "notify.smtp_password":
+		if !value.IsZero() {
+			return redacted_value
+		}
+	case "s3.proxy_url":
+		if proxyUri, err := url.Parse(value.String()); err == nil {
+			return strconv.Quote(proxyUri.Redacted())
+		}
+	case "encryption.identity":
+		if strings.HasPrefix(value.String(), ageSecretKeyPrefix) {
+			return redacted_value
+		}
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		return strconv.Quote(value.String())
+	case reflect.Slice:
+		var items []string
+		for index := 0; index < value.Len(); index++ {
+			items = append(items, strconv.Quote(value.Index(index).String()))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	}
+	return fmt.Sprint(value.Interface())
+}
+
+// UnknownEnvVariables returns the sorted names of variables in `environ`, given like os.Environ,
+// that start with SQUIRRELUP_ but are not read by SquirrelUp, like misspelled ones. Empty
+// variables are ignored.
+func UnknownEnvVariables(environ []string) []string {
+	known := map[string]bool{}
+	for _, name := range otherEnvVariables {
+		known[name] = true
+	}
+	for _, field := range configFields(&Config{}) {
+		known[field.env] = true
+	}
+
+	var unknown []string
+	for _, variable := range environ {
+		name, value, _ := strings.Cut(variable, "=")
+		if strings.HasPrefix(name, env_prefix) && len(value) > 0 && !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
@@ -0,0 +1,448 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type (
+	// conformanceRun tracks objects created by RunBackendConformanceTests under a run prefix.
+	conformanceRun struct {
+		backend StorageBackend
+		prefix  *url.URL
+		lock    sync.Mutex
+		created []*url.URL
+	}
+
+	// conformanceCase is a behavior checked by RunBackendConformanceTests.
+	conformanceCase struct {
+		name string
+		run  func(t *testing.T, run *conformanceRun)
+	}
+)
+
+const (
+	// conformanceConcurrentStores is the number of objects stored at once by the concurrent
+	// case.
+	conformanceConcurrentStores = 4
+)
+
+var (
+	// ConformanceLargeObjectSize is the size of the object stored by the large upload case of
+	// RunBackendConformanceTests. It spans three parts of the minimum multipart part size, so
+	// backends configured with that part size upload it in parts.
+	ConformanceLargeObjectSize int64 = 2*multipart_upload_min_part_size + 1024
+
+	// conformanceCases lists behaviors checked by RunBackendConformanceTests.
+	conformanceCases = []conformanceCase{
+		{"StoreHeadListRemove", conformanceStoreHeadListRemove},
+		{"PrefixSemantics", conformancePrefixSemantics},
+		{"ListOrder", conformanceListOrder},
+		{"NotFound", conformanceNotFound},
+		{"Copy", conformanceCopy},
+		{"LargeUpload", conformanceLargeUpload},
+		{"ConcurrentStores", conformanceConcurrentStoresCase},
+		{"SpecialCharacters", conformanceSpecialCharacters},
+		{"BucketRoot", conformanceBucketRoot},
+		{"StreamedBody", conformanceStreamedBody},
+	}
+)
+
+// RunBackendConformanceTests checks that `backend` behaves as SquirrelUp expects from a
+// StorageBackend. Each behavior runs as a subtest on objects under a fresh prefix below
+// `baseURI`, which must end with a slash. Every object created is removed once the tests
+// finish, including after failed assertions.
+func RunBackendConformanceTests(t *testing.T, backend StorageBackend, baseURI *url.URL) {
+	t.Helper()
+
+	prefix, err := baseURI.Parse(fmt.Sprintf("squirrelup-conformance-%d/", Now().UnixNano()))
+	if err != nil {
+		t.Fatalf("could not construct the test prefix: %s", err.Error())
+	}
+	run := &conformanceRun{backend: backend, prefix: prefix}
+	t.Cleanup(func() { run.cleanup(t) })
+
+	for _, testCase := range conformanceCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			testCase.run(t, run)
+		})
+	}
+}
+
+// uri returns the URI of `key` under the run prefix, `key` is taken literally.
+func (run *conformanceRun) uri(t *testing.T, key string) *url.URL {
+	t.Helper()
+	return ResolveObjectURI(run.prefix, key)
+}
+
+// track records `uri` for removal once the tests finish.
+func (run *conformanceRun) track(uri *url.URL) {
+	run.lock.Lock()
+	defer run.lock.Unlock()
+	run.created = append(run.created, uri)
+}
+
+// store writes `data` under `key`, the object is removed once the tests finish.
+func (run *conformanceRun) store(t *testing.T, key string, data []byte) *url.URL {
+	uri := run.uri(t, key)
+	run.track(uri)
+	if err := run.backend.StoreFile(context.Background(), StoreRequest{URI: uri, BodyAt: bytes.NewReader(data), Length: int64(len(data))}); err != nil {
+		t.Fatalf("StoreFile(%q) failed: %s", uri, err.Error())
+	}
+	return uri
+}
+
+// cleanup removes objects created by the tests and any object left under the run prefix.
+func (run *conformanceRun) cleanup(t *testing.T) {
+	run.lock.Lock()
+	defer run.lock.Unlock()
+
+	remaining := map[string]*url.URL{}
+	for _, uri := range run.created {
+		remaining[uri.String()] = uri
+	}
+	if filelist, err := run.backend.ListFiles(run.prefix); err == nil {
+		for _, fileinfo := range filelist {
+			uri := ResolveObjectURI(run.prefix, "/"+fileinfo.Name())
+			remaining[uri.String()] = uri
+		}
+	}
+	for _, uri := range remaining {
+		if err := run.backend.RemoveFile(uri); err != nil && err.Error() != ErrFileNotFound {
+			t.Errorf("could not remove %q: %s", uri, err.Error())
+		}
+	}
+}
+
+// conformanceData returns `size` bytes of reproducible content.
+func conformanceData(size int64, seed int64) []byte {
+	data := make([]byte, size)
+	_, _ = rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// retrieve returns the content stored under `uri`.
+func (run *conformanceRun) retrieve(t *testing.T, uri *url.URL) []byte {
+	var buf bytes.Buffer
+	if err := run.backend.RetrieveFile(&buf, uri); err != nil {
+		t.Fatalf("RetrieveFile(%q) failed: %s", uri, err.Error())
+	}
+	return buf.Bytes()
+}
+
+// listKeys returns sorted base names of objects listed under `uri`.
+func (run *conformanceRun) listKeys(t *testing.T, uri *url.URL) []string {
+	filelist, err := run.backend.ListFiles(uri)
+	if err != nil {
+		t.Fatalf("ListFiles(%q) failed: %s", uri, err.Error())
+	}
+	var keys []string
+	for _, fileinfo := range filelist {
+		if !fileinfo.IsFile() {
+			t.Errorf("ListFiles(%q) returned %q, which is not a file", uri, fileinfo.Name())
+		}
+		keys = append(keys, path.Base(fileinfo.Name()))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func conformanceStoreHeadListRemove(t *testing.T, run *conformanceRun) {
+	data := conformanceData(1024, 1)
+	uri := run.store(t, "single/object", data)
+
+	fileinfo, err := run.backend.GetFileInfo(uri)
+	if err != nil {
+		t.Fatalf("GetFileInfo(%q) failed: %s", uri, err.Error())
+	}
+	if !fileinfo.IsFile() || fileinfo.Size() != uint64(len(data)) {
+		t.Errorf("GetFileInfo(%q) = file %v of %d bytes, expected a file of %d bytes", uri, fileinfo.IsFile(), fileinfo.Size(), len(data))
+	}
+	if fileinfo.Modified().IsZero() {
+		t.Errorf("GetFileInfo(%q) reported no modification time", uri)
+	}
+
+	keys := run.listKeys(t, run.uri(t, "single/"))
+	if len(keys) != 1 || keys[0] != "object" {
+		t.Errorf("ListFiles listed %v, expected [object]", keys)
+	}
+	if !bytes.Equal(data, run.retrieve(t, uri)) {
+		t.Errorf("RetrieveFile(%q) returned different content", uri)
+	}
+
+	if err = run.backend.RemoveFile(uri); err != nil {
+		t.Fatalf("RemoveFile(%q) failed: %s", uri, err.Error())
+	}
+	if _, err = run.backend.GetFileInfo(uri); err == nil || err.Error() != ErrFileNotFound {
+		t.Errorf("GetFileInfo(%q) after removal returned %v, expected %q", uri, err, ErrFileNotFound)
+	}
+	if keys = run.listKeys(t, run.uri(t, "single/")); len(keys) != 0 {
+		t.Errorf("ListFiles after removal listed %v, expected nothing", keys)
+	}
+}
+
+func conformanceSpecialCharacters(t *testing.T, run *conformanceRun) {
+	names := []string{"100% #1 + more.tar.gz", "query?key=value", "ünïcödé ✓"}
+	dirUri := run.uri(t, "Datenbank Sicherung/ü/")
+	for index, name := range names {
+		run.store(t, "Datenbank Sicherung/ü/"+name, conformanceData(int64(10+index), int64(10+index)))
+	}
+
+	/* keys are listed as they were stored */
+	expected := append([]string{}, names...)
+	sort.Strings(expected)
+	if keys := run.listKeys(t, dirUri); strings.Join(keys, "|") != strings.Join(expected, "|") {
+		t.Errorf("ListFiles(%q) listed %q, expected %q", dirUri, keys, expected)
+	}
+
+	/* URIs of listed objects address the stored objects */
+	filelist, err := run.backend.ListFiles(dirUri)
+	if err != nil {
+		t.Fatalf("ListFiles(%q) failed: %s", dirUri, err.Error())
+	}
+	for _, fileinfo := range filelist {
+		uri := fileinfo.URI()
+		stored, err := run.backend.GetFileInfo(uri)
+		if err != nil {
+			t.Fatalf("GetFileInfo(%q) of a listed object failed: %s", uri, err.Error())
+		}
+		if stored.Size() != fileinfo.Size() {
+			t.Errorf("GetFileInfo(%q) reported %d bytes, listed with %d bytes", uri, stored.Size(), fileinfo.Size())
+		}
+		if err = run.backend.RemoveFile(uri); err != nil {
+			t.Fatalf("RemoveFile(%q) of a listed object failed: %s", uri, err.Error())
+		}
+	}
+	for _, name := range names {
+		uri := run.uri(t, "Datenbank Sicherung/ü/"+name)
+		if _, err = run.backend.GetFileInfo(uri); err == nil || err.Error() != ErrFileNotFound {
+			t.Errorf("GetFileInfo(%q) after removal returned %v, expected %q", uri, err, ErrFileNotFound)
+		}
+	}
+}
+
+// listedAt returns the object listed under `uri` with the key `key`, nil if it is not listed.
+func (run *conformanceRun) listedAt(t *testing.T, uri *url.URL, key string) *FileInfo {
+	filelist, err := run.backend.ListFiles(uri)
+	if err != nil {
+		t.Fatalf("ListFiles(%q) failed: %s", uri, err.Error())
+	}
+	for index := range filelist {
+		if filelist[index].Name() == key {
+			return &filelist[index]
+		}
+	}
+	return nil
+}
+
+func conformanceBucketRoot(t *testing.T, run *conformanceRun) {
+	// the object is stored next to the run prefix, so it is told apart from other objects
+	key := path.Base(run.prefix.Path) + "-root"
+	data := conformanceData(512, 5)
+	uri := run.store(t, "/"+key, data)
+	rootUris := []*url.URL{
+		{Scheme: run.prefix.Scheme, User: run.prefix.User, Host: run.prefix.Host, Path: "/"},
+		{Scheme: run.prefix.Scheme, User: run.prefix.User, Host: run.prefix.Host},
+	}
+
+	/* keys of root-level objects have no leading slash */
+	fileinfo, err := run.backend.GetFileInfo(uri)
+	if err != nil {
+		t.Fatalf("GetFileInfo(%q) failed: %s", uri, err.Error())
+	}
+	if !fileinfo.IsFile() || fileinfo.Name() != key {
+		t.Errorf("GetFileInfo(%q) = file %v named %q, expected a file named %q", uri, fileinfo.IsFile(), fileinfo.Name(), key)
+	}
+	if !bytes.Equal(data, run.retrieve(t, uri)) {
+		t.Errorf("RetrieveFile(%q) returned different content", uri)
+	}
+
+	for _, rootUri := range rootUris {
+		/* the bucket root is a directory */
+		fileinfo, err = run.backend.GetFileInfo(rootUri)
+		if err != nil {
+			t.Fatalf("GetFileInfo(%q) failed: %s", rootUri, err.Error())
+		}
+		if fileinfo.IsFile() || fileinfo.Size() < uint64(len(data)) {
+			t.Errorf("GetFileInfo(%q) = file %v of %d bytes, expected a prefix of at least %d bytes", rootUri, fileinfo.IsFile(), fileinfo.Size(), len(data))
+		}
+
+		/* an empty prefix lists the whole bucket, URIs of listed objects address them */
+		listed := run.listedAt(t, rootUri, key)
+		if listed == nil {
+			t.Errorf("ListFiles(%q) did not list %q", rootUri, key)
+		} else if listed.URI().String() != uri.String() {
+			t.Errorf("ListFiles(%q) listed %q at %q, expected %q", rootUri, key, listed.URI(), uri)
+		}
+	}
+
+	if err = run.backend.RemoveFile(uri); err != nil {
+		t.Fatalf("RemoveFile(%q) failed: %s", uri, err.Error())
+	}
+	if _, err = run.backend.GetFileInfo(uri); err == nil || err.Error() != ErrFileNotFound {
+		t.Errorf("GetFileInfo(%q) after removal returned %v, expected %q", uri, err, ErrFileNotFound)
+	}
+	if listed := run.listedAt(t, rootUris[0], key); listed != nil {
+		t.Errorf("ListFiles(%q) after removal listed %q", rootUris[0], key)
+	}
+}
+
+func conformancePrefixSemantics(t *testing.T, run *conformanceRun) {
+	run.store(t, "dir/a", conformanceData(10, 2))
+	run.store(t, "dir/b", conformanceData(20, 3))
+	run.store(t, "dir-sibling", conformanceData(30, 4))
+
+	/* a trailing slash selects a directory prefix */
+	dirUri := run.uri(t, "dir/")
+	fileinfo, err := run.backend.GetFileInfo(dirUri)
+	if err != nil {
+		t.Fatalf("GetFileInfo(%q) failed: %s", dirUri, err.Error())
+	}
+	if fileinfo.IsFile() || fileinfo.Size() != 30 {
+		t.Errorf("GetFileInfo(%q) = file %v of %d bytes, expected a prefix of 30 bytes", dirUri, fileinfo.IsFile(), fileinfo.Size())
+	}
+	if keys := run.listKeys(t, dirUri); fmt.Sprint(keys) != "[a b]" {
+		t.Errorf("ListFiles(%q) listed %v, expected [a b]", dirUri, keys)
+	}
+
+	/* without a trailing slash keys are matched by their beginning */
+	if keys := run.listKeys(t, run.uri(t, "dir")); fmt.Sprint(keys) != "[a b dir-sibling]" {
+		t.Errorf("ListFiles(dir) listed %v, expected [a b dir-sibling]", keys)
+	}
+
+	/* a key is not a prefix of itself with a trailing slash */
+	if keys := run.listKeys(t, run.uri(t, "dir-sibling/")); len(keys) != 0 {
+		t.Errorf("ListFiles(dir-sibling/) listed %v, expected nothing", keys)
+	}
+}
+
+func conformanceListOrder(t *testing.T, run *conformanceRun) {
+	for i, key := range []string{"order/b", "order/a-2", "order/C", "order/a", "order/a/nested", "order/a-10"} {
+		run.store(t, key, conformanceData(10, int64(200+i)))
+	}
+
+	/* keys are listed in ascending order, regardless of the order they were stored in */
+	uri := run.uri(t, "order/")
+	filelist, err := run.backend.ListFiles(uri)
+	if err != nil {
+		t.Fatalf("ListFiles(%q) failed: %s", uri, err.Error())
+	}
+	var keys []string
+	for _, fileinfo := range filelist {
+		keys = append(keys, strings.TrimPrefix(fileinfo.Name(), strings.TrimPrefix(uri.Path, "/")))
+	}
+	if fmt.Sprint(keys) != "[C a a-10 a-2 a/nested b]" {
+		t.Errorf("ListFiles(%q) listed %v, expected [C a a-10 a-2 a/nested b]", uri, keys)
+	}
+}
+
+func conformanceNotFound(t *testing.T, run *conformanceRun) {
+	uri := run.uri(t, "missing")
+
+	if _, err := run.backend.GetFileInfo(uri); err == nil || err.Error() != ErrFileNotFound {
+		t.Errorf("GetFileInfo(%q) returned %v, expected %q", uri, err, ErrFileNotFound)
+	}
+	var buf bytes.Buffer
+	if err := run.backend.RetrieveFile(&buf, uri); err == nil || err.Error() != ErrFileNotFound {
+		t.Errorf("RetrieveFile(%q) returned %v, expected %q", uri, err, ErrFileNotFound)
+	}
+	// removing a missing object may succeed, S3 deletes without looking up the object first
+	if err := run.backend.RemoveFile(uri); err != nil && err.Error() != ErrFileNotFound {
+		t.Errorf("RemoveFile(%q) returned %v, expected %q or success", uri, err, ErrFileNotFound)
+	}
+	if keys := run.listKeys(t, run.uri(t, "missing/")); len(keys) != 0 {
+		t.Errorf("ListFiles(missing/) listed %v, expected nothing", keys)
+	}
+}
+
+func conformanceCopy(t *testing.T, run *conformanceRun) {
+	data := conformanceData(512, 5)
+	source := run.store(t, "copy/source", data)
+	destination := run.uri(t, "copy/destination")
+	run.track(destination)
+
+	if err := run.backend.CopyFile(source, destination); err != nil {
+		t.Fatalf("CopyFile(%q, %q) failed: %s", source, destination, err.Error())
+	}
+	if !bytes.Equal(data, run.retrieve(t, destination)) {
+		t.Errorf("RetrieveFile(%q) returned different content", destination)
+	}
+	if !bytes.Equal(data, run.retrieve(t, source)) {
+		t.Errorf("RetrieveFile(%q) returned different content after the copy", source)
+	}
+}
+
+func conformanceLargeUpload(t *testing.T, run *conformanceRun) {
+	data := conformanceData(ConformanceLargeObjectSize, 6)
+	uri := run.store(t, "large/object", data)
+
+	fileinfo, err := run.backend.GetFileInfo(uri)
+	if err != nil {
+		t.Fatalf("GetFileInfo(%q) failed: %s", uri, err.Error())
+	}
+	if fileinfo.Size() != uint64(len(data)) {
+		t.Errorf("GetFileInfo(%q) reported %d bytes, expected %d bytes", uri, fileinfo.Size(), len(data))
+	}
+	if !bytes.Equal(data, run.retrieve(t, uri)) {
+		t.Errorf("RetrieveFile(%q) returned different content", uri)
+	}
+}
+
+func conformanceStreamedBody(t *testing.T, run *conformanceRun) {
+	data := conformanceData(2048, 7)
+	uri := run.uri(t, "streamed/object")
+	run.track(uri)
+	err := run.backend.StoreFile(context.Background(), StoreRequest{URI: uri, Body: bytes.NewBuffer(data), Length: -1})
+	if err != nil {
+		t.Fatalf("StoreFile(%q) of a body of unknown length failed: %s", uri, err.Error())
+	}
+
+	fileinfo, err := run.backend.GetFileInfo(uri)
+	if err != nil {
+		t.Fatalf("GetFileInfo(%q) failed: %s", uri, err.Error())
+	}
+	if fileinfo.Size() != uint64(len(data)) {
+		t.Errorf("GetFileInfo(%q) reported %d bytes, expected %d bytes", uri, fileinfo.Size(), len(data))
+	}
+	if !bytes.Equal(data, run.retrieve(t, uri)) {
+		t.Errorf("RetrieveFile(%q) returned different content", uri)
+	}
+}
+
+func conformanceConcurrentStoresCase(t *testing.T, run *conformanceRun) {
+	var wg sync.WaitGroup
+	errs := make([]error, conformanceConcurrentStores)
+	uris := make([]*url.URL, conformanceConcurrentStores)
+	for i := range uris {
+		uris[i] = run.uri(t, fmt.Sprintf("concurrent/object-%d", i))
+		run.track(uris[i])
+	}
+	for i := range uris {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data := conformanceData(4096, int64(100+i))
+			errs[i] = run.backend.StoreFile(context.Background(), StoreRequest{URI: uris[i], BodyAt: bytes.NewReader(data), Length: int64(len(data))})
+		}(i)
+	}
+	wg.Wait()
+
+	for i, uri := range uris {
+		if errs[i] != nil {
+			t.Errorf("StoreFile(%q) failed: %s", uri, errs[i].Error())
+		} else if !bytes.Equal(conformanceData(4096, int64(100+i)), run.retrieve(t, uri)) {
+			t.Errorf("RetrieveFile(%q) returned different content", uri)
+		}
+	}
+	if keys := run.listKeys(t, run.uri(t, "concurrent/")); len(keys) != conformanceConcurrentStores {
+		t.Errorf("ListFiles(concurrent/) listed %v, expected %d objects", keys, conformanceConcurrentStores)
+	}
+}
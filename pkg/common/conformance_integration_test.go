@@ -0,0 +1,40 @@
+//go:build integration
+
+package common
+
+import (
+	"net/url"
+	"os"
+	"testing"
+)
+
+// TestBackendConformance runs the conformance tests against the backend for the base URI
+// given by SQUIRRELUP_CONFORMANCE_URI, configured from the environment like SquirrelUp itself.
+// Run with: go test -tags integration -run TestBackendConformance ./pkg/common
+func TestBackendConformance(t *testing.T) {
+	base := os.Getenv("SQUIRRELUP_CONFORMANCE_URI")
+	if base == "" {
+		t.Skip("SQUIRRELUP_CONFORMANCE_URI is not set")
+	}
+	baseUri, err := url.ParseRequestURI(base)
+	if err != nil {
+		t.Fatalf("could not parse SQUIRRELUP_CONFORMANCE_URI: %s", err.Error())
+	}
+
+	var cfg Config
+	if err = cfg.SetDefaultValues(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	// upload the large object in parts unless configured otherwise
+	cfg.S3.PartSizeBytes = multipart_upload_min_part_size
+	if err = cfg.LoadConfigFromEnv(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	cfg.Internal.Reporter = &DummyProgressReporter{}
+
+	backend, err := CreateStorageBackend(baseUri, &cfg)
+	if err != nil {
+		t.Fatalf("failed to create backend: %s", err.Error())
+	}
+	RunBackendConformanceTests(t, backend, baseUri)
+}
@@ -0,0 +1,42 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"testing"
+)
+
+/* test cases for RunBackendConformanceTests */
+func TestMemoryBackendConformance(t *testing.T) {
+	memory := NewMemoryBackend()
+	baseUri, _ := url.ParseRequestURI("memory://bucket/base/")
+
+	t.Run("Suite", func(t *testing.T) {
+		RunBackendConformanceTests(t, memory, baseUri)
+	})
+
+	// objects created by the suite are removed, including those at the bucket root
+	filelist, _ := memory.ListFiles(baseUri)
+	assertEquals(t, 0, len(filelist), "len(filelist)")
+	rootUri, _ := url.ParseRequestURI("memory://bucket/")
+	filelist, _ = memory.ListFiles(rootUri)
+	assertEquals(t, 0, len(filelist), "len(filelist)")
+}
+
+func TestConformanceCleanup(t *testing.T) {
+	// Setup Test
+	memory := NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/base/run/")
+	run := &conformanceRun{backend: memory, prefix: prefixUri}
+	run.store(t, "tracked", []byte("data"))
+	run.track(run.uri(t, "never-stored"))
+	untrackedUri := run.uri(t, "untracked")
+	_ = memory.StoreFile(context.Background(), StoreRequest{URI: untrackedUri, BodyAt: bytes.NewReader([]byte("data")), Length: 4})
+
+	// Perform the test
+	run.cleanup(t)
+
+	filelist, _ := memory.ListFiles(prefixUri)
+	assertEquals(t, 0, len(filelist), "len(filelist)")
+}
@@ -0,0 +1,46 @@
+package common
+
+import (
+	"io"
+)
+
+type (
+	// consoleModeSwitcher is implemented by consoles whose output mode can be queried and changed,
+	// like the Windows console.
+	consoleModeSwitcher interface {
+		ConsoleMode() (uint32, error)
+		SetConsoleMode(uint32) error
+	}
+)
+
+const (
+	// enable_virtual_terminal_processing is the console output mode that makes the Windows
+	// console interpret ANSI escape sequences instead of printing them.
+	enable_virtual_terminal_processing uint32 = 0x0004
+)
+
+var (
+	// outputConsole returns the console behind `output` if its mode has to be switched before
+	// writing ANSI escape sequences, nil otherwise. Can be overridden in tests.
+	outputConsole func(output io.Writer) consoleModeSwitcher = platformOutputConsole
+)
+
+// enableVirtualTerminal switches `console` to interpret ANSI escape sequences. Returns false
+// if the console does not support them, like cmd.exe before Windows 10.
+func enableVirtualTerminal(console consoleModeSwitcher) bool {
+	mode, err := console.ConsoleMode()
+	if err != nil {
+		return false
+	}
+	if mode&enable_virtual_terminal_processing != 0 {
+		return true
+	}
+	return console.SetConsoleMode(mode|enable_virtual_terminal_processing) == nil
+}
+
+// supportsAnsi returns true if ANSI escape sequences written to `output` move the cursor
+// instead of garbling the output, enabling them on consoles that need it.
+func supportsAnsi(output io.Writer) bool {
+	console := outputConsole(output)
+	return console == nil || enableVirtualTerminal(console)
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+
+package common
+
+import (
+	"io"
+)
+
+// platformOutputConsole returns nil, terminals interpret ANSI escape sequences without
+// switching modes on this platform.
+func platformOutputConsole(output io.Writer) consoleModeSwitcher {
+	return nil
+}
@@ -0,0 +1,82 @@
+package common
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+// fakeConsole records output mode changes like a Windows console.
+type fakeConsole struct {
+	mode    uint32
+	getErr  error
+	setErr  error
+	setMode []uint32
+}
+
+func (console *fakeConsole) ConsoleMode() (uint32, error) {
+	return console.mode, console.getErr
+}
+
+func (console *fakeConsole) SetConsoleMode(mode uint32) error {
+	console.setMode = append(console.setMode, mode)
+	if console.setErr != nil {
+		return console.setErr
+	}
+	console.mode = mode
+	return nil
+}
+
+// helper function: make `console` the console behind every output for the duration of the test.
+func setOutputConsole(t *testing.T, console consoleModeSwitcher) {
+	outputConsole = func(io.Writer) consoleModeSwitcher { return console }
+	t.Cleanup(func() { outputConsole = platformOutputConsole })
+}
+
+/* test cases for enableVirtualTerminal */
+func TestEnableVirtualTerminal(t *testing.T) {
+	/* virtual terminal processing is added to the current mode */
+	console := &fakeConsole{mode: 0x0003}
+	assertEquals(t, true, enableVirtualTerminal(console), "enableVirtualTerminal")
+	assertEquals(t, 1, len(console.setMode), "len(setMode)")
+	assertEquals(t, uint32(0x0007), console.setMode[0], "setMode[0]")
+
+	/* consoles processing escape sequences already are left alone */
+	console = &fakeConsole{mode: 0x0007}
+	assertEquals(t, true, enableVirtualTerminal(console), "enableVirtualTerminal")
+	assertEquals(t, 0, len(console.setMode), "len(setMode)")
+
+	/* consoles without virtual terminal processing refuse the mode */
+	console = &fakeConsole{mode: 0x0003, setErr: errors.New("invalid parameter")}
+	assertEquals(t, false, enableVirtualTerminal(console), "enableVirtualTerminal")
+
+	/* the mode cannot be read */
+	console = &fakeConsole{getErr: errors.New("invalid handle")}
+	assertEquals(t, false, enableVirtualTerminal(console), "enableVirtualTerminal")
+	assertEquals(t, 0, len(console.setMode), "len(setMode)")
+}
+
+/* test cases for NewProgressReporter on consoles */
+func TestNewProgressReporterConsole(t *testing.T) {
+	// Setup Test
+	var cfg Config
+	if err := cfg.SetDefaultValues(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	t.Setenv("SQUIRRELUP_NO_PROGRESS", "")
+	t.Setenv("NO_COLOR", "")
+	t.Setenv("TERM", "xterm")
+
+	// Perform the test
+	/* progressbars are displayed once escape sequences are enabled */
+	console := &fakeConsole{}
+	setOutputConsole(t, console)
+	_, ok := NewProgressReporter(io.Discard, &cfg).(*MultiProgressbarReporter)
+	assertEquals(t, true, ok, "MultiProgressbarReporter")
+	assertEquals(t, enable_virtual_terminal_processing, console.mode, "console.mode")
+
+	/* plain text is displayed if they cannot be enabled */
+	setOutputConsole(t, &fakeConsole{setErr: errors.New("invalid parameter")})
+	_, ok = NewProgressReporter(io.Discard, &cfg).(*PlainProgressReporter)
+	assertEquals(t, true, ok, "PlainProgressReporter")
+}
@@ -0,0 +1,39 @@
+//go:build windows
+
+package common
+
+import (
+	"io"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// windowsConsole is a Windows console given by its handle.
+type windowsConsole windows.Handle
+
+// ConsoleMode returns the output mode of the console.
+func (console windowsConsole) ConsoleMode() (uint32, error) {
+	var mode uint32
+	err := windows.GetConsoleMode(windows.Handle(console), &mode)
+	return mode, err
+}
+
+// SetConsoleMode sets the output mode of the console.
+func (console windowsConsole) SetConsoleMode(mode uint32) error {
+	return windows.SetConsoleMode(windows.Handle(console), mode)
+}
+
+// platformOutputConsole returns the console behind `output`, nil if it is a file or a pipe,
+// which receive escape sequences as they are on every platform.
+func platformOutputConsole(output io.Writer) consoleModeSwitcher {
+	file, ok := output.(*os.File)
+	if !ok {
+		return nil
+	}
+	var mode uint32
+	if windows.GetConsoleMode(windows.Handle(file.Fd()), &mode) != nil {
+		return nil
+	}
+	return windowsConsole(file.Fd())
+}
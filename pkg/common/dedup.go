@@ -0,0 +1,622 @@
+package common
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+)
+
+type (
+	// chunkSizes bounds the size of chunks cut by a chunker, the average size must be a power of two.
+	chunkSizes struct {
+		min, avg, max int
+	}
+
+	// chunker splits a stream into content-defined chunks in the way of FastCDC: a gear hash
+	// rolls over the input and a chunk ends where the hash matches a mask. A stricter mask
+	// below the average size and a looser one above it keep chunk sizes close to the average.
+	// Inserting or removing data only changes the chunks around the edit.
+	chunker struct {
+		input        io.Reader
+		sizes        chunkSizes
+		maskS, maskL uint64
+		buf          []byte
+		start, end   int
+		eof          bool
+	}
+
+	// dedupManifest lists the chunks of a deduplicated backup in the order of the TAR stream.
+	dedupManifest struct {
+		Version int `json:"version"`
+		// size of the uncompressed TAR stream
+		Size   int64        `json:"size"`
+		Chunks []dedupChunk `json:"chunks"`
+		// digests of the chunks of an encrypted backup, one per line in the order of Chunks,
+		// encrypted for its recipients, see sealDigests
+		Digests []byte `json:"digests,omitempty"`
+	}
+
+	// dedupChunk is a chunk of a deduplicated backup.
+	dedupChunk struct {
+		// name of the chunk object relative to the manifest
+		Key string `json:"key"`
+		// hex encoded SHA-256 digest of the uncompressed chunk, only kept in the Digests of
+		// the manifest for encrypted chunks
+		Hash string `json:"hash,omitempty"`
+		Size int64  `json:"size"`
+	}
+
+	// chunkIndex holds the keys of chunks stored under a prefix.
+	chunkIndex map[string]bool
+
+	// nopWriteCloser adds a Close method doing nothing to a writer.
+	nopWriteCloser struct {
+		io.Writer
+	}
+
+	// limitedWriter fails writes beyond `remaining` bytes.
+	limitedWriter struct {
+		io.Writer
+		remaining int64
+	}
+)
+
+const (
+	// DedupManifestSuffix is appended to the backup name to form the name of the manifest
+	// describing a deduplicated backup, see Config.Backup.Dedup.
+	DedupManifestSuffix = ".tar.chunks.json"
+	// DedupChunkPrefix is the directory next to the manifests holding the chunks of deduplicated backups.
+	DedupChunkPrefix = "chunks/"
+
+	// extension of chunk objects, before the extension added by encryption
+	dedup_chunk_suffix = ".chunk"
+
+	dedup_manifest_version = 1
+	// kind of the state file caching the chunks stored under a prefix
+	dedup_index_kind = "chunks"
+	// unreferenced chunks younger than this may belong to a backup still being stored
+	dedup_chunk_grace = 24 * time.Hour
+	// manifests are read into memory, larger objects are rejected
+	max_dedup_manifest_size = 64 << 20
+)
+
+var (
+	// dedupChunkSizes bounds the size of chunks of deduplicated backups, can be overridden in
+	// tests.
+	dedupChunkSizes = chunkSizes{min: 256 << 10, avg: 1 << 20, max: 4 << 20}
+
+	// gearTable maps bytes to the random values rolled into the chunker hash. The values are
+	// derived from a fixed seed, since changing them moves all chunk boundaries.
+	gearTable = func() (table [256]uint64) {
+		// splitmix64
+		var state uint64 = 0x5371756972726c55
+		for index := range table {
+			state += 0x9e3779b97f4a7c15
+			value := state
+			value = (value ^ (value >> 30)) * 0xbf58476d1ce4e5b9
+			value = (value ^ (value >> 27)) * 0x94d049bb133111eb
+			table[index] = value ^ (value >> 31)
+		}
+		return
+	}()
+)
+
+// IsDedupManifest returns true for names of manifests of deduplicated backups.
+func IsDedupManifest(name string) bool {
+	return strings.HasSuffix(name, DedupManifestSuffix)
+}
+
+// IsChunkObject returns true for names of chunks of deduplicated backups, which are named
+// after the SHA-256 digest of their contents, see chunkName.
+func IsChunkObject(key string) bool {
+	hash, found := strings.CutSuffix(strings.TrimSuffix(key, AgeFileSuffix), dedup_chunk_suffix)
+	if !found || len(hash) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil && strings.ToLower(hash) == hash
+}
+
+// newChunker returns a chunker splitting `input` into chunks bounded by `sizes`.
+func newChunker(input io.Reader, sizes chunkSizes) *chunker {
+	avgBits := bits.Len(uint(sizes.avg)) - 1
+	return &chunker{
+		input: input,
+		sizes: sizes,
+		maskS: ^uint64(0) << (64 - (avgBits + 1)),
+		maskL: ^uint64(0) << (64 - max(avgBits-1, 1)),
+		buf:   make([]byte, sizes.max),
+	}
+}
+
+// Next returns the next chunk of the input, which is valid until the following call. Returns
+// io.EOF once the input is exhausted.
+func (c *chunker) Next() ([]byte, error) {
+	if c.start > 0 {
+		c.end = copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+	}
+	for !c.eof && c.end < len(c.buf) {
+		n, err := c.input.Read(c.buf[c.end:])
+		c.end += n
+		if err == io.EOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if c.end == 0 {
+		return nil, io.EOF
+	}
+	c.start = c.cutPoint(c.buf[:c.end])
+	return c.buf[:c.start], nil
+}
+
+// cutPoint returns the length of the chunk starting at `data`, which holds the rest of the
+// input or at least the maximum chunk size.
+func (c *chunker) cutPoint(data []byte) int {
+	length := min(len(data), c.sizes.max)
+	if length <= c.sizes.min {
+		return length
+	}
+	normal := min(length, c.sizes.avg)
+	var hash uint64
+	index := c.sizes.min
+	for ; index < normal; index++ {
+		hash = (hash << 1) + gearTable[data[index]]
+		if hash&c.maskS == 0 {
+			return index + 1
+		}
+	}
+	for ; index < length; index++ {
+		hash = (hash << 1) + gearTable[data[index]]
+		if hash&c.maskL == 0 {
+			return index + 1
+		}
+	}
+	return length
+}
+
+// chunkName returns the name of a chunk with the SHA-256 digest `sum`. It is the hex encoded
+// digest, or an HMAC of it keyed with `key` if set, so that the names of encrypted chunks do
+// not tell whether some known data is stored.
+func chunkName(sum [sha256.Size]byte, key []byte) string {
+	if len(key) == 0 {
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write(sum[:])
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// chunkKey returns the name of the object storing a chunk named `hash`, see chunkName.
+func chunkKey(hash string, encrypted bool) string {
+	if encrypted {
+		return DedupChunkPrefix + hash + dedup_chunk_suffix + AgeFileSuffix
+	}
+	return DedupChunkPrefix + hash + dedup_chunk_suffix
+}
+
+// encodeChunk compresses `data` and encrypts it for `recipients`, if any.
+func encodeChunk(data []byte, recipients []age.Recipient) ([]byte, error) {
+	var encoded bytes.Buffer
+	var output io.WriteCloser = nopWriteCloser{&encoded}
+	var err error
+	if len(recipients) > 0 {
+		output, err = age.Encrypt(&encoded, recipients...)
+		if err != nil {
+			return nil, fmt.Errorf("could not encrypt chunk: %s", err.Error())
+		}
+	}
+	gz := gzip.NewWriter(output)
+	if _, err = gz.Write(data); err == nil {
+		err = gz.Close()
+	}
+	if err == nil {
+		err = output.Close()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not encode chunk: %s", err.Error())
+	}
+	return encoded.Bytes(), nil
+}
+
+// decodeChunk reverses encodeChunk for the stored `chunk` and verifies its digest.
+func decodeChunk(data []byte, chunk dedupChunk, identities []age.Identity) ([]byte, error) {
+	var input io.Reader = bytes.NewReader(data)
+	if strings.HasSuffix(chunk.Key, AgeFileSuffix) {
+		plaintext, err := DecryptStream(input, identities)
+		if err != nil {
+			return nil, fmt.Errorf("could not decrypt chunk %q: %s", chunk.Key, err.Error())
+		}
+		input = plaintext
+	}
+	gz, err := gzip.NewReader(input)
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress chunk %q: %s", chunk.Key, err.Error())
+	}
+	decoded, err := io.ReadAll(io.LimitReader(gz, chunk.Size+1))
+	if err != nil {
+		return nil, fmt.Errorf("could not decompress chunk %q: %s", chunk.Key, err.Error())
+	}
+	sum := sha256.Sum256(decoded)
+	if int64(len(decoded)) != chunk.Size || hex.EncodeToString(sum[:]) != chunk.Hash {
+		return nil, fmt.Errorf("chunk %q is corrupted: %s", chunk.Key, ErrChecksumMismatch)
+	}
+	return decoded, nil
+}
+
+// sealDigests moves the digests of the chunks of `manifest` into its Digests, encrypted for
+// `recipients`.
+func (manifest *dedupManifest) sealDigests(recipients []age.Recipient) error {
+	hashes := make([]string, len(manifest.Chunks))
+	for index := range manifest.Chunks {
+		hashes[index] = manifest.Chunks[index].Hash
+		manifest.Chunks[index].Hash = ""
+	}
+	var sealed bytes.Buffer
+	encryptedWriter, err := age.Encrypt(&sealed, recipients...)
+	if err == nil {
+		_, err = io.WriteString(encryptedWriter, strings.Join(hashes, "\n"))
+	}
+	if err == nil {
+		err = encryptedWriter.Close()
+	}
+	if err != nil {
+		return fmt.Errorf("could not encrypt chunk digests: %s", err.Error())
+	}
+	manifest.Digests = sealed.Bytes()
+	return nil
+}
+
+// openDigests decrypts the Digests of `manifest` with `identities` and restores the digests of
+// its chunks.
+func (manifest *dedupManifest) openDigests(identities []age.Identity) error {
+	plaintext, err := DecryptStream(bytes.NewReader(manifest.Digests), identities)
+	if err != nil {
+		return fmt.Errorf("could not decrypt chunk digests: %s", err.Error())
+	}
+	data, err := io.ReadAll(plaintext)
+	if err != nil {
+		return fmt.Errorf("could not decrypt chunk digests: %s", err.Error())
+	}
+	hashes := strings.Split(string(data), "\n")
+	if len(hashes) != len(manifest.Chunks) {
+		return fmt.Errorf("manifest lists %d chunks, but %d digests", len(manifest.Chunks), len(hashes))
+	}
+	for index, hash := range hashes {
+		manifest.Chunks[index].Hash = hash
+	}
+	return nil
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// manifestDirectory returns the prefix holding the manifest `uri`, chunk keys are relative to it.
+func manifestDirectory(uri *url.URL) *url.URL {
+	return &url.URL{Scheme: uri.Scheme, User: uri.User, Host: uri.Host, Path: strings.TrimSuffix(path.Dir(uri.Path), "/") + "/"}
+}
+
+// dedupIndexPath returns the path of the file caching the chunks stored under `prefix`,
+// located in `cfg.Backup.DedupCacheDir` or the user cache directory.
+func dedupIndexPath(cfg *Config, prefix *url.URL) (string, error) {
+	cacheDir := cfg.Backup.DedupCacheDir
+	if len(cacheDir) == 0 {
+		userCacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return "", err
+		}
+		cacheDir = filepath.Join(userCacheDir, "squirrelup")
+	}
+	sum := sha256.Sum256([]byte(prefix.String()))
+	return filepath.Join(cacheDir, dedup_index_kind+"-"+hex.EncodeToString(sum[:8])), nil
+}
+
+// loadChunkIndex reads the chunk index cached at `indexPath`, missing or unreadable files
+// result in an empty index.
+func loadChunkIndex(indexPath string) chunkIndex {
+	index := chunkIndex{}
+	raw, err := os.ReadFile(filepath.Clean(indexPath))
+	if err != nil {
+		return index
+	}
+	data, err := DecodeStateFile(dedup_index_kind, raw)
+	if err != nil {
+		return index
+	}
+	for _, key := range strings.Split(string(data), "\n") {
+		if len(key) > 0 {
+			index[key] = true
+		}
+	}
+	return index
+}
+
+// save replaces the chunk index cached at `indexPath`.
+func (index chunkIndex) save(indexPath string, cfg *Config) error {
+	keys := make([]string, 0, len(index))
+	for key := range index {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if err := os.MkdirAll(filepath.Dir(indexPath), 0700); err != nil {
+		return err
+	}
+	return AtomicWriteFile(indexPath, EncodeStateFile(dedup_index_kind, []byte(strings.Join(keys, "\n"))), cfg.FileMode(StateFile))
+}
+
+// listChunks returns the index of chunks stored under `prefix`. The `cached` index is
+// returned along with the error if the chunks cannot be listed, like with write-only
+// credentials. Its chunks may have been removed by a cleanup since, see chunkStored.
+func listChunks(backend StorageBackend, prefix *url.URL, cached chunkIndex) (chunkIndex, error) {
+	filelist, err := backend.ListFiles(ResolveObjectURI(prefix, DedupChunkPrefix))
+	if err != nil {
+		return cached, err
+	}
+	index := chunkIndex{}
+	for _, fileinfo := range filelist {
+		if key := path.Base(fileinfo.Name()); fileinfo.IsFile() && IsChunkObject(key) {
+			index[DedupChunkPrefix+key] = true
+		}
+	}
+	return index, nil
+}
+
+// chunkStored tells whether the chunk `key` is still stored under `prefix`. Chunks that cannot
+// be looked up are assumed to be missing.
+func chunkStored(backend StorageBackend, prefix *url.URL, key string) bool {
+	_, err := backend.GetFileInfo(ResolveObjectURI(prefix, key))
+	return err == nil
+}
+
+// storeDedupArchive splits the TAR stream of the gzip-compressed archive at `archivePath` into
+// chunks and uploads those not stored next to `object.Object` yet, each compressed and encrypted
+// for `recipients` on its own. Encrypted chunks are named with `opts.ChunkKey`. The manifest
+// listing the chunks is stored at `object.Object`, the digests of encrypted chunks are only
+// stored in it encrypted. Chunks found in the local chunk index only are looked up before
+// they are relied on. Records the uploaded size and the checksum of the manifest.
+func storeDedupArchive(ctx context.Context, backend StorageBackend, archivePath string, recipients []age.Recipient, object *BackupObject, opts *BackupOptions, cfg *Config, stdout, stderr io.Writer) error {
+	prefix := manifestDirectory(object.Object)
+	if len(recipients) == 0 {
+		// report no pubkey
+		cfg.Internal.Warnings.Report(stderr, WarningEncryption, "", "no pubkey found, encryption disabled")
+	}
+
+	/* find chunks stored by earlier backups */
+	indexPath, err := dedupIndexPath(cfg, prefix)
+	if err != nil {
+		cfg.Internal.Warnings.Report(stderr, WarningChunkIndex, "", fmt.Sprintf("could not locate the chunk index: %s", err.Error()))
+	}
+	var index chunkIndex = chunkIndex{}
+	if len(indexPath) > 0 {
+		index = loadChunkIndex(indexPath)
+	}
+	listed := true
+	index, err = listChunks(backend, prefix, index)
+	if err != nil {
+		listed = false
+		cfg.Internal.Warnings.Report(stderr, WarningChunkIndex, prefix.String(), fmt.Sprintf("could not list chunks under %q, checking chunks of the local chunk index instead: %s", prefix, err.Error()))
+	}
+	if len(indexPath) > 0 {
+		defer func() {
+			if err := index.save(indexPath, cfg); err != nil {
+				cfg.Internal.Warnings.Report(stderr, WarningChunkIndex, indexPath, fmt.Sprintf("could not save the chunk index: %s", err.Error()))
+			}
+		}()
+	}
+
+	/* split the TAR stream and upload new chunks */
+	archive, err := os.Open(filepath.Clean(archivePath))
+	if err != nil {
+		return fmt.Errorf("could not open backup archive: %s", err.Error())
+	}
+	defer archive.Close()
+	gz, err := gzip.NewReader(archive)
+	if err != nil {
+		return fmt.Errorf("could not decompress backup archive: %s", err.Error())
+	}
+
+	if opts.Verbose {
+		fmt.Fprintf(stderr, "uploading chunks of the backup archive of %q to %q\n", opts.Source, ResolveObjectURI(prefix, DedupChunkPrefix))
+	}
+	manifest := dedupManifest{Version: dedup_manifest_version}
+	chunkContentType := ContentTypeGzip
+	var nameKey []byte
+	if len(recipients) > 0 {
+		chunkContentType = ContentTypeAge
+		nameKey = opts.ChunkKey
+	}
+	var stored int
+	var data []byte
+	// chunks known to be stored without listing them
+	verified := chunkIndex{}
+	chunks := newChunker(gz, dedupChunkSizes)
+	for {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		data, err = chunks.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("could not read backup archive: %s", err.Error())
+		}
+		sum := sha256.Sum256(data)
+		chunk := dedupChunk{Key: chunkKey(chunkName(sum, nameKey), len(recipients) > 0), Hash: hex.EncodeToString(sum[:]), Size: int64(len(data))}
+		manifest.Chunks = append(manifest.Chunks, chunk)
+		manifest.Size += chunk.Size
+		if index[chunk.Key] && (listed || verified[chunk.Key] || chunkStored(backend, prefix, chunk.Key)) {
+			verified[chunk.Key] = true
+			continue
+		}
+
+		var encoded []byte
+		encoded, err = encodeChunk(data, recipients)
+		if err != nil {
+			return err
+		}
+		encodedSum := sha256.Sum256(encoded)
+		chunkUri := ResolveObjectURI(prefix, chunk.Key)
+		err = backend.StoreFile(ctx, StoreRequest{URI: chunkUri, BodyAt: bytes.NewReader(encoded), Length: int64(len(encoded)), Checksum: hex.EncodeToString(encodedSum[:]), ContentType: chunkContentType, Quiet: true})
+		if err != nil {
+			return fmt.Errorf("unable to write chunk %q: %s", chunkUri, err.Error())
+		}
+		index[chunk.Key] = true
+		verified[chunk.Key] = true
+		stored++
+		object.Sizes.Uploaded += int64(len(encoded))
+		if opts.Uploaded != nil {
+			opts.Uploaded.Add(int64(len(encoded)))
+		}
+	}
+
+	/* store the manifest */
+	if len(recipients) > 0 {
+		if err = manifest.sealDigests(recipients); err != nil {
+			return err
+		}
+	}
+	data, err = json.Marshal(&manifest)
+	if err != nil {
+		return fmt.Errorf("could not encode manifest: %s", err.Error())
+	}
+	sum := sha256.Sum256(data)
+	object.Checksum = hex.EncodeToString(sum[:])
+	object.ContentType = ContentTypeJSON
+	err = backend.StoreFile(ctx, StoreRequest{URI: object.Object, BodyAt: bytes.NewReader(data), Length: int64(len(data)), Checksum: object.Checksum, ContentType: object.ContentType})
+	if err != nil {
+		return fmt.Errorf("unable to write backup manifest of %q to %q: %s", opts.Source, object.Object, err.Error())
+	}
+	object.ManifestSize = int64(len(data))
+	object.Sizes.Uploaded += object.ManifestSize
+
+	fmt.Fprintf(stdout, "uploaded backup archive of %q to %q, %d of %d chunks were new\n", opts.Source, object.Object, stored, len(manifest.Chunks))
+	fmt.Fprintf(stdout, "backup sizes: source %d bytes, archive %d bytes, uploaded %d bytes\n", object.Sizes.Source, object.Sizes.Archive, object.Sizes.Uploaded)
+	return nil
+}
+
+// readDedupManifest retrieves and parses the manifest stored under `uri`.
+func readDedupManifest(backend StorageBackend, uri *url.URL) (*dedupManifest, error) {
+	var buf bytes.Buffer
+	if err := backend.RetrieveFile(&limitedWriter{&buf, max_dedup_manifest_size}, uri); err != nil {
+		return nil, fmt.Errorf("could not read manifest %q: %s", uri, err.Error())
+	}
+	var manifest dedupManifest
+	if err := json.Unmarshal(buf.Bytes(), &manifest); err != nil {
+		return nil, fmt.Errorf("could not parse manifest %q: %s", uri, err.Error())
+	}
+	if manifest.Version != dedup_manifest_version {
+		return nil, fmt.Errorf("unsupported version %d of manifest %q", manifest.Version, uri)
+	}
+	for _, chunk := range manifest.Chunks {
+		if !strings.HasPrefix(chunk.Key, DedupChunkPrefix) || !IsChunkObject(strings.TrimPrefix(chunk.Key, DedupChunkPrefix)) {
+			return nil, fmt.Errorf("manifest %q lists the invalid chunk %q", uri, chunk.Key)
+		}
+	}
+	return &manifest, nil
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	if int64(len(p)) > lw.remaining {
+		return 0, fmt.Errorf("object exceeds %d bytes", max_dedup_manifest_size)
+	}
+	lw.remaining -= int64(len(p))
+	return lw.Writer.Write(p)
+}
+
+// retrieveDedupStream returns a reader producing the gzip-compressed TAR stream of the
+// deduplicated backup with the manifest `uri`, reassembled from its chunks. Encrypted chunks
+// are decrypted with `identities`. Also returns whether chunks are decrypted. Closing the
+// reader or cancelling `ctx` stops the download.
+func retrieveDedupStream(ctx context.Context, backend StorageBackend, uri *url.URL, identities []age.Identity) (io.ReadCloser, bool, error) {
+	manifest, err := readDedupManifest(backend, uri)
+	if err != nil {
+		return nil, false, err
+	}
+	var encrypted bool
+	for _, chunk := range manifest.Chunks {
+		encrypted = encrypted || strings.HasSuffix(chunk.Key, AgeFileSuffix)
+	}
+	if encrypted && len(identities) == 0 {
+		return nil, false, fmt.Errorf("chunks of %q are encrypted, an identity is required to restore them", uri)
+	}
+	if len(manifest.Digests) > 0 {
+		if err = manifest.openDigests(identities); err != nil {
+			return nil, false, fmt.Errorf("could not read manifest %q: %s", uri, err.Error())
+		}
+	}
+
+	prefix := manifestDirectory(uri)
+	pipeReader, writer := io.Pipe()
+	reader := &cancelableReader{pipeReader, context.AfterFunc(ctx, func() {
+		pipeReader.CloseWithError(ctx.Err())
+	})}
+	go func() {
+		gz := gzip.NewWriter(writer)
+		var err error
+		for _, chunk := range manifest.Chunks {
+			var buf bytes.Buffer
+			if err = backend.RetrieveFile(&buf, ResolveObjectURI(prefix, chunk.Key)); err != nil {
+				err = fmt.Errorf("could not retrieve chunk %q: %s", chunk.Key, err.Error())
+				break
+			}
+			var data []byte
+			if data, err = decodeChunk(buf.Bytes(), chunk, identities); err != nil {
+				break
+			}
+			if _, err = gz.Write(data); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = gz.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+
+	return reader, encrypted, nil
+}
+
+// unreferencedChunks returns the chunks of `chunks` that none of the `manifests` refers to
+// and that were stored at least dedup_chunk_grace before `now`, so chunks of a backup still
+// being stored are kept. Fails if any of the manifests cannot be read, since the chunks it
+// refers to are unknown.
+func unreferencedChunks(backend StorageBackend, manifests, chunks []FileInfo, now time.Time) ([]FileInfo, error) {
+	referenced := map[string]bool{}
+	for _, fileinfo := range manifests {
+		manifest, err := readDedupManifest(backend, fileinfo.URI())
+		if err != nil {
+			return nil, err
+		}
+		prefix := manifestDirectory(fileinfo.URI())
+		for _, chunk := range manifest.Chunks {
+			referenced[ResolveObjectURI(prefix, chunk.Key).Path] = true
+		}
+	}
+
+	var unreferenced []FileInfo
+	for _, fileinfo := range chunks {
+		if !referenced[fileinfo.URI().Path] && now.Sub(fileinfo.Modified()) >= dedup_chunk_grace {
+			unreferenced = append(unreferenced, fileinfo)
+		}
+	}
+	return unreferenced, nil
+}
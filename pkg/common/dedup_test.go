@@ -0,0 +1,393 @@
+package common
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+)
+
+// unlistableChunksBackend is a MemoryBackend whose chunks cannot be listed, like with
+// write-only credentials.
+type unlistableChunksBackend struct {
+	*MemoryBackend
+}
+
+// test chunk sizes, small enough for chunks of a few kilobytes
+var testChunkSizes = chunkSizes{min: 1 << 10, avg: 4 << 10, max: 16 << 10}
+
+// helper function: `size` bytes of pseudo-random data.
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	_, _ = rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func (ucb *unlistableChunksBackend) ListFiles(uri *url.URL) ([]FileInfo, error) {
+	if strings.HasSuffix(uri.Path, "/"+DedupChunkPrefix) {
+		return nil, fmt.Errorf("%s", ErrAccessDenied)
+	}
+	return ucb.MemoryBackend.ListFiles(uri)
+}
+
+// helper function: SHA-256 digests of the chunks of `data`.
+func chunkHashes(t *testing.T, data []byte, sizes chunkSizes) []string {
+	var hashes []string
+	chunks := newChunker(bytes.NewReader(data), sizes)
+	for {
+		chunk, err := chunks.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		sum := sha256.Sum256(chunk)
+		hashes = append(hashes, hex.EncodeToString(sum[:]))
+	}
+	return hashes
+}
+
+// helper function: use small chunks for the duration of the test.
+func setupDedupChunkSizes(t *testing.T) {
+	original := dedupChunkSizes
+	dedupChunkSizes = testChunkSizes
+	t.Cleanup(func() { dedupChunkSizes = original })
+}
+
+/* test cases for chunker */
+func TestChunker(t *testing.T) {
+	// Setup Test
+	data := randomData(1, 1<<20)
+
+	// Perform the test
+	var joined bytes.Buffer
+	var sizes []int
+	chunks := newChunker(iotestHalfReader{bytes.NewReader(data)}, testChunkSizes)
+	for {
+		chunk, err := chunks.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		joined.Write(chunk)
+		sizes = append(sizes, len(chunk))
+	}
+	assertEquals(t, true, bytes.Equal(data, joined.Bytes()), "chunks")
+	for index, size := range sizes {
+		if size > testChunkSizes.max || (size < testChunkSizes.min && index < len(sizes)-1) {
+			t.Errorf("chunk %d is %d bytes long", index, size)
+		}
+	}
+	// chunks are cut close to the average size
+	average := len(data) / len(sizes)
+	assertEquals(t, true, average > testChunkSizes.avg/2 && average < 2*testChunkSizes.avg, fmt.Sprintf("average %d", average))
+
+	/* the same input results in the same chunks */
+	assertEquals(t, strings.Join(chunkHashes(t, data, testChunkSizes), ","), strings.Join(chunkHashes(t, data, testChunkSizes), ","), "deterministic")
+
+	/* inserting data only changes the chunks around the edit */
+	edited := append(append(append([]byte{}, data[:len(data)/2]...), []byte("inserted data")...), data[len(data)/2:]...)
+	known := map[string]bool{}
+	for _, hash := range chunkHashes(t, data, testChunkSizes) {
+		known[hash] = true
+	}
+	var changed int
+	editedHashes := chunkHashes(t, edited, testChunkSizes)
+	for _, hash := range editedHashes {
+		if !known[hash] {
+			changed++
+		}
+	}
+	assertEquals(t, true, changed > 0 && changed <= 2, fmt.Sprintf("changed %d of %d chunks", changed, len(editedHashes)))
+
+	/* empty input has no chunks */
+	_, err := newChunker(bytes.NewReader(nil), testChunkSizes).Next()
+	assertEquals(t, io.EOF, err, "empty")
+}
+
+// iotestHalfReader reads half as many bytes as requested, like a slow network stream.
+type iotestHalfReader struct {
+	io.Reader
+}
+
+func (hr iotestHalfReader) Read(p []byte) (int, error) {
+	return hr.Reader.Read(p[:(len(p)+1)/2])
+}
+
+/* test cases for IsChunkObject */
+func TestIsChunkObject(t *testing.T) {
+	hash := strings.Repeat("0123456789abcdef", 4)
+	assertEquals(t, true, IsChunkObject(hash+".chunk"), "IsChunkObject(hash.chunk)")
+	assertEquals(t, true, IsChunkObject(hash+".chunk.age"), "IsChunkObject(hash.chunk.age)")
+	assertEquals(t, "chunks/"+hash+".chunk.age", chunkKey(hash, true), "chunkKey")
+	assertEquals(t, false, IsChunkObject(strings.ToUpper(hash)+".chunk"), "IsChunkObject(HASH.chunk)")
+	assertEquals(t, false, IsChunkObject(hash[1:]+"g.chunk"), "IsChunkObject(invalid)")
+	assertEquals(t, false, IsChunkObject("2024-05-01T03.tar.gz.age"), "IsChunkObject(backup)")
+	// obfuscated backup names are digests as well
+	assertEquals(t, false, IsChunkObject(hash), "IsChunkObject(hash)")
+	assertEquals(t, true, IsBackupObject(hash), "IsBackupObject(hash)")
+	assertEquals(t, false, IsBackupObject(hash+".chunk.age"), "IsBackupObject(hash.chunk.age)")
+	assertEquals(t, true, IsDedupManifest("2024-05-01T03"+DedupManifestSuffix), "IsDedupManifest")
+}
+
+/* test cases for chunkIndex */
+func TestChunkIndex(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	cfg.Backup.DedupCacheDir = filepath.Join(t.TempDir(), "cache")
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	hash := strings.Repeat("0123456789abcdef", 4)
+
+	// Perform the test
+	indexPath, err := dedupIndexPath(cfg, prefixUri)
+	assertEquals(t, nil, err, "dedupIndexPath")
+	assertEquals(t, cfg.Backup.DedupCacheDir, filepath.Dir(indexPath), "dedupIndexPath")
+	otherUri, _ := url.ParseRequestURI("memory://bucket/other/")
+	otherPath, _ := dedupIndexPath(cfg, otherUri)
+	assertEquals(t, false, indexPath == otherPath, "dedupIndexPath(other)")
+
+	/* missing indexes are empty */
+	assertEquals(t, 0, len(loadChunkIndex(indexPath)), "loadChunkIndex(missing)")
+
+	/* saved indexes are read back */
+	index := chunkIndex{chunkKey(hash, true): true, chunkKey(hash, false): true}
+	assertEquals(t, nil, index.save(indexPath, cfg), "save")
+	loaded := loadChunkIndex(indexPath)
+	assertEquals(t, 2, len(loaded), "loadChunkIndex")
+	assertEquals(t, true, loaded["chunks/"+hash+".chunk.age"], "loadChunkIndex")
+
+	/* corrupted indexes are empty */
+	if err = os.WriteFile(indexPath, []byte("corrupted"), 0600); err != nil {
+		t.Fatalf("could not write to temporary file: %s", err.Error())
+	}
+	assertEquals(t, 0, len(loadChunkIndex(indexPath)), "loadChunkIndex(corrupted)")
+
+	/* the listing of the prefix replaces the cached index */
+	memory := NewMemoryBackend()
+	for _, key := range []string{chunkKey(hash, true), "chunks/unrelated", "other/" + hash + ".chunk"} {
+		if err = StoreFileAt(memory, bytes.NewReader([]byte("data")), 4, ResolveObjectURI(prefixUri, key)); err != nil {
+			t.Fatalf("could not store object: %s", err.Error())
+		}
+	}
+	listed, err := listChunks(memory, prefixUri, loaded)
+	assertEquals(t, nil, err, "listChunks")
+	assertEquals(t, 1, len(listed), "listChunks")
+	assertEquals(t, true, listed["chunks/"+hash+".chunk.age"], "listChunks")
+
+	/* the cached index is used if chunks cannot be listed */
+	dummy := &DummyBackend{}
+	dummy.SetDummyError(fmt.Errorf("%s", ErrAccessDenied))
+	listed, err = listChunks(dummy, prefixUri, loaded)
+	assertEquals(t, ErrAccessDenied, fmt.Sprintf("%v", err), "listChunks(denied)")
+	assertEquals(t, 2, len(listed), "listChunks(denied)")
+}
+
+/* test cases for unreferencedChunks */
+func TestUnreferencedChunks(t *testing.T) {
+	// Setup Test
+	memory := NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	now := time.Date(2024, 5, 10, 3, 0, 0, 0, time.UTC)
+	keys := make([]string, 3)
+	for index := range keys {
+		keys[index] = chunkKey(strings.Repeat(fmt.Sprintf("%x", index), 64), true)
+	}
+	store := func(key string, data string, modified time.Time) {
+		uri := ResolveObjectURI(prefixUri, key)
+		if err := StoreFileAt(memory, strings.NewReader(data), int64(len(data)), uri); err != nil {
+			t.Fatalf("could not store object: %s", err.Error())
+		}
+		if err := memory.SetFileModified(uri, modified); err != nil {
+			t.Fatalf("could not set modification time: %s", err.Error())
+		}
+	}
+	old := now.Add(-48 * time.Hour)
+	store("backup"+DedupManifestSuffix, fmt.Sprintf(`{"version":1,"size":2,"chunks":[{"key":%q,"hash":"","size":1},{"key":%q,"hash":"","size":1}]}`, keys[0], keys[0]), old)
+	store(keys[0], "a", old)
+	store(keys[1], "b", old)
+	// recent chunks may belong to a backup still being stored
+	store(keys[2], "c", now.Add(-time.Hour))
+	list := func(prefix string) []FileInfo {
+		filelist, err := memory.ListFiles(ResolveObjectURI(prefixUri, prefix))
+		if err != nil {
+			t.Fatalf("could not list objects: %s", err.Error())
+		}
+		return filelist
+	}
+
+	// Perform the test
+	unreferenced, err := unreferencedChunks(memory, list("backup"), list(DedupChunkPrefix), now)
+	assertEquals(t, nil, err, "unreferencedChunks")
+	assertEquals(t, 1, len(unreferenced), "unreferencedChunks")
+	assertEquals(t, "prefix/"+keys[1], unreferenced[0].Name(), "unreferencedChunks")
+
+	/* without manifests all old chunks are unreferenced */
+	unreferenced, err = unreferencedChunks(memory, nil, list(DedupChunkPrefix), now)
+	assertEquals(t, nil, err, "unreferencedChunks(none)")
+	assertEquals(t, 2, len(unreferenced), "unreferencedChunks(none)")
+
+	/* nothing is unreferenced if a manifest cannot be read */
+	store("broken"+DedupManifestSuffix, "{", old)
+	unreferenced, err = unreferencedChunks(memory, list("broken"), list(DedupChunkPrefix), now)
+	assertEquals(t, true, err != nil && strings.HasPrefix(err.Error(), "could not parse manifest"), "unreferencedChunks(broken)")
+	assertEquals(t, 0, len(unreferenced), "unreferencedChunks(broken)")
+}
+
+/* test cases for deduplicated backups */
+func TestBackupDedup(t *testing.T) {
+	// Setup Test
+	setupDedupChunkSizes(t)
+	cfg := setupBackupConfig(t)
+	cfg.Backup.Dedup = true
+	cfg.Backup.DedupCacheDir = t.TempDir()
+	cfg.Backup.Hours = 0
+	t.Cleanup(func() { Now = time.Now })
+	memory := NewMemoryBackend()
+	var backend StorageBackend = memory
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("could not generate identity: %s", err.Error())
+	}
+	srcDir := t.TempDir()
+	data := randomData(2, 256<<10)
+	backup := func(day int) (BackupResult, string) {
+		if err := os.WriteFile(filepath.Join(srcDir, "image.raw"), data, 0600); err != nil {
+			t.Fatalf("could not write to temporary file: %s", err.Error())
+		}
+		nominalTime := time.Date(2024, 5, day, 3, 0, 0, 0, time.UTC)
+		Now = func() time.Time { return nominalTime }
+		var stdout bytes.Buffer
+		result, err := Backup(context.Background(), BackupOptions{
+			Source:      srcDir,
+			Destination: prefixUri,
+			Config:      cfg,
+			Backend:     backend,
+			Time:        nominalTime,
+			Recipients:  []age.Recipient{identity.Recipient()},
+			ChunkKey:    []byte("chunk-key"),
+			Stdout:      &stdout,
+		})
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		return result, stdout.String()
+	}
+	restore := func(object *url.URL) []byte {
+		var output bytes.Buffer
+		_, err := Restore(context.Background(), RestoreOptions{Object: object, Config: cfg, Backend: memory, Identities: []age.Identity{identity}, Output: &output})
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		gz, err := gzip.NewReader(&output)
+		if err != nil {
+			t.Fatalf("could not decompress backup: %s", err.Error())
+		}
+		reader := tar.NewReader(gz)
+		for {
+			header, err := reader.Next()
+			if err != nil {
+				t.Fatalf("could not read backup: %s", err.Error())
+			}
+			if strings.HasSuffix(header.Name, "image.raw") {
+				contents, _ := io.ReadAll(reader)
+				return contents
+			}
+		}
+	}
+	chunkCount := func() int {
+		filelist, _ := memory.ListFiles(ResolveObjectURI(prefixUri, DedupChunkPrefix))
+		return len(filelist)
+	}
+
+	// Perform the test
+	first, stdout := backup(1)
+	assertEquals(t, "memory://bucket/prefix/2024-05-01T03"+DedupManifestSuffix, first.Object.String(), "result.Object")
+	assertEquals(t, true, first.Stored, "result.Stored")
+	assertEquals(t, true, strings.HasSuffix(stdout, fmt.Sprintf(" chunks were new\nbackup sizes: source %d bytes, archive %d bytes, uploaded %d bytes\n", first.Sizes.Source, first.Sizes.Archive, first.Sizes.Uploaded)), "stdout")
+	assertEquals(t, true, chunkCount() > 10, "chunks")
+	fileinfo, err := memory.GetFileInfo(first.Object)
+	assertEquals(t, nil, err, "manifest")
+	assertEquals(t, int64(fileinfo.Size()), first.Objects[0].ManifestSize, "result.ManifestSize")
+	assertEquals(t, true, first.Sizes.Uploaded > first.Objects[0].ManifestSize, "result.Sizes.Uploaded")
+	assertEquals(t, true, bytes.Equal(data, restore(first.Object)), "restored")
+
+	/* chunks are encrypted */
+	filelist, _ := memory.ListFiles(ResolveObjectURI(prefixUri, DedupChunkPrefix))
+	assertEquals(t, true, strings.HasSuffix(filelist[0].Name(), AgeFileSuffix), "encrypted")
+	var chunk bytes.Buffer
+	_ = memory.RetrieveFile(&chunk, filelist[0].URI())
+	assertEquals(t, true, bytes.HasPrefix(chunk.Bytes(), []byte(AgeHeaderPrefix)), "encrypted")
+
+	/* names of encrypted chunks are keyed, their digests are only stored encrypted */
+	var stored bytes.Buffer
+	_ = memory.RetrieveFile(&stored, first.Object)
+	var manifest dedupManifest
+	assertEquals(t, nil, json.Unmarshal(stored.Bytes(), &manifest), "manifest")
+	assertEquals(t, "", manifest.Chunks[0].Hash, "manifest.Chunks[0].Hash")
+	assertEquals(t, true, bytes.HasPrefix(manifest.Digests, []byte(AgeHeaderPrefix)), "manifest.Digests")
+	assertEquals(t, nil, manifest.openDigests([]age.Identity{identity}), "openDigests")
+	stored.Reset()
+	_ = memory.RetrieveFile(&stored, ResolveObjectURI(prefixUri, manifest.Chunks[0].Key))
+	decoded, err := decodeChunk(stored.Bytes(), manifest.Chunks[0], []age.Identity{identity})
+	assertEquals(t, nil, err, "decodeChunk")
+	sum := sha256.Sum256(decoded)
+	assertEquals(t, chunkKey(chunkName(sum, []byte("chunk-key")), true), manifest.Chunks[0].Key, "manifest.Chunks[0].Key")
+	assertEquals(t, false, strings.Contains(manifest.Chunks[0].Key, hex.EncodeToString(sum[:])), "manifest.Chunks[0].Key")
+
+	/* unchanged chunks are not uploaded again */
+	chunksBefore := chunkCount()
+	copy(data[100<<10:], []byte("changed"))
+	second, _ := backup(2)
+	added := chunkCount() - chunksBefore
+	assertEquals(t, true, added > 0 && added <= 3, fmt.Sprintf("added %d chunks", added))
+	assertEquals(t, true, second.Sizes.Uploaded < first.Sizes.Uploaded/4, "result.Sizes.Uploaded")
+	assertEquals(t, true, bytes.Equal(data, restore(second.Object)), "restored")
+
+	/* chunks of expired backups are removed unless referenced by a remaining backup */
+	cfg.Backup.Hours = 36
+	chunksBefore = chunkCount()
+	result, err := CleanupPrefix(memory, cfg, time.Date(2024, 5, 3, 3, 30, 0, 0, time.UTC), prefixUri, CleanupOptions{})
+	assertEquals(t, nil, err, "CleanupPrefix")
+	assertEquals(t, 0, len(result.Warnings), "CleanupPrefix.Warnings")
+	removed := chunksBefore - chunkCount()
+	assertEquals(t, true, removed > 0 && removed <= added, fmt.Sprintf("removed %d chunks", removed))
+	assertEquals(t, 1+removed, len(result.Removed), "CleanupPrefix.Removed")
+	assertEquals(t, "memory://bucket/prefix/2024-05-01T03"+DedupManifestSuffix, result.Removed[0], "CleanupPrefix.Removed")
+	assertEquals(t, true, result.Remaining["2024-05-02T03"+DedupManifestSuffix], "CleanupPrefix.Remaining")
+	assertEquals(t, true, bytes.Equal(data, restore(second.Object)), "restored")
+
+	/* restoring encrypted chunks requires an identity */
+	_, err = Restore(context.Background(), RestoreOptions{Object: second.Object, Config: cfg, Backend: memory, Output: io.Discard})
+	assertEquals(t, true, err != nil && strings.Contains(err.Error(), "an identity is required"), "Restore(no identity)")
+
+	/* chunks of the local chunk index that were removed are stored again if chunks cannot be listed */
+	cfg.Backup.Hours = 0
+	filelist, _ = memory.ListFiles(ResolveObjectURI(prefixUri, DedupChunkPrefix))
+	for _, fileinfo := range filelist {
+		_ = memory.RemoveFile(fileinfo.URI())
+	}
+	backend = &unlistableChunksBackend{memory}
+	third, _ := backup(4)
+	assertEquals(t, len(filelist), chunkCount(), "chunks")
+	assertEquals(t, true, bytes.Equal(data, restore(third.Object)), "restored")
+
+	/* encrypted chunks cannot be named without a key */
+	_, err = Backup(context.Background(), BackupOptions{Source: srcDir, Destination: prefixUri, Config: cfg, Backend: memory, Recipients: []age.Recipient{identity.Recipient()}})
+	assertEquals(t, "encrypted deduplicated backups require a key to name their chunks", fmt.Sprintf("%v", err), "Backup(no chunk key)")
+}
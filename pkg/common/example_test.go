@@ -0,0 +1,123 @@
+package common_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"github.com/breezerider/squirrel-up/pkg/common"
+)
+
+// exampleConfig returns the default configuration with backup names in UTC and no retention.
+func exampleConfig() *common.Config {
+	var cfg common.Config
+	_ = cfg.SetDefaultValues()
+	cfg.Backup.Name = "2006-01-02T15"
+	cfg.Backup.Timezone = "UTC"
+	cfg.Backup.Hours = 0
+	cfg.Internal.Reporter = &common.DummyProgressReporter{}
+	return &cfg
+}
+
+func ExampleBackup() {
+	srcDir, _ := os.MkdirTemp("", "example")
+	defer os.RemoveAll(srcDir)
+	_ = os.WriteFile(filepath.Join(srcDir, "notes.txt"), []byte("notes"), 0600)
+
+	identity, _ := age.GenerateX25519Identity()
+	prefix, _ := url.Parse("memory://bucket/backups/")
+	result, err := common.Backup(context.Background(), common.BackupOptions{
+		Source:      srcDir,
+		Destination: prefix,
+		Config:      exampleConfig(),
+		Backend:     common.NewMemoryBackend(),
+		Time:        time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC),
+		Recipients:  []age.Recipient{identity.Recipient()},
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(result.Object, result.Stored)
+	// Output: memory://bucket/backups/2024-05-01T03.tar.gz.age true
+}
+
+func ExampleRestore() {
+	identity, _ := age.GenerateX25519Identity()
+	var encrypted bytes.Buffer
+	writer, _ := age.Encrypt(&encrypted, identity.Recipient())
+	_, _ = writer.Write([]byte("backup contents"))
+	_ = writer.Close()
+
+	backend := common.NewMemoryBackend()
+	object, _ := url.Parse("memory://bucket/backups/2024-05-01T03.tar.gz.age")
+	_ = backend.StoreFile(context.Background(), common.StoreRequest{URI: object, BodyAt: bytes.NewReader(encrypted.Bytes()), Length: int64(encrypted.Len())})
+
+	var output bytes.Buffer
+	result, err := common.Restore(context.Background(), common.RestoreOptions{
+		Object:     object,
+		Backend:    backend,
+		Identities: []age.Identity{identity},
+		Output:     &output,
+	})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(output.String(), result.Decrypted)
+	// Output: backup contents true
+}
+
+func ExampleList() {
+	backend := common.NewMemoryBackend()
+	common.CreateDummyBackend = func(cfg *common.Config) common.StorageBackend { return backend }
+	defer func() { common.CreateDummyBackend = nil }()
+
+	prefix, _ := url.Parse("dummy://bucket/backups/")
+	for hour, key := range []string{"2024-05-01T03.tar.gz.age", "2024-05-01T02.tar.gz.age", common.CatalogObjectName} {
+		object, _ := prefix.Parse(key)
+		_ = backend.StoreFile(context.Background(), common.StoreRequest{URI: object, BodyAt: strings.NewReader("data"), Length: 4})
+		_ = backend.SetFileModified(object, time.Date(2024, 5, 1, 3-hour, 0, 0, 0, time.UTC))
+	}
+
+	backups, err := common.List(context.Background(), prefix, exampleConfig(), common.ListOptions{})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, backup := range backups {
+		fmt.Println(backup.Key, backup.Size)
+	}
+	// Output:
+	// 2024-05-01T02.tar.gz.age 4
+	// 2024-05-01T03.tar.gz.age 4
+}
+
+func ExamplePrune() {
+	backend := common.NewMemoryBackend()
+	common.CreateDummyBackend = func(cfg *common.Config) common.StorageBackend { return backend }
+	defer func() { common.CreateDummyBackend = nil }()
+
+	prefix, _ := url.Parse("dummy://bucket/backups/")
+	for days, key := range []string{"recent.tar.gz.age", "outdated.tar.gz.age"} {
+		object, _ := prefix.Parse(key)
+		_ = backend.StoreFile(context.Background(), common.StoreRequest{URI: object, BodyAt: strings.NewReader("data"), Length: 4})
+		_ = backend.SetFileModified(object, time.Now().AddDate(0, 0, -7*days))
+	}
+
+	cfg := exampleConfig()
+	cfg.Backup.Hours = 72
+	result, err := common.Prune(context.Background(), prefix, cfg, common.PruneOptions{})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(result.Removed)
+	// Output: [dummy://bucket/backups/outdated.tar.gz.age]
+}
@@ -0,0 +1,165 @@
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+type (
+	// FileClass describes what a file written by squirrelup holds, which determines its mode.
+	FileClass int
+)
+
+const (
+	// SecretFile holds backup data, possibly decrypted, like temporary archives and downloads.
+	SecretFile FileClass = iota
+	// StateFile holds state read back by later runs, like caches and recovery files.
+	StateFile
+	// ReportFile holds reports meant to be read by other users, like monitoring tools.
+	ReportFile
+
+	// mode of secret and state files unless configured otherwise
+	default_secret_file_mode fs.FileMode = 0600
+	// mode of report files unless configured otherwise
+	default_report_file_mode fs.FileMode = 0644
+	// number of names tried by CreateTempFile before giving up
+	max_temp_file_attempts = 10000
+	// first field in the header of state files
+	state_file_magic = "squirrelup-state"
+	// format version in the header of state files
+	state_file_version = 1
+
+	// Errors returned by DecodeStateFile.
+	ErrStateFileUnknown   = "unknown state file format"
+	ErrStateFileVersion   = "unsupported state file version"
+	ErrStateFileCorrupted = "state file is corrupted"
+)
+
+var (
+	// beforeRename is called by AtomicWriteFile before renaming the complete temporary file,
+	// tests use it to simulate crashes.
+	beforeRename func(tmpPath string)
+)
+
+// FileMode returns the mode of files of `class` created by squirrelup: Backup.FileMode if set,
+// otherwise 0600 for secret and state files and 0644 for reports. Files are created with this
+// mode, so the umask still applies.
+func (cfg *Config) FileMode(class FileClass) fs.FileMode {
+	if cfg != nil && len(cfg.Backup.FileMode) > 0 {
+		if value, err := strconv.ParseUint(cfg.Backup.FileMode, 8, 9); err == nil {
+			return fs.FileMode(value)
+		}
+	}
+	if class == ReportFile {
+		return default_report_file_mode
+	}
+	return default_secret_file_mode
+}
+
+// HasTrailingSeparator returns true if `path` ends with a path separator, which is either
+// slash or backslash on Windows.
+func HasTrailingSeparator(path string) bool {
+	return len(path) > 0 && os.IsPathSeparator(path[len(path)-1])
+}
+
+// CreateFile creates a new file at `path` with `mode`, reduced by the umask, and opens it for
+// writing. Existing files are never opened, so symbolic links planted at `path` are not followed.
+func CreateFile(path string, mode fs.FileMode) (*os.File, error) {
+	return os.OpenFile(filepath.Clean(path), os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+}
+
+// CreateTempFile creates a new temporary file in `dir` like os.CreateTemp, with `mode` reduced
+// by the umask instead of 0600. The last "*" in `pattern` is replaced by a random string,
+// which is appended if `pattern` has none. The default directory for temporary files is
+// used if `dir` is empty.
+func CreateTempFile(dir, pattern string, mode fs.FileMode) (*os.File, error) {
+	if len(dir) == 0 {
+		dir = os.TempDir()
+	}
+	prefix, suffix := pattern, ""
+	if index := strings.LastIndex(pattern, "*"); index >= 0 {
+		prefix, suffix = pattern[:index], pattern[index+1:]
+	}
+
+	var err error
+	for attempt := 0; attempt < max_temp_file_attempts; attempt++ {
+		name := filepath.Join(dir, prefix+strconv.FormatUint(uint64(rand.Uint32()), 10)+suffix)
+		var file *os.File
+		file, err = os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, mode)
+		if !os.IsExist(err) {
+			return file, err
+		}
+	}
+	return nil, &fs.PathError{Op: "createtemp", Path: filepath.Join(dir, pattern), Err: fs.ErrExist}
+}
+
+// AtomicWriteFile replaces the file at `path` with `data`. The data is written to a temporary
+// file in the same directory with `mode`, synced to disk and renamed over `path`, so readers
+// see either the previous or the new contents even if the process dies or the system crashes.
+func AtomicWriteFile(path string, data []byte, mode fs.FileMode) error {
+	dir := filepath.Dir(path)
+	tmp, err := CreateTempFile(dir, "."+filepath.Base(path)+"-*", mode)
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && beforeRename != nil {
+		beforeRename(tmp.Name())
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	// persist the rename, not every file system supports syncing directories
+	if dirFile, err := os.Open(filepath.Clean(dir)); err == nil {
+		_ = dirFile.Sync()
+		_ = dirFile.Close()
+	}
+	return nil
+}
+
+// EncodeStateFile prefixes `data` with a header naming the `kind` of state, the format version
+// and the SHA-256 checksum of `data`, see DecodeStateFile.
+func EncodeStateFile(kind string, data []byte) []byte {
+	sum := sha256.Sum256(data)
+	header := fmt.Sprintf("%s %s v%d sha256:%s\n", state_file_magic, kind, state_file_version, hex.EncodeToString(sum[:]))
+	return append([]byte(header), data...)
+}
+
+// DecodeStateFile returns the data of a state file of `kind` written by EncodeStateFile.
+// Files without a header for `kind` fail with ErrStateFileUnknown, files of another format
+// version with ErrStateFileVersion and files whose data does not match the checksum in the
+// header, like files cut short, with ErrStateFileCorrupted.
+func DecodeStateFile(kind string, raw []byte) ([]byte, error) {
+	header, data, found := bytes.Cut(raw, []byte("\n"))
+	fields := strings.Fields(string(header))
+	if !found || len(fields) != 4 || fields[0] != state_file_magic || fields[1] != kind {
+		return nil, fmt.Errorf("%s", ErrStateFileUnknown)
+	}
+	if fields[2] != fmt.Sprintf("v%d", state_file_version) {
+		return nil, fmt.Errorf("%s: %s", ErrStateFileVersion, fields[2])
+	}
+	sum := sha256.Sum256(data)
+	if fields[3] != "sha256:"+hex.EncodeToString(sum[:]) {
+		return nil, fmt.Errorf("%s", ErrStateFileCorrupted)
+	}
+	return data, nil
+}
@@ -0,0 +1,28 @@
+//go:build !unix
+
+package common
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+)
+
+// helper function: skip the test, there is no umask on this platform.
+func setUmask(t *testing.T, mask int) {
+	t.Skip("umask is not supported on " + runtime.GOOS)
+}
+
+// helper function: kill the test process without giving it a chance to clean up.
+func killProcess() {
+	if process, err := os.FindProcess(os.Getpid()); err == nil {
+		_ = process.Kill()
+	}
+}
+
+// helper function: check the process of `exitErr` was killed by killProcess, which exits
+// with status 1 on this platform.
+func assertKilled(t *testing.T, exitErr *exec.ExitError) {
+	assertEquals(t, 1, exitErr.ExitCode(), "exitCode")
+}
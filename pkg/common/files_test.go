@@ -0,0 +1,278 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+// helper function: skip tests relying on permission bits to restrict access, which are
+// derived from the read-only attribute on Windows.
+func skipWithoutPermissionBits(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission bits do not restrict access on windows")
+	}
+}
+
+// helper function: permission bits of the file at `path`.
+func filePerm(t *testing.T, path string) fs.FileMode {
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("could not stat file: %s", err.Error())
+	}
+	return info.Mode().Perm()
+}
+
+/* test cases for HasTrailingSeparator */
+func TestHasTrailingSeparator(t *testing.T) {
+	for path, expected := range map[string]bool{
+		"":          false,
+		"/":         true,
+		"data":      false,
+		"data/":     true,
+		"data/file": false,
+	} {
+		assertEquals(t, expected, HasTrailingSeparator(path), "HasTrailingSeparator("+path+")")
+	}
+
+	/* backslashes are separators on Windows only */
+	assertEquals(t, runtime.GOOS == "windows", HasTrailingSeparator(`C:\data\`), "HasTrailingSeparator")
+}
+
+/* test cases for FileMode */
+func TestFileMode(t *testing.T) {
+	// Setup Test
+	var cfg Config
+
+	// Perform the test
+	assertEquals(t, fs.FileMode(0600), cfg.FileMode(SecretFile), "cfg.FileMode(SecretFile)")
+	assertEquals(t, fs.FileMode(0600), cfg.FileMode(StateFile), "cfg.FileMode(StateFile)")
+	assertEquals(t, fs.FileMode(0644), cfg.FileMode(ReportFile), "cfg.FileMode(ReportFile)")
+
+	/* a nil config uses the defaults */
+	var nilCfg *Config
+	assertEquals(t, fs.FileMode(0600), nilCfg.FileMode(SecretFile), "nilCfg.FileMode(SecretFile)")
+
+	/* the configured mode applies to every class */
+	cfg.Backup.FileMode = "0640"
+	assertEquals(t, fs.FileMode(0640), cfg.FileMode(SecretFile), "cfg.FileMode(SecretFile)")
+	assertEquals(t, fs.FileMode(0640), cfg.FileMode(ReportFile), "cfg.FileMode(ReportFile)")
+}
+
+/* test cases for CreateFile */
+func TestCreateFile(t *testing.T) {
+	// Setup Test
+	setUmask(t, 022)
+	dir := t.TempDir()
+
+	// Perform the test
+	for mode, expected := range map[fs.FileMode]fs.FileMode{0600: 0600, 0644: 0644, 0666: 0644} {
+		file, err := CreateFile(filepath.Join(dir, fmt.Sprintf("%o", mode)), mode)
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		file.Close()
+		assertEquals(t, expected, filePerm(t, file.Name()), fmt.Sprintf("perm(%o)", mode))
+	}
+
+	/* existing files and symbolic links are not opened */
+	_, err := CreateFile(filepath.Join(dir, "600"), 0600)
+	assertEquals(t, true, os.IsExist(err), "os.IsExist(err)")
+	if err := os.Symlink(filepath.Join(dir, "target"), filepath.Join(dir, "link")); err != nil {
+		t.Fatalf("could not create symbolic link: %s", err.Error())
+	}
+	_, err = CreateFile(filepath.Join(dir, "link"), 0600)
+	assertEquals(t, true, os.IsExist(err), "os.IsExist(err)")
+	_, err = os.Lstat(filepath.Join(dir, "target"))
+	assertEquals(t, true, os.IsNotExist(err), "os.IsNotExist(err)")
+}
+
+/* test cases for CreateTempFile */
+func TestCreateTempFile(t *testing.T) {
+	// Setup Test
+	setUmask(t, 027)
+	dir := t.TempDir()
+	t.Setenv("TMPDIR", dir)
+
+	/* the random part replaces the last "*" */
+	file, err := CreateTempFile(dir, "upload-*.json", 0666)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	file.Close()
+	name := filepath.Base(file.Name())
+	assertEquals(t, true, strings.HasPrefix(name, "upload-") && strings.HasSuffix(name, ".json") && len(name) > len("upload-.json"), "name")
+	assertEquals(t, fs.FileMode(0640), filePerm(t, file.Name()), "perm")
+
+	/* the random part is appended without "*", in the default directory without `dir` */
+	file, err = CreateTempFile("", "squirrelup-backup-", 0600)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	file.Close()
+	assertEquals(t, dir, filepath.Dir(file.Name()), "dir")
+	assertEquals(t, true, strings.HasPrefix(filepath.Base(file.Name()), "squirrelup-backup-"), "name")
+	assertEquals(t, fs.FileMode(0600), filePerm(t, file.Name()), "perm")
+
+	/* missing directories are reported */
+	_, err = CreateTempFile(filepath.Join(dir, "missing"), "file-", 0600)
+	assertEquals(t, true, os.IsNotExist(err), "os.IsNotExist(err)")
+}
+
+/* test cases for AtomicWriteFile */
+func TestAtomicWriteFile(t *testing.T) {
+	// Setup Test
+	setUmask(t, 022)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+
+	// Perform the test
+	if err := AtomicWriteFile(path, []byte("first"), 0600); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	if err := AtomicWriteFile(path, []byte("second"), 0644); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	data, _ := os.ReadFile(path)
+	assertEquals(t, "second", string(data), "data")
+	assertEquals(t, fs.FileMode(0644), filePerm(t, path), "perm")
+
+	/* no temporary files are left behind */
+	entries, _ := os.ReadDir(dir)
+	assertEquals(t, 1, len(entries), "len(entries)")
+
+	/* failing to replace the file removes the temporary file */
+	if err := os.Mkdir(filepath.Join(dir, "directory"), 0700); err != nil {
+		t.Fatalf("could not create directory: %s", err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(dir, "directory", "entry"), nil, 0600); err != nil {
+		t.Fatalf("could not write file: %s", err.Error())
+	}
+	err := AtomicWriteFile(filepath.Join(dir, "directory"), []byte("third"), 0600)
+	assertEquals(t, true, err != nil, "err != nil")
+	entries, _ = os.ReadDir(dir)
+	assertEquals(t, 2, len(entries), "len(entries)")
+}
+
+/* test cases for modes of temporary backup files */
+func TestBackupFileModes(t *testing.T) {
+	// Setup Test
+	setUmask(t, 022)
+	cfg := setupBackupConfig(t)
+	srcDir := setupBackupSource(t)
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("could not generate identity: %s", err.Error())
+	}
+
+	/* archives and encrypted files are private by default */
+	archivePath, _, err := ArchiveDirectory(context.Background(), srcDir, cfg, ArchiveFilter{})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	defer os.Remove(archivePath)
+	assertEquals(t, fs.FileMode(0600), filePerm(t, archivePath), "perm(archive)")
+
+	encryptedPath, err := encryptFile(context.Background(), archivePath, []age.Recipient{identity.Recipient()}, cfg)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	defer os.Remove(encryptedPath)
+	assertEquals(t, fs.FileMode(0600), filePerm(t, encryptedPath), "perm(encrypted)")
+
+	/* the configured mode is reduced by the umask */
+	cfg.Backup.FileMode = "0666"
+	archivePath, _, err = ArchiveDirectory(context.Background(), srcDir, cfg, ArchiveFilter{})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	defer os.Remove(archivePath)
+	assertEquals(t, fs.FileMode(0644), filePerm(t, archivePath), "perm(archive)")
+}
+
+/* test cases for EncodeStateFile and DecodeStateFile */
+func TestStateFile(t *testing.T) {
+	// Setup Test
+	encoded := EncodeStateFile("test", []byte("state\n"))
+
+	// Perform the test
+	assertEquals(t, "squirrelup-state test v1 sha256:", string(encoded[:32]), "header")
+	data, err := DecodeStateFile("test", encoded)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "state\n", string(data), "data")
+
+	/* empty state is valid */
+	data, err = DecodeStateFile("test", EncodeStateFile("test", nil))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 0, len(data), "len(data)")
+
+	for raw, expected := range map[string]string{
+		"":                                    ErrStateFileUnknown,
+		"state\n":                             ErrStateFileUnknown,
+		string(EncodeStateFile("other", nil)): ErrStateFileUnknown,
+		strings.Replace(string(encoded), " v1 ", " v2 ", 1): ErrStateFileVersion + ": v2",
+		string(encoded[:len(encoded)-1]):                    ErrStateFileCorrupted,
+		string(encoded) + "appended":                        ErrStateFileCorrupted,
+	} {
+		_, err = DecodeStateFile("test", []byte(raw))
+		assertEquals(t, expected, fmt.Sprintf("%v", err), "err")
+	}
+}
+
+/* test cases for AtomicWriteFile when the process dies before the rename */
+func TestAtomicWriteFileCrash(t *testing.T) {
+	if path := os.Getenv("SQUIRRELUP_TEST_CRASH_STATE_FILE"); len(path) > 0 {
+		// kill the process once the temporary file is complete
+		beforeRename = func(string) { killProcess() }
+		_ = AtomicWriteFile(path, EncodeStateFile("test", []byte("second")), 0600)
+		t.Fatalf("the process was supposed to be killed")
+	}
+
+	// Setup Test
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state")
+	if err := AtomicWriteFile(path, EncodeStateFile("test", []byte("first")), 0600); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	// Perform the test
+	cmd := exec.Command(os.Args[0], "-test.run=^TestAtomicWriteFileCrash$")
+	cmd.Env = append(os.Environ(), "SQUIRRELUP_TEST_CRASH_STATE_FILE="+path)
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertKilled(t, exitErr)
+
+	/* the previous state is intact, the new one is left in a hidden temporary file */
+	raw, _ := os.ReadFile(path)
+	data, err := DecodeStateFile("test", raw)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "first", string(data), "data")
+	leftovers, _ := filepath.Glob(filepath.Join(dir, ".state-*"))
+	assertEquals(t, 1, len(leftovers), "len(leftovers)")
+
+	/* the next write replaces the state */
+	if err := AtomicWriteFile(path, EncodeStateFile("test", []byte("third")), 0600); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	raw, _ = os.ReadFile(path)
+	data, _ = DecodeStateFile("test", raw)
+	assertEquals(t, "third", string(data), "data")
+}
@@ -0,0 +1,26 @@
+//go:build unix
+
+package common
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+)
+
+// helper function: set the umask to `mask` for the duration of the test.
+func setUmask(t *testing.T, mask int) {
+	oldMask := syscall.Umask(mask)
+	t.Cleanup(func() { syscall.Umask(oldMask) })
+}
+
+// helper function: kill the test process without giving it a chance to clean up.
+func killProcess() {
+	_ = syscall.Kill(os.Getpid(), syscall.SIGKILL)
+}
+
+// helper function: check the process of `exitErr` was killed by killProcess.
+func assertKilled(t *testing.T, exitErr *exec.ExitError) {
+	assertEquals(t, syscall.SIGKILL, exitErr.Sys().(syscall.WaitStatus).Signal(), "signal")
+}
@@ -0,0 +1,172 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+type (
+	// JournalEntry records the outcome of a backup run in the local journal.
+	JournalEntry struct {
+		// start of the run
+		Time        time.Time `json:"time"`
+		Source      string    `json:"source"`
+		Destination string    `json:"destination"`
+		// name of the stored object, empty if none was stored
+		Key           string  `json:"key,omitempty"`
+		SourceBytes   int64   `json:"source_bytes"`
+		ArchiveBytes  int64   `json:"archive_bytes"`
+		UploadedBytes int64   `json:"uploaded_bytes"`
+		Seconds       float64 `json:"duration_seconds"`
+		Status        string  `json:"status"`
+		// true if the backup was skipped as the backup directory did not change
+		Skipped bool `json:"skipped,omitempty"`
+		// outcomes of the upload and of the cleanup of old backups, see RunSummary
+		Upload  string `json:"upload,omitempty"`
+		Cleanup string `json:"cleanup,omitempty"`
+		// first line of the error of a failed run or the warning of a run with warnings
+		Error string `json:"error,omitempty"`
+		// warnings of the run in the order they were reported, and their number by code
+		Warnings      []Warning      `json:"warnings,omitempty"`
+		WarningCounts map[string]int `json:"warning_counts,omitempty"`
+	}
+)
+
+const (
+	// journal_file_name is the name of the journal next to the default configuration file.
+	journal_file_name = "journal.jsonl"
+)
+
+// JournalFilepath returns the path of the journal: `cfg.Backup.JournalPath` if set, otherwise
+// journal.jsonl in the directory of `defaultConfigFilepath`. Empty if neither is set.
+func JournalFilepath(cfg *Config, defaultConfigFilepath string) string {
+	if len(cfg.Backup.JournalPath) > 0 {
+		return cfg.Backup.JournalPath
+	}
+	if len(defaultConfigFilepath) == 0 {
+		return ""
+	}
+	return filepath.Join(filepath.Dir(defaultConfigFilepath), journal_file_name)
+}
+
+// NewJournalEntry returns the journal entry of the run described by `summary`.
+func NewJournalEntry(summary *RunSummary) JournalEntry {
+	entry := JournalEntry{
+		Time:        summary.Started,
+		Source:      summary.Source,
+		Destination: summary.Destination,
+		Seconds:     summary.Finished.Sub(summary.Started).Seconds(),
+		Status:      summary.Status,
+		Skipped:     summary.Skipped,
+		Upload:      summary.Upload,
+		Cleanup:     summary.Cleanup,
+		Warnings:    summary.Warnings,
+	}
+	entry.WarningCounts = CountWarnings(summary.Warnings)
+	if summary.Result != nil {
+		if summary.Result.Stored && summary.Result.Object != nil {
+			entry.Key = path.Base(summary.Result.Object.Path)
+		}
+		entry.SourceBytes = summary.Result.Sizes.Source
+		entry.ArchiveBytes = summary.Result.Sizes.Archive
+		entry.UploadedBytes = summary.Result.Sizes.Uploaded
+	}
+	if summary.Err != nil {
+		entry.Error, _, _ = strings.Cut(summary.Err.Error(), "\n")
+	}
+	return entry
+}
+
+// AppendJournal appends `entry` to the journal at `journalPath`, creating it along with its
+// directory if needed. If the journal holds more than `maxEntries` entries afterwards, the
+// oldest ones are removed; 0 keeps all entries.
+func AppendJournal(journalPath string, entry JournalEntry, maxEntries int64) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("could not encode journal entry: %s", err.Error())
+	}
+	if err = os.MkdirAll(filepath.Dir(journalPath), 0700); err != nil {
+		return fmt.Errorf("could not create journal directory: %s", err.Error())
+	}
+	file, err := os.OpenFile(filepath.Clean(journalPath), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("could not open journal: %s", err.Error())
+	}
+	_, err = file.Write(append(line, '\n'))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("could not write journal: %s", err.Error())
+	}
+
+	if maxEntries > 0 {
+		return capJournal(journalPath, maxEntries)
+	}
+	return nil
+}
+
+// capJournal removes the oldest entries of the journal at `journalPath` beyond `maxEntries`.
+func capJournal(journalPath string, maxEntries int64) error {
+	data, err := os.ReadFile(filepath.Clean(journalPath))
+	if err != nil {
+		return fmt.Errorf("could not read journal: %s", err.Error())
+	}
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	if int64(len(lines)) <= maxEntries {
+		return nil
+	}
+	if err = AtomicWriteFile(journalPath, bytes.Join(lines[int64(len(lines))-maxEntries:], nil), 0600); err != nil {
+		return fmt.Errorf("could not shorten journal: %s", err.Error())
+	}
+	return nil
+}
+
+// ReadJournal returns the entries of the journal at `journalPath` in the order they were
+// recorded. Lines that cannot be parsed, such as one cut short by a crash, are skipped.
+func ReadJournal(journalPath string) ([]JournalEntry, error) {
+	file, err := os.Open(filepath.Clean(journalPath))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err == nil {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read journal: %s", err.Error())
+	}
+	return entries, nil
+}
+
+// QueryJournal returns the last `limit` of `entries` whose destination starts with `prefix`,
+// all matching entries if `limit` is 0.
+func QueryJournal(entries []JournalEntry, prefix string, limit int) []JournalEntry {
+	var matching []JournalEntry
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Destination, prefix) {
+			matching = append(matching, entry)
+		}
+	}
+	if limit > 0 && limit < len(matching) {
+		matching = matching[len(matching)-limit:]
+	}
+	return matching
+}
@@ -0,0 +1,131 @@
+package common
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// helper function: journal entry of a run of `destination` started `minute` minutes past 3:00.
+func journalEntry(destination string, minute int) JournalEntry {
+	return JournalEntry{
+		Time:        time.Date(2024, time.May, 1, 3, minute, 0, 0, time.UTC),
+		Source:      "/home/user",
+		Destination: destination,
+		Status:      RunSucceeded,
+	}
+}
+
+/* test cases for NewJournalEntry */
+func TestNewJournalEntry(t *testing.T) {
+	// Setup Test
+	started := time.Date(2024, time.May, 1, 3, 0, 0, 0, time.UTC)
+	object, _ := url.Parse("b2://bucket/prefix/2024-05-01T03+0000.tar.gz")
+	summary := RunSummary{
+		Status:      RunWarning,
+		Source:      "/home/user",
+		Destination: "b2://bucket/prefix/",
+		Started:     started,
+		Finished:    started.Add(90 * time.Second),
+		Upload:      StepSucceeded,
+		Cleanup:     StepFailed,
+		Result:      &BackupResult{Object: object, Stored: true, Sizes: BackupSizes{Source: 300, Archive: 200, Uploaded: 210}},
+		Err:         errors.New("backup size deviates\nfrom recent backups"),
+	}
+
+	// Perform the test
+	entry := NewJournalEntry(&summary)
+	assertEquals(t, started, entry.Time, "entry.Time")
+	assertEquals(t, "2024-05-01T03+0000.tar.gz", entry.Key, "entry.Key")
+	assertEquals(t, int64(210), entry.UploadedBytes, "entry.UploadedBytes")
+	assertEquals(t, 90.0, entry.Seconds, "entry.Seconds")
+	assertEquals(t, RunWarning, entry.Status, "entry.Status")
+	assertEquals(t, StepSucceeded, entry.Upload, "entry.Upload")
+	assertEquals(t, StepFailed, entry.Cleanup, "entry.Cleanup")
+	assertEquals(t, "backup size deviates", entry.Error, "entry.Error")
+
+	/* there is no key for backups that were not stored */
+	summary.Result.Stored = false
+	assertEquals(t, "", NewJournalEntry(&summary).Key, "entry.Key")
+
+	/* warnings are recorded along with their number by code */
+	assertEquals(t, 0, len(entry.Warnings), "len(entry.Warnings)")
+	summary.Warnings = []Warning{{WarningSizeAnomaly, "b2://bucket/prefix/2024-05-01T03+0000.tar.gz", "backup size deviates"}}
+	entry = NewJournalEntry(&summary)
+	assertEquals(t, summary.Warnings[0], entry.Warnings[0], "entry.Warnings[0]")
+	assertEquals(t, 1, entry.WarningCounts[WarningSizeAnomaly], "entry.WarningCounts")
+}
+
+/* test cases for AppendJournal */
+func TestAppendJournal(t *testing.T) {
+	// Setup Test
+	journalPath := filepath.Join(t.TempDir(), "squirrelup", "journal.jsonl")
+
+	/* entries are appended, creating the journal and its directory */
+	for minute := 0; minute < 3; minute++ {
+		if err := AppendJournal(journalPath, journalEntry("b2://bucket/prefix/", minute), 0); err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+	}
+	entries, err := ReadJournal(journalPath)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 3, len(entries), "len(entries)")
+	assertEquals(t, 2, entries[2].Time.Minute(), "entries[2].Time")
+
+	/* the oldest entries are removed beyond the maximum */
+	if err = AppendJournal(journalPath, journalEntry("b2://bucket/prefix/", 3), 2); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	entries, _ = ReadJournal(journalPath)
+	assertEquals(t, 2, len(entries), "len(entries)")
+	assertEquals(t, 2, entries[0].Time.Minute(), "entries[0].Time")
+	assertEquals(t, 3, entries[1].Time.Minute(), "entries[1].Time")
+
+	/* lines cut short are skipped */
+	file, _ := os.OpenFile(journalPath, os.O_WRONLY|os.O_APPEND, 0600)
+	_, _ = file.WriteString(`{"time":"2024-05-01T03:04:00Z","sour`)
+	_ = file.Close()
+	entries, _ = ReadJournal(journalPath)
+	assertEquals(t, 2, len(entries), "len(entries)")
+
+	/* failures are reported */
+	err = AppendJournal(filepath.Dir(journalPath), journalEntry("b2://bucket/prefix/", 4), 0)
+	if err == nil {
+		t.Fatalf("This test should throw an error")
+	}
+}
+
+/* test cases for QueryJournal */
+func TestQueryJournal(t *testing.T) {
+	// Setup Test
+	entries := []JournalEntry{
+		journalEntry("b2://bucket/home/", 0),
+		journalEntry("b2://other/home/", 1),
+		journalEntry("b2://bucket/home/", 2),
+		journalEntry("b2://bucket/work/", 3),
+	}
+
+	/* entries are filtered by destination prefix */
+	assertEquals(t, 3, len(QueryJournal(entries, "b2://bucket/", 0)), "len(QueryJournal)")
+	assertEquals(t, 4, len(QueryJournal(entries, "", 0)), "len(QueryJournal)")
+	assertEquals(t, 0, len(QueryJournal(entries, "b2://unknown/", 0)), "len(QueryJournal)")
+
+	/* and limited to the most recent ones */
+	matching := QueryJournal(entries, "b2://bucket/home/", 1)
+	assertEquals(t, 1, len(matching), "len(QueryJournal)")
+	assertEquals(t, 2, matching[0].Time.Minute(), "matching[0].Time")
+}
+
+/* test cases for JournalFilepath */
+func TestJournalFilepath(t *testing.T) {
+	var cfg Config
+	assertEquals(t, "", JournalFilepath(&cfg, ""), "JournalFilepath")
+	assertEquals(t, filepath.Join("config", "journal.jsonl"), JournalFilepath(&cfg, filepath.Join("config", "squirrelup.yml")), "JournalFilepath")
+	cfg.Backup.JournalPath = "/var/log/squirrelup.jsonl"
+	assertEquals(t, "/var/log/squirrelup.jsonl", JournalFilepath(&cfg, filepath.Join("config", "squirrelup.yml")), "JournalFilepath")
+}
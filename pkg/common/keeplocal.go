@@ -0,0 +1,108 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// renameFile moves a file, tests replace it to simulate moves across filesystems.
+var renameFile = os.Rename
+
+// keepLocalCopy places the file at `filePath` into `cfg.Backup.KeepLocalDir` as `name` and
+// returns the path of the copy. The file is moved unless `keepSource` is set or it cannot be
+// renamed, for instance because the directory is on another filesystem, in which case it is
+// copied. The copy is written under a hidden temporary name first, so the directory never
+// holds an incomplete copy under the final name.
+func keepLocalCopy(filePath, name string, keepSource bool, cfg *Config) (string, error) {
+	dir := cfg.Backup.KeepLocalDir
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("could not create local backup directory: %s", err.Error())
+	}
+	localPath := filepath.Join(dir, filepath.Base(name))
+	if !keepSource {
+		if err := renameFile(filePath, localPath); err == nil {
+			return localPath, nil
+		}
+	}
+
+	input, err := os.Open(filepath.Clean(filePath))
+	if err != nil {
+		return "", fmt.Errorf("could not open backup archive: %s", err.Error())
+	}
+	defer input.Close()
+	output, err := CreateTempFile(dir, "."+filepath.Base(name)+"-*", cfg.FileMode(SecretFile))
+	if err != nil {
+		return "", fmt.Errorf("could not create local copy: %s", err.Error())
+	}
+	_, err = CopyBuffer(output, input, cfg.BufferSize())
+	if err == nil {
+		err = output.Sync()
+	}
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(output.Name(), localPath)
+	}
+	if err != nil {
+		_ = os.Remove(output.Name())
+		return "", fmt.Errorf("could not copy backup archive to %q: %s", localPath, err.Error())
+	}
+	if !keepSource {
+		_ = os.Remove(filePath)
+	}
+	return localPath, nil
+}
+
+// pruneLocalCopies removes files in `cfg.Backup.KeepLocalDir` last modified longer than
+// `cfg.Backup.Hours` before `now` and returns their paths. Like the cleanup of the output
+// prefix it applies to every file in the directory, except hidden ones and subdirectories.
+// Files that cannot be removed are skipped, the first error is returned along with the
+// paths of the removed files.
+func pruneLocalCopies(cfg *Config, now time.Time) ([]string, error) {
+	entries, err := os.ReadDir(cfg.Backup.KeepLocalDir)
+	if err != nil {
+		return nil, fmt.Errorf("could not list local backup directory: %s", err.Error())
+	}
+
+	var removed []string
+	var firstErr error
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if now.Sub(info.ModTime()).Hours() < cfg.Backup.Hours {
+			continue
+		}
+		localPath := filepath.Join(cfg.Backup.KeepLocalDir, entry.Name())
+		if err := os.Remove(localPath); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("could not remove local copy: %s", err.Error())
+			}
+			continue
+		}
+		removed = append(removed, localPath)
+	}
+	return removed, firstErr
+}
+
+// keepLocal keeps the stored file at `filePath` as a local copy named `name`, failures are
+// reported as warnings of `result`.
+func keepLocal(filePath, name string, keepSource bool, cfg *Config, result *BackupResult, stdout, stderr io.Writer) {
+	localPath, err := keepLocalCopy(filePath, name, keepSource, cfg)
+	if err != nil {
+		warning := fmt.Sprintf("%s, the backup was not kept locally", err.Error())
+		cfg.Internal.Warnings.Report(stderr, WarningKeepLocal, name, warning)
+		result.Warnings = append(result.Warnings, warning)
+		return
+	}
+	fmt.Fprintf(stdout, "kept local copy of the backup at %q\n", localPath)
+}
@@ -0,0 +1,176 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// helper function: write `content` to a new file in `dir`, modified at `modified` if set.
+func writeLocalFile(t *testing.T, dir, name, content string, modified time.Time) string {
+	filePath := filepath.Join(dir, name)
+	if err := os.WriteFile(filePath, []byte(content), 0600); err != nil {
+		t.Fatalf("could not write to temporary file: %s", err.Error())
+	}
+	if !modified.IsZero() {
+		if err := os.Chtimes(filePath, modified, modified); err != nil {
+			t.Fatalf("could not set modification time: %s", err.Error())
+		}
+	}
+	return filePath
+}
+
+// helper function: list names of files in `dir`.
+func listLocalFiles(t *testing.T, dir string) string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("could not list directory: %s", err.Error())
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return strings.Join(names, " ")
+}
+
+/* test cases for keepLocalCopy */
+func TestKeepLocalCopy(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	srcDir := t.TempDir()
+	cfg.Backup.KeepLocalDir = filepath.Join(t.TempDir(), "local")
+
+	/* files are moved within a filesystem */
+	filePath := writeLocalFile(t, srcDir, "archive", "moved", time.Time{})
+	localPath, err := keepLocalCopy(filePath, "moved.tar.gz.age", false, cfg)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, filepath.Join(cfg.Backup.KeepLocalDir, "moved.tar.gz.age"), localPath, "localPath")
+	content, _ := os.ReadFile(localPath)
+	assertEquals(t, "moved", string(content), "content")
+	_, err = os.Stat(filePath)
+	assertEquals(t, true, errors.Is(err, os.ErrNotExist), "moved")
+
+	/* files are copied if they cannot be renamed */
+	renameFile = func(oldpath, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: errors.New("invalid cross-device link")}
+	}
+	t.Cleanup(func() { renameFile = os.Rename })
+	filePath = writeLocalFile(t, srcDir, "archive", "copied", time.Time{})
+	localPath, err = keepLocalCopy(filePath, "copied.tar.gz.age", false, cfg)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	content, _ = os.ReadFile(localPath)
+	assertEquals(t, "copied", string(content), "content")
+	_, err = os.Stat(filePath)
+	assertEquals(t, true, errors.Is(err, os.ErrNotExist), "copied")
+	if info, err := os.Stat(localPath); err != nil || info.Mode().Perm()&0077 != 0 {
+		t.Fatalf("unexpected mode of local copy: %+v, %+v", info, err)
+	}
+
+	/* files to keep in place are copied */
+	filePath = writeLocalFile(t, srcDir, "source", "kept", time.Time{})
+	_, err = keepLocalCopy(filePath, "kept", true, cfg)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	content, _ = os.ReadFile(filePath)
+	assertEquals(t, "kept", string(content), "source")
+	assertEquals(t, "copied.tar.gz.age kept moved.tar.gz.age", listLocalFiles(t, cfg.Backup.KeepLocalDir), "files")
+}
+
+/* test cases for pruneLocalCopies */
+func TestPruneLocalCopies(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	cfg.Backup.Hours = 24
+	cfg.Backup.KeepLocalDir = t.TempDir()
+	now := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	writeLocalFile(t, cfg.Backup.KeepLocalDir, "old", "old", now.Add(-48*time.Hour))
+	writeLocalFile(t, cfg.Backup.KeepLocalDir, "recent", "recent", now.Add(-time.Hour))
+	writeLocalFile(t, cfg.Backup.KeepLocalDir, ".hidden", "hidden", now.Add(-48*time.Hour))
+	if err := os.Mkdir(filepath.Join(cfg.Backup.KeepLocalDir, "subdir"), 0700); err != nil {
+		t.Fatalf("could not create directory: %s", err.Error())
+	}
+
+	// Perform the test
+	removed, err := pruneLocalCopies(cfg, now)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 1, len(removed), "len(removed)")
+	assertEquals(t, filepath.Join(cfg.Backup.KeepLocalDir, "old"), removed[0], "removed")
+	assertEquals(t, ".hidden recent subdir", listLocalFiles(t, cfg.Backup.KeepLocalDir), "files")
+
+	/* a missing directory is reported */
+	cfg.Backup.KeepLocalDir = filepath.Join(cfg.Backup.KeepLocalDir, "missing")
+	if _, err = pruneLocalCopies(cfg, now); err == nil {
+		t.Fatalf("pruneLocalCopies was supposed to fail")
+	}
+}
+
+func TestBackupKeepLocal(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	cfg.Backup.Hours = 24
+	cfg.Backup.KeepLocalDir = t.TempDir()
+	cfg.Backup.KeepLocalCleanup = true
+	srcDir := setupBackupSource(t)
+	memory := NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	nominalTime := time.Now()
+	writeLocalFile(t, cfg.Backup.KeepLocalDir, "expired.tar.gz", "expired", nominalTime.Add(-48*time.Hour))
+	var stdout, stderr bytes.Buffer
+
+	// Perform the test
+	result, err := Backup(context.Background(), BackupOptions{
+		Source:      srcDir,
+		Destination: prefixUri,
+		Config:      cfg,
+		Backend:     memory,
+		Time:        nominalTime,
+		Stdout:      &stdout,
+		Stderr:      &stderr,
+	})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	/* the stored archive is kept and old local copies are removed */
+	assertEquals(t, 0, len(result.Warnings), "len(result.Warnings)")
+	assertEquals(t, result.Name, listLocalFiles(t, cfg.Backup.KeepLocalDir), "files")
+	var buf bytes.Buffer
+	if err = memory.RetrieveFile(&buf, result.Object); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	content, _ := os.ReadFile(filepath.Join(cfg.Backup.KeepLocalDir, result.Name))
+	assertEquals(t, true, bytes.Equal(buf.Bytes(), content), "content")
+	assertEquals(t, true, strings.Contains(stdout.String(), "removed local copy "), "stdout")
+
+	/* failures to keep the archive are warnings */
+	blocker := writeLocalFile(t, t.TempDir(), "file", "file", time.Time{})
+	cfg.Backup.KeepLocalDir = filepath.Join(blocker, "local")
+	result, err = Backup(context.Background(), BackupOptions{
+		Source:      srcDir,
+		Destination: prefixUri,
+		Config:      cfg,
+		Backend:     memory,
+		Time:        nominalTime.Add(time.Hour),
+		Stdout:      &stdout,
+		Stderr:      &stderr,
+	})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, result.Stored, "result.Stored")
+	assertEquals(t, 2, len(result.Warnings), "len(result.Warnings)")
+	assertEquals(t, true, strings.HasSuffix(result.Warnings[0], ", the backup was not kept locally"), "result.Warnings")
+}
@@ -0,0 +1,247 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+type (
+	// Keyring stores secrets by service and account name.
+	Keyring interface {
+		// Get returns the secret of `service` and `account`, ErrKeyringNotFound if there is none.
+		Get(service, account string) (string, error)
+		// Set stores `secret` for `service` and `account`, replacing the previous one.
+		Set(service, account, secret string) error
+		// Delete removes the secret of `service` and `account`, ErrKeyringNotFound if there is none.
+		Delete(service, account string) error
+	}
+
+	// S3Credentials are the application key ID and secret stored in a keyring entry.
+	S3Credentials struct {
+		ID     string `json:"id"`
+		Secret string `json:"secret"`
+	}
+
+	// MemoryKeyring is a keyring that keeps secrets in memory.
+	MemoryKeyring struct {
+		lock    sync.Mutex
+		secrets map[[2]string]string
+	}
+
+	// commandKeyring accesses the keyring through the command line tool of the operating system,
+	// secret-tool of libsecret (Secret Service) or security on macOS (Keychain).
+	commandKeyring struct {
+		darwin bool
+		// runs `args` with `stdin` as standard input and returns the standard output, tests
+		// replace it
+		run func(stdin string, args ...string) (string, error)
+	}
+
+	// keyringCommandError is the failure of a keyring command along with its exit code and
+	// error output.
+	keyringCommandError struct {
+		command string
+		code    int
+		stderr  string
+	}
+)
+
+const (
+	// CredentialSourceConfig reads S3 credentials from the configuration file and environment.
+	CredentialSourceConfig = "config"
+	// CredentialSourceKeyring reads S3 credentials from the keyring of the operating system,
+	// falling back to the configuration file and environment.
+	CredentialSourceKeyring = "keyring"
+
+	// label of keyring entries holding S3 credentials
+	keyring_label = "SquirrelUp S3 credentials"
+)
+
+var (
+	// ErrKeyringNotFound is returned by keyrings holding no entry for a service and account.
+	ErrKeyringNotFound = errors.New("no entry found in the keyring")
+
+	// SystemKeyring holds S3 credentials in the keyring of the operating system, tests replace it.
+	SystemKeyring Keyring = newSystemKeyring()
+)
+
+func (kce *keyringCommandError) Error() string {
+	return fmt.Sprintf("%s failed with exit status %d: %s", kce.command, kce.code, kce.stderr)
+}
+
+// NewMemoryKeyring creates an empty MemoryKeyring.
+func NewMemoryKeyring() *MemoryKeyring {
+	return &MemoryKeyring{secrets: map[[2]string]string{}}
+}
+
+// Get returns the secret of `service` and `account`.
+func (mk *MemoryKeyring) Get(service, account string) (string, error) {
+	mk.lock.Lock()
+	defer mk.lock.Unlock()
+	secret, prs := mk.secrets[[2]string{service, account}]
+	if !prs {
+		return "", ErrKeyringNotFound
+	}
+	return secret, nil
+}
+
+// Set stores `secret` for `service` and `account`.
+func (mk *MemoryKeyring) Set(service, account, secret string) error {
+	mk.lock.Lock()
+	defer mk.lock.Unlock()
+	mk.secrets[[2]string{service, account}] = secret
+	return nil
+}
+
+// Delete removes the secret of `service` and `account`.
+func (mk *MemoryKeyring) Delete(service, account string) error {
+	mk.lock.Lock()
+	defer mk.lock.Unlock()
+	if _, prs := mk.secrets[[2]string{service, account}]; !prs {
+		return ErrKeyringNotFound
+	}
+	delete(mk.secrets, [2]string{service, account})
+	return nil
+}
+
+// runKeyringCommand runs `args` with `stdin` as standard input and returns the standard output.
+func runKeyringCommand(stdin string, args ...string) (string, error) {
+	if _, err := exec.LookPath(args[0]); err != nil {
+		return "", fmt.Errorf("%s is not available: %s", args[0], err.Error())
+	}
+	command := exec.Command(args[0], args[1:]...)
+	command.Stdin = strings.NewReader(stdin)
+	var stderr strings.Builder
+	command.Stderr = &stderr
+	output, err := command.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return "", &keyringCommandError{args[0], exitErr.ExitCode(), strings.TrimSpace(stderr.String())}
+		}
+		return "", fmt.Errorf("%s failed: %s", args[0], err.Error())
+	}
+	return string(output), nil
+}
+
+// notFound reports whether `err` of a keyring command means the entry does not exist. The
+// security command exits with 44 then, secret-tool exits with 1 without an error message.
+func (ck *commandKeyring) notFound(err error) bool {
+	var commandErr *keyringCommandError
+	if !errors.As(err, &commandErr) {
+		return false
+	}
+	if ck.darwin {
+		return commandErr.code == 44
+	}
+	return commandErr.code == 1 && len(commandErr.stderr) == 0
+}
+
+// Get returns the secret of `service` and `account`.
+func (ck *commandKeyring) Get(service, account string) (string, error) {
+	var output string
+	var err error
+	if ck.darwin {
+		output, err = ck.run("", "security", "find-generic-password", "-s", service, "-a", account, "-w")
+	} else {
+		output, err = ck.run("", "secret-tool", "lookup", "service", service, "account", account)
+	}
+	if err != nil && ck.notFound(err) {
+		return "", ErrKeyringNotFound
+	} else if err != nil {
+		return "", err
+	}
+	if ck.darwin {
+		// security terminates the secret with a newline
+		output = strings.TrimSuffix(output, "\n")
+	}
+	if len(output) == 0 {
+		return "", ErrKeyringNotFound
+	}
+	return output, nil
+}
+
+// Set stores `secret` for `service` and `account`. The secret is passed on standard input,
+// so it does not show up in the list of processes.
+func (ck *commandKeyring) Set(service, account, secret string) error {
+	if ck.darwin {
+		quote := func(text string) string {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(text) + `"`
+		}
+		_, err := ck.run("add-generic-password -U -l "+quote(keyring_label)+" -s "+quote(service)+" -a "+quote(account)+" -w "+quote(secret)+"\n", "security", "-i")
+		return err
+	}
+	_, err := ck.run(secret, "secret-tool", "store", "--label", keyring_label, "service", service, "account", account)
+	return err
+}
+
+// Delete removes the secret of `service` and `account`.
+func (ck *commandKeyring) Delete(service, account string) error {
+	var err error
+	if ck.darwin {
+		_, err = ck.run("", "security", "delete-generic-password", "-s", service, "-a", account)
+	} else {
+		// secret-tool clear succeeds whether there is an entry or not
+		if _, err = ck.Get(service, account); err != nil {
+			return err
+		}
+		_, err = ck.run("", "secret-tool", "clear", "service", service, "account", account)
+	}
+	if err != nil && ck.notFound(err) {
+		return ErrKeyringNotFound
+	}
+	return err
+}
+
+// EncodeS3Credentials returns `credentials` as stored in a keyring entry.
+func EncodeS3Credentials(credentials S3Credentials) (string, error) {
+	data, err := json.Marshal(credentials)
+	if err != nil {
+		return "", fmt.Errorf("could not encode credentials: %s", err.Error())
+	}
+	return string(data), nil
+}
+
+// decodeS3Credentials parses the credentials stored in a keyring entry.
+func decodeS3Credentials(secret string) (S3Credentials, error) {
+	var credentials S3Credentials
+	if err := json.Unmarshal([]byte(secret), &credentials); err != nil {
+		return credentials, fmt.Errorf("could not parse credentials: %s", err.Error())
+	}
+	if len(credentials.ID) == 0 || len(credentials.Secret) == 0 {
+		return credentials, fmt.Errorf("could not parse credentials: the key ID or secret is missing")
+	}
+	return credentials, nil
+}
+
+// ResolveCredentials reads the S3 key ID and secret from `keyring` into `cfg` if
+// `cfg.S3.CredentialSource` is CredentialSourceKeyring. If the keyring is unavailable or
+// holds no usable entry, the credentials of the configuration file and environment are kept
+// and the reason is written to `stderr`.
+func ResolveCredentials(cfg *Config, keyring Keyring, stderr io.Writer) {
+	if cfg.S3.CredentialSource != CredentialSourceKeyring {
+		return
+	}
+
+	secret, err := keyring.Get(cfg.S3.KeyringService, cfg.S3.KeyringAccount)
+	var credentials S3Credentials
+	if err == nil {
+		credentials, err = decodeS3Credentials(secret)
+	}
+	if err != nil {
+		if errors.Is(err, ErrKeyringNotFound) {
+			err = fmt.Errorf("no credentials stored for service %q and account %q", cfg.S3.KeyringService, cfg.S3.KeyringAccount)
+		}
+		fmt.Fprintf(stderr, "warning: could not read S3 credentials from the keyring: %s, using the configuration file and environment instead\n", err.Error())
+		return
+	}
+
+	cfg.S3.ID, cfg.S3.Secret = credentials.ID, credentials.Secret
+	cfg.SetSource("s3.id", ConfigSourceKeyring)
+	cfg.SetSource("s3.secret", ConfigSourceKeyring)
+}
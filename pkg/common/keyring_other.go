@@ -0,0 +1,11 @@
+//go:build !windows
+
+package common
+
+import "runtime"
+
+// newSystemKeyring returns the keyring of the operating system, the Keychain on macOS and
+// the Secret Service elsewhere.
+func newSystemKeyring() Keyring {
+	return &commandKeyring{darwin: runtime.GOOS == "darwin", run: runKeyringCommand}
+}
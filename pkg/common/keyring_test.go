@@ -0,0 +1,121 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// helper function: command keyring recording the commands it runs, which return `output`
+// and `err`.
+func setupCommandKeyring(darwin bool, output string, err error) (*commandKeyring, *[]string) {
+	var commands []string
+	keyring := &commandKeyring{darwin: darwin, run: func(stdin string, args ...string) (string, error) {
+		commands = append(commands, strings.Join(args, " ")+" < "+stdin)
+		return output, err
+	}}
+	return keyring, &commands
+}
+
+/* test cases for commandKeyring */
+func TestCommandKeyring(t *testing.T) {
+	/* secrets are read with secret-tool */
+	keyring, commands := setupCommandKeyring(false, `{"id":"key"}`, nil)
+	secret, err := keyring.Get("squirrelup", "default")
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, `{"id":"key"}`, secret, "secret")
+	assertEquals(t, "secret-tool lookup service squirrelup account default < ", (*commands)[0], "commands")
+
+	/* secrets are passed on standard input */
+	keyring, commands = setupCommandKeyring(false, "", nil)
+	if err = keyring.Set("squirrelup", "default", "secret"); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "secret-tool store --label SquirrelUp S3 credentials service squirrelup account default < secret", (*commands)[0], "commands")
+
+	/* secret-tool exits with 1 and no message for missing entries */
+	keyring, _ = setupCommandKeyring(false, "", &keyringCommandError{"secret-tool", 1, ""})
+	_, err = keyring.Get("squirrelup", "default")
+	assertEquals(t, ErrKeyringNotFound, err, "err")
+	assertEquals(t, ErrKeyringNotFound, keyring.Delete("squirrelup", "default"), "err")
+
+	/* other failures are reported */
+	keyring, _ = setupCommandKeyring(false, "", &keyringCommandError{"secret-tool", 1, "Cannot autolaunch D-Bus without X11 $DISPLAY"})
+	_, err = keyring.Get("squirrelup", "default")
+	assertEquals(t, "secret-tool failed with exit status 1: Cannot autolaunch D-Bus without X11 $DISPLAY", err.Error(), "err")
+
+	/* the Keychain is accessed with security on macOS */
+	keyring, commands = setupCommandKeyring(true, "secret\n", nil)
+	secret, err = keyring.Get("squirrelup", "default")
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "secret", secret, "secret")
+	if err = keyring.Set("squirrelup", "default", `se"cret`); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "security -i < add-generic-password -U -l \"SquirrelUp S3 credentials\" -s \"squirrelup\" -a \"default\" -w \"se\\\"cret\"\n", (*commands)[1], "commands")
+	keyring, _ = setupCommandKeyring(true, "", &keyringCommandError{"security", 44, "The specified item could not be found in the keychain."})
+	_, err = keyring.Get("squirrelup", "default")
+	assertEquals(t, ErrKeyringNotFound, err, "err")
+}
+
+/* test cases for ResolveCredentials */
+func TestResolveCredentials(t *testing.T) {
+	// Setup Test
+	var cfg Config
+	if err := cfg.SetDefaultValues(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	cfg.S3.ID, cfg.S3.Secret = "file-id", "file-secret"
+	keyring := NewMemoryKeyring()
+	var stderr bytes.Buffer
+
+	/* the keyring is only read if configured */
+	_ = keyring.Set("squirrelup", "default", `{"id":"keyring-id","secret":"keyring-secret"}`)
+	ResolveCredentials(&cfg, keyring, &stderr)
+	assertEquals(t, "file-id", cfg.S3.ID, "cfg.S3.ID")
+
+	/* credentials of the keyring replace configured ones */
+	cfg.S3.CredentialSource = CredentialSourceKeyring
+	ResolveCredentials(&cfg, keyring, &stderr)
+	assertEquals(t, "keyring-id", cfg.S3.ID, "cfg.S3.ID")
+	assertEquals(t, "keyring-secret", cfg.S3.Secret, "cfg.S3.Secret")
+	assertEquals(t, ConfigSourceKeyring, cfg.Source("s3.secret"), "cfg.Source")
+	assertEquals(t, "", stderr.String(), "stderr")
+
+	/* configured credentials are kept if the keyring has none */
+	cfg.S3.ID, cfg.S3.Secret, cfg.S3.KeyringAccount = "file-id", "file-secret", "other"
+	ResolveCredentials(&cfg, keyring, &stderr)
+	assertEquals(t, "file-id", cfg.S3.ID, "cfg.S3.ID")
+	assertEquals(t, "warning: could not read S3 credentials from the keyring: no credentials stored for service \"squirrelup\" and account \"other\", using the configuration file and environment instead\n", stderr.String(), "stderr")
+
+	/* or if the keyring is unavailable */
+	stderr.Reset()
+	unavailable, _ := setupCommandKeyring(false, "", errors.New("secret-tool is not available"))
+	ResolveCredentials(&cfg, unavailable, &stderr)
+	assertEquals(t, "file-secret", cfg.S3.Secret, "cfg.S3.Secret")
+	assertEquals(t, true, strings.Contains(stderr.String(), "secret-tool is not available"), "stderr")
+
+	/* entries without a secret are rejected */
+	stderr.Reset()
+	_ = keyring.Set("squirrelup", "other", `{"id":"keyring-id"}`)
+	ResolveCredentials(&cfg, keyring, &stderr)
+	assertEquals(t, "file-id", cfg.S3.ID, "cfg.S3.ID")
+	assertEquals(t, true, strings.Contains(stderr.String(), "the key ID or secret is missing"), "stderr")
+}
+
+/* test cases for MemoryKeyring */
+func TestMemoryKeyring(t *testing.T) {
+	keyring := NewMemoryKeyring()
+	_, err := keyring.Get("service", "account")
+	assertEquals(t, ErrKeyringNotFound, err, "err")
+	_ = keyring.Set("service", "account", "secret")
+	secret, _ := keyring.Get("service", "account")
+	assertEquals(t, "secret", secret, "secret")
+	assertEquals(t, nil, keyring.Delete("service", "account"), "err")
+	assertEquals(t, ErrKeyringNotFound, keyring.Delete("service", "account"), "err")
+}
@@ -0,0 +1,126 @@
+//go:build windows
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+type (
+	// windowsCredential mirrors the CREDENTIALW structure of the Credential Manager.
+	windowsCredential struct {
+		Flags              uint32
+		Type               uint32
+		TargetName         *uint16
+		Comment            *uint16
+		LastWritten        windows.Filetime
+		CredentialBlobSize uint32
+		CredentialBlob     *byte
+		Persist            uint32
+		AttributeCount     uint32
+		Attributes         uintptr
+		TargetAlias        *uint16
+		UserName           *uint16
+	}
+
+	// windowsKeyring holds secrets as generic credentials of the Windows Credential Manager,
+	// named after the service and account.
+	windowsKeyring struct{}
+)
+
+const (
+	// generic credentials of the Credential Manager, persisted for the user on this machine
+	cred_type_generic          = 1
+	cred_persist_local_machine = 2
+)
+
+var (
+	advapi32        = windows.NewLazySystemDLL("advapi32.dll")
+	procCredReadW   = advapi32.NewProc("CredReadW")
+	procCredWriteW  = advapi32.NewProc("CredWriteW")
+	procCredDeleteW = advapi32.NewProc("CredDeleteW")
+	procCredFree    = advapi32.NewProc("CredFree")
+)
+
+// newSystemKeyring returns the Windows Credential Manager.
+func newSystemKeyring() Keyring {
+	return windowsKeyring{}
+}
+
+// credentialTarget returns the name of the credential of `service` and `account`.
+func credentialTarget(service, account string) (*uint16, error) {
+	return windows.UTF16PtrFromString(service + ":" + account)
+}
+
+// credentialError converts the error of a Credential Manager call.
+func credentialError(call string, err error) error {
+	if errors.Is(err, windows.ERROR_NOT_FOUND) {
+		return ErrKeyringNotFound
+	}
+	return fmt.Errorf("%s failed: %s", call, err.Error())
+}
+
+// Get returns the secret of `service` and `account`.
+func (windowsKeyring) Get(service, account string) (string, error) {
+	target, err := credentialTarget(service, account)
+	if err != nil {
+		return "", err
+	}
+	var credential *windowsCredential
+	ret, _, err := procCredReadW.Call(uintptr(unsafe.Pointer(target)), cred_type_generic, 0, uintptr(unsafe.Pointer(&credential)))
+	if ret == 0 {
+		return "", credentialError("CredRead", err)
+	}
+	defer procCredFree.Call(uintptr(unsafe.Pointer(credential)))
+	return string(unsafe.Slice(credential.CredentialBlob, credential.CredentialBlobSize)), nil
+}
+
+// Set stores `secret` for `service` and `account`.
+func (windowsKeyring) Set(service, account, secret string) error {
+	target, err := credentialTarget(service, account)
+	if err != nil {
+		return err
+	}
+	userName, err := windows.UTF16PtrFromString(account)
+	if err != nil {
+		return err
+	}
+	comment, err := windows.UTF16PtrFromString(keyring_label)
+	if err != nil {
+		return err
+	}
+	blob := []byte(secret)
+	credential := windowsCredential{
+		Type:               cred_type_generic,
+		TargetName:         target,
+		Comment:            comment,
+		CredentialBlobSize: uint32(len(blob)),
+		Persist:            cred_persist_local_machine,
+		UserName:           userName,
+	}
+	if len(blob) > 0 {
+		credential.CredentialBlob = &blob[0]
+	}
+	ret, _, err := procCredWriteW.Call(uintptr(unsafe.Pointer(&credential)), 0)
+	if ret == 0 {
+		return credentialError("CredWrite", err)
+	}
+	return nil
+}
+
+// Delete removes the secret of `service` and `account`.
+func (windowsKeyring) Delete(service, account string) error {
+	target, err := credentialTarget(service, account)
+	if err != nil {
+		return err
+	}
+	ret, _, err := procCredDeleteW.Call(uintptr(unsafe.Pointer(target)), cred_type_generic, 0)
+	if ret == 0 {
+		return credentialError("CredDelete", err)
+	}
+	return nil
+}
@@ -0,0 +1,207 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+type (
+	// Lease is the content of the lease object.
+	Lease struct {
+		Host    string    `json:"host"`
+		PID     int       `json:"pid"`
+		Expires time.Time `json:"expires"`
+		// random value identifying the run holding the lease
+		Token string `json:"token"`
+	}
+
+	// PrefixLease is a lease held on a prefix, see AcquireLease. It is renewed while held.
+	PrefixLease struct {
+		backend StorageBackend
+		uri     *url.URL
+		ttl     time.Duration
+		lease   Lease
+		lock    sync.Mutex
+		stop    chan struct{}
+		done    chan struct{}
+		stderr  io.Writer
+	}
+)
+
+const (
+	// LeaseObjectName is the name of the object announcing the host writing to a prefix.
+	LeaseObjectName = ".squirrelup-lease"
+
+	// lease_clock_skew is the time a lease of another host is still respected after it
+	// expired, clocks of hosts sharing a prefix may differ by up to this much
+	lease_clock_skew = 2 * time.Minute
+	// lease_poll_interval is the time between checks of a lease held by another host
+	lease_poll_interval = 5 * time.Second
+)
+
+var (
+	// leaseWait waits for `d` or until `ctx` is done, tests replace it to avoid sleeping.
+	leaseWait = func(ctx context.Context, d time.Duration) error {
+		return cleanupWait(ctx, d)
+	}
+)
+
+// String describes the holder of the lease.
+func (lease *Lease) String() string {
+	return fmt.Sprintf("host %s (pid %d) until %s", lease.Host, lease.PID, lease.Expires.Format(time.RFC3339))
+}
+
+// AcquireLease stores a lease object under `prefix` announcing that this host writes to it for
+// backup.lease_ttl_seconds, the lease is renewed until it is released. If another host holds a
+// lease that has not expired, allowing for clock skew, it is waited for up to
+// backup.lease_wait_seconds and the acquisition fails afterwards. Expired and unreadable leases
+// and leases of this host are overwritten. The lease is read back once stored, so that a host
+// losing a race for it fails instead of writing along with the winner.
+func AcquireLease(backend StorageBackend, cfg *Config, prefix *url.URL, stderr io.Writer) (*PrefixLease, error) {
+	stderr = writerOrDiscard(stderr)
+	host, err := cfg.BackupHostname()
+	if err != nil {
+		return nil, err
+	}
+	token := make([]byte, 16)
+	if _, err = rand.Read(token); err != nil {
+		return nil, fmt.Errorf("could not create lease token: %s", err.Error())
+	}
+	pl := &PrefixLease{
+		backend: backend,
+		uri:     ResolveObjectURI(prefix, LeaseObjectName),
+		ttl:     time.Duration(cfg.Backup.LeaseTTLSeconds * float64(time.Second)),
+		lease:   Lease{Host: host, PID: os.Getpid(), Token: hex.EncodeToString(token)},
+		stderr:  stderr,
+	}
+
+	/* wait for leases of other hosts to be released or to expire */
+	deadline := Now().Add(time.Duration(cfg.Backup.LeaseWaitSeconds * float64(time.Second)))
+	for {
+		current, err := pl.read()
+		if err != nil {
+			return nil, err
+		}
+		if current == nil || current.Host == host || !Now().Before(current.Expires.Add(lease_clock_skew)) {
+			break
+		}
+		remaining := deadline.Sub(Now())
+		if remaining <= 0 {
+			return nil, fmt.Errorf("prefix %q is being written by %s, remove %q if that host is no longer running", prefix, current, pl.uri)
+		}
+		fmt.Fprintf(stderr, "waiting for the lease of %s on %q...\n", current, prefix)
+		if err = leaseWait(context.Background(), min(remaining, lease_poll_interval)); err != nil {
+			return nil, err
+		}
+	}
+
+	/* store the lease and verify that no other host overwrote it */
+	if err = pl.store(); err != nil {
+		return nil, err
+	}
+	current, err := pl.read()
+	if err != nil {
+		return nil, err
+	}
+	if current == nil || current.Token != pl.lease.Token {
+		holder := "another host"
+		if current != nil {
+			holder = current.String()
+		}
+		return nil, fmt.Errorf("lost the lease on prefix %q to %s", prefix, holder)
+	}
+
+	pl.stop, pl.done = make(chan struct{}), make(chan struct{})
+	go pl.renewPeriodically()
+	return pl, nil
+}
+
+// Release stops renewing the lease and removes the lease object, unless another host took it over.
+func (pl *PrefixLease) Release() error {
+	close(pl.stop)
+	<-pl.done
+
+	current, err := pl.read()
+	if err != nil {
+		return err
+	}
+	if current == nil || current.Token != pl.lease.Token {
+		return nil
+	}
+	if err = pl.backend.RemoveFile(pl.uri); err != nil {
+		return fmt.Errorf("could not remove lease %q: %s", pl.uri, err.Error())
+	}
+	return nil
+}
+
+// renewPeriodically extends the lease every third of its lifetime until it is released. It
+// stops once the lease was removed or taken over by another host, so that it is not overwritten.
+func (pl *PrefixLease) renewPeriodically() {
+	defer close(pl.done)
+	ticker := time.NewTicker(max(pl.ttl/3, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-pl.stop:
+			return
+		case <-ticker.C:
+			current, err := pl.read()
+			if err == nil && current == nil {
+				fmt.Fprintf(pl.stderr, "warning: lease %q was removed, it is no longer renewed\n", pl.uri)
+				return
+			}
+			if err == nil && current.Token != pl.lease.Token {
+				fmt.Fprintf(pl.stderr, "warning: lost the lease %q to %s, it is no longer renewed\n", pl.uri, current)
+				return
+			}
+			if err == nil {
+				err = pl.store()
+			}
+			if err != nil {
+				fmt.Fprintf(pl.stderr, "warning: %s\n", err.Error())
+			}
+		}
+	}
+}
+
+// store writes the lease object with an expiry one lifetime from now.
+func (pl *PrefixLease) store() error {
+	pl.lock.Lock()
+	defer pl.lock.Unlock()
+	pl.lease.Expires = Now().Add(pl.ttl).UTC()
+	data, err := json.Marshal(&pl.lease)
+	if err != nil {
+		return fmt.Errorf("could not encode lease: %s", err.Error())
+	}
+	err = pl.backend.StoreFile(context.Background(), StoreRequest{URI: pl.uri, BodyAt: bytes.NewReader(data), Length: int64(len(data)), Quiet: true})
+	if err != nil {
+		return fmt.Errorf("could not store lease %q: %s", pl.uri, err.Error())
+	}
+	return nil
+}
+
+// read returns the lease stored under the prefix, nil if there is none or it cannot be parsed.
+func (pl *PrefixLease) read() (*Lease, error) {
+	var buf bytes.Buffer
+	if err := pl.backend.RetrieveFile(&buf, pl.uri); err != nil {
+		if err.Error() == ErrFileNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("could not read lease %q: %s", pl.uri, err.Error())
+	}
+	var lease Lease
+	if err := json.Unmarshal(buf.Bytes(), &lease); err != nil {
+		fmt.Fprintf(pl.stderr, "warning: ignoring unreadable lease %q: %s\n", pl.uri, err.Error())
+		return nil, nil
+	}
+	return &lease, nil
+}
@@ -0,0 +1,204 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// leaseStealingBackend is a MemoryBackend on which another host overwrites every lease stored.
+type leaseStealingBackend struct {
+	*MemoryBackend
+}
+
+func (lsb *leaseStealingBackend) StoreFile(ctx context.Context, req StoreRequest) error {
+	data, _ := json.Marshal(&Lease{Host: "host-b", PID: 2, Expires: Now().Add(time.Hour), Token: "stolen"})
+	return lsb.MemoryBackend.StoreFile(ctx, StoreRequest{URI: req.URI, BodyAt: bytes.NewReader(data), Length: int64(len(data))})
+}
+
+// helper function: store a lease of `host` expiring at `expires` under `prefixUri`.
+func storeLease(t *testing.T, memory *MemoryBackend, prefixUri *url.URL, host string, expires time.Time) {
+	data, _ := json.Marshal(&Lease{Host: host, PID: 2, Expires: expires, Token: "other"})
+	uri := ResolveObjectURI(prefixUri, LeaseObjectName)
+	if err := memory.StoreFile(context.Background(), StoreRequest{URI: uri, BodyAt: bytes.NewReader(data), Length: int64(len(data))}); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+}
+
+// helper function: read the lease stored under `prefixUri`.
+func readLease(t *testing.T, memory *MemoryBackend, prefixUri *url.URL) *Lease {
+	pl := &PrefixLease{backend: memory, uri: ResolveObjectURI(prefixUri, LeaseObjectName)}
+	lease, err := pl.read()
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	return lease
+}
+
+/* test cases for AcquireLease */
+func TestAcquireLease(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	cfg.Backup.Hostname = "host-a"
+	now := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	Now = func() time.Time { return now }
+	t.Cleanup(func() { Now = time.Now })
+	memory := NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+
+	/* the lease is stored while held and removed once released */
+	lease, err := AcquireLease(memory, cfg, prefixUri, nil)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	stored := readLease(t, memory, prefixUri)
+	assertEquals(t, "host-a", stored.Host, "stored.Host")
+	assertEquals(t, now.Add(10*time.Minute), stored.Expires, "stored.Expires")
+	assertEquals(t, false, IsBackupObject(LeaseObjectName), "IsBackupObject")
+	if err = lease.Release(); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, readLease(t, memory, prefixUri) == nil, "released lease")
+
+	/* leases of other hosts are respected until they expire, allowing for clock skew */
+	for _, testCase := range []struct {
+		host     string
+		expires  time.Time
+		acquired bool
+	}{
+		{"host-b", now.Add(time.Minute), false},
+		{"host-b", now.Add(-time.Minute), false},
+		{"host-b", now.Add(-lease_clock_skew), true},
+		{"host-a", now.Add(time.Hour), true},
+	} {
+		storeLease(t, memory, prefixUri, testCase.host, testCase.expires)
+		lease, err = AcquireLease(memory, cfg, prefixUri, nil)
+		assertEquals(t, testCase.acquired, err == nil, fmt.Sprintf("AcquireLease(%s, %s)", testCase.host, testCase.expires))
+		if err == nil {
+			assertEquals(t, "host-a", readLease(t, memory, prefixUri).Host, "stored.Host")
+			_ = lease.Release()
+		} else {
+			assertEquals(t, fmt.Sprintf(`prefix "memory://bucket/prefix/" is being written by host host-b (pid 2) until %s, remove "memory://bucket/prefix/.squirrelup-lease" if that host is no longer running`, testCase.expires.Format(time.RFC3339)), err.Error(), "err.Error")
+		}
+	}
+
+	/* unreadable leases are overwritten */
+	uri := ResolveObjectURI(prefixUri, LeaseObjectName)
+	_ = memory.StoreFile(context.Background(), StoreRequest{URI: uri, BodyAt: strings.NewReader("garbage"), Length: 7})
+	var stderr bytes.Buffer
+	lease, err = AcquireLease(memory, cfg, prefixUri, &stderr)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, strings.HasPrefix(stderr.String(), `warning: ignoring unreadable lease "memory://bucket/prefix/.squirrelup-lease"`), "stderr")
+
+	/* a lease taken over by another host is left in place */
+	storeLease(t, memory, prefixUri, "host-b", now.Add(time.Hour))
+	if err = lease.Release(); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "host-b", readLease(t, memory, prefixUri).Host, "stored.Host")
+}
+
+func TestAcquireLeaseContention(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	cfg.Backup.Hostname = "host-a"
+	cfg.Backup.LeaseWaitSeconds = 12
+	clock := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	Now = func() time.Time { return clock }
+	t.Cleanup(func() { Now = time.Now })
+	memory := NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	storeLease(t, memory, prefixUri, "host-b", clock.Add(time.Hour))
+
+	var waits []time.Duration
+	oldLeaseWait := leaseWait
+	leaseWait = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		clock = clock.Add(d)
+		return nil
+	}
+	t.Cleanup(func() { leaseWait = oldLeaseWait })
+
+	/* the lease of another host is waited for up to backup.lease_wait_seconds */
+	var stderr bytes.Buffer
+	_, err := AcquireLease(memory, cfg, prefixUri, &stderr)
+	if err == nil {
+		t.Fatalf("AcquireLease was supposed to fail")
+	}
+	assertEquals(t, "[5s 5s 2s]", fmt.Sprint(waits), "waits")
+	assertEquals(t, true, strings.HasPrefix(stderr.String(), `waiting for the lease of host host-b (pid 2) until 2024-05-01T04:00:00Z on "memory://bucket/prefix/"...`), "stderr")
+
+	/* and acquired once released */
+	waits = nil
+	leaseWait = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d)
+		return memory.RemoveFile(ResolveObjectURI(prefixUri, LeaseObjectName))
+	}
+	lease, err := AcquireLease(memory, cfg, prefixUri, nil)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 1, len(waits), "len(waits)")
+	_ = lease.Release()
+
+	/* a lease overwritten by another host right after it was stored is lost */
+	_, err = AcquireLease(&leaseStealingBackend{memory}, cfg, prefixUri, nil)
+	if err == nil {
+		t.Fatalf("AcquireLease was supposed to fail")
+	}
+	assertEquals(t, `lost the lease on prefix "memory://bucket/prefix/" to host host-b (pid 2) until 2024-05-01T04:00:12Z`, err.Error(), "err.Error")
+}
+
+func TestPrefixLeaseRenew(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	cfg.Backup.Hostname = "host-a"
+	cfg.Backup.LeaseTTLSeconds = 3
+	memory := NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+
+	/* the lease is extended while held */
+	lease, err := AcquireLease(memory, cfg, prefixUri, nil)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	first := readLease(t, memory, prefixUri).Expires
+	time.Sleep(1500 * time.Millisecond)
+	assertEquals(t, true, readLease(t, memory, prefixUri).Expires.After(first), "renewed lease")
+	if err = lease.Release(); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+}
+
+func TestPrefixLeaseRenewLost(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	cfg.Backup.Hostname = "host-a"
+	cfg.Backup.LeaseTTLSeconds = 3
+	memory := NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	var stderr bytes.Buffer
+
+	/* a lease taken over by another host is no longer renewed */
+	lease, err := AcquireLease(memory, cfg, prefixUri, &stderr)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	expires := Now().Add(time.Hour).UTC().Truncate(time.Second)
+	storeLease(t, memory, prefixUri, "host-b", expires)
+	time.Sleep(1500 * time.Millisecond)
+	if err = lease.Release(); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	stored := readLease(t, memory, prefixUri)
+	assertEquals(t, "host-b", stored.Host, "stored.Host")
+	assertEquals(t, true, stored.Expires.Equal(expires), "stored.Expires")
+	assertEquals(t, true, strings.Contains(stderr.String(), "warning: lost the lease \"memory://bucket/prefix/.squirrelup-lease\" to host host-b"), "stderr")
+}
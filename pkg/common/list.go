@@ -0,0 +1,151 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+type (
+	// BackupInfo describes a backup stored under a prefix.
+	BackupInfo struct {
+		// name of the backup object
+		Key    string
+		Object *url.URL
+		// last modification time of the backup object, or its nominal time if recorded
+		Time time.Time
+		Size uint64
+		// outcome of the last verification, if recorded
+		Verified *BackupVerification
+	}
+
+	// BackupVerification records when a backup was last verified and the outcome.
+	BackupVerification struct {
+		Time   time.Time
+		Passed bool
+		Error  string
+	}
+
+	// ListOptions configures List.
+	ListOptions struct {
+		// lists the prefix, created for it if not set
+		Backend StorageBackend
+		// returns the backups recorded for the prefix sorted by time, e.g. by a catalog. The
+		// prefix contents are listed instead if it is not set or returns false.
+		Recorded func(ctx context.Context, backend StorageBackend) ([]BackupInfo, bool)
+	}
+
+	// PruneOptions configures Prune.
+	PruneOptions struct {
+		// removes the backups, created for the prefix if not set
+		Backend StorageBackend
+		// time compared against the retention period, the current time if zero
+		Now time.Time
+		// configures the removal, see CleanupPrefix. The context is the one passed to Prune
+		// and objects stored next to the backups are always kept.
+		Cleanup CleanupOptions
+	}
+)
+
+const (
+	// Names of objects stored next to the backups under a prefix.
+	// CatalogObjectName is the name of the object listing all backups stored under a prefix.
+	CatalogObjectName = ".squirrelup-catalog.json"
+	// FingerprintObjectName is the name of the object storing the fingerprint of the last uploaded backup.
+	FingerprintObjectName = ".fingerprint"
+	// IndexObjectName is the name of the object mapping obfuscated names to backup names.
+	IndexObjectName = ".squirrelup-index.age"
+	// AbortedMarkerSuffix is appended to the backup name to form the name of the aborted marker.
+	AbortedMarkerSuffix = ".aborted"
+	// CorruptObjectSuffix is appended to the name of auxiliary objects that could not be read.
+	CorruptObjectSuffix = ".corrupt"
+)
+
+var (
+	// auxiliaryObjectNames lists objects never removed by the cleanup of a prefix.
+	auxiliaryObjectNames = []string{FingerprintObjectName, IndexObjectName, CatalogObjectName, LeaseObjectName}
+)
+
+// IsBackupObject returns false for objects SquirrelUp stores next to the backups.
+func IsBackupObject(key string) bool {
+	switch key {
+	case FingerprintObjectName, IndexObjectName, CatalogObjectName, LeaseObjectName:
+		return false
+	}
+	return !strings.HasSuffix(key, AbortedMarkerSuffix) && !strings.HasSuffix(key, CorruptObjectSuffix) && !IsChunkObject(key)
+}
+
+// List returns the backups stored under `prefix` sorted by time. The backups recorded by
+// `opts.Recorded` are returned if it is set, otherwise the prefix is listed. `cfg` is only
+// used to create the backend if `opts.Backend` is not set.
+func List(ctx context.Context, prefix *url.URL, cfg *Config, opts ListOptions) ([]BackupInfo, error) {
+	backend := opts.Backend
+	if backend == nil {
+		var err error
+		backend, err = CreateStorageBackend(prefix, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create backend: %s", err.Error())
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if opts.Recorded != nil {
+		if backups, ok := opts.Recorded(ctx, backend); ok {
+			return backups, ctx.Err()
+		}
+	}
+
+	filelist, err := backend.ListFiles(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("could not list remote files: %s", err.Error())
+	}
+	if err = ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	var backups []BackupInfo
+	for _, fileinfo := range filelist {
+		key := path.Base(fileinfo.Name())
+		if !fileinfo.IsFile() || !IsBackupObject(key) {
+			continue
+		}
+		backups = append(backups, BackupInfo{Key: key, Object: fileinfo.URI(), Time: fileinfo.Modified().UTC(), Size: fileinfo.Size()})
+	}
+	sort.SliceStable(backups, func(i, j int) bool {
+		if backups[i].Time.Equal(backups[j].Time) {
+			return backups[i].Key < backups[j].Key
+		}
+		return backups[i].Time.Before(backups[j].Time)
+	})
+
+	return backups, nil
+}
+
+// Prune removes backups under `prefix` older than the configured retention period, see
+// CleanupPrefix. Nominal times of backups with obfuscated names are not known here unless
+// `opts.Cleanup.Resolve` provides them, their modification times are used instead.
+func Prune(ctx context.Context, prefix *url.URL, cfg *Config, opts PruneOptions) (*CleanupResult, error) {
+	backend := opts.Backend
+	if backend == nil {
+		var err error
+		backend, err = CreateStorageBackend(prefix, cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create backend: %s", err.Error())
+		}
+	}
+	now := opts.Now
+	if now.IsZero() {
+		now = Now()
+	}
+
+	cleanup := opts.Cleanup
+	cleanup.Context = ctx
+	cleanup.Keep = append(append([]string{}, auxiliaryObjectNames...), cleanup.Keep...)
+	return CleanupPrefix(backend, cfg, now, prefix, cleanup)
+}
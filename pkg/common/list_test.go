@@ -0,0 +1,166 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// helper function: make CreateStorageBackend return `memory` for dummy URIs.
+func useMemoryBackend(t *testing.T, memory *MemoryBackend) {
+	CreateDummyBackend = func(cfg *Config) StorageBackend {
+		return memory
+	}
+	t.Cleanup(func() { CreateDummyBackend = nil })
+}
+
+/* test cases for IsBackupObject */
+func TestIsBackupObject(t *testing.T) {
+	assertEquals(t, true, IsBackupObject("2024-05-01T03+0000.tar.gz.age"), "backup")
+	assertEquals(t, false, IsBackupObject(CatalogObjectName), "catalog")
+	assertEquals(t, false, IsBackupObject(FingerprintObjectName), "fingerprint")
+	assertEquals(t, false, IsBackupObject(IndexObjectName), "index")
+	assertEquals(t, false, IsBackupObject("2024-05-01T03+0000"+AbortedMarkerSuffix), "aborted marker")
+	assertEquals(t, false, IsBackupObject(IndexObjectName+CorruptObjectSuffix), "corrupt index")
+}
+
+/* test cases for List */
+func TestList(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	memory := NewMemoryBackend()
+	useMemoryBackend(t, memory)
+	prefixUri, _ := url.ParseRequestURI("dummy://bucket/prefix/")
+	now := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	storeAged(t, memory, prefixUri, "newer", now.Add(-time.Hour))
+	storeAged(t, memory, prefixUri, "older", now.Add(-48*time.Hour))
+	storeAged(t, memory, prefixUri, CatalogObjectName, now)
+	storeAged(t, memory, prefixUri, "newer"+AbortedMarkerSuffix, now)
+
+	// Perform the test
+	backups, err := List(context.Background(), prefixUri, cfg, ListOptions{})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 2, len(backups), "len(backups)")
+	assertEquals(t, "older", backups[0].Key, "backups[0].Key")
+	assertEquals(t, "dummy://bucket/prefix/older", backups[0].Object.String(), "backups[0].Object")
+	assertEquals(t, now.Add(-48*time.Hour), backups[0].Time, "backups[0].Time")
+	assertEquals(t, uint64(4), backups[0].Size, "backups[0].Size")
+	assertEquals(t, "newer", backups[1].Key, "backups[1].Key")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = List(ctx, prefixUri, cfg, ListOptions{})
+	assertEquals(t, context.Canceled, err, "err")
+
+	invalidUri, _ := url.ParseRequestURI("invalid://bucket/prefix/")
+	_, err = List(context.Background(), invalidUri, cfg, ListOptions{})
+	assertEquals(t, "failed to create backend: unknown URL scheme invalid", err.Error(), "err")
+}
+
+func TestListRecorded(t *testing.T) {
+	// Setup Test
+	memory := NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	now := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	storeAged(t, memory, prefixUri, "listed", now)
+	recorded := []BackupInfo{{Key: "recorded", Time: now, Size: 4, Verified: &BackupVerification{Time: now, Passed: true}}}
+	var found bool
+	opts := ListOptions{
+		Backend: memory,
+		Recorded: func(ctx context.Context, backend StorageBackend) ([]BackupInfo, bool) {
+			assertEquals(t, StorageBackend(memory), backend, "backend")
+			return recorded, found
+		},
+	}
+
+	// Perform the test
+	/* the prefix is listed without a record */
+	backups, err := List(context.Background(), prefixUri, nil, opts)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 1, len(backups), "len(backups)")
+	assertEquals(t, "listed", backups[0].Key, "backups[0].Key")
+
+	/* recorded backups are returned as they are */
+	found = true
+	backups, err = List(context.Background(), prefixUri, nil, opts)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 1, len(backups), "len(backups)")
+	assertEquals(t, "recorded", backups[0].Key, "backups[0].Key")
+	assertEquals(t, true, backups[0].Verified.Passed, "backups[0].Verified.Passed")
+}
+
+/* test cases for Prune */
+func TestPrune(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	cfg.Backup.Hours = 24
+	memory := NewMemoryBackend()
+	useMemoryBackend(t, memory)
+	prefixUri, _ := url.ParseRequestURI("dummy://bucket/prefix/")
+	now := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	oldNow := Now
+	Now = func() time.Time { return now }
+	defer func() { Now = oldNow }()
+	storeAged(t, memory, prefixUri, "newer", now.Add(-time.Hour))
+	storeAged(t, memory, prefixUri, "older", now.Add(-48*time.Hour))
+	storeAged(t, memory, prefixUri, CatalogObjectName, now.Add(-48*time.Hour))
+
+	// Perform the test
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := Prune(ctx, prefixUri, cfg, PruneOptions{})
+	assertEquals(t, context.Canceled, err, "err")
+
+	result, err := Prune(context.Background(), prefixUri, cfg, PruneOptions{})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 1, len(result.Removed), "len(result.Removed)")
+	assertEquals(t, "dummy://bucket/prefix/older", result.Removed[0], "result.Removed")
+
+	backups, _ := memory.ListFiles(prefixUri)
+	assertEquals(t, 2, len(backups), "len(backups)")
+}
+
+func TestPruneOptions(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	cfg.Backup.Hours = 24
+	memory := NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	now := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	storeAged(t, memory, prefixUri, "obfuscated", now.Add(-time.Hour))
+	storeAged(t, memory, prefixUri, "newest", now.Add(-48*time.Hour))
+	storeAged(t, memory, prefixUri, IndexObjectName, now.Add(-48*time.Hour))
+
+	// Perform the test
+	/* nominal times are resolved, the newest backup is kept */
+	result, err := Prune(context.Background(), prefixUri, cfg, PruneOptions{
+		Backend: memory,
+		Now:     now,
+		Cleanup: CleanupOptions{
+			Resolve: func(key string) (string, time.Time, bool) {
+				if key == "obfuscated" {
+					return "nominal", now.Add(-72 * time.Hour), true
+				}
+				return "", time.Time{}, false
+			},
+			KeepNewest: true,
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "[memory://bucket/prefix/obfuscated]", fmt.Sprint(result.Removed), "result.Removed")
+
+	backups, _ := memory.ListFiles(prefixUri)
+	assertEquals(t, 2, len(backups), "len(backups)")
+}
@@ -0,0 +1,264 @@
+package common
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// MemoryBackend is a storage backend that keeps objects in memory.
+	// It follows the same URI semantics as B2Backend: memory://bucket/path/to/key.
+	MemoryBackend struct {
+		lock    sync.Mutex
+		objects map[string]map[string]*memoryObject
+	}
+
+	memoryObject struct {
+		data         []byte
+		modified     time.Time
+		metadata     map[string]string
+		storageClass string
+	}
+)
+
+// NewMemoryBackend creates an empty MemoryBackend.
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		objects: map[string]map[string]*memoryObject{},
+	}
+}
+
+// splitMemoryURI returns bucket and key of an URI.
+func splitMemoryURI(uri *url.URL) (string, string) {
+	return uri.Host, strings.TrimPrefix(uri.Path, "/")
+}
+
+// memoryFileInfo describes `object` stored under `key` in the bucket of `uri`. The entity
+// tag is the quoted MD5 digest of the data, as S3 reports it for objects uploaded at once.
+func memoryFileInfo(uri *url.URL, key string, object *memoryObject) *FileInfo {
+	digest := md5.Sum(object.data)
+	return &FileInfo{
+		name:         key,
+		size:         uint64(len(object.data)),
+		modified:     object.modified,
+		isfile:       true,
+		uri:          objectURI(uri, key),
+		etag:         `"` + hex.EncodeToString(digest[:]) + `"`,
+		storageClass: object.storageClass,
+	}
+}
+
+// SetFileModified overrides the last modified date of an object.
+func (m *MemoryBackend) SetFileModified(uri *url.URL, modified time.Time) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	bucket, key := splitMemoryURI(uri)
+	object, prs := m.objects[bucket][key]
+	if !prs {
+		return errors.New(ErrFileNotFound)
+	}
+	object.modified = modified
+
+	return nil
+}
+
+// FileMetadata returns the user-defined metadata stored along with an object.
+func (m *MemoryBackend) FileMetadata(uri *url.URL) (map[string]string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	bucket, key := splitMemoryURI(uri)
+	object, prs := m.objects[bucket][key]
+	if !prs {
+		return nil, errors.New(ErrFileNotFound)
+	}
+	metadata := make(map[string]string, len(object.metadata))
+	for name, value := range object.metadata {
+		metadata[name] = value
+	}
+
+	return metadata, nil
+}
+
+// GetFileInfo returns a FileInfo struct filled with information
+// about object defined by the input URI.
+// Input URI must follow the pattern: memory://bucket/path/to/key.
+func (m *MemoryBackend) GetFileInfo(uri *url.URL) (*FileInfo, error) {
+	bucket, key := splitMemoryURI(uri)
+
+	// is this a prefix path?
+	if key == "" || strings.HasSuffix(key, "/") {
+		filelist, err := m.ListFiles(uri)
+		if err != nil {
+			return nil, err
+		}
+
+		fileinfo := &FileInfo{
+			name:     key,
+			modified: time.Unix(0, 0).UTC(),
+			isfile:   false,
+			uri:      objectURI(uri, key),
+		}
+		for _, item := range filelist {
+			fileinfo.size += item.Size()
+			if fileinfo.modified.Before(item.Modified()) {
+				fileinfo.modified = item.Modified()
+			}
+		}
+		return fileinfo, nil
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	object, prs := m.objects[bucket][key]
+	if !prs {
+		return nil, errors.New(ErrFileNotFound)
+	}
+
+	return memoryFileInfo(uri, key, object), nil
+}
+
+// ListFiles return an array of FileInfo structs filled with information
+// about objects defined by the input URI, sorted by key.
+// Input URI must follow the pattern: memory://bucket/path/to/prefix.
+func (m *MemoryBackend) ListFiles(uri *url.URL) ([]FileInfo, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	bucket, prefix := splitMemoryURI(uri)
+
+	result := []FileInfo{}
+	for key, object := range m.objects[bucket] {
+		if strings.HasPrefix(key, prefix) {
+			result = append(result, *memoryFileInfo(uri, key, object))
+		}
+	}
+	sortFileInfos(result)
+
+	return result, nil
+}
+
+// StoreFile writes the body of the request to its URI, along with its metadata and storage
+// class. The checksum of the request is verified before the object is stored.
+// Output URI must follow the pattern: memory://bucket/path/to/key.
+func (m *MemoryBackend) StoreFile(ctx context.Context, req StoreRequest) error {
+	if err := req.validate(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var input io.Reader = req.Body
+	if req.BodyAt != nil {
+		input = io.NewSectionReader(req.BodyAt, 0, req.Length)
+	}
+	data, err := io.ReadAll(input)
+	if err != nil {
+		return fmt.Errorf("could not read input: %s", err.Error())
+	}
+	if req.Length >= 0 && int64(len(data)) != req.Length {
+		return fmt.Errorf("input of %d bytes does not match the expected length of %d bytes", len(data), req.Length)
+	}
+	if err = req.verifyChecksum(data); err != nil {
+		return err
+	}
+
+	storageClass := req.StorageClass
+	if storageClass == "" {
+		storageClass = defaultStorageClass
+	}
+	var metadata map[string]string
+	if len(req.Metadata) > 0 {
+		metadata = make(map[string]string, len(req.Metadata))
+		for name, value := range req.Metadata {
+			metadata[name] = value
+		}
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	bucket, key := splitMemoryURI(req.URI)
+	if _, prs := m.objects[bucket]; !prs {
+		m.objects[bucket] = map[string]*memoryObject{}
+	}
+	m.objects[bucket][key] = &memoryObject{
+		data:         data,
+		modified:     Now().UTC(),
+		metadata:     metadata,
+		storageClass: storageClass,
+	}
+
+	return nil
+}
+
+// RetrieveFile writes data stored under input URI to `output`.
+// Input URI must follow the pattern: memory://bucket/path/to/key.
+func (m *MemoryBackend) RetrieveFile(output io.Writer, uri *url.URL) error {
+	m.lock.Lock()
+	bucket, key := splitMemoryURI(uri)
+	object, prs := m.objects[bucket][key]
+	m.lock.Unlock()
+
+	if !prs {
+		return errors.New(ErrFileNotFound)
+	}
+
+	_, err := output.Write(object.data)
+	if err != nil {
+		return fmt.Errorf("could not write output: %s", err.Error())
+	}
+	return nil
+}
+
+// CopyFile copies an object from source URI to destination URI.
+// Both URIs must follow the pattern: memory://bucket/path/to/key.
+func (m *MemoryBackend) CopyFile(source *url.URL, destination *url.URL) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	srcBucket, srcKey := splitMemoryURI(source)
+	object, prs := m.objects[srcBucket][srcKey]
+	if !prs {
+		return errors.New(ErrFileNotFound)
+	}
+
+	dstBucket, dstKey := splitMemoryURI(destination)
+	if _, prs := m.objects[dstBucket]; !prs {
+		m.objects[dstBucket] = map[string]*memoryObject{}
+	}
+	m.objects[dstBucket][dstKey] = &memoryObject{
+		data:         object.data,
+		modified:     Now().UTC(),
+		metadata:     object.metadata,
+		storageClass: object.storageClass,
+	}
+
+	return nil
+}
+
+// RemoveFile removes an object under the given URI.
+// Object URI must follow the pattern: memory://bucket/path/to/key.
+func (m *MemoryBackend) RemoveFile(uri *url.URL) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	bucket, key := splitMemoryURI(uri)
+	if _, prs := m.objects[bucket][key]; !prs {
+		return errors.New(ErrFileNotFound)
+	}
+	delete(m.objects[bucket], key)
+
+	return nil
+}
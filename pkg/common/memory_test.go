@@ -0,0 +1,203 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+/* test cases for MemoryBackend */
+func TestMemoryStoreRetrieveRemove(t *testing.T) {
+	// Setup Test
+	memory := NewMemoryBackend()
+	mockURI, err := url.ParseRequestURI("memory://bucket/path/to/key")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Perform the test
+	data := []byte("test")
+	if err = memory.StoreFile(context.Background(), StoreRequest{URI: mockURI, BodyAt: bytes.NewReader(data), Length: 4}); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	fileinfo, err := memory.GetFileInfo(mockURI)
+	if fileinfo == nil || err != nil {
+		t.Fatalf("unexpected test result: %+v, %+v", fileinfo, err)
+	}
+	assertEquals(t, "path/to/key", fileinfo.Name(), "fileinfo.Name")
+	assertEquals(t, uint64(4), fileinfo.Size(), "fileinfo.Size")
+	assertEquals(t, true, fileinfo.IsFile(), "fileinfo.IsFile")
+
+	var output bytes.Buffer
+	if err = memory.RetrieveFile(&output, mockURI); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "test", output.String(), "output")
+
+	if err = memory.RemoveFile(mockURI); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	_, err = memory.GetFileInfo(mockURI)
+	if err == nil {
+		t.Fatalf("unexpected test result: GetFileInfo was supposed to fail")
+	}
+	assertEquals(t, ErrFileNotFound, err.Error(), "err.Error")
+
+	err = memory.RetrieveFile(&output, mockURI)
+	if err == nil {
+		t.Fatalf("unexpected test result: RetrieveFile was supposed to fail")
+	}
+	assertEquals(t, ErrFileNotFound, err.Error(), "err.Error")
+
+	err = memory.RemoveFile(mockURI)
+	if err == nil {
+		t.Fatalf("unexpected test result: RemoveFile was supposed to fail")
+	}
+	assertEquals(t, ErrFileNotFound, err.Error(), "err.Error")
+}
+
+func TestMemoryListFilesAndPrefixInfo(t *testing.T) {
+	// Setup Test
+	memory := NewMemoryBackend()
+	for _, key := range []string{"prefix/b", "prefix/a", "other/c"} {
+		mockURI, _ := url.ParseRequestURI("memory://bucket/" + key)
+		if err := memory.StoreFile(context.Background(), StoreRequest{URI: mockURI, BodyAt: bytes.NewReader([]byte(key)), Length: int64(len(key))}); err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+	}
+	mockURI, _ := url.ParseRequestURI("memory://bucket/prefix/a")
+	if err := memory.SetFileModified(mockURI, time.Unix(1, 0).UTC()); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	// Perform the test
+	prefixURI, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	filelist, err := memory.ListFiles(prefixURI)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 2, len(filelist), "len(filelist)")
+	assertEquals(t, "prefix/a", filelist[0].Name(), "filelist[0].Name")
+	assertEquals(t, time.Unix(1, 0).UTC(), filelist[0].Modified(), "filelist[0].Modified")
+	assertEquals(t, "prefix/b", filelist[1].Name(), "filelist[1].Name")
+	assertEquals(t, "memory://bucket/prefix/b", filelist[1].URI().String(), "filelist[1].URI")
+	assertEquals(t, `"d7843bb37976fdf43542261fb9db7ade"`, filelist[1].ETag(), "filelist[1].ETag")
+	assertEquals(t, "STANDARD", filelist[1].StorageClass(), "filelist[1].StorageClass")
+
+	fileinfo, err := memory.GetFileInfo(prefixURI)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "prefix/", fileinfo.Name(), "fileinfo.Name")
+	assertEquals(t, uint64(16), fileinfo.Size(), "fileinfo.Size")
+	assertEquals(t, false, fileinfo.IsFile(), "fileinfo.IsFile")
+	assertEquals(t, "memory://bucket/prefix/", fileinfo.URI().String(), "fileinfo.URI")
+}
+
+func TestMemoryCopyFile(t *testing.T) {
+	// Setup Test
+	memory := NewMemoryBackend()
+	sourceURI, _ := url.ParseRequestURI("memory://bucket/source")
+	destinationURI, _ := url.ParseRequestURI("memory://bucket/destination")
+	if err := memory.StoreFile(context.Background(), StoreRequest{URI: sourceURI, BodyAt: bytes.NewReader([]byte("test")), Length: 4}); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	// Perform the test
+	if err := memory.CopyFile(sourceURI, destinationURI); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	var output bytes.Buffer
+	if err := memory.RetrieveFile(&output, destinationURI); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "test", output.String(), "output")
+
+	missingURI, _ := url.ParseRequestURI("memory://bucket/missing")
+	err := memory.CopyFile(missingURI, destinationURI)
+	if err == nil {
+		t.Fatalf("unexpected test result: CopyFile was supposed to fail")
+	}
+	assertEquals(t, ErrFileNotFound, err.Error(), "err.Error")
+}
+
+func TestMemoryStoreFileRequest(t *testing.T) {
+	// Setup Test
+	memory := NewMemoryBackend()
+	mockURI, err := url.ParseRequestURI("memory://bucket/path/to/key")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	digest := sha256.Sum256([]byte("test"))
+
+	// Perform the test
+	err = memory.StoreFile(context.Background(), StoreRequest{
+		URI:          mockURI,
+		Body:         strings.NewReader("test"),
+		Length:       -1,
+		Metadata:     map[string]string{"source": "/home"},
+		Checksum:     hex.EncodeToString(digest[:]),
+		StorageClass: "STANDARD_IA",
+	})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	fileinfo, err := memory.GetFileInfo(mockURI)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, uint64(4), fileinfo.Size(), "fileinfo.Size")
+	assertEquals(t, "STANDARD_IA", fileinfo.StorageClass(), "fileinfo.StorageClass")
+	metadata, err := memory.FileMetadata(mockURI)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 1, len(metadata), "len(metadata)")
+	assertEquals(t, "/home", metadata["source"], "metadata.source")
+
+	/* checksum mismatch */
+	err = memory.StoreFile(context.Background(), StoreRequest{URI: mockURI, BodyAt: strings.NewReader("data"), Length: 4, Checksum: hex.EncodeToString(digest[:])})
+	if err == nil {
+		t.Fatalf("unexpected test result: StoreFile was supposed to fail")
+	}
+	assertEquals(t, ErrChecksumMismatch, err.Error(), "err.Error")
+
+	/* length mismatch */
+	err = memory.StoreFile(context.Background(), StoreRequest{URI: mockURI, Body: strings.NewReader("data"), Length: 8})
+	if err == nil {
+		t.Fatalf("unexpected test result: StoreFile was supposed to fail")
+	}
+	assertEquals(t, "input of 4 bytes does not match the expected length of 8 bytes", err.Error(), "err.Error")
+
+	/* cancelled context */
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = memory.StoreFile(ctx, StoreRequest{URI: mockURI, BodyAt: strings.NewReader("data"), Length: 4})
+	assertEquals(t, context.Canceled, err, "err")
+
+	/* failed requests keep the stored object */
+	var output bytes.Buffer
+	if err = memory.RetrieveFile(&output, mockURI); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "test", output.String(), "output")
+
+	/* copies keep metadata and storage class */
+	destinationURI, _ := url.ParseRequestURI("memory://bucket/path/to/copy")
+	if err = memory.CopyFile(mockURI, destinationURI); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	fileinfo, _ = memory.GetFileInfo(destinationURI)
+	assertEquals(t, "STANDARD_IA", fileinfo.StorageClass(), "copy.StorageClass")
+	metadata, _ = memory.FileMetadata(destinationURI)
+	assertEquals(t, "/home", metadata["source"], "copy.metadata.source")
+}
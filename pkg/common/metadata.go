@@ -0,0 +1,223 @@
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mholt/archiver/v4"
+	"gopkg.in/yaml.v3"
+)
+
+type (
+	// ArchiveMetadata describes the SquirrelUp version and settings that created an archive.
+	ArchiveMetadata struct {
+		Format  int    `json:"format"`
+		Version string `json:"version"`
+		Commit  string `json:"commit,omitempty"`
+		// time the archive was created at
+		Created time.Time `json:"created"`
+		// digest of the configuration without secrets, see Config.Digest
+		ConfigDigest string         `json:"config_digest"`
+		Options      ArchiveOptions `json:"options"`
+	}
+
+	// ArchiveOptions lists the settings an archive was created with.
+	ArchiveOptions struct {
+		Compression   string `json:"compression"`
+		Archival      string `json:"archival"`
+		NumericUIDGID bool   `json:"numeric_uid_gid"`
+		Owner         string `json:"owner,omitempty"`
+		Group         string `json:"group,omitempty"`
+		ModeMask      string `json:"mode_mask,omitempty"`
+		Xattrs        bool   `json:"xattrs,omitempty"`
+	}
+
+	// archiveMetadataInfo describes the metadata entry of an archive.
+	archiveMetadataInfo struct {
+		size     int64
+		modified time.Time
+	}
+)
+
+const (
+	// ArchiveMetadataName is the name of the metadata entry written first to archives.
+	ArchiveMetadataName = ".squirrelup-archive.json"
+
+	// version of the metadata format written by this version
+	archive_metadata_format = 1
+	// upper bound of the size of metadata entries
+	max_archive_metadata_size = 64 * 1024
+
+	// compression and archival formats of archives created by ArchiveDirectory
+	archive_compression = "gzip"
+	archive_archival    = "tar"
+)
+
+func (info *archiveMetadataInfo) Name() string {
+	return ArchiveMetadataName
+}
+
+func (info *archiveMetadataInfo) Size() int64 {
+	return info.size
+}
+
+func (info *archiveMetadataInfo) Mode() fs.FileMode {
+	return 0644
+}
+
+func (info *archiveMetadataInfo) ModTime() time.Time {
+	return info.modified
+}
+
+func (info *archiveMetadataInfo) IsDir() bool {
+	return false
+}
+
+func (info *archiveMetadataInfo) Sys() any {
+	return nil
+}
+
+// NewArchiveMetadata returns the metadata of archives created with `cfg` by SquirrelUp
+// `version` built from `commit`.
+func NewArchiveMetadata(cfg *Config, version, commit string) *ArchiveMetadata {
+	return &ArchiveMetadata{
+		Format:       archive_metadata_format,
+		Version:      version,
+		Commit:       commit,
+		Created:      Now().UTC().Truncate(time.Second),
+		ConfigDigest: cfg.Digest(),
+		Options: ArchiveOptions{
+			Compression:   archive_compression,
+			Archival:      archive_archival,
+			NumericUIDGID: cfg.Backup.NumericUIDGID,
+			Owner:         cfg.Backup.Owner,
+			Group:         cfg.Backup.Group,
+			ModeMask:      cfg.Backup.ModeMask,
+			Xattrs:        cfg.Backup.Xattrs,
+		},
+	}
+}
+
+// Digest returns the SHA-256 digest of the configuration with secrets left out, like
+// credentials and the key of obfuscated names. Internal settings are not covered.
+func (cfg *Config) Digest() string {
+	var settings struct {
+		S3          any `yaml:"s3"`
+		Encryption  any `yaml:"encryption"`
+		Backup      any `yaml:"backup"`
+		Progress    any `yaml:"progress"`
+		Performance any `yaml:"performance"`
+	}
+	s3, backup := cfg.S3, cfg.Backup
+	s3.ID, s3.Secret, s3.Token = "", "", ""
+	if proxyUri, err := url.Parse(s3.ProxyURL); err == nil {
+		s3.ProxyURL = proxyUri.Redacted()
+	}
+	backup.NameKey = ""
+	settings.S3, settings.Encryption, settings.Backup = s3, cfg.Encryption, backup
+	settings.Progress, settings.Performance = cfg.Progress, cfg.Performance
+
+	data, err := yaml.Marshal(&settings)
+	if err != nil {
+		return ""
+	}
+	hash := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(hash[:])
+}
+
+// archiveFile returns the metadata as an archive entry.
+func (metadata *ArchiveMetadata) archiveFile() (archiver.File, error) {
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return archiver.File{}, fmt.Errorf("could not encode archive metadata: %s", err.Error())
+	}
+	return archiver.File{
+		FileInfo:      &archiveMetadataInfo{int64(len(data)), metadata.Created},
+		NameInArchive: ArchiveMetadataName,
+		Open: func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(data)), nil
+		},
+	}, nil
+}
+
+// ReadArchiveMetadata decodes the contents of the metadata entry of an archive.
+func ReadArchiveMetadata(input io.Reader) (*ArchiveMetadata, error) {
+	data, err := io.ReadAll(io.LimitReader(input, max_archive_metadata_size+1))
+	if err != nil {
+		return nil, fmt.Errorf("could not read archive metadata: %s", err.Error())
+	} else if len(data) > max_archive_metadata_size {
+		return nil, fmt.Errorf("could not read archive metadata: exceeds %d bytes", max_archive_metadata_size)
+	}
+	var metadata ArchiveMetadata
+	if err = json.Unmarshal(data, &metadata); err != nil {
+		return nil, fmt.Errorf("could not decode archive metadata: %s", err.Error())
+	}
+	return &metadata, nil
+}
+
+// Warnings lists reasons why SquirrelUp `version` may not restore the archive as created:
+// the archive was created by a newer version, with a newer metadata format or with options
+// this version does not expect. Versions that are not like 1.2.3 are not compared.
+func (metadata *ArchiveMetadata) Warnings(version string) []string {
+	var warnings []string
+	if compareVersions(version, metadata.Version) < 0 {
+		warnings = append(warnings, fmt.Sprintf("archive was created by SquirrelUp %s, which is newer than this version %s", metadata.Version, version))
+	}
+	if metadata.Format > archive_metadata_format {
+		warnings = append(warnings, fmt.Sprintf("archive metadata format %d is newer than the supported format %d", metadata.Format, archive_metadata_format))
+	}
+	if metadata.Options.Compression != archive_compression {
+		warnings = append(warnings, fmt.Sprintf("archive uses unexpected compression %q, expected %q", metadata.Options.Compression, archive_compression))
+	}
+	if metadata.Options.Archival != archive_archival {
+		warnings = append(warnings, fmt.Sprintf("archive uses unexpected archive format %q, expected %q", metadata.Options.Archival, archive_archival))
+	}
+	return warnings
+}
+
+// compareVersions compares versions like v1.2.3 or 1.2.3-rc1 by their numeric components,
+// suffixes are ignored. Returns -1, 0 or 1 like strings.Compare, 0 if either version is not
+// like that.
+func compareVersions(a, b string) int {
+	partsA, okA := parseVersion(a)
+	partsB, okB := parseVersion(b)
+	if !okA || !okB {
+		return 0
+	}
+	for index := range partsA {
+		if partsA[index] != partsB[index] {
+			if partsA[index] < partsB[index] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// parseVersion returns the major, minor and patch numbers of a version like v1.2.3.
+func parseVersion(version string) ([3]int, bool) {
+	var parts [3]int
+	version, _, _ = strings.Cut(strings.TrimPrefix(version, "v"), "-")
+	fields := strings.Split(version, ".")
+	if len(fields) != len(parts) {
+		return parts, false
+	}
+	for index, field := range fields {
+		number, err := strconv.Atoi(field)
+		if err != nil || number < 0 {
+			return parts, false
+		}
+		parts[index] = number
+	}
+	return parts, true
+}
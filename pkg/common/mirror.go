@@ -0,0 +1,159 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// BackupMirror is another prefix a backup is copied to once it was stored under the
+	// destination of the backup.
+	BackupMirror struct {
+		Destination *url.URL
+		// stores the copies, created for Destination if not set
+		Backend StorageBackend
+	}
+
+	// MirrorResult describes the copies of a backup stored under a mirror.
+	MirrorResult struct {
+		Destination *url.URL
+		// URIs of the stored copies
+		Objects []*url.URL
+		// why the backup was not stored under the mirror, nil if it was
+		Err error
+		// outcome of the removal of old backups under the mirror, nil if it did not run
+		Cleanup *CleanupResult
+	}
+
+	// MirrorError reports a backup that was stored under its destination, but not under
+	// every mirror.
+	MirrorError struct {
+		Failed []MirrorResult
+	}
+)
+
+const (
+	// MirrorPolicyAll fails backups that could not be stored under every mirror.
+	MirrorPolicyAll = "all-must-succeed"
+	// MirrorPolicyAny only warns about mirrors a backup could not be stored under.
+	MirrorPolicyAny = "any"
+)
+
+func (me *MirrorError) Error() string {
+	var failures []string
+	for _, mirror := range me.Failed {
+		failures = append(failures, fmt.Sprintf("%q: %s", mirror.Destination, mirror.Err.Error()))
+	}
+	return fmt.Sprintf("backup was not stored under every mirror: %s", strings.Join(failures, "; "))
+}
+
+// newMirrors returns the results of `mirrors` along with their backends, which are created
+// unless set. Mirrors whose backend cannot be created fail right away.
+func newMirrors(mirrors []BackupMirror, cfg *Config, stderr io.Writer) ([]MirrorResult, []StorageBackend) {
+	results := make([]MirrorResult, len(mirrors))
+	backends := make([]StorageBackend, len(mirrors))
+	for index, mirror := range mirrors {
+		results[index].Destination = mirror.Destination
+		backends[index] = mirror.Backend
+		if backends[index] == nil {
+			var err error
+			backends[index], err = CreateStorageBackend(mirror.Destination, cfg)
+			if err != nil {
+				results[index].Err = fmt.Errorf("failed to create backend: %s", err.Error())
+				fmt.Fprintf(stderr, "mirror %q failed: %s\n", mirror.Destination, results[index].Err.Error())
+			}
+		}
+	}
+	return results, backends
+}
+
+// storeMirrors uploads the file at `filePath`, stored as `object`, under `objectName` to every
+// mirror that did not fail yet, at most `cfg.Backup.MirrorConcurrency` at a time. Messages
+// of each upload are written once all of them are done, in the order of the mirrors.
+func storeMirrors(ctx context.Context, mirrors []MirrorResult, backends []StorageBackend, filePath, objectName string, object *BackupObject, opts *BackupOptions, cfg *Config, stdout, stderr io.Writer) {
+	outputs := make([]struct{ stdout, stderr bytes.Buffer }, len(mirrors))
+	errs := make([]error, len(mirrors))
+	workers := make(chan struct{}, max(cfg.Backup.MirrorConcurrency, 1))
+	var wg sync.WaitGroup
+	for index := range mirrors {
+		if mirrors[index].Err != nil {
+			continue
+		}
+		workers <- struct{}{}
+		wg.Add(1)
+		go func(index int) {
+			defer func() { <-workers; wg.Done() }()
+			mirrorObject := BackupObject{
+				Object:      ResolveObjectURI(mirrors[index].Destination, objectName),
+				Name:        object.Name,
+				Sizes:       object.Sizes,
+				ContentType: object.ContentType,
+			}
+			errs[index] = storeArchive(ctx, backends[index], filePath, &mirrorObject, opts, func(string, *url.URL) {}, &outputs[index].stdout, &outputs[index].stderr)
+			if errs[index] == nil {
+				mirrors[index].Objects = append(mirrors[index].Objects, mirrorObject.Object)
+			}
+		}(index)
+	}
+	wg.Wait()
+
+	for index := range outputs {
+		_, _ = io.Copy(stdout, &outputs[index].stdout)
+		_, _ = io.Copy(stderr, &outputs[index].stderr)
+		if errs[index] != nil {
+			mirrors[index].Err = errs[index]
+			fmt.Fprintf(stderr, "mirror %q failed: %s\n", mirrors[index].Destination, errs[index].Error())
+		}
+	}
+}
+
+// cleanupMirrors removes backups older than the retention period under every mirror the
+// backup was stored under, independently of each other. Failures are warnings of `result`.
+func cleanupMirrors(backends []StorageBackend, cfg *Config, now time.Time, opts CleanupOptions, result *BackupResult, stderr io.Writer) {
+	for index := range result.Mirrors {
+		mirror := &result.Mirrors[index]
+		if mirror.Err != nil {
+			continue
+		}
+		var err error
+		mirror.Cleanup, err = CleanupPrefix(backends[index], cfg, now, mirror.Destination, opts)
+		if mirror.Cleanup != nil {
+			result.Warnings = append(result.Warnings, mirror.Cleanup.Warnings...)
+		}
+		if err != nil {
+			warning := fmt.Sprintf("failed to clean up mirror %q: %s", mirror.Destination, err.Error())
+			cfg.Internal.Warnings.Report(stderr, WarningCleanup, mirror.Destination.String(), warning)
+			result.Warnings = append(result.Warnings, warning)
+		}
+	}
+}
+
+// mirrorFailure returns a *MirrorError for the mirrors of `result` the backup could not be
+// stored under. They are only warnings of `result` if `cfg.Backup.MirrorPolicy` is
+// MirrorPolicyAny.
+func mirrorFailure(cfg *Config, result *BackupResult, stderr io.Writer) error {
+	var failed []MirrorResult
+	for _, mirror := range result.Mirrors {
+		if mirror.Err != nil {
+			failed = append(failed, mirror)
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	if cfg.Backup.MirrorPolicy == MirrorPolicyAny {
+		for _, mirror := range failed {
+			warning := fmt.Sprintf("backup was not stored under mirror %q: %s", mirror.Destination, mirror.Err.Error())
+			cfg.Internal.Warnings.Report(stderr, WarningMirror, mirror.Destination.String(), warning)
+			result.Warnings = append(result.Warnings, warning)
+		}
+		return nil
+	}
+	return &MirrorError{failed}
+}
@@ -0,0 +1,142 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingStoreBackend is a MemoryBackend that fails to store files.
+type failingStoreBackend struct {
+	*MemoryBackend
+}
+
+func (fsb *failingStoreBackend) StoreFile(ctx context.Context, req StoreRequest) error {
+	return errors.New("connection refused")
+}
+
+// helper function: store an object under `uri` last modified at `modified`.
+func storeMirrorObject(t *testing.T, memory *MemoryBackend, uri string, modified time.Time) {
+	objectUri, _ := url.ParseRequestURI(uri)
+	if err := memory.StoreFile(context.Background(), StoreRequest{URI: objectUri, BodyAt: bytes.NewReader([]byte("old")), Length: 3}); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	if err := memory.SetFileModified(objectUri, modified); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+}
+
+/* test cases for Backup with mirrors */
+func TestBackupMirrors(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	cfg.Backup.Hours = 24
+	cfg.Backup.MirrorConcurrency = 2
+	srcDir := setupBackupSource(t)
+	primary, first, second := NewMemoryBackend(), NewMemoryBackend(), NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	firstUri, _ := url.ParseRequestURI("memory://first/mirror/")
+	secondUri, _ := url.ParseRequestURI("memory://second/mirror/")
+	nominalTime := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	storeMirrorObject(t, first, "memory://first/mirror/old.tar.gz", nominalTime.Add(-48*time.Hour))
+	storeMirrorObject(t, second, "memory://second/mirror/old.tar.gz", nominalTime.Add(-48*time.Hour))
+	var stdout, stderr bytes.Buffer
+
+	// Perform the test
+	result, err := Backup(context.Background(), BackupOptions{
+		Source:      srcDir,
+		Destination: prefixUri,
+		Config:      cfg,
+		Backend:     primary,
+		Time:        nominalTime,
+		Mirrors:     []BackupMirror{{firstUri, first}, {secondUri, second}},
+		Stdout:      &stdout,
+		Stderr:      &stderr,
+	})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	/* the same archive is stored under every mirror, old backups are removed under each */
+	var stored bytes.Buffer
+	if err = primary.RetrieveFile(&stored, result.Object); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 2, len(result.Mirrors), "len(result.Mirrors)")
+	for index, memory := range []*MemoryBackend{first, second} {
+		mirror := result.Mirrors[index]
+		assertEquals(t, nil, mirror.Err, "mirror.Err")
+		assertEquals(t, 1, len(mirror.Objects), "len(mirror.Objects)")
+		assertEquals(t, mirror.Destination.String()+"2024-05-01T03.tar.gz", mirror.Objects[0].String(), "mirror.Objects")
+		var copied bytes.Buffer
+		if err = memory.RetrieveFile(&copied, mirror.Objects[0]); err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		assertEquals(t, true, bytes.Equal(stored.Bytes(), copied.Bytes()), "copied")
+		assertEquals(t, 1, len(mirror.Cleanup.Removed), "len(mirror.Cleanup.Removed)")
+	}
+	assertEquals(t, true, strings.Contains(stdout.String(), `uploaded backup archive of "`+srcDir+`" to "memory://second/mirror/2024-05-01T03.tar.gz"`), "stdout")
+}
+
+func TestBackupMirrorFailure(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	cfg.Backup.Hours = 24
+	srcDir := setupBackupSource(t)
+	primary, working := NewMemoryBackend(), NewMemoryBackend()
+	failing := &failingStoreBackend{NewMemoryBackend()}
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	workingUri, _ := url.ParseRequestURI("memory://working/mirror/")
+	failingUri, _ := url.ParseRequestURI("memory://failing/mirror/")
+	nominalTime := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	storeMirrorObject(t, primary, "memory://bucket/prefix/old.tar.gz", nominalTime.Add(-48*time.Hour))
+	storeMirrorObject(t, failing.MemoryBackend, "memory://failing/mirror/old.tar.gz", nominalTime.Add(-48*time.Hour))
+	var stderr bytes.Buffer
+	backup := func() (BackupResult, error) {
+		stderr.Reset()
+		return Backup(context.Background(), BackupOptions{
+			Source:      srcDir,
+			Destination: prefixUri,
+			Config:      cfg,
+			Backend:     primary,
+			Time:        nominalTime,
+			Mirrors:     []BackupMirror{{failingUri, failing}, {workingUri, working}},
+			Stderr:      &stderr,
+		})
+	}
+
+	/* every mirror must store the backup by default */
+	result, err := backup()
+	var mirrorErr *MirrorError
+	if !errors.As(err, &mirrorErr) {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 1, len(mirrorErr.Failed), "len(mirrorErr.Failed)")
+	assertEquals(t, failingUri, mirrorErr.Failed[0].Destination, "mirrorErr.Failed")
+	assertEquals(t, true, strings.HasPrefix(err.Error(), `backup was not stored under every mirror: "memory://failing/mirror/": unable to write backup archive`), "err")
+	assertEquals(t, true, strings.Contains(stderr.String(), `mirror "memory://failing/mirror/" failed: `), "stderr")
+
+	/* the other destinations are stored and cleaned up independently of the failed mirror */
+	assertEquals(t, true, result.Stored, "result.Stored")
+	assertEquals(t, 1, len(result.Cleanup.Removed), "len(result.Cleanup.Removed)")
+	assertEquals(t, (*CleanupResult)(nil), result.Mirrors[0].Cleanup, "result.Mirrors[0].Cleanup")
+	assertEquals(t, nil, result.Mirrors[1].Err, "result.Mirrors[1].Err")
+	assertEquals(t, 1, len(result.Mirrors[1].Objects), "len(result.Mirrors[1].Objects)")
+	oldUri, _ := url.ParseRequestURI("memory://failing/mirror/old.tar.gz")
+	_, err = failing.GetFileInfo(oldUri)
+	assertEquals(t, nil, err, "failing.GetFileInfo")
+
+	/* a single copy is enough with the any policy */
+	cfg.Backup.MirrorPolicy = MirrorPolicyAny
+	nominalTime = nominalTime.Add(time.Hour)
+	result, err = backup()
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 1, len(result.Warnings), "len(result.Warnings)")
+	assertEquals(t, true, strings.HasPrefix(result.Warnings[0], `backup was not stored under mirror "memory://failing/mirror/": `), "result.Warnings")
+}
@@ -0,0 +1,272 @@
+package common
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// RunSummary describes the outcome of a backup run, it is sent by SendNotification.
+	RunSummary struct {
+		Status string
+		// backup directory and output prefix as given, the latter is updated once it is scoped
+		Source      string
+		Destination string
+		// name of the backup, empty if it was not determined
+		Name     string
+		Started  time.Time
+		Finished time.Time
+		// true if the backup was skipped as the backup directory did not change
+		Skipped bool
+		// outcomes of the upload and of the cleanup of old backups, see StepSucceeded, empty
+		// if the run ended before either was attempted
+		Upload  string
+		Cleanup string
+		// result of the backup, nil if it did not run
+		Result *BackupResult
+		// warnings of the run in the order they were reported, see Warnings
+		Warnings []Warning
+		// error of a failed run, or the warning of a run that succeeded with warnings
+		Err error
+		// last lines logged by the run, only sent for failed runs
+		Log []string
+	}
+)
+
+const (
+	// connection security of the SMTP server, see Config.Notify.SMTPSecurity
+	SMTPSecurityStartTLS = "starttls"
+	SMTPSecurityTLS      = "tls"
+	SMTPSecurityNone     = "none"
+
+	// outcomes of a backup run, see RunSummary.Status
+	RunSucceeded = "succeeded"
+	RunWarning   = "succeeded with warnings"
+	RunFailed    = "failed"
+
+	// outcomes of the steps of a backup run, see RunSummary.Upload and RunSummary.Cleanup
+	StepSucceeded = "succeeded"
+	StepFailed    = "failed"
+	StepSkipped   = "skipped"
+
+	// upper limit of Config.Notify.LogLines
+	MaxNotifyLogLines = 1000
+)
+
+var (
+	// smtpTLSConfig returns the TLS configuration for connections to the SMTP server `host`,
+	// can be overridden in tests.
+	smtpTLSConfig = func(host string) *tls.Config {
+		return &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+	}
+)
+
+// validateNotify checks the notification configuration if an SMTP server is set.
+func (cfg *Config) validateNotify() error {
+	if len(cfg.Notify.SMTPHost) == 0 {
+		return nil
+	}
+	switch cfg.Notify.SMTPSecurity {
+	case SMTPSecurityStartTLS, SMTPSecurityTLS, SMTPSecurityNone:
+	default:
+		return fmt.Errorf("invalid SMTP security %q, expecting %q, %q or %q",
+			cfg.Notify.SMTPSecurity, SMTPSecurityStartTLS, SMTPSecurityTLS, SMTPSecurityNone)
+	}
+	if cfg.Notify.SMTPPort < 1 || cfg.Notify.SMTPPort > 65535 {
+		return fmt.Errorf("invalid SMTP port %d", cfg.Notify.SMTPPort)
+	}
+	if len(cfg.Notify.SMTPPassword) > 0 && len(cfg.Notify.SMTPPasswordFile) > 0 {
+		return fmt.Errorf("SMTP password and password file are mutually exclusive")
+	}
+	if len(cfg.Notify.SMTPFrom) == 0 || len(cfg.Notify.SMTPTo) == 0 {
+		return fmt.Errorf("notifications require a sender and at least one recipient")
+	}
+	if cfg.Notify.SMTPTimeoutSeconds <= 0 {
+		return fmt.Errorf("SMTP timeout must be positive")
+	}
+	if cfg.Notify.LogLines < 0 || cfg.Notify.LogLines > MaxNotifyLogLines {
+		return fmt.Errorf("number of log lines must be between 0 and %d", MaxNotifyLogLines)
+	}
+	return nil
+}
+
+// smtpPassword returns the password for the SMTP server, read from
+// `cfg.Notify.SMTPPasswordFile` if set. A single trailing newline is stripped from
+// password files.
+func smtpPassword(cfg *Config) (string, error) {
+	if len(cfg.Notify.SMTPPasswordFile) == 0 {
+		return cfg.Notify.SMTPPassword, nil
+	}
+	password, err := os.ReadFile(filepath.Clean(cfg.Notify.SMTPPasswordFile))
+	if err != nil {
+		return "", fmt.Errorf("could not read SMTP password file: %s", err.Error())
+	}
+	if trimmed, found := bytes.CutSuffix(password, []byte("\n")); found {
+		password, _ = bytes.CutSuffix(trimmed, []byte("\r"))
+	}
+	return string(password), nil
+}
+
+// SendNotification emails the summary of a backup run to the recipients configured in
+// `cfg.Notify`. Nothing is sent if no SMTP server is configured, or for successful runs if
+// `cfg.Notify.OnlyOnFailure` is set. Gives up after `cfg.Notify.SMTPTimeoutSeconds`.
+func SendNotification(cfg *Config, summary *RunSummary) error {
+	if len(cfg.Notify.SMTPHost) == 0 || (cfg.Notify.OnlyOnFailure && summary.Status == RunSucceeded) {
+		return nil
+	}
+	password, err := smtpPassword(cfg)
+	if err != nil {
+		return err
+	}
+
+	message := notificationMessage(cfg, summary)
+	err = sendMail(cfg, password, message)
+	if err != nil {
+		return fmt.Errorf("could not send notification via %s: %s", net.JoinHostPort(cfg.Notify.SMTPHost, strconv.FormatInt(cfg.Notify.SMTPPort, 10)), err.Error())
+	}
+	return nil
+}
+
+// sendMail delivers `message` over a connection secured as configured in
+// `cfg.Notify.SMTPSecurity`, authenticating if a username is set.
+func sendMail(cfg *Config, password string, message []byte) error {
+	host := cfg.Notify.SMTPHost
+	address := net.JoinHostPort(host, strconv.FormatInt(cfg.Notify.SMTPPort, 10))
+	timeout := time.Duration(cfg.Notify.SMTPTimeoutSeconds * float64(time.Second))
+
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if cfg.Notify.SMTPSecurity == SMTPSecurityTLS {
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, smtpTLSConfig(host))
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if cfg.Notify.SMTPSecurity == SMTPSecurityStartTLS {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return fmt.Errorf("server does not support STARTTLS")
+		}
+		if err = client.StartTLS(smtpTLSConfig(host)); err != nil {
+			return err
+		}
+	}
+	if len(cfg.Notify.SMTPUsername) > 0 {
+		if err = client.Auth(smtp.PlainAuth("", cfg.Notify.SMTPUsername, password, host)); err != nil {
+			return err
+		}
+	}
+
+	if err = client.Mail(cfg.Notify.SMTPFrom); err != nil {
+		return err
+	}
+	for _, recipient := range cfg.Notify.SMTPTo {
+		if err = client.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = writer.Write(message); err != nil {
+		return err
+	}
+	if err = writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// notificationSubject returns the subject line of the notification for `summary`.
+func notificationSubject(summary *RunSummary) string {
+	return fmt.Sprintf("[%s] backup %s: %s", tempFilePrefix, summary.Status, summary.Destination)
+}
+
+// notificationMessage formats the notification for `summary` as a plain text email.
+func notificationMessage(cfg *Config, summary *RunSummary) []byte {
+	var body strings.Builder
+	fmt.Fprintf(&body, "status: %s\n", summary.Status)
+	if hostname, err := cfg.BackupHostname(); err == nil {
+		fmt.Fprintf(&body, "host: %s\n", hostname)
+	}
+	fmt.Fprintf(&body, "source: %s\n", summary.Source)
+	fmt.Fprintf(&body, "destination: %s\n", summary.Destination)
+	if len(summary.Name) > 0 {
+		fmt.Fprintf(&body, "backup: %s\n", summary.Name)
+	}
+	fmt.Fprintf(&body, "started: %s\n", summary.Started.Format(time.RFC3339))
+	fmt.Fprintf(&body, "finished: %s\n", summary.Finished.Format(time.RFC3339))
+	if summary.Skipped {
+		fmt.Fprintf(&body, "backup directory unchanged, skipped\n")
+	}
+	if len(summary.Upload) > 0 {
+		fmt.Fprintf(&body, "upload: %s\n", summary.Upload)
+	}
+	if len(summary.Cleanup) > 0 {
+		fmt.Fprintf(&body, "cleanup: %s\n", summary.Cleanup)
+	}
+	if result := summary.Result; result != nil {
+		for _, object := range result.Objects {
+			fmt.Fprintf(&body, "object: %s\n", object.Object)
+		}
+		fmt.Fprintf(&body, "sizes: source %d bytes, archive %d bytes, uploaded %d bytes\n",
+			result.Sizes.Source, result.Sizes.Archive, result.Sizes.Uploaded)
+		if result.Cleanup != nil {
+			fmt.Fprintf(&body, "removed backups: %d\n", len(result.Cleanup.Removed))
+		}
+		fmt.Fprintf(&body, "stage timings: %s\n", result.Timings)
+	}
+	if len(summary.Warnings) > 0 {
+		fmt.Fprintf(&body, "%s\n", WarningsSummary(summary.Warnings))
+		for _, warning := range summary.Warnings {
+			fmt.Fprintf(&body, "warning [%s]: %s\n", warning.Code, warning.Message)
+		}
+	} else if result := summary.Result; result != nil {
+		for _, warning := range result.Warnings {
+			fmt.Fprintf(&body, "warning: %s\n", warning)
+		}
+	}
+	if summary.Err != nil {
+		fmt.Fprintf(&body, "error: %s\n", summary.Err.Error())
+	}
+	if summary.Status == RunFailed && len(summary.Log) > 0 {
+		fmt.Fprintf(&body, "\nlast %d log lines:\n", len(summary.Log))
+		for _, line := range summary.Log {
+			fmt.Fprintf(&body, "%s\n", line)
+		}
+	}
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", cfg.Notify.SMTPFrom)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(cfg.Notify.SMTPTo, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", notificationSubject(summary)))
+	fmt.Fprintf(&message, "Date: %s\r\n", summary.Finished.Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&message, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&message, "Content-Transfer-Encoding: 8bit\r\n")
+	fmt.Fprintf(&message, "\r\n")
+	message.WriteString(strings.ReplaceAll(body.String(), "\n", "\r\n"))
+	return message.Bytes()
+}
@@ -0,0 +1,411 @@
+package common
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type (
+	// mockSMTPMessage is a message received by mockSMTPServer.
+	mockSMTPMessage struct {
+		auth       string
+		from       string
+		recipients []string
+		data       string
+	}
+
+	// mockSMTPServer accepts a single SMTP session on the loopback interface.
+	mockSMTPServer struct {
+		port     int64
+		listener net.Listener
+		messages chan mockSMTPMessage
+	}
+)
+
+// helper function: TLS configuration of a server for 127.0.0.1 and a client trusting it.
+func mockTLSConfigs(t *testing.T) (*tls.Config, *tls.Config) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	defer server.Close()
+	clientConfig := server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	return &tls.Config{Certificates: server.TLS.Certificates}, clientConfig
+}
+
+// helper function: start a mock SMTP server. Connections are wrapped in TLS at once if
+// `implicit` is set, STARTTLS is offered if `starttls` is set.
+func startMockSMTPServer(t *testing.T, serverTLS *tls.Config, implicit, starttls bool) *mockSMTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen: %s", err.Error())
+	}
+	if implicit {
+		listener = tls.NewListener(listener, serverTLS)
+	}
+	server := &mockSMTPServer{
+		port:     int64(listener.Addr().(*net.TCPAddr).Port),
+		listener: listener,
+		messages: make(chan mockSMTPMessage, 1),
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer func() { conn.Close() }()
+		text := textproto.NewConn(conn)
+		var message mockSMTPMessage
+		_ = text.PrintfLine("220 localhost ESMTP")
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			command, argument, _ := strings.Cut(line, " ")
+			switch strings.ToUpper(command) {
+			case "EHLO":
+				if starttls {
+					_ = text.PrintfLine("250-localhost\r\n250-AUTH PLAIN\r\n250 STARTTLS")
+				} else {
+					_ = text.PrintfLine("250-localhost\r\n250 AUTH PLAIN")
+				}
+			case "STARTTLS":
+				_ = text.PrintfLine("220 ready")
+				conn = tls.Server(conn, serverTLS)
+				text = textproto.NewConn(conn)
+			case "AUTH":
+				_, credentials, _ := strings.Cut(argument, " ")
+				decoded, _ := base64.StdEncoding.DecodeString(credentials)
+				message.auth = string(decoded)
+				_ = text.PrintfLine("235 authenticated")
+			case "MAIL":
+				_, message.from, _ = strings.Cut(argument, ":")
+				_ = text.PrintfLine("250 ok")
+			case "RCPT":
+				_, recipient, _ := strings.Cut(argument, ":")
+				message.recipients = append(message.recipients, recipient)
+				_ = text.PrintfLine("250 ok")
+			case "DATA":
+				_ = text.PrintfLine("354 go ahead")
+				data, _ := io.ReadAll(text.DotReader())
+				message.data = string(data)
+				_ = text.PrintfLine("250 queued")
+			case "QUIT":
+				_ = text.PrintfLine("221 bye")
+				server.messages <- message
+				return
+			default:
+				_ = text.PrintfLine("502 unknown command")
+			}
+		}
+	}()
+	return server
+}
+
+// helper function: receive the message sent to a mock SMTP server.
+func (server *mockSMTPServer) receive(t *testing.T) mockSMTPMessage {
+	select {
+	case message := <-server.messages:
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no message received")
+	}
+	return mockSMTPMessage{}
+}
+
+// helper function: configuration sending notifications to a mock SMTP server.
+func setupNotifyConfig(t *testing.T, server *mockSMTPServer, security string) *Config {
+	var cfg Config
+	if err := cfg.SetDefaultValues(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	cfg.Backup.Hostname = "host"
+	cfg.Notify.SMTPHost = "127.0.0.1"
+	cfg.Notify.SMTPPort = server.port
+	cfg.Notify.SMTPSecurity = security
+	cfg.Notify.SMTPFrom = "squirrelup@example.com"
+	cfg.Notify.SMTPTo = []string{"admin@example.com", "oncall@example.com"}
+	return &cfg
+}
+
+// helper function: summary of a backup run.
+func mockRunSummary(status string, err error) *RunSummary {
+	objectUri, _ := url.Parse("b2://bucket/prefix/2024-05-01T03+0000.tar.gz")
+	summary := &RunSummary{
+		Status:      status,
+		Source:      "/data",
+		Destination: "b2://bucket/prefix/",
+		Name:        "2024-05-01T03+0000",
+		Started:     time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC),
+		Finished:    time.Date(2024, 5, 1, 3, 5, 0, 0, time.UTC),
+		Err:         err,
+		Log:         []string{"checking backup directory size...", "backup failed"},
+	}
+	if err == nil {
+		summary.Result = &BackupResult{
+			Objects: []BackupObject{{Object: objectUri}},
+			Sizes:   BackupSizes{Source: 1234, Archive: 567, Uploaded: 600},
+			Timings: StageTimings{Archive: time.Minute, Total: 5 * time.Minute},
+		}
+	}
+	return summary
+}
+
+/* test cases for SendNotification */
+func TestSendNotificationSuccess(t *testing.T) {
+	// Setup Test
+	server := startMockSMTPServer(t, nil, false, false)
+	cfg := setupNotifyConfig(t, server, SMTPSecurityNone)
+
+	// Perform the test
+	err := SendNotification(cfg, mockRunSummary(RunSucceeded, nil))
+	assertEquals(t, nil, err, "err")
+	received := server.receive(t)
+	assertEquals(t, "<squirrelup@example.com>", received.from, "from")
+	assertEquals(t, "<admin@example.com>,<oncall@example.com>", strings.Join(received.recipients, ","), "recipients")
+	assertEquals(t, "", received.auth, "auth")
+
+	message, err := mail.ReadMessage(strings.NewReader(received.data))
+	if err != nil {
+		t.Fatalf("could not parse message: %s", err.Error())
+	}
+	assertEquals(t, "squirrelup@example.com", message.Header.Get("From"), "From")
+	assertEquals(t, "admin@example.com, oncall@example.com", message.Header.Get("To"), "To")
+	assertEquals(t, "[SquirrelUp] backup succeeded: b2://bucket/prefix/", message.Header.Get("Subject"), "Subject")
+	assertEquals(t, "Wed, 01 May 2024 03:05:00 +0000", message.Header.Get("Date"), "Date")
+	assertEquals(t, "text/plain; charset=utf-8", message.Header.Get("Content-Type"), "Content-Type")
+	body, _ := io.ReadAll(message.Body)
+	assertEquals(t, "status: succeeded\n"+
+		"host: host\n"+
+		"source: /data\n"+
+		"destination: b2://bucket/prefix/\n"+
+		"backup: 2024-05-01T03+0000\n"+
+		"started: 2024-05-01T03:00:00Z\n"+
+		"finished: 2024-05-01T03:05:00Z\n"+
+		"object: b2://bucket/prefix/2024-05-01T03+0000.tar.gz\n"+
+		"sizes: source 1234 bytes, archive 567 bytes, uploaded 600 bytes\n"+
+		"stage timings: archive=1m00s encrypt=0s upload=0s cleanup=0s total=5m00s\n",
+		strings.ReplaceAll(string(body), "\r\n", "\n"), "body")
+}
+
+func TestSendNotificationFailure(t *testing.T) {
+	// Setup Test
+	server := startMockSMTPServer(t, nil, false, false)
+	cfg := setupNotifyConfig(t, server, SMTPSecurityNone)
+	cfg.Notify.OnlyOnFailure = true
+
+	// Perform the test
+	err := SendNotification(cfg, mockRunSummary(RunFailed, errors.New("backend operation failed: access denied")))
+	assertEquals(t, nil, err, "err")
+	message, err := mail.ReadMessage(strings.NewReader(server.receive(t).data))
+	if err != nil {
+		t.Fatalf("could not parse message: %s", err.Error())
+	}
+	assertEquals(t, "[SquirrelUp] backup failed: b2://bucket/prefix/", message.Header.Get("Subject"), "Subject")
+	body, _ := io.ReadAll(message.Body)
+	assertEquals(t, "status: failed\n"+
+		"host: host\n"+
+		"source: /data\n"+
+		"destination: b2://bucket/prefix/\n"+
+		"backup: 2024-05-01T03+0000\n"+
+		"started: 2024-05-01T03:00:00Z\n"+
+		"finished: 2024-05-01T03:05:00Z\n"+
+		"error: backend operation failed: access denied\n"+
+		"\n"+
+		"last 2 log lines:\n"+
+		"checking backup directory size...\n"+
+		"backup failed\n",
+		strings.ReplaceAll(string(body), "\r\n", "\n"), "body")
+}
+
+func TestNotificationMessageWarnings(t *testing.T) {
+	// Setup Test
+	cfg := new(Config)
+	summary := mockRunSummary(RunSucceeded, nil)
+	summary.Result.Warnings = []string{"skipped unreadable /data/a"}
+
+	/* warnings of the result are listed without a collector */
+	body := strings.ReplaceAll(string(notificationMessage(cfg, summary)), "\r\n", "\n")
+	assertEquals(t, true, strings.HasSuffix(body, "total=5m00s\n"+
+		"warning: skipped unreadable /data/a\n"), "body")
+
+	/* collected warnings are listed with their codes after a summary */
+	summary.Warnings = []Warning{
+		{WarningSkippedFile, "/data/a", "skipped unreadable /data/a"},
+		{WarningCatalog, "b2://bucket/prefix/", "could not update the catalog"},
+	}
+	body = strings.ReplaceAll(string(notificationMessage(cfg, summary)), "\r\n", "\n")
+	assertEquals(t, true, strings.HasSuffix(body, "total=5m00s\n"+
+		"2 warnings (catalog: 1, skipped_file: 1)\n"+
+		"warning [skipped_file]: skipped unreadable /data/a\n"+
+		"warning [catalog]: could not update the catalog\n"), "body")
+}
+
+func TestNotificationMessageSteps(t *testing.T) {
+	// Setup Test
+	cfg := new(Config)
+	summary := mockRunSummary(RunWarning, errors.New("warning: cleanup failed"))
+
+	/* steps are not listed before they were attempted */
+	body := strings.ReplaceAll(string(notificationMessage(cfg, summary)), "\r\n", "\n")
+	assertEquals(t, false, strings.Contains(body, "upload: "), "body")
+	assertEquals(t, false, strings.Contains(body, "cleanup: "), "body")
+
+	/* the outcomes of the upload and the cleanup are listed separately */
+	summary.Upload, summary.Cleanup = StepSucceeded, StepFailed
+	body = strings.ReplaceAll(string(notificationMessage(cfg, summary)), "\r\n", "\n")
+	assertEquals(t, true, strings.Contains(body, "upload: succeeded\ncleanup: failed\n"), "body")
+}
+
+func TestSendNotificationOnlyOnFailure(t *testing.T) {
+	// Setup Test
+	server := startMockSMTPServer(t, nil, false, false)
+	cfg := setupNotifyConfig(t, server, SMTPSecurityNone)
+	cfg.Notify.OnlyOnFailure = true
+
+	/* successful runs are not reported */
+	err := SendNotification(cfg, mockRunSummary(RunSucceeded, nil))
+	assertEquals(t, nil, err, "err")
+
+	/* warnings are */
+	err = SendNotification(cfg, mockRunSummary(RunWarning, errors.New("warning: cleanup failed")))
+	assertEquals(t, nil, err, "err")
+	message, err := mail.ReadMessage(strings.NewReader(server.receive(t).data))
+	if err != nil {
+		t.Fatalf("could not parse message: %s", err.Error())
+	}
+	assertEquals(t, "[SquirrelUp] backup succeeded with warnings: b2://bucket/prefix/", message.Header.Get("Subject"), "Subject")
+	body, _ := io.ReadAll(message.Body)
+	assertEquals(t, false, strings.Contains(string(body), "log lines"), "body")
+
+	/* nothing is sent without an SMTP server */
+	cfg.Notify.SMTPHost = ""
+	assertEquals(t, nil, SendNotification(cfg, mockRunSummary(RunFailed, errors.New("failed"))), "err")
+}
+
+func TestSendNotificationTLS(t *testing.T) {
+	// Setup Test
+	serverTLS, clientTLS := mockTLSConfigs(t)
+	smtpTLSConfig = func(host string) *tls.Config {
+		config := clientTLS.Clone()
+		config.ServerName = host
+		return config
+	}
+	defer func() {
+		smtpTLSConfig = func(host string) *tls.Config {
+			return &tls.Config{ServerName: host, MinVersion: tls.VersionTLS12}
+		}
+	}()
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if err := os.WriteFile(passwordFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatalf("could not write file: %s", err.Error())
+	}
+
+	for _, security := range []string{SMTPSecurityStartTLS, SMTPSecurityTLS} {
+		server := startMockSMTPServer(t, serverTLS, security == SMTPSecurityTLS, security == SMTPSecurityStartTLS)
+		cfg := setupNotifyConfig(t, server, security)
+		cfg.Notify.SMTPUsername = "user"
+		cfg.Notify.SMTPPasswordFile = passwordFile
+
+		// Perform the test
+		err := SendNotification(cfg, mockRunSummary(RunSucceeded, nil))
+		assertEquals(t, nil, err, "err("+security+")")
+		received := server.receive(t)
+		assertEquals(t, "\x00user\x00secret", received.auth, "auth("+security+")")
+		assertEquals(t, true, strings.Contains(received.data, "Subject: [SquirrelUp] backup succeeded: "), "data("+security+")")
+	}
+}
+
+func TestSendNotificationErrors(t *testing.T) {
+	// Setup Test
+	server := startMockSMTPServer(t, nil, false, false)
+	cfg := setupNotifyConfig(t, server, SMTPSecurityStartTLS)
+	address := "127.0.0.1:" + strconv.FormatInt(server.port, 10)
+
+	/* STARTTLS is required unless disabled */
+	err := SendNotification(cfg, mockRunSummary(RunFailed, errors.New("failed")))
+	assertEquals(t, "could not send notification via "+address+": server does not support STARTTLS", fmt.Sprintf("%v", err), "err")
+
+	/* unreachable servers fail */
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	cfg.Notify.SMTPPort = int64(listener.Addr().(*net.TCPAddr).Port)
+	listener.Close()
+	err = SendNotification(cfg, mockRunSummary(RunFailed, errors.New("failed")))
+	assertEquals(t, true, err != nil && strings.HasPrefix(err.Error(), "could not send notification via 127.0.0.1:"), "err")
+
+	/* servers that do not respond time out */
+	silent, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer silent.Close()
+	go func() {
+		conn, err := silent.Accept()
+		if err == nil {
+			_, _ = bufio.NewReader(conn).ReadString('\n')
+			conn.Close()
+		}
+	}()
+	cfg.Notify.SMTPPort = int64(silent.Addr().(*net.TCPAddr).Port)
+	cfg.Notify.SMTPTimeoutSeconds = 0.05
+	started := time.Now()
+	err = SendNotification(cfg, mockRunSummary(RunFailed, errors.New("failed")))
+	assertEquals(t, true, err != nil && strings.Contains(err.Error(), "i/o timeout"), "err")
+	assertEquals(t, true, time.Since(started) < 5*time.Second, "timeout")
+
+	/* missing password files fail */
+	cfg.Notify.SMTPPasswordFile = filepath.Join(t.TempDir(), "missing")
+	err = SendNotification(cfg, mockRunSummary(RunFailed, errors.New("failed")))
+	assertEquals(t, true, err != nil && strings.HasPrefix(err.Error(), "could not read SMTP password file: "), "err")
+}
+
+/* test cases for validateNotify */
+func TestValidateNotify(t *testing.T) {
+	// Setup Test
+	var cfg Config
+	if err := cfg.SetDefaultValues(); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	/* notifications are disabled by default */
+	assertEquals(t, nil, cfg.validateNotify(), "disabled")
+	assertEquals(t, int64(587), cfg.Notify.SMTPPort, "cfg.Notify.SMTPPort")
+	assertEquals(t, SMTPSecurityStartTLS, cfg.Notify.SMTPSecurity, "cfg.Notify.SMTPSecurity")
+	assertEquals(t, 30.0, cfg.Notify.SMTPTimeoutSeconds, "cfg.Notify.SMTPTimeoutSeconds")
+	assertEquals(t, int64(20), cfg.Notify.LogLines, "cfg.Notify.LogLines")
+
+	cfg.Notify.SMTPHost = "smtp.example.com"
+	cfg.Notify.SMTPFrom = "squirrelup@example.com"
+	cfg.Notify.SMTPTo = []string{"admin@example.com"}
+	assertEquals(t, nil, cfg.validateNotify(), "valid")
+
+	for _, testCase := range []struct {
+		modify   func(cfg *Config)
+		expected string
+	}{
+		{func(cfg *Config) { cfg.Notify.SMTPSecurity = "ssl" }, `invalid SMTP security "ssl", expecting "starttls", "tls" or "none"`},
+		{func(cfg *Config) { cfg.Notify.SMTPPort = 0 }, "invalid SMTP port 0"},
+		{func(cfg *Config) { cfg.Notify.SMTPPassword, cfg.Notify.SMTPPasswordFile = "secret", "/etc/password" }, "SMTP password and password file are mutually exclusive"},
+		{func(cfg *Config) { cfg.Notify.SMTPTo = nil }, "notifications require a sender and at least one recipient"},
+		{func(cfg *Config) { cfg.Notify.SMTPTimeoutSeconds = 0 }, "SMTP timeout must be positive"},
+		{func(cfg *Config) { cfg.Notify.LogLines = -1 }, "number of log lines must be between 0 and 1000"},
+		{func(cfg *Config) { cfg.Notify.LogLines = 1001 }, "number of log lines must be between 0 and 1000"},
+	} {
+		modified := cfg
+		testCase.modify(&modified)
+		assertEquals(t, testCase.expected, fmt.Sprintf("%v", modified.validateNotify()), "validateNotify")
+	}
+}
@@ -0,0 +1,152 @@
+package common
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+type (
+	// bufferedPart holds a part of a multipart upload in memory, so it is read from the
+	// input once, even though it is hashed before being sent and sent again on retries.
+	// The buffer is taken from partBufferPool when the part is first read and returned
+	// by release.
+	bufferedPart struct {
+		sr       *io.SectionReader
+		buf      *[]byte
+		position int64
+		md5      string
+		sha256   string
+	}
+
+	// partChecksummer is implemented by request bodies able to provide their checksums
+	// without being read by the SDK, empty checksums are computed by the SDK.
+	partChecksummer interface {
+		checksums() (md5 string, sha256 string, err error)
+	}
+)
+
+// partBufferPool holds buffers of parts that finished uploading, see bufferedPart.
+var partBufferPool sync.Pool
+
+// newBufferedPart creates a bufferedPart for the data of `sr`, nothing is read yet.
+func newBufferedPart(sr *io.SectionReader) *bufferedPart {
+	return &bufferedPart{sr: sr}
+}
+
+// Size returns the size of the part in bytes.
+func (bp *bufferedPart) Size() int64 {
+	return bp.sr.Size()
+}
+
+// load reads the part into a buffer and computes its checksums, unless already done.
+func (bp *bufferedPart) load() error {
+	if bp.buf != nil {
+		return nil
+	}
+
+	size := int(bp.sr.Size())
+	buf, _ := partBufferPool.Get().(*[]byte)
+	if buf == nil || cap(*buf) < size {
+		// buffers of smaller parts are dropped
+		data := make([]byte, size)
+		buf = &data
+	}
+	*buf = (*buf)[:size]
+
+	n, err := bp.sr.ReadAt(*buf, 0)
+	if n < size {
+		partBufferPool.Put(buf)
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+
+	md5sum := md5.Sum(*buf)
+	sha256sum := sha256.Sum256(*buf)
+	bp.buf = buf
+	bp.md5 = base64.StdEncoding.EncodeToString(md5sum[:])
+	bp.sha256 = hex.EncodeToString(sha256sum[:])
+	return nil
+}
+
+// checksums returns the base64 encoded MD5 and hex encoded SHA-256 digests of the part.
+func (bp *bufferedPart) checksums() (string, string, error) {
+	if err := bp.load(); err != nil {
+		return "", "", err
+	}
+	return bp.md5, bp.sha256, nil
+}
+
+// Read reads the part from its buffer, loading it first if necessary.
+func (bp *bufferedPart) Read(p []byte) (int, error) {
+	if err := bp.load(); err != nil {
+		return 0, err
+	}
+	if bp.position >= int64(len(*bp.buf)) {
+		return 0, io.EOF
+	}
+	n := copy(p, (*bp.buf)[bp.position:])
+	bp.position += int64(n)
+	return n, nil
+}
+
+// Seek sets the offset for the next Read.
+func (bp *bufferedPart) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += bp.position
+	case io.SeekEnd:
+		offset += bp.sr.Size()
+	default:
+		return 0, errors.New("Seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("Seek: invalid offset")
+	}
+	bp.position = offset
+	return offset, nil
+}
+
+// release returns the buffer to partBufferPool, the part must not be read afterwards.
+// It is safe to call on a nil part.
+func (bp *bufferedPart) release() {
+	if bp == nil || bp.buf == nil {
+		return
+	}
+	partBufferPool.Put(bp.buf)
+	bp.buf = nil
+}
+
+// setPartChecksums is a request handler setting the checksum headers of uploaded parts that
+// provide them. Otherwise the SDK reads each part to compute them before sending it.
+func setPartChecksums(r *request.Request) {
+	input, ok := r.Params.(*s3.UploadPartInput)
+	if !ok {
+		return
+	}
+	part, ok := input.Body.(partChecksummer)
+	if !ok {
+		return
+	}
+	md5sum, sha256sum, err := part.checksums()
+	if err != nil {
+		r.Error = awserr.New("BodyHashError", "failed to read part", err)
+		return
+	}
+	if len(md5sum) == 0 || len(sha256sum) == 0 {
+		return
+	}
+	r.HTTPRequest.Header.Set("Content-Md5", md5sum)
+	r.HTTPRequest.Header.Set("X-Amz-Content-Sha256", sha256sum)
+}
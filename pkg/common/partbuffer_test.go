@@ -0,0 +1,113 @@
+package common
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+/* test cases for bufferedPart */
+func TestBufferedPart(t *testing.T) {
+	// Setup Test
+	data := []byte("0123456789")
+	var read atomic.Int64
+	part := newBufferedPart(io.NewSectionReader(&countingReaderAt{bytes.NewReader(data), &read}, 2, 6))
+	assertEquals(t, int64(6), part.Size(), "part.Size")
+	assertEquals(t, int64(0), read.Load(), "read")
+
+	// Perform the test
+	md5sum, sha256sum, err := part.checksums()
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	expectedMD5 := md5.Sum(data[2:8])
+	expectedSHA256 := sha256.Sum256(data[2:8])
+	assertEquals(t, base64.StdEncoding.EncodeToString(expectedMD5[:]), md5sum, "md5sum")
+	assertEquals(t, hex.EncodeToString(expectedSHA256[:]), sha256sum, "sha256sum")
+
+	/* the part is read from the input once */
+	for i := 0; i < 2; i++ {
+		content, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		assertEquals(t, "234567", string(content), "content")
+		n, err := part.Seek(0, io.SeekStart)
+		assertEquals(t, int64(0), n, "part.Seek")
+		assertEquals(t, nil, err, "part.Seek")
+	}
+	assertEquals(t, int64(6), read.Load(), "read")
+
+	n, _ := part.Seek(-2, io.SeekEnd)
+	assertEquals(t, int64(4), n, "part.Seek(SeekEnd)")
+	n, _ = part.Seek(1, io.SeekCurrent)
+	assertEquals(t, int64(5), n, "part.Seek(SeekCurrent)")
+	content, _ := io.ReadAll(part)
+	assertEquals(t, "7", string(content), "content")
+	if _, err = part.Seek(-1, io.SeekStart); err == nil {
+		t.Fatalf("Seek was supposed to fail")
+	}
+
+	/* buffers are released once */
+	part.release()
+	part.release()
+	assertEquals(t, (*[]byte)(nil), part.buf, "part.buf")
+	(*bufferedPart)(nil).release()
+}
+
+func TestBufferedPartShortInput(t *testing.T) {
+	// Setup Test
+	part := newBufferedPart(io.NewSectionReader(bytes.NewReader([]byte("0123")), 2, 6))
+
+	// Perform the test
+	if _, err := io.ReadAll(part); err != io.ErrUnexpectedEOF {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	if _, _, err := part.checksums(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+}
+
+/* test cases for setPartChecksums */
+func TestSetPartChecksums(t *testing.T) {
+	newRequest := func(params interface{}) *request.Request {
+		return &request.Request{Params: params, HTTPRequest: &http.Request{Header: http.Header{}}}
+	}
+	data := []byte("data")
+	md5sum := md5.Sum(data)
+	sha256sum := sha256.Sum256(data)
+
+	/* buffered parts */
+	part := newBufferedPart(io.NewSectionReader(bytes.NewReader(data), 0, 4))
+	r := newRequest(&s3.UploadPartInput{Body: newProgressPartReader(part, &DummyProgressReporter{}, 1)})
+	setPartChecksums(r)
+	assertEquals(t, nil, r.Error, "r.Error")
+	assertEquals(t, base64.StdEncoding.EncodeToString(md5sum[:]), r.HTTPRequest.Header.Get("Content-Md5"), "Content-Md5")
+	assertEquals(t, hex.EncodeToString(sha256sum[:]), r.HTTPRequest.Header.Get("X-Amz-Content-Sha256"), "X-Amz-Content-Sha256")
+
+	/* streamed parts and other operations are left to the SDK */
+	r = newRequest(&s3.UploadPartInput{Body: newProgressSectionReader(io.NewSectionReader(bytes.NewReader(data), 0, 4), &DummyProgressReporter{}, 1)})
+	setPartChecksums(r)
+	assertEquals(t, 0, len(r.HTTPRequest.Header), "len(Header)")
+	r = newRequest(&s3.PutObjectInput{Body: part})
+	setPartChecksums(r)
+	assertEquals(t, 0, len(r.HTTPRequest.Header), "len(Header)")
+
+	/* read errors fail the request */
+	part = newBufferedPart(io.NewSectionReader(bytes.NewReader(data), 2, 4))
+	r = newRequest(&s3.UploadPartInput{Body: part})
+	setPartChecksums(r)
+	if r.Error == nil {
+		t.Fatalf("setPartChecksums was supposed to fail")
+	}
+	assertEquals(t, 0, len(r.HTTPRequest.Header), "len(Header)")
+}
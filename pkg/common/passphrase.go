@@ -0,0 +1,134 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"golang.org/x/term"
+)
+
+const (
+	// prefix of binary age-encrypted files
+	ageHeaderPrefix = "age-encryption.org/"
+	// upper bound of the size of identity files, encrypted or not
+	maxIdentityFileSize = 1024 * 1024
+	// path of the controlling terminal, passphrases are read from it
+	terminalPath = "/dev/tty"
+)
+
+// ReadPassphrase prompts for a passphrase with `prompt` and returns it, it fails if there is
+// no terminal to read it from. Tests replace it to avoid the terminal.
+var ReadPassphrase func(prompt string) ([]byte, error) = readTerminalPassphrase
+
+// readTerminalPassphrase reads a passphrase from the controlling terminal without echoing it,
+// or from standard input if it is a terminal and there is no controlling terminal.
+func readTerminalPassphrase(prompt string) ([]byte, error) {
+	var input, output *os.File = os.Stdin, os.Stderr
+	if tty, err := os.OpenFile(terminalPath, os.O_RDWR, 0); err == nil {
+		defer tty.Close()
+		input, output = tty, tty
+	}
+	if !term.IsTerminal(int(input.Fd())) {
+		return nil, fmt.Errorf("no terminal to read the passphrase from")
+	}
+
+	fmt.Fprint(output, prompt)
+	passphrase, err := term.ReadPassword(int(input.Fd()))
+	fmt.Fprintln(output)
+	if err != nil {
+		return nil, fmt.Errorf("could not read passphrase: %s", err.Error())
+	}
+	return passphrase, nil
+}
+
+// isEncryptedIdentityFile returns true if `data` holds an age-encrypted file, binary or armored.
+func isEncryptedIdentityFile(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(ageHeaderPrefix)) || bytes.HasPrefix(bytes.TrimSpace(data), []byte(armor.Header))
+}
+
+// readIdentityFile returns the contents of the identity file at `path`. Files encrypted with
+// a passphrase, like those created by `age -p`, are decrypted in memory with the passphrase
+// read from `cfg.Encryption.IdentityPassphraseFile` or prompted for on the terminal, unless
+// `cfg.Internal.NoPrompt` is set.
+func readIdentityFile(path string, cfg *Config) ([]byte, error) {
+	identityFile, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return nil, fmt.Errorf("could not open identity file: %s", err.Error())
+	}
+	defer identityFile.Close()
+
+	data, err := io.ReadAll(io.LimitReader(identityFile, maxIdentityFileSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("could not read identity file: %s", err.Error())
+	} else if len(data) > maxIdentityFileSize {
+		return nil, fmt.Errorf("could not read identity file: exceeds %d bytes", maxIdentityFileSize)
+	}
+	if !isEncryptedIdentityFile(data) {
+		return data, nil
+	}
+
+	passphrase, err := identityPassphrase(path, cfg)
+	if err != nil {
+		return nil, err
+	}
+	identity, err := age.NewScryptIdentity(string(passphrase))
+	clear(passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt identity file %q: %s", path, err.Error())
+	}
+
+	var input io.Reader = bytes.NewReader(data)
+	if !bytes.HasPrefix(data, []byte(ageHeaderPrefix)) {
+		input = armor.NewReader(bufio.NewReader(bytes.NewReader(bytes.TrimSpace(data))))
+	}
+	plaintext, err := age.Decrypt(input, identity)
+	if err == nil {
+		data, err = io.ReadAll(io.LimitReader(plaintext, maxIdentityFileSize))
+	}
+	if err != nil {
+		var noMatch *age.NoIdentityMatchError
+		if errors.As(err, &noMatch) {
+			return nil, fmt.Errorf("could not decrypt identity file %q: wrong passphrase", path)
+		}
+		return nil, fmt.Errorf("could not decrypt identity file %q: %s", path, err.Error())
+	}
+	return data, nil
+}
+
+// identityPassphrase returns the passphrase of the identity file at `path`, see readIdentityFile.
+// A single trailing newline is stripped from passphrase files.
+func identityPassphrase(path string, cfg *Config) ([]byte, error) {
+	if len(cfg.Encryption.IdentityPassphraseFile) > 0 {
+		passphrase, err := os.ReadFile(filepath.Clean(cfg.Encryption.IdentityPassphraseFile))
+		if err != nil {
+			return nil, fmt.Errorf("could not read identity passphrase file: %s", err.Error())
+		}
+		if trimmed, found := bytes.CutSuffix(passphrase, []byte("\n")); found {
+			passphrase, _ = bytes.CutSuffix(trimmed, []byte("\r"))
+		}
+		if len(passphrase) == 0 {
+			return nil, fmt.Errorf("identity passphrase file %q is empty", cfg.Encryption.IdentityPassphraseFile)
+		}
+		return passphrase, nil
+	}
+
+	if cfg.Internal.NoPrompt {
+		return nil, fmt.Errorf("identity file %q is passphrase-protected, set SQUIRRELUP_IDENTITY_PASSPHRASE_FILE to read it", path)
+	}
+	passphrase, err := ReadPassphrase(fmt.Sprintf("Enter passphrase for identity file %q: ", path))
+	if err != nil {
+		return nil, fmt.Errorf("identity file %q is passphrase-protected, set SQUIRRELUP_IDENTITY_PASSPHRASE_FILE or run from a terminal: %s", path, err.Error())
+	}
+	if len(strings.TrimSpace(string(passphrase))) == 0 {
+		return nil, fmt.Errorf("could not decrypt identity file %q: empty passphrase", path)
+	}
+	return passphrase, nil
+}
@@ -0,0 +1,155 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+const (
+	// passphrase of testdata/identity.txt.age, created with `age -p`
+	fixturePassphrase = "correct horse battery staple"
+	// recipient of the identity in testdata/identity.txt.age
+	fixtureRecipient = "age14rewqkuzsr9nq8gvryy2pwucv5q72e64ctc28g2j8ja6lwavpq9stxmcq6"
+)
+
+// helper function: replace ReadPassphrase to return `passphrase` or `err`, recording prompts.
+func stubPassphrase(t *testing.T, passphrase string, err error) *[]string {
+	var prompts []string
+	oldReadPassphrase := ReadPassphrase
+	ReadPassphrase = func(prompt string) ([]byte, error) {
+		prompts = append(prompts, prompt)
+		if err != nil {
+			return nil, err
+		}
+		return []byte(passphrase), nil
+	}
+	t.Cleanup(func() { ReadPassphrase = oldReadPassphrase })
+	return &prompts
+}
+
+// helper function: recipients of `cfg.Encryption.Identity`.
+func loadRecipients(cfg *Config) (string, error) {
+	identities, err := LoadIdentities(cfg)
+	if err != nil {
+		return "", err
+	}
+	var recipients []string
+	for _, identity := range identities {
+		if x25519, ok := identity.(*age.X25519Identity); ok {
+			recipients = append(recipients, x25519.Recipient().String())
+		}
+	}
+	return fmt.Sprint(recipients), nil
+}
+
+/* test cases for isEncryptedIdentityFile */
+func TestIsEncryptedIdentityFile(t *testing.T) {
+	// Setup Test
+	fixture, err := os.ReadFile("testdata/identity.txt.age")
+	if err != nil {
+		t.Fatalf("could not read fixture: %s", err.Error())
+	}
+
+	// Perform the test
+	assertEquals(t, true, isEncryptedIdentityFile(fixture), "binary")
+	assertEquals(t, true, isEncryptedIdentityFile([]byte("\n"+armor.Header+"\n")), "armored")
+	assertEquals(t, false, isEncryptedIdentityFile([]byte("# public key: age1...\nAGE-SECRET-KEY-1...\n")), "plaintext")
+	assertEquals(t, false, isEncryptedIdentityFile(nil), "empty")
+}
+
+/* test cases for LoadIdentities */
+func TestLoadIdentitiesPassphraseFile(t *testing.T) {
+	// Setup Test
+	prompts := stubPassphrase(t, "", fmt.Errorf("unexpected prompt"))
+	tmpDir := t.TempDir()
+	passphrasePath := filepath.Join(tmpDir, "passphrase")
+	var cfg Config
+	cfg.Encryption.Identity = "testdata/identity.txt.age"
+	cfg.Encryption.IdentityPassphraseFile = passphrasePath
+
+	// Perform the test
+	for _, content := range []string{fixturePassphrase, fixturePassphrase + "\n", fixturePassphrase + "\r\n"} {
+		if err := os.WriteFile(passphrasePath, []byte(content), 0600); err != nil {
+			t.Fatalf("could not write passphrase file: %s", err.Error())
+		}
+		recipients, err := loadRecipients(&cfg)
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		assertEquals(t, "["+fixtureRecipient+"]", recipients, "recipients")
+	}
+	assertEquals(t, 0, len(*prompts), "len(prompts)")
+
+	/* armored identity files are decrypted as well */
+	fixture, _ := os.ReadFile("testdata/identity.txt.age")
+	var armored bytes.Buffer
+	writer := armor.NewWriter(&armored)
+	_, _ = writer.Write(fixture)
+	_ = writer.Close()
+	cfg.Encryption.Identity = filepath.Join(tmpDir, "identity.txt.age")
+	if err := os.WriteFile(cfg.Encryption.Identity, armored.Bytes(), 0600); err != nil {
+		t.Fatalf("could not write identity file: %s", err.Error())
+	}
+	recipients, err := loadRecipients(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "["+fixtureRecipient+"]", recipients, "recipients")
+
+	/* errors */
+	for content, expected := range map[string]string{
+		"wrong horse": fmt.Sprintf("could not decrypt identity file %q: wrong passphrase", cfg.Encryption.Identity),
+		"\n":          fmt.Sprintf("identity passphrase file %q is empty", passphrasePath),
+	} {
+		if err := os.WriteFile(passphrasePath, []byte(content), 0600); err != nil {
+			t.Fatalf("could not write passphrase file: %s", err.Error())
+		}
+		_, err = loadRecipients(&cfg)
+		assertEquals(t, expected, fmt.Sprintf("%v", err), "err")
+	}
+	cfg.Encryption.IdentityPassphraseFile = filepath.Join(tmpDir, "missing")
+	_, err = loadRecipients(&cfg)
+	assertEquals(t, true, strings.HasPrefix(fmt.Sprintf("%v", err), "could not read identity passphrase file: "), "err")
+}
+
+func TestLoadIdentitiesPassphrasePrompt(t *testing.T) {
+	// Setup Test
+	prompts := stubPassphrase(t, fixturePassphrase, nil)
+	var cfg Config
+	cfg.Encryption.Identity = "testdata/identity.txt.age"
+
+	// Perform the test
+	recipients, err := loadRecipients(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "["+fixtureRecipient+"]", recipients, "recipients")
+	assertEquals(t, `[Enter passphrase for identity file "testdata/identity.txt.age": ]`, fmt.Sprint(*prompts), "prompts")
+
+	/* wrong and empty passphrases */
+	stubPassphrase(t, "wrong horse", nil)
+	_, err = loadRecipients(&cfg)
+	assertEquals(t, `could not decrypt identity file "testdata/identity.txt.age": wrong passphrase`, fmt.Sprintf("%v", err), "err")
+	stubPassphrase(t, " ", nil)
+	_, err = loadRecipients(&cfg)
+	assertEquals(t, `could not decrypt identity file "testdata/identity.txt.age": empty passphrase`, fmt.Sprintf("%v", err), "err")
+
+	/* without a terminal */
+	stubPassphrase(t, "", fmt.Errorf("no terminal to read the passphrase from"))
+	_, err = loadRecipients(&cfg)
+	assertEquals(t, `identity file "testdata/identity.txt.age" is passphrase-protected, set SQUIRRELUP_IDENTITY_PASSPHRASE_FILE or run from a terminal: no terminal to read the passphrase from`, fmt.Sprintf("%v", err), "err")
+
+	/* prompts can be disabled */
+	prompts = stubPassphrase(t, fixturePassphrase, nil)
+	cfg.Internal.NoPrompt = true
+	_, err = loadRecipients(&cfg)
+	assertEquals(t, `identity file "testdata/identity.txt.age" is passphrase-protected, set SQUIRRELUP_IDENTITY_PASSPHRASE_FILE to read it`, fmt.Sprintf("%v", err), "err")
+	assertEquals(t, 0, len(*prompts), "len(prompts)")
+}
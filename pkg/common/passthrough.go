@@ -0,0 +1,111 @@
+package common
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+type (
+	// backupArtifact is a file encrypted and stored as a backup object.
+	backupArtifact struct {
+		// file to encrypt and store
+		path string
+		// name of the backup object before extensions of the encryption are appended
+		name string
+		// size of the backed up data
+		sourceSize int64
+		// the file is removed once the backup is done
+		temporary bool
+	}
+)
+
+const (
+	// PassthroughMultipleReject fails passthrough backups of directories holding several files.
+	PassthroughMultipleReject = "reject"
+	// PassthroughMultipleIndividual stores every file of a passthrough backup as an object of
+	// its own, named after the backup followed by '_' and the file name.
+	PassthroughMultipleIndividual = "individual"
+
+	// limits of the components of file extensions kept by passthrough backups
+	passthrough_extension_components = 2
+	passthrough_extension_length     = 5
+)
+
+// passthroughArtifacts lists the regular files in `dirPath` to store as they are, without
+// archiving them first. Excluded files are left out, they are matched by their name below
+// `root` like entries of archives. A single file is named after the backup
+// `backupName` followed by its extension, several files are rejected unless
+// `cfg.Backup.PassthroughMultiple` is PassthroughMultipleIndividual. Subdirectories and other
+// non-regular files fail the backup, symbolic links to regular files are followed.
+func passthroughArtifacts(dirPath, root, backupName string, cfg *Config, filter ArchiveFilter) ([]backupArtifact, error) {
+	entries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not read backup directory: %s", err.Error())
+	}
+
+	var artifacts []backupArtifact
+	for _, entry := range entries {
+		if filter.Exclude != nil && filter.Exclude(path.Join(root, entry.Name())) {
+			continue
+		}
+		filePath := filepath.Join(dirPath, entry.Name())
+		info, err := os.Stat(filePath)
+		if err != nil {
+			return nil, fmt.Errorf("could not stat %q: %s", filePath, err.Error())
+		} else if !info.Mode().IsRegular() {
+			return nil, fmt.Errorf("passthrough backups store regular files only, %q is not", filePath)
+		}
+		artifacts = append(artifacts, backupArtifact{path: filePath, name: entry.Name(), sourceSize: info.Size()})
+	}
+
+	switch {
+	case len(artifacts) == 0:
+		return nil, fmt.Errorf("no files to back up in %q", dirPath)
+	case len(artifacts) == 1:
+		artifacts[0].name = backupName + passthroughExtension(artifacts[0].name)
+	case cfg.Backup.PassthroughMultiple == PassthroughMultipleIndividual:
+		for index := range artifacts {
+			artifacts[index].name = backupName + "_" + artifacts[index].name
+		}
+	default:
+		return nil, fmt.Errorf("passthrough backup of %q holds %d files, set backup.passthrough_multiple to %q to store them individually",
+			dirPath, len(artifacts), PassthroughMultipleIndividual)
+	}
+	return artifacts, nil
+}
+
+// passthroughExtension returns the extension of the file `name` kept in the name of its
+// backup: up to two trailing components of at most five letters and digits, at least one of
+// them a letter. For example '.dump.zst' of 'db.dump.zst' and '.tar' of 'export.2024-05-01.tar'.
+func passthroughExtension(name string) string {
+	var extension string
+	base := strings.TrimLeft(name, ".")
+	for count := 0; count < passthrough_extension_components; count++ {
+		dot := strings.LastIndex(base, ".")
+		if dot <= 0 || !isExtensionComponent(base[dot+1:]) {
+			break
+		}
+		extension = base[dot:] + extension
+		base = base[:dot]
+	}
+	return extension
+}
+
+// isExtensionComponent reports whether `component` may be part of a file extension.
+func isExtensionComponent(component string) bool {
+	if len(component) == 0 || len(component) > passthrough_extension_length {
+		return false
+	}
+	var letters bool
+	for _, char := range component {
+		if (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z') {
+			letters = true
+		} else if char < '0' || char > '9' {
+			return false
+		}
+	}
+	return letters
+}
@@ -0,0 +1,221 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+)
+
+// helper function: source directory holding files named after `contents`.
+func setupPassthroughSource(t *testing.T, contents map[string]string) string {
+	srcDir := t.TempDir()
+	for name, content := range contents {
+		if err := os.WriteFile(filepath.Join(srcDir, name), []byte(content), 0600); err != nil {
+			t.Fatalf("could not write to temporary file: %s", err.Error())
+		}
+	}
+	return srcDir
+}
+
+/* test cases for passthroughExtension */
+func TestPassthroughExtension(t *testing.T) {
+	for name, expected := range map[string]string{
+		"db.dump.zst":                  ".dump.zst",
+		"snapshot.sql.gz":              ".sql.gz",
+		"borg-export.2024-05-01.tar":   ".tar",
+		"archive.2024.tar.gz":          ".tar.gz",
+		"data.backup.tar.gz":           ".tar.gz",
+		"export.2024":                  "",
+		"export":                       "",
+		".hidden":                      "",
+		".hidden.tar":                  ".tar",
+		"image.qcow2":                  ".qcow2",
+		"notes.markdown":               "",
+		"release-1.2.3":                "",
+		"file.":                        "",
+		"strange.ext ension":           "",
+		"db.DUMP":                      ".DUMP",
+		"multiple..dots.tar":           ".dots.tar",
+		"2024-05-01T03-0000.tar.zst":   ".tar.zst",
+		"vm-100-disk-0.raw.zst":        ".raw.zst",
+		"export.borg.tar.zst.somewhat": "",
+	} {
+		assertEquals(t, expected, passthroughExtension(name), "passthroughExtension("+name+")")
+	}
+}
+
+/* test cases for passthroughArtifacts */
+func TestPassthroughArtifacts(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	srcDir := setupPassthroughSource(t, map[string]string{"db.dump.zst": "dump", "notes.txt": "notes"})
+	exclude := ArchiveFilter{Exclude: func(name string) bool { return name == filepath.Base(srcDir)+"/notes.txt" }}
+
+	// Perform the test
+	artifacts, err := passthroughArtifacts(srcDir, archiveRoot(srcDir), "2024-05-01T03", cfg, exclude)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 1, len(artifacts), "len(artifacts)")
+	assertEquals(t, "2024-05-01T03.dump.zst", artifacts[0].name, "artifacts[0].name")
+	assertEquals(t, filepath.Join(srcDir, "db.dump.zst"), artifacts[0].path, "artifacts[0].path")
+	assertEquals(t, int64(4), artifacts[0].sourceSize, "artifacts[0].sourceSize")
+	assertEquals(t, false, artifacts[0].temporary, "artifacts[0].temporary")
+
+	/* several files are rejected unless stored individually */
+	_, err = passthroughArtifacts(srcDir, archiveRoot(srcDir), "2024-05-01T03", cfg, ArchiveFilter{})
+	assertEquals(t, fmt.Sprintf("passthrough backup of %q holds 2 files, set backup.passthrough_multiple to \"individual\" to store them individually", srcDir), fmt.Sprintf("%v", err), "err")
+
+	cfg.Backup.PassthroughMultiple = PassthroughMultipleIndividual
+	artifacts, err = passthroughArtifacts(srcDir, archiveRoot(srcDir), "2024-05-01T03", cfg, ArchiveFilter{})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 2, len(artifacts), "len(artifacts)")
+	assertEquals(t, "2024-05-01T03_db.dump.zst", artifacts[0].name, "artifacts[0].name")
+	assertEquals(t, "2024-05-01T03_notes.txt", artifacts[1].name, "artifacts[1].name")
+
+	/* directories without files and nested directories fail */
+	emptyDir := t.TempDir()
+	_, err = passthroughArtifacts(emptyDir, archiveRoot(emptyDir), "2024-05-01T03", cfg, ArchiveFilter{})
+	assertEquals(t, fmt.Sprintf("no files to back up in %q", emptyDir), fmt.Sprintf("%v", err), "err")
+
+	nestedDir := filepath.Join(srcDir, "nested")
+	_ = os.Mkdir(nestedDir, 0700)
+	_, err = passthroughArtifacts(srcDir, archiveRoot(srcDir), "2024-05-01T03", cfg, ArchiveFilter{})
+	assertEquals(t, fmt.Sprintf("passthrough backups store regular files only, %q is not", nestedDir), fmt.Sprintf("%v", err), "err")
+
+	_, err = passthroughArtifacts(filepath.Join(emptyDir, "missing"), "missing", "2024-05-01T03", cfg, ArchiveFilter{})
+	assertEquals(t, true, strings.HasPrefix(fmt.Sprintf("%v", err), "could not read backup directory: "), "err")
+}
+
+/* test cases for Backup */
+func TestBackupPassthrough(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	cfg.Backup.Passthrough = true
+	srcDir := setupPassthroughSource(t, map[string]string{"db.dump.zst": "compressed dump"})
+	memory := NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	identity, _ := age.GenerateX25519Identity()
+
+	// Perform the test
+	for _, recipients := range [][]age.Recipient{{identity.Recipient()}, nil} {
+		result, err := Backup(context.Background(), BackupOptions{
+			Source:      srcDir,
+			Destination: prefixUri,
+			Config:      cfg,
+			Backend:     memory,
+			Time:        time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC),
+			Recipients:  recipients,
+		})
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+
+		var buf bytes.Buffer
+		if err = memory.RetrieveFile(&buf, result.Object); err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		var content []byte
+		if len(recipients) > 0 {
+			assertEquals(t, "memory://bucket/prefix/2024-05-01T03.dump.zst.age", result.Object.String(), "result.Object")
+			reader, err := age.Decrypt(&buf, identity)
+			if err != nil {
+				t.Fatalf("could not decrypt backup: %s", err.Error())
+			}
+			content, _ = io.ReadAll(reader)
+		} else {
+			assertEquals(t, "memory://bucket/prefix/2024-05-01T03.dump.zst", result.Object.String(), "result.Object")
+			content = buf.Bytes()
+		}
+		assertEquals(t, "compressed dump", string(content), "content")
+		assertEquals(t, 1, len(result.Objects), "len(result.Objects)")
+		assertEquals(t, int64(15), result.Sizes.Source, "result.Sizes.Source")
+		assertEquals(t, int64(15), result.Sizes.Archive, "result.Sizes.Archive")
+
+		/* the source file is left in place */
+		stored, err := os.ReadFile(filepath.Join(srcDir, "db.dump.zst"))
+		assertEquals(t, "compressed dump", string(stored), "source")
+		assertEquals(t, nil, err, "err")
+	}
+
+	/* streams are archives already */
+	result, err := Backup(context.Background(), BackupOptions{
+		Destination: prefixUri,
+		Config:      cfg,
+		Backend:     memory,
+		Time:        time.Date(2024, 5, 1, 4, 0, 0, 0, time.UTC),
+		Input:       bytes.NewReader(make([]byte, 2*tar_block_size)),
+		InputFormat: InputFormatTar,
+	})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "2024-05-01T04.tar.gz", result.Name, "result.Name")
+}
+
+func TestBackupPassthroughIndividual(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	cfg.Backup.Passthrough = true
+	cfg.Backup.PassthroughMultiple = PassthroughMultipleIndividual
+	cfg.Backup.Hours = 24
+	srcDir := setupPassthroughSource(t, map[string]string{"db.dump.zst": "dump", "media.tar": "media!"})
+	memory := NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	var stdout bytes.Buffer
+
+	/* objects of an earlier backup of the same files expire individually */
+	for name, modified := range map[string]time.Time{
+		"2024-04-29T03_db.dump.zst": time.Date(2024, 4, 29, 3, 0, 0, 0, time.UTC),
+		"2024-04-29T03_media.tar":   time.Date(2024, 4, 29, 3, 0, 0, 0, time.UTC),
+		"2024-04-30T05_db.dump.zst": time.Date(2024, 4, 30, 5, 0, 0, 0, time.UTC),
+	} {
+		objectUri, _ := prefixUri.Parse(name)
+		_ = memory.StoreFile(context.Background(), StoreRequest{URI: objectUri, BodyAt: bytes.NewReader([]byte("old")), Length: 3})
+		_ = memory.SetFileModified(objectUri, modified)
+	}
+
+	// Perform the test
+	result, err := Backup(context.Background(), BackupOptions{
+		Source:      srcDir,
+		Destination: prefixUri,
+		Config:      cfg,
+		Backend:     memory,
+		Time:        time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC),
+		Stdout:      &stdout,
+	})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	assertEquals(t, 2, len(result.Objects), "len(result.Objects)")
+	assertEquals(t, "2024-05-01T03_db.dump.zst", result.Objects[0].Name, "result.Objects[0].Name")
+	assertEquals(t, int64(4), result.Objects[0].Sizes.Uploaded, "result.Objects[0].Sizes.Uploaded")
+	assertEquals(t, "2024-05-01T03_media.tar", result.Objects[1].Name, "result.Objects[1].Name")
+	assertEquals(t, int64(6), result.Objects[1].Sizes.Uploaded, "result.Objects[1].Sizes.Uploaded")
+	assertEquals(t, result.Objects[0].Object, result.Object, "result.Object")
+	assertEquals(t, result.Objects[0].Checksum, result.Checksum, "result.Checksum")
+	assertEquals(t, int64(10), result.Sizes.Uploaded, "result.Sizes.Uploaded")
+	assertEquals(t, true, result.Stored, "result.Stored")
+
+	var remaining []string
+	files, _ := memory.ListFiles(prefixUri)
+	for _, file := range files {
+		remaining = append(remaining, filepath.Base(file.Name()))
+	}
+	assertEquals(t, "2024-04-30T05_db.dump.zst,2024-05-01T03_db.dump.zst,2024-05-01T03_media.tar", strings.Join(remaining, ","), "remaining")
+	assertEquals(t, 2, len(result.Cleanup.Removed), "len(result.Cleanup.Removed)")
+	assertEquals(t, 3, len(result.Cleanup.Remaining), "len(result.Cleanup.Remaining)")
+	assertEquals(t, true, strings.Contains(stdout.String(), "uploaded backup archive of "+fmt.Sprintf("%q", srcDir)+" to \"memory://bucket/prefix/2024-05-01T03_media.tar\"\n"), "stdout")
+}
@@ -0,0 +1,187 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+
+	"github.com/mholt/archiver/v4"
+)
+
+type (
+	// byteBudget limits the number of bytes held at once.
+	byteBudget struct {
+		lock      sync.Mutex
+		cond      *sync.Cond
+		available int64
+	}
+
+	// prefetchJob reads a file ahead of the archive writer.
+	prefetchJob struct {
+		open   func() (io.ReadCloser, error)
+		size   int64
+		result chan prefetchResult
+	}
+
+	// prefetchResult holds the content of a file read ahead and the error that stopped
+	// reading it, if any. Errors of opening the file are returned without content.
+	prefetchResult struct {
+		data    []byte
+		openErr error
+		readErr error
+	}
+
+	// prefetchedFile replays a file read ahead, the budget it uses is returned once closed.
+	prefetchedFile struct {
+		reader   *bytes.Reader
+		readErr  error
+		size     int64
+		budget   *byteBudget
+		released sync.Once
+	}
+)
+
+const (
+	// regular files up to this size are read ahead of the archive writer
+	prefetch_max_file_size = 1024 * 1024
+	// upper bound of the data read ahead, but not archived yet
+	prefetch_budget = 64 * 1024 * 1024
+)
+
+// newByteBudget creates a budget of `available` bytes.
+func newByteBudget(available int64) *byteBudget {
+	budget := &byteBudget{available: available}
+	budget.cond = sync.NewCond(&budget.lock)
+	return budget
+}
+
+// acquire waits until `size` bytes are available and takes them. Returns false without
+// taking anything once `ctx` is done.
+func (bb *byteBudget) acquire(ctx context.Context, size int64) bool {
+	stop := context.AfterFunc(ctx, func() {
+		bb.lock.Lock()
+		defer bb.lock.Unlock()
+		bb.cond.Broadcast()
+	})
+	defer stop()
+
+	bb.lock.Lock()
+	defer bb.lock.Unlock()
+	for bb.available < size && ctx.Err() == nil {
+		bb.cond.Wait()
+	}
+	if ctx.Err() != nil {
+		return false
+	}
+	bb.available -= size
+	return true
+}
+
+// release returns `size` bytes to the budget.
+func (bb *byteBudget) release(size int64) {
+	bb.lock.Lock()
+	defer bb.lock.Unlock()
+	bb.available += size
+	bb.cond.Broadcast()
+}
+
+func (pf *prefetchedFile) Read(p []byte) (int, error) {
+	n, err := pf.reader.Read(p)
+	if err == io.EOF && pf.readErr != nil {
+		err = pf.readErr
+	}
+	return n, err
+}
+
+func (pf *prefetchedFile) Close() error {
+	pf.released.Do(func() { pf.budget.release(pf.size) })
+	return nil
+}
+
+// run reads the file of the job and delivers the result.
+func (job *prefetchJob) run() {
+	var result prefetchResult
+	file, err := job.open()
+	if err != nil {
+		result.openErr = err
+	} else {
+		// a file grown since the walk is read one byte past its size, which fails the
+		// archive writer just like reading it sequentially
+		data := make([]byte, job.size+1)
+		n, err := io.ReadFull(file, data)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+		result.data, result.readErr = data[:n], err
+		_ = file.Close()
+	}
+	job.result <- result
+}
+
+// prefetchFiles makes `files` read regular files of up to `maxFileSize` bytes ahead of the
+// archive writer with `concurrency` goroutines. Files are read in the order of `files` and
+// at most `budget` bytes are held before the archive writer consumes them. Errors are
+// reported when the archive writer opens or reads the affected file, as they would be
+// without prefetching. The returned function stops reading ahead, it must be called once
+// the archive is written.
+func prefetchFiles(ctx context.Context, files []archiver.File, concurrency int, maxFileSize, budget int64) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	bytesBudget := newByteBudget(budget)
+	maxFileSize = min(maxFileSize, budget)
+
+	var queue []*prefetchJob
+	for index := range files {
+		if !files[index].Mode().IsRegular() || files[index].Size() > maxFileSize {
+			continue
+		}
+		job := &prefetchJob{files[index].Open, files[index].Size(), make(chan prefetchResult, 1)}
+		queue = append(queue, job)
+		files[index].Open = func() (io.ReadCloser, error) {
+			select {
+			case result := <-job.result:
+				if result.openErr != nil {
+					bytesBudget.release(job.size)
+					return nil, result.openErr
+				}
+				return &prefetchedFile{reader: bytes.NewReader(result.data), readErr: result.readErr, size: job.size, budget: bytesBudget}, nil
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+
+	// dispatch jobs in archive order, so the next file to archive is never stuck behind
+	// files the writer has yet to consume
+	var wg sync.WaitGroup
+	jobs := make(chan *prefetchJob)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(jobs)
+		for _, job := range queue {
+			if !bytesBudget.acquire(ctx, job.size) {
+				return
+			}
+			select {
+			case jobs <- job:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for worker := 0; worker < concurrency; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				job.run()
+			}
+		}()
+	}
+
+	return func() {
+		cancel()
+		wg.Wait()
+	}
+}
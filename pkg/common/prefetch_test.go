@@ -0,0 +1,337 @@
+package common
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mholt/archiver/v4"
+)
+
+// failingReader returns its data, then fails.
+type failingReader struct {
+	data io.Reader
+	err  error
+}
+
+func (fr *failingReader) Read(p []byte) (int, error) {
+	n, err := fr.data.Read(p)
+	if err == io.EOF {
+		err = fr.err
+	}
+	return n, err
+}
+
+func (fr *failingReader) Close() error {
+	return nil
+}
+
+// helper function: write `count` files of `size` bytes to `dirPath`, spread over subdirectories.
+func writeSmallFiles(tb testing.TB, dirPath string, count, size int) {
+	for index := 0; index < count; index++ {
+		subDir := filepath.Join(dirPath, fmt.Sprintf("dir%02d", index%16))
+		if err := os.MkdirAll(subDir, 0700); err != nil {
+			tb.Fatalf("could not create directory: %s", err.Error())
+		}
+		data := []byte(strings.Repeat(fmt.Sprintf("%08d", index), size/8+1)[:size])
+		if err := os.WriteFile(filepath.Join(subDir, fmt.Sprintf("file%05d", index)), data, 0600); err != nil {
+			tb.Fatalf("could not write to temporary file: %s", err.Error())
+		}
+	}
+}
+
+// helper function: list entries of a gzip-compressed TAR archive as "name:content" for
+// regular files and "name" otherwise.
+func listArchive(t *testing.T, archivePath string) []string {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		t.Fatalf("could not open archive: %s", err.Error())
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("could not decompress archive: %s", err.Error())
+	}
+	var entries []string
+	reader := tar.NewReader(gz)
+	for {
+		hdr, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("could not read archive: %s", err.Error())
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			data, _ := io.ReadAll(reader)
+			entries = append(entries, hdr.Name+":"+string(data))
+		} else {
+			entries = append(entries, hdr.Name)
+		}
+	}
+	return entries
+}
+
+/* test cases for byteBudget */
+func TestByteBudget(t *testing.T) {
+	budget := newByteBudget(10)
+	assertEquals(t, true, budget.acquire(context.Background(), 6), "acquire(6)")
+
+	/* waits for bytes to be released */
+	acquired := make(chan bool)
+	go func() { acquired <- budget.acquire(context.Background(), 6) }()
+	select {
+	case <-acquired:
+		t.Fatalf("acquire was supposed to wait")
+	case <-time.After(10 * time.Millisecond):
+	}
+	budget.release(6)
+	assertEquals(t, true, <-acquired, "acquire(6)")
+
+	/* gives up once the context is done */
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { acquired <- budget.acquire(ctx, 6) }()
+	cancel()
+	assertEquals(t, false, <-acquired, "acquire(6)")
+	assertEquals(t, int64(4), budget.available, "budget.available")
+}
+
+/* test cases for prefetchFiles */
+func TestPrefetchFiles(t *testing.T) {
+	// Setup Test
+	srcDir := t.TempDir()
+	writeSmallFiles(t, srcDir, 40, 5)
+	if err := os.WriteFile(filepath.Join(srcDir, "large"), []byte(strings.Repeat("x", 64)), 0600); err != nil {
+		t.Fatalf("could not write to temporary file: %s", err.Error())
+	}
+	files, err := archiver.FilesFromDisk(nil, map[string]string{srcDir: ""})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	// Perform the test, the budget only fits two small files at once
+	stop := prefetchFiles(context.Background(), files, 4, 32, 10)
+	defer stop()
+
+	var regular int
+	for _, file := range files {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		regular++
+		reader, err := file.Open()
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		data, err := io.ReadAll(reader)
+		_ = reader.Close()
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		// entries are named relative to the parent of the source directory
+		expected, _ := os.ReadFile(filepath.Join(filepath.Dir(srcDir), file.NameInArchive))
+		assertEquals(t, string(expected), string(data), file.NameInArchive)
+		if file.Name() == "large" {
+			_, prefetched := reader.(*prefetchedFile)
+			assertEquals(t, false, prefetched, "large file prefetched")
+		}
+	}
+	assertEquals(t, 41, regular, "regular")
+}
+
+func TestPrefetchFilesErrors(t *testing.T) {
+	// Setup Test
+	srcDir := setupBackupSource(t)
+	info, err := os.Stat(filepath.Join(srcDir, "file.txt"))
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	openErr := errors.New("open failed")
+	readErr := errors.New("read failed")
+	files := []archiver.File{
+		{FileInfo: info, NameInArchive: "open", Open: func() (io.ReadCloser, error) { return nil, openErr }},
+		{FileInfo: info, NameInArchive: "read", Open: func() (io.ReadCloser, error) {
+			return &failingReader{strings.NewReader("test"), readErr}, nil
+		}},
+	}
+
+	// Perform the test
+	stop := prefetchFiles(context.Background(), files, 2, prefetch_max_file_size, int64(info.Size()))
+	defer stop()
+
+	/* opening fails when the file is opened */
+	if _, err = files[0].Open(); err != openErr {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	/* reading fails after the data read before the error */
+	reader, err := files[1].Open()
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	data, err := io.ReadAll(reader)
+	assertEquals(t, "test", string(data), "data")
+	assertEquals(t, readErr, err, "err")
+	_ = reader.Close()
+}
+
+func TestPrefetchFilesStop(t *testing.T) {
+	// Setup Test
+	srcDir := t.TempDir()
+	writeSmallFiles(t, srcDir, 20, 5)
+	files, err := archiver.FilesFromDisk(nil, map[string]string{srcDir: ""})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	// Perform the test, files are never consumed
+	stop := prefetchFiles(context.Background(), files, 2, 32, 10)
+	stop()
+
+	for _, file := range files {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		if reader, err := file.Open(); err == nil {
+			_ = reader.Close()
+		} else {
+			assertEquals(t, context.Canceled, err, "err")
+		}
+	}
+}
+
+/* test cases for ArchiveDirectory */
+func TestArchiveDirectoryReadConcurrency(t *testing.T) {
+	// Setup Test
+	srcDir := t.TempDir()
+	writeSmallFiles(t, srcDir, 100, 100)
+	if err := os.WriteFile(filepath.Join(srcDir, "large"), make([]byte, prefetch_max_file_size+1), 0600); err != nil {
+		t.Fatalf("could not write to temporary file: %s", err.Error())
+	}
+	cfg := setupBackupConfig(t)
+
+	// Perform the test
+	archivePath, size, err := ArchiveDirectory(context.Background(), srcDir, cfg, ArchiveFilter{})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	defer os.Remove(archivePath)
+	sequential := listArchive(t, archivePath)
+
+	cfg.Backup.ReadConcurrency = 4
+	archivePath, prefetchedSize, err := ArchiveDirectory(context.Background(), srcDir, cfg, ArchiveFilter{})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	defer os.Remove(archivePath)
+
+	/* entries are written in the same order */
+	assertEquals(t, size, prefetchedSize, "size")
+	assertEquals(t, 118, len(sequential), "len(entries)")
+	assertEquals(t, strings.Join(sequential, "\n"), strings.Join(listArchive(t, archivePath), "\n"), "entries")
+}
+
+func TestArchiveDirectoryReadConcurrencyError(t *testing.T) {
+	skipWithoutPermissionBits(t)
+	if os.Getuid() == 0 {
+		t.Skip("root can read files without permissions")
+	}
+
+	// Setup Test
+	srcDir := t.TempDir()
+	writeSmallFiles(t, srcDir, 20, 100)
+	if err := os.Chmod(filepath.Join(srcDir, "dir03", "file00003"), 0); err != nil {
+		t.Fatalf("could not change permissions: %s", err.Error())
+	}
+	cfg := setupBackupConfig(t)
+
+	// Perform the test
+	var messages []string
+	for _, concurrency := range []int64{0, 4} {
+		cfg.Backup.ReadConcurrency = concurrency
+		archivePath, _, err := ArchiveDirectory(context.Background(), srcDir, cfg, ArchiveFilter{})
+		_ = os.Remove(archivePath)
+		if err == nil {
+			t.Fatalf("ArchiveDirectory was supposed to fail")
+		}
+		messages = append(messages, err.Error())
+	}
+
+	/* the unreadable file fails the archive as without prefetching */
+	assertEquals(t, messages[0], messages[1], "err")
+}
+
+// BenchmarkArchiveDirectory archives a tree of many small files reading them sequentially
+// and ahead of the archive writer.
+func BenchmarkArchiveDirectory(b *testing.B) {
+	srcDir := b.TempDir()
+	writeSmallFiles(b, srcDir, 5000, 2048)
+	var cfg Config
+	if err := cfg.SetDefaultValues(); err != nil {
+		b.Fatalf(err.Error())
+	}
+
+	for _, concurrency := range []int64{0, 4, 16} {
+		b.Run(fmt.Sprintf("read_concurrency=%d", concurrency), func(b *testing.B) {
+			cfg.Backup.ReadConcurrency = concurrency
+			b.SetBytes(5000 * 2048)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				archivePath, _, err := ArchiveDirectory(context.Background(), srcDir, &cfg, ArchiveFilter{})
+				_ = os.Remove(archivePath)
+				if err != nil {
+					b.Fatalf("unexpected test result: %+v", err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkPrefetchFiles writes a TAR archive of many small files that take `latency` to
+// open, as on a busy disk or a network file system, reading them sequentially and ahead of
+// the archive writer.
+func BenchmarkPrefetchFiles(b *testing.B) {
+	const latency = 100 * time.Microsecond
+	srcDir := b.TempDir()
+	writeSmallFiles(b, srcDir, 2000, 2048)
+
+	for _, concurrency := range []int{0, 4, 16} {
+		b.Run(fmt.Sprintf("read_concurrency=%d", concurrency), func(b *testing.B) {
+			b.SetBytes(2000 * 2048)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				files, err := archiver.FilesFromDisk(nil, map[string]string{srcDir: ""})
+				if err != nil {
+					b.Fatalf("unexpected test result: %+v", err)
+				}
+				for index := range files {
+					open := files[index].Open
+					files[index].Open = func() (io.ReadCloser, error) {
+						time.Sleep(latency)
+						return open()
+					}
+				}
+				b.StartTimer()
+
+				stop := func() {}
+				if concurrency > 0 {
+					stop = prefetchFiles(context.Background(), files, concurrency, prefetch_max_file_size, prefetch_budget)
+				}
+				err = archiver.Tar{}.Archive(context.Background(), io.Discard, files)
+				stop()
+				if err != nil {
+					b.Fatalf("unexpected test result: %+v", err)
+				}
+			}
+		})
+	}
+}
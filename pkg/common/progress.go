@@ -3,6 +3,7 @@ package common
 import (
 	"fmt"
 	"io"
+	"os"
 	"slices"
 	"sync"
 
@@ -10,27 +11,57 @@ import (
 )
 
 type (
+	// ProgressStyle selects how progress is displayed.
+	ProgressStyle int
+
 	// DummyProgressReporter is just a stub.
 	DummyProgressReporter struct {
 	}
 
 	// MultiProgressbarReporter reportes progress of individual taks via progressbars.
+	//
+	// All methods are safe for concurrent use. `barLock` guards the tasks and the lines
+	// assigned to them, `wrLock` guards the output and the cursor position. Where both
+	// are needed, `barLock` is acquired first.
 	MultiProgressbarReporter struct {
-		active   []int
-		bars     map[int]*progressbar.ProgressBar
-		barLock  sync.Mutex
-		wrLock   sync.Mutex
+		active     []int
+		bars       map[int]*progressbar.ProgressBar
+		barLock    sync.Mutex
+		wrLock     sync.Mutex
+		output     io.Writer
+		curLine    int
+		totLines   int
+		lastTask   int
+		enabled    bool
+		closed     bool
+		hideCursor bool
+		options    []progressbar.Option
+	}
+
+	// PlainProgressReporter reports progress of tasks as plain lines of text, a line is written
+	// whenever the description of a task changes and when a described task finishes. It is
+	// meant for terminals that cannot display progressbars. All methods are safe for
+	// concurrent use.
+	PlainProgressReporter struct {
 		output   io.Writer
-		curLine  int
-		totLines int
+		lock     sync.Mutex
+		lastTask int
+		tasks    map[int]string
 	}
 
-	// io.Writer wrapper to know which progressbar wants to write.
+	// io.Writer wrapper to know which progressbar wants to write. A new writer is assigned
+	// whenever the line of a progressbar changes, `Index` is never modified.
 	multiProgressbarWriter struct {
 		*MultiProgressbarReporter
 		Index int
 	}
 
+	// io.Writer that advances a task by the number of bytes written.
+	progressTaskWriter struct {
+		ProgressReporter
+		Index int
+	}
+
 	// ProgressReporter is a generic interface to setting up progress reporting.
 	// Currently, it provisions following methods:
 	//   * AdvanceTask advance progress on a task given by its index by a cetain amount.
@@ -43,8 +74,69 @@ type (
 		DescribeTask(int, string) error
 		FinishTask(int) error
 	}
+
+	// ProgressReporterFacade is implemented by progress reporters that can be switched off.
+	// Callers query it before creating tasks.
+	ProgressReporterFacade interface {
+		Enabled() bool
+	}
+)
+
+const (
+	// ProgressHidden displays no progress at all.
+	ProgressHidden ProgressStyle = iota
+	// ProgressPlain displays progress as plain lines of text without colors or cursor movement.
+	ProgressPlain
+	// ProgressBars displays progressbars.
+	ProgressBars
+
+	// ANSI sequences hiding and showing the cursor while progressbars are drawn
+	ansiHideCursor = "\033[?25l"
+	ansiShowCursor = "\033[?25h"
 )
 
+// ProgressEnabled returns true if `pr` is set and, for reporters implementing
+// ProgressReporterFacade, progress reporting is enabled.
+func ProgressEnabled(pr ProgressReporter) bool {
+	if pr == nil {
+		return false
+	}
+	if facade, ok := pr.(ProgressReporterFacade); ok {
+		return facade.Enabled()
+	}
+	return true
+}
+
+// SelectProgressStyle decides how progress is displayed for the configuration `cfg` and the
+// environment given by `getenv`. Progress is hidden if disabled in the configuration or if
+// SQUIRRELUP_NO_PROGRESS is set, and displayed as plain text if NO_COLOR is set or TERM is
+// 'dumb'.
+func SelectProgressStyle(cfg *Config, getenv func(string) string) ProgressStyle {
+	if !cfg.Progress.Enabled || len(getenv("SQUIRRELUP_NO_PROGRESS")) > 0 {
+		return ProgressHidden
+	}
+	if len(getenv("NO_COLOR")) > 0 || getenv("TERM") == "dumb" {
+		return ProgressPlain
+	}
+	return ProgressBars
+}
+
+// NewProgressReporter creates the progress reporter selected by SelectProgressStyle for
+// the configuration `cfg` and the process environment. Returns nil if progress is hidden.
+// Progress is displayed as plain text on consoles that cannot move the cursor.
+func NewProgressReporter(output io.Writer, cfg *Config) ProgressReporter {
+	switch SelectProgressStyle(cfg, os.Getenv) {
+	case ProgressPlain:
+		return NewPlainProgressReporter(output)
+	case ProgressBars:
+		if !supportsAnsi(output) {
+			return NewPlainProgressReporter(output)
+		}
+		return NewConfiguredProgressbarReporter(output, cfg)
+	}
+	return nil
+}
+
 // AdvanceTask stub.
 func (dummy *DummyProgressReporter) AdvanceTask(index int, increment int64) error {
 	return nil
@@ -66,7 +158,8 @@ func (dummy *DummyProgressReporter) FinishTask(index int) error {
 }
 
 // NewMultiProgressbarReporter creates a MultiProgressBarReporter with a given `output`.
-func NewMultiProgressbarReporter(output io.Writer) *MultiProgressbarReporter {
+// The `options` are applied to every progressbar created by the reporter.
+func NewMultiProgressbarReporter(output io.Writer, options ...progressbar.Option) *MultiProgressbarReporter {
 	return &MultiProgressbarReporter{
 		active:   []int{},
 		bars:     map[int]*progressbar.ProgressBar{},
@@ -75,9 +168,26 @@ func NewMultiProgressbarReporter(output io.Writer) *MultiProgressbarReporter {
 		output:   output,
 		curLine:  1,
 		totLines: 1,
+		enabled:  true,
+		options:  options,
 	}
 }
 
+// NewConfiguredProgressbarReporter creates a MultiProgressBarReporter with a given `output`
+// according to the progress configuration in `cfg`. The cursor is hidden while progressbars
+// are displayed.
+func NewConfiguredProgressbarReporter(output io.Writer, cfg *Config) *MultiProgressbarReporter {
+	mpr := NewMultiProgressbarReporter(output, cfg.ProgressbarOptions()...)
+	mpr.enabled = cfg.Progress.Enabled
+	mpr.hideCursor = true
+	return mpr
+}
+
+// Enabled returns true if progressbars should be displayed.
+func (mpr *MultiProgressbarReporter) Enabled() bool {
+	return mpr.enabled
+}
+
 // AdvanceTask advances the progress by `increment` on a task specified by `index`.
 func (mpr *MultiProgressbarReporter) AdvanceTask(index int, increment int64) error {
 	mpr.barLock.Lock()
@@ -87,8 +197,12 @@ func (mpr *MultiProgressbarReporter) AdvanceTask(index int, increment int64) err
 		return fmt.Errorf("task index %d outside of available range", index)
 	}
 
-	if !mpr.bars[index].IsFinished() {
+	if !mpr.bars[index].IsFinished() && !mpr.closed {
 		if !slices.Contains(mpr.active, index) {
+			if len(mpr.active) == 0 && mpr.hideCursor {
+				// hide the cursor while progressbars are displayed
+				mpr.write(ansiHideCursor)
+			}
 			mpr.active = append(mpr.active, index)
 
 			progressbar.OptionSetWriter(&multiProgressbarWriter{
@@ -97,8 +211,7 @@ func (mpr *MultiProgressbarReporter) AdvanceTask(index int, increment int64) err
 			})(mpr.bars[index])
 
 			if len(mpr.active) > mpr.totLines {
-				fmt.Fprintf(mpr.output, "\n")
-				mpr.totLines++
+				mpr.addLine()
 			}
 		}
 
@@ -118,15 +231,19 @@ func (mpr *MultiProgressbarReporter) CreateFileTask(size int64) (int, error) {
 	mpr.barLock.Lock()
 	defer mpr.barLock.Unlock()
 
-	var index int = len(mpr.bars) + 1
+	// indices are never reused, finished tasks are removed from `bars`
+	mpr.lastTask++
+	var index int = mpr.lastTask
 
 	var bar *progressbar.ProgressBar = progressbar.NewOptions64(
 		size,
-		progressbar.OptionSetWriter(io.Discard),
-		progressbar.OptionShowBytes(true),
-		progressbar.OptionClearOnFinish(),
-		progressbar.OptionSetPredictTime(false),
-		progressbar.OptionSetRenderBlankState(false),
+		append([]progressbar.Option{
+			progressbar.OptionSetWriter(io.Discard),
+			progressbar.OptionShowBytes(true),
+			progressbar.OptionClearOnFinish(),
+			progressbar.OptionSetPredictTime(false),
+			progressbar.OptionSetRenderBlankState(false),
+		}, mpr.options...)...,
 	)
 
 	mpr.bars[index] = bar
@@ -169,6 +286,11 @@ func (mpr *MultiProgressbarReporter) FinishTask(index int) error {
 // remove a task that has finished
 func (mpr *MultiProgressbarReporter) remove(index int) {
 	active := slices.Index(mpr.active, index)
+	if active < 0 {
+		// task was never displayed
+		delete(mpr.bars, index)
+		return
+	}
 
 	mpr.active[active] = mpr.active[len(mpr.active)-1]
 	mpr.active = mpr.active[:len(mpr.active)-1]
@@ -184,9 +306,128 @@ func (mpr *MultiProgressbarReporter) remove(index int) {
 		})(mpr.bars[mpr.active[active]])
 		_ = mpr.bars[mpr.active[active]].RenderBlank()
 	}
+	if len(mpr.active) == 0 && mpr.hideCursor {
+		mpr.write(ansiShowCursor)
+	}
 	delete(mpr.bars, index)
 }
 
+// write `text` to the output without moving the cursor.
+func (mpr *MultiProgressbarReporter) write(text string) {
+	mpr.wrLock.Lock()
+	defer mpr.wrLock.Unlock()
+
+	fmt.Fprint(mpr.output, text)
+}
+
+// addLine appends a line for another progressbar below the last one.
+func (mpr *MultiProgressbarReporter) addLine() {
+	mpr.wrLock.Lock()
+	defer mpr.wrLock.Unlock()
+
+	_, _ = (&multiProgressbarWriter{MultiProgressbarReporter: mpr}).move(mpr.totLines, mpr.output)
+	fmt.Fprint(mpr.output, "\n")
+	mpr.totLines++
+	mpr.curLine = mpr.totLines
+}
+
+// Close clears all displayed progressbars, moves the cursor to the beginning of the last
+// line used by progressbars and shows the cursor again. Tasks are not displayed after
+// the reporter was closed.
+func (mpr *MultiProgressbarReporter) Close() error {
+	mpr.barLock.Lock()
+	defer mpr.barLock.Unlock()
+
+	if mpr.closed {
+		return nil
+	}
+	mpr.closed = true
+
+	if len(mpr.active) == 0 {
+		return nil
+	}
+	for _, index := range mpr.active {
+		_ = mpr.bars[index].Clear()
+		progressbar.OptionSetWriter(io.Discard)(mpr.bars[index])
+	}
+	mpr.active = []int{}
+
+	mpr.wrLock.Lock()
+	defer mpr.wrLock.Unlock()
+
+	_, err := (&multiProgressbarWriter{MultiProgressbarReporter: mpr}).move(mpr.totLines, mpr.output)
+	if err != nil {
+		return err
+	}
+	if mpr.hideCursor {
+		_, err = fmt.Fprint(mpr.output, "\r"+ansiShowCursor)
+	} else {
+		_, err = fmt.Fprint(mpr.output, "\r")
+	}
+	return err
+}
+
+// NewPlainProgressReporter creates a PlainProgressReporter with a given `output`.
+func NewPlainProgressReporter(output io.Writer) *PlainProgressReporter {
+	return &PlainProgressReporter{
+		output: output,
+		tasks:  map[int]string{},
+	}
+}
+
+// AdvanceTask checks that the task specified by `index` exists, progress is not displayed.
+func (ppr *PlainProgressReporter) AdvanceTask(index int, increment int64) error {
+	ppr.lock.Lock()
+	defer ppr.lock.Unlock()
+
+	if _, prs := ppr.tasks[index]; !prs {
+		return fmt.Errorf("task index %d outside of available range", index)
+	}
+	return nil
+}
+
+// CreateFileTask creates a new task, nothing is written until it is described.
+func (ppr *PlainProgressReporter) CreateFileTask(size int64) (int, error) {
+	ppr.lock.Lock()
+	defer ppr.lock.Unlock()
+
+	ppr.lastTask++
+	ppr.tasks[ppr.lastTask] = ""
+	return ppr.lastTask, nil
+}
+
+// DescribeTask writes the new description of a task specified by `index`.
+func (ppr *PlainProgressReporter) DescribeTask(index int, description string) error {
+	ppr.lock.Lock()
+	defer ppr.lock.Unlock()
+
+	previous, prs := ppr.tasks[index]
+	if !prs {
+		return fmt.Errorf("task index %d outside of available range", index)
+	}
+	if description != previous {
+		ppr.tasks[index] = description
+		fmt.Fprintf(ppr.output, "%s...\n", description)
+	}
+	return nil
+}
+
+// FinishTask finishes a task specified by `index`.
+func (ppr *PlainProgressReporter) FinishTask(index int) error {
+	ppr.lock.Lock()
+	defer ppr.lock.Unlock()
+
+	description, prs := ppr.tasks[index]
+	if !prs {
+		return fmt.Errorf("task index %d outside of available range", index)
+	}
+	if len(description) > 0 {
+		fmt.Fprintf(ppr.output, "%s done\n", description)
+	}
+	delete(ppr.tasks, index)
+	return nil
+}
+
 // Write to output stream on the respective line.
 func (mpw *multiProgressbarWriter) Write(p []byte) (n int, err error) {
 	mpw.wrLock.Lock()
@@ -199,6 +440,13 @@ func (mpw *multiProgressbarWriter) Write(p []byte) (n int, err error) {
 	return mpw.output.Write(p)
 }
 
+// Write advances the task by the number of bytes in `p`.
+func (ptw *progressTaskWriter) Write(p []byte) (n int, err error) {
+	n = len(p)
+	err = ptw.AdvanceTask(ptw.Index, int64(n))
+	return
+}
+
 // Move cursor to the beginning of the current progressbar.
 func (mpw *multiProgressbarWriter) move(index int, writer io.Writer) (int, error) {
 	bias := mpw.curLine - index
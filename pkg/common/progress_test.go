@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -199,3 +200,275 @@ func TestMultiProgressbarWriterInvalidMove(t *testing.T) {
 		assertEquals(t, "failWriter write failed", err.Error(), "TestMultiProgressbarWriterInvalidMove.Error")
 	}
 }
+
+func TestConfiguredProgressbarReporter(t *testing.T) {
+	var cfg Config
+	if err := cfg.SetDefaultValues(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	var output bytes.Buffer
+
+	/* width option is applied to created tasks */
+	cfg.Progress.Width = 10
+	mockMPR := NewConfiguredProgressbarReporter(&output, &cfg)
+	assertEquals(t, true, mockMPR.Enabled(), "mockMPR.Enabled")
+	assertEquals(t, true, ProgressEnabled(mockMPR), "ProgressEnabled")
+
+	index, err := mockMPR.CreateFileTask(100)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	_ = mockMPR.DescribeTask(index, "test")
+	_ = mockMPR.AdvanceTask(index, 10)
+	assertEquals(t, true, strings.Contains(output.String(), "test  10% |█         |"), "output")
+
+	/* disabled reporter */
+	cfg.Progress.Enabled = false
+	mockMPR = NewConfiguredProgressbarReporter(&output, &cfg)
+	assertEquals(t, false, mockMPR.Enabled(), "mockMPR.Enabled")
+	assertEquals(t, false, ProgressEnabled(mockMPR), "ProgressEnabled")
+}
+
+func TestProgressEnabled(t *testing.T) {
+	assertEquals(t, false, ProgressEnabled(nil), "ProgressEnabled(nil)")
+	assertEquals(t, true, ProgressEnabled(&DummyProgressReporter{}), "ProgressEnabled(DummyProgressReporter)")
+	assertEquals(t, true, ProgressEnabled(NewMultiProgressbarReporter(io.Discard)), "ProgressEnabled(MultiProgressbarReporter)")
+}
+
+func TestFileTaskIndexReuse(t *testing.T) {
+	// Setup Test
+	mockMPR := NewMultiProgressbarReporter(io.Discard)
+	first, _ := mockMPR.CreateFileTask(10)
+	second, _ := mockMPR.CreateFileTask(10)
+	_ = mockMPR.AdvanceTask(second, 1)
+
+	// Perform the test
+	if err := mockMPR.FinishTask(first); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	third, _ := mockMPR.CreateFileTask(10)
+	assertEquals(t, 3, third, "third")
+
+	/* finishing the new task leaves the live one intact */
+	if err := mockMPR.FinishTask(third); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	if err := mockMPR.AdvanceTask(second, 1); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 1, len(mockMPR.active), "len(mockMPR.active)")
+	assertEquals(t, second, mockMPR.active[0], "mockMPR.active[0]")
+}
+
+func TestFileTaskConcurrent(t *testing.T) {
+	const workers = 8
+	const tasks = 50
+
+	// Setup Test
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	var seen = map[int]bool{}
+	mockMPR := NewMultiProgressbarReporter(io.Discard)
+
+	// Perform the test
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < tasks; i++ {
+				index, err := mockMPR.CreateFileTask(4)
+				if err != nil {
+					t.Errorf("unexpected test result: %+v", err)
+					return
+				}
+				lock.Lock()
+				if seen[index] {
+					t.Errorf("task index %d was reused", index)
+				}
+				seen[index] = true
+				lock.Unlock()
+
+				_ = mockMPR.DescribeTask(index, "test")
+				_ = mockMPR.AdvanceTask(index, 2)
+				if i%2 == 0 {
+					_ = mockMPR.AdvanceTask(index, 2)
+				} else if err := mockMPR.FinishTask(index); err != nil {
+					t.Errorf("unexpected test result: %+v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	assertEquals(t, workers*tasks, len(seen), "len(seen)")
+	assertEquals(t, 0, len(mockMPR.bars), "len(mockMPR.bars)")
+	assertEquals(t, 0, len(mockMPR.active), "len(mockMPR.active)")
+}
+
+func TestFileTaskLines(t *testing.T) {
+	var output bytes.Buffer
+
+	// Setup Test
+	mockMPR := NewMultiProgressbarReporter(&output)
+	first, _ := mockMPR.CreateFileTask(10)
+	second, _ := mockMPR.CreateFileTask(10)
+	_ = mockMPR.AdvanceTask(first, 1)
+
+	// Perform the test
+	output.Reset()
+	_ = mockMPR.AdvanceTask(second, 1)
+	assertEquals(t, true, strings.HasPrefix(output.String(), "\n"), "output.HasPrefix")
+	assertEquals(t, 2, mockMPR.totLines, "mockMPR.totLines")
+	assertEquals(t, 2, mockMPR.curLine, "mockMPR.curLine")
+
+	/* the first progressbar is drawn one line up */
+	output.Reset()
+	_ = mockMPR.AdvanceTask(first, 1)
+	assertEquals(t, true, strings.HasPrefix(output.String(), "\r\033[1A"), "output.HasPrefix")
+	assertEquals(t, 1, mockMPR.curLine, "mockMPR.curLine")
+
+	/* a new line is added below the last one, wherever the cursor is */
+	third, _ := mockMPR.CreateFileTask(10)
+	output.Reset()
+	_ = mockMPR.AdvanceTask(third, 1)
+	assertEquals(t, true, strings.HasPrefix(output.String(), "\r\033[1B\n"), "output.HasPrefix")
+	assertEquals(t, 3, mockMPR.totLines, "mockMPR.totLines")
+	assertEquals(t, 3, mockMPR.curLine, "mockMPR.curLine")
+}
+
+func TestCloseFinished(t *testing.T) {
+	var cfg Config
+	if err := cfg.SetDefaultValues(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	var output bytes.Buffer
+
+	// Setup Test
+	mockMPR := NewConfiguredProgressbarReporter(&output, &cfg)
+	index, _ := mockMPR.CreateFileTask(10)
+	_ = mockMPR.AdvanceTask(index, 5)
+	assertEquals(t, true, strings.HasPrefix(output.String(), ansiHideCursor), "output.HasPrefix")
+
+	// Perform the test
+	_ = mockMPR.AdvanceTask(index, 5)
+	assertEquals(t, true, strings.HasSuffix(output.String(), ansiShowCursor), "output.HasSuffix")
+
+	/* nothing left to restore */
+	output.Reset()
+	if err := mockMPR.Close(); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "", output.String(), "output")
+}
+
+func TestCloseAborted(t *testing.T) {
+	var cfg Config
+	if err := cfg.SetDefaultValues(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	var output bytes.Buffer
+
+	// Setup Test
+	mockMPR := NewConfiguredProgressbarReporter(&output, &cfg)
+	first, _ := mockMPR.CreateFileTask(10)
+	second, _ := mockMPR.CreateFileTask(10)
+	_ = mockMPR.AdvanceTask(first, 5)
+	_ = mockMPR.AdvanceTask(second, 5)
+	_ = mockMPR.AdvanceTask(first, 1)
+
+	// Perform the test
+	output.Reset()
+	if err := mockMPR.Close(); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, true, strings.HasSuffix(output.String(), "\r"+ansiShowCursor), "output.HasSuffix")
+	assertEquals(t, 2, mockMPR.curLine, "mockMPR.curLine")
+	assertEquals(t, 2, mockMPR.totLines, "mockMPR.totLines")
+	assertEquals(t, 0, len(mockMPR.active), "len(mockMPR.active)")
+
+	/* closed reporter does not display tasks */
+	output.Reset()
+	_ = mockMPR.AdvanceTask(second, 1)
+	if err := mockMPR.Close(); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "", output.String(), "output")
+}
+
+func TestSelectProgressStyle(t *testing.T) {
+	var cfg Config
+	if err := cfg.SetDefaultValues(); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	var tests = []struct {
+		enabled  bool
+		env      map[string]string
+		expected ProgressStyle
+	}{
+		{true, map[string]string{}, ProgressBars},
+		{true, map[string]string{"TERM": "xterm-256color"}, ProgressBars},
+		{true, map[string]string{"TERM": "dumb"}, ProgressPlain},
+		{true, map[string]string{"NO_COLOR": "1"}, ProgressPlain},
+		{true, map[string]string{"NO_COLOR": ""}, ProgressBars},
+		{true, map[string]string{"SQUIRRELUP_NO_PROGRESS": "1", "TERM": "dumb"}, ProgressHidden},
+		{false, map[string]string{}, ProgressHidden},
+		{false, map[string]string{"NO_COLOR": "1"}, ProgressHidden},
+	}
+
+	for _, test := range tests {
+		cfg.Progress.Enabled = test.enabled
+		getenv := func(key string) string { return test.env[key] }
+		assertEquals(t, test.expected, SelectProgressStyle(&cfg, getenv), fmt.Sprintf("SelectProgressStyle(%v, %v)", test.enabled, test.env))
+	}
+}
+
+func TestNewProgressReporter(t *testing.T) {
+	var cfg Config
+	if err := cfg.SetDefaultValues(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	t.Setenv("SQUIRRELUP_NO_PROGRESS", "")
+	t.Setenv("NO_COLOR", "")
+	t.Setenv("TERM", "xterm")
+
+	_, ok := NewProgressReporter(io.Discard, &cfg).(*MultiProgressbarReporter)
+	assertEquals(t, true, ok, "MultiProgressbarReporter")
+
+	t.Setenv("TERM", "dumb")
+	_, ok = NewProgressReporter(io.Discard, &cfg).(*PlainProgressReporter)
+	assertEquals(t, true, ok, "PlainProgressReporter")
+
+	t.Setenv("SQUIRRELUP_NO_PROGRESS", "1")
+	assertEquals(t, nil, NewProgressReporter(io.Discard, &cfg), "hidden")
+}
+
+func TestPlainProgressReporter(t *testing.T) {
+	// Setup Test
+	var output bytes.Buffer
+	ppr := NewPlainProgressReporter(&output)
+
+	// Perform the test
+	index, err := ppr.CreateFileTask(100)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	_ = ppr.DescribeTask(index, "archiving")
+	_ = ppr.DescribeTask(index, "archiving")
+	assertEquals(t, nil, ppr.AdvanceTask(index, 50), "AdvanceTask")
+	_ = ppr.FinishTask(index)
+
+	/* tasks without a description finish silently */
+	index, _ = ppr.CreateFileTask(-1)
+	_ = ppr.FinishTask(index)
+
+	assertEquals(t, "archiving...\narchiving done\n", output.String(), "output")
+	assertEquals(t, false, strings.Contains(output.String(), "\033"), "ANSI codes")
+
+	err = ppr.AdvanceTask(index, 1)
+	assertEquals(t, fmt.Sprintf("task index %d outside of available range", index), err.Error(), "AdvanceTask.Error")
+	err = ppr.DescribeTask(index, "test")
+	assertEquals(t, fmt.Sprintf("task index %d outside of available range", index), err.Error(), "DescribeTask.Error")
+	err = ppr.FinishTask(index)
+	assertEquals(t, fmt.Sprintf("task index %d outside of available range", index), err.Error(), "FinishTask.Error")
+}
@@ -0,0 +1,288 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+)
+
+type (
+	// RestoreOptions configures a restore performed by Restore.
+	RestoreOptions struct {
+		// URI of the backup object to restore
+		Object *url.URL
+		// name of the backup telling its format, the name of Object if empty. Objects with
+		// obfuscated names are restored with their logical name.
+		Name string
+		// backup configuration, used to create the backend if it is not set
+		Config *Config
+		// retrieves the backup, created for Object if not set
+		Backend StorageBackend
+		// age-encrypted objects are decrypted with these identities, see LoadIdentities.
+		// Without identities the object is restored as stored.
+		Identities []age.Identity
+		// receives the restored contents unless Extract is set
+		Output io.Writer
+		// consumes the restored contents, e.g. to extract the archive into a directory
+		Extract func(ctx context.Context, contents io.Reader) error
+		// receive warnings, they are discarded if not set
+		Stderr io.Writer
+	}
+
+	// RestoreResult describes a restore performed by Restore.
+	RestoreResult struct {
+		// URI of the restored object
+		Object *url.URL
+		// size of the stored object
+		Size uint64
+		// number of bytes written to RestoreOptions.Output
+		Written int64
+		// true if the object was decrypted
+		Decrypted bool
+	}
+
+	// ageReader wraps the age payload reader to report truncated or tampered ciphertexts.
+	ageReader struct {
+		io.Reader
+	}
+
+	// streamReadCloser reads from a stream layered on top of the closer.
+	streamReadCloser struct {
+		io.Reader
+		io.Closer
+	}
+
+	// cancelableReader is a pipe reader closed once the context is done.
+	cancelableReader struct {
+		*io.PipeReader
+		stop func() bool
+	}
+
+	// contextReader fails reads once the context is done.
+	contextReader struct {
+		ctx context.Context
+		io.Reader
+	}
+)
+
+const (
+	// AgeFileSuffix is the extension of age-encrypted backups.
+	AgeFileSuffix = ".age"
+
+	// AgeHeaderPrefix starts the header of binary age-encrypted files.
+	AgeHeaderPrefix = "age-encryption.org/v1"
+
+	// ErrTruncatedCiphertext annotates failures to decrypt an age-encrypted stream.
+	ErrTruncatedCiphertext = "ciphertext is truncated or corrupted"
+
+	ageSecretKeyPrefix = "AGE-SECRET-KEY-"
+)
+
+// Read forwards the call to the age payload reader and annotates decryption errors.
+func (ar *ageReader) Read(p []byte) (int, error) {
+	n, err := ar.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		err = fmt.Errorf("%s: %s", ErrTruncatedCiphertext, err.Error())
+	}
+	return n, err
+}
+
+func (cr *cancelableReader) Close() error {
+	cr.stop()
+	return cr.PipeReader.Close()
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.Reader.Read(p)
+}
+
+// LoadIdentities returns the age identities configured by `cfg.Encryption.Identity`, which
+// holds either a secret key or the path of an identity file. Identity files may be encrypted
+// with a passphrase, see readIdentityFile.
+func LoadIdentities(cfg *Config) ([]age.Identity, error) {
+	var identities []age.Identity
+
+	if len(cfg.Encryption.Identity) > 0 {
+		if strings.HasPrefix(cfg.Encryption.Identity, ageSecretKeyPrefix) {
+			i, err := age.ParseX25519Identity(cfg.Encryption.Identity)
+			if err != nil {
+				return nil, fmt.Errorf("parsing identity failed: %s", err.Error())
+			}
+			identities = append(identities, i)
+		} else {
+			data, err := readIdentityFile(cfg.Encryption.Identity, cfg)
+			if err != nil {
+				return nil, err
+			}
+
+			identities, err = age.ParseIdentities(bytes.NewReader(data))
+			clear(data)
+			if err != nil {
+				return nil, fmt.Errorf("parsing identity file failed: %s", err.Error())
+			}
+		}
+	}
+
+	return identities, nil
+}
+
+// SniffEncryption peeks at the beginning of `input` to decide whether it holds an age-encrypted
+// file, binary or armored. A stream cut short within the header counts as encrypted. The `.age`
+// extension of `name` decides if nothing can be read. A mismatch between the extension and
+// the header is reported as a warning.
+func SniffEncryption(input *bufio.Reader, name string, stderr io.Writer) bool {
+	byExtension := strings.HasSuffix(name, AgeFileSuffix)
+	header, _ := input.Peek(len(armor.Header))
+	if len(header) == 0 {
+		return byExtension
+	}
+
+	var encrypted bool
+	for _, prefix := range []string{AgeHeaderPrefix, armor.Header} {
+		if bytes.HasPrefix(header, []byte(prefix)) || (len(header) < len(prefix) && strings.HasPrefix(prefix, string(header))) {
+			encrypted = true
+		}
+	}
+	if encrypted && !byExtension {
+		fmt.Fprintf(stderr, "warning: %q is age-encrypted despite missing the %s extension, decrypting it\n", name, AgeFileSuffix)
+	} else if !encrypted && byExtension {
+		fmt.Fprintf(stderr, "warning: %q is not age-encrypted despite the %s extension, passing it through\n", name, AgeFileSuffix)
+	}
+	return encrypted
+}
+
+// DecryptStream returns a reader producing the plaintext of an age-encrypted `input`.
+// ASCII-armored input is accepted as well.
+func DecryptStream(input io.Reader, identities []age.Identity) (io.Reader, error) {
+	buffered := bufio.NewReader(input)
+	input = buffered
+	if header, _ := buffered.Peek(len(armor.Header)); string(header) == armor.Header {
+		input = armor.NewReader(buffered)
+	}
+
+	plaintext, err := age.Decrypt(input, identities...)
+	if err != nil {
+		var noMatch *age.NoIdentityMatchError
+		if errors.As(err, &noMatch) {
+			return nil, fmt.Errorf("wrong key: none of the configured identities can decrypt this file")
+		}
+		return nil, fmt.Errorf("%s: %s", ErrTruncatedCiphertext, err.Error())
+	}
+
+	return &ageReader{plaintext}, nil
+}
+
+// RetrieveStream returns a reader streaming the object under `uri`, decrypting it when `identities`
+// are given and the object named `name` turns out to be age-encrypted. Also returns whether the
+// object is decrypted. Deduplicated backups, whose manifest is named `name`, are reassembled
+// from their chunks into a gzip-compressed TAR stream. Closing the reader or cancelling `ctx`
+// stops the download.
+func RetrieveStream(ctx context.Context, backend StorageBackend, uri *url.URL, name string, identities []age.Identity, stderr io.Writer) (io.ReadCloser, bool, error) {
+	if IsDedupManifest(name) {
+		return retrieveDedupStream(ctx, backend, uri, identities)
+	}
+
+	pipeReader, writer := io.Pipe()
+	reader := &cancelableReader{pipeReader, context.AfterFunc(ctx, func() {
+		pipeReader.CloseWithError(ctx.Err())
+	})}
+
+	go func() {
+		writer.CloseWithError(backend.RetrieveFile(writer, uri))
+	}()
+
+	if len(identities) > 0 {
+		buffered := bufio.NewReader(reader)
+		if SniffEncryption(buffered, name, writerOrDiscard(stderr)) {
+			plaintext, err := DecryptStream(buffered, identities)
+			if err != nil {
+				reader.Close()
+				return nil, false, fmt.Errorf("could not decrypt file: %s", err.Error())
+			}
+			return &streamReadCloser{plaintext, reader}, true, nil
+		}
+		return &streamReadCloser{buffered, reader}, false, nil
+	}
+
+	return reader, false, nil
+}
+
+// Restore retrieves the backup object, decrypts it if it is age-encrypted and passes the
+// contents to the Extract hook or writes them to the Output of `opts`. Without decryption
+// the number of bytes written is verified against the size of the stored object, unless
+// the object is the manifest of a deduplicated backup.
+func Restore(ctx context.Context, opts RestoreOptions) (RestoreResult, error) {
+	var result RestoreResult = RestoreResult{Object: opts.Object}
+	var err error
+
+	if opts.Object == nil {
+		return result, fmt.Errorf("no backup object given")
+	} else if opts.Output == nil && opts.Extract == nil {
+		return result, fmt.Errorf("no restore output given")
+	}
+	backend := opts.Backend
+	if backend == nil {
+		if opts.Config == nil {
+			return result, fmt.Errorf("no backup configuration given")
+		}
+		backend, err = CreateStorageBackend(opts.Object, opts.Config)
+		if err != nil {
+			return result, fmt.Errorf("failed to create backend: %s", err.Error())
+		}
+	}
+	if err = ctx.Err(); err != nil {
+		return result, err
+	}
+
+	/* validate the object URI */
+	fileinfo, err := backend.GetFileInfo(opts.Object)
+	if err != nil {
+		return result, fmt.Errorf("backend operation failed: %s", err.Error())
+	} else if !fileinfo.IsFile() {
+		return result, fmt.Errorf("input URI must be a file path, but a directory prefix was specified: %q", opts.Object)
+	}
+	result.Size = fileinfo.Size()
+
+	/* retrieve the object */
+	name := opts.Name
+	if len(name) == 0 {
+		name = path.Base(opts.Object.Path)
+	}
+	input, decrypted, err := RetrieveStream(ctx, backend, opts.Object, name, opts.Identities, opts.Stderr)
+	if err != nil {
+		return result, err
+	}
+	defer input.Close()
+	result.Decrypted = decrypted
+
+	contents := &contextReader{ctx, input}
+	if opts.Extract != nil {
+		err = opts.Extract(ctx, contents)
+		if err != nil {
+			return result, fmt.Errorf("could not restore %q: %s", opts.Object, err.Error())
+		}
+		return result, nil
+	}
+
+	result.Written, err = CopyBuffer(opts.Output, contents, opts.Config.BufferSize())
+	if err != nil {
+		return result, fmt.Errorf("could not download file: %s", err.Error())
+	}
+	if !decrypted && !IsDedupManifest(name) && uint64(result.Written) != result.Size {
+		return result, fmt.Errorf("size mismatch for downloaded file: expected %d, got %d", result.Size, result.Written)
+	}
+
+	return result, nil
+}
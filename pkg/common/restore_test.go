@@ -0,0 +1,209 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+)
+
+// helper function: store `content` under `uri` encrypted to a freshly generated identity.
+func storeEncrypted(t *testing.T, memory *MemoryBackend, uri *url.URL, content string) *age.X25519Identity {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("could not generate identity: %s", err.Error())
+	}
+	var buf bytes.Buffer
+	writer, err := age.Encrypt(&buf, identity.Recipient())
+	if err != nil {
+		t.Fatalf("could not encrypt: %s", err.Error())
+	}
+	_, _ = writer.Write([]byte(content))
+	_ = writer.Close()
+	if err = memory.StoreFile(context.Background(), StoreRequest{URI: uri, BodyAt: bytes.NewReader(buf.Bytes()), Length: int64(buf.Len())}); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	return identity
+}
+
+/* test cases for LoadIdentities */
+func TestLoadIdentities(t *testing.T) {
+	// Setup Test
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("could not generate identity: %s", err.Error())
+	}
+	identityPath := filepath.Join(t.TempDir(), "identity.txt")
+	if err = os.WriteFile(identityPath, []byte(identity.String()+"\n"), 0600); err != nil {
+		t.Fatalf("could not write to temporary file: %s", err.Error())
+	}
+
+	// Perform the test
+	var cfg Config
+	identities, err := LoadIdentities(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 0, len(identities), "len(identities)")
+
+	cfg.Encryption.Identity = identity.String()
+	identities, err = LoadIdentities(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 1, len(identities), "len(identities)")
+
+	cfg.Encryption.Identity = identityPath
+	identities, err = LoadIdentities(&cfg)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, identity.String(), identities[0].(*age.X25519Identity).String(), "identities[0]")
+
+	cfg.Encryption.Identity = "AGE-SECRET-KEY-INVALID"
+	_, err = LoadIdentities(&cfg)
+	if err == nil {
+		t.Fatalf("LoadIdentities was supposed to fail")
+	}
+	assertEquals(t, true, strings.HasPrefix(err.Error(), "parsing identity failed: "), "err")
+}
+
+/* test cases for Restore */
+func TestRestoreOutput(t *testing.T) {
+	// Setup Test
+	memory := NewMemoryBackend()
+	encryptedUri, _ := url.ParseRequestURI("memory://bucket/prefix/2024-05-01T03.tar.gz.age")
+	plainUri, _ := url.ParseRequestURI("memory://bucket/prefix/2024-05-01T04.tar.gz")
+	identity := storeEncrypted(t, memory, encryptedUri, "encrypted content")
+	_ = memory.StoreFile(context.Background(), StoreRequest{URI: plainUri, BodyAt: strings.NewReader("plain content"), Length: 13})
+
+	// Perform the test
+	var output bytes.Buffer
+	result, err := Restore(context.Background(), RestoreOptions{
+		Object:     encryptedUri,
+		Backend:    memory,
+		Identities: []age.Identity{identity},
+		Output:     &output,
+	})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "encrypted content", output.String(), "output")
+	assertEquals(t, true, result.Decrypted, "result.Decrypted")
+	assertEquals(t, int64(17), result.Written, "result.Written")
+
+	/* objects that are not encrypted are restored as stored */
+	output.Reset()
+	result, err = Restore(context.Background(), RestoreOptions{
+		Object:     plainUri,
+		Backend:    memory,
+		Identities: []age.Identity{identity},
+		Output:     &output,
+	})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "plain content", output.String(), "output")
+	assertEquals(t, false, result.Decrypted, "result.Decrypted")
+	assertEquals(t, uint64(13), result.Size, "result.Size")
+
+	/* a wrong identity is reported */
+	other, _ := age.GenerateX25519Identity()
+	_, err = Restore(context.Background(), RestoreOptions{
+		Object:     encryptedUri,
+		Backend:    memory,
+		Identities: []age.Identity{other},
+		Output:     io.Discard,
+	})
+	if err == nil {
+		t.Fatalf("Restore was supposed to fail")
+	}
+	assertEquals(t, "could not decrypt file: wrong key: none of the configured identities can decrypt this file", err.Error(), "err")
+}
+
+func TestRestoreExtract(t *testing.T) {
+	// Setup Test
+	memory := NewMemoryBackend()
+	objectUri, _ := url.ParseRequestURI("memory://bucket/prefix/2024-05-01T03.tar.gz.age")
+	identity := storeEncrypted(t, memory, objectUri, "archive")
+
+	// Perform the test
+	var extracted string
+	_, err := Restore(context.Background(), RestoreOptions{
+		Object:     objectUri,
+		Backend:    memory,
+		Identities: []age.Identity{identity},
+		Extract: func(ctx context.Context, contents io.Reader) error {
+			data, err := io.ReadAll(contents)
+			extracted = string(data)
+			return err
+		},
+	})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "archive", extracted, "extracted")
+
+	_, err = Restore(context.Background(), RestoreOptions{
+		Object:  objectUri,
+		Backend: memory,
+		Extract: func(ctx context.Context, contents io.Reader) error {
+			return errors.New("not a TAR archive")
+		},
+	})
+	if err == nil {
+		t.Fatalf("Restore was supposed to fail")
+	}
+	assertEquals(t, "could not restore \"memory://bucket/prefix/2024-05-01T03.tar.gz.age\": not a TAR archive", err.Error(), "err")
+}
+
+func TestRestoreCancelled(t *testing.T) {
+	// Setup Test
+	memory := NewMemoryBackend()
+	objectUri, _ := url.ParseRequestURI("memory://bucket/prefix/object")
+	_ = memory.StoreFile(context.Background(), StoreRequest{URI: objectUri, BodyAt: strings.NewReader("content"), Length: 7})
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// Perform the test
+	_, err := Restore(ctx, RestoreOptions{
+		Object:  objectUri,
+		Backend: memory,
+		Extract: func(ctx context.Context, contents io.Reader) error {
+			cancel()
+			_, err := io.ReadAll(contents)
+			return err
+		},
+	})
+	if err == nil {
+		t.Fatalf("Restore was supposed to fail")
+	}
+	assertEquals(t, true, strings.HasSuffix(err.Error(), context.Canceled.Error()), "err")
+
+	_, err = Restore(ctx, RestoreOptions{Object: objectUri, Backend: memory, Output: io.Discard})
+	assertEquals(t, context.Canceled, err, "err")
+}
+
+func TestRestoreInvalidOptions(t *testing.T) {
+	// Setup Test
+	memory := NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	objectUri, _ := prefixUri.Parse("object")
+	_ = memory.StoreFile(context.Background(), StoreRequest{URI: objectUri, BodyAt: strings.NewReader("content"), Length: 7})
+
+	// Perform the test
+	_, err := Restore(context.Background(), RestoreOptions{Backend: memory, Output: io.Discard})
+	assertEquals(t, "no backup object given", err.Error(), "err")
+	_, err = Restore(context.Background(), RestoreOptions{Object: objectUri, Backend: memory})
+	assertEquals(t, "no restore output given", err.Error(), "err")
+	_, err = Restore(context.Background(), RestoreOptions{Object: objectUri, Output: io.Discard})
+	assertEquals(t, "no backup configuration given", err.Error(), "err")
+	_, err = Restore(context.Background(), RestoreOptions{Object: prefixUri, Backend: memory, Output: io.Discard})
+	assertEquals(t, "input URI must be a file path, but a directory prefix was specified: \"memory://bucket/prefix/\"", err.Error(), "err")
+}
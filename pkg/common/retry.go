@@ -0,0 +1,154 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"time"
+)
+
+type (
+	// RetryPolicy configures how RetryingBackend retries failed requests.
+	RetryPolicy struct {
+		// number of attempts of a request including the first one, a single attempt if < 2
+		MaxAttempts int
+		// wait before the second attempt, doubled for every further attempt up to MaxBackoff
+		// unless it is zero
+		Backoff    time.Duration
+		MaxBackoff time.Duration
+		// decides whether a failed attempt is retried, IsRetriableError if not set
+		Retriable func(err error) bool
+		// called after every failed attempt of `method` on `uri`, `attempt` counts from one
+		// and `retry` tells whether another attempt follows, if set
+		Attempt func(method string, uri *url.URL, attempt int, err error, retry bool)
+		// called before a StoreFile request is sent again, e.g. to reset the progress of the
+		// upload, if set
+		ResetProgress func(req StoreRequest)
+	}
+
+	// RetryingBackend is a StorageBackend retrying failed requests of the backend it wraps
+	// according to a RetryPolicy. GetFileInfo, ListFiles, StoreFile and RemoveFile are
+	// retried, other methods are passed through. Optional interfaces of the wrapped backend,
+	// such as BulkRemover, are found with AsBackend and are not retried by it.
+	//
+	// Retries apply to whole requests, on top of retries done by the wrapped backend itself
+	// like those of the parts of B2 multipart uploads.
+	RetryingBackend struct {
+		StorageBackend
+		policy RetryPolicy
+		// waits before the next attempt until `ctx` is done, tests replace it to avoid sleeping
+		wait func(ctx context.Context, d time.Duration) error
+	}
+)
+
+const (
+	// Names of StorageBackend methods retried by RetryingBackend, passed to RetryPolicy.Attempt.
+	RetryMethodGetFileInfo = "GetFileInfo"
+	RetryMethodListFiles   = "ListFiles"
+	RetryMethodStoreFile   = "StoreFile"
+	RetryMethodRemoveFile  = "RemoveFile"
+)
+
+// NewRetryingBackend returns `backend` wrapped to retry failed requests according to `policy`.
+func NewRetryingBackend(backend StorageBackend, policy RetryPolicy) *RetryingBackend {
+	return &RetryingBackend{StorageBackend: backend, policy: policy, wait: cleanupWait}
+}
+
+// RetryPolicyFromConfig returns the retry policy configured in `cfg.Retry`.
+func RetryPolicyFromConfig(cfg *Config) RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: int(cfg.Retry.MaxAttempts),
+		Backoff:     time.Duration(cfg.Retry.BackoffSeconds * float64(time.Second)),
+		MaxBackoff:  time.Duration(cfg.Retry.MaxBackoffSeconds * float64(time.Second)),
+	}
+}
+
+// IsRetriableError returns false for errors that fail the same way when a request is
+// repeated, like missing objects or rejected credentials, and for cancelled contexts.
+func IsRetriableError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	switch err.Error() {
+	case ErrFileNotFound, ErrBucketNotFound, ErrAccessDenied, ErrInvalidCredentials,
+		ErrInvalidConfig, ErrEncryptionRequired, ErrChecksumMismatch:
+		return false
+	}
+	return true
+}
+
+// Unwrap returns the wrapped backend.
+func (rb *RetryingBackend) Unwrap() StorageBackend {
+	return rb.StorageBackend
+}
+
+// retry calls `request` until it succeeds, fails with an error that is not retriable, the
+// policy runs out of attempts or `ctx` is done.
+func (rb *RetryingBackend) retry(ctx context.Context, method string, uri *url.URL, request func() error) error {
+	retriable := rb.policy.Retriable
+	if retriable == nil {
+		retriable = IsRetriableError
+	}
+	backoff := rb.policy.Backoff
+	for attempt := 1; ; attempt++ {
+		err := request()
+		if err == nil {
+			return nil
+		}
+		retry := attempt < rb.policy.MaxAttempts && retriable(err) && ctx.Err() == nil
+		if rb.policy.Attempt != nil {
+			rb.policy.Attempt(method, uri, attempt, err, retry)
+		}
+		if !retry {
+			return err
+		}
+		if waitErr := rb.wait(ctx, backoff); waitErr != nil {
+			return err
+		}
+		backoff *= 2
+		if rb.policy.MaxBackoff > 0 {
+			backoff = min(backoff, rb.policy.MaxBackoff)
+		}
+	}
+}
+
+// GetFileInfo returns the FileInfo of `uri`, retrying failed requests.
+func (rb *RetryingBackend) GetFileInfo(uri *url.URL) (fileinfo *FileInfo, err error) {
+	err = rb.retry(context.Background(), RetryMethodGetFileInfo, uri, func() error {
+		fileinfo, err = rb.StorageBackend.GetFileInfo(uri)
+		return err
+	})
+	return fileinfo, err
+}
+
+// ListFiles lists the files under `uri`, retrying failed requests.
+func (rb *RetryingBackend) ListFiles(uri *url.URL) (filelist []FileInfo, err error) {
+	err = rb.retry(context.Background(), RetryMethodListFiles, uri, func() error {
+		filelist, err = rb.StorageBackend.ListFiles(uri)
+		return err
+	})
+	return filelist, err
+}
+
+// StoreFile stores `req`, retrying failed requests until `ctx` is done. Requests whose body is
+// only given as an io.Reader cannot be repeated and are sent once.
+func (rb *RetryingBackend) StoreFile(ctx context.Context, req StoreRequest) error {
+	if req.BodyAt == nil && req.Body != nil {
+		return rb.StorageBackend.StoreFile(ctx, req)
+	}
+	var attempted bool
+	return rb.retry(ctx, RetryMethodStoreFile, req.URI, func() error {
+		if attempted && rb.policy.ResetProgress != nil {
+			rb.policy.ResetProgress(req)
+		}
+		attempted = true
+		return rb.StorageBackend.StoreFile(ctx, req)
+	})
+}
+
+// RemoveFile removes `uri`, retrying failed requests.
+func (rb *RetryingBackend) RemoveFile(uri *url.URL) error {
+	return rb.retry(context.Background(), RetryMethodRemoveFile, uri, func() error {
+		return rb.StorageBackend.RemoveFile(uri)
+	})
+}
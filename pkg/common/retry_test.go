@@ -0,0 +1,234 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// flakyBackend is a MemoryBackend whose requests fail with `err` until `failures` attempts of
+// the same method were made. It counts the attempts of every method.
+type flakyBackend struct {
+	*MemoryBackend
+	err      error
+	failures int
+	attempts map[string]int
+}
+
+func (fb *flakyBackend) attempt(method string) error {
+	fb.attempts[method]++
+	if fb.attempts[method] <= fb.failures {
+		return fb.err
+	}
+	return nil
+}
+
+func (fb *flakyBackend) GetFileInfo(uri *url.URL) (*FileInfo, error) {
+	if err := fb.attempt(RetryMethodGetFileInfo); err != nil {
+		return nil, err
+	}
+	return fb.MemoryBackend.GetFileInfo(uri)
+}
+
+func (fb *flakyBackend) ListFiles(uri *url.URL) ([]FileInfo, error) {
+	if err := fb.attempt(RetryMethodListFiles); err != nil {
+		return nil, err
+	}
+	return fb.MemoryBackend.ListFiles(uri)
+}
+
+func (fb *flakyBackend) StoreFile(ctx context.Context, req StoreRequest) error {
+	if err := fb.attempt(RetryMethodStoreFile); err != nil {
+		return err
+	}
+	return fb.MemoryBackend.StoreFile(ctx, req)
+}
+
+func (fb *flakyBackend) RemoveFile(uri *url.URL) error {
+	if err := fb.attempt(RetryMethodRemoveFile); err != nil {
+		return err
+	}
+	return fb.MemoryBackend.RemoveFile(uri)
+}
+
+func TestRetryingBackend(t *testing.T) {
+	uri, _ := url.Parse("memory://bucket/path/to/key")
+	prefix, _ := url.Parse("memory://bucket/path/to/")
+	data := []byte("mock-data")
+
+	requests := map[string]func(StorageBackend) error{
+		RetryMethodGetFileInfo: func(backend StorageBackend) error {
+			_, err := backend.GetFileInfo(uri)
+			return err
+		},
+		RetryMethodListFiles: func(backend StorageBackend) error {
+			_, err := backend.ListFiles(prefix)
+			return err
+		},
+		RetryMethodStoreFile: func(backend StorageBackend) error {
+			return backend.StoreFile(context.Background(), StoreRequest{URI: uri, BodyAt: bytes.NewReader(data), Length: int64(len(data))})
+		},
+		RetryMethodRemoveFile: func(backend StorageBackend) error {
+			return backend.RemoveFile(uri)
+		},
+	}
+
+	testCases := []struct {
+		name     string
+		err      error
+		failures int
+		attempts int
+		expected string
+	}{
+		{"success", errors.New("connection reset"), 0, 1, ""},
+		{"transient then success", errors.New("connection reset"), 2, 3, ""},
+		{"transient exhausted", errors.New("connection reset"), 4, 3, "connection reset"},
+		{"permanent failure", errors.New(ErrAccessDenied), 4, 1, ErrAccessDenied},
+	}
+
+	for method, request := range requests {
+		for _, testCase := range testCases {
+			t.Run(method+"/"+testCase.name, func(t *testing.T) {
+				memory := NewMemoryBackend()
+				if err := StoreFileAt(memory, bytes.NewReader(data), int64(len(data)), uri); err != nil {
+					t.Fatalf(err.Error())
+				}
+				flaky := &flakyBackend{MemoryBackend: memory, err: testCase.err, failures: testCase.failures, attempts: map[string]int{}}
+
+				var waits []time.Duration
+				var reported []string
+				backend := NewRetryingBackend(flaky, RetryPolicy{
+					MaxAttempts: 3,
+					Backoff:     time.Second,
+					MaxBackoff:  time.Second,
+					Attempt: func(method string, uri *url.URL, attempt int, err error, retry bool) {
+						reported = append(reported, fmt.Sprintf("%s %d %v", method, attempt, retry))
+					},
+				})
+				backend.wait = func(ctx context.Context, d time.Duration) error {
+					waits = append(waits, d)
+					return nil
+				}
+
+				err := request(backend)
+				if testCase.expected == "" {
+					if err != nil {
+						t.Fatalf(err.Error())
+					}
+				} else if err == nil {
+					t.Fatalf("This test should throw an error")
+				} else {
+					assertEquals(t, testCase.expected, err.Error(), "err.Error")
+				}
+				assertEquals(t, testCase.attempts, flaky.attempts[method], "flaky.attempts")
+				assertEquals(t, max(testCase.attempts-1, 0), len(waits), "len(waits)")
+				for _, wait := range waits {
+					assertEquals(t, time.Second, wait, "wait")
+				}
+				if testCase.failures > 0 {
+					assertEquals(t, fmt.Sprintf("%s 1 %v", method, testCase.attempts > 1), reported[0], "reported[0]")
+				} else {
+					assertEquals(t, 0, len(reported), "len(reported)")
+				}
+			})
+		}
+	}
+}
+
+func TestRetryingBackendBackoff(t *testing.T) {
+	uri, _ := url.Parse("memory://bucket/path/to/key")
+	flaky := &flakyBackend{MemoryBackend: NewMemoryBackend(), err: errors.New("timeout"), failures: 5, attempts: map[string]int{}}
+
+	var waits []string
+	backend := NewRetryingBackend(flaky, RetryPolicy{MaxAttempts: 5, Backoff: time.Second, MaxBackoff: 5 * time.Second})
+	backend.wait = func(ctx context.Context, d time.Duration) error {
+		waits = append(waits, d.String())
+		return nil
+	}
+
+	if err := backend.RemoveFile(uri); err == nil {
+		t.Fatalf("This test should throw an error")
+	}
+	assertEquals(t, "1s 2s 4s 5s", strings.Join(waits, " "), "waits")
+}
+
+func TestRetryingBackendStoreFile(t *testing.T) {
+	uri, _ := url.Parse("memory://bucket/path/to/key")
+	data := []byte("mock-data")
+	flaky := &flakyBackend{MemoryBackend: NewMemoryBackend(), err: errors.New("timeout"), failures: 1, attempts: map[string]int{}}
+
+	var resets int
+	backend := NewRetryingBackend(flaky, RetryPolicy{MaxAttempts: 3, ResetProgress: func(req StoreRequest) { resets++ }})
+	backend.wait = func(ctx context.Context, d time.Duration) error { return nil }
+
+	/* requests readable at any offset are sent again */
+	if err := backend.StoreFile(context.Background(), StoreRequest{URI: uri, BodyAt: bytes.NewReader(data), Length: int64(len(data))}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	assertEquals(t, 2, flaky.attempts[RetryMethodStoreFile], "flaky.attempts")
+	assertEquals(t, 1, resets, "resets")
+
+	/* requests with a body only readable once are not */
+	flaky.attempts = map[string]int{}
+	if err := backend.StoreFile(context.Background(), StoreRequest{URI: uri, Body: bytes.NewReader(data), Length: -1}); err == nil {
+		t.Fatalf("This test should throw an error")
+	}
+	assertEquals(t, 1, flaky.attempts[RetryMethodStoreFile], "flaky.attempts")
+	assertEquals(t, 1, resets, "resets")
+
+	/* a cancelled request is not retried */
+	flaky.attempts = map[string]int{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := backend.StoreFile(ctx, StoreRequest{URI: uri, BodyAt: bytes.NewReader(data), Length: int64(len(data))}); err == nil {
+		t.Fatalf("This test should throw an error")
+	}
+	assertEquals(t, 1, flaky.attempts[RetryMethodStoreFile], "flaky.attempts")
+}
+
+func TestRetryingBackendUnwrap(t *testing.T) {
+	brb := &bulkRemoveBackend{MemoryBackend: NewMemoryBackend()}
+	backend := NewRetryingBackend(brb, RetryPolicy{MaxAttempts: 3})
+
+	remover, ok := AsBackend[BulkRemover](backend)
+	assertEquals(t, true, ok, "ok")
+	assertEquals(t, BulkRemover(brb), remover, "remover")
+
+	_, ok = AsBackend[ResumableBackend](backend)
+	assertEquals(t, false, ok, "ok")
+}
+
+func TestCreateStorageBackendRetry(t *testing.T) {
+	cfg := new(Config)
+	cfg.S3.Region = "mock-region"
+	mockURI, _ := url.ParseRequestURI("b2://bucket/path/to/key")
+
+	backend, err := CreateStorageBackend(mockURI, cfg)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	_, ok := backend.(*B2Backend)
+	assertEquals(t, true, ok, "ok")
+
+	cfg.Retry.MaxAttempts = 3
+	backend, err = CreateStorageBackend(mockURI, cfg)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	_, ok = backend.(*RetryingBackend)
+	assertEquals(t, true, ok, "ok")
+	_, ok = AsBackend[*B2Backend](backend)
+	assertEquals(t, true, ok, "ok")
+}
+
+func TestIsRetriableError(t *testing.T) {
+	assertEquals(t, false, IsRetriableError(nil), "IsRetriableError(nil)")
+	assertEquals(t, true, IsRetriableError(errors.New("connection reset")), "IsRetriableError")
+	assertEquals(t, false, IsRetriableError(errors.New(ErrFileNotFound)), "IsRetriableError")
+	assertEquals(t, false, IsRetriableError(fmt.Errorf("upload: %w", context.Canceled)), "IsRetriableError")
+}
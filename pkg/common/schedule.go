@@ -0,0 +1,187 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// Schedule determines when the next scheduled backup is due.
+	Schedule interface {
+		// Next returns the first activation time after `t` or zero time if there is none.
+		Next(t time.Time) time.Time
+	}
+
+	// intervalSchedule activates at a fixed interval.
+	intervalSchedule struct {
+		interval time.Duration
+	}
+
+	// cronSchedule activates at times matching a standard five-field cron expression.
+	cronSchedule struct {
+		minutes    uint64
+		hours      uint64
+		days       uint64
+		months     uint64
+		weekdays   uint64
+		anyDay     bool
+		anyWeekday bool
+		location   *time.Location
+	}
+
+	// cronField describes the range of values accepted by a cron field.
+	cronField struct {
+		name string
+		min  int
+		max  int
+	}
+)
+
+const (
+	// scheduleEveryPrefix introduces an interval schedule, e.g. "@every 6h".
+	scheduleEveryPrefix = "@every "
+
+	// cronSearchYears limits the search for the next activation of a cron schedule.
+	cronSearchYears = 5
+)
+
+var cronFields = []cronField{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+// ParseSchedule parses a backup schedule. Accepts either a duration ("6h" or "@every 6h")
+// or a five-field cron expression ("30 2 * * 1-5") evaluated in `location`.
+func ParseSchedule(spec string, location *time.Location) (Schedule, error) {
+	trimmed := strings.TrimSpace(spec)
+	if interval, err := time.ParseDuration(strings.TrimPrefix(trimmed, scheduleEveryPrefix)); err == nil {
+		if interval <= 0 {
+			return nil, fmt.Errorf("invalid schedule %q: interval must be positive", spec)
+		}
+		return &intervalSchedule{interval}, nil
+	} else if strings.HasPrefix(trimmed, scheduleEveryPrefix) {
+		return nil, fmt.Errorf("invalid schedule %q: %s", spec, err.Error())
+	}
+
+	fields := strings.Fields(trimmed)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("invalid schedule %q: expecting a duration or a cron expression with %d fields", spec, len(cronFields))
+	}
+
+	var masks [5]uint64
+	for index, field := range fields {
+		mask, err := parseCronField(field, cronFields[index])
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule %q: %s", spec, err.Error())
+		}
+		masks[index] = mask
+	}
+	// both 0 and 7 stand for Sunday
+	if masks[4]&(1<<7) != 0 {
+		masks[4] |= 1
+	}
+
+	schedule := &cronSchedule{
+		minutes:    masks[0],
+		hours:      masks[1],
+		days:       masks[2],
+		months:     masks[3],
+		weekdays:   masks[4],
+		anyDay:     fields[2] == "*",
+		anyWeekday: fields[4] == "*",
+		location:   location,
+	}
+	if schedule.Next(time.Date(2000, time.January, 1, 0, 0, 0, 0, location)).IsZero() {
+		return nil, fmt.Errorf("invalid schedule %q: never activates", spec)
+	}
+	return schedule, nil
+}
+
+// parseCronField parses a comma-separated list of values, ranges and steps into a bit mask.
+func parseCronField(value string, field cronField) (uint64, error) {
+	var mask uint64
+	for _, item := range strings.Split(value, ",") {
+		rangeSpec, stepSpec, hasStep := strings.Cut(item, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepSpec)
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q in %s field", stepSpec, field.name)
+			}
+		}
+
+		first, last := field.min, field.max
+		if rangeSpec != "*" {
+			firstSpec, lastSpec, isRange := strings.Cut(rangeSpec, "-")
+			var err error
+			first, err = strconv.Atoi(firstSpec)
+			if err != nil {
+				return 0, fmt.Errorf("invalid value %q in %s field", firstSpec, field.name)
+			}
+			last = first
+			if isRange {
+				last, err = strconv.Atoi(lastSpec)
+				if err != nil {
+					return 0, fmt.Errorf("invalid value %q in %s field", lastSpec, field.name)
+				}
+			} else if hasStep {
+				last = field.max
+			}
+		}
+		if first < field.min || last > field.max || first > last {
+			return 0, fmt.Errorf("value %q out of range %d-%d in %s field", rangeSpec, field.min, field.max, field.name)
+		}
+
+		for bit := first; bit <= last; bit += step {
+			mask |= 1 << uint(bit)
+		}
+	}
+	return mask, nil
+}
+
+func (schedule *intervalSchedule) Next(t time.Time) time.Time {
+	return t.Add(schedule.interval)
+}
+
+// dayMatches follows cron semantics: if both the day of month and the day of week
+// are restricted, a day matching either of them is accepted.
+func (schedule *cronSchedule) dayMatches(t time.Time) bool {
+	dayMatch := schedule.days&(1<<uint(t.Day())) != 0
+	weekdayMatch := schedule.weekdays&(1<<uint(t.Weekday())) != 0
+	if schedule.anyDay || schedule.anyWeekday {
+		return dayMatch && weekdayMatch
+	}
+	return dayMatch || weekdayMatch
+}
+
+func (schedule *cronSchedule) Next(t time.Time) time.Time {
+	t = t.In(schedule.location).Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(cronSearchYears, 0, 0)
+
+	for t.Before(limit) {
+		if schedule.months&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, schedule.location)
+			continue
+		}
+		if !schedule.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, schedule.location)
+			continue
+		}
+		if schedule.hours&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, schedule.location)
+			continue
+		}
+		if schedule.minutes&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
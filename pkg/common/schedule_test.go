@@ -0,0 +1,73 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+/* test cases for ParseSchedule */
+func TestParseScheduleValid(t *testing.T) {
+	kathmandu, err := time.LoadLocation("Asia/Kathmandu")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	// Wednesday
+	start := time.Date(2024, time.May, 1, 3, 0, 0, 0, time.UTC)
+
+	for _, testCase := range []struct {
+		spec     string
+		location *time.Location
+		from     time.Time
+		expected string
+	}{
+		/* intervals */
+		{"6h", time.UTC, start, "2024-05-01T09:00:00Z"},
+		{"@every 90m", time.UTC, start, "2024-05-01T04:30:00Z"},
+		/* cron expressions */
+		{"* * * * *", time.UTC, start, "2024-05-01T03:01:00Z"},
+		{"30 2 * * *", time.UTC, start, "2024-05-02T02:30:00Z"},
+		{"*/15 * * * *", time.UTC, start.Add(time.Minute), "2024-05-01T03:15:00Z"},
+		{"0 0 1 * *", time.UTC, start, "2024-06-01T00:00:00Z"},
+		{"0 12 * * 1-5", time.UTC, time.Date(2024, time.May, 3, 13, 0, 0, 0, time.UTC), "2024-05-06T12:00:00Z"},
+		{"0 0 * * 7", time.UTC, start, "2024-05-05T00:00:00Z"},
+		{"0 0 * 2 0", time.UTC, start, "2025-02-02T00:00:00Z"},
+		{"0 0 29 2 *", time.UTC, start, "2028-02-29T00:00:00Z"},
+		{"0 6,18 * * *", time.UTC, start, "2024-05-01T06:00:00Z"},
+		/* day of month or day of week when both are restricted */
+		{"0 0 13 * 5", time.UTC, start, "2024-05-03T00:00:00Z"},
+		/* evaluated in the configured location */
+		{"0 9 * * *", kathmandu, start, "2024-05-01T09:00:00+05:45"},
+		/* nonexistent local time during the DST transition */
+		{"30 2 * * *", berlin, time.Date(2024, time.March, 31, 0, 0, 0, 0, time.UTC), "2024-04-01T02:30:00+02:00"},
+	} {
+		schedule, err := ParseSchedule(testCase.spec, testCase.location)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		assertEquals(t, testCase.expected, schedule.Next(testCase.from).Format(time.RFC3339), "Next("+testCase.spec+")")
+	}
+}
+
+func TestParseScheduleInvalid(t *testing.T) {
+	for _, testCase := range []struct{ spec, expected string }{
+		{"-1h", `invalid schedule "-1h": interval must be positive`},
+		{"@every soon", `invalid schedule "@every soon": time: invalid duration "soon"`},
+		{"* * *", `invalid schedule "* * *": expecting a duration or a cron expression with 5 fields`},
+		{"60 * * * *", `invalid schedule "60 * * * *": value "60" out of range 0-59 in minute field`},
+		{"* 5-2 * * *", `invalid schedule "* 5-2 * * *": value "5-2" out of range 0-23 in hour field`},
+		{"*/0 * * * *", `invalid schedule "*/0 * * * *": invalid step "0" in minute field`},
+		{"* * x * *", `invalid schedule "* * x * *": invalid value "x" in day of month field`},
+		{"0 0 30 2 *", `invalid schedule "0 0 30 2 *": never activates`},
+	} {
+		if _, err := ParseSchedule(testCase.spec, time.UTC); err == nil {
+			t.Fatalf("This test should throw an error")
+		} else {
+			assertEquals(t, testCase.expected, err.Error(), "ParseSchedule("+testCase.spec+")")
+		}
+	}
+}
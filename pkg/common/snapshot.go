@@ -0,0 +1,276 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+type (
+	// Snapshot is a read-only snapshot of the filesystem holding the backup source.
+	Snapshot struct {
+		// directory of the backup source within the snapshot
+		Path string
+
+		lock sync.Mutex
+		// steps removing the snapshot, run in reverse order by Remove
+		teardown []func(ctx context.Context) error
+	}
+)
+
+const (
+	// types of snapshots of the backup source, see Config.Backup.SnapshotType
+	SnapshotLVM    = "lvm"
+	SnapshotBtrfs  = "btrfs"
+	SnapshotZFS    = "zfs"
+	SnapshotCustom = "custom"
+)
+
+var (
+	// snapshotCommand runs the command `args` with the environment variables `env` added and
+	// returns its standard output, can be overridden in tests.
+	snapshotCommand = func(ctx context.Context, env []string, args ...string) ([]byte, error) {
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Env = append(os.Environ(), env...)
+		output, err := cmd.Output()
+		if err != nil {
+			message := err.Error()
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				if stderr := strings.TrimSpace(string(exitErr.Stderr)); len(stderr) > 0 {
+					message += ": " + stderr
+				}
+			}
+			return output, fmt.Errorf("%s failed: %s", args[0], message)
+		}
+		return output, nil
+	}
+)
+
+// validateSnapshot checks that the snapshot configuration is complete for its type.
+func (cfg *Config) validateSnapshot() error {
+	switch cfg.Backup.SnapshotType {
+	case "", SnapshotBtrfs:
+	case SnapshotZFS:
+		if len(cfg.Backup.SnapshotVolume) == 0 {
+			return fmt.Errorf("zfs snapshots require the dataset as snapshot volume")
+		}
+	case SnapshotLVM:
+		if len(cfg.Backup.SnapshotVolume) == 0 || len(cfg.Backup.SnapshotMountpoint) == 0 {
+			return fmt.Errorf("lvm snapshots require the logical volume as snapshot volume and its snapshot mountpoint")
+		}
+	case SnapshotCustom:
+		if len(strings.Fields(cfg.Backup.SnapshotCreate)) == 0 {
+			return fmt.Errorf("custom snapshots require a snapshot create command")
+		}
+	default:
+		return fmt.Errorf("invalid snapshot type %q, expecting %q, %q, %q or %q",
+			cfg.Backup.SnapshotType, SnapshotLVM, SnapshotBtrfs, SnapshotZFS, SnapshotCustom)
+	}
+	return nil
+}
+
+// CreateSnapshot creates a read-only snapshot named `name` of the filesystem holding the
+// directory `source`, as configured by `cfg.Backup.SnapshotType`. Returns nil if snapshots
+// are not configured. Parts of the snapshot created before a failure are removed again.
+func CreateSnapshot(ctx context.Context, source, name string, cfg *Config) (*Snapshot, error) {
+	if len(cfg.Backup.SnapshotType) == 0 {
+		return nil, nil
+	}
+	if err := cfg.validateSnapshot(); err != nil {
+		return nil, err
+	}
+	source, err := filepath.Abs(source)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := &Snapshot{}
+	switch cfg.Backup.SnapshotType {
+	case SnapshotBtrfs:
+		err = snapshot.createBtrfs(ctx, source, name, cfg)
+	case SnapshotZFS:
+		err = snapshot.createZFS(ctx, source, name, cfg)
+	case SnapshotLVM:
+		err = snapshot.createLVM(ctx, source, name, cfg)
+	case SnapshotCustom:
+		err = snapshot.createCustom(ctx, source, name, cfg)
+	}
+	if err == nil {
+		var info os.FileInfo
+		info, err = os.Stat(snapshot.Path)
+		if err == nil && !info.IsDir() {
+			err = fmt.Errorf("%q is not a directory", snapshot.Path)
+		}
+	}
+	if err != nil {
+		_ = snapshot.Remove(context.Background())
+		return nil, fmt.Errorf("could not create %s snapshot of %q: %s", cfg.Backup.SnapshotType, source, err.Error())
+	}
+	return snapshot, nil
+}
+
+// Remove removes the snapshot, nothing is done once it was removed. All steps are attempted
+// even if one fails, the first error is returned.
+func (s *Snapshot) Remove(ctx context.Context) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var err error
+	for index := len(s.teardown) - 1; index >= 0; index-- {
+		if stepErr := s.teardown[index](ctx); stepErr != nil && err == nil {
+			err = stepErr
+		}
+	}
+	s.teardown = nil
+	if err != nil {
+		return fmt.Errorf("could not remove snapshot: %s", err.Error())
+	}
+	return nil
+}
+
+// addCommand registers the command `args` to be run by Remove.
+func (s *Snapshot) addCommand(env []string, args ...string) {
+	s.teardown = append(s.teardown, func(ctx context.Context) error {
+		_, err := snapshotCommand(ctx, env, args...)
+		return err
+	})
+}
+
+// relativeSource returns the path of `source` relative to the directory `root` it lies in.
+func relativeSource(root, source string) (string, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	relative, err := filepath.Rel(root, source)
+	if err != nil || relative == ".." || strings.HasPrefix(relative, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%q is not below %q", source, root)
+	}
+	return relative, nil
+}
+
+// createBtrfs snapshots the subvolume holding the source, which defaults to the source
+// directory itself. The snapshot is created next to the subvolume unless
+// `cfg.Backup.SnapshotDir` is set.
+func (s *Snapshot) createBtrfs(ctx context.Context, source, name string, cfg *Config) error {
+	volume := cfg.Backup.SnapshotVolume
+	if len(volume) == 0 {
+		volume = source
+	}
+	relative, err := relativeSource(volume, source)
+	if err != nil {
+		return err
+	}
+	volume, _ = filepath.Abs(volume)
+	dir := cfg.Backup.SnapshotDir
+	if len(dir) == 0 {
+		dir = filepath.Dir(volume)
+	}
+
+	snapshotPath := filepath.Join(dir, name)
+	if _, err = snapshotCommand(ctx, nil, "btrfs", "subvolume", "snapshot", "-r", volume, snapshotPath); err != nil {
+		return err
+	}
+	s.addCommand(nil, "btrfs", "subvolume", "delete", snapshotPath)
+	s.Path = filepath.Join(snapshotPath, relative)
+	return nil
+}
+
+// createZFS snapshots the dataset holding the source, which is read through the .zfs
+// directory of the dataset. Its mountpoint is looked up unless configured.
+func (s *Snapshot) createZFS(ctx context.Context, source, name string, cfg *Config) error {
+	dataset := cfg.Backup.SnapshotVolume
+	mountpoint := cfg.Backup.SnapshotMountpoint
+	if len(mountpoint) == 0 {
+		output, err := snapshotCommand(ctx, nil, "zfs", "get", "-H", "-o", "value", "mountpoint", dataset)
+		if err != nil {
+			return err
+		}
+		mountpoint = strings.TrimSpace(string(output))
+	}
+	relative, err := relativeSource(mountpoint, source)
+	if err != nil {
+		return err
+	}
+
+	if _, err = snapshotCommand(ctx, nil, "zfs", "snapshot", dataset+"@"+name); err != nil {
+		return err
+	}
+	s.addCommand(nil, "zfs", "destroy", dataset+"@"+name)
+	s.Path = filepath.Join(mountpoint, ".zfs", "snapshot", name, relative)
+	return nil
+}
+
+// createLVM snapshots the logical volume holding the source, given as volume-group/volume,
+// and mounts the snapshot read-only. It is mounted at a temporary directory unless
+// `cfg.Backup.SnapshotDir` is set.
+func (s *Snapshot) createLVM(ctx context.Context, source, name string, cfg *Config) error {
+	volume := cfg.Backup.SnapshotVolume
+	group, _, found := strings.Cut(volume, "/")
+	if !found {
+		return fmt.Errorf("lvm snapshot volume %q must be given as volume-group/logical-volume", volume)
+	}
+	relative, err := relativeSource(cfg.Backup.SnapshotMountpoint, source)
+	if err != nil {
+		return err
+	}
+
+	if _, err = snapshotCommand(ctx, nil, "lvcreate", "--snapshot", "--name", name, "--size", cfg.Backup.SnapshotSize, volume); err != nil {
+		return err
+	}
+	s.addCommand(nil, "lvremove", "--yes", group+"/"+name)
+
+	mountDir := cfg.Backup.SnapshotDir
+	if len(mountDir) == 0 {
+		mountDir, err = os.MkdirTemp("", name+"-")
+		if err != nil {
+			return fmt.Errorf("could not create mount point: %s", err.Error())
+		}
+		s.teardown = append(s.teardown, func(ctx context.Context) error {
+			return os.Remove(mountDir)
+		})
+	}
+	if _, err = snapshotCommand(ctx, nil, "mount", "-o", "ro", "/dev/"+group+"/"+name, mountDir); err != nil {
+		return err
+	}
+	s.addCommand(nil, "umount", mountDir)
+	s.Path = filepath.Join(mountDir, relative)
+	return nil
+}
+
+// createCustom runs the configured create command, which prints the path of the snapshot on
+// the last line of its output. The path stands for the snapshot mountpoint if configured,
+// for the source directory otherwise. Both commands get the source directory and the name of
+// the snapshot in SQUIRRELUP_SNAPSHOT_SOURCE and SQUIRRELUP_SNAPSHOT_NAME, the teardown
+// command gets the printed path in SQUIRRELUP_SNAPSHOT_PATH.
+func (s *Snapshot) createCustom(ctx context.Context, source, name string, cfg *Config) error {
+	env := []string{"SQUIRRELUP_SNAPSHOT_SOURCE=" + source, "SQUIRRELUP_SNAPSHOT_NAME=" + name}
+	output, err := snapshotCommand(ctx, env, strings.Fields(cfg.Backup.SnapshotCreate)...)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	snapshotPath := strings.TrimSpace(lines[len(lines)-1])
+	if teardown := strings.Fields(cfg.Backup.SnapshotTeardown); len(teardown) > 0 {
+		s.addCommand(append(env, "SQUIRRELUP_SNAPSHOT_PATH="+snapshotPath), teardown...)
+	}
+	if len(snapshotPath) == 0 {
+		return fmt.Errorf("snapshot create command printed no path")
+	}
+
+	s.Path = snapshotPath
+	if len(cfg.Backup.SnapshotMountpoint) > 0 {
+		relative, err := relativeSource(cfg.Backup.SnapshotMountpoint, source)
+		if err != nil {
+			return err
+		}
+		s.Path = filepath.Join(snapshotPath, relative)
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// helper function: configuration with snapshots of type `snapshotType`.
+func setupSnapshotConfig(t *testing.T, snapshotType string) *Config {
+	var cfg Config
+	if err := cfg.SetDefaultValues(); err != nil {
+		t.Fatalf(err.Error())
+	}
+	cfg.Backup.SnapshotType = snapshotType
+	return &cfg
+}
+
+// helper function: records commands run for snapshots instead of running them, `run` is
+// called with each command and returns its output.
+func recordSnapshotCommands(t *testing.T, run func(args []string) string) *[]string {
+	var commands []string
+	original := snapshotCommand
+	snapshotCommand = func(ctx context.Context, env []string, args ...string) ([]byte, error) {
+		commands = append(commands, strings.Join(args, " "))
+		return []byte(run(args)), nil
+	}
+	t.Cleanup(func() { snapshotCommand = original })
+	return &commands
+}
+
+/* test cases for CreateSnapshot */
+func TestCreateSnapshotCustom(t *testing.T) {
+	// Setup Test
+	tmpDir := t.TempDir()
+	srcDir := filepath.Join(tmpDir, "volume", "data")
+	snapshotRoot := filepath.Join(tmpDir, "snapshots")
+	marker := filepath.Join(tmpDir, "removed")
+	createScript := filepath.Join(tmpDir, "create.sh")
+	teardownScript := filepath.Join(tmpDir, "teardown.sh")
+	_ = os.MkdirAll(srcDir, 0700)
+	script := fmt.Sprintf("#!/bin/sh\nmkdir -p '%s'/\"$SQUIRRELUP_SNAPSHOT_NAME\"/data\necho 'snapshot created'\necho '%s'/\"$SQUIRRELUP_SNAPSHOT_NAME\"\n", snapshotRoot, snapshotRoot)
+	if err := os.WriteFile(createScript, []byte(script), 0700); err != nil {
+		t.Fatalf("could not write to temporary file: %s", err.Error())
+	}
+	script = fmt.Sprintf("#!/bin/sh\necho \"$SQUIRRELUP_SNAPSHOT_NAME $SQUIRRELUP_SNAPSHOT_PATH $SQUIRRELUP_SNAPSHOT_SOURCE\" >> '%s'\n", marker)
+	if err := os.WriteFile(teardownScript, []byte(script), 0700); err != nil {
+		t.Fatalf("could not write to temporary file: %s", err.Error())
+	}
+	cfg := setupSnapshotConfig(t, SnapshotCustom)
+	cfg.Backup.SnapshotCreate = createScript
+	cfg.Backup.SnapshotTeardown = teardownScript
+
+	/* the printed path stands for the source directory */
+	cfg.Backup.SnapshotMountpoint = ""
+	snapshot, err := CreateSnapshot(context.Background(), srcDir, "first", cfg)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, filepath.Join(snapshotRoot, "first"), snapshot.Path, "snapshot.Path")
+	if err = snapshot.Remove(context.Background()); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	/* the printed path stands for the mountpoint */
+	cfg.Backup.SnapshotMountpoint = filepath.Join(tmpDir, "volume")
+	snapshot, err = CreateSnapshot(context.Background(), srcDir, "second", cfg)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, filepath.Join(snapshotRoot, "second", "data"), snapshot.Path, "snapshot.Path")
+	if err = snapshot.Remove(context.Background()); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	/* removing the snapshot again does nothing */
+	if err = snapshot.Remove(context.Background()); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	data, _ := os.ReadFile(marker)
+	expected := fmt.Sprintf("first %s %s\nsecond %s %s\n", filepath.Join(snapshotRoot, "first"), srcDir, filepath.Join(snapshotRoot, "second"), srcDir)
+	assertEquals(t, expected, string(data), "teardown")
+}
+
+func TestCreateSnapshotCustomFailures(t *testing.T) {
+	// Setup Test
+	tmpDir := t.TempDir()
+	marker := filepath.Join(tmpDir, "removed")
+	teardownScript := filepath.Join(tmpDir, "teardown.sh")
+	script := fmt.Sprintf("#!/bin/sh\necho removed >> '%s'\n", marker)
+	if err := os.WriteFile(teardownScript, []byte(script), 0700); err != nil {
+		t.Fatalf("could not write to temporary file: %s", err.Error())
+	}
+	cfg := setupSnapshotConfig(t, SnapshotCustom)
+	cfg.Backup.SnapshotTeardown = teardownScript
+
+	for _, testCase := range []struct {
+		script   string
+		expected string
+		removed  string
+	}{
+		/* the create command fails, nothing to tear down */
+		{"#!/bin/sh\necho 'no space left' >&2\nexit 3\n", "%s failed: exit status 3: no space left", ""},
+		/* the create command prints no path */
+		{"#!/bin/sh\nexit 0\n", "snapshot create command printed no path", "removed\n"},
+		/* the printed path does not exist */
+		{"#!/bin/sh\necho '" + filepath.Join(tmpDir, "missing") + "'\n", "stat " + filepath.Join(tmpDir, "missing") + ": no such file or directory", "removed\n"},
+		/* the printed path is not a directory */
+		{"#!/bin/sh\necho '" + teardownScript + "'\n", fmt.Sprintf("%q is not a directory", teardownScript), "removed\n"},
+	} {
+		createScript := filepath.Join(tmpDir, "create.sh")
+		if err := os.WriteFile(createScript, []byte(testCase.script), 0700); err != nil {
+			t.Fatalf("could not write to temporary file: %s", err.Error())
+		}
+		cfg.Backup.SnapshotCreate = createScript
+		_ = os.Remove(marker)
+
+		// Perform the test
+		snapshot, err := CreateSnapshot(context.Background(), tmpDir, "snapshot", cfg)
+		if err == nil {
+			t.Fatalf("CreateSnapshot was supposed to fail")
+		}
+		assertEquals(t, true, snapshot == nil, "snapshot == nil")
+		expected := fmt.Sprintf("could not create custom snapshot of %q: ", tmpDir) + strings.Replace(testCase.expected, "%s", createScript, 1)
+		assertEquals(t, expected, err.Error(), "err.Error")
+		data, _ := os.ReadFile(marker)
+		assertEquals(t, testCase.removed, string(data), "removed")
+	}
+}
+
+func TestCreateSnapshotCommands(t *testing.T) {
+	// Setup Test
+	tmpDir := t.TempDir()
+	volume := filepath.Join(tmpDir, "volume")
+	srcDir := filepath.Join(volume, "data")
+	_ = os.MkdirAll(srcDir, 0700)
+	commands := recordSnapshotCommands(t, func(args []string) string {
+		switch strings.Join(args[:2], " ") {
+		case "btrfs subvolume":
+			if args[2] == "snapshot" {
+				_ = os.MkdirAll(filepath.Join(args[5], "data"), 0700)
+			}
+		case "zfs get":
+			return volume + "\n"
+		case "zfs snapshot":
+			_ = os.MkdirAll(filepath.Join(volume, ".zfs", "snapshot", "snap", "data"), 0700)
+		}
+		return ""
+	})
+
+	/* btrfs snapshots are created next to the subvolume */
+	cfg := setupSnapshotConfig(t, SnapshotBtrfs)
+	cfg.Backup.SnapshotVolume = volume
+	snapshot, err := CreateSnapshot(context.Background(), srcDir, "snap", cfg)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, filepath.Join(tmpDir, "snap", "data"), snapshot.Path, "btrfs.Path")
+	_ = snapshot.Remove(context.Background())
+	assertEquals(t, fmt.Sprintf("btrfs subvolume snapshot -r %s %s,btrfs subvolume delete %s", volume, filepath.Join(tmpDir, "snap"), filepath.Join(tmpDir, "snap")),
+		strings.Join(*commands, ","), "btrfs.commands")
+
+	/* zfs snapshots are read from the .zfs directory of the dataset */
+	*commands = nil
+	cfg = setupSnapshotConfig(t, SnapshotZFS)
+	cfg.Backup.SnapshotVolume = "tank/volume"
+	snapshot, err = CreateSnapshot(context.Background(), srcDir, "snap", cfg)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, filepath.Join(volume, ".zfs", "snapshot", "snap", "data"), snapshot.Path, "zfs.Path")
+	_ = snapshot.Remove(context.Background())
+	assertEquals(t, "zfs get -H -o value mountpoint tank/volume,zfs snapshot tank/volume@snap,zfs destroy tank/volume@snap",
+		strings.Join(*commands, ","), "zfs.commands")
+
+	/* lvm snapshots are mounted read-only at a temporary directory */
+	*commands = nil
+	cfg = setupSnapshotConfig(t, SnapshotLVM)
+	cfg.Backup.SnapshotVolume = "vg/volume"
+	cfg.Backup.SnapshotMountpoint = srcDir
+	snapshot, err = CreateSnapshot(context.Background(), srcDir, "snap", cfg)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	mountDir := snapshot.Path
+	assertEquals(t, true, strings.HasPrefix(filepath.Base(mountDir), "snap-"), "lvm.Path")
+	_ = snapshot.Remove(context.Background())
+	assertEquals(t, fmt.Sprintf("lvcreate --snapshot --name snap --size 1G vg/volume,mount -o ro /dev/vg/snap %s,umount %s,lvremove --yes vg/snap", mountDir, mountDir),
+		strings.Join(*commands, ","), "lvm.commands")
+	_, err = os.Stat(mountDir)
+	assertEquals(t, true, os.IsNotExist(err), "lvm.mountDir removed")
+
+	/* the source must lie on the snapshotted volume */
+	*commands = nil
+	cfg.Backup.SnapshotMountpoint = filepath.Join(tmpDir, "other")
+	_, err = CreateSnapshot(context.Background(), srcDir, "snap", cfg)
+	if err == nil {
+		t.Fatalf("CreateSnapshot was supposed to fail")
+	}
+	assertEquals(t, fmt.Sprintf("could not create lvm snapshot of %q: %q is not below %q", srcDir, srcDir, filepath.Join(tmpDir, "other")), err.Error(), "err.Error")
+	assertEquals(t, 0, len(*commands), "len(commands)")
+}
+
+func TestCreateSnapshotDisabled(t *testing.T) {
+	cfg := setupSnapshotConfig(t, "")
+	snapshot, err := CreateSnapshot(context.Background(), t.TempDir(), "snap", cfg)
+	assertEquals(t, true, snapshot == nil && err == nil, "snapshot == nil && err == nil")
+}
+
+func TestValidateSnapshot(t *testing.T) {
+	for _, testCase := range []struct {
+		snapshotType, volume, mountpoint, create string
+		expected                                 string
+	}{
+		{"", "", "", "", ""},
+		{SnapshotBtrfs, "", "", "", ""},
+		{SnapshotZFS, "tank/data", "", "", ""},
+		{SnapshotZFS, "", "", "", "zfs snapshots require the dataset as snapshot volume"},
+		{SnapshotLVM, "vg/data", "/srv", "", ""},
+		{SnapshotLVM, "vg/data", "", "", "lvm snapshots require the logical volume as snapshot volume and its snapshot mountpoint"},
+		{SnapshotCustom, "", "", "/usr/local/bin/snapshot create", ""},
+		{SnapshotCustom, "", "", " ", "custom snapshots require a snapshot create command"},
+		{"xfs", "", "", "", `invalid snapshot type "xfs", expecting "lvm", "btrfs", "zfs" or "custom"`},
+	} {
+		cfg := setupSnapshotConfig(t, testCase.snapshotType)
+		cfg.Backup.SnapshotVolume = testCase.volume
+		cfg.Backup.SnapshotMountpoint = testCase.mountpoint
+		cfg.Backup.SnapshotCreate = testCase.create
+
+		var actual string
+		if err := cfg.validateSnapshot(); err != nil {
+			actual = err.Error()
+		}
+		assertEquals(t, testCase.expected, actual, fmt.Sprintf("validateSnapshot(%q)", testCase.snapshotType))
+	}
+}
+
+func TestRelativeSource(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "volume")
+	for _, testCase := range []struct {
+		source, expected string
+	}{
+		{root, "."},
+		{filepath.Join(root, "data", "db"), filepath.Join("data", "db")},
+		{filepath.Join(root, "..data"), "..data"},
+		{filepath.Dir(root), ""},
+		{filepath.Join(filepath.Dir(root), "other"), ""},
+	} {
+		relative, _ := relativeSource(root, testCase.source)
+		assertEquals(t, testCase.expected, relative, fmt.Sprintf("relativeSource(%q)", testCase.source))
+	}
+}
@@ -0,0 +1,185 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/mholt/archiver/v4"
+)
+
+type (
+	// FileError reports a path of the backup source that could not be read.
+	FileError struct {
+		// absolute path on disk
+		Path string
+		Err  error
+	}
+
+	// FileErrors lists paths of the backup source that could not be read.
+	FileErrors []*FileError
+
+	// fileErrorReader reports read errors of a source file as *FileError.
+	fileErrorReader struct {
+		io.ReadCloser
+		path string
+	}
+)
+
+// errnoNames names error numbers commonly returned when reading a source tree.
+var errnoNames = map[syscall.Errno]string{
+	syscall.EACCES:       "EACCES",
+	syscall.EPERM:        "EPERM",
+	syscall.ENOENT:       "ENOENT",
+	syscall.ENOTDIR:      "ENOTDIR",
+	syscall.EIO:          "EIO",
+	syscall.ELOOP:        "ELOOP",
+	syscall.ENAMETOOLONG: "ENAMETOOLONG",
+}
+
+// Error formats the path followed by the cause and its error number, e.g.
+// '/srv/data/db: permission denied (EACCES)'.
+func (fe *FileError) Error() string {
+	var message string = fe.Err.Error()
+	var pathErr *fs.PathError
+	if errors.As(fe.Err, &pathErr) {
+		// the path is reported already
+		message = pathErr.Err.Error()
+	}
+	var errno syscall.Errno
+	if errors.As(fe.Err, &errno) {
+		if name, prs := errnoNames[errno]; prs {
+			message += " (" + name + ")"
+		}
+	}
+	return fmt.Sprintf("%s: %s", fe.Path, message)
+}
+
+func (fe *FileError) Unwrap() error {
+	return fe.Err
+}
+
+// Error lists all paths on lines of their own.
+func (fes FileErrors) Error() string {
+	lines := []string{fmt.Sprintf("could not read %d paths of the backup source:", len(fes))}
+	for _, fe := range fes {
+		lines = append(lines, "  "+fe.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (fer *fileErrorReader) Read(p []byte) (int, error) {
+	n, err := fer.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		err = &FileError{fer.path, err}
+	}
+	return n, err
+}
+
+// archiveRoot returns the directory archive entries of `dirPath` are named below: the base
+// name of the directory, or none if it is given with a trailing separator.
+func archiveRoot(dirPath string) string {
+	if HasTrailingSeparator(dirPath) {
+		return ""
+	}
+	return filepath.Base(dirPath)
+}
+
+// sourceFiles maps the files below `dirPath` to their names in the archive like
+// archiver.FilesFromDisk does, below `rootInArchive`, symbolic links are preserved. Entries
+// for which `exclude` returns true are left out. Unlike archiver.FilesFromDisk, paths that
+// cannot be read do not stop the walk, they are returned as FileErrors unless excluded.
+// Failing to read `dirPath` itself is an error.
+func sourceFiles(dirPath, rootInArchive string, exclude func(nameInArchive string) bool) ([]archiver.File, FileErrors, error) {
+	absPath, err := filepath.Abs(dirPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var files []archiver.File
+	var problems FileErrors
+	err = filepath.WalkDir(dirPath, func(filename string, d fs.DirEntry, err error) error {
+		if err != nil && filename == dirPath {
+			return err
+		}
+
+		relative := strings.TrimLeft(strings.TrimPrefix(filename, dirPath), string(filepath.Separator))
+		nameInArchive := path.Join(rootInArchive, filepath.ToSlash(relative))
+		if exclude != nil && exclude(nameInArchive) {
+			return nil
+		}
+		diskPath := filepath.Join(absPath, relative)
+		if err != nil {
+			// contents of the directory could not be listed, its entry was added before
+			problems = append(problems, &FileError{diskPath, err})
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			problems = append(problems, &FileError{diskPath, err})
+			return nil
+		}
+		// this is the root folder and we are adding its contents
+		if info.IsDir() && nameInArchive == "" {
+			return nil
+		}
+
+		var linkTarget string
+		if info.Mode()&fs.ModeSymlink != 0 {
+			linkTarget, err = os.Readlink(filename)
+			if err != nil {
+				problems = append(problems, &FileError{diskPath, err})
+				return nil
+			}
+		}
+
+		files = append(files, archiver.File{
+			FileInfo:      info,
+			NameInArchive: nameInArchive,
+			LinkTarget:    linkTarget,
+			Open: func() (io.ReadCloser, error) {
+				file, err := os.Open(filename)
+				if err != nil {
+					return nil, &FileError{diskPath, err}
+				}
+				return &fileErrorReader{file, diskPath}, nil
+			},
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return files, problems, nil
+}
+
+// checkSourceFiles opens every regular file of `files` once, which finds files that cannot
+// be read before archiving starts. Returns the readable files and the problems found.
+func checkSourceFiles(files []archiver.File) ([]archiver.File, FileErrors) {
+	var readable []archiver.File
+	var problems FileErrors
+	for _, file := range files {
+		if file.Mode().IsRegular() {
+			reader, err := file.Open()
+			if err != nil {
+				var fileErr *FileError
+				if !errors.As(err, &fileErr) {
+					fileErr = &FileError{file.NameInArchive, err}
+				}
+				problems = append(problems, fileErr)
+				continue
+			}
+			_ = reader.Close()
+		}
+		readable = append(readable, file)
+	}
+	return readable, problems
+}
@@ -0,0 +1,224 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mholt/archiver/v4"
+)
+
+// helper function: source tree holding an unreadable file and a directory without the
+// execute bit next to a readable file. Returns the tree and the paths that cannot be read.
+func setupUnreadableSource(t *testing.T) (string, []string) {
+	skipWithoutPermissionBits(t)
+	if os.Getuid() == 0 {
+		t.Skip("root can read files without permissions")
+	}
+	srcDir := t.TempDir()
+	for name, content := range map[string]string{
+		"file.txt":             "test content",
+		"deep/secret.key":      "secret",
+		"noexec/inside.txt":    "inside",
+		"deep/nested/more.txt": "more",
+	} {
+		filePath := filepath.Join(srcDir, name)
+		_ = os.MkdirAll(filepath.Dir(filePath), 0700)
+		if err := os.WriteFile(filePath, []byte(content), 0600); err != nil {
+			t.Fatalf("could not write to temporary file: %s", err.Error())
+		}
+	}
+	secret := filepath.Join(srcDir, "deep", "secret.key")
+	noexec := filepath.Join(srcDir, "noexec")
+	if err := os.Chmod(secret, 0); err != nil {
+		t.Fatalf("could not change permissions: %s", err.Error())
+	}
+	if err := os.Chmod(noexec, 0600); err != nil {
+		t.Fatalf("could not change permissions: %s", err.Error())
+	}
+	t.Cleanup(func() { _ = os.Chmod(noexec, 0700) })
+	return srcDir, []string{secret, filepath.Join(noexec, "inside.txt")}
+}
+
+// helper function: names of the entries of the gzip-compressed TAR archive at `archivePath`.
+func archiveEntries(t *testing.T, archivePath string) []string {
+	archive, err := os.Open(archivePath)
+	if err != nil {
+		t.Fatalf("could not open archive: %s", err.Error())
+	}
+	defer archive.Close()
+
+	var names []string
+	format := archiver.CompressedArchive{Compression: archiver.Gz{}, Archival: archiver.Tar{}}
+	err = format.Extract(context.Background(), archive, nil, func(ctx context.Context, file archiver.File) error {
+		names = append(names, file.NameInArchive)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("could not read archive: %s", err.Error())
+	}
+	sort.Strings(names)
+	return names
+}
+
+/* test cases for FileError */
+func TestFileError(t *testing.T) {
+	fileErr := &FileError{"/srv/data/db", &fs.PathError{Op: "open", Path: "data/db", Err: syscall.EACCES}}
+	assertEquals(t, "/srv/data/db: permission denied (EACCES)", fileErr.Error(), "fileErr.Error()")
+	assertEquals(t, true, errors.Is(fileErr, fs.ErrPermission), "errors.Is")
+
+	/* causes without an error number are reported as they are */
+	fileErr = &FileError{"/srv/data/log", io.ErrUnexpectedEOF}
+	assertEquals(t, "/srv/data/log: unexpected EOF", fileErr.Error(), "fileErr.Error()")
+
+	/* lists show every path */
+	fileErrs := FileErrors{
+		{"/srv/data/db", syscall.EIO},
+		{"/srv/data/private", &fs.PathError{Op: "lstat", Path: "/srv/data/private", Err: syscall.ENOENT}},
+	}
+	assertEquals(t, "could not read 2 paths of the backup source:\n"+
+		"  /srv/data/db: input/output error (EIO)\n"+
+		"  /srv/data/private: no such file or directory (ENOENT)", fileErrs.Error(), "fileErrs.Error()")
+}
+
+/* test cases for sourceFiles */
+func TestSourceFiles(t *testing.T) {
+	// Setup Test
+	srcDir := setupBackupSource(t)
+	_ = os.MkdirAll(filepath.Join(srcDir, "sub", "dir"), 0700)
+	_ = os.WriteFile(filepath.Join(srcDir, "sub", "dir", "nested.txt"), []byte("nested"), 0600)
+	_ = os.Symlink("file.txt", filepath.Join(srcDir, "link"))
+
+	// Perform the test
+	for _, dirPath := range []string{srcDir, srcDir + string(filepath.Separator)} {
+		expected, err := archiver.FilesFromDisk(nil, map[string]string{dirPath: ""})
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		files, problems, err := sourceFiles(dirPath, archiveRoot(dirPath), nil)
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		assertEquals(t, 0, len(problems), "len(problems)")
+
+		/* entries match those of archiver */
+		assertEquals(t, len(expected), len(files), "len(files)")
+		for index := range expected {
+			assertEquals(t, expected[index].NameInArchive, files[index].NameInArchive, "files.NameInArchive")
+			assertEquals(t, expected[index].LinkTarget, files[index].LinkTarget, "files.LinkTarget")
+			assertEquals(t, expected[index].Mode(), files[index].Mode(), "files.Mode")
+		}
+	}
+
+	/* excluded entries are dropped, their contents are matched on their own */
+	files, _, _ := sourceFiles(srcDir, archiveRoot(srcDir), func(name string) bool { return strings.HasSuffix(name, "/sub/dir") })
+	var names []string
+	for _, file := range files {
+		names = append(names, strings.TrimPrefix(file.NameInArchive, filepath.Base(srcDir)))
+	}
+	assertEquals(t, ",/file.txt,/link,/sub,/sub/dir/nested.txt", strings.Join(names, ","), "names")
+
+	/* unreadable roots are an error */
+	_, _, err := sourceFiles(filepath.Join(srcDir, "missing"), "missing", nil)
+	assertEquals(t, true, errors.Is(err, fs.ErrNotExist), "err")
+}
+
+func TestSourceFilesUnreadable(t *testing.T) {
+	// Setup Test
+	srcDir, unreadable := setupUnreadableSource(t)
+
+	// Perform the test
+	files, problems, err := sourceFiles(srcDir, archiveRoot(srcDir), nil)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	/* the directory without the execute bit cannot be walked */
+	assertEquals(t, 1, len(problems), "len(problems)")
+	assertEquals(t, unreadable[1]+": permission denied (EACCES)", problems[0].Error(), "problems[0]")
+
+	/* unreadable files are found by opening them */
+	_, problems = checkSourceFiles(files)
+	assertEquals(t, 1, len(problems), "len(problems)")
+	assertEquals(t, unreadable[0]+": permission denied (EACCES)", problems[0].Error(), "problems[0]")
+
+	/* excluded paths are not reported */
+	_, problems, _ = sourceFiles(srcDir, archiveRoot(srcDir), func(name string) bool { return strings.HasSuffix(name, "/noexec/inside.txt") })
+	assertEquals(t, 0, len(problems), "len(problems)")
+}
+
+/* test cases for ArchiveDirectory */
+func TestArchiveDirectoryUnreadable(t *testing.T) {
+	// Setup Test
+	srcDir, unreadable := setupUnreadableSource(t)
+	cfg := setupBackupConfig(t)
+	root := filepath.Base(srcDir)
+
+	// Perform the test
+	/* all problems are reported before archiving */
+	archivePath, _, err := ArchiveDirectory(context.Background(), srcDir, cfg, ArchiveFilter{})
+	assertEquals(t, "", archivePath, "archivePath")
+	assertEquals(t, "could not read 2 paths of the backup source:\n"+
+		"  "+unreadable[1]+": permission denied (EACCES)\n"+
+		"  "+unreadable[0]+": permission denied (EACCES)", fmt.Sprintf("%v", err), "err")
+
+	/* without the preflight check, unreadable files fail the archive once reached */
+	cfg.Backup.Preflight = false
+	cfg.Backup.IgnoreFileErrors = true
+	archivePath, _, err = ArchiveDirectory(context.Background(), srcDir, cfg, ArchiveFilter{})
+	_ = os.Remove(archivePath)
+	assertEquals(t, "failed to generate archive: "+unreadable[0]+": permission denied (EACCES)", fmt.Sprintf("%v", err), "err")
+
+	/* problems are skipped if ignored */
+	cfg.Backup.Preflight = true
+	archivePath, sourceSize, skipped, err := archiveDirectory(context.Background(), srcDir, archiveRoot(srcDir), cfg, ArchiveFilter{})
+	defer os.Remove(archivePath)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 2, len(skipped), "len(skipped)")
+	assertEquals(t, int64(16), sourceSize, "sourceSize")
+	assertEquals(t, root+","+root+"/deep,"+root+"/deep/nested,"+root+"/deep/nested/more.txt,"+root+"/file.txt,"+root+"/noexec",
+		strings.Join(archiveEntries(t, archivePath), ","), "entries")
+}
+
+/* test cases for Backup */
+func TestBackupUnreadable(t *testing.T) {
+	// Setup Test
+	srcDir, unreadable := setupUnreadableSource(t)
+	cfg := setupBackupConfig(t)
+	cfg.Backup.IgnoreFileErrors = true
+	memory := NewMemoryBackend()
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	var stderr bytes.Buffer
+
+	// Perform the test
+	result, err := Backup(context.Background(), BackupOptions{
+		Source:      srcDir,
+		Destination: prefixUri,
+		Config:      cfg,
+		Backend:     memory,
+		Time:        time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC),
+		Stderr:      &stderr,
+	})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+
+	/* skipped paths are listed once the backup is done */
+	assertEquals(t, true, result.Stored, "result.Stored")
+	assertEquals(t, "skipped unreadable "+unreadable[1]+": permission denied (EACCES),"+
+		"skipped unreadable "+unreadable[0]+": permission denied (EACCES)", strings.Join(result.Warnings, ","), "result.Warnings")
+	assertEquals(t, true, strings.HasSuffix(stderr.String(), "warning: skipped unreadable "+unreadable[0]+": permission denied (EACCES)\n"), "stderr")
+}
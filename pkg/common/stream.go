@@ -0,0 +1,155 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	// InputFormatTar marks TAR streams given as BackupOptions.Input, they are gzip-compressed
+	// like archives of directories. Streams that are gzip-compressed already are re-compressed.
+	InputFormatTar = "tar"
+	// InputFormatTarGz marks gzip-compressed TAR streams given as BackupOptions.Input, they are
+	// stored as given.
+	InputFormatTarGz = "tar.gz"
+
+	// size of TAR headers and the offset of the magic in them
+	tar_block_size   = 512
+	tar_magic_offset = 257
+	tar_magic        = "ustar"
+)
+
+var (
+	// gzipMagic starts gzip-compressed streams.
+	gzipMagic = []byte{0x1f, 0x8b}
+	// zstdMagic starts zstd-compressed streams.
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// isTarHeader reports whether `block` is a header of a POSIX or GNU TAR archive, or the
+// zero block ending an empty archive.
+func isTarHeader(block []byte) bool {
+	if len(block) < tar_block_size {
+		return false
+	}
+	return string(block[tar_magic_offset:tar_magic_offset+len(tar_magic)]) == tar_magic ||
+		bytes.Equal(block[:tar_block_size], make([]byte, tar_block_size))
+}
+
+// ArchiveStream stores the TAR stream `input` of the given `format`, see InputFormatTar, as
+// a gzip-compressed archive in a temporary file. Returns its path and the size of the
+// uncompressed stream. Progress is reported to `cfg.Internal.Reporter` on the input side.
+func ArchiveStream(ctx context.Context, input io.Reader, format string, cfg *Config) (string, int64, error) {
+	if format != InputFormatTar && format != InputFormatTarGz {
+		return "", 0, fmt.Errorf("unsupported input format %q, expecting %q or %q", format, InputFormatTar, InputFormatTarGz)
+	}
+
+	// create the output file we'll write to
+	tmp, err := createTempFile(cfg, "backup")
+	if err != nil {
+		return "", 0, fmt.Errorf("could not create temporary file: %s", err.Error())
+	}
+
+	// count progress against an unknown total, the size of streams is not known in advance
+	var reader io.Reader = &contextReader{ctx, input}
+	var index int = 0
+	if ProgressEnabled(cfg.Internal.Reporter) {
+		index, _ = cfg.Internal.Reporter.CreateFileTask(-1)
+		_ = cfg.Internal.Reporter.DescribeTask(index, "archiving")
+		reader = &progressReadCloser{io.NopCloser(reader), cfg.Internal.Reporter, index}
+	}
+
+	var sourceSize int64
+	if format == InputFormatTarGz {
+		err = storeCompressedStream(tmp, reader, cfg)
+		if err == nil {
+			sourceSize, err = checkCompressedArchive(tmp.Name(), cfg)
+		}
+	} else {
+		sourceSize, err = compressStream(tmp, reader, cfg)
+	}
+	if err != nil {
+		_ = tmp.Close()
+		return tmp.Name(), 0, err
+	}
+	if index > 0 {
+		cfg.Internal.Reporter.FinishTask(index)
+	}
+
+	if err = tmp.Close(); err != nil {
+		return tmp.Name(), 0, fmt.Errorf("could not close archive: %s", err.Error())
+	}
+
+	return tmp.Name(), sourceSize, nil
+}
+
+// compressStream writes the TAR stream `input` gzip-compressed to `output`, decompressing it
+// first if it is gzip-compressed already. Returns the size of the uncompressed stream.
+func compressStream(output io.Writer, input io.Reader, cfg *Config) (int64, error) {
+	buffered := bufio.NewReaderSize(input, max(cfg.BufferSize(), tar_block_size))
+	if magic, _ := buffered.Peek(len(gzipMagic)); bytes.Equal(magic, gzipMagic) {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return 0, fmt.Errorf("could not decompress input: %s", err.Error())
+		}
+		buffered = bufio.NewReaderSize(gz, max(cfg.BufferSize(), tar_block_size))
+	}
+	if block, err := buffered.Peek(tar_block_size); err != nil && err != io.EOF {
+		return 0, fmt.Errorf("could not read input: %s", err.Error())
+	} else if !isTarHeader(block) {
+		return 0, fmt.Errorf("input is not a TAR stream")
+	}
+
+	gz := gzip.NewWriter(output)
+	size, err := CopyBuffer(gz, buffered, cfg.BufferSize())
+	if err != nil {
+		return size, fmt.Errorf("could not read input: %s", err.Error())
+	}
+	if err = gz.Close(); err != nil {
+		return size, fmt.Errorf("failed to generate archive: %s", err.Error())
+	}
+	return size, nil
+}
+
+// storeCompressedStream writes the gzip-compressed stream `input` to `output` as given.
+func storeCompressedStream(output io.Writer, input io.Reader, cfg *Config) error {
+	buffered := bufio.NewReaderSize(input, max(cfg.BufferSize(), tar_block_size))
+	if magic, err := buffered.Peek(len(gzipMagic)); err != nil && err != io.EOF {
+		return fmt.Errorf("could not read input: %s", err.Error())
+	} else if !bytes.Equal(magic, gzipMagic) {
+		return fmt.Errorf("input is not gzip-compressed")
+	}
+	if _, err := CopyBuffer(output, buffered, cfg.BufferSize()); err != nil {
+		return fmt.Errorf("could not read input: %s", err.Error())
+	}
+	return nil
+}
+
+// checkCompressedArchive reads the gzip-compressed archive at `archivePath` to the end, which
+// verifies the compression, and checks that it holds a TAR stream. Returns its uncompressed size.
+func checkCompressedArchive(archivePath string, cfg *Config) (int64, error) {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return 0, fmt.Errorf("could not open archive: %s", err.Error())
+	}
+	defer file.Close()
+
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		return 0, fmt.Errorf("could not decompress input: %s", err.Error())
+	}
+	buffered := bufio.NewReaderSize(gz, max(cfg.BufferSize(), tar_block_size))
+	if block, _ := buffered.Peek(tar_block_size); !isTarHeader(block) {
+		return 0, fmt.Errorf("input is not a gzip-compressed TAR stream")
+	}
+	size, err := CopyBuffer(io.Discard, buffered, cfg.BufferSize())
+	if err != nil {
+		return size, fmt.Errorf("could not decompress input: %s", err.Error())
+	}
+	return size, nil
+}
@@ -0,0 +1,175 @@
+package common
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// helper function: TAR stream holding files named after `contents`.
+func setupTarStream(t *testing.T, contents map[string]string) []byte {
+	var buf bytes.Buffer
+	writer := tar.NewWriter(&buf)
+	for name, content := range contents {
+		err := writer.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		if err == nil {
+			_, err = writer.Write([]byte(content))
+		}
+		if err != nil {
+			t.Fatalf("could not write TAR stream: %s", err.Error())
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("could not write TAR stream: %s", err.Error())
+	}
+	return buf.Bytes()
+}
+
+// helper function: gzip-compress `data`.
+func gzipBytes(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		t.Fatalf("could not compress: %s", err.Error())
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("could not compress: %s", err.Error())
+	}
+	return buf.Bytes()
+}
+
+// helper function: contents of the file at `filePath`, decompressed.
+func gunzipFile(t *testing.T, filePath string) []byte {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatalf("could not read archive: %s", err.Error())
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("could not decompress archive: %s", err.Error())
+	}
+	plain, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("could not decompress archive: %s", err.Error())
+	}
+	return plain
+}
+
+/* test cases for ArchiveStream */
+func TestArchiveStream(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	stream := setupTarStream(t, map[string]string{"file.txt": "test content"})
+
+	// Perform the test
+	for name, input := range map[string][]byte{
+		"tar":         stream,
+		"gzipped tar": gzipBytes(t, stream),
+		"empty tar":   make([]byte, 2*tar_block_size),
+	} {
+		archivePath, size, err := ArchiveStream(context.Background(), bytes.NewReader(input), InputFormatTar, cfg)
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		defer os.Remove(archivePath)
+		plain := gunzipFile(t, archivePath)
+		if name == "empty tar" {
+			assertEquals(t, true, bytes.Equal(input, plain), "plain("+name+")")
+		} else {
+			assertEquals(t, true, bytes.Equal(stream, plain), "plain("+name+")")
+		}
+		assertEquals(t, int64(len(plain)), size, "size("+name+")")
+	}
+
+	/* gzip-compressed streams are stored as given */
+	compressed := gzipBytes(t, stream)
+	archivePath, size, err := ArchiveStream(context.Background(), bytes.NewReader(compressed), InputFormatTarGz, cfg)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	defer os.Remove(archivePath)
+	stored, _ := os.ReadFile(archivePath)
+	assertEquals(t, true, bytes.Equal(compressed, stored), "stored")
+	assertEquals(t, int64(len(stream)), size, "size")
+}
+
+func TestArchiveStreamErrors(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	stream := setupTarStream(t, map[string]string{"file.txt": "test content"})
+	notTar := []byte(strings.Repeat("not a TAR stream\n", 64))
+
+	// Perform the test
+	for _, test := range []struct {
+		input    []byte
+		format   string
+		expected string
+	}{
+		{notTar, InputFormatTar, "input is not a TAR stream"},
+		{notTar[:10], InputFormatTar, "input is not a TAR stream"},
+		{nil, InputFormatTar, "input is not a TAR stream"},
+		{gzipBytes(t, notTar), InputFormatTar, "input is not a TAR stream"},
+		{stream, InputFormatTarGz, "input is not gzip-compressed"},
+		{gzipBytes(t, notTar), InputFormatTarGz, "input is not a gzip-compressed TAR stream"},
+		{gzipBytes(t, stream)[:100], InputFormatTarGz, "could not decompress input: unexpected EOF"},
+		{stream, "zip", `unsupported input format "zip", expecting "tar" or "tar.gz"`},
+	} {
+		archivePath, _, err := ArchiveStream(context.Background(), bytes.NewReader(test.input), test.format, cfg)
+		if len(archivePath) > 0 {
+			defer os.Remove(archivePath)
+		}
+		assertEquals(t, test.expected, fmt.Sprintf("%v", err), "err")
+	}
+
+	/* reading stops once the context is done */
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, format := range []string{InputFormatTar, InputFormatTarGz} {
+		archivePath, _, err := ArchiveStream(ctx, bytes.NewReader(stream), format, cfg)
+		defer os.Remove(archivePath)
+		assertEquals(t, "could not read input: context canceled", fmt.Sprintf("%v", err), "err")
+	}
+}
+
+/* test cases for Backup */
+func TestBackupStream(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	memory := NewMemoryBackend()
+	destination, _ := url.Parse("memory://bucket/prefix/")
+	stream := setupTarStream(t, map[string]string{"a.txt": "a", "b.txt": "b"})
+
+	// Perform the test
+	result, err := Backup(context.Background(), BackupOptions{
+		Destination: destination,
+		Config:      cfg,
+		Backend:     memory,
+		Time:        time.Date(2024, time.May, 1, 3, 0, 0, 0, time.UTC),
+		Input:       bytes.NewReader(stream),
+		InputFormat: InputFormatTar,
+	})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "2024-05-01T03.tar.gz", result.Name, "result.Name")
+	assertEquals(t, int64(len(stream)), result.Sizes.Source, "result.Sizes.Source")
+
+	var stored bytes.Buffer
+	if err = memory.RetrieveFile(&stored, result.Object); err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	reader, err := gzip.NewReader(&stored)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	plain, _ := io.ReadAll(reader)
+	assertEquals(t, true, bytes.Equal(stream, plain), "plain")
+}
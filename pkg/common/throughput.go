@@ -0,0 +1,237 @@
+package common
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type (
+	// throughputSample records `bytes` transferred at `at`.
+	throughputSample struct {
+		at    time.Time
+		bytes int64
+	}
+
+	// throughputEstimator estimates the rate of a transfer of `total` bytes from the samples
+	// within the last `window`, the transfer is stalled if nothing was transferred for `stall`.
+	// It is not safe for concurrent use.
+	throughputEstimator struct {
+		clock   func() time.Time
+		window  time.Duration
+		stall   time.Duration
+		total   int64
+		done    int64
+		start   time.Time
+		last    time.Time
+		samples []throughputSample
+	}
+
+	// uploadSummary reports the aggregate progress of the parts of a multipart upload as a
+	// task of its own, the description of which shows the upload rate and the remaining time.
+	// All methods are safe for concurrent use and may be called on nil.
+	uploadSummary struct {
+		lock        sync.Mutex
+		estimator   *throughputEstimator
+		pr          ProgressReporter
+		index       int
+		description string
+		done        chan bool
+		stopped     chan bool
+	}
+)
+
+const (
+	// period over which the upload rate is averaged
+	throughput_window = 10 * time.Second
+	// period without progress after which an upload is displayed as stalled
+	throughput_stall = 30 * time.Second
+	// period between updates of the upload summary
+	upload_summary_interval = 2 * time.Second
+)
+
+// newThroughputEstimator creates an estimator for a transfer of `total` bytes starting now
+// according to `clock`.
+func newThroughputEstimator(total int64, clock func() time.Time) *throughputEstimator {
+	now := clock()
+	return &throughputEstimator{
+		clock:  clock,
+		window: throughput_window,
+		stall:  throughput_stall,
+		total:  total,
+		start:  now,
+		last:   now,
+	}
+}
+
+// advance records that `n` more bytes were transferred.
+func (te *throughputEstimator) advance(n int64) {
+	if n <= 0 {
+		return
+	}
+	now := te.clock()
+	te.done = min(te.done+n, te.total)
+	te.last = now
+	te.samples = append(te.samples, throughputSample{now, n})
+	te.expire(now)
+}
+
+// expire drops samples that left the window before `now`.
+func (te *throughputEstimator) expire(now time.Time) {
+	var expired int
+	for expired < len(te.samples) && now.Sub(te.samples[expired].at) >= te.window {
+		expired++
+	}
+	te.samples = te.samples[expired:]
+}
+
+// rate returns the average number of bytes transferred per second within the window, or
+// since the start if the transfer is younger than the window.
+func (te *throughputEstimator) rate() float64 {
+	now := te.clock()
+	te.expire(now)
+
+	span := min(now.Sub(te.start), te.window)
+	if span <= 0 {
+		return 0
+	}
+	var bytes int64
+	for _, sample := range te.samples {
+		bytes += sample.bytes
+	}
+	return float64(bytes) / span.Seconds()
+}
+
+// stalled returns true if nothing was transferred for the stall period.
+func (te *throughputEstimator) stalled() bool {
+	return te.done < te.total && te.clock().Sub(te.last) >= te.stall
+}
+
+// describe formats the progress of the transfer, e.g. 'uploading 3.2 GiB of 48 GiB,
+// 14 MiB/s, ETA 55m'. The rate is left out until it is known, stalled transfers show
+// 'stalled' instead.
+func (te *throughputEstimator) describe(action string) string {
+	description := fmt.Sprintf("%s %s of %s", action, formatBytes(float64(te.done)), formatBytes(float64(te.total)))
+	if te.stalled() {
+		return description + ", stalled"
+	}
+	rate := te.rate()
+	if rate <= 0 {
+		return description
+	}
+	eta := time.Duration(float64(te.total-te.done) / rate * float64(time.Second))
+	return fmt.Sprintf("%s, %s/s, ETA %s", description, formatBytes(rate), formatETA(eta))
+}
+
+// formatBytes formats `bytes` in binary units with up to one decimal, e.g. '3.2 GiB' or '48 GiB'.
+func formatBytes(bytes float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	var unit int
+	for unit < len(units)-1 && bytes >= 1024 {
+		bytes /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d %s", int64(bytes), units[unit])
+	}
+	return strings.TrimSuffix(strconv.FormatFloat(bytes, 'f', 1, 64), ".0") + " " + units[unit]
+}
+
+// formatCount formats `count` with thousands separated by commas, e.g. '12,345'.
+func formatCount(count int64) string {
+	digits := strconv.FormatInt(count, 10)
+	var sign string
+	if count < 0 {
+		sign, digits = "-", digits[1:]
+	}
+	for index := len(digits) - 3; index > 0; index -= 3 {
+		digits = digits[:index] + "," + digits[index:]
+	}
+	return sign + digits
+}
+
+// formatETA formats the remaining time `d`, rounded to minutes above an hour and to seconds
+// below a minute, e.g. '1h05m', '55m' or '42s'.
+func formatETA(d time.Duration) string {
+	seconds := int64(d.Round(time.Second) / time.Second)
+	if seconds >= 3600 {
+		minutes := int64(d.Round(time.Minute) / time.Minute)
+		return fmt.Sprintf("%dh%02dm", minutes/60, minutes%60)
+	} else if seconds >= 60 {
+		return fmt.Sprintf("%dm", int64(d.Round(time.Minute)/time.Minute))
+	}
+	return fmt.Sprintf("%ds", seconds)
+}
+
+// startUploadSummary creates the summary task of an upload of `total` bytes and updates its
+// description periodically until stopped. Returns nil if progress reporting is disabled.
+func startUploadSummary(pr ProgressReporter, total int64, clock func() time.Time) *uploadSummary {
+	if !ProgressEnabled(pr) {
+		return nil
+	}
+	index, _ := pr.CreateFileTask(total)
+	us := &uploadSummary{
+		estimator: newThroughputEstimator(total, clock),
+		pr:        pr,
+		index:     index,
+		done:      make(chan bool),
+		stopped:   make(chan bool),
+	}
+	us.refresh()
+
+	go func() {
+		defer close(us.stopped)
+		ticker := time.NewTicker(upload_summary_interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				us.refresh()
+			case <-us.done:
+				return
+			}
+		}
+	}()
+
+	return us
+}
+
+// advance records that `n` more bytes were uploaded.
+func (us *uploadSummary) advance(n int64) {
+	if us == nil || n <= 0 {
+		return
+	}
+	us.lock.Lock()
+	defer us.lock.Unlock()
+
+	previous := us.estimator.done
+	us.estimator.advance(n)
+	_ = us.pr.AdvanceTask(us.index, us.estimator.done-previous)
+}
+
+// refresh updates the description of the summary task if it changed.
+func (us *uploadSummary) refresh() {
+	if us == nil {
+		return
+	}
+	us.lock.Lock()
+	defer us.lock.Unlock()
+
+	if description := us.estimator.describe("uploading"); description != us.description {
+		us.description = description
+		_ = us.pr.DescribeTask(us.index, description)
+	}
+}
+
+// stop ends the periodic updates and finishes the summary task.
+func (us *uploadSummary) stop() {
+	if us == nil {
+		return
+	}
+	close(us.done)
+	<-us.stopped
+	us.refresh()
+	_ = us.pr.FinishTask(us.index)
+}
@@ -0,0 +1,156 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// helper function: clock that is moved forward by the test.
+func setupFakeClock() (*time.Time, func() time.Time) {
+	now := time.Date(2024, time.May, 1, 3, 0, 0, 0, time.UTC)
+	return &now, func() time.Time { return now }
+}
+
+/* test cases for throughputEstimator */
+func TestThroughputEstimator(t *testing.T) {
+	const mebibyte = 1024 * 1024
+
+	// Setup Test
+	now, clock := setupFakeClock()
+	estimator := newThroughputEstimator(48*1024*mebibyte, clock)
+
+	// Perform the test
+	for _, step := range []struct {
+		elapsed  time.Duration
+		advance  int64
+		expected string
+	}{
+		/* the rate is not known before any time passed */
+		{0, 0, "uploading 0 B of 48 GiB"},
+		{0, 512, "uploading 512 B of 48 GiB"},
+		/* the rate is averaged since the start within the first window */
+		{2 * time.Second, 28*mebibyte - 512, "uploading 28 MiB of 48 GiB, 14 MiB/s, ETA 58m"},
+		{3 * time.Second, 42 * mebibyte, "uploading 70 MiB of 48 GiB, 14 MiB/s, ETA 58m"},
+		{5 * time.Second, 70 * mebibyte, "uploading 140 MiB of 48 GiB, 14 MiB/s, ETA 58m"},
+		/* samples leave the window, the rate drops */
+		{2 * time.Second, 0, "uploading 140 MiB of 48 GiB, 11.2 MiB/s, ETA 1h13m"},
+		{3 * time.Second, 0, "uploading 140 MiB of 48 GiB, 7 MiB/s, ETA 1h57m"},
+		{4 * time.Second, 0, "uploading 140 MiB of 48 GiB, 7 MiB/s, ETA 1h57m"},
+		{time.Second, 0, "uploading 140 MiB of 48 GiB"},
+		/* uploads without progress are stalled */
+		{19 * time.Second, 0, "uploading 140 MiB of 48 GiB"},
+		{time.Second, 0, "uploading 140 MiB of 48 GiB, stalled"},
+		{20 * time.Second, 0, "uploading 140 MiB of 48 GiB, stalled"},
+		/* progress ends a stall */
+		{0, 100 * mebibyte, "uploading 240 MiB of 48 GiB, 10 MiB/s, ETA 1h22m"},
+		/* bytes beyond the total are not counted */
+		{10 * time.Second, 48 * 1024 * mebibyte, "uploading 48 GiB of 48 GiB, 4.8 GiB/s, ETA 0s"},
+		{time.Minute, 0, "uploading 48 GiB of 48 GiB"},
+	} {
+		*now = now.Add(step.elapsed)
+		estimator.advance(step.advance)
+		assertEquals(t, step.expected, estimator.describe("uploading"), "describe")
+	}
+}
+
+/* test cases for formatBytes */
+func TestFormatBytes(t *testing.T) {
+	for bytes, expected := range map[float64]string{
+		0:                         "0 B",
+		1023:                      "1023 B",
+		1024:                      "1 KiB",
+		1536:                      "1.5 KiB",
+		3.2 * 1024 * 1024 * 1024:  "3.2 GiB",
+		2048 * 1024 * 1024 * 1024: "2 TiB",
+		1 << 60:                   "1048576 TiB",
+	} {
+		assertEquals(t, expected, formatBytes(bytes), "formatBytes")
+	}
+}
+
+/* test cases for formatCount */
+func TestFormatCount(t *testing.T) {
+	for count, expected := range map[int64]string{
+		0:        "0",
+		999:      "999",
+		1000:     "1,000",
+		12345:    "12,345",
+		1000000:  "1,000,000",
+		-1234567: "-1,234,567",
+	} {
+		assertEquals(t, expected, formatCount(count), "formatCount")
+	}
+}
+
+/* test cases for formatETA */
+func TestFormatETA(t *testing.T) {
+	for d, expected := range map[time.Duration]string{
+		0:                                 "0s",
+		42*time.Second + time.Millisecond: "42s",
+		59 * time.Second:                  "59s",
+		55*time.Minute + 20*time.Second:   "55m",
+		65*time.Minute + 40*time.Second:   "1h06m",
+		25 * time.Hour:                    "25h00m",
+	} {
+		assertEquals(t, expected, formatETA(d), "formatETA")
+	}
+}
+
+/* test cases for uploadSummary */
+func TestUploadSummary(t *testing.T) {
+	// Setup Test
+	var output bytes.Buffer
+	now, clock := setupFakeClock()
+	summary := startUploadSummary(NewPlainProgressReporter(&output), 4096, clock)
+
+	// Perform the test
+	*now = now.Add(time.Second)
+	summary.advance(1024)
+	summary.refresh()
+	*now = now.Add(throughput_stall)
+	summary.refresh()
+	summary.advance(3072)
+	summary.stop()
+
+	assertEquals(t, "uploading 0 B of 4 KiB...\n"+
+		"uploading 1 KiB of 4 KiB, 1 KiB/s, ETA 3s...\n"+
+		"uploading 1 KiB of 4 KiB, stalled...\n"+
+		"uploading 4 KiB of 4 KiB, 307 B/s, ETA 0s...\n"+
+		"uploading 4 KiB of 4 KiB, 307 B/s, ETA 0s done\n", output.String(), "output")
+
+	/* summaries are not reported without progress */
+	summary = startUploadSummary(nil, 4096, clock)
+	assertEquals(t, true, summary == nil, "summary")
+	summary.advance(1024)
+	summary.stop()
+}
+
+func TestB2StoreFileUploadSummary(t *testing.T) {
+	const contentLength = 3*multipart_upload_min_part_size + 1024
+	data := conformanceData(contentLength, 1)
+	mockURI, _ := url.ParseRequestURI("b2://test-bucket/valid/new/multipart/key")
+
+	for _, bufferedParts := range []int64{0, 2} {
+		// Setup Test
+		var output bytes.Buffer
+		cfg := new(Config)
+		cfg.S3.PartSizeBytes = multipart_upload_min_part_size
+		cfg.S3.MaxBufferedParts = bufferedParts
+		mockB2, _ := setupStubB2Backend(cfg)
+		mockB2.pr = NewPlainProgressReporter(&output)
+
+		// Perform the test
+		err := mockB2.StoreFile(context.Background(), StoreRequest{URI: mockURI, BodyAt: bytes.NewReader(data), Length: contentLength})
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		lines := strings.Split(strings.TrimSpace(output.String()), "\n")
+		assertEquals(t, "uploading 0 B of 15 MiB...", lines[0], "lines[0]")
+		assertEquals(t, true, strings.HasPrefix(lines[len(lines)-1], "uploading 15 MiB of 15 MiB"), "lines[-1]")
+		assertEquals(t, true, strings.HasSuffix(lines[len(lines)-1], " done"), "lines[-1]")
+	}
+}
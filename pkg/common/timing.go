@@ -0,0 +1,79 @@
+package common
+
+import (
+	"fmt"
+	"time"
+)
+
+type (
+	// StageTimings holds how long the stages of a backup took. Stages that did not run
+	// are zero.
+	StageTimings struct {
+		Archive time.Duration
+		Encrypt time.Duration
+		Upload  time.Duration
+		Cleanup time.Duration
+		Total   time.Duration
+	}
+
+	// stageTimer measures consecutive stages of a backup. It relies on the monotonic clock
+	// reading of time.Now, so changes of the wall clock do not affect the durations.
+	stageTimer struct {
+		timings    *StageTimings
+		start      time.Time
+		stageStart time.Time
+		stage      *time.Duration
+	}
+)
+
+// StageClock returns the current time for measuring backup stages, can be overridden to pin
+// the clock. Unlike Now, it must keep the monotonic clock reading of time.Now.
+var StageClock func() time.Time = time.Now
+
+// String formats the timings as a single line, e.g. 'archive=3m12s encrypt=48s upload=7m05s
+// cleanup=2s total=11m07s'.
+func (st StageTimings) String() string {
+	return fmt.Sprintf("archive=%s encrypt=%s upload=%s cleanup=%s total=%s",
+		formatStageDuration(st.Archive), formatStageDuration(st.Encrypt), formatStageDuration(st.Upload),
+		formatStageDuration(st.Cleanup), formatStageDuration(st.Total))
+}
+
+// formatStageDuration formats `d` rounded to seconds with zero-padded minutes and seconds.
+func formatStageDuration(d time.Duration) string {
+	seconds := int64(d.Round(time.Second) / time.Second)
+	if seconds >= 3600 {
+		return fmt.Sprintf("%dh%02dm%02ds", seconds/3600, seconds/60%60, seconds%60)
+	} else if seconds >= 60 {
+		return fmt.Sprintf("%dm%02ds", seconds/60, seconds%60)
+	}
+	return fmt.Sprintf("%ds", seconds)
+}
+
+// newStageTimer starts measuring the total duration recorded in `timings`.
+func newStageTimer(timings *StageTimings) *stageTimer {
+	now := StageClock()
+	return &stageTimer{timings: timings, start: now, stageStart: now}
+}
+
+// begin ends the current stage and starts measuring the stage recorded in `stage`.
+func (timer *stageTimer) begin(stage *time.Duration) {
+	now := StageClock()
+	timer.end(now)
+	timer.stage = stage
+	timer.stageStart = now
+}
+
+// stop ends the current stage and records the total duration.
+func (timer *stageTimer) stop() {
+	now := StageClock()
+	timer.end(now)
+	timer.stage = nil
+	timer.timings.Total = now.Sub(timer.start)
+}
+
+// end adds the time spent in the current stage until `now` to its duration.
+func (timer *stageTimer) end(now time.Time) {
+	if timer.stage != nil {
+		*timer.stage += now.Sub(timer.stageStart)
+	}
+}
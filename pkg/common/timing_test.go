@@ -0,0 +1,81 @@
+package common
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// helper function: make StageClock advance by `step` on every call.
+func steppingStageClock(t *testing.T, step time.Duration) {
+	now := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	StageClock = func() time.Time {
+		now = now.Add(step)
+		return now
+	}
+	t.Cleanup(func() { StageClock = time.Now })
+}
+
+/* test cases for StageTimings */
+func TestStageTimingsString(t *testing.T) {
+	timings := StageTimings{
+		Archive: 3*time.Minute + 12*time.Second,
+		Encrypt: 48*time.Second + 400*time.Millisecond,
+		Upload:  7*time.Minute + 5*time.Second,
+		Cleanup: 1500 * time.Millisecond,
+		Total:   time.Hour + 11*time.Minute + 7*time.Second,
+	}
+	assertEquals(t, "archive=3m12s encrypt=48s upload=7m05s cleanup=2s total=1h11m07s", timings.String(), "timings.String")
+	assertEquals(t, "archive=0s encrypt=0s upload=0s cleanup=0s total=0s", StageTimings{}.String(), "StageTimings{}.String")
+}
+
+/* test cases for stageTimer */
+func TestStageTimer(t *testing.T) {
+	// Setup Test
+	steppingStageClock(t, time.Second)
+	var timings StageTimings
+
+	// Perform the test
+	timer := newStageTimer(&timings)
+	timer.begin(&timings.Archive)
+	timer.begin(&timings.Upload)
+	timer.begin(&timings.Archive)
+	timer.stop()
+
+	assertEquals(t, 2*time.Second, timings.Archive, "timings.Archive")
+	assertEquals(t, time.Duration(0), timings.Encrypt, "timings.Encrypt")
+	assertEquals(t, time.Second, timings.Upload, "timings.Upload")
+	assertEquals(t, 4*time.Second, timings.Total, "timings.Total")
+}
+
+func TestBackupTimings(t *testing.T) {
+	// Setup Test
+	cfg := setupBackupConfig(t)
+	cfg.Backup.Hours = 24
+	srcDir := setupBackupSource(t)
+	prefixUri, _ := url.ParseRequestURI("memory://bucket/prefix/")
+	steppingStageClock(t, time.Minute)
+
+	// Perform the test
+	result, err := Backup(context.Background(), BackupOptions{
+		Source:      srcDir,
+		Destination: prefixUri,
+		Config:      cfg,
+		Backend:     NewMemoryBackend(),
+		Time:        time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "archive=1m00s encrypt=1m00s upload=1m00s cleanup=1m00s total=5m00s", result.Timings.String(), "result.Timings")
+
+	/* stages that did not run are zero */
+	result, _ = Backup(context.Background(), BackupOptions{
+		Source:      srcDir,
+		Destination: prefixUri,
+		Config:      cfg,
+		DryRun:      true,
+	})
+	assertEquals(t, "archive=1m00s encrypt=1m00s upload=0s cleanup=0s total=3m00s", result.Timings.String(), "result.Timings")
+}
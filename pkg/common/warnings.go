@@ -0,0 +1,119 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type (
+	// Warning describes a non-fatal issue of a run.
+	Warning struct {
+		// one of the Warning* constants
+		Code string `json:"code"`
+		// file, object or prefix the warning is about, empty if not applicable
+		Subject string `json:"subject,omitempty"`
+		Message string `json:"message"`
+	}
+
+	// Warnings collects the warnings of a run in the order they were reported, it is safe for
+	// concurrent use. Methods of a nil *Warnings do nothing, so warnings may be reported
+	// whether or not the caller collects them, see Config.Internal.Warnings.
+	Warnings struct {
+		lock     sync.Mutex
+		warnings []Warning
+	}
+)
+
+const (
+	// codes of warnings collected by Warnings
+	WarningSkippedFile   = "skipped_file"
+	WarningCleanup       = "cleanup"
+	WarningSizeAnomaly   = "size_anomaly"
+	WarningPermissions   = "permissions"
+	WarningListing       = "listing"
+	WarningEncryption    = "encryption"
+	WarningMirror        = "mirror"
+	WarningKeepLocal     = "keep_local"
+	WarningCatalog       = "catalog"
+	WarningChunkIndex    = "chunk_index"
+	WarningConfiguration = "configuration"
+	WarningSnapshot      = "snapshot"
+	WarningLease         = "lease"
+)
+
+func (warning Warning) String() string {
+	return warning.Message
+}
+
+// Add collects the warning `message` about `subject`.
+func (w *Warnings) Add(code, subject, message string) {
+	if w == nil {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.warnings = append(w.warnings, Warning{Code: code, Subject: subject, Message: message})
+}
+
+// Report writes the warning `message` to `stderr` and collects it.
+func (w *Warnings) Report(stderr io.Writer, code, subject, message string) {
+	fmt.Fprintf(stderr, "warning: %s\n", message)
+	w.Add(code, subject, message)
+}
+
+// List returns the collected warnings in the order they were reported.
+func (w *Warnings) List() []Warning {
+	if w == nil {
+		return nil
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return append([]Warning(nil), w.warnings...)
+}
+
+// Len returns the number of collected warnings.
+func (w *Warnings) Len() int {
+	if w == nil {
+		return 0
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return len(w.warnings)
+}
+
+// CountWarnings returns the number of `warnings` by code.
+func CountWarnings(warnings []Warning) map[string]int {
+	if len(warnings) == 0 {
+		return nil
+	}
+	counts := map[string]int{}
+	for _, warning := range warnings {
+		counts[warning.Code]++
+	}
+	return counts
+}
+
+// WarningsSummary describes the number of `warnings` by code on a single line, e.g.
+// "3 warnings (cleanup: 1, skipped_file: 2)". Empty if there are none.
+func WarningsSummary(warnings []Warning) string {
+	counts := CountWarnings(warnings)
+	if len(counts) == 0 {
+		return ""
+	}
+	codes := make([]string, 0, len(counts))
+	for code := range counts {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for index, code := range codes {
+		codes[index] = fmt.Sprintf("%s: %d", code, counts[code])
+	}
+	noun := "warnings"
+	if len(warnings) == 1 {
+		noun = "warning"
+	}
+	return fmt.Sprintf("%d %s (%s)", len(warnings), noun, strings.Join(codes, ", "))
+}
@@ -0,0 +1,67 @@
+package common
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+/* test cases for Warnings */
+func TestWarnings(t *testing.T) {
+	// Setup Test
+	var stderr bytes.Buffer
+	warnings := new(Warnings)
+
+	// Perform the test
+	warnings.Add(WarningSkippedFile, "/data/a", "skipped unreadable /data/a")
+	warnings.Report(&stderr, WarningCleanup, "b2://bucket/prefix/", "failed to clean up backup prefix")
+	warnings.Add(WarningSkippedFile, "/data/b", "skipped unreadable /data/b")
+
+	/* warnings are listed in the order they were reported, only reported ones are printed */
+	assertEquals(t, 3, warnings.Len(), "warnings.Len")
+	list := warnings.List()
+	assertEquals(t, Warning{WarningSkippedFile, "/data/a", "skipped unreadable /data/a"}, list[0], "list[0]")
+	assertEquals(t, Warning{WarningCleanup, "b2://bucket/prefix/", "failed to clean up backup prefix"}, list[1], "list[1]")
+	assertEquals(t, Warning{WarningSkippedFile, "/data/b", "skipped unreadable /data/b"}, list[2], "list[2]")
+	assertEquals(t, "warning: failed to clean up backup prefix\n", stderr.String(), "stderr")
+
+	/* warnings may be reported concurrently */
+	var wait sync.WaitGroup
+	for index := 0; index < 10; index++ {
+		wait.Add(1)
+		go func(index int) {
+			defer wait.Done()
+			warnings.Add(WarningMirror, "", fmt.Sprintf("mirror %d", index))
+		}(index)
+	}
+	wait.Wait()
+	assertEquals(t, 13, warnings.Len(), "warnings.Len")
+
+	/* a nil collector only prints reported warnings */
+	var none *Warnings
+	stderr.Reset()
+	none.Add(WarningCleanup, "", "ignored")
+	none.Report(&stderr, WarningCleanup, "", "printed")
+	assertEquals(t, 0, none.Len(), "none.Len")
+	assertEquals(t, 0, len(none.List()), "none.List")
+	assertEquals(t, "warning: printed\n", stderr.String(), "stderr")
+}
+
+func TestWarningsSummary(t *testing.T) {
+	// Perform the test
+	assertEquals(t, "", WarningsSummary(nil), "WarningsSummary")
+	assertEquals(t, 0, len(CountWarnings(nil)), "CountWarnings")
+
+	warnings := []Warning{
+		{Code: WarningSkippedFile, Message: "a"},
+		{Code: WarningCleanup, Message: "b"},
+		{Code: WarningSkippedFile, Message: "c"},
+	}
+	counts := CountWarnings(warnings)
+	assertEquals(t, 2, len(counts), "len(counts)")
+	assertEquals(t, 2, counts[WarningSkippedFile], "counts[WarningSkippedFile]")
+	assertEquals(t, 1, counts[WarningCleanup], "counts[WarningCleanup]")
+	assertEquals(t, "3 warnings (cleanup: 1, skipped_file: 2)", WarningsSummary(warnings), "WarningsSummary")
+	assertEquals(t, "1 warning (skipped_file: 1)", WarningsSummary(warnings[:1]), "WarningsSummary")
+}
@@ -0,0 +1,330 @@
+package common
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mholt/archiver/v4"
+)
+
+type (
+	// XattrError reports an extended attribute that could not be restored.
+	XattrError struct {
+		Name string
+		Err  error
+	}
+
+	// xattrFileInfo adds PAX records holding extended attributes to the TAR header of a file.
+	// archive/tar populates the header from the one returned by Sys().
+	xattrFileInfo struct {
+		fs.FileInfo
+		header *tar.Header
+	}
+
+	// aclEntry is an entry of a POSIX ACL.
+	aclEntry struct {
+		tag  uint16
+		perm uint16
+		id   uint32
+	}
+)
+
+const (
+	// prefix of PAX records holding extended attributes, as written by GNU tar and star
+	paxXattrPrefix = "SCHILY.xattr."
+	// PAX records holding POSIX access and default ACLs in their text form
+	paxACLAccess  = "SCHILY.acl.access"
+	paxACLDefault = "SCHILY.acl.default"
+
+	// extended attributes holding POSIX ACLs in their binary form on Linux
+	xattrACLAccess  = "system.posix_acl_access"
+	xattrACLDefault = "system.posix_acl_default"
+
+	// binary ACLs start with the version and hold entries of a tag, permissions and an ID
+	aclVersion     = 2
+	aclEntrySize   = 8
+	aclUndefinedID = 0xffffffff
+	aclUserObj     = 0x01
+	aclUser        = 0x02
+	aclGroupObj    = 0x04
+	aclGroup       = 0x08
+	aclMask        = 0x10
+	aclOther       = 0x20
+)
+
+var (
+	// paxACLRecords maps extended attributes holding ACLs to the PAX records of their text
+	// form.
+	paxACLRecords = map[string]string{
+		xattrACLAccess:  paxACLAccess,
+		xattrACLDefault: paxACLDefault,
+	}
+
+	// aclTagNames are the names of ACL tags in the text form, abbreviations are accepted as
+	// well.
+	aclTagNames = map[uint16]string{
+		aclUserObj:  "user",
+		aclUser:     "user",
+		aclGroupObj: "group",
+		aclGroup:    "group",
+		aclMask:     "mask",
+		aclOther:    "other",
+	}
+)
+
+func (e *XattrError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Name, e.Err.Error())
+}
+
+func (e *XattrError) Unwrap() error {
+	return e.Err
+}
+
+// Sys returns the header holding the PAX records.
+func (xfi *xattrFileInfo) Sys() any {
+	return xfi.header
+}
+
+// Uname returns the user name of the header.
+func (xfi *xattrFileInfo) Uname() (string, error) {
+	return xfi.header.Uname, nil
+}
+
+// Gname returns the group name of the header.
+func (xfi *xattrFileInfo) Gname() (string, error) {
+	return xfi.header.Gname, nil
+}
+
+// attachXattrs records extended attributes and POSIX ACLs of the directories, regular files
+// and symbolic links of `files`, found below `dirPath`, as PAX records of their TAR headers.
+// Attributes that cannot be read, e.g. on file systems without support for them, are
+// reported to `warn` if set and do not fail the archive.
+func attachXattrs(files []archiver.File, dirPath, rootInArchive string, warn func(message string)) error {
+	if warn == nil {
+		warn = func(string) {}
+	}
+	if !xattrsSupported {
+		warn(fmt.Sprintf("extended attributes are not supported on %s", runtime.GOOS))
+		return nil
+	}
+
+	for index := range files {
+		file := &files[index]
+		mode := file.Mode()
+		if !mode.IsRegular() && !mode.IsDir() && mode&fs.ModeSymlink == 0 {
+			continue
+		}
+		relative := strings.TrimPrefix(strings.TrimPrefix(file.NameInArchive, rootInArchive), "/")
+		diskPath := filepath.Join(dirPath, filepath.FromSlash(relative))
+		records, err := xattrRecords(diskPath)
+		if err != nil {
+			warn(fmt.Sprintf("could not read extended attributes of %q: %s", diskPath, err.Error()))
+			continue
+		}
+		if len(records) == 0 {
+			continue
+		}
+		header, err := tar.FileInfoHeader(file.FileInfo, file.LinkTarget)
+		if err != nil {
+			return fmt.Errorf("could not create header of archive entry %q: %s", file.NameInArchive, err.Error())
+		}
+		header.PAXRecords = records
+		file.FileInfo = &xattrFileInfo{file.FileInfo, header}
+	}
+	return nil
+}
+
+// xattrRecords returns the extended attributes of `diskPath` as PAX records, ACLs are
+// recorded in their text form.
+func xattrRecords(diskPath string) (map[string]string, error) {
+	attributes, err := listXattrs(diskPath)
+	if err != nil || len(attributes) == 0 {
+		return nil, err
+	}
+	records := make(map[string]string, len(attributes))
+	for name, value := range attributes {
+		if record, isACL := paxACLRecords[name]; isACL {
+			text, err := aclToText(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", name, err.Error())
+			}
+			records[record] = text
+		} else {
+			records[paxXattrPrefix+name] = string(value)
+		}
+	}
+	return records, nil
+}
+
+// RestoreXattrs sets the extended attributes and POSIX ACLs held by the PAX records `records`
+// of a TAR header on `target`, symbolic links are not followed. Returns an XattrError for
+// every attribute that could not be set, e.g. without the privileges to set it.
+func RestoreXattrs(target string, records map[string]string) []error {
+	keys := make([]string, 0, len(records))
+	for key := range records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var errs []error
+	for _, key := range keys {
+		var name string
+		var value []byte
+		switch {
+		case key == paxACLAccess || key == paxACLDefault:
+			name = xattrACLAccess
+			if key == paxACLDefault {
+				name = xattrACLDefault
+			}
+			var err error
+			if value, err = aclFromText(records[key]); err != nil {
+				errs = append(errs, &XattrError{name, err})
+				continue
+			}
+		case strings.HasPrefix(key, paxXattrPrefix):
+			name, value = strings.TrimPrefix(key, paxXattrPrefix), []byte(records[key])
+		default:
+			continue
+		}
+		if err := setXattr(target, name, value); err != nil {
+			errs = append(errs, &XattrError{name, err})
+		}
+	}
+	return errs
+}
+
+// aclToText converts a POSIX ACL from its binary form to its text form with numeric IDs,
+// e.g. 'user::rw-,user:1000:r--,group::r--,mask::r--,other::---'.
+func aclToText(value []byte) (string, error) {
+	if len(value) < 4 || (len(value)-4)%aclEntrySize != 0 || binary.LittleEndian.Uint32(value) != aclVersion {
+		return "", fmt.Errorf("invalid ACL")
+	}
+	var entries []string
+	for offset := 4; offset < len(value); offset += aclEntrySize {
+		entry := aclEntry{
+			tag:  binary.LittleEndian.Uint16(value[offset:]),
+			perm: binary.LittleEndian.Uint16(value[offset+2:]),
+			id:   binary.LittleEndian.Uint32(value[offset+4:]),
+		}
+		name, ok := aclTagNames[entry.tag]
+		if !ok {
+			return "", fmt.Errorf("invalid ACL tag %#x", entry.tag)
+		}
+		var qualifier string
+		if entry.tag == aclUser || entry.tag == aclGroup {
+			qualifier = strconv.FormatUint(uint64(entry.id), 10)
+		}
+		perm := []byte("---")
+		for bit, char := range "rwx" {
+			if entry.perm&(4>>bit) != 0 {
+				perm[bit] = byte(char)
+			}
+		}
+		entries = append(entries, name+":"+qualifier+":"+string(perm))
+	}
+	return strings.Join(entries, ","), nil
+}
+
+// aclFromText converts a POSIX ACL from its text form to its binary form. Tags may be
+// abbreviated, users and groups are given by ID or by name, and a trailing ID field as
+// written by star takes precedence over names.
+func aclFromText(text string) ([]byte, error) {
+	var entries []aclEntry
+	for _, field := range strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == '\n' }) {
+		parts := strings.Split(strings.TrimSpace(field), ":")
+		if len(parts) < 3 || len(parts) > 4 {
+			return nil, fmt.Errorf("invalid ACL entry %q", field)
+		}
+		entry := aclEntry{id: aclUndefinedID}
+		named := len(parts[1]) > 0
+		switch parts[0] {
+		case "user", "u":
+			entry.tag = aclUserObj
+			if named {
+				entry.tag = aclUser
+			}
+		case "group", "g":
+			entry.tag = aclGroupObj
+			if named {
+				entry.tag = aclGroup
+			}
+		case "mask", "m":
+			entry.tag = aclMask
+		case "other", "o":
+			entry.tag = aclOther
+		default:
+			return nil, fmt.Errorf("invalid ACL entry %q", field)
+		}
+		if named {
+			qualifier := parts[1]
+			if len(parts) == 4 {
+				qualifier = parts[3]
+			}
+			id, err := aclQualifierID(qualifier, entry.tag == aclGroup)
+			if err != nil {
+				return nil, fmt.Errorf("invalid ACL entry %q: %s", field, err.Error())
+			}
+			entry.id = id
+		}
+		for _, char := range parts[2] {
+			switch char {
+			case 'r':
+				entry.perm |= 4
+			case 'w':
+				entry.perm |= 2
+			case 'x':
+				entry.perm |= 1
+			case '-':
+			default:
+				return nil, fmt.Errorf("invalid ACL entry %q", field)
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	// the kernel expects entries ordered by tag and ID
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].tag != entries[j].tag {
+			return entries[i].tag < entries[j].tag
+		}
+		return entries[i].id < entries[j].id
+	})
+	value := binary.LittleEndian.AppendUint32(nil, aclVersion)
+	for _, entry := range entries {
+		value = binary.LittleEndian.AppendUint16(value, entry.tag)
+		value = binary.LittleEndian.AppendUint16(value, entry.perm)
+		value = binary.LittleEndian.AppendUint32(value, entry.id)
+	}
+	return value, nil
+}
+
+// aclQualifierID returns the ID of the user or group `qualifier`, given by ID or by name.
+func aclQualifierID(qualifier string, group bool) (uint32, error) {
+	if id, err := strconv.ParseUint(qualifier, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+	var id string
+	if group {
+		g, err := user.LookupGroup(qualifier)
+		if err != nil {
+			return 0, err
+		}
+		id = g.Gid
+	} else {
+		u, err := user.Lookup(qualifier)
+		if err != nil {
+			return 0, err
+		}
+		id = u.Uid
+	}
+	value, err := strconv.ParseUint(id, 10, 32)
+	return uint32(value), err
+}
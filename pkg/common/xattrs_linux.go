@@ -0,0 +1,58 @@
+//go:build linux
+
+package common
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// xattrsSupported is true if extended attributes can be recorded on this platform.
+const xattrsSupported = true
+
+// listXattrs returns the extended attributes of `path`, symbolic links are not followed.
+func listXattrs(path string) (map[string][]byte, error) {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size == 0 {
+		return nil, err
+	}
+	names := make([]byte, size)
+	if size, err = unix.Llistxattr(path, names); err != nil {
+		return nil, err
+	}
+
+	attributes := make(map[string][]byte)
+	for _, name := range strings.Split(string(names[:size]), "\x00") {
+		if len(name) == 0 {
+			continue
+		}
+		value, err := getXattr(path, name)
+		if errors.Is(err, unix.ENODATA) {
+			// removed since it was listed
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err.Error())
+		}
+		attributes[name] = value
+	}
+	return attributes, nil
+}
+
+// getXattr returns the value of the extended attribute `name` of `path`.
+func getXattr(path, name string) ([]byte, error) {
+	size, err := unix.Lgetxattr(path, name, nil)
+	if err != nil || size == 0 {
+		return []byte{}, err
+	}
+	value := make([]byte, size)
+	size, err = unix.Lgetxattr(path, name, value)
+	return value[:size], err
+}
+
+// setXattr sets the extended attribute `name` of `path`, symbolic links are not followed.
+func setXattr(path, name string, value []byte) error {
+	return unix.Lsetxattr(path, name, value, 0)
+}
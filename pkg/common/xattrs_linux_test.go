@@ -0,0 +1,162 @@
+//go:build linux
+
+package common
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// helper function: set the extended attribute `name` of `path`, skips the test if the file
+// system or the privileges of the test do not allow it.
+func setXattrOrSkip(t *testing.T, path, name string, value []byte) {
+	if err := unix.Lsetxattr(path, name, value, 0); err != nil {
+		t.Skipf("could not set extended attribute %q: %s", name, err.Error())
+	}
+}
+
+// helper function: return a temporary directory on tmpfs if available.
+func xattrTempDir(t *testing.T) string {
+	dirPath, err := os.MkdirTemp("/dev/shm", "squirrelup-xattrs-")
+	if err != nil {
+		return t.TempDir()
+	}
+	t.Cleanup(func() { os.RemoveAll(dirPath) })
+	return dirPath
+}
+
+// helper function: read the headers of a gzip-compressed TAR archive by entry name.
+func readArchiveHeaders(t *testing.T, archivePath string) map[string]*tar.Header {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		t.Fatalf("could not open archive: %s", err.Error())
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("could not read archive: %s", err.Error())
+	}
+	headers := map[string]*tar.Header{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return headers
+		} else if err != nil {
+			t.Fatalf("could not read archive: %s", err.Error())
+		}
+		headers[hdr.Name] = hdr
+	}
+}
+
+/* test cases for archiving and restoring extended attributes */
+func TestArchiveDirectoryXattrs(t *testing.T) {
+	// Setup Test
+	srcDir := filepath.Join(xattrTempDir(t), "data")
+	if err := os.MkdirAll(filepath.Join(srcDir, "sub"), 0750); err != nil {
+		t.Fatalf("could not create directory: %s", err.Error())
+	}
+	filePath := filepath.Join(srcDir, "sub", "file")
+	if err := os.WriteFile(filePath, []byte("content"), 0640); err != nil {
+		t.Fatalf("could not write to temporary file: %s", err.Error())
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, "plain"), []byte("plain"), 0600); err != nil {
+		t.Fatalf("could not write to temporary file: %s", err.Error())
+	}
+	acl, _ := aclFromText("user::rw-,user:1234:r--,group::r--,mask::r--,other::---")
+	setXattrOrSkip(t, filePath, "user.squirrelup.label", []byte("blue\x00binary"))
+	setXattrOrSkip(t, filePath, xattrACLAccess, acl)
+	defaultACL, _ := aclFromText("user::rwx,group::r-x,group:4321:rwx,mask::rwx,other::---")
+	setXattrOrSkip(t, filepath.Join(srcDir, "sub"), xattrACLDefault, defaultACL)
+	cfg := setupBackupConfig(t)
+	cfg.Backup.Xattrs = true
+	var warnings []string
+	filter := ArchiveFilter{Warn: func(message string) { warnings = append(warnings, message) }}
+
+	// Perform the test
+	archivePath, _, err := ArchiveDirectory(context.Background(), srcDir, cfg, filter)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	defer os.Remove(archivePath)
+
+	/* extended attributes and ACLs are recorded as PAX records */
+	headers := readArchiveHeaders(t, archivePath)
+	records := headers["data/sub/file"].PAXRecords
+	assertEquals(t, "blue\x00binary", records[paxXattrPrefix+"user.squirrelup.label"], "PAXRecords")
+	assertEquals(t, "user::rw-,user:1234:r--,group::r--,mask::r--,other::---", records[paxACLAccess], "PAXRecords")
+	assertEquals(t, "user::rwx,group::r-x,group:4321:rwx,mask::rwx,other::---", headers["data/sub"].PAXRecords[paxACLDefault], "PAXRecords")
+	assertEquals(t, 0, len(headers["data/plain"].PAXRecords), "len(PAXRecords)")
+	assertEquals(t, 0, len(warnings), "len(warnings)")
+
+	/* and not without backup.xattrs */
+	cfg.Backup.Xattrs = false
+	plainPath, _, err := ArchiveDirectory(context.Background(), srcDir, cfg, filter)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	defer os.Remove(plainPath)
+	assertEquals(t, 0, len(readArchiveHeaders(t, plainPath)["data/sub/file"].PAXRecords), "len(PAXRecords)")
+
+	/* the records are restored */
+	target := filepath.Join(xattrTempDir(t), "file")
+	if err = os.WriteFile(target, nil, 0640); err != nil {
+		t.Fatalf("could not write to temporary file: %s", err.Error())
+	}
+	assertEquals(t, 0, len(RestoreXattrs(target, records)), "len(errs)")
+	value, err := getXattr(target, "user.squirrelup.label")
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "blue\x00binary", string(value), "label")
+	value, err = getXattr(target, xattrACLAccess)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	text, _ := aclToText(value)
+	assertEquals(t, "user::rw-,user:1234:r--,group::r--,mask::r--,other::---", text, "acl")
+
+	/* attributes that cannot be set are reported */
+	errs := RestoreXattrs(target, map[string]string{paxXattrPrefix + "bogus.name": "value", paxACLDefault: "user::rwx,group::r-x,other::---", "comment": "ignored"})
+	assertEquals(t, 2, len(errs), "len(errs)")
+	var xattrErr *XattrError
+	assertEquals(t, true, errors.As(errs[0], &xattrErr), "errors.As")
+	assertEquals(t, xattrACLDefault, xattrErr.Name, "Name")
+	assertEquals(t, true, strings.HasPrefix(errs[1].Error(), "bogus.name: "), "Error")
+}
+
+func TestAttachXattrsUnreadable(t *testing.T) {
+	// Setup Test
+	srcDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcDir, "file"), []byte("content"), 0600); err != nil {
+		t.Fatalf("could not write to temporary file: %s", err.Error())
+	}
+	files, _, err := sourceFiles(srcDir, "data", nil)
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	// entries that cannot be read fail listing their attributes
+	files[1].NameInArchive = "data/missing"
+	var warnings []string
+
+	// Perform the test
+	err = attachXattrs(files, srcDir, "data", func(message string) { warnings = append(warnings, message) })
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, 1, len(warnings), "len(warnings)")
+	assertEquals(t, true, strings.HasPrefix(warnings[0], "could not read extended attributes of \""+filepath.Join(srcDir, "missing")+"\": "), "warning")
+	_, isXattrFileInfo := files[1].FileInfo.(*xattrFileInfo)
+	assertEquals(t, false, isXattrFileInfo, "xattrFileInfo")
+	assertEquals(t, fs.FileMode(0600), files[1].Mode(), "Mode")
+}
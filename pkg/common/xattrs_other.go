@@ -0,0 +1,21 @@
+//go:build !linux
+
+package common
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// xattrsSupported is true if extended attributes can be recorded on this platform.
+const xattrsSupported = false
+
+// listXattrs fails, extended attributes are not supported on this platform.
+func listXattrs(path string) (map[string][]byte, error) {
+	return nil, fmt.Errorf("extended attributes are not supported on %s", runtime.GOOS)
+}
+
+// setXattr fails, extended attributes are not supported on this platform.
+func setXattr(path, name string, value []byte) error {
+	return fmt.Errorf("extended attributes are not supported on %s", runtime.GOOS)
+}
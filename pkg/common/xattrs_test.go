@@ -0,0 +1,63 @@
+package common
+
+import (
+	"archive/tar"
+	"testing"
+	"time"
+)
+
+/* test cases for aclToText and aclFromText */
+func TestACLText(t *testing.T) {
+	/* ACLs survive the conversion to their binary form and back, entries are ordered */
+	for text, expected := range map[string]string{
+		"user::rw-,group::r--,other::---":                                            "user::rw-,group::r--,other::---",
+		"user::rwx,user:1000:r-x,group::r-x,mask::r-x,other::r--":                    "user::rwx,user:1000:r-x,group::r-x,mask::r-x,other::r--",
+		"u::rw-,g::r--,g:42:rw-,u:7:--x,m::rw-,o::r--":                               "user::rw-,user:7:--x,group::r--,group:42:rw-,mask::rw-,other::r--",
+		"user::rw-,user:someone:r--:1234,group::r--,mask::r--,other::r--":            "user::rw-,user:1234:r--,group::r--,mask::r--,other::r--",
+		"user::rw-\nuser:1001:rw-\nuser:1000:r--\ngroup::---\nmask::rw-\nother::---": "user::rw-,user:1000:r--,user:1001:rw-,group::---,mask::rw-,other::---",
+	} {
+		value, err := aclFromText(text)
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		actual, err := aclToText(value)
+		if err != nil {
+			t.Fatalf("unexpected test result: %+v", err)
+		}
+		assertEquals(t, expected, actual, "aclToText")
+	}
+
+	/* malformed ACLs are rejected */
+	for _, text := range []string{"user:rw-", "world::rwx", "user::rwz", "user:no-such-user-squirrelup:r--"} {
+		if _, err := aclFromText(text); err == nil {
+			t.Fatalf("aclFromText(%q) was supposed to fail", text)
+		}
+	}
+	for _, value := range [][]byte{{}, {1, 0, 0, 0}, {2, 0, 0, 0, 1}, {2, 0, 0, 0, 0x40, 0, 0, 0, 0, 0, 0, 0}} {
+		if _, err := aclToText(value); err == nil {
+			t.Fatalf("aclToText(%v) was supposed to fail", value)
+		}
+	}
+}
+
+/* test cases for xattrFileInfo */
+func TestXattrFileInfoHeader(t *testing.T) {
+	// Setup Test
+	modTime := time.Date(2024, 5, 1, 3, 0, 0, 0, time.UTC)
+	original := &tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0640, Uid: 1000, Gid: 100, Uname: "someone", Gname: "users", ModTime: modTime}
+	header := &tar.Header{Uid: 1000, Gid: 100, Uname: "someone", Gname: "users", PAXRecords: map[string]string{
+		paxXattrPrefix + "user.label": "blue",
+		paxACLAccess:                  "user::rw-,group::r--,other::---",
+	}}
+
+	/* headers derived from the file info hold the PAX records and ownership */
+	derived, err := tar.FileInfoHeader(&xattrFileInfo{original.FileInfo(), header}, "")
+	if err != nil {
+		t.Fatalf("unexpected test result: %+v", err)
+	}
+	assertEquals(t, "blue", derived.PAXRecords[paxXattrPrefix+"user.label"], "PAXRecords")
+	assertEquals(t, "user::rw-,group::r--,other::---", derived.PAXRecords[paxACLAccess], "PAXRecords")
+	assertEquals(t, 1000, derived.Uid, "Uid")
+	assertEquals(t, "users", derived.Gname, "Gname")
+	assertEquals(t, int64(0640), derived.Mode, "Mode")
+}